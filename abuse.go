@@ -0,0 +1,169 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// AbuseOptions configure the throttling and banning of clients that make
+// malformed or refused calls, such as scanners and misconfigured automounters.
+//
+// A strike is recorded against a client address for each call that can't be
+// parsed, names an unknown program or procedure, is refused for its
+// credentials, presents an invalid file handle or arguments, or is a refused
+// mount. Ordinary failures, such as looking up a missing file, are not
+// counted.
+type AbuseOptions struct {
+	// Window is the period strikes are counted over. Defaults to a minute.
+	Window time.Duration
+	// TarpitAfter is the number of strikes within Window after which
+	// failing replies to the client are delayed by TarpitDelay. Zero disables
+	// tarpitting.
+	TarpitAfter int
+	TarpitDelay time.Duration
+	// BanAfter is the number of strikes within Window after which the
+	// client's connections are closed, and new ones refused, for BanDuration.
+	// Zero disables banning.
+	BanAfter    int
+	BanDuration time.Duration
+}
+
+func (o *AbuseOptions) enabled() bool {
+	return o.TarpitAfter > 0 || o.BanAfter > 0
+}
+
+// abuseTrackerPrune is the number of tracked clients past which expired
+// records are dropped.
+const abuseTrackerPrune = 1024
+
+type abuseRecord struct {
+	windowStart time.Time
+	strikes     int
+	bannedUntil time.Time
+}
+
+// abuseTracker counts strikes per client address. A nil tracker records
+// nothing.
+type abuseTracker struct {
+	AbuseOptions
+	mu      sync.Mutex
+	clients map[string]*abuseRecord
+}
+
+func newAbuseTracker(opts AbuseOptions) *abuseTracker {
+	if !opts.enabled() {
+		return nil
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+	return &abuseTracker{
+		AbuseOptions: opts,
+		clients:      make(map[string]*abuseRecord),
+	}
+}
+
+func clientKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// strike records a strike against addr, and reports the delay to apply to the
+// failing reply and whether the client is now banned.
+func (t *abuseTracker) strike(addr net.Addr) (time.Duration, bool) {
+	if t == nil {
+		return 0, false
+	}
+	key := clientKey(addr)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.clients[key]
+	if !ok {
+		if len(t.clients) >= abuseTrackerPrune {
+			t.prune(now)
+		}
+		r = &abuseRecord{windowStart: now}
+		t.clients[key] = r
+	}
+	if now.Sub(r.windowStart) > t.Window {
+		r.windowStart = now
+		r.strikes = 0
+	}
+	r.strikes++
+
+	if t.BanAfter > 0 && r.strikes >= t.BanAfter {
+		if !now.Before(r.bannedUntil) {
+			Log.Warnf("banning %s for %v after %d strikes", key, t.BanDuration, r.strikes)
+		}
+		r.bannedUntil = now.Add(t.BanDuration)
+		return 0, true
+	}
+	if t.TarpitAfter > 0 && r.strikes >= t.TarpitAfter {
+		return t.TarpitDelay, false
+	}
+	return 0, false
+}
+
+// banned reports whether connections from addr are to be refused.
+func (t *abuseTracker) banned(addr net.Addr) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.clients[clientKey(addr)]
+	return ok && time.Now().Before(r.bannedUntil)
+}
+
+// prune drops the records of clients with no current strikes or ban.
+func (t *abuseTracker) prune(now time.Time) {
+	for k, r := range t.clients {
+		if now.Sub(r.windowStart) > t.Window && !now.Before(r.bannedUntil) {
+			delete(t.clients, k)
+		}
+	}
+}
+
+// isStrike reports whether a call that failed with err counts against the
+// client.
+func isStrike(err error) bool {
+	var nfsErr *NFSStatusError
+	if errors.As(err, &nfsErr) {
+		return nfsErr.NFSStatus == NFSStatusBadHandle || nfsErr.NFSStatus == NFSStatusInval
+	}
+	var rpcErr RPCError
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.Code() {
+		case ResponseCodeProgUnavailable, ResponseCodeProcUnavailable, ResponseCodeGarbageArgs,
+			ResponseCodeRPCMismatch, ResponseCodeAuthError:
+			return true
+		}
+	}
+	return false
+}
+
+// strike records a strike against the client of c, tarpitting the reply when
+// the client is over its threshold. It reports whether the connection should
+// be closed because the client is banned.
+func (c *conn) strike(ctx context.Context) bool {
+	delay, banned := c.Server.abuse.strike(c.Conn.RemoteAddr())
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+	return banned
+}
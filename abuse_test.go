@@ -0,0 +1,55 @@
+package nfs_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestAbusiveClientBanned(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/home", 0755)
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:      helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		AbuseOptions: nfs.AbuseOptions{BanAfter: 3, BanDuration: time.Minute},
+	})
+
+	// ordinary failures don't count against the client.
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	for i := 0; i < 5; i++ {
+		if _, _, err := target.Lookup("/missing", false); err == nil {
+			t.Fatal("expected lookup of a missing file to fail")
+		}
+	}
+	_ = target.Close()
+
+	// closed reports whether the server hangs up on a connection sending data.
+	closed := func(data []byte) bool {
+		c, err := net.Dial("tcp", srv.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(time.Second))
+		_, _ = c.Write(data)
+		_, err = c.Read(make([]byte, 4))
+		return err == io.EOF
+	}
+	for i := 0; i < 3; i++ {
+		// a record fragment which isn't the last isn't supported.
+		if !closed([]byte{0, 0, 0, 40}) {
+			t.Fatal("expected a malformed call to close the connection")
+		}
+	}
+	if !closed(nil) {
+		t.Fatal("expected a banned client to be refused")
+	}
+}
@@ -0,0 +1,195 @@
+package nfs
+
+import (
+	"context"
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// ACCESS3 permission bits, per rfc1813 section 3.3.4
+const (
+	accessRead    = 0x0001
+	accessLookup  = 0x0002
+	accessModify  = 0x0004
+	accessExtend  = 0x0008
+	accessDelete  = 0x0010
+	accessExecute = 0x0020
+)
+
+// inGroup reports whether gid is the primary or a supplementary group of cred.
+func (a *AuthUnix) inGroup(gid uint32) bool {
+	if a.GID == gid {
+		return true
+	}
+	for _, g := range a.GIDs {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// grantedAccess evaluates the mode bits of an object for cred, returning the
+// ACCESS3 bits it is granted. As on a local system, uid 0 is granted
+// everything except execution of files that no one may execute.
+func grantedAccess(cred *AuthUnix, attr *FileAttribute) uint32 {
+	isDir := attr.Type == FileTypeDirectory
+	var bits uint32
+	switch {
+	case cred.UID == 0:
+		bits = 7
+		if !isDir && attr.FileMode&0111 == 0 {
+			bits = 6
+		}
+	case cred.UID == attr.UID:
+		bits = (attr.FileMode >> 6) & 7
+	case cred.inGroup(attr.GID):
+		bits = (attr.FileMode >> 3) & 7
+	default:
+		bits = attr.FileMode & 7
+	}
+
+	var granted uint32
+	if bits&4 != 0 {
+		granted |= accessRead
+	}
+	if bits&2 != 0 {
+		granted |= accessModify | accessExtend
+		if isDir {
+			granted |= accessDelete
+		}
+	}
+	if bits&1 != 0 {
+		if isDir {
+			granted |= accessLookup
+		} else {
+			granted |= accessExecute
+		}
+	}
+	return granted
+}
+
+// permissionCaller provides the identity to check permissions for, when the
+// export asks for permissions to be enforced by the server.
+func permissionCaller(ctx context.Context) (*AuthUnix, bool) {
+	opts := exportOptionsFromContext(ctx)
+	if opts == nil || !opts.CheckPermissions {
+		return nil, false
+	}
+	return CredentialsFromContext(ctx)
+}
+
+// checkAccess fails with NFS3ERR_ACCES unless the caller is granted all of
+// the ACCESS3 bits in want on the object with attr.
+func checkAccess(ctx context.Context, attr *FileAttribute, want uint32) error {
+	cred, ok := permissionCaller(ctx)
+	if !ok || attr == nil {
+		return nil
+	}
+	attr = presentedOwner(ctx, attr)
+	if grantedAccess(cred, attr)&want != want {
+		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+	}
+	return nil
+}
+
+// checkIOAccess checks a READ or WRITE of a file. The owner of a file may
+// always do I/O on it, as a local process with the file open could after a
+// chmod, and a file that may be executed may be read.
+func checkIOAccess(ctx context.Context, attr *FileAttribute, write bool) error {
+	cred, ok := permissionCaller(ctx)
+	attr = presentedOwner(ctx, attr)
+	if !ok || attr == nil || cred.UID == attr.UID {
+		return nil
+	}
+	granted := grantedAccess(cred, attr)
+	if write && granted&accessModify == 0 {
+		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+	}
+	if !write && granted&(accessRead|accessExecute) == 0 {
+		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+	}
+	return nil
+}
+
+// checkOwner fails with NFS3ERR_PERM unless the caller owns the object with
+// attr, or is uid 0.
+func checkOwner(ctx context.Context, attr *FileAttribute) error {
+	cred, ok := permissionCaller(ctx)
+	attr = presentedOwner(ctx, attr)
+	if !ok || attr == nil || cred.UID == 0 || cred.UID == attr.UID {
+		return nil
+	}
+	return &NFSStatusError{NFSStatusPerm, os.ErrPermission}
+}
+
+// checkSetAttr checks that the caller may make the changes of a SETATTR. The
+// size of a file may be changed by anyone who may write to it, but its owner
+// only by uid 0, its group only by uid 0 or by the owner to one of their own
+// groups, and its mode and times only by its owner.
+func checkSetAttr(ctx context.Context, attr *FileAttribute, s *SetFileAttributes) error {
+	cred, ok := permissionCaller(ctx)
+	if !ok || attr == nil {
+		return nil
+	}
+	attr = presentedOwner(ctx, attr)
+	if s.SetSize != nil {
+		if err := checkIOAccess(ctx, attr, true); err != nil {
+			return err
+		}
+	}
+	if s.SetUID != nil && *s.SetUID != attr.UID && cred.UID != 0 {
+		return &NFSStatusError{NFSStatusPerm, os.ErrPermission}
+	}
+	if s.SetGID != nil && *s.SetGID != attr.GID && cred.UID != 0 && (cred.UID != attr.UID || !cred.inGroup(*s.SetGID)) {
+		return &NFSStatusError{NFSStatusPerm, os.ErrPermission}
+	}
+	if s.SetMode != nil || s.SetAtime != nil || s.SetMtime != nil {
+		return checkOwner(ctx, attr)
+	}
+	return nil
+}
+
+// restrictSetgid drops the setgid bit from the mode a SETATTR gives a file
+// whose group the caller isn't in, as chmod does locally for callers other
+// than uid 0.
+func restrictSetgid(ctx context.Context, attr *FileAttribute, s *SetFileAttributes) {
+	cred, ok := permissionCaller(ctx)
+	if !ok || attr == nil || s.SetMode == nil || cred.UID == 0 || attr.Type == FileTypeDirectory {
+		return
+	}
+	gid := attr.GID
+	if s.SetGID != nil {
+		gid = *s.SetGID
+	}
+	if *s.SetMode&unixSetgid != 0 && !cred.inGroup(gid) {
+		mode := *s.SetMode &^ unixSetgid
+		s.SetMode = &mode
+	}
+}
+
+// killPrivileges drops the setuid bit of a file written by a caller other
+// than uid 0, and its setgid bit when its group may execute it, as a local
+// write does, so that a changed program doesn't keep running as its owner.
+// As chownToCaller, it is only done on exports with options, and is best
+// effort.
+func killPrivileges(ctx context.Context, changer billy.Change, path string, attr *FileAttribute) {
+	if changer == nil || exportOptionsFromContext(ctx) == nil {
+		return
+	}
+	if cred, ok := CredentialsFromContext(ctx); !ok || cred.UID == 0 {
+		return
+	}
+	mode := attr.Mode()
+	drop := mode & os.ModeSetuid
+	if mode&os.ModeSetgid != 0 && mode&0010 != 0 {
+		drop |= os.ModeSetgid
+	}
+	if drop == 0 {
+		return
+	}
+	if err := changer.Chmod(path, mode&modeBits&^drop); err != nil {
+		Log.Debugf("unable to drop the setuid bits of %s: %v", path, err)
+	}
+}
@@ -0,0 +1,52 @@
+package nfs_test
+
+import (
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	mem := memfs.New()
+	// memfs objects are owned by 0:0.
+	_ = mem.MkdirAll("/grp/sub", 0750)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{CheckPermissions: true})
+	srv := nfstest.ServeCached(t, handler)
+
+	dial := func(gids uint32) *nfstest.Client {
+		cred := rpc.AuthUnix{Machinename: "client", Uid: 1000, Gid: 100, GidLen: 1, Gids: gids}
+		target := srv.Mount(t, "/", cred.Auth())
+		return target
+	}
+
+	// a supplementary group of 0 grants the group's r-x.
+	member := dial(0)
+	defer member.Close()
+	if _, _, err := member.Lookup("/grp/sub", false); err != nil {
+		t.Fatalf("expected lookup through the group's directory to succeed: %v", err)
+	}
+	if _, err := member.ReadDirPlus("/grp"); err != nil {
+		t.Fatalf("expected the group to list the directory: %v", err)
+	}
+	if _, err := member.Create("/grp/file", 0666); !nfstest.IsStatus(err, nfs.NFSStatusAccess) {
+		t.Fatalf("expected create without write permission to fail, got %v", err)
+	}
+	access, err := member.Access("/grp", 0x3f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access != 0x3 {
+		t.Fatalf("expected ACCESS to grant READ|LOOKUP, got %#x", access)
+	}
+
+	other := dial(5)
+	defer other.Close()
+	if _, _, err := other.Lookup("/grp/sub", false); err == nil {
+		t.Fatal("expected lookup through the directory to be refused to others")
+	}
+}
@@ -0,0 +1,83 @@
+package nfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// AuthUnix is the AUTH_SYS credential a call is made with, per rfc5531
+// appendix A.
+type AuthUnix struct {
+	Stamp       uint32
+	MachineName string
+	UID         uint32
+	GID         uint32
+	GIDs        []uint32
+}
+
+const (
+	authUnixMachineNameMax = 255
+	authUnixGIDsMax        = 16
+)
+
+var errBadAuthUnix = errors.New("malformed AUTH_SYS credential")
+
+// parseAuthUnix decodes the body of an AUTH_SYS credential. The lengths in the
+// body are checked against the limits of the rfc rather than trusted.
+func parseAuthUnix(body []byte) (*AuthUnix, error) {
+	next := func() (uint32, error) {
+		if len(body) < 4 {
+			return 0, errBadAuthUnix
+		}
+		v := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		return v, nil
+	}
+
+	a := &AuthUnix{}
+	var err error
+	if a.Stamp, err = next(); err != nil {
+		return nil, err
+	}
+	nameLen, err := next()
+	if err != nil {
+		return nil, err
+	}
+	padded := (nameLen + 3) &^ 3
+	if nameLen > authUnixMachineNameMax || uint32(len(body)) < padded {
+		return nil, errBadAuthUnix
+	}
+	a.MachineName = string(body[:nameLen])
+	body = body[padded:]
+	if a.UID, err = next(); err != nil {
+		return nil, err
+	}
+	if a.GID, err = next(); err != nil {
+		return nil, err
+	}
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if count > authUnixGIDsMax {
+		return nil, errBadAuthUnix
+	}
+	a.GIDs = make([]uint32, count)
+	for i := range a.GIDs {
+		if a.GIDs[i], err = next(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+type credentialsKey struct{}
+
+// CredentialsFromContext returns the identity a call is made with, after any
+// squashing required by the export's options. It is only available for calls
+// made with AUTH_SYS credentials.
+func CredentialsFromContext(ctx context.Context) (*AuthUnix, bool) {
+	cred, ok := ctx.Value(credentialsKey{}).(*AuthUnix)
+	return cred, ok
+}
@@ -0,0 +1,31 @@
+package nfs_test
+
+import (
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestRPCSECGSSRefused(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/home", 0755)
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	_, err := target.Call(&rpc.Header{
+		Rpcvers: 2,
+		Vers:    nfsc.Nfs3Vers,
+		Prog:    nfsc.Nfs3Prog,
+		Proc:    uint32(nfs.NFSProcedureNull),
+		Cred:    rpc.Auth{Flavor: uint32(nfs.AuthFlavorRPCSECGSS), Body: make([]byte, 20)},
+		Verf:    rpc.AuthNull,
+	})
+	if err == nil {
+		t.Fatal("expected an RPCSEC_GSS call to be refused")
+	}
+}
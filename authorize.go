@@ -0,0 +1,114 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// Operation describes an NFS call about to be dispatched, for a Server's
+// Authorize hook.
+type Operation struct {
+	Procedure NFSProcedure
+	// Conn is the connection the call was made on.
+	Conn net.Conn
+	// Credentials are the identity the call is made as, after squashing, or
+	// nil for calls made without AUTH_SYS credentials.
+	Credentials *AuthUnix
+	// Filesystem is the export the call is made against.
+	Filesystem billy.Filesystem
+	// Path is the object the call acts on. For calls naming an entry of a
+	// directory, such as CREATE or REMOVE, it is the path of that entry.
+	Path []string
+	// To is the new path of a RENAME, or the new name of a LINK.
+	To []string
+}
+
+// AuthorizeFunc decides whether an operation may proceed. Any status other
+// than NFSStatusOk refuses the operation with that status.
+type AuthorizeFunc func(ctx context.Context, op *Operation) NFSStatus
+
+var errNotAuthorized = errors.New("operation not authorized")
+
+// peekOperation resolves the objects a call acts on from its arguments,
+// leaving them in place for the procedure. An operation is returned as soon as
+// the call's file handle resolves; the error reports arguments past the
+// handle that couldn't be read, which the procedure will also fail on.
+func (w *response) peekOperation(h Handler) (*Operation, error) {
+	var op *Operation
+	err := w.peek(func(r io.Reader) error {
+		fh, err := readHandle(r)
+		if err != nil {
+			return err
+		}
+		fs, p, err := h.FromHandle(fh)
+		if err != nil {
+			return err
+		}
+		op = &Operation{Procedure: NFSProcedure(w.req.Header.Proc), Filesystem: fs, Path: p}
+
+		var entry, to []string
+		switch op.Procedure {
+		case NFSProcedureLookup, NFSProcedureCreate, NFSProcedureMkDir, NFSProcedureSymlink,
+			NFSProcedureMkNod, NFSProcedureRemove, NFSProcedureRmDir:
+			if entry, err = readEntryPath(r, p); err != nil {
+				return err
+			}
+			op.Path = entry
+		case NFSProcedureRename:
+			if entry, err = readEntryPath(r, p); err != nil {
+				return err
+			}
+			op.Path = entry
+			if to, err = readDirOpPath(r, h); err != nil {
+				return err
+			}
+			op.To = to
+		case NFSProcedureLink:
+			if to, err = readDirOpPath(r, h); err != nil {
+				return err
+			}
+			op.To = to
+		}
+		return nil
+	})
+	return op, err
+}
+
+// readDirOpPath reads the handle and name of a diropargs3.
+func readDirOpPath(r io.Reader, h Handler) ([]string, error) {
+	fh, err := readHandle(r)
+	if err != nil {
+		return nil, err
+	}
+	_, dir, err := h.FromHandle(fh)
+	if err != nil {
+		return nil, err
+	}
+	return readEntryPath(r, dir)
+}
+
+// readEntryPath reads the name of an entry of dir.
+func readEntryPath(r io.Reader, dir []string) ([]string, error) {
+	size, err := xdr.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > PathNameMax {
+		return nil, &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	}
+	buf := make([]byte, (size+3)&^3)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	name := buf[:size]
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	return lookupPath(dir, name), nil
+}
@@ -0,0 +1,71 @@
+package nfs_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestAuthorize(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/keep", 0755)
+	_ = mem.MkdirAll("/open", 0755)
+	_ = billyutil.WriteFile(mem, "/keep/file", []byte("hello"), 0644)
+
+	var mu sync.Mutex
+	var seen []nfs.Operation
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		Authorize: func(ctx context.Context, op *nfs.Operation) nfs.NFSStatus {
+			mu.Lock()
+			seen = append(seen, *op)
+			mu.Unlock()
+			if op.Procedure == nfs.NFSProcedureRemove && len(op.Path) > 0 && op.Path[0] == "keep" {
+				return nfs.NFSStatusPerm
+			}
+			if op.Procedure == nfs.NFSProcedureRename && len(op.To) > 0 && op.To[0] == "keep" {
+				return nfs.NFSStatusAccess
+			}
+			return nfs.NFSStatusOk
+		},
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if err := target.Remove("/keep/file"); !os.IsPermission(err) {
+		t.Fatalf("expected remove to be refused with the hook's status: %v", err)
+	}
+	if _, err := mem.Stat("/keep/file"); err != nil {
+		t.Fatalf("expected refused remove to leave the file: %v", err)
+	}
+	if _, err := target.Create("/open/other", 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Rename("/open/other", "/keep/other"); !nfstest.IsStatus(err, nfs.NFSStatusAccess) {
+		t.Fatalf("expected rename into a protected directory to be refused: %v", err)
+	}
+	if err := target.Remove("/open/other"); err != nil {
+		t.Fatalf("expected other removes to be allowed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var found bool
+	for _, op := range seen {
+		if op.Procedure == nfs.NFSProcedureRemove && strings.Join(op.Path, "/") == "keep/file" {
+			found = op.Filesystem != nil && op.Conn != nil
+		}
+	}
+	if !found {
+		t.Fatal("expected the hook to see the path of the removed entry")
+	}
+}
@@ -0,0 +1,94 @@
+package nfs
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientStats are the calls a client address has made to the server.
+type ClientStats struct {
+	// Client is the address of the client, without its port.
+	Client string
+	// Calls and Errors count the calls made and those failed, by procedure,
+	// named as in Event.Procedure. Calls of other programs, such as portmap,
+	// are named by program and procedure number.
+	Calls  map[string]uint64
+	Errors map[string]uint64
+	// BytesIn and BytesOut are the sizes of the calls and replies.
+	BytesIn  uint64
+	BytesOut uint64
+	// LastCall is when the client last called the server.
+	LastCall time.Time
+}
+
+// clientStatsTracker records the ClientStats of every client address. A nil
+// tracker records nothing.
+type clientStatsTracker struct {
+	mu      sync.Mutex
+	clients map[string]*ClientStats
+}
+
+func newClientStatsTracker(enabled bool) *clientStatsTracker {
+	if !enabled {
+		return nil
+	}
+	return &clientStatsTracker{clients: make(map[string]*ClientStats)}
+}
+
+func (t *clientStatsTracker) record(addr net.Addr, w *response) {
+	if t == nil {
+		return
+	}
+	name := procedureName(w.req)
+	if name == "" {
+		name = fmt.Sprintf("%d.%d", w.req.Header.Prog, w.req.Header.Proc)
+	}
+	key := clientKey(addr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.clients[key]
+	if !ok {
+		s = &ClientStats{Client: key, Calls: make(map[string]uint64), Errors: make(map[string]uint64)}
+		t.clients[key] = s
+	}
+	s.Calls[name]++
+	if w.err != nil || w.refused {
+		s.Errors[name]++
+	}
+	s.BytesIn += uint64(w.req.size)
+	s.BytesOut += uint64(w.writer.Len())
+	s.LastCall = time.Now()
+}
+
+func (t *clientStatsTracker) list() []ClientStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]ClientStats, 0, len(t.clients))
+	for _, s := range t.clients {
+		c := *s
+		c.Calls = make(map[string]uint64, len(s.Calls))
+		for k, v := range s.Calls {
+			c.Calls[k] = v
+		}
+		c.Errors = make(map[string]uint64, len(s.Errors))
+		for k, v := range s.Errors {
+			c.Errors[k] = v
+		}
+		stats = append(stats, c)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Client < stats[j].Client })
+	return stats
+}
+
+// ClientStats provides the statistics of each client address that has called
+// the server, when EnableClientStats is set, ordered by address.
+func (s *Server) ClientStats() []ClientStats {
+	s.init()
+	return s.clientStats.list()
+}
@@ -0,0 +1,45 @@
+package nfs_test
+
+import (
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestClientStats(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/data", []byte("hello"), 0644)
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:           helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		EnableClientStats: true,
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if _, _, err := target.Lookup("/data", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := target.Lookup("/missing", false); err == nil {
+		t.Fatal("expected the lookup to fail")
+	}
+
+	stats := srv.ClientStats()
+	if len(stats) != 1 || stats[0].Client != "127.0.0.1" {
+		t.Fatalf("unexpected client stats %+v", stats)
+	}
+	s := stats[0]
+	if s.Calls["mount.Mount"] != 1 || s.Calls["nfs.Lookup"] < 2 {
+		t.Fatalf("unexpected calls %v", s.Calls)
+	}
+	if s.Errors["nfs.Lookup"] != 1 || s.Errors["mount.Mount"] != 0 {
+		t.Fatalf("unexpected errors %v", s.Errors)
+	}
+	if s.BytesIn == 0 || s.BytesOut == 0 || s.LastCall.IsZero() {
+		t.Fatalf("expected bytes and the time of the last call to be counted: %+v", s)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+)
+
+// Config is the JSON configuration file of nfsd.
+type Config struct {
+	// Listen is the address the NFS and MOUNT programs are served on.
+	Listen string `json:"listen"`
+	// Portmap, when set, is an address portmap is also served on, such as
+	// ":111", for clients that aren't given the port of Listen.
+	Portmap string `json:"portmap"`
+	// AdvertisedPort is the port clients are told to reach Listen on, when it
+	// is forwarded from another, such as from 2049 to that of a container.
+	AdvertisedPort int `json:"advertised_port"`
+	// Metrics, when set, is the address counters are served on over HTTP, at
+	// /debug/vars.
+	Metrics string `json:"metrics"`
+	// LogLevel is one of panic, fatal, error, warn, info, debug and trace.
+	LogLevel string `json:"log_level"`
+	// LogFile, when set, is appended to rather than logging to stderr. It is
+	// reopened on SIGHUP, for log rotation.
+	LogFile string `json:"log_file"`
+	// HandleCache is the number of file handles kept.
+	HandleCache int `json:"handle_cache"`
+	// HandleSize is the length of the file handles given, 16 bytes when
+	// zero, for clients which mishandle others.
+	HandleSize int `json:"handle_size"`
+	// HandleTable, when set, is a file the handles are saved to on stop and
+	// restored from on start, so that clients keep using them across a
+	// restart.
+	HandleTable string `json:"handle_table"`
+	// OperationTimeout, when set, is a duration such as "30s" after which a
+	// call still blocked on the directory's filesystem fails with
+	// NFS3ERR_JUKEBOX, for the client to retry.
+	OperationTimeout string `json:"operation_timeout"`
+	// SlowOperationThreshold, when set, is a duration such as "1s" from
+	// which calls are logged as slow, with where their time went.
+	SlowOperationThreshold string `json:"slow_operation_threshold"`
+	// MaxInFlightBytes bounds the size of the calls being processed at once.
+	MaxInFlightBytes int64 `json:"max_in_flight_bytes"`
+	// NFSv4 serves version 4 of the NFS program alongside version 3.
+	NFSv4 bool `json:"nfsv4"`
+	// StableDirCookies continues directory listings from the names of
+	// entries rather than their positions, so that listings of directories
+	// changing between pages aren't restarted.
+	StableDirCookies bool `json:"stable_dir_cookies"`
+	// Watch invalidates cached handles when exported directories are changed
+	// by other processes.
+	Watch bool `json:"watch"`
+	// Admin, when set, is the address the provisioning API is served on over
+	// HTTP, for orchestrators to make and drop exports with. It changes the
+	// exports of the server, so should only be reachable by them.
+	Admin string `json:"admin"`
+	// AdminToken, when set, must be given to the provisioning API as a
+	// bearer token.
+	AdminToken string `json:"admin_token"`
+	// ProvisionDir is the directory the exports made through the
+	// provisioning API are carved from, each a directory of it.
+	ProvisionDir string `json:"provision_dir"`
+	// ProvisionState, when set, is the file the exports made through the
+	// provisioning API are kept in, so that they are served again after a
+	// restart.
+	ProvisionState string `json:"provision_state"`
+
+	// TLS, when set, serves Listen over TLS, for clients reaching it through
+	// a TLS tunnel. It is read on start.
+	TLS *TLSConfig `json:"tls"`
+
+	Exports []ExportConfig `json:"exports"`
+}
+
+// TLSConfig is the certificate Listen is served with over TLS.
+type TLSConfig struct {
+	// Cert and Key are PEM files of the certificate of the server and its
+	// key.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// ClientCA, when set, is a PEM file of the CAs the certificates clients
+	// give are verified against, for exports with require_client_cert or
+	// client_cert_names.
+	ClientCA string `json:"client_ca"`
+}
+
+// config provides the tls.Config of the listener.
+func (t *TLSConfig) config() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if t.ClientCA != "" {
+		pem, err := os.ReadFile(t.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s holds no certificates", t.ClientCA)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// ExportConfig is a local directory served to clients mounting Path.
+type ExportConfig struct {
+	// Path is the path clients mount, such as "/data".
+	Path string `json:"path"`
+	// Dir is the local directory exported.
+	Dir string `json:"dir"`
+	// WindowsNames presents the names of Dir holding characters Windows
+	// reserves as characters Windows clients can open.
+	WindowsNames bool `json:"windows_names"`
+	// QuotaBytes, when set, bounds the file data of the export, which is
+	// reported to clients as its size.
+	QuotaBytes int64 `json:"quota_bytes"`
+
+	OptionsConfig
+	// Clients override the options for clients within a network.
+	Clients []ClientConfig `json:"clients"`
+}
+
+// ClientConfig applies options to the clients within Network, a CIDR.
+type ClientConfig struct {
+	Network string `json:"network"`
+	OptionsConfig
+}
+
+// OptionsConfig are the policies of an export.
+type OptionsConfig struct {
+	ReadOnly         bool     `json:"read_only"`
+	RootSquash       bool     `json:"root_squash"`
+	AllSquash        bool     `json:"all_squash"`
+	AnonUID          uint32   `json:"anon_uid"`
+	AnonGID          uint32   `json:"anon_gid"`
+	CheckPermissions bool     `json:"check_permissions"`
+	AuthFlavors      []string `json:"auth_flavors"`
+	Secure           bool     `json:"secure"`
+	Hide             []string `json:"hide"`
+	HideRegexp       []string `json:"hide_regexp"`
+	ConfineSymlinks  bool     `json:"confine_symlinks"`
+	MaxDirEntries    int      `json:"max_dir_entries"`
+	MaxPathDepth     int      `json:"max_path_depth"`
+	MaxHandles       int      `json:"max_handles"`
+	Fileid32         bool     `json:"fileid32"`
+	RequireUTF8      bool     `json:"require_utf8"`
+	CaseInsensitive  bool     `json:"case_insensitive"`
+	DenyCreate       []string `json:"deny_create"`
+	DenyCreateRegexp []string `json:"deny_create_regexp"`
+	// Umask, ForceFileMode and ForceDirMode are octal modes, such as "022".
+	Umask         string `json:"umask"`
+	ForceFileMode string `json:"force_file_mode"`
+	ForceDirMode  string `json:"force_dir_mode"`
+	PresentOwner  bool   `json:"present_owner"`
+	OwnerUID      uint32 `json:"owner_uid"`
+	OwnerGID      uint32 `json:"owner_gid"`
+	// DisableProcedures names NFSv3 procedures, such as "symlink".
+	DisableProcedures []string `json:"disable_procedures"`
+	MacOSQuirks       bool     `json:"macos_quirks"`
+	WindowsQuirks     bool     `json:"windows_quirks"`
+	ESXiQuirks        bool     `json:"esxi_quirks"`
+	// RequireClientCert and ClientCertNames, patterns such as
+	// "*.clients.example.com", admit clients by their certificates, given
+	// over tls.
+	RequireClientCert bool     `json:"require_client_cert"`
+	ClientCertNames   []string `json:"client_cert_names"`
+	// Referrals refer NFSv4 clients of subtrees of the export to the servers
+	// serving them.
+	Referrals []ReferralConfig `json:"referrals"`
+}
+
+// ReferralConfig refers the subtree at Path, from the root of the export, to
+// RootPath on Servers.
+type ReferralConfig struct {
+	Path     string   `json:"path"`
+	Servers  []string `json:"servers"`
+	RootPath string   `json:"root_path"`
+}
+
+var flavorNames = map[string]nfs.AuthFlavor{
+	"none": nfs.AuthFlavorNull,
+	"sys":  nfs.AuthFlavorUnix,
+}
+
+// gssFlavorNames are the flavors of RPCSEC_GSS, which are refused by name
+// rather than taken as unknown.
+var gssFlavorNames = map[string]bool{"krb5": true, "krb5i": true, "krb5p": true}
+
+func (o *OptionsConfig) options() (nfs.ExportOptions, error) {
+	opts := nfs.ExportOptions{
+		ReadOnly:          o.ReadOnly,
+		RootSquash:        o.RootSquash,
+		AllSquash:         o.AllSquash,
+		AnonUID:           o.AnonUID,
+		AnonGID:           o.AnonGID,
+		CheckPermissions:  o.CheckPermissions,
+		Secure:            o.Secure,
+		Hide:              o.Hide,
+		ConfineSymlinks:   o.ConfineSymlinks,
+		MaxDirEntries:     o.MaxDirEntries,
+		MaxPathDepth:      o.MaxPathDepth,
+		MaxHandles:        o.MaxHandles,
+		Fileid32:          o.Fileid32,
+		RequireUTF8:       o.RequireUTF8,
+		CaseInsensitive:   o.CaseInsensitive,
+		DenyCreate:        o.DenyCreate,
+		PresentOwner:      o.PresentOwner,
+		OwnerUID:          o.OwnerUID,
+		OwnerGID:          o.OwnerGID,
+		MacOSQuirks:       o.MacOSQuirks,
+		WindowsQuirks:     o.WindowsQuirks,
+		ESXiQuirks:        o.ESXiQuirks,
+		RequireClientCert: o.RequireClientCert,
+		ClientCertNames:   o.ClientCertNames,
+	}
+	for _, pattern := range o.Hide {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return opts, fmt.Errorf("hide pattern %q: %w", pattern, err)
+		}
+	}
+	for _, expr := range o.HideRegexp {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return opts, err
+		}
+		opts.HideRegexp = append(opts.HideRegexp, re)
+	}
+	for _, pattern := range o.ClientCertNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return opts, fmt.Errorf("client_cert_names pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range o.DenyCreate {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return opts, fmt.Errorf("deny_create pattern %q: %w", pattern, err)
+		}
+	}
+	for _, expr := range o.DenyCreateRegexp {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return opts, err
+		}
+		opts.DenyCreateRegexp = append(opts.DenyCreateRegexp, re)
+	}
+	for _, m := range []struct {
+		name  string
+		value string
+		mode  *os.FileMode
+	}{
+		{"umask", o.Umask, &opts.Umask},
+		{"force_file_mode", o.ForceFileMode, &opts.ForceFileMode},
+		{"force_dir_mode", o.ForceDirMode, &opts.ForceDirMode},
+	} {
+		if m.value == "" {
+			continue
+		}
+		mode, err := parseMode(m.value)
+		if err != nil {
+			return opts, fmt.Errorf("%s %q: %w", m.name, m.value, err)
+		}
+		*m.mode = mode
+	}
+	for _, name := range o.DisableProcedures {
+		proc, ok := procedureNamed(name)
+		if !ok {
+			return opts, fmt.Errorf("unknown procedure %q", name)
+		}
+		opts.DisableProcedures = append(opts.DisableProcedures, proc)
+	}
+	for _, r := range o.Referrals {
+		if !strings.HasPrefix(r.Path, "/") {
+			return opts, fmt.Errorf("referral path %q is not absolute", r.Path)
+		}
+		if len(r.Servers) == 0 {
+			return opts, fmt.Errorf("referral of %s names no servers", r.Path)
+		}
+		opts.Referrals = append(opts.Referrals, nfs.Referral{
+			Path:      r.Path,
+			Locations: []nfs.FSLocation{{Servers: r.Servers, RootPath: r.RootPath}},
+		})
+	}
+	for _, name := range o.AuthFlavors {
+		f, ok := flavorNames[name]
+		if !ok && gssFlavorNames[name] {
+			return opts, fmt.Errorf("auth flavor %q needs RPCSEC_GSS, which is not implemented", name)
+		}
+		if !ok {
+			return opts, fmt.Errorf("unknown auth flavor %q", name)
+		}
+		opts.AuthFlavors = append(opts.AuthFlavors, f)
+	}
+	return opts, nil
+}
+
+// procedureNamed provides the NFSv3 procedure of a name, in any case.
+func procedureNamed(name string) (nfs.NFSProcedure, bool) {
+	for p := nfs.NFSProcedureGetAttr; p <= nfs.NFSProcedureCommit; p++ {
+		if strings.EqualFold(p.String(), name) {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// parseMode parses an octal mode, such as "0755" or "2775", into the
+// os.FileMode of its permission, setuid, setgid and sticky bits.
+func parseMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 12)
+	if err != nil {
+		return 0, err
+	}
+	mode := os.FileMode(n) & os.ModePerm
+	if n&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if n&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if n&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// operationTimeout is the parsed OperationTimeout, which check validates.
+func (c *Config) operationTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.OperationTimeout)
+	return d
+}
+
+// slowOperationThreshold is the parsed SlowOperationThreshold, which check
+// validates.
+func (c *Config) slowOperationThreshold() time.Duration {
+	d, _ := time.ParseDuration(c.SlowOperationThreshold)
+	return d
+}
+
+// LoadConfig reads and checks the configuration file at name.
+func LoadConfig(name string) (*Config, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{
+		Listen:      ":2049",
+		LogLevel:    "info",
+		HandleCache: 1 << 16,
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if err := c.check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return c, nil
+}
+
+func (c *Config) check() error {
+	if _, err := nfs.Log.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.OperationTimeout != "" {
+		if _, err := time.ParseDuration(c.OperationTimeout); err != nil {
+			return fmt.Errorf("operation_timeout: %w", err)
+		}
+	}
+	if c.SlowOperationThreshold != "" {
+		if _, err := time.ParseDuration(c.SlowOperationThreshold); err != nil {
+			return fmt.Errorf("slow_operation_threshold: %w", err)
+		}
+	}
+	if c.HandleCache < 2 {
+		return errors.New("handle_cache must be at least 2")
+	}
+	if c.TLS != nil {
+		if _, err := c.TLS.config(); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	}
+	if len(c.Exports) == 0 && c.ProvisionDir == "" {
+		return errors.New("no exports")
+	}
+	if c.ProvisionDir != "" {
+		dir, err := filepath.Abs(c.ProvisionDir)
+		if err != nil {
+			return err
+		}
+		c.ProvisionDir = dir
+	}
+	seen := make(map[string]bool)
+	for i := range c.Exports {
+		e := &c.Exports[i]
+		if err := e.check(); err != nil {
+			return err
+		}
+		if seen[e.Path] {
+			return fmt.Errorf("export path %s is given twice", e.Path)
+		}
+		seen[e.Path] = true
+	}
+	return nil
+}
+
+func (e *ExportConfig) check() error {
+	if !path.IsAbs(e.Path) {
+		return fmt.Errorf("export path %q is not absolute", e.Path)
+	}
+	e.Path = path.Clean(e.Path)
+	dir, err := filepath.Abs(e.Dir)
+	if err != nil {
+		return err
+	}
+	e.Dir = dir
+	if info, err := os.Stat(e.Dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("export %s: %s is not a directory", e.Path, e.Dir)
+	}
+	if e.QuotaBytes < 0 {
+		return fmt.Errorf("export %s: quota_bytes is negative", e.Path)
+	}
+	if _, err := e.options(); err != nil {
+		return fmt.Errorf("export %s: %w", e.Path, err)
+	}
+	for _, cl := range e.Clients {
+		if _, _, err := net.ParseCIDR(cl.Network); err != nil {
+			return fmt.Errorf("export %s: %w", e.Path, err)
+		}
+		if _, err := cl.options(); err != nil {
+			return fmt.Errorf("export %s: %w", e.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	_ = os.Mkdir(data, 0755)
+	file := filepath.Join(dir, "file")
+	_ = os.WriteFile(file, nil, 0644)
+
+	// load loads a configuration file of contents.
+	load := func(contents string) (*Config, error) {
+		name := filepath.Join(dir, "nfsd.json")
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return LoadConfig(name)
+	}
+
+	c, err := load(`{"exports": [{"path": "/data/", "dir": "` + filepath.ToSlash(data) + `",
+		"umask": "022", "auth_flavors": ["sys"], "disable_procedures": ["SYMLINK"],
+		"referrals": [{"path": "/away", "servers": ["other.example.com"], "root_path": "/export/away"}]}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != ":2049" || c.LogLevel != "info" || c.HandleCache != 1<<16 {
+		t.Fatalf("expected the defaults, got %q, %q and %d", c.Listen, c.LogLevel, c.HandleCache)
+	}
+	e := c.Exports[0]
+	if e.Path != "/data" || e.Dir != data {
+		t.Fatalf("expected the export of %s at /data, got %s at %s", data, e.Dir, e.Path)
+	}
+	opts, err := e.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Umask != 022 {
+		t.Fatalf("expected a umask of 022, got %o", opts.Umask)
+	}
+	if len(opts.AuthFlavors) != 1 || opts.AuthFlavors[0] != nfs.AuthFlavorUnix {
+		t.Fatalf("expected AUTH_SYS alone, got %v", opts.AuthFlavors)
+	}
+	if len(opts.DisableProcedures) != 1 || opts.DisableProcedures[0] != nfs.NFSProcedureSymlink {
+		t.Fatalf("expected SYMLINK to be disabled, got %v", opts.DisableProcedures)
+	}
+	if len(opts.Referrals) != 1 || opts.Referrals[0].Locations[0].RootPath != "/export/away" {
+		t.Fatalf("expected /away to be referred to other.example.com, got %+v", opts.Referrals)
+	}
+
+	export := func(path, dir, options string) string {
+		return `{"path": "` + path + `", "dir": "` + filepath.ToSlash(dir) + `"` + options + `}`
+	}
+	for _, tc := range []struct {
+		config   string
+		expected string
+	}{
+		{`{"exports": []}`, "no exports"},
+		{`{"exports": [` + export("data", data, "") + `]}`, "not absolute"},
+		{`{"exports": [` + export("/a", data, "") + `, ` + export("/a/", data, "") + `]}`, "given twice"},
+		{`{"exports": [` + export("/a", file, "") + `]}`, "not a directory"},
+		{`{"exports": [` + export("/a", data, `, "umask": "999"`) + `]}`, "umask"},
+		{`{"exports": [` + export("/a", data, `, "disable_procedures": ["open"]`) + `]}`, "unknown procedure"},
+		{`{"exports": [` + export("/a", data, `, "auth_flavors": ["krb5i"]`) + `]}`, "not implemented"},
+		{`{"exports": [` + export("/a", data, `, "referrals": [{"path": "/away"}]`) + `]}`, "no servers"},
+		{`{"exports": [` + export("/a", data, `, "auth_flavors": ["kerberos"]`) + `]}`, "unknown auth flavor"},
+		{`{"handle_cache": 1, "exports": [` + export("/a", data, "") + `]}`, "handle_cache"},
+		{`{"operation_timeout": "soon", "exports": [` + export("/a", data, "") + `]}`, "operation_timeout"},
+	} {
+		if _, err := load(tc.config); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%s: expected an error about %s, got %v", tc.config, tc.expected, err)
+		}
+	}
+}
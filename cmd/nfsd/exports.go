@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+// export is a directory being served.
+type export struct {
+	config  ExportConfig
+	fs      billy.Filesystem
+	options *helpers.ExportHandler
+	watcher *helpers.Watcher
+	// changes changes the attributes of the files of fs, and quota, when
+	// the export has one, is what fs wraps them with.
+	changes billy.Change
+	quota   *helpers.QuotaFS
+	// provisioned is set for exports made through the provisioning API.
+	provisioned bool
+}
+
+// exports is the handler of nfsd, serving each configured directory to the
+// clients mounting its path. The exports can be replaced while they are
+// served, in which case the handles of unchanged exports remain valid.
+type exports struct {
+	mu     sync.RWMutex
+	byPath map[string]*export
+	byFS   map[billy.Filesystem]*export
+	// cache is the handler wrapping exports, whose handles are dropped with
+	// the exports they resolve to.
+	cache *helpers.CachingHandler
+
+	// configMu serializes changes of the configuration, and of the exports
+	// made through the provisioning API, which are served alongside those of
+	// the configuration, by name.
+	configMu    sync.Mutex
+	config      *Config
+	provisioned map[string]ExportConfig
+}
+
+func newExports() *exports {
+	return &exports{
+		byPath:      make(map[string]*export),
+		byFS:        make(map[billy.Filesystem]*export),
+		provisioned: make(map[string]ExportConfig),
+	}
+}
+
+// configure replaces the exports with those of c, and those provisioned.
+func (x *exports) configure(c *Config) error {
+	x.configMu.Lock()
+	defer x.configMu.Unlock()
+	x.config = c
+	return x.apply()
+}
+
+// apply serves the exports of the configuration and those provisioned. An
+// export provisioned at the path of one configured isn't served.
+func (x *exports) apply() error {
+	c := x.config
+	configs := append([]ExportConfig{}, c.Exports...)
+	provisioned := make(map[string]bool)
+	for name, ec := range x.provisioned {
+		if exportConfigured(c, ec.Path) {
+			nfs.Log.Warnf("not serving provisioned export %s, whose path is configured", name)
+			continue
+		}
+		configs = append(configs, ec)
+		provisioned[ec.Path] = true
+	}
+
+	next := make(map[string]*export, len(configs))
+	for _, ec := range configs {
+		opts, err := ec.options()
+		if err != nil {
+			return err
+		}
+		rules := make([]helpers.ExportRule, 0, len(ec.Clients))
+		for _, cl := range ec.Clients {
+			_, network, err := net.ParseCIDR(cl.Network)
+			if err != nil {
+				return err
+			}
+			ro, err := cl.options()
+			if err != nil {
+				return err
+			}
+			rules = append(rules, helpers.ExportRule{Network: network, Options: ro})
+		}
+		next[ec.Path] = &export{
+			config:      ec,
+			options:     &helpers.ExportHandler{Options: opts, Rules: rules},
+			provisioned: provisioned[ec.Path],
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for p, e := range x.byPath {
+		if n, ok := next[p]; ok && n.config.Dir == e.config.Dir && n.config.WindowsNames == e.config.WindowsNames &&
+			(n.config.QuotaBytes == 0) == (e.quota == nil) {
+			n.fs, n.watcher, n.changes, n.quota = e.fs, e.watcher, e.changes, e.quota
+			if n.quota != nil {
+				n.quota.SetLimit(n.config.QuotaBytes)
+			}
+			continue
+		}
+		x.drop(e)
+	}
+	for p, e := range next {
+		if e.fs == nil {
+			if err := e.open(); err != nil {
+				nfs.Log.Errorf("unable to export %s as %s: %v", e.config.Dir, e.config.Path, err)
+				delete(next, p)
+				continue
+			}
+			nfs.Log.Infof("exporting %s as %s", e.config.Dir, e.config.Path)
+		}
+		switch {
+		case c.Watch && e.watcher == nil && x.cache != nil:
+			w, err := helpers.NewWatcher(x.cache, e.fs, e.config.Dir)
+			if err != nil {
+				nfs.Log.Warnf("unable to watch %s: %v", e.config.Dir, err)
+				break
+			}
+			e.watcher = w
+		case !c.Watch && e.watcher != nil:
+			_ = e.watcher.Close()
+			e.watcher = nil
+		}
+		x.byFS[e.fs] = e
+	}
+	x.byPath = next
+	return nil
+}
+
+// open makes the filesystem of e.
+func (e *export) open() error {
+	var fs billy.Filesystem = helpers.NewChangeOSFS(osfs.New(e.config.Dir))
+	if e.config.WindowsNames {
+		fs = helpers.NewEncodingFS(fs, helpers.WindowsNames)
+	}
+	e.changes, _ = fs.(billy.Change)
+	if e.config.QuotaBytes > 0 {
+		q, err := helpers.NewQuotaFS(fs, e.config.QuotaBytes)
+		if err != nil {
+			return err
+		}
+		e.quota, fs = q, q
+	}
+	e.fs = fs
+	return nil
+}
+
+// exportConfigured reports whether c configures an export at p.
+func exportConfigured(c *Config, p string) bool {
+	for _, ec := range c.Exports {
+		if ec.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// drop stops serving e, so that its handles go stale.
+func (x *exports) drop(e *export) {
+	nfs.Log.Infof("no longer exporting %s as %s", e.config.Dir, e.config.Path)
+	if e.watcher != nil {
+		_ = e.watcher.Close()
+	}
+	delete(x.byFS, e.fs)
+	if x.cache != nil {
+		x.cache.InvalidatePath(e.fs, []string{})
+	}
+}
+
+// close stops watching the exports.
+func (x *exports) close() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, e := range x.byPath {
+		if e.watcher != nil {
+			_ = e.watcher.Close()
+			e.watcher = nil
+		}
+	}
+}
+
+func (x *exports) lookup(fs billy.Filesystem) *export {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.byFS[fs]
+}
+
+// Mount serves the export whose path is the one mounted.
+func (x *exports) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	x.mu.RLock()
+	e, ok := x.byPath[path.Clean("/"+string(req.Dirpath))]
+	x.mu.RUnlock()
+	if !ok {
+		return nfs.MountStatusErrNoEnt, nil, nil
+	}
+	return nfs.MountStatusOk, e.fs, []nfs.AuthFlavor{nfs.AuthFlavorUnix, nfs.AuthFlavorNull}
+}
+
+// Change provides the attribute changes of the osfs exports.
+func (x *exports) Change(fs billy.Filesystem) billy.Change {
+	if e := x.lookup(fs); e != nil && e.changes != nil {
+		return e.changes
+	}
+	if c, ok := fs.(billy.Change); ok {
+		return c
+	}
+	return nil
+}
+
+// FSStat provides the free space of the filesystem holding an export.
+func (x *exports) FSStat(ctx context.Context, fs billy.Filesystem, s *nfs.FSStat) error {
+	e := x.lookup(fs)
+	if e == nil {
+		return nil
+	}
+	if err := statfs(e.config.Dir, s); err != nil {
+		return err
+	}
+	if e.quota != nil {
+		e.quota.LimitFSStat(s)
+	}
+	return nil
+}
+
+// ExportOptions applies the options of the export fs belongs to.
+func (x *exports) ExportOptions(ctx context.Context, conn net.Conn, fs billy.Filesystem) *nfs.ExportOptions {
+	e := x.lookup(fs)
+	if e == nil {
+		// the export was removed while the call was in flight.
+		return &nfs.ExportOptions{ReadOnly: true, AllSquash: true}
+	}
+	return e.options.ExportOptions(ctx, conn, fs)
+}
+
+// MountOptions applies the options of the export mounted, before it is.
+func (x *exports) MountOptions(ctx context.Context, conn net.Conn, req nfs.MountRequest) *nfs.ExportOptions {
+	x.mu.RLock()
+	e, ok := x.byPath[path.Clean("/"+string(req.Dirpath))]
+	x.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return e.options.ExportOptions(ctx, conn, e.fs)
+}
+
+// ToHandle handled by CachingHandler
+func (x *exports) ToHandle(fs billy.Filesystem, path []string) []byte {
+	return []byte{}
+}
+
+// FromHandle handled by CachingHandler
+func (x *exports) FromHandle([]byte) (billy.Filesystem, []string, error) {
+	return nil, []string{}, nil
+}
+
+// InvalidateHandle handled by CachingHandler
+func (x *exports) InvalidateHandle(billy.Filesystem, []byte) error {
+	return nil
+}
+
+// HandleLimit handled by CachingHandler
+func (x *exports) HandleLimit() int {
+	return -1
+}
@@ -0,0 +1,250 @@
+// Command nfsd serves local directories over NFSv3, as configured by a JSON
+// file. See the README of the repository for the configuration format.
+//
+// SIGHUP reloads the configuration: exports are added, removed and have
+// their options replaced, the log level is applied and the log file is
+// reopened. The listen and metrics addresses only change on restart. SIGINT
+// and SIGTERM stop the server.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+func main() {
+	configPath := flag.String("config", "/etc/nfsd.json", "configuration file")
+	check := flag.Bool("check", false, "check the configuration file and exit")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nfsd: %v\n", err)
+		os.Exit(2)
+	}
+	if *check {
+		return
+	}
+	if err := run(*configPath, config); err != nil {
+		nfs.Log.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath string, config *Config) error {
+	logs := &logOutput{}
+	if err := logs.configure(config); err != nil {
+		return err
+	}
+	defer logs.close()
+
+	x := newExports()
+	cache := helpers.NewCachingHandler(x, config.HandleCache).(*helpers.CachingHandler)
+	x.cache = cache
+	if err := cache.SetHandleFormat(helpers.HandleFormat{Size: config.HandleSize}); err != nil {
+		return err
+	}
+	if config.ProvisionState != "" {
+		if err := x.loadProvisioned(config.ProvisionState); err != nil {
+			return fmt.Errorf("unable to restore provisioned exports: %w", err)
+		}
+	}
+	if err := x.configure(config); err != nil {
+		return err
+	}
+	defer x.close()
+	if config.HandleTable != "" {
+		if err := loadHandles(cache, config.HandleTable); err != nil {
+			nfs.Log.Warnf("unable to restore handles: %v", err)
+		}
+		defer func() {
+			if err := saveHandles(cache, config.HandleTable); err != nil {
+				nfs.Log.Errorf("unable to save handles: %v", err)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newMetrics(x)
+	server := &nfs.Server{
+		Handler:                cache,
+		Context:                ctx,
+		MaxInFlightBytes:       config.MaxInFlightBytes,
+		OperationTimeout:       config.operationTimeout(),
+		SlowOperationThreshold: config.slowOperationThreshold(),
+		EnableNFSv4:            config.NFSv4,
+		StableDirCookies:       config.StableDirCookies,
+		EnablePortmap:          config.Portmap != "",
+		AdvertisedPort:         config.AdvertisedPort,
+		Events:                 m,
+		Authorize:              m.authorize,
+
+		// the counters of clients are only read by the metrics.
+		EnableClientStats: config.Metrics != "",
+	}
+	publishServer(server)
+
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}()
+	for _, addr := range []string{config.Listen, config.Portmap} {
+		if addr == "" {
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		if addr == config.Listen && config.TLS != nil {
+			conf, err := config.TLS.config()
+			if err != nil {
+				_ = l.Close()
+				return err
+			}
+			l = tls.NewListener(l, conf)
+		}
+		listeners = append(listeners, l)
+	}
+	if config.Metrics != "" {
+		ml, err := net.Listen("tcp", config.Metrics)
+		if err != nil {
+			return err
+		}
+		nfs.Log.Infof("serving metrics on http://%s/debug/vars", ml.Addr())
+		go m.serve(ctx, ml, server)
+	}
+	if config.Admin != "" {
+		al, err := net.Listen("tcp", config.Admin)
+		if err != nil {
+			return err
+		}
+		nfs.Log.Infof("serving the provisioning API on http://%s/exports", al.Addr())
+		go serveAdmin(ctx, al, x, config.AdminToken)
+	}
+	if server.AdvertisedPort == 0 {
+		// portmap, on a listener of its own, gives the port of the first.
+		server.AdvertisedPort = listeners[0].Addr().(*net.TCPAddr).Port
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) { served <- server.Serve(l) }(l)
+	}
+
+	for {
+		select {
+		case err := <-served:
+			return err
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				nfs.Log.Infof("stopping on %v", sig)
+				return nil
+			}
+			reload(configPath, logs, x, server)
+		}
+	}
+}
+
+// reload applies the configuration file again, keeping the running one when
+// the file is invalid.
+func reload(configPath string, logs *logOutput, x *exports, server *nfs.Server) {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		nfs.Log.Errorf("not reloading: %v", err)
+		return
+	}
+	if err := logs.configure(config); err != nil {
+		nfs.Log.Errorf("unable to reopen log: %v", err)
+	}
+	if err := x.configure(config); err != nil {
+		nfs.Log.Errorf("unable to reload exports: %v", err)
+		return
+	}
+	nfs.Log.Infof("reloaded %s", configPath)
+	server.Publish(nfs.Event{Type: nfs.EventExportReload, Path: configPath})
+}
+
+// loadHandles restores the handles saved in name, if there are any.
+func loadHandles(cache *helpers.CachingHandler, name string) error {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cache.Import(f)
+}
+
+// saveHandles replaces name by the handles of cache.
+func saveHandles(cache *helpers.CachingHandler, name string) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	if err := cache.Export(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// logOutput is where the log is written.
+type logOutput struct {
+	file *os.File
+}
+
+// configure applies the log level of c, and opens its log file.
+func (o *logOutput) configure(c *Config) error {
+	level, err := nfs.Log.ParseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	nfs.Log.SetLevel(level)
+
+	if c.LogFile == "" {
+		log.SetOutput(os.Stderr)
+		o.close()
+		return nil
+	}
+	f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	o.close()
+	o.file = f
+	return nil
+}
+
+func (o *logOutput) close() {
+	if o.file != nil {
+		_ = o.file.Close()
+		o.file = nil
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+)
+
+// metrics are the counters nfsd publishes with expvar, served as JSON at
+// /debug/vars of the metrics address.
+type metrics struct {
+	// operations counts the NFS calls dispatched, by procedure.
+	operations *expvar.Map
+	// events counts the security events of the server, by type.
+	events *expvar.Map
+}
+
+func newMetrics(x *exports) *metrics {
+	m := &metrics{
+		operations: expvar.NewMap("nfs_operations"),
+		events:     expvar.NewMap("nfs_events"),
+	}
+	expvar.Publish("nfs_exports", expvar.Func(func() interface{} {
+		x.mu.RLock()
+		defer x.mu.RUnlock()
+		return len(x.byPath)
+	}))
+	return m
+}
+
+// publishServer publishes the mounts and the per client counters of s.
+func publishServer(s *nfs.Server) {
+	type mount struct {
+		Client string    `json:"client"`
+		Export string    `json:"export"`
+		Time   time.Time `json:"time"`
+		Flavor uint32    `json:"flavor"`
+	}
+	expvar.Publish("nfs_mounts", expvar.Func(func() interface{} {
+		mounts := []mount{}
+		for _, m := range s.Mounts() {
+			mounts = append(mounts, mount{m.Client.String(), m.Export, m.Time, uint32(m.Flavor)})
+		}
+		return mounts
+	}))
+	expvar.Publish("nfs_clients", expvar.Func(func() interface{} {
+		return s.ClientStats()
+	}))
+	expvar.Publish("nfs_pings", expvar.Func(func() interface{} {
+		return s.PingStats()
+	}))
+}
+
+// authorize counts each call, letting it proceed.
+func (m *metrics) authorize(ctx context.Context, op *nfs.Operation) nfs.NFSStatus {
+	m.operations.Add(op.Procedure.String(), 1)
+	return nfs.NFSStatusOk
+}
+
+// OnEvent counts e, and logs refusals.
+func (m *metrics) OnEvent(e nfs.Event) {
+	m.events.Add(e.Type.String(), 1)
+	switch e.Type {
+	case nfs.EventMountDenied, nfs.EventAuthFailure, nfs.EventPermissionDenied:
+		nfs.Log.Warnf("%s: %s %s by %v: %v", e.Type, e.Procedure, e.Path, e.Client, e.Err)
+	}
+}
+
+// serve serves the metrics on l until ctx is done, and the health of s at
+// /healthz, for load balancers.
+func (m *metrics) serve(ctx context.Context, l net.Listener, s *nfs.Server) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Healthy(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		nfs.Log.Errorf("metrics server: %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+)
+
+// The provisioning API has orchestrators, such as the controller of a CSI
+// driver, make exports at runtime, each carved out of a directory of
+// provision_dir and mounted at "/" followed by its name:
+//
+//	GET    /exports              lists the exports, with their usage
+//	PUT    /exports/{name}       makes or updates an export, given as in the
+//	                             configuration but for its path and dir
+//	DELETE /exports/{name}       drops an export, and with ?purge=true its data
+//
+// Putting an export again with the same options succeeds, so that requests
+// can be retried.
+
+var (
+	errProvisioningOff = errors.New("provision_dir is not configured")
+	errNoExport        = errors.New("no such provisioned export")
+	errConfigured      = errors.New("the path of the export is configured")
+	errInvalidExport   = errors.New("invalid export")
+)
+
+// exportStatus describes an export to the provisioning API.
+type exportStatus struct {
+	Name        string `json:"name,omitempty"`
+	Path        string `json:"path"`
+	Dir         string `json:"dir"`
+	Provisioned bool   `json:"provisioned"`
+	QuotaBytes  int64  `json:"quota_bytes,omitempty"`
+	UsedBytes   int64  `json:"used_bytes,omitempty"`
+}
+
+// validVolumeName reports whether name can name a provisioned export, and
+// the directory it is carved out of.
+func validVolumeName(name string) bool {
+	if name == "" || len(name) > nfs.PathNameMax || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// provision makes or updates the export name with the options of ec.
+func (x *exports) provision(name string, ec ExportConfig) (ExportConfig, error) {
+	x.configMu.Lock()
+	defer x.configMu.Unlock()
+	if x.config.ProvisionDir == "" {
+		return ec, errProvisioningOff
+	}
+	if !validVolumeName(name) {
+		return ec, fmt.Errorf("%w name %q", errInvalidExport, name)
+	}
+	ec.Path = "/" + name
+	ec.Dir = filepath.Join(x.config.ProvisionDir, name)
+	if exportConfigured(x.config, ec.Path) {
+		return ec, errConfigured
+	}
+	if err := os.MkdirAll(ec.Dir, 0o755); err != nil {
+		return ec, err
+	}
+	if err := ec.check(); err != nil {
+		return ec, fmt.Errorf("%w: %v", errInvalidExport, err)
+	}
+	prev, existed := x.provisioned[name]
+	x.provisioned[name] = ec
+	if err := x.saveProvisioned(); err != nil {
+		if existed {
+			x.provisioned[name] = prev
+		} else {
+			delete(x.provisioned, name)
+		}
+		return ec, err
+	}
+	return ec, x.apply()
+}
+
+// deprovision drops the export name, and removes its data when purging.
+func (x *exports) deprovision(name string, purge bool) error {
+	x.configMu.Lock()
+	defer x.configMu.Unlock()
+	ec, ok := x.provisioned[name]
+	if !ok {
+		return errNoExport
+	}
+	delete(x.provisioned, name)
+	if err := x.saveProvisioned(); err != nil {
+		x.provisioned[name] = ec
+		return err
+	}
+	if err := x.apply(); err != nil {
+		return err
+	}
+	if purge {
+		return os.RemoveAll(ec.Dir)
+	}
+	return nil
+}
+
+// status describes the exports served.
+func (x *exports) status() []exportStatus {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	list := make([]exportStatus, 0, len(x.byPath))
+	for _, e := range x.byPath {
+		s := exportStatus{Path: e.config.Path, Dir: e.config.Dir, Provisioned: e.provisioned}
+		if e.provisioned {
+			s.Name = strings.TrimPrefix(e.config.Path, "/")
+		}
+		if e.quota != nil {
+			s.UsedBytes, s.QuotaBytes = e.quota.Usage()
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// loadProvisioned restores the exports provisioned before a restart from
+// name, if it exists.
+func (x *exports) loadProvisioned(name string) error {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	x.configMu.Lock()
+	defer x.configMu.Unlock()
+	return json.Unmarshal(data, &x.provisioned)
+}
+
+// saveProvisioned replaces the provision_state file by the exports
+// provisioned, when there is one.
+func (x *exports) saveProvisioned() error {
+	name := x.config.ProvisionState
+	if name == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(x.provisioned, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// serveAdmin serves the provisioning API on l until ctx is done.
+func serveAdmin(ctx context.Context, l net.Listener, x *exports, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/exports", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, x.status())
+	})
+	mux.HandleFunc("/exports/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/exports/")
+		switch r.Method {
+		case http.MethodPut:
+			var ec ExportConfig
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&ec); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ec, err := x.provision(name, ec)
+			if err != nil {
+				http.Error(w, err.Error(), provisionErrorCode(err))
+				return
+			}
+			nfs.Log.Infof("provisioned %s as %s", ec.Dir, ec.Path)
+			writeJSON(w, http.StatusOK, exportStatus{Name: name, Path: ec.Path, Dir: ec.Dir, Provisioned: true, QuotaBytes: ec.QuotaBytes})
+		case http.MethodDelete:
+			if err := x.deprovision(name, r.URL.Query().Get("purge") == "true"); err != nil {
+				http.Error(w, err.Error(), provisionErrorCode(err))
+				return
+			}
+			nfs.Log.Infof("deprovisioned /%s", name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	srv := &http.Server{
+		Handler:           requireToken(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		nfs.Log.Errorf("admin server: %v", err)
+	}
+}
+
+// requireToken has requests to h give token as a bearer token, when set.
+func requireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func provisionErrorCode(err error) int {
+	switch {
+	case errors.Is(err, errNoExport):
+		return http.StatusNotFound
+	case errors.Is(err, errConfigured):
+		return http.StatusConflict
+	case errors.Is(err, errProvisioningOff):
+		return http.StatusNotImplemented
+	case errors.Is(err, errInvalidExport):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,12 @@
+//go:build !(darwin || freebsd || linux)
+
+package main
+
+import (
+	nfs "github.com/willscott/go-nfs"
+)
+
+// statfs leaves the free space to the server's defaults.
+func statfs(dir string, s *nfs.FSStat) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build darwin || freebsd || linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+
+	nfs "github.com/willscott/go-nfs"
+)
+
+// statfs fills in the free space and files of the filesystem holding dir.
+func statfs(dir string, s *nfs.FSStat) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return err
+	}
+	bsize := uint64(st.Bsize)
+	s.TotalSize = uint64(st.Blocks) * bsize
+	s.FreeSize = uint64(st.Bfree) * bsize
+	s.AvailableSize = uint64(st.Bavail) * bsize
+	s.TotalFiles = uint64(st.Files)
+	s.FreeFiles = uint64(st.Ffree)
+	s.AvailableFiles = uint64(st.Ffree)
+	return nil
+}
@@ -8,13 +8,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"reflect"
+	"time"
 
 	xdr2 "github.com/rasky/go-xdr/xdr2"
 	"github.com/willscott/go-nfs-client/nfs/rpc"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
+// maxAuthBytes is MAX_AUTH_BYTES of rfc5531.
+const maxAuthBytes = 400
+
 var (
 	// ErrInputInvalid is returned when input cannot be parsed
 	ErrInputInvalid = errors.New("invalid input")
@@ -22,13 +28,15 @@ var (
 	ErrAlreadySent = errors.New("response already started")
 )
 
-// ResponseCode is a combination of accept_stat and reject_stat.
+// ResponseCode is a combination of accept_stat and reject_stat. The codes
+// below ResponseCodeRPCMismatch are the accept_stat values of rfc5531.
 type ResponseCode uint32
 
 // ResponseCode Codes
 const (
 	ResponseCodeSuccess ResponseCode = iota
 	ResponseCodeProgUnavailable
+	ResponseCodeProgMismatch
 	ResponseCodeProcUnavailable
 	ResponseCodeGarbageArgs
 	ResponseCodeSystemErr
@@ -40,42 +48,92 @@ type conn struct {
 	*Server
 	writeSerializer chan []byte
 	net.Conn
+	// id numbers the connection among those of the process.
+	id uint64
+}
+
+// NetConn provides the connection calls are read from, as tls.Conn does,
+// for the connections given to Handlers to be unwrapped, such as by
+// ClientCertificate.
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
 }
 
+// serve handles the calls of the connection in turn. They are read by a
+// goroutine of their own, which ends the context of the call being handled
+// when the client disconnects, so that the backend can abandon work whose
+// reply can no longer be sent.
 func (c *conn) serve(ctx context.Context) {
 	connCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	c.writeSerializer = make(chan []byte, 1)
 	go c.serializeWrites(connCtx)
 
-	bio := bufio.NewReader(c.Conn)
-	for {
-		w, err := c.readRequestHeader(connCtx, bio)
-		if err != nil {
-			if err == io.EOF {
-				// Clean close.
-				c.Close()
-				return
-			}
-			return
+	requests := make(chan *response)
+	go c.readRequests(connCtx, cancel, requests)
+	for w := range requests {
+		err := c.handle(connCtx, w)
+		if w.refused || isStrike(w.err) {
+			c.strike(connCtx)
 		}
-		Log.Tracef("request: %v", w.req)
-		err = c.handle(connCtx, w)
+		c.Server.Trace.record(c.Conn.RemoteAddr(), w)
+		c.Server.clientStats.record(c.Conn.RemoteAddr(), w)
+		c.Server.health.record(c.Conn.LocalAddr().Network(), w)
 		respErr := w.finish(connCtx)
+		c.logSlow(w)
+		c.Server.inFlight.release(w.req.size)
 		if err != nil {
-			Log.Errorf("error handling req: %v", err)
+			Log.Errorf("error handling %v: %v", w.req, err)
 			// failure to handle at a level needing to close the connection.
 			c.Close()
 			return
 		}
 		if respErr != nil {
-			Log.Errorf("error sending response: %v", respErr)
+			Log.Errorf("error sending response to %v: %v", w.req, respErr)
 			c.Close()
 			return
 		}
 	}
 }
 
+// readRequests reads the calls of the connection into requests, each in full,
+// so that the connection is read while the previous call is handled. Once the
+// connection can't be read, it is closed and cancel is called.
+func (c *conn) readRequests(ctx context.Context, cancel context.CancelFunc, requests chan<- *response) {
+	defer close(requests)
+	defer cancel()
+	defer c.Close()
+
+	bio := bufio.NewReader(c.Conn)
+	for {
+		w, err := c.readRequestHeader(ctx, bio)
+		if err != nil {
+			if errors.Is(err, ErrInputInvalid) {
+				c.strike(ctx)
+			}
+			return
+		}
+		if c.Server.abuse.banned(c.Conn.RemoteAddr()) {
+			return
+		}
+		Log.Tracef("request: %v", w.req)
+		// Hold budget for the request before its body is read off the socket.
+		if err := c.Server.inFlight.acquire(ctx, w.req.size); err != nil {
+			return
+		}
+		if err := w.req.readBody(); err != nil {
+			c.Server.inFlight.release(w.req.size)
+			return
+		}
+		select {
+		case requests <- w:
+		case <-ctx.Done():
+			c.Server.inFlight.release(w.req.size)
+			return
+		}
+	}
+}
+
 func (c *conn) serializeWrites(ctx context.Context) {
 	// todo: maybe don't need the extra buffer
 	writer := bufio.NewWriter(c.Conn)
@@ -104,6 +162,10 @@ func (c *conn) serializeWrites(ctx context.Context) {
 			if n < len(msg) {
 				panic("todo: ensure writes complete fully.")
 			}
+			if c.Server.SocketOptions.BatchWrites && len(c.writeSerializer) > 0 {
+				// another reply is ready; let it share this write.
+				continue
+			}
 			if err = writer.Flush(); err != nil {
 				return
 			}
@@ -114,26 +176,83 @@ func (c *conn) serializeWrites(ctx context.Context) {
 // Handle a request. errors from this method indicate a failure to read or
 // write on the network stream, and trigger a disconnection of the connection.
 func (c *conn) handle(ctx context.Context, w *response) error {
-	handler := c.Server.handlerFor(w.req.Header.Prog, w.req.Header.Proc)
+	if w.req.Header.Prog == nfsServiceID && !c.Server.servesNFSVersion(w.req.Header.Vers) {
+		if err := w.drain(ctx); err != nil {
+			return err
+		}
+		return c.err(ctx, w, &ProgMismatchError{Low: nfs3Version, High: c.Server.maxNFSVersion()})
+	}
+	if w.req.Header.Prog == mountServiceID && (w.req.Header.Vers < mountVersion1 || w.req.Header.Vers > mountVersion) {
+		if err := w.drain(ctx); err != nil {
+			return err
+		}
+		return c.err(ctx, w, &ProgMismatchError{Low: mountVersion1, High: mountVersion})
+	}
+	if w.req.Header.Prog == portmapServiceID && c.Server.EnablePortmap && w.req.Header.Vers != portmapVersion {
+		if err := w.drain(ctx); err != nil {
+			return err
+		}
+		return c.err(ctx, w, &ProgMismatchError{Low: portmapVersion, High: portmapVersion})
+	}
+	handler := c.Server.handlerFor(w.req.Header.Prog, w.req.Header.Vers, w.req.Header.Proc)
 	if handler == nil {
-		Log.Errorf("No handler for %d.%d", w.req.Header.Prog, w.req.Header.Proc)
+		Log.Errorf("No handler for %v", w.req)
 		if err := w.drain(ctx); err != nil {
 			return err
 		}
 		return c.err(ctx, w, &ResponseCodeProcUnavailableError{})
 	}
-	appError := handler(ctx, w, c.Server.Handler)
+	if w.req.Header.Prog == nfsServiceID && w.req.Header.Vers == nfs3Version {
+		w.errorFmt = procErrorFormatter(NFSProcedure(w.req.Header.Proc))
+	}
+	ctx, callErr := c.callContext(ctx, w)
+	if callErr != nil {
+		if err := w.drain(ctx); err != nil {
+			return err
+		}
+		defer c.publishCall(ctx, w)
+		return c.err(ctx, w, callErr)
+	}
+	if w.op != nil {
+		// so that removing the export of the call waits for it.
+		leave, err := c.Server.exports.enter(w.op.Filesystem)
+		if err != nil {
+			if err := w.drain(ctx); err != nil {
+				return err
+			}
+			defer c.publishCall(ctx, w)
+			return c.err(ctx, w, err)
+		}
+		defer leave()
+		if err := c.Server.breakDelegations(w.op); err != nil {
+			if err := w.drain(ctx); err != nil {
+				return err
+			}
+			defer c.publishCall(ctx, w)
+			return c.err(ctx, w, err)
+		}
+	}
+	w.dispatched = time.Now()
+	appError := c.dispatch(ctx, w, handler)
+	w.returned = time.Now()
+	if modifiesExport(&w.req.Header) {
+		c.Server.attrCache.clear()
+	}
+	if appError == nil && w.err == nil {
+		c.publishOperation(ctx, w)
+	}
 	if drainErr := w.drain(ctx); drainErr != nil {
 		return drainErr
 	}
+	defer c.publishCall(ctx, w)
 	if appError != nil && !w.responded {
-		Log.Errorf("call to %+v failed: %v", handler, appError)
+		Log.Errorf("%v failed: %v", w.req, appError)
 		if err := c.err(ctx, w, appError); err != nil {
 			return err
 		}
 	}
 	if !w.responded {
-		Log.Errorf("Handler did not indicate response status via writing or erroring")
+		Log.Errorf("Handler did not indicate response status of %v via writing or erroring", w.req)
 		if err := c.err(ctx, w, &ResponseCodeSystemError{}); err != nil {
 			return err
 		}
@@ -151,12 +270,25 @@ func (c *conn) err(ctx context.Context, w *response, err error) error {
 	if w.err == nil {
 		w.err = err
 	}
+	if c.Server.OnError != nil {
+		if _, ok := RequestIDFromContext(ctx); !ok {
+			// for calls refused before their context was made.
+			ctx = c.requestContext(ctx, w)
+		}
+		c.Server.OnError(ctx, err)
+	}
 
 	if w.responded {
 		return nil
 	}
 
 	rpcErr := w.errorFmt(err)
+	// arguments that can't be decoded are refused whatever the procedure,
+	// even where it wraps the error in a status of its own.
+	var garbage *ResponseCodeGarbageArgsError
+	if errors.As(err, &garbage) {
+		rpcErr = garbage
+	}
 	if writeErr := w.writeHeader(rpcErr.Code()); writeErr != nil {
 		return writeErr
 	}
@@ -167,17 +299,39 @@ func (c *conn) err(ctx context.Context, w *response, err error) error {
 
 type request struct {
 	xid uint32
+	// id is the request ID of the call, as given by RequestIDFromContext.
+	id string
 	rpc.Header
 	Body io.Reader
+	// size is the length of the request frame.
+	size int64
+}
+
+// readBody reads the rest of the call off the connection. The buffer grows
+// as the call arrives, rather than by the length the record claims.
+func (r *request) readBody() error {
+	lr, ok := r.Body.(*io.LimitedReader)
+	if !ok {
+		return ErrInputInvalid
+	}
+	body, err := io.ReadAll(lr)
+	if err != nil {
+		return err
+	}
+	if lr.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	r.Body = &io.LimitedReader{R: bytes.NewReader(body), N: int64(len(body))}
+	return nil
 }
 
 func (r *request) String() string {
 	if r.Header.Prog == nfsServiceID {
-		return fmt.Sprintf("RPC #%d (nfs.%s)", r.xid, NFSProcedure(r.Header.Proc))
+		return fmt.Sprintf("RPC %s (nfs.%s)", r.id, NFSProcedure(r.Header.Proc))
 	} else if r.Header.Prog == mountServiceID {
-		return fmt.Sprintf("RPC #%d (mount.%s)", r.xid, MountProcedure(r.Header.Proc))
+		return fmt.Sprintf("RPC %s (mount.%s)", r.id, MountProcedure(r.Header.Proc))
 	}
-	return fmt.Sprintf("RPC #%d (%d.%d)", r.xid, r.Header.Prog, r.Header.Proc)
+	return fmt.Sprintf("RPC %s (%d.%d)", r.id, r.Header.Prog, r.Header.Proc)
 }
 
 type response struct {
@@ -187,6 +341,24 @@ type response struct {
 	err       error
 	errorFmt  func(error) RPCError
 	req       *request
+	// refused is set by procedures that refuse a call without an error, such
+	// as a denied MNT.
+	refused bool
+	// op is the operation the call was found to act on before dispatch,
+	// mount the request of a MNT or UMNT call, and flavors those advertised
+	// to a MNT.
+	op      *Operation
+	mount   *MountRequest
+	flavors []AuthFlavor
+	// cred is the identity the client made the call as, before squashing.
+	cred *AuthUnix
+	// trace captures the call for Server.Trace, read since start.
+	trace *traceBuffer
+	start time.Time
+	// dispatched and returned are when the procedure of the call was
+	// dispatched and returned, for Server.SlowOperationThreshold.
+	dispatched time.Time
+	returned   time.Time
 }
 
 func (w *response) writeXdrHeader() error {
@@ -221,14 +393,20 @@ func (w *response) writeHeader(code ResponseCode) error {
 		return err
 	}
 
-	if status == rpc.MsgAccepted {
-		// Write opaque_auth header.
-		err = xdr.Write(w.writer, &rpc.AuthNull)
-		if err != nil {
-			return err
+	if status == rpc.MsgDenied {
+		// rejected replies carry a reject_stat rather than an accept_stat.
+		rejectStat := uint32(0) // RPC_MISMATCH
+		if code == ResponseCodeAuthError {
+			rejectStat = 1 // AUTH_ERROR
 		}
+		return xdr.Write(w.writer, &rejectStat)
 	}
 
+	// Write opaque_auth header.
+	err = xdr.Write(w.writer, &rpc.AuthNull)
+	if err != nil {
+		return err
+	}
 	return xdr.Write(w.writer, &code)
 }
 
@@ -251,6 +429,89 @@ func (w *response) Write(dat []byte) error {
 	return nil
 }
 
+// peek reads the start of the request body with fn, leaving what it reads in
+// place to be read again by the procedure.
+func (w *response) peek(fn func(r io.Reader) error) error {
+	body, ok := w.req.Body.(*io.LimitedReader)
+	if !ok {
+		return ErrInputInvalid
+	}
+	var prefix bytes.Buffer
+	defer func() {
+		w.req.Body = &io.LimitedReader{R: io.MultiReader(&prefix, body), N: int64(prefix.Len()) + body.N}
+	}()
+	return fn(io.TeeReader(body, &prefix))
+}
+
+// readHandle reads a file handle from the arguments of an NFS procedure.
+func readHandle(r io.Reader) ([]byte, error) {
+	return readBoundedOpaque(r, FHSize)
+}
+
+// readBoundedOpaque reads a variable length opaque of at most max bytes.
+// Longer or truncated opaques are GARBAGE_ARGS.
+func readBoundedOpaque(r io.Reader, max uint32) ([]byte, error) {
+	size, err := xdr.ReadUint32(r)
+	if err != nil {
+		return nil, &ResponseCodeGarbageArgsError{err}
+	}
+	if size > max {
+		return nil, &ResponseCodeGarbageArgsError{ErrInputInvalid}
+	}
+	buf := make([]byte, (size+3)&^3)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, &ResponseCodeGarbageArgsError{err}
+	}
+	return buf[:size], nil
+}
+
+// argLimits bound the variable length fields of the arguments decoded by
+// readArgs, by the name given in their xdrmax tag. Names are bounded as the
+// targets of links are rather than by PathNameMax, so that those a little
+// too long are still refused as NAMETOOLONG.
+var argLimits = map[string]uint{
+	"handle": FHSize,
+	"name":   pathMax,
+}
+
+// readArgs decodes v from the arguments of a call. The decoder allocates the
+// declared length of a variable length item before reading it, so lengths
+// are bounded by what remains of the call, and the fields of a struct by
+// their xdrmax tag. Arguments that can't be decoded are GARBAGE_ARGS.
+func readArgs(r io.Reader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return decodeArg(r, v, math.MaxInt32)
+	}
+	st := rv.Elem()
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		max := uint(math.MaxInt32)
+		if name, ok := f.Tag.Lookup("xdrmax"); ok {
+			max = argLimits[name]
+		}
+		if err := decodeArg(r, st.Field(i).Addr().Interface(), max); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// decodeArg decodes v, with items of at most max bytes or elements.
+func decodeArg(r io.Reader, v interface{}, max uint) error {
+	if lr, ok := r.(*io.LimitedReader); ok && lr.N < int64(max) {
+		// a limit of zero would be none at all.
+		max = uint(lr.N) + 1
+	}
+	if _, err := xdr2.UnmarshalLimited(r, v, max); err != nil {
+		return &ResponseCodeGarbageArgsError{err}
+	}
+	return nil
+}
+
 // drain reads the rest of the request frame if not consumed by the handler.
 func (w *response) drain(ctx context.Context) error {
 	if reader, ok := w.req.Body.(*io.LimitedReader); ok {
@@ -296,6 +557,10 @@ func (c *conn) readRequestHeader(ctx context.Context, reader *bufio.Reader) (w *
 	}
 
 	r := io.LimitedReader{R: reader, N: int64(reqLen)}
+	trace := c.Server.Trace.newBuffer()
+	if trace != nil {
+		r.R = io.TeeReader(reader, trace)
+	}
 
 	xid, err := xdr.ReadUint32(&r)
 	if err != nil {
@@ -310,11 +575,13 @@ func (c *conn) readRequestHeader(ctx context.Context, reader *bufio.Reader) (w *
 	}
 
 	req := request{
-		xid,
-		rpc.Header{},
-		&r,
+		xid:  xid,
+		id:   requestID(c.id, xid),
+		Body: &r,
+		size: int64(reqLen),
 	}
-	if err = xdr.Read(&r, &req.Header); err != nil {
+	// the credential and verifier are opaque_auth, of at most 400 bytes.
+	if _, err = xdr2.UnmarshalLimited(&r, &req.Header, maxAuthBytes); err != nil {
 		return nil, err
 	}
 
@@ -324,6 +591,8 @@ func (c *conn) readRequestHeader(ctx context.Context, reader *bufio.Reader) (w *
 		errorFmt: basicErrorFormatter,
 		// TODO: use a pool for these.
 		writer: bytes.NewBuffer([]byte{}),
+		trace:  trace,
+		start:  time.Now(),
 	}
 	return w, nil
 }
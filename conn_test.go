@@ -0,0 +1,159 @@
+package nfs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// blockingStatHandler blocks FSSTAT until its context is done.
+type blockingStatHandler struct {
+	nfs.Handler
+	started   chan struct{}
+	cancelled chan struct{}
+}
+
+func (h *blockingStatHandler) FSStat(ctx context.Context, fs billy.Filesystem, s *nfs.FSStat) error {
+	close(h.started)
+	<-ctx.Done()
+	close(h.cancelled)
+	return ctx.Err()
+}
+
+func TestDisconnectCancelsCall(t *testing.T) {
+	mem := memfs.New()
+	handler := &blockingStatHandler{
+		Handler:   helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		started:   make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+	srv := nfstest.Serve(t, handler)
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var args bytes.Buffer
+	_ = xdr.Write(&args, handler.ToHandle(mem, []string{}))
+	msg := callMessage(nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureFSStat), args.Bytes())
+	var mark [4]byte
+	binary.BigEndian.PutUint32(mark[:], uint32(len(msg))|1<<31)
+	if _, err := conn.Write(append(mark[:], msg...)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handler.started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("FSSTAT was not called")
+	}
+	_ = conn.Close()
+	select {
+	case <-handler.cancelled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the context of the call to be cancelled when the client disconnected")
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/dir", 0755)
+
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	_, root, err := target.Lookup("/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isGarbage := func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "GARBAGE_ARGS")
+	}
+
+	// names over the length decoded are refused before they are read.
+	if _, _, err := nfstest.Lookup(target.Target, root, strings.Repeat("a", 4097)); !isGarbage(err) {
+		t.Fatalf("lookup of an overlong name: expected GARBAGE_ARGS, got %v", err)
+	}
+	long := make([]byte, nfs.FHSize+1)
+	if _, _, err := nfstest.Lookup(target.Target, long, "dir"); !isGarbage(err) {
+		t.Fatalf("lookup in an overlong handle: expected GARBAGE_ARGS, got %v", err)
+	}
+	if _, err := target.GetAttr(long); !isGarbage(err) {
+		t.Fatalf("getattr of an overlong handle: expected GARBAGE_ARGS, got %v", err)
+	}
+
+	// the connection serves calls after refusing those.
+	if _, _, err := nfstest.Lookup(target.Target, root, "dir"); err != nil {
+		t.Fatalf("lookup after garbage: %v", err)
+	}
+}
+
+func TestSocketOptions(t *testing.T) {
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 1024),
+		SocketOptions: nfs.SocketOptions{
+			DisableNoDelay: true,
+			ReadBuffer:     64 * 1024,
+			WriteBuffer:    64 * 1024,
+			BatchWrites:    true,
+		},
+	})
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// calls sent together have their replies batched, none of which may be
+	// held back.
+	const calls = 16
+	var pipelined []byte
+	msg := callMessage(nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureNull), nil)
+	for i := 0; i < calls; i++ {
+		var mark [4]byte
+		binary.BigEndian.PutUint32(mark[:], uint32(len(msg))|1<<31)
+		pipelined = append(pipelined, mark[:]...)
+		pipelined = append(pipelined, msg...)
+	}
+	if _, err := conn.Write(pipelined); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < calls; i++ {
+		var mark, xid uint32
+		if err := binary.Read(conn, binary.BigEndian, &mark); err != nil {
+			t.Fatalf("expected %d replies, got %d: %v", calls, i, err)
+		}
+		reply := make([]byte, mark&^(1<<31))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("expected %d replies, got %d: %v", calls, i, err)
+		}
+		if err := binary.Read(bytes.NewReader(reply), binary.BigEndian, &xid); err != nil || xid != 0x1234 {
+			t.Fatalf("expected the reply to the call, got xid %x: %v", xid, err)
+		}
+	}
+}
+
+// callMessage builds an RPC call message, without its record mark.
+func callMessage(prog, vers, proc uint32, args []byte) []byte {
+	var msg bytes.Buffer
+	_ = xdr.Write(&msg, uint32(0x1234))
+	_ = xdr.Write(&msg, uint32(0))
+	_ = xdr.Write(&msg, &rpc.Header{Rpcvers: 2, Prog: prog, Vers: vers, Proc: proc, Cred: rpc.AuthNull, Verf: rpc.AuthNull})
+	msg.Write(args)
+	return msg.Bytes()
+}
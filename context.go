@@ -0,0 +1,56 @@
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// The calls served are given contexts carrying who made them and what they
+// are made against, for Handlers, and the filesystems they serve, to act on
+// as they see fit, such as to serve each user a filesystem of their own from
+// Mount. CredentialsFromContext provides the identity of the call.
+
+type clientAddrKey struct{}
+type requestIDKey struct{}
+type exportKey struct{}
+
+// connIDs numbers the connections of the process, to tell apart the calls of
+// clients reusing xids.
+var connIDs atomic.Uint64
+
+// ClientAddrFromContext returns the address of the client making a call.
+func ClientAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey{}).(net.Addr)
+	return addr, ok
+}
+
+// RequestIDFromContext returns the ID of a call, which is unique among those
+// served by the process: the number of its connection and its xid. It is the
+// ID logs name the call by, and that its trace records, events and errors
+// carry.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// ExportFromContext returns the filesystem an NFSv3 call is made against,
+// once its file handle is resolved.
+func ExportFromContext(ctx context.Context) (billy.Filesystem, bool) {
+	fs, ok := ctx.Value(exportKey{}).(billy.Filesystem)
+	return fs, ok && fs != nil
+}
+
+// requestContext attaches the client and ID of the call w to ctx.
+func (c *conn) requestContext(ctx context.Context, w *response) context.Context {
+	ctx = context.WithValue(ctx, clientAddrKey{}, c.Conn.RemoteAddr())
+	return context.WithValue(ctx, requestIDKey{}, w.req.id)
+}
+
+// requestID provides the request ID of the call xid of connection conn.
+func requestID(conn uint64, xid uint32) string {
+	return fmt.Sprintf("%x-%08x", conn, xid)
+}
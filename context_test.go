@@ -0,0 +1,159 @@
+package nfs_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// mountContext records the context of the calls to Mount.
+type mountContext struct {
+	nfs.Handler
+	mu   sync.Mutex
+	addr net.Addr
+	cred *nfs.AuthUnix
+}
+
+func (h *mountContext) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	h.mu.Lock()
+	h.addr, _ = nfs.ClientAddrFromContext(ctx)
+	h.cred, _ = nfs.CredentialsFromContext(ctx)
+	h.mu.Unlock()
+	return h.Handler.Mount(ctx, conn, req)
+}
+
+func TestRequestContext(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/file", []byte("hello"), 0644)
+
+	handler := &mountContext{Handler: helpers.NewNullAuthHandler(mem)}
+	var mu sync.Mutex
+	ids := map[string]bool{}
+	var exports []billy.Filesystem
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler: helpers.NewCachingHandler(handler, 1024),
+		Authorize: func(ctx context.Context, op *nfs.Operation) nfs.NFSStatus {
+			mu.Lock()
+			defer mu.Unlock()
+			if id, ok := nfs.RequestIDFromContext(ctx); ok {
+				ids[id] = true
+			}
+			if fs, ok := nfs.ExportFromContext(ctx); ok {
+				exports = append(exports, fs)
+			}
+			return nfs.NFSStatusOk
+		},
+	})
+	target := srv.Mount(t, "/", rpc.NewAuthUnix("client", 1000, 100).Auth())
+
+	if _, err := target.Getattr("/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Getattr("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	handler.mu.Lock()
+	if handler.addr == nil {
+		t.Fatal("expected the address of the client to be given to Mount")
+	}
+	if handler.cred == nil || handler.cred.UID != 1000 {
+		t.Fatalf("expected the credentials of the client to be given to Mount: %+v", handler.cred)
+	}
+	handler.mu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exports) < 2 || len(ids) != len(exports) {
+		t.Fatalf("expected each call to have its own ID, got %d for %d calls", len(ids), len(exports))
+	}
+	for _, fs := range exports {
+		if fs != billy.Filesystem(mem) {
+			t.Fatalf("expected calls to carry their export, got %v", fs)
+		}
+	}
+}
+
+func TestRequestIDCorrelation(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/secret", []byte("hello"), 0644)
+
+	var mu sync.Mutex
+	var authorized, failed []string
+	var events []nfs.Event
+	var trace bytes.Buffer
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		Trace:   nfs.NewTraceRecorder(&trace, 0),
+		Authorize: func(ctx context.Context, op *nfs.Operation) nfs.NFSStatus {
+			if op.Procedure != nfs.NFSProcedureLookup || strings.Join(op.Path, "/") != "secret" {
+				return nfs.NFSStatusOk
+			}
+			id, _ := nfs.RequestIDFromContext(ctx)
+			mu.Lock()
+			authorized = append(authorized, id)
+			mu.Unlock()
+			return nfs.NFSStatusAccess
+		},
+		Events: nfs.EventSubscriberFunc(func(e nfs.Event) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		}),
+		OnError: func(ctx context.Context, err error) {
+			id, _ := nfs.RequestIDFromContext(ctx)
+			mu.Lock()
+			failed = append(failed, id)
+			mu.Unlock()
+		},
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if _, _, err := target.Lookup("/secret", false); !nfstest.IsStatus(err, nfs.NFSStatusAccess) {
+		t.Fatalf("expected the lookup to be refused, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(authorized) != 1 || authorized[0] == "" {
+		t.Fatalf("expected the refused call to have a request ID, got %q", authorized)
+	}
+	id := authorized[0]
+	if len(failed) != 1 || failed[0] != id {
+		t.Fatalf("expected the error of %s to carry its request ID, got %q", id, failed)
+	}
+	var denied []string
+	for _, e := range events {
+		if e.Type == nfs.EventPermissionDenied {
+			denied = append(denied, e.RequestID)
+		}
+	}
+	if len(denied) != 1 || denied[0] != id {
+		t.Fatalf("expected the event of %s to carry its request ID, got %q", id, denied)
+	}
+	records, err := nfs.ReadTrace(&trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traced := 0
+	for _, r := range records {
+		if r.RequestID == id {
+			traced++
+		}
+	}
+	if traced != 2 {
+		t.Fatalf("expected the call of %s and its reply to be traced with its request ID, got %d records", id, traced)
+	}
+}
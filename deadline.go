@@ -0,0 +1,58 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var errTimeout = errors.New("procedure timed out")
+
+// timeoutFor is the timeout of an NFSv3 call, or zero when it has none.
+func (s *Server) timeoutFor(req *request) time.Duration {
+	if req.Header.Prog != nfsServiceID || req.Header.Vers != nfs3Version {
+		return 0
+	}
+	if d, ok := s.OperationTimeouts[NFSProcedure(req.Header.Proc)]; ok {
+		return d
+	}
+	return s.OperationTimeout
+}
+
+// dispatch runs the procedure of a call. A call with a timeout runs in a
+// goroutine of its own, on copies of the call and response, so that a
+// procedure still blocked in the backend when the timeout passes can be
+// abandoned: its context is cancelled, and the call is failed with
+// NFS3ERR_JUKEBOX, which clients retry later.
+func (c *conn) dispatch(ctx context.Context, w *response, handler HandleFunc) error {
+	timeout := c.Server.timeoutFor(w.req)
+	if timeout <= 0 {
+		return handler(ctx, w, c.Server.handler())
+	}
+	body, err := io.ReadAll(w.req.Body)
+	if err != nil {
+		return err
+	}
+	req := *w.req
+	req.Body = &io.LimitedReader{R: bytes.NewReader(body), N: int64(len(body))}
+	hw := *w
+	hw.req = &req
+	hw.writer = bytes.NewBuffer(append([]byte{}, w.writer.Bytes()...))
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- handler(ctx, &hw, c.Server.handler())
+	}()
+	select {
+	case err := <-done:
+		*w = hw
+		return err
+	case <-ctx.Done():
+		Log.Warnf("%v from %v abandoned after %v", w.req, c.Conn.RemoteAddr(), timeout)
+		return &NFSStatusError{NFSStatusJukebox, errTimeout}
+	}
+}
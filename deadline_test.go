@@ -0,0 +1,63 @@
+package nfs_test
+
+import (
+	"testing"
+	"time"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestOperationTimeout(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/slow", []byte("x"), 0644)
+	_ = billyutil.WriteFile(mem, "/fast", []byte("x"), 0644)
+	fs := &blockingFS{Filesystem: mem, release: make(chan struct{})}
+	defer close(fs.release)
+
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:           helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024),
+		OperationTimeout:  time.Minute,
+		OperationTimeouts: map[nfs.NFSProcedure]time.Duration{nfs.NFSProcedureLookup: 50 * time.Millisecond},
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client doesn't know JUKEBOX, so the status is read from the reply.
+	type lookupArgs struct {
+		rpc.Header
+		Handle   []byte
+		Filename string
+	}
+	res, err := target.Call(&lookupArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Vers:    nfsc.Nfs3Vers,
+			Prog:    nfsc.Nfs3Prog,
+			Proc:    uint32(nfs.NFSProcedureLookup),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle:   root,
+		Filename: "slow",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := xdr.ReadUint32(res); err != nil || status != uint32(nfs.NFSStatusJukebox) {
+		t.Fatalf("expected a hung lookup to fail with JUKEBOX, got %d: %v", status, err)
+	}
+	if _, _, err := target.Lookup("/fast", false); err != nil {
+		t.Fatalf("expected the connection to keep serving calls: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package nfs
+
+import (
+	"container/list"
+	"sync"
+)
+
+// dirCookieLimit bounds the cookies remembered for listings of filesystems
+// listing a part at a time, as ListingFilesystem and PagedFilesystem do. Continuing from a forgotten cookie fails with
+// NFS3ERR_BAD_COOKIE, and clients then list the directory afresh.
+const dirCookieLimit = 1 << 16
+
+// dirCookies remembers the entries cookies were given for, least recently
+// used first to be forgotten.
+type dirCookies struct {
+	mu      sync.Mutex
+	last    uint64
+	order   *list.List
+	cookies map[uint64]*list.Element
+	// listings are the change attributes of directories read in full when
+	// they were listed, by the cookie verifier of the listing, least
+	// recently used first to be forgotten.
+	listingOrder *list.List
+	listings     map[uint64]*list.Element
+}
+
+// dirCookie is where a listing continues after the entry a cookie was given
+// for: the page of entries at token, past its first skip entries.
+type dirCookie struct {
+	cookie uint64
+	// dir is the handle of the directory listed.
+	dir   string
+	token string
+	skip  int
+	// pos is the number of entries listed up to and including this one.
+	pos int
+}
+
+func newDirCookies() *dirCookies {
+	// cookies 0 and 1 are those of '.' and '..'.
+	return &dirCookies{last: 1, order: list.New(), cookies: make(map[uint64]*list.Element),
+		listingOrder: list.New(), listings: make(map[uint64]*list.Element)}
+}
+
+// dirListing is the change attribute of a directory when the listing of a
+// cookie verifier was made.
+type dirListing struct {
+	verifier uint64
+	change   uint64
+}
+
+// issue provides a cookie to continue the listing of dir from the page at
+// token, past its first skip entries.
+func (d *dirCookies) issue(dir, token string, skip, pos int) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.last++
+	d.cookies[d.last] = d.order.PushFront(dirCookie{d.last, dir, token, skip, pos})
+	for d.order.Len() > dirCookieLimit {
+		old := d.order.Remove(d.order.Back()).(dirCookie)
+		delete(d.cookies, old.cookie)
+	}
+	return d.last
+}
+
+// resume provides where the listing of dir a cookie was given for continues.
+func (d *dirCookies) resume(dir string, cookie uint64) (dirCookie, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.cookies[cookie]
+	if !ok || e.Value.(dirCookie).dir != dir {
+		return dirCookie{}, false
+	}
+	d.order.MoveToFront(e)
+	return e.Value.(dirCookie), true
+}
+
+// listed records the change attribute of the directory a listing with
+// verifier was made of.
+func (d *dirCookies) listed(verifier, change uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.listings[verifier]; ok {
+		d.listingOrder.Remove(e)
+	}
+	d.listings[verifier] = d.listingOrder.PushFront(dirListing{verifier, change})
+	for d.listingOrder.Len() > dirCookieLimit {
+		old := d.listingOrder.Remove(d.listingOrder.Back()).(dirListing)
+		delete(d.listings, old.verifier)
+	}
+}
+
+// unchanged reports whether the directory a listing with verifier was made
+// of still has the change attribute it had then. Listings forgotten since
+// are taken as changed.
+func (d *dirCookies) unchanged(verifier, change uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.listings[verifier]
+	if !ok || e.Value.(dirListing).change != change {
+		return false
+	}
+	d.listingOrder.MoveToFront(e)
+	return true
+}
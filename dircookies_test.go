@@ -0,0 +1,75 @@
+package nfs_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// shuffledFS lists directories in a different order each time.
+type shuffledFS struct {
+	billy.Filesystem
+}
+
+func (s shuffledFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := s.Filesystem.ReadDir(name)
+	rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	return entries, err
+}
+
+func TestStableDirCookies(t *testing.T) {
+	for _, stable := range []bool{false, true} {
+		mem := memfs.New()
+		for i := 0; i < 300; i++ {
+			if err := billyutil.WriteFile(mem, fmt.Sprintf("/dir/%04d", i), nil, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cache := helpers.NewCachingHandler(helpers.NewNullAuthHandler(shuffledFS{mem}), 1024).(*helpers.CachingHandler)
+		srv := nfstest.Start(t, &nfs.Server{
+			Handler:          cache,
+			StableDirCookies: stable,
+		})
+		target := srv.Mount(t, "/", rpc.AuthNull)
+		if entries, err := nfstest.ReadDir(target.Target, "/dir"); err != nil || len(entries) != 300 {
+			t.Fatalf("expected the listing in any order to be paged through, got %d: %v", len(entries), err)
+		}
+
+		_, fh, err := target.Lookup("/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, verf, _, err := nfstest.ReadDirPage(target.Target, fh, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := page[len(page)-1]
+		if err := mem.Remove("/dir/0000"); err != nil {
+			t.Fatal(err)
+		}
+		// as the directory changes behind the server.
+		cache.InvalidateListing(mem, []string{"dir"})
+		rest, _, _, err := nfstest.ReadDirPage(target.Target, fh, last.Cookie, verf)
+		if !stable {
+			if !nfstest.IsStatus(err, nfs.NFSStatusBadCookie) {
+				t.Fatalf("expected a continued listing of a changed directory to be refused, got %v", err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		} else if want := fmt.Sprintf("%04d", len(page)-2); rest[0].FileName != want {
+			t.Fatalf("expected the listing to continue with %s, got %s", want, rest[0].FileName)
+		}
+		target.Close()
+		srv.Close()
+	}
+}
@@ -1,10 +1,16 @@
 package nfs
 
 import (
+	"bytes"
+	"context"
 	"encoding"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/go-git/go-billy/v5"
 )
 
 // RPCError provides the error interface for errors thrown by
@@ -90,7 +96,7 @@ func (a *AuthError) Error() string {
 // MarshalBinary sends the specific auth status
 func (a *AuthError) MarshalBinary() (data []byte, err error) {
 	var resp [4]byte
-	binary.LittleEndian.PutUint32(resp[:], uint32(a.AuthStat))
+	binary.BigEndian.PutUint32(resp[:], uint32(a.AuthStat))
 	return resp[:], nil
 }
 
@@ -112,8 +118,32 @@ func (r *RPCMismatchError) Error() string {
 // MarshalBinary sends the specific rpc mismatch range
 func (r *RPCMismatchError) MarshalBinary() (data []byte, err error) {
 	var resp [8]byte
-	binary.LittleEndian.PutUint32(resp[0:4], uint32(r.Low))
-	binary.LittleEndian.PutUint32(resp[4:8], uint32(r.High))
+	binary.BigEndian.PutUint32(resp[0:4], uint32(r.Low))
+	binary.BigEndian.PutUint32(resp[4:8], uint32(r.High))
+	return resp[:], nil
+}
+
+// ProgMismatchError is an RPCError for calls to an unsupported version of a
+// program.
+type ProgMismatchError struct {
+	Low  uint32
+	High uint32
+}
+
+// Code for ProgMismatchError is ResponseCodeProgMismatch
+func (p *ProgMismatchError) Code() ResponseCode {
+	return ResponseCodeProgMismatch
+}
+
+func (p *ProgMismatchError) Error() string {
+	return fmt.Sprintf("Program Mismatch: Expected version between %d and %d.", p.Low, p.High)
+}
+
+// MarshalBinary sends the supported version range
+func (p *ProgMismatchError) MarshalBinary() (data []byte, err error) {
+	var resp [8]byte
+	binary.BigEndian.PutUint32(resp[0:4], p.Low)
+	binary.BigEndian.PutUint32(resp[4:8], p.High)
 	return resp[:], nil
 }
 
@@ -135,6 +165,34 @@ func (r *ResponseCodeProcUnavailableError) MarshalBinary() (data []byte, err err
 	return []byte{}, nil
 }
 
+// ResponseCodeGarbageArgsError is an RPCError for calls whose arguments can't
+// be decoded, or hold fields longer than they may be.
+type ResponseCodeGarbageArgsError struct {
+	WrappedErr error
+}
+
+// Code for ResponseCodeGarbageArgsError is ResponseCodeGarbageArgs
+func (r *ResponseCodeGarbageArgsError) Code() ResponseCode {
+	return ResponseCodeGarbageArgs
+}
+
+func (r *ResponseCodeGarbageArgsError) Error() string {
+	if r.WrappedErr == nil {
+		return "The arguments of the call could not be decoded"
+	}
+	return fmt.Sprintf("The arguments of the call could not be decoded: %v", r.WrappedErr)
+}
+
+// MarshalBinary - this error has no associated body
+func (r *ResponseCodeGarbageArgsError) MarshalBinary() (data []byte, err error) {
+	return []byte{}, nil
+}
+
+// Unwrap unpacks wrapped errors
+func (r *ResponseCodeGarbageArgsError) Unwrap() error {
+	return r.WrappedErr
+}
+
 // ResponseCodeSystemError is an RPCError
 type ResponseCodeSystemError struct {
 }
@@ -210,9 +268,14 @@ func (s *StatusErrorWithBody) MarshalBinary() (data []byte, err error) {
 
 // errFormatterWithBody appends a provided body to errors
 func errFormatterWithBody(body []byte) func(err error) RPCError {
+	return errFormatterWithBodyFunc(func() []byte { return body[:] })
+}
+
+// errFormatterWithBodyFunc appends a body generated at the time of the error.
+func errFormatterWithBodyFunc(body func() []byte) func(err error) RPCError {
 	return func(err error) RPCError {
 		if nerr, ok := err.(*NFSStatusError); ok {
-			return &StatusErrorWithBody{*nerr, body[:]}
+			return &StatusErrorWithBody{*nerr, body()}
 		}
 		var rErr RPCError
 		if errors.As(err, &rErr) {
@@ -227,4 +290,167 @@ var (
 	opAttrErrorFormatter  = errFormatterWithBody(opAttrErrorBody[:])
 	wccDataErrorBody      = [8]byte{}
 	wccDataErrorFormatter = errFormatterWithBody(wccDataErrorBody[:])
+	doubleWccErrorBody    = [16]byte{}
+	linkErrorBody         = [12]byte{}
 )
+
+// procErrorFormatter provides the error formatter matching the failure body
+// of an NFS procedure, for failures before the procedure sets its own.
+func procErrorFormatter(proc NFSProcedure) func(err error) RPCError {
+	switch proc {
+	case NFSProcedureSetAttr, NFSProcedureWrite, NFSProcedureCreate, NFSProcedureMkDir,
+		NFSProcedureSymlink, NFSProcedureMkNod, NFSProcedureRemove, NFSProcedureRmDir,
+		NFSProcedureCommit:
+		return wccDataErrorFormatter
+	case NFSProcedureRename:
+		return errFormatterWithBody(doubleWccErrorBody[:])
+	case NFSProcedureLink:
+		return errFormatterWithBody(linkErrorBody[:])
+	case NFSProcedureLookup, NFSProcedureAccess, NFSProcedureReadlink, NFSProcedureRead,
+		NFSProcedureReadDir, NFSProcedureReadDirPlus, NFSProcedureFSStat, NFSProcedureFSInfo,
+		NFSProcedurePathConf:
+		return opAttrErrorFormatter
+	}
+	return basicErrorFormatter
+}
+
+// opAttrErrorFormatterFor reports the current attributes of an object with a
+// failure.
+func opAttrErrorFormatterFor(ctx context.Context, fs billy.Filesystem, path []string) func(err error) RPCError {
+	return errFormatterWithBodyFunc(func() []byte {
+		writer := bytes.NewBuffer([]byte{})
+		if err := WritePostOpAttrs(writer, tryStat(ctx, fs, path)); err != nil {
+			return opAttrErrorBody[:]
+		}
+		return writer.Bytes()
+	})
+}
+
+// wccObject is a file or directory whose attributes are reported as wcc_data.
+type wccObject struct {
+	fs   billy.Filesystem
+	path []string
+	pre  *FileCacheAttribute
+}
+
+// wccErrorFormatter reports the wcc_data of each object with a failure, so
+// that a failed mutation still lets clients revalidate their caches.
+func wccErrorFormatter(ctx context.Context, objs ...wccObject) func(err error) RPCError {
+	return errFormatterWithBodyFunc(func() []byte {
+		writer := bytes.NewBuffer([]byte{})
+		for _, o := range objs {
+			if err := WriteWcc(writer, o.pre, tryStat(ctx, o.fs, o.path)); err != nil {
+				return make([]byte, len(wccDataErrorBody)*len(objs))
+			}
+		}
+		return writer.Bytes()
+	})
+}
+
+var (
+	// ErrNoSpace can be returned by a filesystem when an operation fails for
+	// lack of space. It is reported to clients as NFS3ERR_NOSPC.
+	ErrNoSpace = errors.New("no space left on device")
+	// ErrQuotaExceeded can be returned by a filesystem when an operation would
+	// exceed the caller's quota. It is reported to clients as NFS3ERR_DQUOT.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// StatusFromError determines the NFSStatus best describing an error returned
+// by a backing filesystem. fallback is used when nothing more specific is
+// known about the failure.
+func StatusFromError(err error, fallback NFSStatus) NFSStatus {
+	var nerr *NFSStatusError
+	if errors.As(err, &nerr) {
+		return nerr.NFSStatus
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if s, ok := errnoStatus(errno); ok {
+			return s
+		}
+	}
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return NFSStatusNoEnt
+	case errors.Is(err, os.ErrExist):
+		return NFSStatusExist
+	case errors.Is(err, os.ErrPermission), errors.Is(err, billy.ErrCrossedBoundary):
+		return NFSStatusAccess
+	case errors.Is(err, os.ErrInvalid):
+		return NFSStatusInval
+	case errors.Is(err, billy.ErrReadOnly):
+		return NFSStatusROFS
+	case errors.Is(err, billy.ErrNotSupported):
+		return NFSStatusNotSupp
+	case errors.Is(err, ErrNoSpace):
+		return NFSStatusNoSPC
+	case errors.Is(err, ErrQuotaExceeded):
+		return NFSStatusDQuot
+	case errors.Is(err, context.DeadlineExceeded):
+		// a backend giving up on the context of a call with a timeout.
+		return NFSStatusJukebox
+	}
+	return fallback
+}
+
+func errnoStatus(errno syscall.Errno) (NFSStatus, bool) {
+	switch errno {
+	case syscall.EPERM:
+		return NFSStatusPerm, true
+	case syscall.ENOENT:
+		return NFSStatusNoEnt, true
+	case syscall.EIO:
+		return NFSStatusIO, true
+	case syscall.ENXIO:
+		return NFSStatusNXIO, true
+	case syscall.EACCES:
+		return NFSStatusAccess, true
+	case syscall.EEXIST:
+		return NFSStatusExist, true
+	case syscall.EXDEV:
+		return NFSStatusXDev, true
+	case syscall.ENODEV:
+		return NFSStatusNoDev, true
+	case syscall.ENOTDIR:
+		return NFSStatusNotDir, true
+	case syscall.EISDIR:
+		return NFSStatusIsDir, true
+	case syscall.EINVAL:
+		return NFSStatusInval, true
+	case syscall.EFBIG:
+		return NFSStatusFBig, true
+	case syscall.ENOSPC:
+		return NFSStatusNoSPC, true
+	case syscall.EROFS:
+		return NFSStatusROFS, true
+	case syscall.EMLINK:
+		return NFSStatusMlink, true
+	case syscall.ENAMETOOLONG:
+		return NFSStatusNameTooLong, true
+	case syscall.ENOTEMPTY:
+		return NFSStatusNotEmpty, true
+	case syscall.EDQUOT:
+		return NFSStatusDQuot, true
+	case syscall.ESTALE:
+		return NFSStatusStale, true
+	case syscall.ENOTSUP:
+		return NFSStatusNotSupp, true
+	}
+	// EOPNOTSUPP aliases ENOTSUP on some platforms, so can't share the switch.
+	if errno == syscall.EOPNOTSUPP {
+		return NFSStatusNotSupp, true
+	}
+	return platformErrnoStatus(errno)
+}
+
+// statusError wraps an error from a backing filesystem as an NFSStatusError.
+func statusError(err error, fallback NFSStatus) error {
+	var nerr *NFSStatusError
+	if errors.As(err, &nerr) {
+		return nerr
+	}
+	return &NFSStatusError{StatusFromError(err, fallback), err}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package nfs
+
+import (
+	"syscall"
+)
+
+func platformErrnoStatus(errno syscall.Errno) (NFSStatus, bool) {
+	return 0, false
+}
@@ -0,0 +1,53 @@
+package nfs_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+)
+
+func TestStatusFromError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want nfs.NFSStatus
+	}{
+		{&os.PathError{Op: "mkdir", Path: "/a", Err: syscall.ENOSPC}, nfs.NFSStatusNoSPC},
+		{&os.PathError{Op: "write", Path: "/a", Err: syscall.EDQUOT}, nfs.NFSStatusDQuot},
+		{&os.PathError{Op: "rmdir", Path: "/a", Err: syscall.ENOTEMPTY}, nfs.NFSStatusNotEmpty},
+		{&os.PathError{Op: "open", Path: "/a", Err: syscall.EACCES}, nfs.NFSStatusAccess},
+		{&os.PathError{Op: "chown", Path: "/a", Err: syscall.EPERM}, nfs.NFSStatusPerm},
+		{&os.PathError{Op: "open", Path: "/a", Err: syscall.ENAMETOOLONG}, nfs.NFSStatusNameTooLong},
+		{&os.LinkError{Op: "rename", Old: "/a", New: "/b", Err: syscall.EXDEV}, nfs.NFSStatusXDev},
+		{fmt.Errorf("wrapped: %w", os.ErrNotExist), nfs.NFSStatusNoEnt},
+		{billy.ErrReadOnly, nfs.NFSStatusROFS},
+		{fmt.Errorf("bucket full: %w", nfs.ErrNoSpace), nfs.NFSStatusNoSPC},
+		{&os.PathError{Op: "write", Path: "/a", Err: nfs.ErrQuotaExceeded}, nfs.NFSStatusDQuot},
+		{&nfs.NFSStatusError{NFSStatus: nfs.NFSStatusStale}, nfs.NFSStatusStale},
+		{errors.New("opaque"), nfs.NFSStatusIO},
+	}
+	if runtime.GOOS == "windows" {
+		// the system error codes of Windows the os package doesn't map.
+		cases = append(cases, []struct {
+			err  error
+			want nfs.NFSStatus
+		}{
+			{&os.PathError{Op: "open", Path: "/a", Err: syscall.Errno(32)}, nfs.NFSStatusJukebox},
+			{&os.PathError{Op: "write", Path: "/a", Err: syscall.Errno(112)}, nfs.NFSStatusNoSPC},
+			{&os.PathError{Op: "remove", Path: "/a", Err: syscall.Errno(145)}, nfs.NFSStatusNotEmpty},
+			{&os.PathError{Op: "open", Path: "/a", Err: syscall.Errno(206)}, nfs.NFSStatusNameTooLong},
+			{&os.LinkError{Op: "rename", Old: "/a", New: "/b", Err: syscall.Errno(17)}, nfs.NFSStatusXDev},
+			{&os.PathError{Op: "write", Path: "/a", Err: syscall.Errno(1295)}, nfs.NFSStatusDQuot},
+		}...)
+	}
+	for _, c := range cases {
+		if got := nfs.StatusFromError(c.err, nfs.NFSStatusIO); got != c.want {
+			t.Errorf("StatusFromError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//go:build windows
+
+package nfs
+
+import (
+	"syscall"
+)
+
+// Windows system error codes, which the syscall package gives as Errno but
+// doesn't name, per
+// https://learn.microsoft.com/windows/win32/debug/system-error-codes
+const (
+	errorNotSameDevice     syscall.Errno = 17
+	errorWriteProtect      syscall.Errno = 19
+	errorSharingViolation  syscall.Errno = 32
+	errorLockViolation     syscall.Errno = 33
+	errorHandleDiskFull    syscall.Errno = 39
+	errorDiskFull          syscall.Errno = 112
+	errorInvalidName       syscall.Errno = 123
+	errorDirNotEmpty       syscall.Errno = 145
+	errorFilenameExcRange  syscall.Errno = 206
+	errorDirectory         syscall.Errno = 267
+	errorCantAccessFile    syscall.Errno = 1920
+	errorNotAReparsePoint  syscall.Errno = 4390
+	errorPrivilegeNotHeld  syscall.Errno = 1314
+	errorDiskQuotaExceeded syscall.Errno = 1295
+)
+
+// platformErrnoStatus maps the errors Windows gives for which the os package
+// has no portable equivalent.
+func platformErrnoStatus(errno syscall.Errno) (NFSStatus, bool) {
+	switch errno {
+	case errorNotSameDevice:
+		return NFSStatusXDev, true
+	case errorWriteProtect:
+		return NFSStatusROFS, true
+	case errorSharingViolation, errorLockViolation:
+		// another process has the file open without sharing it, which the
+		// client may retry.
+		return NFSStatusJukebox, true
+	case errorHandleDiskFull, errorDiskFull:
+		return NFSStatusNoSPC, true
+	case errorInvalidName, errorNotAReparsePoint:
+		return NFSStatusInval, true
+	case errorDirNotEmpty:
+		return NFSStatusNotEmpty, true
+	case errorFilenameExcRange:
+		return NFSStatusNameTooLong, true
+	case errorDirectory:
+		return NFSStatusNotDir, true
+	case errorCantAccessFile, errorPrivilegeNotHeld:
+		return NFSStatusAccess, true
+	case errorDiskQuotaExceeded:
+		return NFSStatusDQuot, true
+	}
+	return 0, false
+}
@@ -0,0 +1,159 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"time"
+)
+
+// EventType classifies the security relevant events published to an
+// EventSubscriber.
+type EventType int
+
+// Event types
+const (
+	// EventMountGranted is published when a client mounts an export.
+	EventMountGranted EventType = iota + 1
+	// EventMountDenied is published when a mount is refused.
+	EventMountDenied
+	// EventUnmount is published when a client unmounts an export.
+	EventUnmount
+	// EventAuthFailure is published when a call is refused for its
+	// credentials.
+	EventAuthFailure
+	// EventPermissionDenied is published when a call fails with
+	// NFS3ERR_ACCES or NFS3ERR_PERM, or is refused by the Authorize hook.
+	EventPermissionDenied
+	// EventExportReload is published by handlers which change the set of
+	// exports they serve, through Server.Publish.
+	EventExportReload
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventMountGranted:
+		return "mount-granted"
+	case EventMountDenied:
+		return "mount-denied"
+	case EventUnmount:
+		return "unmount"
+	case EventAuthFailure:
+		return "auth-failure"
+	case EventPermissionDenied:
+		return "permission-denied"
+	case EventExportReload:
+		return "export-reload"
+	default:
+		return fmt.Sprintf("event(%d)", int(t))
+	}
+}
+
+// Event is a record of a security relevant decision made by the server.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// RequestID is the ID of the call the event arose from, as given by
+	// RequestIDFromContext, or empty for events published otherwise.
+	RequestID string
+	// Client is the address the call was made from.
+	Client net.Addr
+	// Flavor is the authentication flavor of the call, and Credentials its
+	// AUTH_SYS identity after squashing, when it had one.
+	Flavor      AuthFlavor
+	Credentials *AuthUnix
+	// Procedure names the call, such as "mount.Mount" or "nfs.Remove".
+	Procedure string
+	// Path is the directory mounted or unmounted, or the object the call acted
+	// on when known.
+	Path string
+	// Flavors are the authentication flavors offered to a granted mount, from
+	// which the client picks one for its calls.
+	Flavors []AuthFlavor
+	// Err is the reason for a refusal.
+	Err error
+}
+
+// EventSubscriber receives the events of a Server. OnEvent is called
+// synchronously from the connection the event arose on, so should hand events
+// off rather than block.
+type EventSubscriber interface {
+	OnEvent(Event)
+}
+
+// EventSubscriberFunc adapts a function to an EventSubscriber.
+type EventSubscriberFunc func(Event)
+
+// OnEvent calls f.
+func (f EventSubscriberFunc) OnEvent(e Event) {
+	f(e)
+}
+
+// Publish sends an event to the server's subscriber, if it has one.
+func (s *Server) Publish(e Event) {
+	if s.Events == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.Events.OnEvent(e)
+}
+
+// procedureName names the procedure of a MOUNT or NFS call, such as
+// "nfs.Read", or is empty for those of other programs.
+func procedureName(req *request) string {
+	switch {
+	case req.Header.Prog == mountServiceID:
+		return "mount." + MountProcedure(req.Header.Proc).String()
+	case req.Header.Prog == nfsServiceID && req.Header.Vers == nfs4Version:
+		return fmt.Sprintf("nfs4.%d", req.Header.Proc)
+	case req.Header.Prog == nfsServiceID:
+		return "nfs." + NFSProcedure(req.Header.Proc).String()
+	}
+	return ""
+}
+
+// publishCall publishes the event, if any, arising from the handling of a call.
+func (c *conn) publishCall(ctx context.Context, w *response) {
+	if c.Server.Events == nil {
+		return
+	}
+	e := Event{
+		RequestID: w.req.id,
+		Client:    c.Conn.RemoteAddr(),
+		Flavor:    AuthFlavor(w.req.Header.Cred.Flavor),
+		Err:       w.err,
+	}
+	e.Credentials, _ = CredentialsFromContext(ctx)
+	e.Procedure = procedureName(w.req)
+	if w.mount != nil {
+		e.Path = string(w.mount.Dirpath)
+	} else if w.op != nil {
+		e.Path = "/" + path.Join(w.op.Path...)
+	}
+
+	isMount := w.req.Header.Prog == mountServiceID && w.req.Header.Proc == uint32(MountProcMount)
+	var authErr *AuthError
+	var nfsErr *NFSStatusError
+	switch {
+	case errors.As(w.err, &authErr):
+		e.Type = EventAuthFailure
+	case isMount && w.err != nil:
+		e.Type = EventMountDenied
+	case isMount:
+		e.Type = EventMountGranted
+		e.Flavors = w.flavors
+	case w.mount != nil:
+		e.Type = EventUnmount
+	case errors.Is(w.err, errNotAuthorized):
+		e.Type = EventPermissionDenied
+	case errors.As(w.err, &nfsErr) && (nfsErr.NFSStatus == NFSStatusAccess || nfsErr.NFSStatus == NFSStatusPerm):
+		e.Type = EventPermissionDenied
+	default:
+		return
+	}
+	c.Server.Publish(e)
+}
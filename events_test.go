@@ -0,0 +1,74 @@
+package nfs_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestEvents(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/home", 0755)
+	_ = mem.MkdirAll("/home/private", 0700)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{
+		CheckPermissions: true,
+		AuthFlavors:      []nfs.AuthFlavor{nfs.AuthFlavorUnix},
+	})
+
+	var mu sync.Mutex
+	var events []nfs.Event
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler: helpers.NewCachingHandler(handler, 1024),
+		Events: nfs.EventSubscriberFunc(func(e nfs.Event) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		}),
+	})
+
+	if target, err := nfstest.Dial(srv.Addr(), "/", rpc.AuthNull); err == nil {
+		_ = target.Close()
+		t.Fatal("expected a mount with AUTH_NULL to be refused")
+	}
+	target := srv.Mount(t, "/", rpc.NewAuthUnix("client", 1000, 100).Auth())
+	if _, err := target.ReadDirPlus("/home/private"); err == nil {
+		t.Fatal("expected listing a private directory to fail")
+	}
+	_ = target.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var types []nfs.EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+		if e.Client == nil || e.Time.IsZero() {
+			t.Fatalf("expected events to identify the client and time: %+v", e)
+		}
+		switch e.Type {
+		case nfs.EventMountGranted:
+			if e.Credentials == nil || e.Credentials.UID != 1000 || e.Path != "/" ||
+				!reflect.DeepEqual(e.Flavors, []nfs.AuthFlavor{nfs.AuthFlavorUnix}) {
+				t.Fatalf("unexpected mount event: %+v", e)
+			}
+		case nfs.EventAuthFailure:
+			if e.Procedure != "mount.Mount" || e.Path != "/" || e.Flavor != nfs.AuthFlavorNull {
+				t.Fatalf("unexpected auth failure: %+v", e)
+			}
+		case nfs.EventPermissionDenied:
+			if e.Procedure != "nfs.ReadDirPlus" || e.Path != "/home/private" {
+				t.Fatalf("unexpected denial event: %+v", e)
+			}
+		}
+	}
+	want := []nfs.EventType{nfs.EventAuthFailure, nfs.EventMountGranted, nfs.EventPermissionDenied, nfs.EventUnmount}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("expected events %v, got %v", want, types)
+	}
+}
@@ -27,9 +27,16 @@ func main() {
 	fmt.Printf("osnfs server running at %s\n", listener.Addr())
 
 	bfs := osfs.New(os.Args[1])
-	bfsPlusChange := NewChangeOSFS(bfs)
+	bfsPlusChange := nfshelper.NewChangeOSFS(bfs)
 
 	handler := nfshelper.NewNullAuthHandler(bfsPlusChange)
 	cacheHelper := nfshelper.NewCachingHandler(handler, 1024)
+	// other processes may modify the folder while it is served.
+	watcher, err := nfshelper.NewWatcher(cacheHelper.(*nfshelper.CachingHandler), bfsPlusChange, os.Args[1])
+	if err != nil {
+		fmt.Printf("Failed to watch %s: %v\n", os.Args[1], err)
+		return
+	}
+	defer watcher.Close()
 	fmt.Printf("%v", nfs.Serve(listener, cacheHelper))
 }
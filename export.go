@@ -0,0 +1,797 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// AnonID is the uid and gid that squashed identities are mapped to when an
+// export doesn't pick its own: "nobody" on most systems.
+const AnonID = 65534
+
+// windowsAnonID is the id Windows clients send for users they have no
+// identity to map to, -2 as an unsigned 32 bit id.
+const windowsAnonID = 0xfffffffe
+
+// ExportOptions are the policies applied to calls against an exported
+// filesystem, before the call touches the filesystem.
+type ExportOptions struct {
+	// ReadOnly refuses calls that would modify the export with NFS3ERR_ROFS,
+	// before they reach the filesystem, and has ACCESS, FSINFO and FSSTAT
+	// present the export as read-only.
+	ReadOnly bool
+	// RootSquash maps calls made as uid 0 to AnonUID, and group 0 to AnonGID,
+	// so that root on a client has no special standing on the export.
+	RootSquash bool
+	// AllSquash maps every call to AnonUID and AnonGID, so that no identity
+	// asserted by a client is trusted.
+	AllSquash bool
+	// AnonUID and AnonGID are the identity that squashed credentials, and
+	// calls without AUTH_SYS credentials, are mapped to. AnonID is used when
+	// both are zero.
+	AnonUID uint32
+	AnonGID uint32
+	// CheckPermissions has the server evaluate the mode bits of objects
+	// against the uid, gid and supplementary gids of each call, rather than
+	// leaving access control to the filesystem.
+	CheckPermissions bool
+	// AuthFlavors are the authentication flavors accepted by the export, in
+	// order of preference, and are advertised to clients when they mount it.
+	// Mounts and calls made with other flavors are refused with AUTH_TOOWEAK.
+	// Any flavor is accepted when empty.
+	//
+	// RPCSEC_GSS is not implemented: calls using it are always refused, and
+	// mounts of exports listing it or its Kerberos pseudo-flavors are
+	// refused with MNT3ERR_SERVERFAULT rather than advertising flavors no
+	// call could be made with.
+	AuthFlavors []AuthFlavor
+	// Hide lists glob patterns, as of path.Match, of entries hidden from
+	// clients: they are left out of READDIR and READDIRPLUS, LOOKUP and
+	// REMOVE of them fail with NFS3ERR_NOENT, and creating them or renaming
+	// onto them fails with NFS3ERR_ACCES. A pattern with a slash is matched
+	// against the path of the entry from the root of the export, such as
+	// "/build/*.o", and others against its name in any directory, such as
+	// ".git" or "*.tmp". Everything below a hidden directory is hidden too.
+	// Malformed patterns match nothing.
+	Hide []string
+	// HideRegexp hides the entries whose names match any of its expressions,
+	// as Hide does.
+	HideRegexp []*regexp.Regexp
+	// Secure refuses mounts and calls from source ports above 1023, which
+	// only root may bind on most clients, as the secure option of other
+	// servers does. Any port is accepted when unset, as clients in containers
+	// without CAP_NET_BIND_SERVICE need.
+	Secure bool
+	// RequireClientCert refuses mounts and calls from clients which didn't
+	// present a verified certificate over TLS, for servers whose listener
+	// is made with tls.NewListener and a tls.Config verifying client
+	// certificates against its ClientCAs, as tls.VerifyClientCertIfGiven
+	// does. Clients over other connections are refused, so an export can
+	// be served to certificate holders alone.
+	RequireClientCert bool
+	// ClientCertNames, when set, requires a verified client certificate, as
+	// RequireClientCert does, which names a client matching one of the
+	// patterns, in the syntax of path.Match, by a DNS, email or URI subject
+	// alternative name or its common name. Names are matched regardless of
+	// case, and "*" doesn't match across the "/" of URIs.
+	ClientCertNames []string
+	// ConfineSymlinks refuses calls through symlinks leading out of the
+	// export with NFS3ERR_ACCES. Clients resolve links themselves, but the
+	// handle of a link can still be read or listed, and the filesystem then
+	// follows it on the server. With this set the server resolves the
+	// links along the path of each call first, refusing links whose targets
+	// climb out of the export, and links with absolute targets, whose
+	// meaning depends on the filesystem. It costs an Lstat of each element
+	// of the path, and is meant for exports of trees that clients or local
+	// users can make links in.
+	ConfineSymlinks bool
+	// MaxDirEntries, when set, bounds the entries of a directory that can be
+	// listed. Listings of larger directories fail with NFS3ERR_FBIG, rather
+	// than clients being sent listings of any length, or for a
+	// ListingFilesystem once the listing passes the bound. Hidden entries are
+	// not counted.
+	MaxDirEntries int
+	// MaxPathDepth, when set, bounds the number of elements of the paths of
+	// objects calls can act on, from the root of the export. Calls on deeper
+	// objects, including creating them, fail with NFS3ERR_NAMETOOLONG.
+	MaxPathDepth int
+	// MaxHandles, when set, bounds the file handles a client address is
+	// given by the server. Past it, the handles given to the client least
+	// recently are forgotten, unless another client was given them too, and
+	// fail with NFS3ERR_STALE, as when the handler's own cache of handles is
+	// full. One client walking a large tree then can't push the handles of
+	// others out of that cache.
+	MaxHandles int
+	// Fileid32 folds the fileids of the export into 32 bits, for clients and
+	// applications which fail on larger inode numbers. The halves of each
+	// fileid are combined, as Linux clients mounting without 64 bit inode
+	// numbers do, so distinct files may then share a fileid.
+	Fileid32 bool
+	// RequireUTF8 refuses names given by clients which aren't valid UTF-8
+	// with NFS3ERR_INVAL, and leaves entries of the backend with such names
+	// out of listings, so that clients aren't sent names they can't decode.
+	// helpers.NewEncodingFS translates names of backends kept in another
+	// encoding instead.
+	RequireUTF8 bool
+	// CaseInsensitive has names given by clients refer to the entries whose
+	// names are equal to them but for case, as macOS and Windows clients
+	// expect, while keeping the case names are created with. A name
+	// matching an entry exactly refers to it, and otherwise the first by
+	// name of the entries matching it but for case, so that creating a
+	// name which differs only in case from an existing entry finds that
+	// entry, failing with NFS3ERR_EXIST when exclusive, and a RENAME of an
+	// entry to a name differing only in case changes the case of its name.
+	// Full listings leave out entries whose names equal an earlier one but
+	// for case, since clients couldn't tell them apart; those of a
+	// ListingFilesystem or PagedFilesystem don't. PATHCONF reports the
+	// export as case-insensitive. It costs a listing of the directory for
+	// each name not found as it is given.
+	CaseInsensitive bool
+	// DenyCreate lists glob patterns, as Hide does, of names that clients
+	// may not create: CREATE, MKDIR, SYMLINK, MKNOD and LINK of them, and
+	// RENAME onto them, fail with NFS3ERR_ACCES, while existing entries of
+	// those names are left alone. Device names, or the names reserved on
+	// Windows, can be kept out of an export with them. Denying ".nfs*" also
+	// denies the renames clients make of files removed while still open, so
+	// that such files can't be removed until they are closed.
+	DenyCreate []string
+	// DenyCreateRegexp denies creating the names matching any of its
+	// expressions, as DenyCreate does. "(?i)" has an expression ignore case,
+	// as the names reserved on Windows need:
+	//
+	//	(?i)^(con|prn|aux|nul|com[1-9]|lpt[1-9])(\..*)?$
+	DenyCreateRegexp []*regexp.Regexp
+	// Umask removes its permission bits from the modes of the objects
+	// clients create, whatever mode they ask for, as the create mask of
+	// Samba does. A mode of 0022 keeps created objects from being writable
+	// by others than their owners.
+	Umask os.FileMode
+	// ForceFileMode and ForceDirMode add their bits, which may include the
+	// setgid and sticky bits, to the modes of the files and the directories
+	// clients create, after Umask, as the force create mode and force
+	// directory mode of Samba do.
+	ForceFileMode os.FileMode
+	ForceDirMode  os.FileMode
+	// PresentOwner presents every object of the export as owned by OwnerUID
+	// and OwnerGID, whatever owner the filesystem keeps, for backends such as
+	// object stores whose ownership means nothing to clients.
+	// CheckPermissions evaluates modes against the presented owner too.
+	// Objects are still given to the callers creating them, and SETATTR
+	// still changes the owner kept.
+	PresentOwner bool
+	OwnerUID     uint32
+	OwnerGID     uint32
+	// DisableProcedures lists the NFSv3 procedures the export doesn't serve,
+	// such as SYMLINK on a share for Windows clients, or REMOVE on an
+	// archive. SYMLINK, MKNOD and LINK then fail with NFS3ERR_NOTSUPP, as
+	// they do against filesystems without them, other procedures that modify
+	// the export with NFS3ERR_ROFS, and the rest with NFS3ERR_NOTSUPP.
+	// FSINFO doesn't advertise links, symlinks or setting times when LINK,
+	// SYMLINK or SETATTR are disabled, and ACCESS doesn't grant removing
+	// entries without REMOVE, or modifying files without WRITE.
+	DisableProcedures []NFSProcedure
+	// MacOSQuirks serves the export as macOS clients, and Finder, expect.
+	// The attributes GETATTR and ACCESS stat are reused for up to a second,
+	// since Finder asks for them of every object it shows, again and again;
+	// calls modifying any export clear them, so only changes made around
+	// the server are seen late. Removing or renaming an entry removes or
+	// renames its "._" AppleDouble file along with it, in which macOS keeps
+	// the extended attributes of files on filesystems without them, rather
+	// than leaving it behind. PATHCONF reports the LinkMax of APFS for
+	// filesystems with hard links, which macOS otherwise takes to have none.
+	// CaseInsensitive should be set too for backends Finder's users expect
+	// to ignore case, as APFS does.
+	MacOSQuirks bool
+	// WindowsQuirks serves the export as the Client for NFS of Windows
+	// expects. Names are folded for case, as with CaseInsensitive, since
+	// Windows applications name files in any case. Calls made as uid or gid
+	// 4294967294, the -2 which Windows clients not given an identity to map
+	// users to send, are served as the anonymous identity, rather than
+	// creating objects owned by an id no one has. Names holding characters
+	// Windows reserves can't be opened from it; helpers.WindowsNames
+	// presents them as characters it can.
+	WindowsQuirks bool
+	// ESXiQuirks serves the export as a datastore of VMware ESXi hosts.
+	// Every WRITE is made stable before it is replied to, whatever stability
+	// it asks for, so that the disks of virtual machines survive the loss of
+	// the server. FSINFO offers transfers of at most a MiB, the largest ESXi
+	// makes, rather than sizes it would refuse. ESXi locks the files of a
+	// virtual machine with ".lck" files it creates with EXCLUSIVE CREATEs,
+	// which are served whatever the export, and makes its calls as root, so
+	// RootSquash should be left off.
+	ESXiQuirks bool
+	// Referrals are subtrees of the export served by other servers. NFSv4
+	// operations on objects within them fail with NFS4ERR_MOVED, but for
+	// the GETATTR of their fs_locations, which gives clients the servers to
+	// find them on. NFSv3 clients aren't referred, and see the subtrees as
+	// the filesystem holds them, if it does.
+	Referrals []Referral
+}
+
+// ExportHandler is an optional extension of Handler which applies
+// ExportOptions to the filesystems it serves. ExportOptions is consulted for
+// every NFS call with the filesystem the call's file handle resolves to, and
+// may return nil when no policy applies.
+type ExportHandler interface {
+	ExportOptions(ctx context.Context, conn net.Conn, fs billy.Filesystem) *ExportOptions
+}
+
+// MountOptionsHandler is an optional extension of ExportHandler giving the
+// options of the export a MNT names before it is mounted, so that mounts
+// refused by their flavor, port or client certificate never reach Mount.
+// When it returns nil, or isn't implemented, the options of the filesystem
+// mounted are checked once Mount returns it.
+type MountOptionsHandler interface {
+	MountOptions(ctx context.Context, conn net.Conn, req MountRequest) *ExportOptions
+}
+
+// esxiQuirks reports whether the export a call is made against is served
+// as an ESXi datastore.
+func esxiQuirks(ctx context.Context) bool {
+	opts := exportOptionsFromContext(ctx)
+	return opts != nil && opts.ESXiQuirks
+}
+
+// foldsCase reports whether the names of the export are folded for case.
+func (o *ExportOptions) foldsCase() bool {
+	return o.CaseInsensitive || o.WindowsQuirks
+}
+
+func (o *ExportOptions) anon() (uint32, uint32) {
+	if o.AnonUID == 0 && o.AnonGID == 0 {
+		return AnonID, AnonID
+	}
+	return o.AnonUID, o.AnonGID
+}
+
+// squash provides the identity a call made with cred is performed as.
+func (o *ExportOptions) squash(cred *AuthUnix) *AuthUnix {
+	uid, gid := o.anon()
+	if cred == nil {
+		return &AuthUnix{UID: uid, GID: gid}
+	}
+	if o.WindowsQuirks && (cred.UID == windowsAnonID || cred.GID == windowsAnonID) {
+		mapped := *cred
+		if mapped.UID == windowsAnonID {
+			mapped.UID = uid
+		}
+		if mapped.GID == windowsAnonID {
+			mapped.GID = gid
+		}
+		cred = &mapped
+	}
+	if o.AllSquash {
+		return &AuthUnix{Stamp: cred.Stamp, MachineName: cred.MachineName, UID: uid, GID: gid}
+	}
+	if !o.RootSquash {
+		return cred
+	}
+	sq := *cred
+	sq.GIDs = make([]uint32, len(cred.GIDs))
+	copy(sq.GIDs, cred.GIDs)
+	if sq.UID == 0 {
+		sq.UID = uid
+	}
+	if sq.GID == 0 {
+		sq.GID = gid
+	}
+	for i, g := range sq.GIDs {
+		if g == 0 {
+			sq.GIDs[i] = gid
+		}
+	}
+	return &sq
+}
+
+// allowsFlavor reports whether calls made with the given credential flavor are
+// accepted.
+func (o *ExportOptions) allowsFlavor(flavor uint32) bool {
+	if len(o.AuthFlavors) == 0 {
+		return true
+	}
+	for _, f := range o.AuthFlavors {
+		if uint32(f) == flavor {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFlavors refuses AuthFlavors listing RPCSEC_GSS or its Kerberos
+// pseudo-flavors.
+func (o *ExportOptions) checkFlavors() error {
+	for _, f := range o.AuthFlavors {
+		switch f {
+		case AuthFlavorRPCSECGSS, AuthFlavorKrb5, AuthFlavorKrb5i, AuthFlavorKrb5p:
+			return fmt.Errorf("auth flavor %d: %w", f, errGSSNotImplemented)
+		}
+	}
+	return nil
+}
+
+// allowsPort reports whether calls from addr are accepted.
+func (o *ExportOptions) allowsPort(addr net.Addr) bool {
+	if !o.Secure {
+		return true
+	}
+	a, ok := addr.(*net.TCPAddr)
+	return ok && a.Port < 1024
+}
+
+var errInsecurePort = errors.New("call from an unreserved port")
+
+var errGSSNotImplemented = errors.New("RPCSEC_GSS and the Kerberos flavors are not implemented")
+
+var errHidden = errors.New("entry is hidden by the export")
+
+var errSymlinkEscape = errors.New("symlink leads out of the export")
+
+var errNotUTF8 = errors.New("name is not valid UTF-8")
+
+var errDeniedName = errors.New("name may not be created in the export")
+
+var errDisabledProcedure = errors.New("procedure is disabled on the export")
+
+var errPathTooDeep = errors.New("path is deeper than the export allows")
+
+var errDirTooLarge = errors.New("directory has more entries than the export lists")
+
+// exportAttributes provides attributes as the export presents them.
+func exportAttributes(ctx context.Context, attr *FileAttribute) *FileAttribute {
+	opts := exportOptionsFromContext(ctx)
+	if attr == nil || opts == nil {
+		return attr
+	}
+	if opts.Fileid32 {
+		attr.Fileid = fold32(attr.Fileid)
+	}
+	if opts.PresentOwner {
+		attr.UID, attr.GID = opts.OwnerUID, opts.OwnerGID
+	}
+	return attr
+}
+
+// presentedOwner provides attributes with the owner the export presents, for
+// permissions to be evaluated against, leaving attr as it is.
+func presentedOwner(ctx context.Context, attr *FileAttribute) *FileAttribute {
+	if opts := exportOptionsFromContext(ctx); attr != nil && opts != nil && opts.PresentOwner {
+		presented := *attr
+		presented.UID, presented.GID = opts.OwnerUID, opts.OwnerGID
+		return &presented
+	}
+	return attr
+}
+
+// fold32 folds a fileid into 32 bits.
+func fold32(id uint64) uint64 {
+	return uint64(uint32(id) ^ uint32(id>>32))
+}
+
+// checkUTF8 refuses an operation naming an object by a name which isn't
+// valid UTF-8.
+func (o *ExportOptions) checkUTF8(op *Operation) error {
+	for _, p := range [][]string{op.Path, op.To} {
+		for _, name := range p {
+			if !utf8.ValidString(name) {
+				return &NFSStatusError{NFSStatusInval, errNotUTF8}
+			}
+		}
+	}
+	return nil
+}
+
+// checkDepth refuses an operation on an object deeper than the export
+// allows.
+func (o *ExportOptions) checkDepth(op *Operation) error {
+	if o.MaxPathDepth > 0 && (len(op.Path) > o.MaxPathDepth || len(op.To) > o.MaxPathDepth) {
+		return &NFSStatusError{NFSStatusNameTooLong, errPathTooDeep}
+	}
+	return nil
+}
+
+// confinedLinkHops bounds the links resolved in confining a path, as the
+// kernel bounds those it follows.
+const confinedLinkHops = 40
+
+// checkSymlinks refuses an operation passing through a link out of the
+// export. The last element of its path is only resolved for procedures that
+// act on what a link points to.
+func (o *ExportOptions) checkSymlinks(op *Operation) error {
+	if escapes(op.Filesystem, op.Path, followsPath(op.Procedure)) || escapes(op.Filesystem, op.To, false) {
+		return &NFSStatusError{NFSStatusAccess, errSymlinkEscape}
+	}
+	return nil
+}
+
+// escapes reports whether resolving p on fs, and its last element when
+// follow is set, follows a link out of fs or one with an absolute target.
+// Missing elements end the check, leaving them for the call to report.
+func escapes(fs billy.Filesystem, p []string, follow bool) bool {
+	var at []string
+	rest := append([]string(nil), p...)
+	hops := 0
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(at) == 0 {
+				return true
+			}
+			at = at[:len(at)-1]
+			continue
+		}
+		next := append(at[:len(at):len(at)], elem)
+		if len(rest) == 0 && !follow {
+			return false
+		}
+		info, err := fs.Lstat(fs.Join(next...))
+		if err != nil {
+			return false
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			at = next
+			continue
+		}
+		if hops++; hops > confinedLinkHops {
+			return true
+		}
+		target, err := fs.Readlink(fs.Join(next...))
+		if err != nil || path.IsAbs(target) || filepath.IsAbs(target) {
+			return true
+		}
+		rest = append(strings.Split(filepath.ToSlash(target), "/"), rest...)
+	}
+	return false
+}
+
+// followsPath reports whether proc acts on what a link at its path points
+// to, rather than on the link.
+func followsPath(proc NFSProcedure) bool {
+	switch proc {
+	case NFSProcedureRead, NFSProcedureWrite, NFSProcedureCommit, NFSProcedureSetAttr,
+		NFSProcedureReadDir, NFSProcedureReadDirPlus:
+		return true
+	}
+	return false
+}
+
+// hidesEntry reports whether the entry name in directory dir is hidden.
+func (o *ExportOptions) hidesEntry(dir []string, name string) bool {
+	if o.RequireUTF8 && !utf8.ValidString(name) {
+		return true
+	}
+	return matchesEntry(o.Hide, o.HideRegexp, dir, name)
+}
+
+// matchesEntry reports whether the entry name in directory dir matches any of
+// patterns or expressions. Patterns with a slash are matched against the path
+// of the entry from the root of the export.
+func matchesEntry(patterns []string, expressions []*regexp.Regexp, dir []string, name string) bool {
+	if len(patterns) == 0 && len(expressions) == 0 {
+		return false
+	}
+	var full string
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			if full == "" {
+				full = "/" + path.Join(append(dir[:len(dir):len(dir)], name)...)
+			}
+			if ok, _ := path.Match(pattern, full); ok {
+				return true
+			}
+		} else if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	for _, re := range expressions {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDenied refuses an operation creating an entry of a name the export
+// denies.
+func (o *ExportOptions) checkDenied(op *Operation) error {
+	denied := func(p []string) bool {
+		n := len(p)
+		return n > 0 && matchesEntry(o.DenyCreate, o.DenyCreateRegexp, p[:n-1], p[n-1])
+	}
+	if (createsEntry(op.Procedure) && denied(op.Path)) || denied(op.To) {
+		return &NFSStatusError{NFSStatusAccess, errDeniedName}
+	}
+	return nil
+}
+
+// disables reports whether the export doesn't serve proc.
+func (o *ExportOptions) disables(proc NFSProcedure) bool {
+	for _, p := range o.DisableProcedures {
+		if p == proc {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProcedure refuses calls to the procedures the export disables.
+func (o *ExportOptions) checkProcedure(proc NFSProcedure) error {
+	if !o.disables(proc) {
+		return nil
+	}
+	switch proc {
+	case NFSProcedureSymlink, NFSProcedureMkNod, NFSProcedureLink:
+		return &NFSStatusError{NFSStatusNotSupp, errDisabledProcedure}
+	}
+	if isModifyingProcedure(proc) {
+		return &NFSStatusError{NFSStatusROFS, errDisabledProcedure}
+	}
+	return &NFSStatusError{NFSStatusNotSupp, errDisabledProcedure}
+}
+
+// procedureDisabled reports whether the export of a call doesn't serve proc.
+func procedureDisabled(ctx context.Context, proc NFSProcedure) bool {
+	opts := exportOptionsFromContext(ctx)
+	return opts != nil && opts.disables(proc)
+}
+
+// hidden gives the first component of p which is hidden, or -1.
+func (o *ExportOptions) hidden(p []string) int {
+	for i := range p {
+		if o.hidesEntry(p[:i], p[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkHidden refuses an operation on a hidden entry. An entry named by the
+// call, rather than by its handle, is missing, or can't be created.
+func (o *ExportOptions) checkHidden(op *Operation) error {
+	if i := o.hidden(op.Path); i >= 0 {
+		named := i == len(op.Path)-1 && namesEntry(op.Procedure)
+		switch {
+		case named && createsEntry(op.Procedure):
+			return &NFSStatusError{NFSStatusAccess, errHidden}
+		case named:
+			return &NFSStatusError{NFSStatusNoEnt, errHidden}
+		default:
+			return &NFSStatusError{NFSStatusStale, errHidden}
+		}
+	}
+	if i := o.hidden(op.To); i >= 0 {
+		if i == len(op.To)-1 {
+			return &NFSStatusError{NFSStatusAccess, errHidden}
+		}
+		return &NFSStatusError{NFSStatusStale, errHidden}
+	}
+	return nil
+}
+
+// foldOperation replaces the names of the entries an operation names with
+// those of the entries they refer to regardless of case.
+func (o *ExportOptions) foldOperation(op *Operation) {
+	fold := func(p []string) {
+		if n := len(p); n > 0 {
+			p[n-1] = string(foldedName(op.Filesystem, p[:n-1], []byte(p[n-1])))
+		}
+	}
+	if namesEntry(op.Procedure) {
+		fold(op.Path)
+	}
+	fold(op.To)
+}
+
+// namesEntry reports whether the path of an operation of proc is that of an
+// entry named in a directory.
+func namesEntry(proc NFSProcedure) bool {
+	switch proc {
+	case NFSProcedureLookup, NFSProcedureRemove, NFSProcedureRmDir, NFSProcedureRename:
+		return true
+	}
+	return createsEntry(proc)
+}
+
+func createsEntry(proc NFSProcedure) bool {
+	switch proc {
+	case NFSProcedureCreate, NFSProcedureMkDir, NFSProcedureSymlink, NFSProcedureMkNod:
+		return true
+	}
+	return false
+}
+
+func isModifyingProcedure(proc NFSProcedure) bool {
+	switch proc {
+	case NFSProcedureSetAttr, NFSProcedureWrite, NFSProcedureCreate, NFSProcedureMkDir,
+		NFSProcedureSymlink, NFSProcedureMkNod, NFSProcedureRemove, NFSProcedureRmDir,
+		NFSProcedureRename, NFSProcedureLink, NFSProcedureCommit:
+		return true
+	}
+	return false
+}
+
+// isReadOnly reports whether calls against fs may not modify it.
+func isReadOnly(ctx context.Context, fs billy.Filesystem) bool {
+	if opts := exportOptionsFromContext(ctx); opts != nil && opts.ReadOnly {
+		return true
+	}
+	return !billy.CapabilityCheck(fs, billy.WriteCapability)
+}
+
+type exportOptionsKey struct{}
+
+func exportOptionsFromContext(ctx context.Context) *ExportOptions {
+	opts, _ := ctx.Value(exportOptionsKey{}).(*ExportOptions)
+	return opts
+}
+
+// callContext attaches the identity of a call, and the options of the export
+// it is made against, to ctx before the call is dispatched.
+func (c *conn) callContext(ctx context.Context, w *response) (context.Context, error) {
+	ctx = c.requestContext(ctx, w)
+	if err := c.checkFence(w); err != nil {
+		return ctx, err
+	}
+	var cred *AuthUnix
+	if w.req.Header.Cred.Flavor == uint32(AuthFlavorRPCSECGSS) {
+		// The server doesn't establish RPCSEC_GSS contexts, so can neither
+		// verify these credentials nor unwrap krb5i and krb5p bodies.
+		return ctx, &AuthError{AuthStatRPCGSSCredProblem}
+	}
+	if certCred, ok, err := c.Server.certificateCredentials(ctx, c.Conn); err != nil {
+		Log.Debugf("unable to map the client certificate of %v: %v", c.Conn.RemoteAddr(), err)
+		return ctx, &AuthError{AuthStatBadCred}
+	} else if ok {
+		// in place of whatever AUTH_SYS credentials the client sent.
+		cred = certCred
+	} else if w.req.Header.Cred.Flavor == uint32(AuthFlavorUnix) {
+		if cred, err = parseAuthUnix(w.req.Header.Cred.Body); err != nil {
+			return ctx, &AuthError{AuthStatBadCred}
+		}
+		if cred, err = c.Server.idMapper().MapCredentials(ctx, c.Conn, cred); err != nil {
+			Log.Debugf("unable to map the credentials of %v: %v", c.Conn.RemoteAddr(), err)
+			return ctx, &AuthError{AuthStatBadCred}
+		}
+	}
+	w.cred = cred
+
+	var op *Operation
+	var opErr error
+	if w.req.Header.Prog == nfsServiceID && w.req.Header.Vers == nfs3Version && w.req.Header.Proc != uint32(NFSProcedureNull) {
+		// Bad arguments are left for the procedure to report.
+		op, opErr = w.peekOperation(c.Server.handler())
+		w.op = op
+		if op != nil {
+			ctx = context.WithValue(ctx, exportKey{}, op.Filesystem)
+		}
+	}
+	return c.operationContext(ctx, w, op, opErr)
+}
+
+// operationContext applies the options of the export op is made against to a
+// call: calls the export refuses fail, and the identity of the call is
+// squashed before it is attached to ctx and handed to Server.Authorize. op is
+// nil for calls that don't act on an export; opErr reports arguments of op
+// that couldn't be read, which skip Authorize as the procedure fails on them.
+func (c *conn) operationContext(ctx context.Context, w *response, op *Operation, opErr error) (context.Context, error) {
+	cred := w.cred
+	if eh, ok := c.Server.handler().(ExportHandler); ok && op != nil {
+		if opts := eh.ExportOptions(ctx, c.Conn, op.Filesystem); opts != nil {
+			if !opts.allowsFlavor(w.req.Header.Cred.Flavor) {
+				return ctx, &AuthError{AuthStatTooWeak}
+			}
+			if !opts.allowsPort(c.Conn.RemoteAddr()) {
+				return ctx, &NFSStatusError{NFSStatusPerm, errInsecurePort}
+			}
+			if err := opts.checkClientCert(c.Conn); err != nil {
+				return ctx, &NFSStatusError{NFSStatusAccess, err}
+			}
+			if opts.RequireUTF8 {
+				// before hidden names are checked, which such names are.
+				if err := opts.checkUTF8(op); err != nil {
+					return ctx, err
+				}
+			}
+			if opts.foldsCase() {
+				// so that a hidden entry can't be named in other cases.
+				opts.foldOperation(op)
+			}
+			if err := opts.checkHidden(op); err != nil {
+				return ctx, err
+			}
+			if err := opts.checkDenied(op); err != nil {
+				return ctx, err
+			}
+			if err := opts.checkDepth(op); err != nil {
+				return ctx, err
+			}
+			if opts.ConfineSymlinks {
+				if err := opts.checkSymlinks(op); err != nil {
+					return ctx, err
+				}
+			}
+			if opts.ReadOnly && isModifyingProcedure(op.Procedure) {
+				return ctx, &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+			}
+			if err := opts.checkProcedure(op.Procedure); err != nil {
+				return ctx, err
+			}
+			ctx = context.WithValue(ctx, exportOptionsKey{}, opts)
+			cred = opts.squash(cred)
+		}
+	}
+
+	if cred != nil && c.Server.GroupResolver != nil {
+		// after squashing, so that squashed calls get the groups of the
+		// identity they are squashed to.
+		cred = c.Server.resolveGroups(ctx, cred)
+	}
+	if cred != nil {
+		ctx = context.WithValue(ctx, credentialsKey{}, cred)
+	}
+
+	if op != nil {
+		op.Conn = c.Conn
+		op.Credentials = cred
+	}
+	if c.Server.Authorize != nil && op != nil && opErr == nil {
+		if status := c.Server.Authorize(ctx, op); status != NFSStatusOk {
+			return ctx, &NFSStatusError{status, errNotAuthorized}
+		}
+	}
+	return ctx, nil
+}
+
+// exportMode has the attributes of an object about to be created give it the
+// mode its export imposes: the mode asked for, or def when none is, with the
+// Umask of the export removed and its ForceFileMode or ForceDirMode added.
+func exportMode(ctx context.Context, attrs *SetFileAttributes, def os.FileMode, dir bool) {
+	opts := exportOptionsFromContext(ctx)
+	if opts == nil {
+		return
+	}
+	force := opts.ForceFileMode
+	if dir {
+		force = opts.ForceDirMode
+	}
+	if opts.Umask == 0 && force == 0 {
+		return
+	}
+	mode := unixMode(attrs.Mode(def)&^(opts.Umask&os.ModePerm) | force&modeBits)
+	attrs.SetMode = &mode
+}
+
+// chownToCaller gives an object created by a call to the identity the call is
+// made as. This is only done on exports with options, since other handlers may
+// not expect ownership to follow the client, and is best effort as the server
+// may not be privileged to change ownership. Objects created in a setgid
+// directory, with attributes dir, take the group of the directory instead.
+func chownToCaller(ctx context.Context, changer billy.Change, path string, dir *FileAttribute) {
+	if changer == nil || exportOptionsFromContext(ctx) == nil {
+		return
+	}
+	cred, ok := CredentialsFromContext(ctx)
+	if !ok {
+		return
+	}
+	gid := cred.GID
+	if dir != nil && dir.FileMode&unixSetgid != 0 {
+		gid = dir.GID
+	}
+	if err := changer.Lchown(path, int(cred.UID), int(gid)); err != nil {
+		Log.Debugf("unable to give %s to %d:%d: %v", path, cred.UID, gid, err)
+	}
+}
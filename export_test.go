@@ -0,0 +1,583 @@
+package nfs_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestExportModes(t *testing.T) {
+	dir := t.TempDir()
+	fs := changeOS{osfs.New(dir), dir}
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(fs), nfs.ExportOptions{
+		Umask:        0027,
+		ForceDirMode: os.ModeSetgid | 0010,
+	})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if _, err := target.Mkdir("/shared", 0777); err != nil {
+		t.Fatal(err)
+	}
+	attr, _, err := target.Lookup("/shared", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := attr.(*nfsc.Fattr).FileMode & 07777; mode != 02750 {
+		t.Fatalf("expected the umask and forced bits to give mode 02750, got %o", mode)
+	}
+}
+
+func TestPresentOwner(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/dir", 0755)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{
+		PresentOwner:     true,
+		OwnerUID:         1000,
+		OwnerGID:         100,
+		CheckPermissions: true,
+	})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.NewAuthUnix("client", 1000, 100).Auth())
+
+	attr, _, err := target.Lookup("/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fattr := attr.(*nfsc.Fattr); fattr.UID != 1000 || fattr.GID != 100 {
+		t.Fatalf("expected the presented owner, got %d:%d", fattr.UID, fattr.GID)
+	}
+	if _, err := target.Mkdir("/dir/sub", 0755); err != nil {
+		t.Fatalf("expected the presented owner to be granted its permissions, got %v", err)
+	}
+}
+
+func TestSquash(t *testing.T) {
+	for _, opts := range []struct {
+		nfs.ExportOptions
+		root, user [2]int
+	}{
+		{nfs.ExportOptions{}, [2]int{0, 0}, [2]int{1000, 100}},
+		{nfs.ExportOptions{RootSquash: true}, [2]int{nfs.AnonID, nfs.AnonID}, [2]int{1000, 100}},
+		{nfs.ExportOptions{AllSquash: true, AnonUID: 99, AnonGID: 98}, [2]int{99, 98}, [2]int{99, 98}},
+	} {
+		mem := memfs.New()
+		_ = mem.MkdirAll("/home", 0755)
+		fs := &ownerFS{Filesystem: mem, owners: make(map[string][2]int)}
+		handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(fs), opts.ExportOptions)
+		srv, err := nfstest.NewServer(helpers.NewCachingHandler(handler, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			name     string
+			uid, gid uint32
+			expected [2]int
+		}{
+			{"root", 0, 0, opts.root},
+			{"user", 1000, 100, opts.user},
+		} {
+			target := srv.Mount(t, "/", rpc.NewAuthUnix("client", tc.uid, tc.gid).Auth())
+			if _, err := target.Create(tc.name, 0666); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := target.Mkdir(tc.name+"-dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			_ = target.Close()
+
+			for _, p := range []string{tc.name, tc.name + "-dir"} {
+				if got := fs.owner(p); got != tc.expected {
+					t.Fatalf("%+v: %s created by %d:%d is owned by %v, expected %v", opts.ExportOptions, p, tc.uid, tc.gid, got, tc.expected)
+				}
+			}
+		}
+		_ = srv.Close()
+	}
+}
+
+// countedMounts counts the mounts that reach the wrapped handler.
+type countedMounts struct {
+	nfs.Handler
+	n int32
+}
+
+func (h *countedMounts) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	atomic.AddInt32(&h.n, 1)
+	return h.Handler.Mount(ctx, conn, req)
+}
+
+func TestExportAuthFlavors(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/home", 0755)
+	counted := &countedMounts{Handler: helpers.NewNullAuthHandler(mem)}
+	handler := helpers.NewExportHandler(counted, nfs.ExportOptions{
+		AuthFlavors: []nfs.AuthFlavor{nfs.AuthFlavorUnix},
+	})
+	srv := nfstest.ServeCached(t, handler)
+
+	if target, err := nfstest.Dial(srv.Addr(), "/", rpc.AuthNull); err == nil {
+		_ = target.Close()
+		t.Fatal("expected a mount with AUTH_NULL to be refused")
+	}
+	if n := atomic.LoadInt32(&counted.n); n != 0 {
+		t.Fatalf("a mount with a refused flavor reached the handler %d times", n)
+	}
+
+	target := srv.Mount(t, "/", rpc.NewAuthUnix("client", 1000, 100).Auth())
+	_, root, err := target.Lookup("/home", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := nfstest.Lookup(target.Target, root, "."); err == nil {
+		t.Fatal("expected a call with AUTH_NULL to be refused")
+	}
+}
+
+func TestExportKerberosFlavors(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{
+		AuthFlavors: []nfs.AuthFlavor{nfs.AuthFlavorKrb5i, nfs.AuthFlavorUnix},
+	})
+	srv := nfstest.ServeCached(t, handler)
+
+	// rather than advertising a flavor no call could be made with.
+	target, err := nfstest.Dial(srv.Addr(), "/", rpc.NewAuthUnix("client", 1000, 100).Auth())
+	if err == nil {
+		_ = target.Close()
+		t.Fatal("expected a mount of an export listing krb5i to be refused")
+	}
+}
+
+func TestExportSecure(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{Secure: true})
+	srv := nfstest.ServeCached(t, handler)
+
+	if target, err := nfstest.Dial(srv.Addr(), "/", rpc.AuthNull); err == nil {
+		_ = target.Close()
+		t.Fatal("expected a mount from an unreserved port to be refused")
+	}
+}
+
+func TestExportRules(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/home", 0755)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, host, _ := net.ParseCIDR("127.0.0.1/32")
+	_, other, _ := net.ParseCIDR("10.0.0.0/24")
+
+	for _, tc := range []struct {
+		name     string
+		rules    []helpers.ExportRule
+		readOnly bool
+	}{
+		{"default", []helpers.ExportRule{{Network: other}}, true},
+		{"match", []helpers.ExportRule{{Network: loopback}}, false},
+		{"most specific", []helpers.ExportRule{
+			{Network: loopback},
+			{Network: host, Options: nfs.ExportOptions{ReadOnly: true}},
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{ReadOnly: true}, tc.rules...)
+			srv := nfstest.ServeCached(t, handler)
+			target := srv.Mount(t, "/", rpc.AuthNull)
+
+			_, err := target.Create("/home/"+strings.ReplaceAll(tc.name, " ", "-"), 0666)
+			if tc.readOnly && !nfstest.IsStatus(err, nfs.NFSStatusROFS) {
+				t.Fatalf("expected create on a read-only export to fail with ROFS: %v", err)
+			}
+			if !tc.readOnly && err != nil {
+				t.Fatalf("expected create to succeed: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadOnlyExport(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/dir/sub", 0755)
+	_ = billyutil.WriteFile(mem, "/dir/file", []byte("hello"), 0644)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{ReadOnly: true})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	for name, call := range map[string]func() error{
+		"create":  func() error { _, err := target.Create("/dir/new", 0644); return err },
+		"mkdir":   func() error { _, err := target.Mkdir("/dir/new", 0755); return err },
+		"remove":  func() error { return target.Remove("/dir/file") },
+		"rmdir":   func() error { return target.RmDir("/dir/sub") },
+		"rename":  func() error { return target.Rename("/dir/file", "/dir/moved") },
+		"symlink": func() error { return target.Symlink("file", "/dir/link") },
+		"setattr": func() error {
+			return target.Setattr("/dir/file", nfsc.Sattr3{Mode: nfsc.SetMode{SetIt: true, Mode: 0600}})
+		},
+	} {
+		if err := call(); !nfstest.IsStatus(err, nfs.NFSStatusROFS) {
+			t.Errorf("expected %s on a read-only export to fail with ROFS: %v", name, err)
+		}
+	}
+	entries, _ := mem.ReadDir("/dir")
+	if len(entries) != 2 {
+		t.Fatalf("expected the export to be unchanged, got %d entries", len(entries))
+	}
+	if info, _ := mem.Stat("/dir/file"); info.Mode().Perm() != 0644 {
+		t.Fatalf("expected the mode to be unchanged, got %v", info.Mode())
+	}
+
+	info, err := target.FSInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Properties&nfs.FSInfoPropertyCanSetTime != 0 {
+		t.Fatal("expected FSINFO of a read-only export not to offer setting times")
+	}
+	mask, err := target.Access("/dir/file", 0x3f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask&(0x04|0x08|0x10) != 0 {
+		t.Fatalf("expected ACCESS on a read-only export to deny modification, got %#x", mask)
+	}
+}
+
+func TestExportHide(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/.git", 0755)
+	_ = mem.MkdirAll("/lost+found", 0755)
+	_ = mem.MkdirAll("/build", 0755)
+	_ = mem.MkdirAll("/src/build", 0755)
+	_ = billyutil.WriteFile(mem, "/.git/config", []byte("x"), 0644)
+	_ = billyutil.WriteFile(mem, "/src/main.go", []byte("x"), 0644)
+	_ = billyutil.WriteFile(mem, "/src/old.tmp", []byte("x"), 0644)
+	_ = billyutil.WriteFile(mem, "/build/x.o", []byte("x"), 0644)
+	_ = billyutil.WriteFile(mem, "/src/build/y.o", []byte("x"), 0644)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{
+		Hide:       []string{".git", "*.tmp", "/build/*.o"},
+		HideRegexp: []*regexp.Regexp{regexp.MustCompile(`^lost\+found$`)},
+	})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	names := func(dir string) []string {
+		entries, err := nfstest.ReadDir(target.Target, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.FileName)
+		}
+		return out
+	}
+	if got := names("/"); !reflect.DeepEqual(got, []string{"build", "src"}) {
+		t.Fatalf("unexpected root listing %v", got)
+	}
+	if got := names("/src"); !reflect.DeepEqual(got, []string{"build", "main.go"}) {
+		t.Fatalf("unexpected /src listing %v", got)
+	}
+	if got := names("/build"); len(got) != 0 {
+		t.Fatalf("expected /build/x.o to be hidden, got %v", got)
+	}
+	if got := names("/src/build"); !reflect.DeepEqual(got, []string{"y.o"}) {
+		t.Fatalf("expected only /build to be matched by its pattern, got %v", got)
+	}
+
+	for _, p := range []string{"/.git", "/lost+found", "/src/old.tmp"} {
+		if _, _, err := target.Lookup(p, false); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected LOOKUP of %s to fail with NOENT: %v", p, err)
+		}
+	}
+	if _, err := target.Create("/src/new.tmp", 0644); !nfstest.IsStatus(err, nfs.NFSStatusAccess) {
+		t.Errorf("expected creating a hidden name to fail with ACCES: %v", err)
+	}
+	if err := target.Rename("/src/main.go", "/src/main.tmp"); !nfstest.IsStatus(err, nfs.NFSStatusAccess) {
+		t.Errorf("expected renaming onto a hidden name to fail with ACCES: %v", err)
+	}
+	if err := target.Remove("/src/old.tmp"); err == nil {
+		t.Error("expected removing a hidden entry to fail")
+	}
+	if _, err := mem.Stat("/src/old.tmp"); err != nil {
+		t.Fatal("expected the hidden entry to be kept")
+	}
+}
+
+func TestConfineSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	export := filepath.Join(dir, "export")
+	_ = os.MkdirAll(filepath.Join(dir, "outside"), 0755)
+	_ = os.MkdirAll(filepath.Join(export, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "outside", "secret"), []byte("secret"), 0644)
+	_ = os.WriteFile(filepath.Join(export, "sub", "file"), []byte("shared"), 0644)
+	_ = os.Symlink("../outside", filepath.Join(export, "escape"))
+	_ = os.Symlink("../outside/secret", filepath.Join(export, "leak"))
+	_ = os.Symlink(filepath.Join(dir, "outside"), filepath.Join(export, "absolute"))
+	_ = os.Symlink("sub/../sub/file", filepath.Join(export, "inside"))
+
+	serve := func(confine bool) *nfstest.Client {
+		fs := helpers.NewChangeOSFS(osfs.New(export))
+		handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(fs), nfs.ExportOptions{ConfineSymlinks: confine})
+		srv, err := nfstest.NewServer(helpers.NewCachingHandler(handler, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { srv.Close() })
+		target := srv.Mount(t, "/", rpc.AuthNull)
+		return target
+	}
+	read := func(target *nfstest.Client, name string) ([]byte, error) {
+		rf, err := target.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer rf.Close()
+		return io.ReadAll(rf)
+	}
+
+	open := serve(false)
+	if b, err := read(open, "/leak"); err != nil || string(b) != "secret" {
+		t.Fatalf("expected the server to follow the link unconfined, got %q: %v", b, err)
+	}
+
+	confined := serve(true)
+	for _, name := range []string{"/escape/secret", "/leak", "/absolute/secret"} {
+		if _, err := read(confined, name); !nfstest.IsStatus(err, nfs.NFSStatusAccess) {
+			t.Fatalf("expected reading %s to be refused, got %v", name, err)
+		}
+	}
+	if b, err := read(confined, "/inside"); err != nil || string(b) != "shared" {
+		t.Fatalf("expected a link within the export to be followed, got %q: %v", b, err)
+	}
+	if _, _, err := confined.Lookup("/leak"); err != nil {
+		t.Fatalf("expected the link itself to be looked up: %v", err)
+	}
+}
+
+func TestExportLimits(t *testing.T) {
+	mem := memfs.New()
+	for _, name := range []string{"/a", "/b", "/c", "/deep/er/still"} {
+		if err := billyutil.WriteFile(mem, name, []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{MaxDirEntries: 3, MaxPathDepth: 2, MaxHandles: 2})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if _, err := nfstest.ReadDir(target.Target, "/"); !nfstest.IsStatus(err, nfs.NFSStatusFBig) {
+		t.Fatalf("expected listing 4 entries to be refused, got %v", err)
+	}
+	if entries, err := nfstest.ReadDir(target.Target, "/deep"); err != nil || len(entries) != 1 {
+		t.Fatalf("expected a small directory to be listed, got %d entries: %v", len(entries), err)
+	}
+	if _, err := target.Mkdir("/deep/er/more", 0755); !nfstest.IsStatus(err, nfs.NFSStatusNameTooLong) {
+		t.Fatalf("expected creating past the depth to be refused, got %v", err)
+	}
+	if _, err := target.Mkdir("/deep/more", 0755); err != nil {
+		t.Fatalf("expected creating within the depth: %v", err)
+	}
+
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handles [][]byte
+	for _, name := range []string{"a", "b", "c"} {
+		fh, _, err := nfstest.Lookup(target.Target, root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, fh)
+	}
+	if _, err := target.GetAttr(handles[0]); !nfstest.IsStatus(err, nfs.NFSStatusStale) {
+		t.Fatalf("expected the oldest handle past the quota to be stale, got %v", err)
+	}
+	for _, fh := range handles[1:] {
+		if _, err := target.GetAttr(fh); err != nil {
+			t.Fatalf("expected handles within the quota to be kept: %v", err)
+		}
+	}
+}
+
+func TestFileid32(t *testing.T) {
+	mem := memfs.New()
+	if err := billyutil.WriteFile(mem, "/dir/file", []byte("hello"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fileids := func(opts nfs.ExportOptions) []uint64 {
+		handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), opts)
+		srv := nfstest.ServeCached(t, handler)
+		target := srv.Mount(t, "/", rpc.AuthNull)
+
+		info, _, err := target.Lookup("/dir/file", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := nfstest.ReadDir(target.Target, "/dir")
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("expected the file to be listed, got %d: %v", len(entries), err)
+		}
+		plus, err := target.ReadDirPlus("/dir")
+		if err != nil || len(plus) != 1 {
+			t.Fatalf("expected the file to be listed, got %d: %v", len(plus), err)
+		}
+		return []uint64{info.(*nfsc.Fattr).Fileid, entries[0].FileId, plus[0].FileId, plus[0].Attr.Attr.Fileid}
+	}
+
+	full := fileids(nfs.ExportOptions{})
+	if full[0] < 1<<32 {
+		t.Fatalf("expected a 64 bit fileid to fold, got %d", full[0])
+	}
+	folded := fileids(nfs.ExportOptions{Fileid32: true})
+	want := uint64(uint32(full[0]) ^ uint32(full[0]>>32))
+	for i, id := range folded {
+		if id != want || full[i] != full[0] {
+			t.Fatalf("expected fileid %d to fold to %d, got %d", full[i], want, id)
+		}
+	}
+}
+
+func TestDenyCreate(t *testing.T) {
+	mem := memfs.New()
+	if err := billyutil.WriteFile(mem, "/CON", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{
+		DenyCreate:       []string{".nfs*"},
+		DenyCreateRegexp: []*regexp.Regexp{regexp.MustCompile(`(?i)^(con|nul)(\..*)?$`)},
+	})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	for _, name := range []string{"/nul.txt", "/.nfs0001"} {
+		if _, err := target.Mkdir(name, 0755); !nfstest.IsStatus(err, nfs.NFSStatusAccess) {
+			t.Fatalf("expected creating %s to be denied, got %v", name, err)
+		}
+	}
+	if _, err := target.Mkdir("/ok", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Rename("/ok", "/Nul"); !nfstest.IsStatus(err, nfs.NFSStatusAccess) {
+		t.Fatalf("expected renaming onto a denied name to be refused, got %v", err)
+	}
+	if _, _, err := target.Lookup("/CON"); err != nil {
+		t.Fatalf("expected an existing entry of a denied name to be left alone, got %v", err)
+	}
+}
+
+func TestDisableProcedures(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/file", []byte("hello"), 0644)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{
+		DisableProcedures: []nfs.NFSProcedure{nfs.NFSProcedureSymlink, nfs.NFSProcedureRemove},
+	})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if err := target.Symlink("file", "/link"); !nfstest.IsStatus(err, nfs.NFSStatusNotSupp) {
+		t.Fatalf("expected a disabled SYMLINK to be unsupported, got %v", err)
+	}
+	if err := target.Remove("/file"); !nfstest.IsStatus(err, nfs.NFSStatusROFS) {
+		t.Fatalf("expected a disabled REMOVE to fail as on a read-only export, got %v", err)
+	}
+	if _, err := mem.Stat("/file"); err != nil {
+		t.Fatalf("expected the file to be kept: %v", err)
+	}
+	if _, err := target.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("expected other procedures to be served: %v", err)
+	}
+
+	info, err := target.FSInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Properties&nfs.FSInfoPropertySymlink != 0 {
+		t.Fatalf("expected FSINFO not to advertise disabled symlinks: %x", info.Properties)
+	}
+	granted, err := target.Access("/dir", 0x10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if granted != 0 {
+		t.Fatalf("expected ACCESS not to grant removing entries, got %x", granted)
+	}
+}
+
+func TestWindowsQuirks(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/a:b", []byte("hello"), 0644)
+	fs := &ownerFS{Filesystem: helpers.NewEncodingFS(mem, helpers.WindowsNames), owners: make(map[string][2]int)}
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(fs), nfs.ExportOptions{WindowsQuirks: true})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.NewAuthUnix("client", 0xfffffffe, 0xfffffffe).Auth())
+
+	if _, _, err := target.Lookup("/A\uf03aB"); err != nil {
+		t.Fatalf("expected a reserved character to be presented as a private use one, in any case: %v", err)
+	}
+	if _, err := target.Create("/c\uf03fd", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/c?d"); err != nil {
+		t.Fatalf("expected a private use character to create the reserved one: %v", err)
+	}
+	if got := fs.owner("c\uf03fd"); got != [2]int{nfs.AnonID, nfs.AnonID} {
+		t.Fatalf("expected the anonymous identity of Windows to be squashed, got %v", got)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	mem := memfs.New()
+	for _, name := range []string{"/Docs/a", "/docs", "/Secret"} {
+		if err := billyutil.WriteFile(mem, name, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{CaseInsensitive: true, Hide: []string{"Secret"}})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	entries, err := nfstest.ReadDir(target.Target, "/")
+	if err != nil || len(entries) != 1 || entries[0].FileName != "Docs" {
+		t.Fatalf("expected names equal but for case to be listed once, got %v: %v", entries, err)
+	}
+	if info, _, err := target.Lookup("/DOCS/A"); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected names to be looked up regardless of case, got %v: %v", info, err)
+	}
+	if info, _, err := target.Lookup("/docs"); err != nil || info.IsDir() {
+		t.Fatalf("expected an exact name to refer to its own entry, got %v: %v", info, err)
+	}
+	if _, _, err := target.Lookup("/secret", false); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a hidden entry to stay hidden in other cases, got %v", err)
+	}
+	if _, err := target.Mkdir("/DOCS", 0755); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected creating a name differing in case to collide, got %v", err)
+	}
+	if err := target.Rename("/Docs/a", "/Docs/A"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = nfstest.ReadDir(target.Target, "/Docs")
+	if err != nil || len(entries) != 1 || entries[0].FileName != "A" {
+		t.Fatalf("expected the rename to change the case of the name, got %v: %v", entries, err)
+	}
+}
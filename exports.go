@@ -0,0 +1,421 @@
+package nfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	billy "github.com/go-git/go-billy/v5"
+)
+
+var (
+	// ErrExportExists is returned by AddExport for a name already exported.
+	ErrExportExists = errors.New("export already exists")
+	// ErrUnknownExport is returned by RemoveExport for a name not exported.
+	ErrUnknownExport = errors.New("no such export")
+
+	errExportRemoved = errors.New("export was removed")
+)
+
+// exportTagSize is the length of the tag leading the handles of an export.
+// The handles of an export's handler can be no longer than FHSize less it.
+const exportTagSize = 8
+
+// AddExport serves handler at "/" followed by name, alongside the Handler of
+// the server, which is left to serve mounts of every other path. Exports can
+// be added and removed while the server is serving, as multi-tenant servers
+// give each tenant its own. The handles of an export are those of its handler
+// led by a tag derived from name, so they are no longer than FHSize less 8
+// bytes, and clients keep them across restarts of a server adding the same
+// exports. Names are single path components.
+func (s *Server) AddExport(name string, handler Handler) error {
+	if handler == nil || name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid export name %q", name)
+	}
+	s.init()
+	return s.exports.add(name, handler)
+}
+
+// RemoveExport stops serving the export name. Its handles are stale from
+// then on, and dropped from its handler where it caches them, while other
+// exports are left untouched. RemoveExport waits for the mounts and NFSv3
+// calls of the export in progress to return, and so mustn't be called from
+// within one.
+func (s *Server) RemoveExport(name string) error {
+	s.init()
+	return s.exports.remove(name)
+}
+
+// Exports lists the names of the exports added to the server, in order.
+func (s *Server) Exports() []string {
+	s.init()
+	return s.exports.names()
+}
+
+// handler provides the Handler calls are served by: the Handler of the
+// server, or once an export has been added, the set of exports, which falls
+// back to it.
+func (s *Server) handler() Handler {
+	if s.exports != nil && s.exports.used.Load() {
+		return s.exports
+	}
+	return s.Handler
+}
+
+// exportSet serves the exports added to a server. Handles are routed to an
+// export by their tag, and filesystems by those the export has given, as
+// handlers and filesystems may not be comparable.
+type exportSet struct {
+	server *Server
+	used   atomic.Bool
+	mu     sync.RWMutex
+	byName map[string]*export
+	byTag  map[[exportTagSize]byte]*export
+}
+
+// export is an export of an exportSet, tracking the calls in progress on it
+// so that its removal can wait for them.
+type export struct {
+	name    string
+	tag     [exportTagSize]byte
+	handler Handler
+
+	mu      sync.Mutex
+	idle    *sync.Cond
+	calls   int
+	removed bool
+	fss     []billy.Filesystem
+}
+
+func newExportSet(s *Server) *exportSet {
+	return &exportSet{
+		server: s,
+		byName: make(map[string]*export),
+		byTag:  make(map[[exportTagSize]byte]*export),
+	}
+}
+
+func exportTag(name string) [exportTagSize]byte {
+	sum := sha256.Sum256([]byte("go-nfs export " + name))
+	var tag [exportTagSize]byte
+	copy(tag[:], sum[:])
+	return tag
+}
+
+func (x *exportSet) add(name string, handler Handler) error {
+	e := &export{name: name, tag: exportTag(name), handler: handler}
+	e.idle = sync.NewCond(&e.mu)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.byName[name]; ok {
+		return ErrExportExists
+	}
+	if _, ok := x.byTag[e.tag]; ok {
+		return fmt.Errorf("the handles of export %q would collide with another", name)
+	}
+	x.byName[name] = e
+	x.byTag[e.tag] = e
+	x.used.Store(true)
+	return nil
+}
+
+func (x *exportSet) remove(name string) error {
+	x.mu.Lock()
+	e, ok := x.byName[name]
+	if ok {
+		delete(x.byName, name)
+		delete(x.byTag, e.tag)
+	}
+	x.mu.Unlock()
+	if !ok {
+		return ErrUnknownExport
+	}
+
+	e.mu.Lock()
+	e.removed = true
+	for e.calls > 0 {
+		e.idle.Wait()
+	}
+	fss := e.fss
+	e.mu.Unlock()
+	if ih, ok := e.handler.(interface {
+		InvalidatePath(billy.Filesystem, []string)
+	}); ok {
+		for _, fs := range fss {
+			ih.InvalidatePath(fs, []string{})
+		}
+	}
+	return nil
+}
+
+func (x *exportSet) names() []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	names := make([]string, 0, len(x.byName))
+	for name := range x.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// enter counts a call on the export of fs in progress until the function it
+// returns is called. Calls on a removed export fail as stale.
+func (x *exportSet) enter(fs billy.Filesystem) (func(), error) {
+	if x == nil || !x.used.Load() {
+		return func() {}, nil
+	}
+	e := x.exportOf(fs)
+	if e == nil {
+		return func() {}, nil
+	}
+	if !e.enter() {
+		return nil, &NFSStatusError{NFSStatusStale, errExportRemoved}
+	}
+	return e.leave, nil
+}
+
+func (e *export) enter() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.removed {
+		return false
+	}
+	e.calls++
+	return true
+}
+
+func (e *export) leave() {
+	e.mu.Lock()
+	e.calls--
+	if e.calls == 0 {
+		e.idle.Broadcast()
+	}
+	e.mu.Unlock()
+}
+
+// owns reports whether fs was given by the export.
+func (e *export) owns(fs billy.Filesystem) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, f := range e.fss {
+		if sameFilesystem(f, fs) {
+			return true
+		}
+	}
+	return false
+}
+
+// record notes that fs was given by the export.
+func (e *export) record(fs billy.Filesystem) {
+	if fs == nil || e.owns(fs) {
+		return
+	}
+	e.mu.Lock()
+	e.fss = append(e.fss, fs)
+	e.mu.Unlock()
+}
+
+func sameFilesystem(a, b billy.Filesystem) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	if reflect.TypeOf(a).Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// exportOf provides the export that gave fs, or nil if the Handler of the
+// server did.
+func (x *exportSet) exportOf(fs billy.Filesystem) *export {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for _, e := range x.byName {
+		if e.owns(fs) {
+			return e
+		}
+	}
+	return nil
+}
+
+// handlerOf provides the handler of the filesystem fs.
+func (x *exportSet) handlerOf(fs billy.Filesystem) Handler {
+	if e := x.exportOf(fs); e != nil {
+		return e.handler
+	}
+	if x.server.Handler != nil {
+		return x.server.Handler
+	}
+	return unexported{}
+}
+
+// exportOfMount provides the export the path mounted leads with, and the rest
+// of the path, or nil if it is of no export.
+func (x *exportSet) exportOfMount(dirpath []byte) (*export, string) {
+	p := path.Clean("/" + string(dirpath))
+	name, rest := p[1:], "/"
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.byName[name], rest
+}
+
+// Mount mounts the export the path leads with, passing it the rest of the
+// path, or has the Handler of the server mount paths of no export.
+func (x *exportSet) Mount(ctx context.Context, conn net.Conn, req MountRequest) (MountStatus, billy.Filesystem, []AuthFlavor) {
+	e, rest := x.exportOfMount(req.Dirpath)
+	if e == nil {
+		if x.server.Handler == nil {
+			return MountStatusErrNoEnt, nil, nil
+		}
+		return x.server.Handler.Mount(ctx, conn, req)
+	}
+	if !e.enter() {
+		return MountStatusErrNoEnt, nil, nil
+	}
+	defer e.leave()
+	req.Dirpath = []byte(rest)
+	status, fs, flavors := e.handler.Mount(ctx, conn, req)
+	if status == MountStatusOk {
+		e.record(fs)
+	}
+	return status, fs, flavors
+}
+
+func (x *exportSet) Change(fs billy.Filesystem) billy.Change {
+	return x.handlerOf(fs).Change(fs)
+}
+
+func (x *exportSet) FSStat(ctx context.Context, fs billy.Filesystem, s *FSStat) error {
+	return x.handlerOf(fs).FSStat(ctx, fs, s)
+}
+
+// ToHandle provides the handle of path in fs, led by the tag of its export.
+func (x *exportSet) ToHandle(fs billy.Filesystem, path []string) []byte {
+	e := x.exportOf(fs)
+	if e == nil {
+		return x.handlerOf(fs).ToHandle(fs, path)
+	}
+	fh := e.handler.ToHandle(fs, path)
+	if fh == nil {
+		return nil
+	}
+	if len(fh) > FHSize-exportTagSize {
+		Log.Errorf("no handle for %s: the handle of %d bytes of export %s is too long to tag", fs.Join(path...), len(fh), e.name)
+		return nil
+	}
+	return append(e.tag[:len(e.tag):len(e.tag)], fh...)
+}
+
+// FromHandle resolves the handles of exports by their tag, and has the
+// Handler of the server resolve the rest.
+func (x *exportSet) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
+	if e := x.exportOfHandle(fh); e != nil {
+		fs, p, err := e.handler.FromHandle(fh[exportTagSize:])
+		if err == nil {
+			e.record(fs)
+		}
+		return fs, p, err
+	}
+	if x.server.Handler == nil {
+		return nil, []string{}, &NFSStatusError{NFSStatusStale, nil}
+	}
+	return x.server.Handler.FromHandle(fh)
+}
+
+func (x *exportSet) InvalidateHandle(fs billy.Filesystem, fh []byte) error {
+	if e := x.exportOfHandle(fh); e != nil {
+		return e.handler.InvalidateHandle(fs, fh[exportTagSize:])
+	}
+	return x.handlerOf(fs).InvalidateHandle(fs, fh)
+}
+
+func (x *exportSet) exportOfHandle(fh []byte) *export {
+	if len(fh) <= exportTagSize {
+		return nil
+	}
+	var tag [exportTagSize]byte
+	copy(tag[:], fh)
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.byTag[tag]
+}
+
+// HandleLimit is the least of the limits of the handlers.
+func (x *exportSet) HandleLimit() int {
+	limit := math.MaxInt32
+	if x.server.Handler != nil {
+		limit = x.server.Handler.HandleLimit()
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for _, e := range x.byName {
+		if l := e.handler.HandleLimit(); l < limit {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// ExportOptions provides the options of the export of fs, if its handler
+// applies any.
+func (x *exportSet) ExportOptions(ctx context.Context, conn net.Conn, fs billy.Filesystem) *ExportOptions {
+	if eh, ok := x.handlerOf(fs).(ExportHandler); ok {
+		return eh.ExportOptions(ctx, conn, fs)
+	}
+	return nil
+}
+
+// MountOptions provides the options the handler of the export mounted gives
+// for the mount, if it gives them.
+func (x *exportSet) MountOptions(ctx context.Context, conn net.Conn, req MountRequest) *ExportOptions {
+	h := x.server.Handler
+	e, rest := x.exportOfMount(req.Dirpath)
+	if e != nil {
+		h = e.handler
+		req.Dirpath = []byte(rest)
+	}
+	if mh, ok := h.(MountOptionsHandler); ok {
+		return mh.MountOptions(ctx, conn, req)
+	}
+	return nil
+}
+
+// Capabilities provides the capabilities of the handler of fs.
+func (x *exportSet) Capabilities(fs billy.Filesystem) Capabilities {
+	return CapabilitiesOf(x.handlerOf(fs), fs)
+}
+
+// unexported is the handler of the paths of no export, when the server has
+// no Handler of its own.
+type unexported struct{}
+
+func (unexported) Mount(context.Context, net.Conn, MountRequest) (MountStatus, billy.Filesystem, []AuthFlavor) {
+	return MountStatusErrNoEnt, nil, nil
+}
+
+func (unexported) Change(billy.Filesystem) billy.Change { return nil }
+
+func (unexported) FSStat(context.Context, billy.Filesystem, *FSStat) error { return nil }
+
+func (unexported) ToHandle(billy.Filesystem, []string) []byte { return nil }
+
+func (unexported) FromHandle([]byte) (billy.Filesystem, []string, error) {
+	return nil, []string{}, &NFSStatusError{NFSStatusStale, nil}
+}
+
+func (unexported) InvalidateHandle(billy.Filesystem, []byte) error { return nil }
+
+func (unexported) HandleLimit() int { return math.MaxInt32 }
@@ -0,0 +1,80 @@
+package nfs_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestAddExport(t *testing.T) {
+	tenantA, tenantB := memfs.New(), memfs.New()
+	for fs, name := range map[billy.Filesystem]string{tenantA: "/a", tenantB: "/b"} {
+		if err := billyutil.WriteFile(fs, name, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &nfs.Server{}
+	if err := srv.AddExport("a", helpers.NewCachingHandler(helpers.NewNullAuthHandler(tenantA), 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddExport("a", helpers.NewCachingHandler(helpers.NewNullAuthHandler(tenantA), 1024)); !errors.Is(err, nfs.ErrExportExists) {
+		t.Fatalf("expected a second export of a to fail, got %v", err)
+	}
+	ts := nfstest.Start(t, srv)
+	// exports can be added while serving.
+	if err := srv.AddExport("b", helpers.NewCachingHandler(helpers.NewNullAuthHandler(tenantB), 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if names := srv.Exports(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Fatalf("unexpected exports %v", names)
+	}
+
+	targets := make(map[string]*nfstest.Client)
+	for _, dirpath := range []string{"/a", "/b"} {
+		target, err := nfstest.Dial(ts.Addr(), dirpath, rpc.AuthNull)
+		if err != nil {
+			t.Fatalf("mount of %s: %v", dirpath, err)
+		}
+		defer target.Close()
+		targets[dirpath] = target
+	}
+	handles := make(map[string][]byte)
+	for dirpath, name := range map[string]string{"/a": "a", "/b": "b"} {
+		_, fh, err := targets[dirpath].Lookup(name, false)
+		if err != nil {
+			t.Fatalf("lookup of %s in %s: %v", name, dirpath, err)
+		}
+		handles[dirpath] = fh
+	}
+	if _, _, err := targets["/a"].Lookup("b", false); err == nil {
+		t.Fatal("expected export a not to see the files of export b")
+	}
+	if _, err := nfstest.Dial(ts.Addr(), "/", rpc.AuthNull); err == nil {
+		t.Fatal("expected the mount of a path of no export to fail")
+	}
+
+	if err := srv.RemoveExport("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RemoveExport("a"); !errors.Is(err, nfs.ErrUnknownExport) {
+		t.Fatalf("expected a second removal of a to fail, got %v", err)
+	}
+	if _, err := targets["/a"].GetAttr(handles["/a"]); !nfstest.IsStatus(err, nfs.NFSStatusStale) {
+		t.Fatalf("expected the handles of a removed export to be stale, got %v", err)
+	}
+	if _, err := targets["/b"].GetAttr(handles["/b"]); err != nil {
+		t.Fatalf("expected the handles of b to outlive the removal of another export: %v", err)
+	}
+	if _, err := nfstest.Dial(ts.Addr(), "/a", rpc.AuthNull); err == nil {
+		t.Fatal("expected the mount of a removed export to fail")
+	}
+}
@@ -0,0 +1,74 @@
+package nfs
+
+import (
+	"errors"
+	"net"
+)
+
+var errFenced = errors.New("client is fenced")
+
+// Fence refuses the future calls of the client at ip, such as when a cluster
+// manager has moved its exports to another node. NFS calls fail with status,
+// which should be NFSStatusStale, so that the client looks the export up
+// afresh, or NFSStatusAccess. Mounts are refused with MNT3ERR_ACCES.
+//
+// The mounts of the client are forgotten, leaving Mounts and MOUNT DUMP, and
+// so is its NFSv4 state, releasing its leases, opens and locks. Once Fence
+// returns, another node may take over.
+func (s *Server) Fence(ip net.IP, status NFSStatus) {
+	if status == NFSStatusOk {
+		status = NFSStatusStale
+	}
+	s.fenceMu.Lock()
+	if s.fences == nil {
+		s.fences = make(map[string]NFSStatus)
+	}
+	s.fences[ip.String()] = status
+	s.fenceMu.Unlock()
+
+	if err := s.mountStore().RemoveMounts(&net.IPAddr{IP: ip}); err != nil {
+		Log.Errorf("unable to remove the mounts of fenced client %v: %v", ip, err)
+	}
+	if s.nfs4State != nil {
+		s.nfs4State.removeClientsAt(ip.String())
+	}
+}
+
+// Unfence allows the client at ip to make calls again.
+func (s *Server) Unfence(ip net.IP) {
+	s.fenceMu.Lock()
+	defer s.fenceMu.Unlock()
+	delete(s.fences, ip.String())
+}
+
+// fenced reports the status calls from addr are refused with, if it is fenced.
+func (s *Server) fenced(addr net.Addr) (NFSStatus, bool) {
+	s.fenceMu.RLock()
+	defer s.fenceMu.RUnlock()
+	if len(s.fences) == 0 {
+		return NFSStatusOk, false
+	}
+	status, ok := s.fences[clientKey(addr)]
+	return status, ok
+}
+
+// checkFence refuses the calls of fenced clients. NULL calls are left to
+// succeed, so that the client still sees the server as up.
+func (c *conn) checkFence(w *response) error {
+	status, ok := c.Server.fenced(c.Conn.RemoteAddr())
+	if !ok {
+		return nil
+	}
+	switch w.req.Header.Prog {
+	case nfsServiceID:
+		if w.req.Header.Proc != uint32(NFSProcedureNull) {
+			return &NFSStatusError{status, errFenced}
+		}
+	case mountServiceID:
+		if w.req.Header.Proc == uint32(MountProcMount) {
+			// the MNT3ERR_ACCES mountstat3 shares the value of NFS3ERR_ACCES.
+			return &NFSStatusError{NFSStatusAccess, errFenced}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package nfs_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestFence(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/home", 0755)
+	store := &memNFS4Store{clients: make(map[string]nfs.NFS4ClientRecord)}
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:        helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		EnableNFSv4:    true,
+		NFS4StateStore: store,
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	// op runs a single operation COMPOUND, providing its status and result.
+	op := func(ops *bytes.Buffer) (uint32, io.Reader) {
+		res, err := compound4(target, 1, ops.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, _ := xdr.ReadUint32(res)
+		_, _ = xdr.ReadUint32(res) // empty tag
+		_, _ = xdr.ReadUint32(res) // result count
+		_, _ = xdr.ReadUint32(res) // op
+		_, _ = xdr.ReadUint32(res) // op status
+		return st, res
+	}
+	var ops bytes.Buffer
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetClientID))
+	ops.Write([]byte("verifier"))
+	_ = xdr.Write(&ops, "client-1")
+	_ = xdr.Write(&ops, uint32(0x40000000))
+	_ = xdr.Write(&ops, "tcp")
+	_ = xdr.Write(&ops, "127.0.0.1.8.1")
+	_ = xdr.Write(&ops, uint32(1))
+	st, res := op(&ops)
+	if st != 0 {
+		t.Fatalf("expected SETCLIENTID to succeed, got %d", st)
+	}
+	var clientID uint64
+	var confirm [8]byte
+	_ = xdr.Read(res, &clientID)
+	_, _ = io.ReadFull(res, confirm[:])
+	ops.Reset()
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetClientIDConfirm))
+	_ = xdr.Write(&ops, clientID)
+	ops.Write(confirm[:])
+	if st, _ := op(&ops); st != 0 {
+		t.Fatalf("expected SETCLIENTID_CONFIRM to succeed, got %d", st)
+	}
+	renew := func() uint32 {
+		ops.Reset()
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpRenew))
+		_ = xdr.Write(&ops, clientID)
+		st, _ := op(&ops)
+		return st
+	}
+	if len(srv.Mounts()) != 1 {
+		t.Fatalf("expected the mount to be listed, got %v", srv.Mounts())
+	}
+
+	localhost := net.ParseIP("127.0.0.1")
+	srv.Fence(localhost, nfs.NFSStatusStale)
+	if _, err := target.Getattr("/home"); !nfstest.IsStatus(err, nfs.NFSStatusStale) {
+		t.Fatalf("expected calls from a fenced client to be stale: %v", err)
+	}
+	if again, err := nfstest.Dial(srv.Addr(), "/", rpc.AuthNull); err == nil {
+		_ = again.Close()
+		t.Fatal("expected a fenced client to be unable to mount")
+	}
+	// the client is left to the node taking over.
+	if mounts := srv.Mounts(); len(mounts) != 0 {
+		t.Fatalf("expected the mounts of a fenced client to be dropped, got %v", mounts)
+	}
+	if recs, _ := store.Clients(); len(recs) != 0 {
+		t.Fatalf("expected the fenced NFSv4 client to be forgotten, got %v", recs)
+	}
+
+	srv.Unfence(localhost)
+	if _, err := target.Getattr("/home"); err != nil {
+		t.Fatalf("expected calls to succeed once unfenced: %v", err)
+	}
+	if st := renew(); st != uint32(nfs.NFSStatusExpired) {
+		t.Fatalf("expected the lease of the fenced client to be gone, got %d", st)
+	}
+}
@@ -1,11 +1,13 @@
 package nfs
 
 import (
-	"errors"
+	"context"
 	"hash/fnv"
 	"io"
 	"math"
 	"os"
+	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/go-git/go-billy/v5"
@@ -26,6 +28,34 @@ type FileAttribute struct {
 	FSID                uint64
 	Fileid              uint64
 	Atime, Mtime, Ctime FileTime
+
+	// change is the counter of a ChangeCounter, or zero.
+	change uint64
+}
+
+// ChangeCounter is an optional extension of the os.FileInfo returned by a
+// filesystem, or of its Sys() value, for backends whose timestamps are too
+// coarse to reveal every change. ChangeCounter returns a counter which grows
+// with every change to the data or metadata of the object.
+type ChangeCounter interface {
+	ChangeCounter() uint64
+}
+
+// FileIdentifier is an optional extension of the os.FileInfo returned by a
+// filesystem, for backends which present several objects with the same inode
+// number, such as a file and its copies in snapshots. Fileid is used as the
+// fileid of the object instead.
+type FileIdentifier interface {
+	Fileid() uint64
+}
+
+// Change provides the NFSv4 change attribute of the object: the counter of
+// its filesystem when it keeps one, and otherwise its ctime.
+func (f *FileAttribute) Change() uint64 {
+	if f.change != 0 {
+		return f.change
+	}
+	return uint64(f.Ctime.Seconds)<<32 | uint64(f.Ctime.Nseconds)
 }
 
 // FileType represents a NFS File Type
@@ -63,9 +93,50 @@ func (f FileType) String() string {
 	}
 }
 
+// The setuid, setgid and sticky bits of a mode, as they are sent to clients.
+const (
+	unixSetuid = 04000
+	unixSetgid = 02000
+	unixSticky = 01000
+)
+
+// modeBits are the bits of an os.FileMode a client can set.
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
 // Mode provides the OS interpreted mode of the file attributes
 func (f *FileAttribute) Mode() os.FileMode {
-	return os.FileMode(f.FileMode)
+	return os.FileMode(f.FileMode&^(unixSetuid|unixSetgid|unixSticky)) | fileModeFromUnix(f.FileMode&^0777)
+}
+
+// unixMode provides the bits of m a client can set as a mode3 does, with the
+// setuid, setgid and sticky bits where POSIX places them.
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= unixSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= unixSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= unixSticky
+	}
+	return mode
+}
+
+// fileModeFromUnix provides the os.FileMode of the bits of a mode3.
+func fileModeFromUnix(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&unixSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&unixSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&unixSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
 }
 
 // FileCacheAttribute is the subset of FileAttribute used by
@@ -90,7 +161,9 @@ func ToFileAttribute(info os.FileInfo, filePath string) *FileAttribute {
 	f := FileAttribute{}
 
 	m := info.Mode()
-	f.FileMode = uint32(m)
+	// the type bits of os.FileMode are kept above those of the mode, where
+	// clients ignore them, for Go clients of the server.
+	f.FileMode = uint32(m&^modeBits) | unixMode(m)
 	if info.IsDir() {
 		f.Type = FileTypeDirectory
 	} else if m&os.ModeSymlink != 0 {
@@ -109,35 +182,66 @@ func ToFileAttribute(info os.FileInfo, filePath string) *FileAttribute {
 	// The number of hard links to the file.
 	f.Nlink = 1
 
+	f.Filesize = uint64(info.Size())
+	f.Used = uint64(info.Size())
+	f.Mtime = ToNFSTime(info.ModTime())
+	f.Atime = f.Mtime
+	f.Ctime = f.Mtime
+
 	if a := file.GetInfo(info); a != nil {
 		f.Nlink = a.Nlink
 		f.UID = a.UID
 		f.GID = a.GID
 		f.SpecData = [2]uint32{a.Major, a.Minor}
 		f.Fileid = a.Fileid
+		if f.Fileid == 0 {
+			// the platform gives no inode numbers, as on Windows.
+			f.Fileid = fileidForPath(filePath)
+		}
+		if !a.Atime.IsZero() {
+			f.Atime = ToNFSTime(a.Atime)
+		}
+		if !a.Ctime.IsZero() {
+			f.Ctime = ToNFSTime(a.Ctime)
+		}
 	} else {
-		hasher := fnv.New64()
-		_, _ = hasher.Write([]byte(filePath))
-		f.Fileid = hasher.Sum64()
+		f.Fileid = fileidForPath(filePath)
+	}
+	if fi, ok := info.(FileIdentifier); ok {
+		f.Fileid = fi.Fileid()
 	}
 
-	f.Filesize = uint64(info.Size())
-	f.Used = uint64(info.Size())
-	f.Atime = ToNFSTime(info.ModTime())
-	f.Mtime = f.Atime
-	f.Ctime = f.Atime
+	cc, ok := info.(ChangeCounter)
+	if !ok {
+		cc, ok = info.Sys().(ChangeCounter)
+	}
+	if ok {
+		// NFSv3 has no change attribute, and clients watch the ctime of wcc
+		// data instead. The counter replaces its fraction, so that each change
+		// gives a distinct ctime however coarse the backend's clock.
+		f.change = cc.ChangeCounter()
+		f.Ctime.Nseconds = uint32(f.change % 1e9)
+	}
 	return &f
 }
 
+// fileidForPath derives a fileid for backends that don't expose inode numbers.
+// The path is canonicalized so that every spelling of it maps to one id.
+func fileidForPath(filePath string) uint64 {
+	hasher := fnv.New64()
+	_, _ = hasher.Write([]byte(path.Clean("/" + filepath.ToSlash(filePath))))
+	return hasher.Sum64()
+}
+
 // tryStat attempts to create a FileAttribute from a path.
-func tryStat(fs billy.Filesystem, path []string) *FileAttribute {
+func tryStat(ctx context.Context, fs billy.Filesystem, path []string) *FileAttribute {
 	fullPath := fs.Join(path...)
-	attrs, err := fs.Stat(fullPath)
+	attrs, err := fs.Lstat(fullPath)
 	if err != nil || attrs == nil {
 		Log.Errorf("err loading attrs for %s: %v", fs.Join(path...), err)
 		return nil
 	}
-	return ToFileAttribute(attrs, fullPath)
+	return exportAttributes(ctx, ToFileAttribute(attrs, fullPath))
 }
 
 // WriteWcc writes the `wcc_data` representation of an object.
@@ -201,26 +305,19 @@ type SetFileAttributes struct {
 // provided file.
 func (s *SetFileAttributes) Apply(changer billy.Change, fs billy.Filesystem, file string) error {
 	curOS, err := fs.Lstat(file)
-	if errors.Is(err, os.ErrNotExist) {
-		return &NFSStatusError{NFSStatusNoEnt, os.ErrNotExist}
-	} else if errors.Is(err, os.ErrPermission) {
-		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
-	} else if err != nil {
-		return nil
+	if err != nil {
+		return statusError(err, NFSStatusIO)
 	}
 	curr := ToFileAttribute(curOS, file)
 
 	if s.SetMode != nil {
-		mode := os.FileMode(*s.SetMode) & os.ModePerm
-		if mode != curr.Mode().Perm() {
+		mode := fileModeFromUnix(*s.SetMode)
+		if mode != curr.Mode()&modeBits {
 			if changer == nil {
 				return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
 			}
 			if err := changer.Chmod(file, mode); err != nil {
-				if errors.Is(err, os.ErrPermission) {
-					return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
-				}
-				return err
+				return statusError(err, NFSStatusIO)
 			}
 		}
 	}
@@ -238,10 +335,7 @@ func (s *SetFileAttributes) Apply(changer billy.Change, fs billy.Filesystem, fil
 				return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
 			}
 			if err := changer.Lchown(file, int(euid), int(egid)); err != nil {
-				if errors.Is(err, os.ErrPermission) {
-					return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
-				}
-				return err
+				return statusError(err, NFSStatusIO)
 			}
 		}
 	}
@@ -250,19 +344,18 @@ func (s *SetFileAttributes) Apply(changer billy.Change, fs billy.Filesystem, fil
 			return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
 		}
 		fp, err := fs.OpenFile(file, os.O_WRONLY|os.O_EXCL, 0)
-		if errors.Is(err, os.ErrPermission) {
-			return &NFSStatusError{NFSStatusAccess, err}
-		} else if err != nil {
-			return err
+		if err != nil {
+			return statusError(err, NFSStatusAccess)
 		}
 		if *s.SetSize > math.MaxInt64 {
 			return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
 		}
 		if err := fp.Truncate(int64(*s.SetSize)); err != nil {
-			return err
+			_ = fp.Close()
+			return statusError(err, NFSStatusIO)
 		}
 		if err := fp.Close(); err != nil {
-			return err
+			return statusError(err, NFSStatusIO)
 		}
 	}
 
@@ -275,15 +368,12 @@ func (s *SetFileAttributes) Apply(changer billy.Change, fs billy.Filesystem, fil
 		if s.SetMtime != nil {
 			mtime = s.SetMtime
 		}
-		if atime != curr.Atime.Native() || mtime != curr.Mtime.Native() {
+		if !atime.Equal(*curr.Atime.Native()) || !mtime.Equal(*curr.Mtime.Native()) {
 			if changer == nil {
 				return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
 			}
 			if err := changer.Chtimes(file, *atime, *mtime); err != nil {
-				if errors.Is(err, os.ErrPermission) {
-					return &NFSStatusError{NFSStatusAccess, err}
-				}
-				return err
+				return statusError(err, NFSStatusIO)
 			}
 		}
 	}
@@ -293,7 +383,7 @@ func (s *SetFileAttributes) Apply(changer billy.Change, fs billy.Filesystem, fil
 // Mode returns a mode if specified or the provided default mode.
 func (s *SetFileAttributes) Mode(def os.FileMode) os.FileMode {
 	if s.SetMode != nil {
-		return os.FileMode(*s.SetMode) & os.ModePerm
+		return fileModeFromUnix(*s.SetMode)
 	}
 	return def
 }
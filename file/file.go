@@ -1,6 +1,9 @@
 package file
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 type FileInfo struct {
 	Nlink  uint32
@@ -9,9 +12,16 @@ type FileInfo struct {
 	Major  uint32
 	Minor  uint32
 	Fileid uint64
+	// Atime and Ctime are the access and status change times, when known.
+	Atime time.Time
+	Ctime time.Time
 }
 
 // GetInfo extracts some non-standardized items from the result of a Stat call.
+// A filesystem of its own may give them as a *FileInfo from Sys.
 func GetInfo(fi os.FileInfo) *FileInfo {
+	if info, ok := fi.Sys().(*FileInfo); ok {
+		return info
+	}
 	return getInfo(fi)
 }
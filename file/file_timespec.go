@@ -0,0 +1,12 @@
+//go:build dragonfly || linux || openbsd || solaris
+
+package file
+
+import (
+	"syscall"
+	"time"
+)
+
+func statTimes(s *syscall.Stat_t) (atime, ctime time.Time) {
+	return time.Unix(s.Atim.Unix()), time.Unix(s.Ctim.Unix())
+}
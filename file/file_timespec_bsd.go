@@ -0,0 +1,12 @@
+//go:build darwin || freebsd || netbsd
+
+package file
+
+import (
+	"syscall"
+	"time"
+)
+
+func statTimes(s *syscall.Stat_t) (atime, ctime time.Time) {
+	return time.Unix(s.Atimespec.Unix()), time.Unix(s.Ctimespec.Unix())
+}
@@ -2,11 +2,22 @@
 
 package file
 
-import "os"
+import (
+	"os"
+	"syscall"
+	"time"
+)
 
 func getInfo(info os.FileInfo) *FileInfo {
 	// https://godoc.org/golang.org/x/sys/windows#GetFileInformationByHandle
-	// can be potentially used to populate Nlink
-
-	return nil
+	// can be potentially used to populate Nlink and Fileid, but needs the
+	// file to be opened.
+	d, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return nil
+	}
+	return &FileInfo{
+		Nlink: 1,
+		Atime: time.Unix(0, d.LastAccessTime.Nanoseconds()),
+	}
 }
@@ -0,0 +1,144 @@
+package nfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/file"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestStableFileid(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inode numbers are not exposed on windows")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := nfstest.ServeFS(t, osfs.New(dir))
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	a, _, err := target.Lookup("/a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := target.Lookup("/b", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.(*nfsc.Fattr).Fileid != b.(*nfsc.Fattr).Fileid {
+		t.Fatal("hard links should share a fileid")
+	}
+	c, _, err := target.Lookup("/c", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.(*nfsc.Fattr).Fileid == a.(*nfsc.Fattr).Fileid {
+		t.Fatal("a symlink should not report the fileid of its target")
+	}
+
+	entries, err := nfstest.ReadDir(target.Target, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		want := a.(*nfsc.Fattr).Fileid
+		if e.FileName == "c" {
+			want = c.(*nfsc.Fattr).Fileid
+		}
+		if e.FileId != want {
+			t.Fatalf("readdir fileid for %s does not match lookup", e.FileName)
+		}
+	}
+}
+
+type countedFileInfo struct {
+	os.FileInfo
+	change uint64
+}
+
+func (f countedFileInfo) ChangeCounter() uint64 { return f.change }
+
+func TestChangeCounter(t *testing.T) {
+	mem := memfs.New()
+	if err := billyutil.WriteFile(mem, "/file", []byte("hello"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	info, err := mem.Lstat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := nfs.ToFileAttribute(info, "/file")
+	if want := uint64(plain.Ctime.Seconds)<<32 | uint64(plain.Ctime.Nseconds); plain.Change() != want {
+		t.Fatalf("expected the change attribute to follow ctime, got %d", plain.Change())
+	}
+
+	before := nfs.ToFileAttribute(countedFileInfo{info, 41}, "/file")
+	after := nfs.ToFileAttribute(countedFileInfo{info, 42}, "/file")
+	if before.Change() != 41 || after.Change() != 42 {
+		t.Fatalf("expected the change counter, got %d and %d", before.Change(), after.Change())
+	}
+	if before.AsCache().Ctime == after.AsCache().Ctime {
+		t.Fatal("expected a change to be visible in the wcc ctime")
+	}
+	if before.Ctime.Seconds != plain.Ctime.Seconds {
+		t.Fatal("expected the ctime seconds to be kept")
+	}
+}
+
+// inodelessFileInfo gives the attributes of platforms without inode numbers,
+// as Windows does.
+type inodelessFileInfo struct {
+	os.FileInfo
+	atime time.Time
+}
+
+func (f inodelessFileInfo) Sys() interface{} {
+	return &file.FileInfo{Nlink: 1, Atime: f.atime}
+}
+
+func TestFileidWithoutInode(t *testing.T) {
+	mem := memfs.New()
+	if err := billyutil.WriteFile(mem, "/file", []byte("hello"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	info, err := mem.Lstat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	atime := time.Unix(1700000000, 0)
+	fi := inodelessFileInfo{info, atime}
+
+	a := nfs.ToFileAttribute(fi, "/file")
+	if a.Fileid == 0 {
+		t.Fatal("expected a fileid derived from the path")
+	}
+	if b := nfs.ToFileAttribute(fi, "/dir/../file"); b.Fileid != a.Fileid {
+		t.Fatal("expected every spelling of a path to have one fileid")
+	}
+	if other := nfs.ToFileAttribute(fi, "/other"); other.Fileid == a.Fileid {
+		t.Fatal("expected another path to have another fileid")
+	}
+	if a.Atime.Seconds != uint32(atime.Unix()) {
+		t.Fatalf("expected the access time of the platform, got %d", a.Atime.Seconds)
+	}
+}
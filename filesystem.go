@@ -1,6 +1,11 @@
 package nfs
 
-import "time"
+import (
+	"os"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
 
 // FSStat returns metadata about a file system
 type FSStat struct {
@@ -13,3 +18,146 @@ type FSStat struct {
 	// CacheHint is called "invarsec" in the nfs standard
 	CacheHint time.Duration
 }
+
+// FSInfo describes the static limits of a file system, as reported to clients
+// in FSINFO.
+type FSInfo struct {
+	// MaxFileSize is the size of the largest file the file system can store.
+	MaxFileSize uint64
+	// TimeDelta is the granularity with which timestamps are stored.
+	TimeDelta time.Duration
+}
+
+// FSInfoFilesystem is an optional extension of a billy.Filesystem that reports
+// its real limits. FSInfo is passed the server defaults, and should adjust the
+// fields the file system knows better.
+type FSInfoFilesystem interface {
+	FSInfo(*FSInfo) error
+}
+
+// fsInfoFor provides the limits of fs, falling back to the defaults when the
+// file system doesn't report its own.
+func fsInfoFor(fs billy.Filesystem) (FSInfo, error) {
+	info := FSInfo{
+		MaxFileSize: 1 << 62, // wild guess. this seems big.
+		TimeDelta:   time.Nanosecond,
+	}
+	if ifs, ok := fs.(FSInfoFilesystem); ok {
+		if err := ifs.FSInfo(&info); err != nil {
+			return info, err
+		}
+	}
+	return info, nil
+}
+
+// ListingFilesystem is an optional extension of a billy.Filesystem that can
+// list a directory a part at a time, for directories too large to be read in
+// full for each page of a listing. READDIR and READDIRPLUS then resume each
+// listing from the name of the entry their cookie was given for, so entries
+// added or removed between pages don't shift the rest, and hold only a page
+// of the directory at a time.
+type ListingFilesystem interface {
+	// ReadDirFrom provides up to n entries of dirname sorting by name after
+	// the name after, in order. An empty after starts at the first entry, and
+	// fewer than n entries are provided only once the listing is done.
+	ReadDirFrom(dirname string, after string, n int) ([]os.FileInfo, error)
+}
+
+// PagedFilesystem is an optional extension of a billy.Filesystem whose
+// directories are listed a page at a time by continuation tokens, as those of
+// databases and object stores are. It is used as ListingFilesystem is, with
+// listings resuming from the page holding the entry a cookie was given for.
+type PagedFilesystem interface {
+	// ReadDirPaged provides up to n entries of dirname from the page at
+	// token, with the token of the following page. An empty token starts at
+	// the first page, and an empty next token ends the listing. Listing a
+	// token again should provide the same page, or those entries to follow
+	// it, for as long as clients may continue a listing from it.
+	ReadDirPaged(dirname string, token string, n int) (entries []os.FileInfo, next string, err error)
+}
+
+// SyncFilesystem is an optional extension of a billy.Filesystem that can flush
+// the contents of a file to stable storage, as fsync(2) does. Files opened
+// from a filesystem may instead provide a `Sync() error` method directly.
+//
+// When neither is available, writes are assumed to be stable as soon as the
+// backing filesystem accepts them.
+type SyncFilesystem interface {
+	Sync(filename string) error
+}
+
+type syncFile interface {
+	Sync() error
+}
+
+// canSync reports whether data written to files of fs can be explicitly
+// flushed, which determines whether UNSTABLE writes need a later COMMIT.
+func canSync(fs billy.Filesystem, f billy.File) bool {
+	if _, ok := f.(syncFile); ok {
+		return true
+	}
+	_, ok := fs.(SyncFilesystem)
+	return ok
+}
+
+// syncToStable flushes the contents of f, open at path, to stable storage.
+func syncToStable(fs billy.Filesystem, f billy.File, path string) error {
+	if sf, ok := f.(syncFile); ok {
+		return sf.Sync()
+	}
+	if sfs, ok := fs.(SyncFilesystem); ok {
+		return sfs.Sync(path)
+	}
+	return nil
+}
+
+// Invalidator is told of changes made to a filesystem other than through NFS,
+// so that the handles and directory listings cached for it are dropped.
+// Paths are relative to the root of the filesystem it was given for.
+type Invalidator interface {
+	// InvalidatePath forgets path and everything below it, after it has been
+	// removed or replaced.
+	InvalidatePath(path []string)
+	// InvalidateListing forgets the listing of the directory at path, after
+	// entries have been added to or removed from it.
+	InvalidateListing(path []string)
+}
+
+// InvalidatingFilesystem is an optional extension of a billy.Filesystem whose
+// contents can change behind the server, such as a remote or layered backend.
+// SetInvalidator is called by caching handlers each time the filesystem is
+// mounted, with an Invalidator for the caches of that handler. Wrapping
+// filesystems should pass on an Invalidator to the filesystems they wrap,
+// translating paths where theirs differ.
+type InvalidatingFilesystem interface {
+	SetInvalidator(Invalidator)
+}
+
+// SparseFile is an optional extension of a billy.File that knows where its
+// holes are, the regions which read as zeros without being stored, as lseek(2)
+// does with SEEK_DATA and SEEK_HOLE. READ_PLUS reports the holes of such
+// files to clients in place of their zeros.
+type SparseFile interface {
+	// SeekData provides the offset of the first data at or after offset, or
+	// io.EOF when only a hole follows it.
+	SeekData(offset int64) (int64, error)
+	// SeekHole provides the offset of the first hole at or after offset,
+	// which is the size of the file when data runs up to its end.
+	SeekHole(offset int64) (int64, error)
+}
+
+// SecLabelXattr is the extended attribute the NFSv4.2 sec_label of a file is
+// stored in, the SELinux context of the file.
+const SecLabelXattr = "security.selinux"
+
+// XattrFilesystem is an optional extension of a billy.Filesystem storing the
+// extended attributes of files, as lgetxattr(2) and lsetxattr(2) do, without
+// following links. The NFSv4.2 sec_label of files is stored through it, in
+// their SecLabelXattr attribute.
+type XattrFilesystem interface {
+	// Getxattr provides the value of the attribute name of the file at
+	// path, failing with an error matching os.ErrNotExist when it has none.
+	Getxattr(path, name string) ([]byte, error)
+	// Setxattr sets the attribute name of the file at path to value.
+	Setxattr(path, name string, value []byte) error
+}
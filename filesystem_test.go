@@ -0,0 +1,110 @@
+package nfs_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// invalidatingFS is a filesystem modified behind the server by the test.
+type invalidatingFS struct {
+	billy.Filesystem
+	inv nfs.Invalidator
+}
+
+func (fs *invalidatingFS) SetInvalidator(inv nfs.Invalidator) {
+	fs.inv = inv
+}
+
+func TestInvalidator(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/d", 0755)
+	_ = billyutil.WriteFile(mem, "/d/f", []byte("x"), 0644)
+	fs := &invalidatingFS{Filesystem: mem}
+
+	srv := nfstest.ServeFS(t, fs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	if fs.inv == nil {
+		t.Fatal("expected the filesystem to be given an invalidator on mount")
+	}
+
+	_, dir, err := target.Lookup("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the directory is replaced behind the server, which still resolves its
+	// handle until told.
+	_ = mem.Remove("/d/f")
+	_ = mem.Remove("/d")
+	_ = mem.MkdirAll("/d", 0755)
+	if _, _, err := nfstest.Lookup(target.Target, dir, "f"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected NOENT before invalidation: %v", err)
+	}
+	fs.inv.InvalidatePath([]string{"d"})
+	if _, _, err := nfstest.Lookup(target.Target, dir, "f"); !nfstest.IsStatus(err, nfs.NFSStatusStale) {
+		t.Fatalf("expected the replaced directory to be stale: %v", err)
+	}
+
+	_ = billyutil.WriteFile(mem, "/new", []byte("x"), 0644)
+	fs.inv.InvalidateListing([]string{})
+	entries, err := nfstest.ReadDir(target.Target, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected the new entry to be listed, got %d entries", len(entries))
+	}
+}
+
+// declaredCapabilities declares the capabilities of its filesystems.
+type declaredCapabilities struct {
+	nfs.Handler
+	caps nfs.Capabilities
+}
+
+func (h *declaredCapabilities) Capabilities(billy.Filesystem) nfs.Capabilities {
+	return h.caps
+}
+
+func TestCapabilities(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/file", []byte("hello"), 0644)
+	_ = mem.Symlink("file", "/link")
+
+	for _, caps := range []nfs.Capabilities{nfs.CapabilitySymlinks, 0} {
+		handler := &declaredCapabilities{helpers.NewNullAuthHandler(mem), caps}
+		srv, err := nfstest.NewServer(helpers.NewCachingHandler(handler, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := srv.Mount(t, "/", rpc.AuthNull)
+
+		info, err := target.FSInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Properties&nfs.FSInfoPropertySymlink != 0; got != (caps != 0) {
+			t.Fatalf("expected FSINFO to advertise symlinks only when declared, got properties %x for %v", info.Properties, caps)
+		}
+		if info.Properties&nfs.FSInfoPropertyLink != 0 {
+			t.Fatalf("expected FSINFO not to advertise links that aren't declared: %x", info.Properties)
+		}
+		err = target.Symlink("file", "/other")
+		if caps == 0 && !nfstest.IsStatus(err, nfs.NFSStatusNotSupp) {
+			t.Fatalf("expected symlinks to be refused as unsupported: %v", err)
+		} else if caps != 0 && err != nil {
+			t.Fatal(err)
+		}
+		target.Close()
+		srv.Close()
+	}
+}
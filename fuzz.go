@@ -0,0 +1,62 @@
+package nfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// DecodeCall decodes the header of an RPC call message, given without its
+// record mark, as the server does for every call it receives. It is exposed
+// for fuzzing.
+func DecodeCall(msg []byte) (rpc.Header, error) {
+	c := &conn{Server: &Server{}}
+	w, err := c.readRequestHeader(context.Background(), bufio.NewReader(bytes.NewReader(record(msg))))
+	if err != nil {
+		return rpc.Header{}, err
+	}
+	return w.req.Header, nil
+}
+
+// HandleMessage handles a single RPC call message, given without its record
+// mark, as though it were received from a loopback client, and returns the
+// reply. It runs the procedures of the MOUNT and NFS programs on their
+// arguments without a network, so that their decoding can be fuzzed.
+func (s *Server) HandleMessage(ctx context.Context, msg []byte) ([]byte, error) {
+	s.init()
+	c := s.newConn(loopbackConn{})
+	w, err := c.readRequestHeader(ctx, bufio.NewReader(bytes.NewReader(record(msg))))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.handle(ctx, w); err != nil {
+		return nil, err
+	}
+	return w.writer.Bytes(), nil
+}
+
+// record frames msg as the single fragment of a record.
+func record(msg []byte) []byte {
+	rec := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(rec, uint32(len(msg))|1<<31)
+	return append(rec, msg...)
+}
+
+// loopbackConn is the connection of the calls given to HandleMessage.
+type loopbackConn struct{}
+
+func (loopbackConn) Read([]byte) (int, error)    { return 0, net.ErrClosed }
+func (loopbackConn) Write(b []byte) (int, error) { return len(b), nil }
+func (loopbackConn) Close() error                { return nil }
+func (loopbackConn) LocalAddr() net.Addr         { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2049} }
+func (loopbackConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1023}
+}
+func (loopbackConn) SetDeadline(time.Time) error      { return nil }
+func (loopbackConn) SetReadDeadline(time.Time) error  { return nil }
+func (loopbackConn) SetWriteDeadline(time.Time) error { return nil }
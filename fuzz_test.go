@@ -0,0 +1,76 @@
+package nfs_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func FuzzDecodeCall(f *testing.F) {
+	f.Add(callMessage(nfsc.Nfs3Prog, 3, 0, nil))
+	f.Add(callMessage(nfsc.MountProg, 3, 1, []byte{0, 0, 0, 1, '/', 0, 0, 0}))
+	f.Add([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 1, 0x86, 0xa3, 0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 1, 0x7f, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		_, _ = nfs.DecodeCall(msg)
+	})
+}
+
+func FuzzMountCall(f *testing.F) {
+	for _, p := range []string{"/", "/dir", "", "/missing"} {
+		var args bytes.Buffer
+		_ = xdr.Write(&args, p)
+		for _, proc := range []uint32{1, 3} {
+			f.Add(proc, args.Bytes())
+		}
+	}
+	f.Add(uint32(1), []byte{0xff, 0xff, 0xff, 0xff})
+	srv, _ := fuzzServer(f)
+	f.Fuzz(func(t *testing.T, proc uint32, args []byte) {
+		reply, err := srv.HandleMessage(context.Background(), callMessage(nfsc.MountProg, 3, proc%6, args))
+		if err == nil && len(reply) < 8 {
+			t.Fatalf("expected a reply, got %x", reply)
+		}
+	})
+}
+
+func FuzzNFSCall(f *testing.F) {
+	srv, dir := fuzzServer(f)
+	var name bytes.Buffer
+	_ = xdr.Write(&name, dir)
+	_ = xdr.Write(&name, "file")
+	var handle bytes.Buffer
+	_ = xdr.Write(&handle, dir)
+	for proc := uint32(0); proc <= uint32(nfs.NFSProcedureCommit); proc++ {
+		f.Add(proc, handle.Bytes())
+		f.Add(proc, name.Bytes())
+		f.Add(proc, append(name.Bytes(), make([]byte, 64)...))
+	}
+	f.Add(uint32(nfs.NFSProcedureLookup), append(handle.Bytes(), 0x7f, 0xff, 0xff, 0xff))
+	f.Add(uint32(nfs.NFSProcedureWrite), append(handle.Bytes(), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0, 0x7f, 0xff, 0xff, 0xff))
+	f.Fuzz(func(t *testing.T, proc uint32, args []byte) {
+		reply, err := srv.HandleMessage(context.Background(), callMessage(nfsc.Nfs3Prog, 3, proc%22, args))
+		if err == nil && len(reply) < 8 {
+			t.Fatalf("expected a reply, got %x", reply)
+		}
+	})
+}
+
+func fuzzServer(t testing.TB) (*nfs.Server, []byte) {
+	mem := memfs.New()
+	if err := mem.MkdirAll("/dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := billyutil.WriteFile(mem, "/dir/file", []byte("hello"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+	return &nfs.Server{Handler: handler, EnableNFSv4: true}, handler.ToHandle(mem, []string{"dir"})
+}
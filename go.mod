@@ -3,6 +3,7 @@ module github.com/willscott/go-nfs
 go 1.19
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/go-git/go-billy/v5 v5.5.0
 	github.com/google/uuid v1.5.0
 	github.com/hashicorp/golang-lru/v2 v2.0.7
@@ -10,12 +11,15 @@ require (
 	github.com/willscott/go-nfs-client v0.0.0-20240104095149-b44639837b00
 	github.com/willscott/memphis v0.0.0-20210922141505-529d4987ab7e
 	golang.org/x/sys v0.16.0
+	golang.org/x/text v0.14.0
 )
 
 require (
 	github.com/cyphar/filepath-securejoin v0.2.4 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/polydawn/go-timeless-api v0.0.0-20220821201550-b93919e12c56 // indirect
 	github.com/polydawn/refmt v0.0.0-20201211092308-30ac6d18308e // indirect
 	github.com/polydawn/rio v0.0.0-20220823181337-7c31ad9831a4 // indirect
 	github.com/warpfork/go-errcat v0.0.0-20180917083543-335044ffc86e // indirect
+	golang.org/x/net v0.19.0 // indirect
 )
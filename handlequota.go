@@ -0,0 +1,82 @@
+package nfs
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// handleQuotas tracks the handles given to each client address on exports
+// with ExportOptions.MaxHandles.
+type handleQuotas struct {
+	mu      sync.Mutex
+	clients map[string]*clientHandles
+	// holders counts the clients each handle was given to.
+	holders map[string]int
+}
+
+// clientHandles are the handles given to a client, most recently first.
+type clientHandles struct {
+	order *list.List
+	index map[string]*list.Element
+}
+
+// quotaHandle is a handle given to a client.
+type quotaHandle struct {
+	fs     billy.Filesystem
+	handle []byte
+}
+
+func newHandleQuotas() *handleQuotas {
+	return &handleQuotas{clients: make(map[string]*clientHandles), holders: make(map[string]int)}
+}
+
+// give records handle as given to client, and provides the handles past
+// limit that client no longer holds and no other client was given.
+func (q *handleQuotas) give(client string, limit int, fs billy.Filesystem, handle []byte) []quotaHandle {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c, ok := q.clients[client]
+	if !ok {
+		c = &clientHandles{order: list.New(), index: make(map[string]*list.Element)}
+		q.clients[client] = c
+	}
+	key := string(handle)
+	if e, ok := c.index[key]; ok {
+		c.order.MoveToFront(e)
+	} else {
+		c.index[key] = c.order.PushFront(quotaHandle{fs, handle})
+		q.holders[key]++
+	}
+	var forgotten []quotaHandle
+	for c.order.Len() > limit {
+		old := c.order.Remove(c.order.Back()).(quotaHandle)
+		oldKey := string(old.handle)
+		delete(c.index, oldKey)
+		if q.holders[oldKey]--; q.holders[oldKey] <= 0 {
+			delete(q.holders, oldKey)
+			forgotten = append(forgotten, old)
+		}
+	}
+	return forgotten
+}
+
+// toHandle provides the handle of path in fs for the reply to a call,
+// counting it against the handles of the client when the export bounds
+// them. The root of an export is not counted, since clients learn its
+// handle by mounting it.
+func (w *response) toHandle(ctx context.Context, userHandle Handler, fs billy.Filesystem, path []string) []byte {
+	handle := userHandle.ToHandle(fs, path)
+	opts := exportOptionsFromContext(ctx)
+	if opts == nil || opts.MaxHandles <= 0 || len(path) == 0 || w.conn == nil {
+		return handle
+	}
+	for _, old := range w.Server.handleQuotas.give(clientKey(w.Conn.RemoteAddr()), opts.MaxHandles, fs, handle) {
+		if err := userHandle.InvalidateHandle(old.fs, old.handle); err != nil {
+			Log.Debugf("unable to forget a handle past the quota of %v: %v", w.Conn.RemoteAddr(), err)
+		}
+	}
+	return handle
+}
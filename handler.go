@@ -44,9 +44,78 @@ type UnixChange interface {
 
 // CachingHandler represents the optional caching work that a user may wish to over-ride with
 // their own implementations, but which can be otherwise provided through defaults.
+// Cached listings are continued only while their directory keeps the change
+// attribute, or mtime, it had when it was listed.
 type CachingHandler interface {
 	VerifierFor(path string, contents []fs.FileInfo) uint64
 
 	// fs.FileInfo needs to be sorted by Name(), nil in case of a cache-miss
 	DataForVerifier(path string, verifier uint64) []fs.FileInfo
 }
+
+// ListingVerifier is an optional extension of a Handler providing the cookie
+// verifiers of directory listings without keeping the listings, as a
+// CachingHandler does. Continuations of a listing then read the directory
+// again, and are refused with NFS3ERR_BAD_COOKIE once it has changed.
+type ListingVerifier interface {
+	// VerifierFor provides the cookie verifier for a directory listing. It must
+	// change whenever the sorted contents of the directory change.
+	VerifierFor(path string, contents []fs.FileInfo) uint64
+}
+
+// Capabilities are the optional features of the filesystems of a Handler.
+type Capabilities uint32
+
+const (
+	// CapabilitySymlinks serves SYMLINK and READLINK.
+	CapabilitySymlinks Capabilities = 1 << iota
+	// CapabilityLinks serves LINK, through the UnixChange of the filesystem.
+	CapabilityLinks
+	// CapabilitySpecialFiles serves MKNOD, through the UnixChange of the
+	// filesystem.
+	CapabilitySpecialFiles
+	// CapabilitySync flushes writes to stable storage, through the
+	// SyncFilesystem or the files of the filesystem, where they can be.
+	// Without it, writes are taken as stable once the filesystem accepts
+	// them.
+	CapabilitySync
+	// CapabilityXattrs serves the NFSv4.2 sec_label attribute, through the
+	// XattrFilesystem of the filesystem.
+	CapabilityXattrs
+)
+
+// CapabilityHandler is an optional extension of a Handler declaring the
+// capabilities of its filesystems, in place of inferring them from the
+// interfaces the filesystems implement. Procedures needing a capability a
+// filesystem lacks fail with NFS3ERR_NOTSUPP, and FSINFO advertises those
+// it has.
+type CapabilityHandler interface {
+	Capabilities(fs billy.Filesystem) Capabilities
+}
+
+// CapabilitiesOf provides the capabilities of the filesystem fs of h, as it
+// declares them or, when it doesn't, as they are inferred: symlinks and
+// syncing for every filesystem, links and special files for those whose
+// Change is a UnixChange, and extended attributes for XattrFilesystems.
+// Handlers wrapping others pass them through with it.
+func CapabilitiesOf(h Handler, fs billy.Filesystem) Capabilities {
+	if ch, ok := h.(CapabilityHandler); ok {
+		return ch.Capabilities(fs)
+	}
+	caps := CapabilitySymlinks | CapabilitySync
+	if _, ok := h.Change(fs).(UnixChange); ok {
+		caps |= CapabilityLinks | CapabilitySpecialFiles
+	}
+	if _, ok := fs.(XattrFilesystem); ok {
+		caps |= CapabilityXattrs
+	}
+	return caps
+}
+
+// requireCapability refuses calls against fs needing a capability it lacks.
+func requireCapability(h Handler, fs billy.Filesystem, c Capabilities) error {
+	if CapabilitiesOf(h, fs)&c == 0 {
+		return &NFSStatusError{NFSStatusNotSupp, billy.ErrNotSupported}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthOptions configure the checks of Server.Healthy.
+type HealthOptions struct {
+	// Probe, when set, checks that the backend can be reached, such as by
+	// a stat of the root of a remote filesystem. The server is unhealthy
+	// while it fails.
+	Probe func(ctx context.Context) error
+	// MaxErrorRate, when set, is the fraction of recent calls which may fail
+	// with server errors, NFS3ERR_IO, NFS3ERR_SERVERFAULT or SYSTEM_ERR,
+	// before the server is unhealthy. Errors such as NFS3ERR_NOENT, which
+	// arise from the calls rather than the server, aren't counted.
+	MaxErrorRate float64
+	// ErrorWindow is how long calls count toward the error rate for, a
+	// minute when zero.
+	ErrorWindow time.Duration
+	// MinCalls is the number of recent calls below which the error rate
+	// isn't checked, so that a failure seen by an idle server doesn't make
+	// it unhealthy.
+	MinCalls uint64
+}
+
+// PingStats count the calls of the NULL procedure, with which clients and
+// load balancers probe servers, made over a transport.
+type PingStats struct {
+	// Transport is the network of the listener pings were made to, such
+	// as "tcp".
+	Transport string
+	Count     uint64
+	Last      time.Time
+}
+
+var errNotServing = errors.New("server is not serving")
+
+// healthTracker records the pings, listeners and server errors the health of
+// a server is judged by. Errors are counted for the window in progress and
+// the one before it.
+type healthTracker struct {
+	mu      sync.Mutex
+	serving int
+	pings   map[string]*PingStats
+	window  time.Duration
+	start   time.Time
+	calls   [2]uint64
+	failed  [2]uint64
+}
+
+func newHealthTracker(opts HealthOptions) *healthTracker {
+	window := opts.ErrorWindow
+	if window == 0 {
+		window = time.Minute
+	}
+	return &healthTracker{pings: make(map[string]*PingStats), window: window, start: time.Now()}
+}
+
+// listening counts a listener starting or, with a negative n, finishing.
+func (t *healthTracker) listening(n int) {
+	t.mu.Lock()
+	t.serving += n
+	t.mu.Unlock()
+}
+
+func (t *healthTracker) record(transport string, w *response) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if w.req.Header.Proc == 0 {
+		p, ok := t.pings[transport]
+		if !ok {
+			p = &PingStats{Transport: transport}
+			t.pings[transport] = p
+		}
+		p.Count++
+		p.Last = now
+		return
+	}
+	t.advance(now)
+	t.calls[0]++
+	if isServerError(w.err) {
+		t.failed[0]++
+	}
+}
+
+// advance moves the counts of calls on to the window of now.
+func (t *healthTracker) advance(now time.Time) {
+	elapsed := now.Sub(t.start)
+	if elapsed < t.window {
+		return
+	}
+	if elapsed < 2*t.window {
+		t.calls[1], t.failed[1] = t.calls[0], t.failed[0]
+	} else {
+		t.calls[1], t.failed[1] = 0, 0
+	}
+	t.calls[0], t.failed[0] = 0, 0
+	t.start = now
+}
+
+// errorRate provides the recent calls, and the fraction of them which failed
+// with server errors.
+func (t *healthTracker) errorRate() (uint64, float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(time.Now())
+	calls := t.calls[0] + t.calls[1]
+	if calls == 0 {
+		return 0, 0
+	}
+	return calls, float64(t.failed[0]+t.failed[1]) / float64(calls)
+}
+
+func (t *healthTracker) list() []PingStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]PingStats, 0, len(t.pings))
+	for _, p := range t.pings {
+		stats = append(stats, *p)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Transport < stats[j].Transport })
+	return stats
+}
+
+// isServerError reports whether err is a failure of the server, rather than
+// of the call.
+func isServerError(err error) bool {
+	var nfsErr *NFSStatusError
+	if errors.As(err, &nfsErr) {
+		return nfsErr.NFSStatus == NFSStatusIO || nfsErr.NFSStatus == NFSStatusServerFault
+	}
+	var rpcErr RPCError
+	return errors.As(err, &rpcErr) && rpcErr.Code() == ResponseCodeSystemErr
+}
+
+// PingStats provides the pings made to the server over each transport,
+// ordered by transport.
+func (s *Server) PingStats() []PingStats {
+	s.init()
+	return s.health.list()
+}
+
+// Healthy reports whether the server is fit to be sent calls, for the health
+// checks of load balancers: it must be serving on a listener, the Probe of
+// its HealthOptions must succeed, and its recent calls must fail with server
+// errors no more often than MaxErrorRate allows. The error says which check
+// failed.
+func (s *Server) Healthy(ctx context.Context) error {
+	s.init()
+	s.health.mu.Lock()
+	serving := s.health.serving
+	s.health.mu.Unlock()
+	if serving == 0 {
+		return errNotServing
+	}
+	if s.HealthOptions.Probe != nil {
+		if err := s.HealthOptions.Probe(ctx); err != nil {
+			return fmt.Errorf("backend probe failed: %w", err)
+		}
+	}
+	if s.HealthOptions.MaxErrorRate > 0 {
+		calls, rate := s.health.errorRate()
+		if calls >= s.HealthOptions.MinCalls && rate > s.HealthOptions.MaxErrorRate {
+			return fmt.Errorf("%.0f%% of the last %d calls failed", rate*100, calls)
+		}
+	}
+	return nil
+}
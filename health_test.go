@@ -0,0 +1,103 @@
+package nfs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// failingFS fails to stat its files while fail is set.
+type failingFS struct {
+	billy.Filesystem
+	fail *int32
+}
+
+func (f failingFS) Lstat(name string) (os.FileInfo, error) {
+	if atomic.LoadInt32(f.fail) != 0 {
+		return nil, errors.New("backend unreachable")
+	}
+	return f.Filesystem.Lstat(name)
+}
+
+func TestHealthy(t *testing.T) {
+	var fail int32
+	var probeErr error
+	var mu sync.Mutex
+	fs := failingFS{memfs.New(), &fail}
+	_ = billyutil.WriteFile(fs, "/file", []byte("hello"), 0644)
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024),
+		HealthOptions: nfs.HealthOptions{
+			Probe: func(ctx context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				return probeErr
+			},
+			MaxErrorRate: 0.5,
+			MinCalls:     4,
+		},
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	_, fh, err := target.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := target.Call(&rpc.Header{
+			Rpcvers: 2,
+			Vers:    nfsc.Nfs3Vers,
+			Prog:    nfsc.Nfs3Prog,
+			Proc:    uint32(nfs.NFSProcedureNull),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pings := srv.PingStats()
+	if len(pings) != 1 || pings[0].Transport != "tcp" || pings[0].Count < 2 || pings[0].Last.IsZero() {
+		t.Fatalf("expected the pings over tcp to be counted: %+v", pings)
+	}
+	if err := srv.Healthy(context.Background()); err != nil {
+		t.Fatalf("expected a serving server to be healthy: %v", err)
+	}
+
+	mu.Lock()
+	probeErr = errors.New("no route to backend")
+	mu.Unlock()
+	if err := srv.Healthy(context.Background()); err == nil {
+		t.Fatal("expected a failing probe to make the server unhealthy")
+	}
+	mu.Lock()
+	probeErr = nil
+	mu.Unlock()
+
+	atomic.StoreInt32(&fail, 1)
+	for i := 0; i < 8; i++ {
+		if _, err := target.GetAttr(fh); err == nil {
+			t.Fatal("expected the backend to fail")
+		}
+	}
+	if err := srv.Healthy(context.Background()); err == nil {
+		t.Fatal("expected recent server errors to make the server unhealthy")
+	}
+
+	_ = srv.Close()
+	if err := srv.Healthy(context.Background()); err == nil {
+		t.Fatal("expected a server no longer listening to be unhealthy")
+	}
+}
@@ -0,0 +1,575 @@
+package helpers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/willscott/go-nfs/file"
+)
+
+// archiveStreams is the number of compressed entries of a zip archive kept
+// open for reading on from where the last read ended.
+const archiveStreams = 16
+
+// archiveLinkHops is the number of links followed in resolving a path.
+const archiveLinkHops = 40
+
+// OpenArchive opens the tar or zip archive at name as a read-only
+// filesystem, choosing the format by the extension of the name, or trying
+// zip and then tar if it has neither. Tar archives must not be compressed,
+// since their entries are read in place. The archive stays open until the
+// filesystem is closed.
+func OpenArchive(name string) (*ArchiveFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	var a *ArchiveFS
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".zip":
+		a, err = NewZipFS(f, info.Size())
+	case ".tar":
+		a, err = NewTarFS(f, info.Size())
+	default:
+		if a, err = NewZipFS(f, info.Size()); err != nil {
+			a, err = NewTarFS(f, info.Size())
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	a.closer = f
+	return a, nil
+}
+
+// NewZipFS provides a read-only filesystem of the zip archive of size bytes
+// read from r. Entries stored without compression are read in place; those
+// compressed are decompressed from their start, and read on from there while
+// reads follow on from each other.
+func NewZipFS(r io.ReaderAt, size int64) (*ArchiveFS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	a := newArchiveFS()
+	for _, f := range zr.File {
+		e := &archiveEntry{mode: f.Mode(), size: int64(f.UncompressedSize64), mtime: f.Modified}
+		if e.mode.IsRegular() {
+			if f.Method == zip.Store {
+				off, err := f.DataOffset()
+				if err != nil {
+					return nil, err
+				}
+				e.section = io.NewSectionReader(r, off, e.size)
+			} else {
+				e.zip = f
+			}
+		} else if e.mode&os.ModeSymlink != 0 {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			target, err := io.ReadAll(io.LimitReader(rc, 4096))
+			_ = rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			e.target = string(target)
+		}
+		a.add(f.Name, e)
+	}
+	return a, nil
+}
+
+// NewTarFS provides a read-only filesystem of the tar archive of size bytes
+// read from r, indexing the offsets of its entries so that they are read in
+// place. Sparse entries are refused.
+func NewTarFS(r io.ReaderAt, size int64) (*ArchiveFS, error) {
+	cr := &countingReader{r: io.NewSectionReader(r, 0, size)}
+	tr := tar.NewReader(cr)
+	a := newArchiveFS()
+	var links []*tar.Header
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeGNUSparse || hasSparseRecords(h) {
+			return nil, fmt.Errorf("%s: sparse tar entries are not supported", h.Name)
+		}
+		info := h.FileInfo()
+		e := &archiveEntry{
+			mode:  info.Mode(),
+			mtime: h.ModTime,
+			uid:   uint32(h.Uid),
+			gid:   uint32(h.Gid),
+			major: uint32(h.Devmajor),
+			minor: uint32(h.Devminor),
+		}
+		switch {
+		case h.Typeflag == tar.TypeLink:
+			links = append(links, h)
+			continue
+		case e.mode.IsRegular():
+			e.size = h.Size
+			e.section = io.NewSectionReader(r, cr.n, h.Size)
+		case h.Typeflag == tar.TypeSymlink:
+			e.target = h.Linkname
+		}
+		a.add(h.Name, e)
+	}
+	// hard links share the data and fileid of the entry they link to, which
+	// comes before them in the archive.
+	for _, h := range links {
+		t, ok := a.entries[cleanArchivePath(h.Linkname)]
+		if !ok || t.mode.IsDir() {
+			return nil, fmt.Errorf("%s: link to missing entry %s", h.Name, h.Linkname)
+		}
+		link := *t
+		a.add(h.Name, &link)
+		link.fileid = t.fileid
+	}
+	return a, nil
+}
+
+func hasSparseRecords(h *tar.Header) bool {
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingReader counts the bytes read through it, which gives the offset
+// of the data of each tar entry once its header is read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ArchiveFS is a read-only filesystem of the entries of an archive, or of
+// an HTTP manifest. Calls modifying it fail with billy.ErrReadOnly, which
+// clients see as NFS3ERR_ROFS. Directories the archive holds files in but has
+// no entries for are presented all the same.
+type ArchiveFS struct {
+	entries map[string]*archiveEntry
+	closer  io.Closer
+
+	mu      sync.Mutex
+	streams map[*archiveEntry]*archiveStream
+}
+
+// archiveEntry is a file, directory or link of an archive.
+type archiveEntry struct {
+	name     string
+	mode     os.FileMode
+	size     int64
+	mtime    time.Time
+	uid, gid uint32
+	major    uint32
+	minor    uint32
+	target   string
+	children map[string]*archiveEntry
+	fileid   uint64
+
+	section *io.SectionReader // the data of an entry read in place.
+	zip     *zip.File         // the data of an entry to decompress.
+}
+
+// archiveStream is a compressed entry being read.
+type archiveStream struct {
+	r   io.ReadCloser
+	pos int64
+}
+
+func newArchiveFS() *ArchiveFS {
+	a := &ArchiveFS{entries: make(map[string]*archiveEntry), streams: make(map[*archiveEntry]*archiveStream)}
+	a.entries["/"] = a.dir()
+	return a
+}
+
+func cleanArchivePath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func (a *ArchiveFS) dir() *archiveEntry {
+	return &archiveEntry{mode: os.ModeDir | 0555, children: make(map[string]*archiveEntry)}
+}
+
+// add indexes an entry at name, creating the directories it is in. A later
+// entry for a name replaces an earlier one, as when unpacking the archive.
+func (a *ArchiveFS) add(name string, e *archiveEntry) {
+	name = cleanArchivePath(name)
+	if name == "/" {
+		if e.mode.IsDir() {
+			a.entries["/"].mode, a.entries["/"].mtime = e.mode, e.mtime
+		}
+		return
+	}
+	if e.mode.IsDir() {
+		if old, ok := a.entries[name]; ok && old.mode.IsDir() {
+			old.mode, old.mtime, old.uid, old.gid = e.mode, e.mtime, e.uid, e.gid
+			return
+		}
+		e.children = make(map[string]*archiveEntry)
+	}
+	parent := a.parent(path.Dir(name))
+	e.name = path.Base(name)
+	h := fnv.New64()
+	_, _ = h.Write([]byte(name))
+	e.fileid = h.Sum64()
+	parent.children[e.name] = e
+	a.entries[name] = e
+}
+
+// parent provides the directory at name, creating it and its parents if the
+// archive has no entries for them.
+func (a *ArchiveFS) parent(name string) *archiveEntry {
+	if d, ok := a.entries[name]; ok && d.mode.IsDir() {
+		return d
+	}
+	d := a.dir()
+	a.add(name, d)
+	return a.entries[name]
+}
+
+// resolve finds the entry at name, following links in it, and in its last
+// element when follow is set.
+func (a *ArchiveFS) resolve(op, name string, follow bool) (*archiveEntry, error) {
+	notExist := &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	elems := strings.Split(strings.TrimPrefix(cleanArchivePath(name), "/"), "/")
+	cur, curPath := a.entries["/"], "/"
+	hops := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		if elem == "" {
+			continue
+		}
+		if !cur.mode.IsDir() {
+			return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		next, ok := cur.children[elem]
+		if !ok {
+			return nil, notExist
+		}
+		if next.mode&os.ModeSymlink != 0 && (len(elems) > 0 || follow) {
+			if hops++; hops > archiveLinkHops {
+				return nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target := next.target
+			if !path.IsAbs(target) {
+				target = path.Join(curPath, target)
+			}
+			rest := append(strings.Split(strings.TrimPrefix(path.Clean(target), "/"), "/"), elems...)
+			cur, curPath, elems = a.entries["/"], "/", rest
+			continue
+		}
+		cur, curPath = next, path.Join(curPath, elem)
+	}
+	return cur, nil
+}
+
+// Create fails, since the archive is read-only.
+func (a *ArchiveFS) Create(filename string) (billy.File, error) {
+	return nil, readOnly("create", filename)
+}
+
+// Open opens a file for reading.
+func (a *ArchiveFS) Open(filename string) (billy.File, error) {
+	return a.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file for reading.
+func (a *ArchiveFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, readOnly("open", filename)
+	}
+	e, err := a.resolve("open", filename, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: syscall.EISDIR}
+	}
+	return &archiveFile{fs: a, e: e, name: filename}, nil
+}
+
+// Stat provides the attributes of an entry, following links.
+func (a *ArchiveFS) Stat(filename string) (os.FileInfo, error) {
+	e, err := a.resolve("stat", filename, true)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveInfo{e}, nil
+}
+
+// Lstat provides the attributes of an entry, not following links.
+func (a *ArchiveFS) Lstat(filename string) (os.FileInfo, error) {
+	e, err := a.resolve("lstat", filename, false)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveInfo{e}, nil
+}
+
+// ReadDir lists a directory, sorted by name.
+func (a *ArchiveFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	e, err := a.resolve("readdir", dirname, true)
+	if err != nil {
+		return nil, err
+	}
+	if !e.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: syscall.ENOTDIR}
+	}
+	entries := make([]os.FileInfo, 0, len(e.children))
+	for _, c := range e.children {
+		entries = append(entries, &archiveInfo{c})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Readlink provides the target of a link.
+func (a *ArchiveFS) Readlink(link string) (string, error) {
+	e, err := a.resolve("readlink", link, false)
+	if err != nil {
+		return "", err
+	}
+	if e.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: link, Err: os.ErrInvalid}
+	}
+	return e.target, nil
+}
+
+// Rename fails, since the archive is read-only.
+func (a *ArchiveFS) Rename(oldpath, newpath string) error {
+	return readOnly("rename", oldpath)
+}
+
+// Remove fails, since the archive is read-only.
+func (a *ArchiveFS) Remove(filename string) error {
+	return readOnly("remove", filename)
+}
+
+// MkdirAll fails, since the archive is read-only.
+func (a *ArchiveFS) MkdirAll(filename string, perm os.FileMode) error {
+	return readOnly("mkdir", filename)
+}
+
+// Symlink fails, since the archive is read-only.
+func (a *ArchiveFS) Symlink(target, link string) error {
+	return readOnly("symlink", link)
+}
+
+// TempFile fails, since the archive is read-only.
+func (a *ArchiveFS) TempFile(dir, prefix string) (billy.File, error) {
+	return nil, readOnly("tempfile", dir)
+}
+
+// Join joins the elements of a path.
+func (a *ArchiveFS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// Chroot provides a filesystem of a directory of the archive.
+func (a *ArchiveFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(a, path), nil
+}
+
+// Root provides the root of the archive.
+func (a *ArchiveFS) Root() string {
+	return "/"
+}
+
+// Capabilities marks the archive read-only, so that the server answers
+// calls modifying it with NFS3ERR_ROFS.
+func (a *ArchiveFS) Capabilities() billy.Capability {
+	return billy.ReadCapability | billy.SeekCapability
+}
+
+// Close closes the entries being read, and the archive if it was opened by
+// OpenArchive.
+func (a *ArchiveFS) Close() error {
+	a.mu.Lock()
+	for e, s := range a.streams {
+		_ = s.r.Close()
+		delete(a.streams, e)
+	}
+	a.mu.Unlock()
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
+
+// readAt reads the data of an entry, reading on from where the last read of
+// a compressed entry ended when it can.
+func (a *ArchiveFS) readAt(e *archiveEntry, p []byte, off int64) (int, error) {
+	if e.section != nil {
+		return e.section.ReadAt(p, off)
+	}
+	if e.zip == nil || off >= e.size {
+		return 0, io.EOF
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.streams[e]
+	if !ok || s.pos > off {
+		if ok {
+			_ = s.r.Close()
+		}
+		r, err := e.zip.Open()
+		if err != nil {
+			delete(a.streams, e)
+			return 0, err
+		}
+		if len(a.streams) >= archiveStreams {
+			for old, s := range a.streams {
+				_ = s.r.Close()
+				delete(a.streams, old)
+				break
+			}
+		}
+		s = &archiveStream{r: r}
+		a.streams[e] = s
+	}
+	if off > s.pos {
+		skipped, err := io.CopyN(io.Discard, s.r, off-s.pos)
+		s.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(s.r, p)
+	s.pos += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// archiveInfo describes an entry of an archive.
+type archiveInfo struct {
+	e *archiveEntry
+}
+
+func (i *archiveInfo) Name() string       { return i.e.name }
+func (i *archiveInfo) Size() int64        { return i.e.size }
+func (i *archiveInfo) Mode() os.FileMode  { return i.e.mode }
+func (i *archiveInfo) ModTime() time.Time { return i.e.mtime }
+func (i *archiveInfo) IsDir() bool        { return i.e.mode.IsDir() }
+func (i *archiveInfo) Fileid() uint64     { return i.e.fileid }
+
+func (i *archiveInfo) Sys() interface{} {
+	return &file.FileInfo{
+		Nlink:  1,
+		UID:    i.e.uid,
+		GID:    i.e.gid,
+		Major:  i.e.major,
+		Minor:  i.e.minor,
+		Fileid: i.e.fileid,
+	}
+}
+
+// archiveFile is an entry of an archive open for reading.
+type archiveFile struct {
+	fs     *ArchiveFS
+	e      *archiveEntry
+	name   string
+	pos    int64
+	closed bool
+}
+
+func (f *archiveFile) Name() string {
+	return f.name
+}
+
+func (f *archiveFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	return f.fs.readAt(f.e, p, off)
+}
+
+func (f *archiveFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.e.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *archiveFile) Write(p []byte) (int, error) {
+	return 0, readOnly("write", f.name)
+}
+
+func (f *archiveFile) Truncate(size int64) error {
+	return readOnly("truncate", f.name)
+}
+
+func (f *archiveFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *archiveFile) Lock() error {
+	return nil
+}
+
+func (f *archiveFile) Unlock() error {
+	return nil
+}
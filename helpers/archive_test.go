@@ -0,0 +1,80 @@
+package helpers_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestArchiveFS(t *testing.T) {
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	_ = tw.WriteHeader(&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755})
+	_ = tw.WriteHeader(&tar.Header{Name: "d/f", Typeflag: tar.TypeReg, Mode: 0644, Size: 12, Uid: 1000})
+	_, _ = tw.Write([]byte("tar contents"))
+	_ = tw.WriteHeader(&tar.Header{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "d/f"})
+	_ = tw.WriteHeader(&tar.Header{Name: "h", Typeflag: tar.TypeLink, Linkname: "d/f"})
+	_ = tw.Close()
+	tfs, err := helpers.NewTarFS(bytes.NewReader(tarball.Bytes()), int64(tarball.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := billyutil.ReadFile(tfs, "/l"); err != nil || string(b) != "tar contents" {
+		t.Fatalf("expected the link to be followed, got %q: %v", b, err)
+	}
+	if b, err := billyutil.ReadFile(tfs, "/h"); err != nil || string(b) != "tar contents" {
+		t.Fatalf("expected the hard link to share its data, got %q: %v", b, err)
+	}
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	big := bytes.Repeat([]byte("deflated "), 10000)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "big", Method: zip.Deflate})
+	_, _ = w.Write(big)
+	w, _ = zw.CreateHeader(&zip.FileHeader{Name: "dir/stored", Method: zip.Store})
+	_, _ = w.Write([]byte("stored"))
+	_ = zw.Close()
+	zfs, err := helpers.NewZipFS(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zfs.Close()
+
+	srv := nfstest.ServeFS(t, zfs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	entries, err := nfstest.ReadDir(target.Target, "/")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected the zip's file and the directory of its other, got %d: %v", len(entries), err)
+	}
+	read := func(name string) []byte {
+		rf, err := target.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rf.Close()
+		b, err := io.ReadAll(rf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if b := read("/big"); !bytes.Equal(b, big) {
+		t.Fatalf("unexpected contents of a compressed entry: %d bytes", len(b))
+	}
+	if b := read("/dir/stored"); string(b) != "stored" {
+		t.Fatalf("unexpected contents of a stored entry: %q", b)
+	}
+	if _, err := target.Create("/new", 0644); !nfstest.IsStatus(err, nfs.NFSStatusROFS) {
+		t.Fatalf("expected the archive to be read-only, got %v", err)
+	}
+}
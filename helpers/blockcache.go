@@ -0,0 +1,285 @@
+package helpers
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/willscott/go-nfs"
+)
+
+// DefaultBlockCacheSize is the number of bytes a BlockCacheFS keeps when
+// given no size.
+const DefaultBlockCacheSize = 64 << 20
+
+// DefaultBlockSize is the size of the blocks a BlockCacheFS reads when given
+// no block size.
+const DefaultBlockSize = 64 << 10
+
+// NewBlockCacheFS wraps fs to keep up to size bytes of the files read from
+// it in memory, in blocks of blockSize bytes, dropping the least recently
+// read blocks first. A size or block size of zero takes the default.
+func NewBlockCacheFS(fs billy.Filesystem, size int64, blockSize int) *BlockCacheFS {
+	if size <= 0 {
+		size = DefaultBlockCacheSize
+	}
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	count := int(size / int64(blockSize))
+	if count < 1 {
+		count = 1
+	}
+	blocks, _ := lru.New[blockKey, []byte](count)
+	return &BlockCacheFS{Filesystem: fs, blockSize: int64(blockSize), blocks: blocks}
+}
+
+// BlockCacheFS serves repeated reads of files from memory, for backends
+// which are slow to read from.
+//
+// Blocks of a file are dropped when it is written, truncated, removed or
+// renamed over through the BlockCacheFS, and when the wrapped filesystem
+// reports it replaced through an nfs.Invalidator. Changes made to the backend
+// otherwise are only seen once the blocks they change are dropped.
+type BlockCacheFS struct {
+	billy.Filesystem
+	blockSize int64
+	blocks    *lru.Cache[blockKey, []byte]
+
+	mu    sync.Mutex
+	epoch uint64 // counts invalidations, so reads racing them aren't cached.
+}
+
+// blockKey names a block of a file.
+type blockKey struct {
+	path  string
+	index int64
+}
+
+func cleanBlockPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// invalidate drops the blocks of name and of the files below it.
+func (b *BlockCacheFS) invalidate(name string) {
+	name = cleanBlockPath(name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.epoch++
+	for _, k := range b.blocks.Keys() {
+		if k.path == name || strings.HasPrefix(k.path, prefix) {
+			b.blocks.Remove(k)
+		}
+	}
+}
+
+// block provides a block of a file, reading it from f when it isn't kept. A
+// block shorter than the block size ends the file.
+func (b *BlockCacheFS) block(f billy.File, name string, index int64) ([]byte, error) {
+	key := blockKey{name, index}
+	if data, ok := b.blocks.Get(key); ok {
+		return data, nil
+	}
+	b.mu.Lock()
+	epoch := b.epoch
+	b.mu.Unlock()
+
+	data := make([]byte, b.blockSize)
+	n := 0
+	for n < len(data) {
+		m, err := f.ReadAt(data[n:], index*b.blockSize+int64(n))
+		n += m
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		} else if m == 0 {
+			break
+		}
+	}
+	data = data[:n]
+
+	b.mu.Lock()
+	if b.epoch == epoch {
+		b.blocks.Add(key, data)
+	}
+	b.mu.Unlock()
+	return data, nil
+}
+
+// Create creates a file.
+func (b *BlockCacheFS) Create(filename string) (billy.File, error) {
+	return b.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens a file for reading.
+func (b *BlockCacheFS) Open(filename string) (billy.File, error) {
+	return b.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file, whose reads are served from the cache.
+func (b *BlockCacheFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := b.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		b.invalidate(filename)
+	}
+	return &blockCacheFile{File: f, fs: b, name: cleanBlockPath(filename)}, nil
+}
+
+// Rename moves a file, dropping the blocks of both paths.
+func (b *BlockCacheFS) Rename(oldpath, newpath string) error {
+	err := b.Filesystem.Rename(oldpath, newpath)
+	b.invalidate(oldpath)
+	b.invalidate(newpath)
+	return err
+}
+
+// Remove removes a file, dropping its blocks.
+func (b *BlockCacheFS) Remove(filename string) error {
+	err := b.Filesystem.Remove(filename)
+	b.invalidate(filename)
+	return err
+}
+
+// Chroot provides a BlockCacheFS of a directory, sharing the cache.
+func (b *BlockCacheFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(b, path), nil
+}
+
+// Chmod changes the mode of a file.
+func (b *BlockCacheFS) Chmod(name string, mode os.FileMode) error {
+	c, ok := b.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Chmod(name, mode)
+}
+
+// Lchown changes the owner of a file, not following links.
+func (b *BlockCacheFS) Lchown(name string, uid, gid int) error {
+	c, ok := b.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Lchown(name, uid, gid)
+}
+
+// Chown changes the owner of a file.
+func (b *BlockCacheFS) Chown(name string, uid, gid int) error {
+	c, ok := b.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Chown(name, uid, gid)
+}
+
+// Chtimes changes the times of a file.
+func (b *BlockCacheFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	c, ok := b.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Chtimes(name, atime, mtime)
+}
+
+// Sync flushes a file of the wrapped filesystem, when it can be.
+func (b *BlockCacheFS) Sync(filename string) error {
+	if sfs, ok := b.Filesystem.(nfs.SyncFilesystem); ok {
+		return sfs.Sync(filename)
+	}
+	return nil
+}
+
+// FSInfo provides the limits of the wrapped filesystem.
+func (b *BlockCacheFS) FSInfo(info *nfs.FSInfo) error {
+	if ifs, ok := b.Filesystem.(nfs.FSInfoFilesystem); ok {
+		return ifs.FSInfo(info)
+	}
+	return nil
+}
+
+// SetInvalidator passes inv on to the wrapped filesystem, dropping the blocks
+// of the paths it reports replaced.
+func (b *BlockCacheFS) SetInvalidator(inv nfs.Invalidator) {
+	if ifs, ok := b.Filesystem.(nfs.InvalidatingFilesystem); ok {
+		ifs.SetInvalidator(&blockCacheInvalidator{inv, b})
+	}
+}
+
+type blockCacheInvalidator struct {
+	nfs.Invalidator
+	fs *BlockCacheFS
+}
+
+func (i *blockCacheInvalidator) InvalidatePath(path []string) {
+	i.fs.invalidate(strings.Join(path, "/"))
+	i.Invalidator.InvalidatePath(path)
+}
+
+// blockCacheFile reads a file of a BlockCacheFS through its cache.
+type blockCacheFile struct {
+	billy.File
+	fs   *BlockCacheFS
+	name string
+}
+
+func (f *blockCacheFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / f.fs.blockSize
+		data, err := f.fs.block(f.File, f.name, index)
+		if err != nil {
+			return n, err
+		}
+		start := pos - index*f.fs.blockSize
+		if start >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data[start:])
+		if int64(len(data)) < f.fs.blockSize && n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (f *blockCacheFile) Read(p []byte) (int, error) {
+	pos, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.ReadAt(p, pos)
+	if _, serr := f.File.Seek(pos+int64(n), io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *blockCacheFile) Write(p []byte) (int, error) {
+	defer f.fs.invalidate(f.name)
+	return f.File.Write(p)
+}
+
+func (f *blockCacheFile) Truncate(size int64) error {
+	defer f.fs.invalidate(f.name)
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,92 @@
+package helpers_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// countingFS counts the reads made of its files.
+type countingFS struct {
+	billy.Filesystem
+	reads int32
+}
+
+func (fs *countingFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{File: f, fs: fs}, nil
+}
+
+func (fs *countingFS) Open(name string) (billy.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+type countingFile struct {
+	billy.File
+	fs *countingFS
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt32(&f.fs.reads, 1)
+	return f.File.ReadAt(p, off)
+}
+
+func TestBlockCache(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/data", bytes.Repeat([]byte("0123456789"), 1000), 0644)
+	backend := &countingFS{Filesystem: mem}
+	cache := helpers.NewBlockCacheFS(backend, 1<<20, 4096)
+
+	srv := nfstest.ServeFS(t, cache)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	read := func() []byte {
+		rf, err := target.Open("/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rf.Close()
+		b, err := io.ReadAll(rf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if b := read(); len(b) != 10000 || string(b[9990:]) != "0123456789" {
+		t.Fatalf("unexpected contents read through the cache: %d bytes", len(b))
+	}
+	reads := atomic.LoadInt32(&backend.reads)
+	if reads == 0 {
+		t.Fatal("expected the first read to reach the backend")
+	}
+	_ = read()
+	if n := atomic.LoadInt32(&backend.reads); n != reads {
+		t.Fatalf("expected the second read to be served from the cache, backend read %d more times", n-reads)
+	}
+
+	// a write drops the blocks it makes stale.
+	wf, err := target.OpenFile("/data", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wf.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	_ = wf.Close()
+	if b := read(); string(b[:4]) != "abc3" {
+		t.Fatalf("expected the write to be read back, got %q", b[:4])
+	}
+}
@@ -0,0 +1,875 @@
+// Package boltfs keeps a whole filesystem in a single bbolt database file,
+// so that a small export can be moved around and backed up as one file.
+// Every change is made in a transaction of its own, so the file is left
+// consistent by a crash, and writes are stable once they return.
+package boltfs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/willscott/go-nfs/file"
+	bolt "go.etcd.io/bbolt"
+)
+
+// blockSize is the size of the blocks file data is stored in.
+const blockSize = 64 << 10
+
+// linkHops is the number of links followed in resolving a path.
+const linkHops = 40
+
+// rootIno is the inode number of the root directory.
+const rootIno = 1
+
+var (
+	inodesBucket  = []byte("inodes")  // inode number to inode.
+	entriesBucket = []byte("entries") // directory inode number and name to inode number.
+	dataBucket    = []byte("data")    // inode number and block index to block.
+	metaBucket    = []byte("meta")    // nextKey to the next inode number.
+	nextKey       = []byte("next")
+)
+
+// inode holds the attributes of a file, directory or link.
+type inode struct {
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size,omitempty"`
+	UID    uint32      `json:"uid,omitempty"`
+	GID    uint32      `json:"gid,omitempty"`
+	Mtime  time.Time   `json:"mtime"`
+	Atime  time.Time   `json:"atime"`
+	Ctime  time.Time   `json:"ctime"`
+	Target string      `json:"target,omitempty"`
+	Parent uint64      `json:"parent,omitempty"` // the directory holding a directory.
+}
+
+// Open opens the filesystem kept in the database file at name, creating it
+// if it does not exist. The file is locked until the filesystem is closed.
+func Open(name string) (*FS, error) {
+	db, err := bolt.Open(name, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{inodesBucket, entriesBucket, dataBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(inodesBucket).Get(key(rootIno)) != nil {
+			return nil
+		}
+		now := time.Now()
+		if err := tx.Bucket(metaBucket).Put(nextKey, key(rootIno+1)); err != nil {
+			return err
+		}
+		return putInode(tx, rootIno, &inode{Mode: os.ModeDir | 0755, Mtime: now, Atime: now, Ctime: now})
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &FS{db: db}, nil
+}
+
+// FS is a filesystem kept in a bbolt database. Access times are not updated
+// by reads, which would make every read a transaction of its own.
+type FS struct {
+	db   *bolt.DB
+	temp uint32
+}
+
+// Close closes the database.
+func (b *FS) Close() error {
+	return b.db.Close()
+}
+
+func key(ino uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, ino)
+	return k
+}
+
+func entryKey(dir uint64, name string) []byte {
+	return append(key(dir), name...)
+}
+
+func blockKey(ino uint64, index int64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, ino)
+	binary.BigEndian.PutUint64(k[8:], uint64(index))
+	return k
+}
+
+func getInode(tx *bolt.Tx, ino uint64) (*inode, error) {
+	v := tx.Bucket(inodesBucket).Get(key(ino))
+	if v == nil {
+		return nil, os.ErrNotExist
+	}
+	n := &inode{}
+	if err := json.Unmarshal(v, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func putInode(tx *bolt.Tx, ino uint64, n *inode) error {
+	v, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(inodesBucket).Put(key(ino), v)
+}
+
+func lookupEntry(tx *bolt.Tx, dir uint64, name string) uint64 {
+	v := tx.Bucket(entriesBucket).Get(entryKey(dir, name))
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func split(name string) []string {
+	return strings.Split(strings.TrimPrefix(cleanPath(name), "/"), "/")
+}
+
+// walk finds the inode at name, following links in it, and in its last
+// element when follow is set.
+func walk(tx *bolt.Tx, op, name string, follow bool) (uint64, *inode, error) {
+	ino, dir := uint64(rootIno), "/"
+	n, err := getInode(tx, ino)
+	if err != nil {
+		return 0, nil, err
+	}
+	elems := split(name)
+	hops := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		if elem == "" {
+			continue
+		}
+		if !n.Mode.IsDir() {
+			return 0, nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		child := lookupEntry(tx, ino, elem)
+		if child == 0 {
+			return 0, nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		cn, err := getInode(tx, child)
+		if err != nil {
+			return 0, nil, err
+		}
+		if cn.Mode&os.ModeSymlink != 0 && (len(elems) > 0 || follow) {
+			if hops++; hops > linkHops {
+				return 0, nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target := cn.Target
+			if !path.IsAbs(target) {
+				target = path.Join(dir, target)
+			}
+			elems = append(split(target), elems...)
+			ino, dir = rootIno, "/"
+			if n, err = getInode(tx, ino); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		ino, n, dir = child, cn, path.Join(dir, elem)
+	}
+	return ino, n, nil
+}
+
+// parent finds the directory name is to be in, and the name within it.
+func parent(tx *bolt.Tx, op, name string) (uint64, *inode, string, error) {
+	clean := cleanPath(name)
+	if clean == "/" {
+		return 0, nil, "", &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+	}
+	ino, n, err := walk(tx, op, path.Dir(clean), true)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if !n.Mode.IsDir() {
+		return 0, nil, "", &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return ino, n, path.Base(clean), nil
+}
+
+// create adds an inode as base in the directory dir.
+func create(tx *bolt.Tx, dir uint64, d *inode, base string, n *inode) (uint64, error) {
+	meta := tx.Bucket(metaBucket)
+	ino := binary.BigEndian.Uint64(meta.Get(nextKey))
+	if err := meta.Put(nextKey, key(ino+1)); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	n.Mtime, n.Atime, n.Ctime = now, now, now
+	if err := putInode(tx, ino, n); err != nil {
+		return 0, err
+	}
+	if err := tx.Bucket(entriesBucket).Put(entryKey(dir, base), key(ino)); err != nil {
+		return 0, err
+	}
+	d.Mtime, d.Ctime = now, now
+	return ino, putInode(tx, dir, d)
+}
+
+// isEmpty reports whether the directory ino has no entries.
+func isEmpty(tx *bolt.Tx, ino uint64) bool {
+	prefix := key(ino)
+	k, _ := tx.Bucket(entriesBucket).Cursor().Seek(prefix)
+	return k == nil || !strings.HasPrefix(string(k), string(prefix))
+}
+
+// free drops an inode and its data.
+func free(tx *bolt.Tx, ino uint64) error {
+	if err := truncate(tx, ino, 0); err != nil {
+		return err
+	}
+	return tx.Bucket(inodesBucket).Delete(key(ino))
+}
+
+// truncate drops the data of ino beyond size.
+func truncate(tx *bolt.Tx, ino uint64, size int64) error {
+	data := tx.Bucket(dataBucket)
+	last := size / blockSize
+	if size%blockSize != 0 {
+		if b := data.Get(blockKey(ino, last)); len(b) > int(size%blockSize) {
+			if err := data.Put(blockKey(ino, last), append([]byte(nil), b[:size%blockSize]...)); err != nil {
+				return err
+			}
+		}
+		last++
+	}
+	// keys are gathered first, since deleting under a cursor skips entries.
+	var drop [][]byte
+	c := data.Cursor()
+	prefix := key(ino)
+	for k, _ := c.Seek(blockKey(ino, last)); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+		drop = append(drop, append([]byte(nil), k...))
+	}
+	for _, k := range drop {
+		if err := data.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readAt(tx *bolt.Tx, ino uint64, size int64, p []byte, off int64) (int, error) {
+	data := tx.Bucket(dataBucket)
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= size {
+			return n, io.EOF
+		}
+		index, start := pos/blockSize, pos%blockSize
+		end := int64(len(p)-n) + start
+		if end > blockSize {
+			end = blockSize
+		}
+		if index*blockSize+end > size {
+			end = size - index*blockSize
+		}
+		chunk := p[n : n+int(end-start)]
+		b := data.Get(blockKey(ino, index))
+		copied := 0
+		if int64(len(b)) > start {
+			copied = copy(chunk, b[start:])
+		}
+		for i := copied; i < len(chunk); i++ {
+			chunk[i] = 0
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func writeAt(tx *bolt.Tx, ino uint64, n *inode, p []byte, off int64) error {
+	data := tx.Bucket(dataBucket)
+	for written := 0; written < len(p); {
+		pos := off + int64(written)
+		index, start := pos/blockSize, pos%blockSize
+		b := append([]byte(nil), data.Get(blockKey(ino, index))...)
+		if int64(len(b)) < start {
+			b = append(b, make([]byte, start-int64(len(b)))...)
+		}
+		m := copy(b[start:], p[written:])
+		if room := blockSize - start - int64(m); room > 0 && written+m < len(p) {
+			tail := p[written+m:]
+			if int64(len(tail)) > room {
+				tail = tail[:room]
+			}
+			b = append(b, tail...)
+			m += len(tail)
+		}
+		if err := data.Put(blockKey(ino, index), b); err != nil {
+			return err
+		}
+		written += m
+	}
+	if end := off + int64(len(p)); end > n.Size {
+		n.Size = end
+	}
+	n.Mtime = time.Now()
+	n.Ctime = n.Mtime
+	return putInode(tx, ino, n)
+}
+
+// Create creates a file, truncating it if it exists.
+func (b *FS) Create(filename string) (billy.File, error) {
+	return b.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens a file for reading.
+func (b *FS) Open(filename string) (billy.File, error) {
+	return b.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file, following links.
+func (b *FS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	var ino uint64
+	do := b.db.View
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		do = b.db.Update
+	}
+	err := do(func(tx *bolt.Tx) error {
+		var n *inode
+		var err error
+		ino, n, err = walk(tx, "open", filename, true)
+		if errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE != 0 {
+			dir, d, base, perr := parent(tx, "open", filename)
+			if perr != nil {
+				return perr
+			}
+			if lookupEntry(tx, dir, base) != 0 {
+				// a link to nothing.
+				return err
+			}
+			ino, err = create(tx, dir, d, base, &inode{Mode: perm.Perm()})
+			return err
+		} else if err != nil {
+			return err
+		}
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return &os.PathError{Op: "open", Path: filename, Err: os.ErrExist}
+		}
+		if n.Mode.IsDir() {
+			return &os.PathError{Op: "open", Path: filename, Err: syscall.EISDIR}
+		}
+		if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 && n.Size > 0 {
+			if err := truncate(tx, ino, 0); err != nil {
+				return err
+			}
+			n.Size = 0
+			n.Mtime = time.Now()
+			n.Ctime = n.Mtime
+			return putInode(tx, ino, n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltFile{fs: b, ino: ino, name: filename, flag: flag}, nil
+}
+
+// Stat provides the attributes of a file, following links.
+func (b *FS) Stat(filename string) (os.FileInfo, error) {
+	return b.stat("stat", filename, true)
+}
+
+// Lstat provides the attributes of a file, not following links.
+func (b *FS) Lstat(filename string) (os.FileInfo, error) {
+	return b.stat("lstat", filename, false)
+}
+
+func (b *FS) stat(op, filename string, follow bool) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := b.db.View(func(tx *bolt.Tx) error {
+		ino, n, err := walk(tx, op, filename, follow)
+		if err != nil {
+			return err
+		}
+		info = &fileInfo{name: path.Base(cleanPath(filename)), ino: ino, n: n}
+		return nil
+	})
+	return info, err
+}
+
+// ReadDir lists a directory, sorted by name.
+func (b *FS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return b.ReadDirFrom(dirname, "", -1)
+}
+
+// ReadDirFrom lists up to n entries of a directory following the name after,
+// in order, reading only those entries. A negative n lists every entry.
+func (b *FS) ReadDirFrom(dirname string, after string, n int) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	err := b.db.View(func(tx *bolt.Tx) error {
+		ino, dn, err := walk(tx, "readdir", dirname, true)
+		if err != nil {
+			return err
+		}
+		if !dn.Mode.IsDir() {
+			return &os.PathError{Op: "readdir", Path: dirname, Err: syscall.ENOTDIR}
+		}
+		// entries are keyed by name beneath their directory, so are in order.
+		prefix := key(ino)
+		c := tx.Bucket(entriesBucket).Cursor()
+		k, v := c.Seek(entryKey(ino, after))
+		if after != "" && k != nil && string(k[8:]) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && strings.HasPrefix(string(k), string(prefix)) && len(entries) != n; k, v = c.Next() {
+			child := binary.BigEndian.Uint64(v)
+			cn, err := getInode(tx, child)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, &fileInfo{name: string(k[8:]), ino: child, n: cn})
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// MkdirAll creates a directory and the directories it is in.
+func (b *FS) MkdirAll(filename string, perm os.FileMode) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		ino, n, err := walk(tx, "mkdir", "/", true)
+		if err != nil {
+			return err
+		}
+		at := "/"
+		for _, elem := range split(filename) {
+			if elem == "" {
+				continue
+			}
+			at = path.Join(at, elem)
+			cino, cn, err := walk(tx, "mkdir", at, true)
+			if errors.Is(err, os.ErrNotExist) && lookupEntry(tx, ino, elem) == 0 {
+				dir := &inode{Mode: os.ModeDir | perm.Perm(), Parent: ino}
+				if cino, err = create(tx, ino, n, elem, dir); err != nil {
+					return err
+				}
+				cn = dir
+			} else if err != nil {
+				return err
+			} else if !cn.Mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: filename, Err: syscall.ENOTDIR}
+			}
+			ino, n = cino, cn
+		}
+		return nil
+	})
+}
+
+// Rename moves a file or directory, replacing what is at newpath unless it
+// is a directory holding entries.
+func (b *FS) Rename(oldpath, newpath string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		odir, od, obase, err := parent(tx, "rename", oldpath)
+		if err != nil {
+			return err
+		}
+		ino := lookupEntry(tx, odir, obase)
+		if ino == 0 {
+			return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+		}
+		n, err := getInode(tx, ino)
+		if err != nil {
+			return err
+		}
+		ndir, nd, nbase, err := parent(tx, "rename", newpath)
+		if err != nil {
+			return err
+		}
+		if n.Mode.IsDir() {
+			// a directory cannot be moved into itself.
+			for at := ndir; at != 0; {
+				if at == ino {
+					return &os.PathError{Op: "rename", Path: newpath, Err: os.ErrInvalid}
+				}
+				an, err := getInode(tx, at)
+				if err != nil {
+					return err
+				}
+				at = an.Parent
+			}
+		}
+		if old := lookupEntry(tx, ndir, nbase); old == ino {
+			return nil
+		} else if old != 0 {
+			on, err := getInode(tx, old)
+			if err != nil {
+				return err
+			}
+			switch {
+			case on.Mode.IsDir() && !n.Mode.IsDir():
+				return &os.PathError{Op: "rename", Path: newpath, Err: syscall.EISDIR}
+			case !on.Mode.IsDir() && n.Mode.IsDir():
+				return &os.PathError{Op: "rename", Path: newpath, Err: syscall.ENOTDIR}
+			case on.Mode.IsDir() && !isEmpty(tx, old):
+				return &os.PathError{Op: "rename", Path: newpath, Err: syscall.ENOTEMPTY}
+			}
+			if err := free(tx, old); err != nil {
+				return err
+			}
+		}
+		entries := tx.Bucket(entriesBucket)
+		if err := entries.Delete(entryKey(odir, obase)); err != nil {
+			return err
+		}
+		if err := entries.Put(entryKey(ndir, nbase), key(ino)); err != nil {
+			return err
+		}
+		now := time.Now()
+		n.Ctime = now
+		if n.Mode.IsDir() {
+			n.Parent = ndir
+		}
+		if err := putInode(tx, ino, n); err != nil {
+			return err
+		}
+		if ndir == odir {
+			nd = od
+		} else {
+			od.Mtime, od.Ctime = now, now
+			if err := putInode(tx, odir, od); err != nil {
+				return err
+			}
+		}
+		nd.Mtime, nd.Ctime = now, now
+		return putInode(tx, ndir, nd)
+	})
+}
+
+// Remove removes a file, link or empty directory.
+func (b *FS) Remove(filename string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		dir, d, base, err := parent(tx, "remove", filename)
+		if err != nil {
+			return err
+		}
+		ino := lookupEntry(tx, dir, base)
+		if ino == 0 {
+			return &os.PathError{Op: "remove", Path: filename, Err: os.ErrNotExist}
+		}
+		n, err := getInode(tx, ino)
+		if err != nil {
+			return err
+		}
+		if n.Mode.IsDir() && !isEmpty(tx, ino) {
+			return &os.PathError{Op: "remove", Path: filename, Err: syscall.ENOTEMPTY}
+		}
+		if err := tx.Bucket(entriesBucket).Delete(entryKey(dir, base)); err != nil {
+			return err
+		}
+		if err := free(tx, ino); err != nil {
+			return err
+		}
+		d.Mtime = time.Now()
+		d.Ctime = d.Mtime
+		return putInode(tx, dir, d)
+	})
+}
+
+// Symlink creates a link at link to target.
+func (b *FS) Symlink(target, link string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		dir, d, base, err := parent(tx, "symlink", link)
+		if err != nil {
+			return err
+		}
+		if lookupEntry(tx, dir, base) != 0 {
+			return &os.PathError{Op: "symlink", Path: link, Err: os.ErrExist}
+		}
+		_, err = create(tx, dir, d, base, &inode{Mode: os.ModeSymlink | 0777, Size: int64(len(target)), Target: target})
+		return err
+	})
+}
+
+// Readlink provides the target of a link.
+func (b *FS) Readlink(link string) (string, error) {
+	var target string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, n, err := walk(tx, "readlink", link, false)
+		if err != nil {
+			return err
+		}
+		if n.Mode&os.ModeSymlink == 0 {
+			return &os.PathError{Op: "readlink", Path: link, Err: os.ErrInvalid}
+		}
+		target = n.Target
+		return nil
+	})
+	return target, err
+}
+
+// TempFile creates a new file in dir, named from prefix.
+func (b *FS) TempFile(dir, prefix string) (billy.File, error) {
+	for {
+		name := path.Join(dir, prefix+strconv.FormatInt(time.Now().UnixNano(), 36)+strconv.Itoa(int(atomic.AddUint32(&b.temp, 1))))
+		f, err := b.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, os.ErrExist) {
+			return f, err
+		}
+	}
+}
+
+// Join joins the elements of a path.
+func (b *FS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// Chroot provides a filesystem of a directory.
+func (b *FS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(b, path), nil
+}
+
+// Root provides the root of the filesystem.
+func (b *FS) Root() string {
+	return "/"
+}
+
+// Capabilities reports the filesystem can be read, written and truncated.
+func (b *FS) Capabilities() billy.Capability {
+	return billy.DefaultCapabilities
+}
+
+// change updates the attributes of the inode at name.
+func (b *FS) change(op, name string, follow bool, update func(*inode)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		ino, n, err := walk(tx, op, name, follow)
+		if err != nil {
+			return err
+		}
+		update(n)
+		n.Ctime = time.Now()
+		return putInode(tx, ino, n)
+	})
+}
+
+// Chmod changes the permissions of a file.
+func (b *FS) Chmod(name string, mode os.FileMode) error {
+	return b.change("chmod", name, true, func(n *inode) {
+		n.Mode = n.Mode.Type() | mode.Perm()
+	})
+}
+
+// Lchown changes the owner of a file, not following links.
+func (b *FS) Lchown(name string, uid, gid int) error {
+	return b.change("lchown", name, false, func(n *inode) {
+		n.UID, n.GID = uint32(uid), uint32(gid)
+	})
+}
+
+// Chown changes the owner of a file.
+func (b *FS) Chown(name string, uid, gid int) error {
+	return b.change("chown", name, true, func(n *inode) {
+		n.UID, n.GID = uint32(uid), uint32(gid)
+	})
+}
+
+// Chtimes changes the access and modification times of a file.
+func (b *FS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return b.change("chtimes", name, true, func(n *inode) {
+		n.Atime, n.Mtime = atime, mtime
+	})
+}
+
+// fileInfo describes an inode.
+type fileInfo struct {
+	name string
+	ino  uint64
+	n    *inode
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.n.Size }
+func (i *fileInfo) Mode() os.FileMode  { return i.n.Mode }
+func (i *fileInfo) ModTime() time.Time { return i.n.Mtime }
+func (i *fileInfo) IsDir() bool        { return i.n.Mode.IsDir() }
+func (i *fileInfo) Fileid() uint64     { return i.ino }
+
+func (i *fileInfo) Sys() interface{} {
+	return &file.FileInfo{
+		Nlink:  1,
+		UID:    i.n.UID,
+		GID:    i.n.GID,
+		Fileid: i.ino,
+		Atime:  i.n.Atime,
+		Ctime:  i.n.Ctime,
+	}
+}
+
+// boltFile is an open file. Each read and write is a transaction of its own.
+type boltFile struct {
+	fs     *FS
+	ino    uint64
+	name   string
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *boltFile) Name() string {
+	return f.name
+}
+
+func (f *boltFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	var n int
+	err := f.fs.db.View(func(tx *bolt.Tx) error {
+		in, err := getInode(tx, f.ino)
+		if err != nil {
+			return &os.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		n, err = readAt(tx, f.ino, in.Size, p, off)
+		return err
+	})
+	return n, err
+}
+
+func (f *boltFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *boltFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	err := f.fs.db.Update(func(tx *bolt.Tx) error {
+		n, err := getInode(tx, f.ino)
+		if err != nil {
+			return &os.PathError{Op: "write", Path: f.name, Err: err}
+		}
+		return writeAt(tx, f.ino, n, p, off)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *boltFile) Write(p []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		info, err := f.stat()
+		if err != nil {
+			return 0, err
+		}
+		f.pos = info.Size
+	}
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *boltFile) stat() (*inode, error) {
+	var n *inode
+	err := f.fs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = getInode(tx, f.ino)
+		return err
+	})
+	return n, err
+}
+
+func (f *boltFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		n, err := f.stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += n.Size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *boltFile) Truncate(size int64) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	return f.fs.db.Update(func(tx *bolt.Tx) error {
+		n, err := getInode(tx, f.ino)
+		if err != nil {
+			return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+		}
+		if err := truncate(tx, f.ino, size); err != nil {
+			return err
+		}
+		n.Size = size
+		n.Mtime = time.Now()
+		n.Ctime = n.Mtime
+		return putInode(tx, f.ino, n)
+	})
+}
+
+func (f *boltFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *boltFile) Lock() error {
+	return nil
+}
+
+func (f *boltFile) Unlock() error {
+	return nil
+}
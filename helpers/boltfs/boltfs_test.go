@@ -0,0 +1,116 @@
+package boltfs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/boltfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestBoltFS(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "export.db")
+	bfs, err := boltfs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := nfstest.NewServer(helpers.NewCachingHandler(helpers.NewNullAuthHandler(bfs), 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	big := bytes.Repeat([]byte("spans blocks "), 20000)
+	if _, err := target.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	wf, err := target.OpenFile("/dir/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wf.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Rename("/dir/file", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	srv.Close()
+	if err := bfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bfs, err = boltfs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bfs.Close()
+	if b, err := billyutil.ReadFile(bfs, "/moved"); err != nil || !bytes.Equal(b, big) {
+		t.Fatalf("expected the file to be kept in the database, got %d bytes: %v", len(b), err)
+	}
+	if _, err := bfs.Stat("/dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the directory to stay removed, got %v", err)
+	}
+	f, err := bfs.OpenFile("/moved", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(100000); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(200000); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	want := append(append([]byte(nil), big[:100000]...), make([]byte, 100000)...)
+	if b, err := billyutil.ReadFile(bfs, "/moved"); err != nil || !bytes.Equal(b, want) {
+		t.Fatalf("expected the truncated data to read as zeros once extended: %v", err)
+	}
+	if err := bfs.Symlink("moved", "/link"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := bfs.Stat("/link"); err != nil || info.Size() != 200000 {
+		t.Fatalf("expected the link to be followed, got %v", err)
+	}
+}
+
+func TestBoltFSListing(t *testing.T) {
+	bfs, err := boltfs.Open(filepath.Join(t.TempDir(), "export.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bfs.Close()
+	if err := bfs.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	const files = 1000
+	for i := 0; i < files; i++ {
+		if err := billyutil.WriteFile(bfs, fmt.Sprintf("/dir/%04d", i), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := nfstest.ServeFS(t, bfs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	// listed a part at a time, through ReadDirFrom.
+	if entries, err := nfstest.ReadDir(target.Target, "/dir"); err != nil || len(entries) != files {
+		t.Fatalf("expected every entry to be listed, got %d: %v", len(entries), err)
+	}
+	if entries, err := bfs.ReadDirFrom("/dir", "0997", 10); err != nil || len(entries) != 2 || entries[0].Name() != "0998" {
+		t.Fatalf("expected the entries after 0997, got %d: %v", len(entries), err)
+	}
+}
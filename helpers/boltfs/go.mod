@@ -0,0 +1,21 @@
+module github.com/willscott/go-nfs/helpers/boltfs
+
+go 1.19
+
+require (
+	github.com/go-git/go-billy/v5 v5.5.0
+	github.com/willscott/go-nfs v0.0.0-00010101000000-000000000000
+	github.com/willscott/go-nfs-client v0.0.0-20240104095149-b44639837b00
+	go.etcd.io/bbolt v1.3.8
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.7.0 // indirect
+	github.com/google/uuid v1.5.0 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/rasky/go-xdr v0.0.0-20170124162913-1a41d1a06c93 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
+
+replace github.com/willscott/go-nfs => ../..
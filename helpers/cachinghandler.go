@@ -1,10 +1,17 @@
 package helpers
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/fs"
+	"net"
 	"reflect"
+	"strings"
+	"sync"
 
 	"github.com/willscott/go-nfs"
 
@@ -38,10 +45,19 @@ func NewCachingHandlerWithVerifierLimit(h nfs.Handler, limit int, verifierLimit
 // CachingHandler implements to/from handle via an LRU cache.
 type CachingHandler struct {
 	nfs.Handler
+	mu              sync.Mutex // guards reverseHandles alongside activeHandles.
 	activeHandles   *lru.Cache[uuid.UUID, entry]
 	reverseHandles  map[string][]uuid.UUID
 	activeVerifiers *lru.Cache[uint64, verifier]
 	cacheLimit      int
+	mounts          []mount // the paths filesystems were mounted at, for Export.
+	replicator      HandleReplicator
+	format          HandleFormat
+}
+
+type mount struct {
+	f       billy.Filesystem
+	dirpath string
 }
 
 type entry struct {
@@ -49,10 +65,110 @@ type entry struct {
 	p []string
 }
 
+// ExportOptions passes through the options of the wrapped handler, if it
+// applies any to its exports.
+func (c *CachingHandler) ExportOptions(ctx context.Context, conn net.Conn, f billy.Filesystem) *nfs.ExportOptions {
+	if eh, ok := c.Handler.(nfs.ExportHandler); ok {
+		return eh.ExportOptions(ctx, conn, f)
+	}
+	return nil
+}
+
+// MountOptions passes through the options of the wrapped handler for mounts,
+// if it gives them.
+func (c *CachingHandler) MountOptions(ctx context.Context, conn net.Conn, req nfs.MountRequest) *nfs.ExportOptions {
+	if mh, ok := c.Handler.(nfs.MountOptionsHandler); ok {
+		return mh.MountOptions(ctx, conn, req)
+	}
+	return nil
+}
+
+// Capabilities passes through the capabilities of the wrapped handler.
+func (c *CachingHandler) Capabilities(f billy.Filesystem) nfs.Capabilities {
+	return nfs.CapabilitiesOf(c.Handler, f)
+}
+
+// Mount passes the mount to the wrapped handler, and gives the filesystem
+// mounted an Invalidator for this cache, if it takes one.
+func (c *CachingHandler) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	status, f, flavors := c.Handler.Mount(ctx, conn, req)
+	if status != nfs.MountStatusOk {
+		return status, f, flavors
+	}
+	c.recordMount(f, string(req.Dirpath))
+	if ifs, ok := f.(nfs.InvalidatingFilesystem); ok {
+		ifs.SetInvalidator(c.Invalidator(f))
+	}
+	return status, f, flavors
+}
+
+func (c *CachingHandler) recordMount(f billy.Filesystem, dirpath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.mounts {
+		if reflect.DeepEqual(m.f, f) {
+			return
+		}
+	}
+	c.mounts = append(c.mounts, mount{f, dirpath})
+}
+
+// mountPath provides the filesystem mounted at dirpath, mounting it through
+// the wrapped handler, with a nil net.Conn, if it is not mounted yet. It is
+// nil if the handler refuses the mount.
+func (c *CachingHandler) mountPath(dirpath string) billy.Filesystem {
+	c.mu.Lock()
+	for _, m := range c.mounts {
+		if m.dirpath == dirpath {
+			c.mu.Unlock()
+			return m.f
+		}
+	}
+	c.mu.Unlock()
+	status, f, _ := c.Handler.Mount(context.Background(), nil, nfs.MountRequest{Dirpath: []byte(dirpath)})
+	if status != nfs.MountStatusOk || f == nil {
+		nfs.Log.Warnf("dropping the handles of %s: mount failed with status %d", dirpath, status)
+		return nil
+	}
+	c.recordMount(f, dirpath)
+	return f
+}
+
+// mountOf provides the path f was mounted at.
+func (c *CachingHandler) mountOf(f billy.Filesystem) (string, bool) {
+	for _, m := range c.mounts {
+		if reflect.DeepEqual(m.f, f) {
+			return m.dirpath, true
+		}
+	}
+	return "", false
+}
+
+// Invalidator provides an Invalidator for the handles and listings cached
+// for f.
+func (c *CachingHandler) Invalidator(f billy.Filesystem) nfs.Invalidator {
+	return &cacheInvalidator{c, f}
+}
+
+type cacheInvalidator struct {
+	c *CachingHandler
+	f billy.Filesystem
+}
+
+func (i *cacheInvalidator) InvalidatePath(path []string) {
+	i.c.InvalidatePath(i.f, path)
+}
+
+func (i *cacheInvalidator) InvalidateListing(path []string) {
+	i.c.InvalidateListing(i.f, path)
+}
+
 // ToHandle takes a file and represents it with an opaque handle to reference it.
 // In stateless nfs (when it's serving a unix fs) this can be the device + inode
 // but we can generalize with a stateful local cache of handed out IDs.
 func (c *CachingHandler) ToHandle(f billy.Filesystem, path []string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	joinedPath := f.Join(path...)
 
 	if handle := c.searchReverseCache(f, joinedPath); handle != nil {
@@ -64,44 +180,54 @@ func (c *CachingHandler) ToHandle(f billy.Filesystem, path []string) []byte {
 	newPath := make([]string, len(path))
 
 	copy(newPath, path)
-	evictedKey, evictedPath, ok := c.activeHandles.GetOldest()
-	if evicted := c.activeHandles.Add(id, entry{f, newPath}); evicted && ok {
-		rk := evictedPath.f.Join(evictedPath.p...)
-		c.evictReverseCache(rk, evictedKey)
-	}
-
-	if _, ok := c.reverseHandles[joinedPath]; !ok {
-		c.reverseHandles[joinedPath] = []uuid.UUID{}
-	}
-	c.reverseHandles[joinedPath] = append(c.reverseHandles[joinedPath], id)
-	b, _ := id.MarshalBinary()
-
-	return b
+	c.addHandle(id, f, newPath)
+	return c.format.encode(id)
 }
 
 // FromHandle converts from an opaque handle to the file it represents
 func (c *CachingHandler) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
-	id, err := uuid.FromBytes(fh)
-	if err != nil {
-		return nil, []string{}, err
+	ids := handleIDs(fh)
+	if len(ids) == 0 {
+		return nil, []string{}, fmt.Errorf("invalid handle of %d bytes", len(fh))
 	}
 
-	if f, ok := c.activeHandles.Get(id); ok {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		f, ok := c.activeHandles.Get(id)
+		if !ok {
+			continue
+		}
 		for _, k := range c.activeHandles.Keys() {
 			candidate, _ := c.activeHandles.Peek(k)
 			if hasPrefix(f.p, candidate.p) {
 				_, _ = c.activeHandles.Get(k)
 			}
 		}
-		if ok {
-			newP := make([]string, len(f.p))
-			copy(newP, f.p)
-			return f.f, newP, nil
-		}
+		newP := make([]string, len(f.p))
+		copy(newP, f.p)
+		return f.f, newP, nil
 	}
 	return nil, []string{}, &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusStale}
 }
 
+// addHandle adds the handle id of path in f, with c.mu held.
+func (c *CachingHandler) addHandle(id uuid.UUID, f billy.Filesystem, path []string) {
+	evictedKey, evictedPath, ok := c.activeHandles.GetOldest()
+	if evicted := c.activeHandles.Add(id, entry{f, path}); evicted && ok {
+		rk := evictedPath.f.Join(evictedPath.p...)
+		c.evictReverseCache(rk, evictedKey)
+		c.replicate(HandleChange{Op: HandleRemoved, ID: evictedKey})
+	}
+	joinedPath := f.Join(path...)
+	c.reverseHandles[joinedPath] = append(c.reverseHandles[joinedPath], id)
+	if dirpath, ok := c.mountOf(f); ok {
+		c.replicate(HandleChange{Op: HandleAdded, ID: id, Mount: dirpath, Path: path})
+	}
+}
+
+// searchReverseCache provides the handle given for path in f, laid out in the
+// current format, with c.mu held.
 func (c *CachingHandler) searchReverseCache(f billy.Filesystem, path string) []byte {
 	uuids, exists := c.reverseHandles[path]
 
@@ -112,7 +238,7 @@ func (c *CachingHandler) searchReverseCache(f billy.Filesystem, path string) []b
 	for _, id := range uuids {
 		if candidate, ok := c.activeHandles.Get(id); ok {
 			if reflect.DeepEqual(candidate.f, f) {
-				return id[:]
+				return c.format.encode(id)
 			}
 		}
 	}
@@ -137,16 +263,60 @@ func (c *CachingHandler) evictReverseCache(path string, handle uuid.UUID) {
 
 func (c *CachingHandler) InvalidateHandle(fs billy.Filesystem, handle []byte) error {
 	//Remove from cache
-	id, _ := uuid.FromBytes(handle)
-	entry, ok := c.activeHandles.Get(id)
-	if ok {
-		rk := entry.f.Join(entry.p...)
-		c.evictReverseCache(rk, id)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range handleIDs(handle) {
+		entry, ok := c.activeHandles.Get(id)
+		if ok {
+			rk := entry.f.Join(entry.p...)
+			c.evictReverseCache(rk, id)
+		}
+		if c.activeHandles.Remove(id) {
+			c.replicate(HandleChange{Op: HandleRemoved, ID: id})
+		}
 	}
-	c.activeHandles.Remove(id)
 	return nil
 }
 
+// InvalidatePath forgets the handles of path and of everything below it in
+// f, along with the cached listings of those directories, after they have been
+// removed or replaced by means other than NFS.
+func (c *CachingHandler) InvalidatePath(f billy.Filesystem, path []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range c.activeHandles.Keys() {
+		candidate, ok := c.activeHandles.Peek(k)
+		if !ok || !hasPrefix(candidate.p, path) || !reflect.DeepEqual(candidate.f, f) {
+			continue
+		}
+		c.evictReverseCache(candidate.f.Join(candidate.p...), k)
+		c.activeHandles.Remove(k)
+		c.replicate(HandleChange{Op: HandleRemoved, ID: k})
+	}
+	c.invalidateListings(f.Join(path...), true)
+}
+
+// InvalidateListing forgets the cached listings of the directory at path in f,
+// after its entries have been modified by means other than NFS.
+func (c *CachingHandler) InvalidateListing(f billy.Filesystem, path []string) {
+	c.invalidateListings(f.Join(path...), false)
+}
+
+func (c *CachingHandler) invalidateListings(dir string, below bool) {
+	for _, k := range c.activeVerifiers.Keys() {
+		v, ok := c.activeVerifiers.Peek(k)
+		if ok && (v.path == dir || below && within(v.path, dir)) {
+			c.activeVerifiers.Remove(k)
+		}
+	}
+}
+
+// within reports whether p is below the directory dir.
+func within(p, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return dir == "" || strings.HasPrefix(p, dir+"/")
+}
+
 // HandleLimit exports how many file handles can be safely stored by this cache.
 func (c *CachingHandler) HandleLimit() int {
 	return c.cacheLimit
@@ -197,3 +367,86 @@ func (c *CachingHandler) DataForVerifier(path string, id uint64) []fs.FileInfo {
 	}
 	return nil
 }
+
+// handleTableVersion is the version of the format written by Export.
+const handleTableVersion = 1
+
+// handleTable is the format written by Export: the mounts the handles are
+// in, and the handles from least to most recently used.
+type handleTable struct {
+	Version int           `json:"version"`
+	Mounts  []string      `json:"mounts"`
+	Handles []handleEntry `json:"handles"`
+}
+
+type handleEntry struct {
+	ID    uuid.UUID `json:"id"`
+	Mount int       `json:"mount"`
+	Path  []string  `json:"path"`
+}
+
+// Export writes the handles of the cache to w, so that they can be given the
+// same paths by Import after a restart, or on a standby server, rather than
+// every mounted client seeing its handles go stale. Only the handles of
+// filesystems mounted through the cache are written, as the filesystems are
+// found again by mounting their paths.
+func (c *CachingHandler) Export(w io.Writer) error {
+	c.mu.Lock()
+	table := handleTable{Version: handleTableVersion}
+	mounts := make(map[string]int)
+	for _, k := range c.activeHandles.Keys() {
+		e, ok := c.activeHandles.Peek(k)
+		if !ok {
+			continue
+		}
+		dirpath, ok := c.mountOf(e.f)
+		if !ok {
+			continue
+		}
+		i, ok := mounts[dirpath]
+		if !ok {
+			i = len(table.Mounts)
+			mounts[dirpath] = i
+			table.Mounts = append(table.Mounts, dirpath)
+		}
+		table.Handles = append(table.Handles, handleEntry{ID: k, Mount: i, Path: e.p})
+	}
+	c.mu.Unlock()
+	return json.NewEncoder(w).Encode(&table)
+}
+
+// Import adds the handles written by Export to the cache. The filesystems
+// they are in are mounted again through the wrapped handler, with a nil
+// net.Conn, unless already mounted; the handles of mounts it refuses are dropped, and will be stale
+// to clients.
+func (c *CachingHandler) Import(r io.Reader) error {
+	var table handleTable
+	if err := json.NewDecoder(r).Decode(&table); err != nil {
+		return err
+	}
+	if table.Version != handleTableVersion {
+		return fmt.Errorf("unsupported handle table version %d", table.Version)
+	}
+	filesystems := make([]billy.Filesystem, len(table.Mounts))
+	for i, dirpath := range table.Mounts {
+		filesystems[i] = c.mountPath(dirpath)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range table.Handles {
+		if h.Mount < 0 || h.Mount >= len(filesystems) {
+			return fmt.Errorf("handle %s is in unknown mount %d", h.ID, h.Mount)
+		}
+		f := filesystems[h.Mount]
+		if f == nil || c.activeHandles.Contains(h.ID) {
+			continue
+		}
+		p := h.Path
+		if p == nil {
+			p = []string{}
+		}
+		c.addHandle(h.ID, f, p)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package helpers_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestCachingHandlerConcurrentHandles(t *testing.T) {
+	mem := memfs.New()
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 16; j++ {
+			f, err := mem.Create(fmt.Sprintf("/f%d-%d", i, j))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = f.Close()
+		}
+	}
+	h := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 400; j++ {
+				p := []string{fmt.Sprintf("f%d-%d", i, j%16)}
+				fh := h.ToHandle(mem, p)
+				_, got, err := h.FromHandle(fh)
+				if err != nil {
+					errs <- fmt.Errorf("handle of %v: %w", p, err)
+					return
+				}
+				if !reflect.DeepEqual(got, p) {
+					errs <- fmt.Errorf("handle of %v resolved to %v", p, got)
+					return
+				}
+				if j%7 == 0 {
+					_ = h.InvalidateHandle(mem, fh)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestHandleTableExport(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/d", 0755)
+	_ = billyutil.WriteFile(mem, "/d/f", []byte("x"), 0644)
+
+	serve := func(cache *helpers.CachingHandler) (*nfstest.Server, *nfstest.Client) {
+		srv, err := nfstest.NewServer(cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := srv.Mount(t, "/", rpc.AuthNull)
+		return srv, target
+	}
+	first := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024).(*helpers.CachingHandler)
+	srv, target := serve(first)
+	_, dir, err := target.Lookup("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var table bytes.Buffer
+	if err := first.Export(&table); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	srv.Close()
+
+	second := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024).(*helpers.CachingHandler)
+	if err := second.Import(bytes.NewReader(table.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	srv, target = serve(second)
+	defer srv.Close()
+	defer target.Close()
+	fh, _, err := nfstest.Lookup(target.Target, dir, "f")
+	if err != nil {
+		t.Fatalf("expected the imported handle to resolve: %v", err)
+	}
+	if _, path, err := second.FromHandle(fh); err != nil || !reflect.DeepEqual(path, []string{"d", "f"}) {
+		t.Fatalf("unexpected path %v: %v", path, err)
+	}
+
+	if err := second.Import(strings.NewReader(`{"version":99}`)); err == nil {
+		t.Fatal("expected an unknown version to be refused")
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package helpers
 
 import (
 	"os"
@@ -24,15 +24,26 @@ func (fs COS) Chmod(name string, mode os.FileMode) error {
 
 // Lchown changes ownership
 func (fs COS) Lchown(name string, uid, gid int) error {
-	return os.Lchown(fs.Join(fs.Root(), name), uid, gid)
+	return lchown(fs.Join(fs.Root(), name), uid, gid)
 }
 
 // Chown changes ownership
 func (fs COS) Chown(name string, uid, gid int) error {
-	return os.Chown(fs.Join(fs.Root(), name), uid, gid)
+	return chown(fs.Join(fs.Root(), name), uid, gid)
 }
 
 // Chtimes changes access time
 func (fs COS) Chtimes(name string, atime time.Time, mtime time.Time) error {
 	return os.Chtimes(fs.Join(fs.Root(), name), atime, mtime)
 }
+
+// Sync flushes the contents of a file to stable storage.
+func (fs COS) Sync(name string) error {
+	// opened for writing, as Windows requires of a file it flushes.
+	f, err := os.OpenFile(fs.Join(fs.Root(), name), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package helpers
+
+import (
+	"os"
+)
+
+func lchown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
+func chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || linux || nacl || netbsd || openbsd || solaris
+
+package helpers
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func mknod(path string, mode uint32, dev uint64) error {
+	return unix.Mknod(path, mode, int(dev))
+}
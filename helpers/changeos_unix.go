@@ -1,14 +1,13 @@
 //go:build darwin || dragonfly || freebsd || linux || nacl || netbsd || openbsd || solaris
 
-package main
+package helpers
 
 import (
 	"golang.org/x/sys/unix"
 )
 
 func (fs COS) Mknod(path string, mode uint32, major uint32, minor uint32) error {
-	dev := unix.Mkdev(major, minor)
-	return unix.Mknod(fs.Join(fs.Root(), path), mode, int(dev))
+	return mknod(fs.Join(fs.Root(), path), mode, unix.Mkdev(major, minor))
 }
 
 func (fs COS) Mkfifo(path string, mode uint32) error {
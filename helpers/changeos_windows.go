@@ -0,0 +1,180 @@
+//go:build windows
+
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Windows has no numeric owners to give files, so changes of ownership are
+// accepted and have no effect, rather than failing every SETATTR made by
+// tools that preserve ownership.
+func lchown(name string, uid, gid int) error {
+	return nil
+}
+
+func chown(name string, uid, gid int) error {
+	return nil
+}
+
+// reservedNames are the devices Windows resolves in every directory, with
+// any extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// validName reports whether a file can be given the name elem on Windows.
+// Names of devices, and those with characters Windows refuses or drops, such
+// as a trailing dot, would otherwise open a device or another file than the
+// one named by the client. So would names that aren't UTF-8, which are
+// stored with U+FFFD in place of what can't be decoded.
+func validName(elem string) bool {
+	if elem == "." || elem == ".." {
+		return true
+	}
+	if !utf8.ValidString(elem) {
+		return false
+	}
+	if strings.ContainsAny(elem, `<>:"|?*`) || strings.HasSuffix(elem, ".") || strings.HasSuffix(elem, " ") {
+		return false
+	}
+	for _, c := range elem {
+		if c < 32 {
+			return false
+		}
+	}
+	base := elem
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	return !reservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// validPath reports whether every component of the relative path name is a
+// valid name.
+func validPath(name string) bool {
+	for _, elem := range strings.FieldsFunc(name, func(r rune) bool { return r == '\\' || r == '/' }) {
+		if !validName(elem) {
+			return false
+		}
+	}
+	return true
+}
+
+// invalid fails a call creating name, and missing one looking it up.
+func invalid(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+}
+
+func missing(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// Create creates a file, which must have a valid name.
+func (fs COS) Create(filename string) (billy.File, error) {
+	if !validPath(filename) {
+		return nil, invalid("create", filename)
+	}
+	return fs.Filesystem.Create(filename)
+}
+
+// Open opens a file, where no file of an invalid name can exist.
+func (fs COS) Open(filename string) (billy.File, error) {
+	if !validPath(filename) {
+		return nil, missing("open", filename)
+	}
+	return fs.Filesystem.Open(filename)
+}
+
+// OpenFile opens or creates a file.
+func (fs COS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if !validPath(filename) {
+		if flag&os.O_CREATE != 0 {
+			return nil, invalid("open", filename)
+		}
+		return nil, missing("open", filename)
+	}
+	return fs.Filesystem.OpenFile(filename, flag, perm)
+}
+
+// Stat provides the attributes of a file.
+func (fs COS) Stat(filename string) (os.FileInfo, error) {
+	if !validPath(filename) {
+		return nil, missing("stat", filename)
+	}
+	return fs.Filesystem.Stat(filename)
+}
+
+// Lstat provides the attributes of a file, not following links.
+func (fs COS) Lstat(filename string) (os.FileInfo, error) {
+	if !validPath(filename) {
+		return nil, missing("lstat", filename)
+	}
+	return fs.Filesystem.Lstat(filename)
+}
+
+// ReadDir lists a directory.
+func (fs COS) ReadDir(path string) ([]os.FileInfo, error) {
+	if !validPath(path) {
+		return nil, missing("readdir", path)
+	}
+	return fs.Filesystem.ReadDir(path)
+}
+
+// Rename moves a file to a valid name.
+func (fs COS) Rename(oldpath, newpath string) error {
+	if !validPath(oldpath) {
+		return missing("rename", oldpath)
+	}
+	if !validPath(newpath) {
+		return invalid("rename", newpath)
+	}
+	return fs.Filesystem.Rename(oldpath, newpath)
+}
+
+// Remove removes a file.
+func (fs COS) Remove(filename string) error {
+	if !validPath(filename) {
+		return missing("remove", filename)
+	}
+	return fs.Filesystem.Remove(filename)
+}
+
+// MkdirAll creates a directory and its parents, which must have valid names.
+func (fs COS) MkdirAll(filename string, perm os.FileMode) error {
+	if !validPath(filename) {
+		return invalid("mkdir", filename)
+	}
+	return fs.Filesystem.MkdirAll(filename, perm)
+}
+
+// Symlink creates a link. Clients give targets with forward slashes, which
+// are stored with backslashes, and can't name another volume.
+func (fs COS) Symlink(target, link string) error {
+	if !validPath(link) {
+		return invalid("symlink", link)
+	}
+	target = filepath.FromSlash(target)
+	if filepath.VolumeName(target) != "" {
+		return invalid("symlink", target)
+	}
+	return fs.Filesystem.Symlink(target, link)
+}
+
+// Readlink reads the target of a link, with forward slashes.
+func (fs COS) Readlink(link string) (string, error) {
+	if !validPath(link) {
+		return "", missing("readlink", link)
+	}
+	target, err := fs.Filesystem.Readlink(link)
+	return filepath.ToSlash(target), err
+}
@@ -0,0 +1,46 @@
+//go:build darwin || freebsd || linux || netbsd
+
+package helpers
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Getxattr provides the extended attribute name of the file at path, without
+// following links. Files without it, and those of filesystems not storing
+// extended attributes, have none.
+func (fs COS) Getxattr(path, name string) ([]byte, error) {
+	full := fs.Join(fs.Root(), path)
+	for {
+		n, err := unix.Lgetxattr(full, name, nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		buf := make([]byte, n)
+		n, err = unix.Lgetxattr(full, name, buf)
+		// the attribute may have grown since its size was asked.
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		return buf[:n], nil
+	}
+}
+
+// Setxattr sets the extended attribute name of the file at path, without
+// following links.
+func (fs COS) Setxattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(fs.Join(fs.Root(), path), name, value, 0)
+}
+
+func xattrError(err error) error {
+	if errors.Is(err, errNoAttr) || errors.Is(err, unix.ENOTSUP) {
+		return os.ErrNotExist
+	}
+	return err
+}
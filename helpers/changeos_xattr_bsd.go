@@ -0,0 +1,10 @@
+//go:build darwin || freebsd || netbsd
+
+package helpers
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// errNoAttr is the error of getting an extended attribute a file lacks.
+const errNoAttr = unix.ENOATTR
@@ -0,0 +1,884 @@
+package helpers
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/willscott/go-nfs"
+)
+
+// DefaultCompressionFrameSize is the size of the frames a CompressedFS
+// compresses files in when given no frame size.
+const DefaultCompressionFrameSize = 64 << 10
+
+// compressedDirtyFrames is the number of changed frames a file holds in
+// memory before writing them.
+const compressedDirtyFrames = 64
+
+// compressedCompactSize is the number of bytes of replaced frames a file may
+// hold before it is rewritten without them, when they outweigh its frames.
+const compressedCompactSize = 1 << 20
+
+// compressedMagic starts the trailer of a compressed file.
+var compressedMagic = [8]byte{'n', 'f', 's', 'z', 0, 0, 0, 1}
+
+// compressedTrailerSize is the size of the trailer ending a compressed file:
+// the magic, the offset of its index, its size, its frame size and its number
+// of frames.
+const compressedTrailerSize = 8 + 8 + 8 + 4 + 4
+
+// compressedEntrySize is the size of an entry in the index of a compressed
+// file: the offset and length of the frame, and its kind.
+const compressedEntrySize = 8 + 4 + 1
+
+// The kinds of frame.
+const (
+	frameHole   = 0 // zeros, not stored.
+	frameFlate  = 1 // compressed with deflate.
+	frameStored = 2 // stored as it is, when it doesn't compress.
+)
+
+// NewCompressedFS wraps fs to store the files written through it compressed,
+// in frames of frameSize bytes compressed with compress/flate at level, such
+// as flate.DefaultCompression. A frame size of zero takes the default.
+func NewCompressedFS(fs billy.Filesystem, frameSize int, level int) *CompressedFS {
+	if frameSize <= 0 {
+		frameSize = DefaultCompressionFrameSize
+	}
+	return &CompressedFS{
+		Filesystem: fs,
+		frameSize:  int64(frameSize),
+		level:      level,
+		open:       make(map[string]*compressedData),
+	}
+}
+
+// CompressedFS stores file data compressed on the wrapped filesystem. Files
+// are compressed in frames, with an index of them at the end of the file, so
+// that a read decompresses only the frames it covers.
+//
+// Changed frames are appended to the file, with a new index, rather than
+// rewritten, so that a crash leaves the file as it last was. A file is
+// rewritten without the frames it no longer uses once they outweigh those
+// it does. Files which aren't compressed, such as those there before the
+// wrapper, are read as they are, and are compressed as they are written.
+type CompressedFS struct {
+	billy.Filesystem
+	frameSize int64
+	level     int
+
+	mu   sync.Mutex
+	open map[string]*compressedData // the files open, by path.
+}
+
+// compressedFrame is an entry in the index of a compressed file.
+type compressedFrame struct {
+	off  int64
+	size int64
+	kind uint8
+}
+
+// compressedData is the contents of a file while it is open, shared by the
+// handles open on it.
+type compressedData struct {
+	name      string
+	refs      int
+	frameSize int64
+	size      int64
+	frames    []compressedFrame
+	end       int64            // the size of the file on the backend.
+	dirty     map[int64][]byte // changed frames not yet written, by index.
+	changed   bool
+	removed   bool
+
+	// the frame last decompressed, for reads smaller than a frame.
+	cached     int64
+	cachedData []byte
+}
+
+func cleanCompressedPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// readIndex reads the index of a backend file of the given size, or
+// describes a file which isn't compressed in frames of its contents.
+func (c *CompressedFS) readIndex(f billy.File, size int64) (*compressedData, error) {
+	n := &compressedData{frameSize: c.frameSize, end: size, dirty: make(map[int64][]byte), cached: -1}
+	if size == 0 {
+		return n, nil
+	}
+	var trailer [compressedTrailerSize]byte
+	if size >= compressedTrailerSize {
+		if _, err := f.ReadAt(trailer[:], size-compressedTrailerSize); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	}
+	if size < compressedTrailerSize || !bytes.Equal(trailer[:8], compressedMagic[:]) {
+		n.size = size
+		for off := int64(0); off < size; off += n.frameSize {
+			length := n.frameSize
+			if size-off < length {
+				length = size - off
+			}
+			n.frames = append(n.frames, compressedFrame{off, length, frameStored})
+		}
+		return n, nil
+	}
+	indexOff := int64(binary.BigEndian.Uint64(trailer[8:]))
+	n.size = int64(binary.BigEndian.Uint64(trailer[16:]))
+	n.frameSize = int64(binary.BigEndian.Uint32(trailer[24:]))
+	count := int64(binary.BigEndian.Uint32(trailer[28:]))
+	if n.frameSize == 0 || indexOff < 0 || indexOff+count*compressedEntrySize != size-compressedTrailerSize {
+		return nil, &os.PathError{Op: "open", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	index := make([]byte, count*compressedEntrySize)
+	if _, err := f.ReadAt(index, indexOff); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	for i := int64(0); i < count; i++ {
+		e := index[i*compressedEntrySize:]
+		n.frames = append(n.frames, compressedFrame{
+			off:  int64(binary.BigEndian.Uint64(e)),
+			size: int64(binary.BigEndian.Uint32(e[8:])),
+			kind: e[12],
+		})
+	}
+	return n, nil
+}
+
+// load reads the index of a file from the backend.
+func (c *CompressedFS) load(name string) (*compressedData, error) {
+	f, err := c.Filesystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := c.Filesystem.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: billy.ErrNotSupported}
+	}
+	n, err := c.readIndex(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	n.name = name
+	return n, nil
+}
+
+// frame provides the contents of a frame of a file, of the full frame size,
+// with c.mu held.
+func (c *CompressedFS) frame(n *compressedData, index int64) ([]byte, error) {
+	if data, ok := n.dirty[index]; ok {
+		return data, nil
+	}
+	data := make([]byte, n.frameSize)
+	if index >= int64(len(n.frames)) || n.frames[index].kind == frameHole {
+		return data, nil
+	}
+	if n.cached == index {
+		copy(data, n.cachedData)
+		return data, nil
+	}
+	fr := n.frames[index]
+	f, err := c.Filesystem.Open(n.name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	raw := make([]byte, fr.size)
+	if _, err := f.ReadAt(raw, fr.off); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	switch fr.kind {
+	case frameStored:
+		copy(data, raw)
+	case frameFlate:
+		r := flate.NewReader(bytes.NewReader(raw))
+		if _, err := io.ReadFull(r, data); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	default:
+		return nil, &os.PathError{Op: "read", Path: n.name, Err: os.ErrInvalid}
+	}
+	n.cached, n.cachedData = index, append([]byte{}, data...)
+	return data, nil
+}
+
+// encode compresses a frame, trimmed to the size of the file.
+func (c *CompressedFS) encode(n *compressedData, index int64, data []byte) ([]byte, uint8, error) {
+	if end := n.size - index*n.frameSize; end < int64(len(data)) {
+		data = data[:end]
+	}
+	if len(bytes.Trim(data, "\x00")) == 0 {
+		return nil, frameHole, nil
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+	if buf.Len() >= len(data) {
+		return data, frameStored, nil
+	}
+	return buf.Bytes(), frameFlate, nil
+}
+
+// appendIndex encodes the index and trailer of a file whose index starts at
+// off.
+func (n *compressedData) appendIndex(b []byte, off int64) []byte {
+	for _, fr := range n.frames {
+		var e [compressedEntrySize]byte
+		binary.BigEndian.PutUint64(e[:], uint64(fr.off))
+		binary.BigEndian.PutUint32(e[8:], uint32(fr.size))
+		e[12] = fr.kind
+		b = append(b, e[:]...)
+	}
+	var trailer [compressedTrailerSize]byte
+	copy(trailer[:], compressedMagic[:])
+	binary.BigEndian.PutUint64(trailer[8:], uint64(off))
+	binary.BigEndian.PutUint64(trailer[16:], uint64(n.size))
+	binary.BigEndian.PutUint32(trailer[24:], uint32(n.frameSize))
+	binary.BigEndian.PutUint32(trailer[28:], uint32(len(n.frames)))
+	return append(b, trailer[:]...)
+}
+
+// flush appends the changed frames of a file and a new index to it, with
+// c.mu held.
+func (c *CompressedFS) flush(n *compressedData) error {
+	if !n.changed || n.removed {
+		return nil
+	}
+	count := (n.size + n.frameSize - 1) / n.frameSize
+	for int64(len(n.frames)) < count {
+		n.frames = append(n.frames, compressedFrame{})
+	}
+	n.frames = n.frames[:count]
+
+	indexes := make([]int64, 0, len(n.dirty))
+	for index := range n.dirty {
+		if index < count {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	frames := append([]compressedFrame{}, n.frames...)
+	var b []byte
+	for _, index := range indexes {
+		data, kind, err := c.encode(n, index, n.dirty[index])
+		if err != nil {
+			return err
+		}
+		frames[index] = compressedFrame{n.end + int64(len(b)), int64(len(data)), kind}
+		if kind == frameHole {
+			frames[index].off = 0
+		}
+		b = append(b, data...)
+	}
+	// a frame past the end in the index is cut short by the new size.
+	if last := count - 1; last >= 0 && frames[last].kind == frameStored {
+		if end := n.size - last*n.frameSize; frames[last].size > end {
+			frames[last].size = end
+		}
+	}
+	next := &compressedData{frameSize: n.frameSize, size: n.size, frames: frames}
+	b = next.appendIndex(b, n.end+int64(len(b)))
+
+	f, err := c.Filesystem.OpenFile(n.name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(n.end, io.SeekStart); err == nil {
+		_, err = f.Write(b)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	n.frames = frames
+	n.end += int64(len(b))
+	n.dirty = make(map[int64][]byte)
+	n.cached, n.cachedData = -1, nil
+	n.changed = false
+
+	var live int64
+	for _, fr := range n.frames {
+		live += fr.size
+	}
+	if waste := n.end - live; waste > compressedCompactSize && waste > live {
+		return c.compact(n)
+	}
+	return nil
+}
+
+// compact rewrites a file with only the frames it uses, with c.mu held. The
+// file is written aside and renamed into place, so that a crash leaves either
+// version.
+func (c *CompressedFS) compact(n *compressedData) error {
+	info, err := c.Filesystem.Lstat(n.name)
+	if err != nil {
+		return err
+	}
+	src, err := c.Filesystem.Open(n.name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := c.Filesystem.TempFile(path.Dir(n.name), ".compress-")
+	if err != nil {
+		return err
+	}
+	frames := make([]compressedFrame, len(n.frames))
+	var off int64
+	for i, fr := range n.frames {
+		frames[i] = compressedFrame{off, fr.size, fr.kind}
+		if fr.kind == frameHole {
+			frames[i].off = 0
+			continue
+		}
+		data := make([]byte, fr.size)
+		if _, err = src.ReadAt(data, fr.off); err != nil && !errors.Is(err, io.EOF) {
+			break
+		}
+		if _, err = dst.Write(data); err != nil {
+			break
+		}
+		off += fr.size
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		next := &compressedData{frameSize: n.frameSize, size: n.size, frames: frames}
+		_, err = dst.Write(next.appendIndex(nil, off))
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if ch, ok := c.Filesystem.(billy.Change); ok {
+			err = ch.Chmod(dst.Name(), info.Mode().Perm())
+		}
+	}
+	if err == nil {
+		err = c.Filesystem.Rename(dst.Name(), n.name)
+	}
+	if err != nil {
+		_ = c.Filesystem.Remove(dst.Name())
+		return err
+	}
+	n.frames = frames
+	n.end = off + int64(len(frames))*compressedEntrySize + compressedTrailerSize
+	return nil
+}
+
+// truncate changes the size of a file, with c.mu held.
+func (c *CompressedFS) truncate(n *compressedData, size int64) error {
+	if size < n.size {
+		count := (size + n.frameSize - 1) / n.frameSize
+		for index := range n.dirty {
+			if index >= count {
+				delete(n.dirty, index)
+			}
+		}
+		// the rest of the last frame is cleared, so that extending the file
+		// again reads zeros.
+		last := size / n.frameSize
+		if off := size - last*n.frameSize; off > 0 {
+			data, err := c.frame(n, last)
+			if err != nil {
+				return err
+			}
+			for i := off; i < int64(len(data)); i++ {
+				data[i] = 0
+			}
+			n.dirty[last] = data
+		}
+		if int64(len(n.frames)) > count {
+			n.frames = n.frames[:count]
+		}
+	}
+	n.size = size
+	n.changed = true
+	return nil
+}
+
+// release drops a handle on a file, flushing it when it was the last.
+func (c *CompressedFS) release(n *compressedData) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n.refs--
+	err := c.flush(n)
+	if n.refs == 0 && c.open[n.name] == n {
+		delete(c.open, n.name)
+	}
+	return err
+}
+
+// size provides the size of the contents of a file, with c.mu held.
+func (c *CompressedFS) size(name string, info os.FileInfo) (int64, error) {
+	if n, ok := c.open[name]; ok {
+		return n.size, nil
+	}
+	f, err := c.Filesystem.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if info.Size() < compressedTrailerSize {
+		return info.Size(), nil
+	}
+	var trailer [compressedTrailerSize]byte
+	if _, err := f.ReadAt(trailer[:], info.Size()-compressedTrailerSize); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if !bytes.Equal(trailer[:8], compressedMagic[:]) {
+		return info.Size(), nil
+	}
+	return int64(binary.BigEndian.Uint64(trailer[16:])), nil
+}
+
+func (c *CompressedFS) withSize(info os.FileInfo, name string) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() {
+		return info, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size, err := c.size(name, info)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedInfo{info, size}, nil
+}
+
+// Create creates a file.
+func (c *CompressedFS) Create(filename string) (billy.File, error) {
+	return c.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens a file for reading.
+func (c *CompressedFS) Open(filename string) (billy.File, error) {
+	return c.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file.
+func (c *CompressedFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	name := cleanCompressedPath(filename)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.open[name]
+	backendFlag := flag &^ os.O_APPEND
+	if ok {
+		// the frames of the open file are still read from the backend.
+		backendFlag &^= os.O_TRUNC
+	}
+	f, err := c.Filesystem.OpenFile(name, backendFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if !ok {
+		if n, err = c.load(name); err != nil {
+			return nil, err
+		}
+		c.open[name] = n
+	} else if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := c.truncate(n, 0); err != nil {
+			return nil, err
+		}
+	}
+	n.refs++
+	return &compressedFile{fs: c, data: n, name: filename, flag: flag}, nil
+}
+
+// Sync writes the changes to a file, and syncs it on the wrapped filesystem
+// when it can be.
+func (c *CompressedFS) Sync(filename string) error {
+	c.mu.Lock()
+	var err error
+	if n, ok := c.open[cleanCompressedPath(filename)]; ok {
+		err = c.flush(n)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if sfs, ok := c.Filesystem.(nfs.SyncFilesystem); ok {
+		return sfs.Sync(filename)
+	}
+	return nil
+}
+
+// Stat provides the attributes of a file, with the size of its contents.
+func (c *CompressedFS) Stat(filename string) (os.FileInfo, error) {
+	info, err := c.Filesystem.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.withSize(info, cleanCompressedPath(filename))
+}
+
+// Lstat is Stat, not following links.
+func (c *CompressedFS) Lstat(filename string) (os.FileInfo, error) {
+	info, err := c.Filesystem.Lstat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.withSize(info, cleanCompressedPath(filename))
+}
+
+// ReadDir lists a directory, with the sizes of the contents of its files.
+func (c *CompressedFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries, err := c.Filesystem.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	dir := cleanCompressedPath(dirname)
+	for i, e := range entries {
+		if entries[i], err = c.withSize(e, path.Join(dir, e.Name())); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Rename moves a file or directory.
+func (c *CompressedFS) Rename(oldpath, newpath string) error {
+	from, to := cleanCompressedPath(oldpath), cleanCompressedPath(newpath)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.Filesystem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if n, ok := c.open[to]; ok {
+		n.removed = true
+		delete(c.open, to)
+	}
+	prefix := strings.TrimSuffix(from, "/") + "/"
+	moved := make(map[string]*compressedData)
+	for name, n := range c.open {
+		if name == from || strings.HasPrefix(name, prefix) {
+			delete(c.open, name)
+			n.name = to + strings.TrimPrefix(name, from)
+			moved[n.name] = n
+		}
+	}
+	for name, n := range moved {
+		c.open[name] = n
+	}
+	return nil
+}
+
+// Remove removes a file or empty directory.
+func (c *CompressedFS) Remove(filename string) error {
+	name := cleanCompressedPath(filename)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.Filesystem.Remove(filename); err != nil {
+		return err
+	}
+	if n, ok := c.open[name]; ok {
+		n.removed = true
+		delete(c.open, name)
+	}
+	return nil
+}
+
+// TempFile creates a file with a unique name in dir.
+func (c *CompressedFS) TempFile(dir, prefix string) (billy.File, error) {
+	f, err := c.Filesystem.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return c.OpenFile(f.Name(), os.O_RDWR, 0)
+}
+
+// Chroot provides a CompressedFS of a directory, sharing its open files.
+func (c *CompressedFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(c, path), nil
+}
+
+// Chmod changes the mode of a file.
+func (c *CompressedFS) Chmod(name string, mode os.FileMode) error {
+	ch, ok := c.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return ch.Chmod(name, mode)
+}
+
+// Lchown changes the owner of a file, not following links.
+func (c *CompressedFS) Lchown(name string, uid, gid int) error {
+	ch, ok := c.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return ch.Lchown(name, uid, gid)
+}
+
+// Chown changes the owner of a file.
+func (c *CompressedFS) Chown(name string, uid, gid int) error {
+	ch, ok := c.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return ch.Chown(name, uid, gid)
+}
+
+// Chtimes changes the times of a file, after writing its changes, which
+// would change its modification time again.
+func (c *CompressedFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	ch, ok := c.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	if err := c.Sync(name); err != nil {
+		return err
+	}
+	return ch.Chtimes(name, atime, mtime)
+}
+
+// FSInfo provides the limits of the wrapped filesystem.
+func (c *CompressedFS) FSInfo(info *nfs.FSInfo) error {
+	if ifs, ok := c.Filesystem.(nfs.FSInfoFilesystem); ok {
+		return ifs.FSInfo(info)
+	}
+	return nil
+}
+
+// compressedInfo is a file of a CompressedFS, with the size of its contents
+// rather than of what is stored.
+type compressedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *compressedInfo) Size() int64 { return i.size }
+
+// compressedFile is a handle on a file of a CompressedFS.
+type compressedFile struct {
+	fs     *CompressedFS
+	data   *compressedData
+	name   string
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *compressedFile) Name() string {
+	return f.name
+}
+
+func (f *compressedFile) writable() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *compressedFile) Write(p []byte) (int, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	c, n := f.fs, f.data
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = n.size
+	}
+	written := 0
+	for written < len(p) {
+		off := f.pos + int64(written)
+		index := off / n.frameSize
+		data, err := c.frame(n, index)
+		if err != nil {
+			return written, err
+		}
+		written += copy(data[off-index*n.frameSize:], p[written:])
+		n.dirty[index] = data
+	}
+	f.pos += int64(written)
+	if f.pos > n.size {
+		n.size = f.pos
+	}
+	n.changed = true
+	if len(n.dirty) > compressedDirtyFrames {
+		if err := c.flush(n); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (f *compressedFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	c, n := f.fs, f.data
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if off >= n.size {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if n.size-off < want {
+		want = n.size - off
+	}
+	read := int64(0)
+	for read < want {
+		pos := off + read
+		index := pos / n.frameSize
+		data, err := c.frame(n, index)
+		if err != nil {
+			return int(read), err
+		}
+		read += int64(copy(p[read:want], data[pos-index*n.frameSize:]))
+	}
+	if want < int64(len(p)) {
+		return int(read), io.EOF
+	}
+	return int(read), nil
+}
+
+func (f *compressedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.fs.mu.Lock()
+		offset += f.data.size
+		f.fs.mu.Unlock()
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// isHole reports whether a frame of a file reads as zeros without being
+// stored, with c.mu held.
+func (n *compressedData) isHole(index int64) bool {
+	if _, ok := n.dirty[index]; ok {
+		return false
+	}
+	return index >= int64(len(n.frames)) || n.frames[index].kind == frameHole
+}
+
+// SeekData provides the offset of the first data at or after offset, which is
+// the start of the first frame at or after it that isn't a hole.
+func (f *compressedFile) SeekData(offset int64) (int64, error) {
+	return f.seekFrame(offset, false)
+}
+
+// SeekHole provides the offset of the first hole at or after offset, which is
+// the start of the first frame of zeros at or after it.
+func (f *compressedFile) SeekHole(offset int64) (int64, error) {
+	return f.seekFrame(offset, true)
+}
+
+// seekFrame finds the first frame from the one holding offset which is a
+// hole, or which isn't, providing where at or after offset it starts.
+func (f *compressedFile) seekFrame(offset int64, hole bool) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	n := f.data
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if offset >= n.size {
+		return 0, io.EOF
+	}
+	for index := offset / n.frameSize; index*n.frameSize < n.size; index++ {
+		if n.isHole(index) != hole {
+			continue
+		}
+		if start := index * n.frameSize; start > offset {
+			return start, nil
+		}
+		return offset, nil
+	}
+	if hole {
+		return n.size, nil
+	}
+	return 0, io.EOF
+}
+
+func (f *compressedFile) Truncate(size int64) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.fs.truncate(f.data, size)
+}
+
+func (f *compressedFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.fs.flush(f.data)
+}
+
+func (f *compressedFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return f.fs.release(f.data)
+}
+
+func (f *compressedFile) Lock() error {
+	return nil
+}
+
+func (f *compressedFile) Unlock() error {
+	return nil
+}
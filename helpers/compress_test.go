@@ -0,0 +1,71 @@
+package helpers_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestCompressedFS(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/plain", []byte("stored before compression"), 0644)
+	cfs := helpers.NewCompressedFS(mem, 16<<10, flate.DefaultCompression)
+	content := bytes.Repeat([]byte("compressible text "), 12000)
+	if err := billyutil.WriteFile(cfs, "/data", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := mem.Stat("/data")
+	if stored.Size() >= int64(len(content))/4 {
+		t.Fatalf("expected the file to be stored compressed, it takes %d of %d bytes", stored.Size(), len(content))
+	}
+
+	srv := nfstest.ServeFS(t, cfs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr, err := target.GetAttr(fh); err != nil || attr.Size() != int64(len(content)) {
+		t.Fatalf("expected the size of the contents rather than of what is stored: %v", err)
+	}
+	rf, err := target.Open("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if _, err := rf.ReadAt(buf, 100000); err != nil || !bytes.Equal(buf, content[100000:100100]) {
+		t.Fatalf("unexpected read from the middle of the file: %v", err)
+	}
+	_ = rf.Close()
+
+	wf, err := target.OpenFile("/data", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wf.Seek(50000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wf.Write([]byte("overwritten")); err != nil {
+		t.Fatal(err)
+	}
+	_ = wf.Close()
+	copy(content[50000:], "overwritten")
+
+	// a new wrapper reads what the first stored.
+	reopened := helpers.NewCompressedFS(mem, 0, flate.DefaultCompression)
+	if b, err := billyutil.ReadFile(reopened, "/data"); err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("expected the rewritten file to read back: %v", err)
+	}
+	if b, err := billyutil.ReadFile(reopened, "/plain"); err != nil || string(b) != "stored before compression" {
+		t.Fatalf("expected a file stored uncompressed to read as it is, got %q: %v", b, err)
+	}
+}
@@ -0,0 +1,714 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs"
+)
+
+// DefaultDedupChunkSize is the size of the chunks a DedupFS splits files
+// into when given no chunk size.
+const DefaultDedupChunkSize = 64 << 10
+
+// dedupDirtyChunks is the number of changed chunks a file holds in memory
+// before storing them.
+const dedupDirtyChunks = 64
+
+// NewDedupFS provides a filesystem keeping its files in store, split into
+// chunks of chunkSize bytes which are stored once by the hash of their
+// contents however many files hold them. A chunk size of zero takes the
+// default. The tree of the filesystem is kept in "tree" of store, with a
+// manifest of its chunks for each file, and the chunks in "chunks".
+func NewDedupFS(store billy.Filesystem, chunkSize int) (*DedupFS, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultDedupChunkSize
+	}
+	for _, dir := range []string{"tree", "chunks"} {
+		if err := store.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	tree, err := store.Chroot("tree")
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := store.Chroot("chunks")
+	if err != nil {
+		return nil, err
+	}
+	return &DedupFS{
+		tree:      tree,
+		chunks:    chunks,
+		chunkSize: int64(chunkSize),
+		open:      make(map[string]*dedupData),
+	}, nil
+}
+
+// DedupFS is a filesystem storing identical chunks of its files once, for
+// exports of many similar files, such as images or build artifacts. Chunks
+// are at fixed offsets, so files sharing data at different alignments don't
+// share chunks. Chunks no longer in any file are kept until Collect.
+type DedupFS struct {
+	tree      billy.Filesystem
+	chunks    billy.Filesystem
+	chunkSize int64
+
+	mu   sync.Mutex
+	open map[string]*dedupData // the files open, by path.
+}
+
+// dedupManifest lists the chunks of a file. An empty hash is a chunk of
+// zeros, which isn't stored.
+type dedupManifest struct {
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// dedupData is the contents of a file while it is open, shared by the
+// handles open on it.
+type dedupData struct {
+	name    string
+	refs    int
+	size    int64
+	chunks  []string
+	dirty   map[int64][]byte // changed chunks not yet stored, by index.
+	changed bool
+	removed bool
+}
+
+func cleanDedupPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func (d *DedupFS) chunkPath(hash string) string {
+	return path.Join(hash[:2], hash)
+}
+
+// readManifest reads the manifest of a file, with d.mu held. An empty file
+// is one just created.
+func (d *DedupFS) readManifest(name string) (*dedupManifest, error) {
+	b, err := billyutil.ReadFile(d.tree, name)
+	if err != nil {
+		return nil, err
+	}
+	m := &dedupManifest{}
+	if len(b) == 0 {
+		return m, nil
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// putChunk stores a chunk, if it isn't already, providing its hash.
+func (d *DedupFS) putChunk(data []byte) (string, error) {
+	if len(bytes.Trim(data, "\x00")) == 0 {
+		return "", nil
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	name := d.chunkPath(hash)
+	if _, err := d.chunks.Stat(name); err == nil {
+		return hash, nil
+	}
+	if err := d.chunks.MkdirAll(hash[:2], 0755); err != nil {
+		return "", err
+	}
+	// written aside and renamed into place, so that a chunk is never seen
+	// partly written.
+	f, err := d.chunks.TempFile(hash[:2], ".chunk-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = d.chunks.Rename(f.Name(), name)
+	}
+	if err != nil {
+		_ = d.chunks.Remove(f.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+// chunk provides the contents of a chunk of a file, of the full chunk size,
+// with d.mu held.
+func (d *DedupFS) chunk(n *dedupData, index int64) ([]byte, error) {
+	if data, ok := n.dirty[index]; ok {
+		return data, nil
+	}
+	data := make([]byte, d.chunkSize)
+	if index >= int64(len(n.chunks)) || n.chunks[index] == "" {
+		return data, nil
+	}
+	f, err := d.chunks.Open(d.chunkPath(n.chunks[index]))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.ReadFull(f, data); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// store stores the changed chunks of a file, with d.mu held.
+func (d *DedupFS) store(n *dedupData) error {
+	for index, data := range n.dirty {
+		if end := n.size - index*d.chunkSize; end < int64(len(data)) {
+			data = data[:end]
+		}
+		hash, err := d.putChunk(data)
+		if err != nil {
+			return err
+		}
+		for int64(len(n.chunks)) <= index {
+			n.chunks = append(n.chunks, "")
+		}
+		n.chunks[index] = hash
+		delete(n.dirty, index)
+	}
+	return nil
+}
+
+// flush stores the changes to a file and writes its manifest, with d.mu
+// held.
+func (d *DedupFS) flush(n *dedupData) error {
+	if !n.changed || n.removed {
+		return nil
+	}
+	if err := d.store(n); err != nil {
+		return err
+	}
+	count := (n.size + d.chunkSize - 1) / d.chunkSize
+	if int64(len(n.chunks)) > count {
+		n.chunks = n.chunks[:count]
+	}
+	b, err := json.Marshal(&dedupManifest{Size: n.size, Chunks: n.chunks})
+	if err != nil {
+		return err
+	}
+	// the manifest is rewritten in place, rather than replaced, to keep the
+	// mode and owner of the file.
+	f, err := d.tree.OpenFile(n.name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	n.changed = false
+	return nil
+}
+
+// Create creates a file.
+func (d *DedupFS) Create(filename string) (billy.File, error) {
+	return d.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens a file for reading.
+func (d *DedupFS) Open(filename string) (billy.File, error) {
+	return d.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file.
+func (d *DedupFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	name := cleanDedupPath(filename)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, ok := d.open[name]
+	if ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrExist}
+	}
+	if !ok {
+		if flag&os.O_CREATE != 0 {
+			f, err := d.tree.OpenFile(name, os.O_WRONLY|flag&(os.O_CREATE|os.O_EXCL), perm)
+			if err != nil {
+				return nil, err
+			}
+			if err := f.Close(); err != nil {
+				return nil, err
+			}
+		}
+		info, err := d.tree.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: filename, Err: billy.ErrNotSupported}
+		}
+		m, err := d.readManifest(name)
+		if err != nil {
+			return nil, err
+		}
+		n = &dedupData{name: name, size: m.Size, chunks: m.Chunks, dirty: make(map[int64][]byte)}
+		d.open[name] = n
+	}
+	n.refs++
+	f := &dedupFile{fs: d, data: n, name: filename, flag: flag}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		d.truncate(n, 0)
+	}
+	return f, nil
+}
+
+// truncate changes the size of a file, with d.mu held.
+func (d *DedupFS) truncate(n *dedupData, size int64) {
+	if size < n.size {
+		count := (size + d.chunkSize - 1) / d.chunkSize
+		for index := range n.dirty {
+			if index >= count {
+				delete(n.dirty, index)
+			}
+		}
+		if int64(len(n.chunks)) > count {
+			n.chunks = n.chunks[:count]
+		}
+		// the rest of the last chunk is cleared, so that extending the file
+		// again reads zeros.
+		last := size / d.chunkSize
+		if off := size - last*d.chunkSize; off > 0 {
+			if data, err := d.chunk(n, last); err == nil {
+				for i := off; i < int64(len(data)); i++ {
+					data[i] = 0
+				}
+				n.dirty[last] = data
+			}
+		}
+	}
+	n.size = size
+	n.changed = true
+}
+
+// release drops a handle on a file, flushing it when it was the last.
+func (d *DedupFS) release(n *dedupData) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n.refs--
+	err := d.flush(n)
+	if n.refs == 0 && d.open[n.name] == n {
+		delete(d.open, n.name)
+	}
+	return err
+}
+
+// Sync stores the changes to a file open for writing.
+func (d *DedupFS) Sync(filename string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n, ok := d.open[cleanDedupPath(filename)]; ok {
+		return d.flush(n)
+	}
+	return nil
+}
+
+// Stat provides the attributes of a file, with the size of its contents.
+func (d *DedupFS) Stat(filename string) (os.FileInfo, error) {
+	info, err := d.tree.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return d.withSize(info, cleanDedupPath(filename))
+}
+
+// Lstat is Stat, not following links.
+func (d *DedupFS) Lstat(filename string) (os.FileInfo, error) {
+	info, err := d.tree.Lstat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return d.withSize(info, cleanDedupPath(filename))
+}
+
+// ReadDir lists a directory, with the sizes of the contents of its files.
+func (d *DedupFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries, err := d.tree.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	dir := cleanDedupPath(dirname)
+	for i, e := range entries {
+		if entries[i], err = d.withSize(e, path.Join(dir, e.Name())); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (d *DedupFS) withSize(info os.FileInfo, name string) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() {
+		return info, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n, ok := d.open[name]; ok {
+		return &dedupInfo{info, n.size}, nil
+	}
+	m, err := d.readManifest(name)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupInfo{info, m.Size}, nil
+}
+
+// Rename moves a file or directory.
+func (d *DedupFS) Rename(oldpath, newpath string) error {
+	from, to := cleanDedupPath(oldpath), cleanDedupPath(newpath)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, n := range d.open {
+		if err := d.flush(n); err != nil {
+			return err
+		}
+	}
+	if err := d.tree.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if n, ok := d.open[to]; ok {
+		n.removed = true
+		delete(d.open, to)
+	}
+	prefix := strings.TrimSuffix(from, "/") + "/"
+	moved := make(map[string]*dedupData)
+	for name, n := range d.open {
+		if name == from || strings.HasPrefix(name, prefix) {
+			delete(d.open, name)
+			n.name = to + strings.TrimPrefix(name, from)
+			moved[n.name] = n
+		}
+	}
+	for name, n := range moved {
+		d.open[name] = n
+	}
+	return nil
+}
+
+// Remove removes a file or empty directory. Its chunks are kept until
+// Collect.
+func (d *DedupFS) Remove(filename string) error {
+	name := cleanDedupPath(filename)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.tree.Remove(filename); err != nil {
+		return err
+	}
+	if n, ok := d.open[name]; ok {
+		n.removed = true
+		delete(d.open, name)
+	}
+	return nil
+}
+
+// TempFile creates a file with a unique name in dir.
+func (d *DedupFS) TempFile(dir, prefix string) (billy.File, error) {
+	f, err := d.tree.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return d.OpenFile(f.Name(), os.O_RDWR, 0)
+}
+
+// Join joins the elements of a path.
+func (d *DedupFS) Join(elem ...string) string {
+	return d.tree.Join(elem...)
+}
+
+// MkdirAll creates a directory and its parents.
+func (d *DedupFS) MkdirAll(filename string, perm os.FileMode) error {
+	return d.tree.MkdirAll(filename, perm)
+}
+
+// Symlink creates a link.
+func (d *DedupFS) Symlink(target, link string) error {
+	return d.tree.Symlink(target, link)
+}
+
+// Readlink provides the target of a link.
+func (d *DedupFS) Readlink(link string) (string, error) {
+	return d.tree.Readlink(link)
+}
+
+// Chroot provides a DedupFS of a directory, sharing its store.
+func (d *DedupFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(d, path), nil
+}
+
+// Root provides the root of the filesystem.
+func (d *DedupFS) Root() string {
+	return "/"
+}
+
+// Chmod changes the mode of a file.
+func (d *DedupFS) Chmod(name string, mode os.FileMode) error {
+	c, ok := d.tree.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Chmod(name, mode)
+}
+
+// Lchown changes the owner of a file, not following links.
+func (d *DedupFS) Lchown(name string, uid, gid int) error {
+	c, ok := d.tree.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Lchown(name, uid, gid)
+}
+
+// Chown changes the owner of a file.
+func (d *DedupFS) Chown(name string, uid, gid int) error {
+	c, ok := d.tree.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Chown(name, uid, gid)
+}
+
+// Chtimes changes the times of a file, after storing its changes, which
+// would change its modification time again.
+func (d *DedupFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	c, ok := d.tree.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	if err := d.Sync(name); err != nil {
+		return err
+	}
+	return c.Chtimes(name, atime, mtime)
+}
+
+// Collect removes the stored chunks no file holds, providing the number
+// removed.
+func (d *DedupFS) Collect() (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	held := make(map[string]bool)
+	for _, n := range d.open {
+		if err := d.store(n); err != nil {
+			return 0, err
+		}
+		for _, hash := range n.chunks {
+			held[hash] = true
+		}
+	}
+	err := billyutil.Walk(d.tree, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		m, err := d.readManifest(name)
+		if err != nil {
+			return err
+		}
+		for _, hash := range m.Chunks {
+			held[hash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	err = billyutil.Walk(d.chunks, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || held[info.Name()] {
+			return err
+		}
+		if err := d.chunks.Remove(name); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if removed > 0 {
+		nfs.Log.Debugf("collected %d unused chunks", removed)
+	}
+	return removed, err
+}
+
+// dedupInfo is a file of a DedupFS, with the size of its contents rather
+// than of its manifest.
+type dedupInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *dedupInfo) Size() int64 { return i.size }
+
+// dedupFile is a handle on a file of a DedupFS.
+type dedupFile struct {
+	fs     *DedupFS
+	data   *dedupData
+	name   string
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *dedupFile) Name() string {
+	return f.name
+}
+
+func (f *dedupFile) writable() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *dedupFile) Write(p []byte) (int, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	d, n := f.fs, f.data
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = n.size
+	}
+	written := 0
+	for written < len(p) {
+		off := f.pos + int64(written)
+		index := off / d.chunkSize
+		data, err := d.chunk(n, index)
+		if err != nil {
+			return written, err
+		}
+		written += copy(data[off-index*d.chunkSize:], p[written:])
+		n.dirty[index] = data
+	}
+	f.pos += int64(written)
+	if f.pos > n.size {
+		n.size = f.pos
+	}
+	n.changed = true
+	if len(n.dirty) > dedupDirtyChunks {
+		if err := d.store(n); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (f *dedupFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	d, n := f.fs, f.data
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if off >= n.size {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if n.size-off < want {
+		want = n.size - off
+	}
+	read := int64(0)
+	for read < want {
+		pos := off + read
+		index := pos / d.chunkSize
+		data, err := d.chunk(n, index)
+		if err != nil {
+			return int(read), err
+		}
+		read += int64(copy(p[read:want], data[pos-index*d.chunkSize:]))
+	}
+	if want < int64(len(p)) {
+		return int(read), io.EOF
+	}
+	return int(read), nil
+}
+
+func (f *dedupFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *dedupFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.fs.mu.Lock()
+		offset += f.data.size
+		f.fs.mu.Unlock()
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *dedupFile) Truncate(size int64) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.truncate(f.data, size)
+	return nil
+}
+
+func (f *dedupFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.fs.flush(f.data)
+}
+
+func (f *dedupFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return f.fs.release(f.data)
+}
+
+func (f *dedupFile) Lock() error {
+	return nil
+}
+
+func (f *dedupFile) Unlock() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package helpers_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestDedupFS(t *testing.T) {
+	store := memfs.New()
+	dfs, err := helpers.NewDedupFS(store, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 4096)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	for _, name := range []string{"/a", "/b"} {
+		if err := billyutil.WriteFile(dfs, name, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chunks := func() int {
+		n := 0
+		_ = billyutil.Walk(store, "chunks", func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n++
+			}
+			return err
+		})
+		return n
+	}
+	if n := chunks(); n != 4 {
+		t.Fatalf("expected the chunks of identical files to be stored once, found %d", n)
+	}
+
+	srv := nfstest.ServeFS(t, dfs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	wf, err := target.OpenFile("/b", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wf.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	_ = wf.Close()
+	read := func(name string) []byte {
+		rf, err := target.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rf.Close()
+		b, err := io.ReadAll(rf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if b := read("/a"); !bytes.Equal(b, content) {
+		t.Fatal("expected a write to one file to leave the other sharing its chunks alone")
+	}
+	if b := read("/b"); len(b) != len(content) || string(b[:7]) != "changed" || !bytes.Equal(b[7:], content[7:]) {
+		t.Fatalf("unexpected contents after a write: %q", b[:16])
+	}
+
+	// the first chunk of /a is held by nothing once it is removed.
+	if err := dfs.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := dfs.Collect(); err != nil || n != 1 {
+		t.Fatalf("expected one chunk to be collected, got %d: %v", n, err)
+	}
+	if b := read("/b"); string(b[:7]) != "changed" || !bytes.Equal(b[7:], content[7:]) {
+		t.Fatal("expected collection to keep the chunks of /b")
+	}
+}
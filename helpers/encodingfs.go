@@ -0,0 +1,271 @@
+package helpers
+
+import (
+	"os"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/willscott/go-nfs"
+	"golang.org/x/text/encoding"
+)
+
+// NewEncodingFS wraps fs, whose names are kept in enc, such as
+// charmap.ISO8859_1 for legacy latin-1 data, to present them to clients in
+// UTF-8. Names given by clients are translated to enc, and those they can't
+// be are refused as invalid; names of the backend which don't decode are
+// given with replacement characters. The encoding must keep ASCII as it is,
+// as the ISO 8859 and Windows code pages do, so that separators are kept.
+func NewEncodingFS(fs billy.Filesystem, enc encoding.Encoding) *EncodingFS {
+	return &EncodingFS{Filesystem: fs, enc: enc}
+}
+
+// EncodingFS translates the names of the wrapped filesystem to and from
+// UTF-8.
+type EncodingFS struct {
+	billy.Filesystem
+	enc encoding.Encoding
+}
+
+// backend provides the name of a path on the wrapped filesystem.
+func (e *EncodingFS) backend(op, name string) (string, error) {
+	b, err := e.enc.NewEncoder().String(name)
+	if err != nil {
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+	}
+	return b, nil
+}
+
+// client provides the name of a path of the wrapped filesystem in UTF-8.
+func (e *EncodingFS) client(name string) string {
+	s, err := e.enc.NewDecoder().String(name)
+	if err != nil {
+		return name
+	}
+	return s
+}
+
+// Create creates a file, truncating it if it exists.
+func (e *EncodingFS) Create(filename string) (billy.File, error) {
+	name, err := e.backend("create", filename)
+	if err != nil {
+		return nil, err
+	}
+	return e.Filesystem.Create(name)
+}
+
+// Open opens a file for reading.
+func (e *EncodingFS) Open(filename string) (billy.File, error) {
+	name, err := e.backend("open", filename)
+	if err != nil {
+		return nil, err
+	}
+	return e.Filesystem.Open(name)
+}
+
+// OpenFile opens a file.
+func (e *EncodingFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	name, err := e.backend("open", filename)
+	if err != nil {
+		return nil, err
+	}
+	return e.Filesystem.OpenFile(name, flag, perm)
+}
+
+// Stat provides the attributes of a file, following links.
+func (e *EncodingFS) Stat(filename string) (os.FileInfo, error) {
+	name, err := e.backend("stat", filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := e.Filesystem.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &encodedInfo{info, e.client(info.Name())}, nil
+}
+
+// Lstat provides the attributes of a file, not following links.
+func (e *EncodingFS) Lstat(filename string) (os.FileInfo, error) {
+	name, err := e.backend("lstat", filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := e.Filesystem.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &encodedInfo{info, e.client(info.Name())}, nil
+}
+
+// ReadDir lists a directory, with its names in UTF-8.
+func (e *EncodingFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	name, err := e.backend("readdir", dirname)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := e.Filesystem.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range entries {
+		entries[i] = &encodedInfo{info, e.client(info.Name())}
+	}
+	return entries, nil
+}
+
+// MkdirAll creates a directory and the directories it is in.
+func (e *EncodingFS) MkdirAll(filename string, perm os.FileMode) error {
+	name, err := e.backend("mkdir", filename)
+	if err != nil {
+		return err
+	}
+	return e.Filesystem.MkdirAll(name, perm)
+}
+
+// Rename moves a file or directory.
+func (e *EncodingFS) Rename(oldpath, newpath string) error {
+	from, err := e.backend("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	to, err := e.backend("rename", newpath)
+	if err != nil {
+		return err
+	}
+	return e.Filesystem.Rename(from, to)
+}
+
+// Remove removes a file or empty directory.
+func (e *EncodingFS) Remove(filename string) error {
+	name, err := e.backend("remove", filename)
+	if err != nil {
+		return err
+	}
+	return e.Filesystem.Remove(name)
+}
+
+// TempFile creates a file with a unique name in dir.
+func (e *EncodingFS) TempFile(dir, prefix string) (billy.File, error) {
+	d, err := e.backend("tempfile", dir)
+	if err != nil {
+		return nil, err
+	}
+	p, err := e.backend("tempfile", prefix)
+	if err != nil {
+		return nil, err
+	}
+	return e.Filesystem.TempFile(d, p)
+}
+
+// Symlink creates a link at link to target, translating both.
+func (e *EncodingFS) Symlink(target, link string) error {
+	t, err := e.backend("symlink", target)
+	if err != nil {
+		return err
+	}
+	name, err := e.backend("symlink", link)
+	if err != nil {
+		return err
+	}
+	return e.Filesystem.Symlink(t, name)
+}
+
+// Readlink provides the target of a link in UTF-8.
+func (e *EncodingFS) Readlink(link string) (string, error) {
+	name, err := e.backend("readlink", link)
+	if err != nil {
+		return "", err
+	}
+	target, err := e.Filesystem.Readlink(name)
+	if err != nil {
+		return "", err
+	}
+	return e.client(target), nil
+}
+
+// Chroot provides an EncodingFS of a directory.
+func (e *EncodingFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(e, path), nil
+}
+
+// Chmod changes the mode of a file.
+func (e *EncodingFS) Chmod(name string, mode os.FileMode) error {
+	ch, ok := e.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	b, err := e.backend("chmod", name)
+	if err != nil {
+		return err
+	}
+	return ch.Chmod(b, mode)
+}
+
+// Lchown changes the owner of a file, not following links.
+func (e *EncodingFS) Lchown(name string, uid, gid int) error {
+	ch, ok := e.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	b, err := e.backend("lchown", name)
+	if err != nil {
+		return err
+	}
+	return ch.Lchown(b, uid, gid)
+}
+
+// Chown changes the owner of a file.
+func (e *EncodingFS) Chown(name string, uid, gid int) error {
+	ch, ok := e.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	b, err := e.backend("chown", name)
+	if err != nil {
+		return err
+	}
+	return ch.Chown(b, uid, gid)
+}
+
+// Chtimes changes the times of a file.
+func (e *EncodingFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	ch, ok := e.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	b, err := e.backend("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return ch.Chtimes(b, atime, mtime)
+}
+
+// Sync flushes the contents of a file, when the wrapped filesystem can.
+func (e *EncodingFS) Sync(filename string) error {
+	sfs, ok := e.Filesystem.(nfs.SyncFilesystem)
+	if !ok {
+		return nil
+	}
+	name, err := e.backend("sync", filename)
+	if err != nil {
+		return err
+	}
+	return sfs.Sync(name)
+}
+
+// FSInfo provides the limits of the wrapped filesystem.
+func (e *EncodingFS) FSInfo(info *nfs.FSInfo) error {
+	if ifs, ok := e.Filesystem.(nfs.FSInfoFilesystem); ok {
+		return ifs.FSInfo(info)
+	}
+	return nil
+}
+
+// encodedInfo is a file of an EncodingFS, named in UTF-8.
+type encodedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i *encodedInfo) Name() string { return i.name }
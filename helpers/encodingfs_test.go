@@ -0,0 +1,48 @@
+package helpers_test
+
+import (
+	"io"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestEncodingFS(t *testing.T) {
+	mem := memfs.New()
+	if err := billyutil.WriteFile(mem, "/caf\xe9", []byte("latin-1"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	efs := helpers.NewEncodingFS(mem, charmap.ISO8859_1)
+	srv := nfstest.ServeFS(t, efs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	entries, err := nfstest.ReadDir(target.Target, "/")
+	if err != nil || len(entries) != 1 || entries[0].FileName != "café" {
+		t.Fatalf("expected the name in UTF-8, got %v: %v", entries, err)
+	}
+	rf, err := target.Open("/café")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(rf)
+	rf.Close()
+	if err != nil || string(b) != "latin-1" {
+		t.Fatalf("expected to read the file by its UTF-8 name, got %q: %v", b, err)
+	}
+	if _, err := target.Mkdir("/naïve", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := mem.Stat("/na\xefve"); err != nil || !info.IsDir() {
+		t.Fatalf("expected the directory to be made by its latin-1 name: %v", err)
+	}
+	if _, err := target.Mkdir("/日本", 0755); !nfstest.IsStatus(err, nfs.NFSStatusInval) {
+		t.Fatalf("expected a name latin-1 can't hold to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package helpers
+
+import (
+	"context"
+	"net"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs"
+)
+
+// NewExportHandler wraps a handler to apply opts to every filesystem it
+// serves, or the options of the most specific rule matching the client.
+func NewExportHandler(h nfs.Handler, opts nfs.ExportOptions, rules ...ExportRule) nfs.Handler {
+	return &ExportHandler{Handler: h, Options: opts, Rules: rules}
+}
+
+// ExportRule applies Options to clients connecting from within Network.
+type ExportRule struct {
+	Network *net.IPNet
+	Options nfs.ExportOptions
+}
+
+// ExportHandler applies ExportOptions to the filesystems of the wrapped
+// handler, chosen by the address of the client.
+type ExportHandler struct {
+	nfs.Handler
+	// Options apply to clients matching none of the Rules.
+	Options nfs.ExportOptions
+	// Rules apply per client network. When several match a client, the one
+	// with the longest prefix is used.
+	Rules []ExportRule
+}
+
+// ExportOptions provides the options for calls against fs.
+func (h *ExportHandler) ExportOptions(ctx context.Context, conn net.Conn, fs billy.Filesystem) *nfs.ExportOptions {
+	opts := h.Options
+	if rule := h.match(conn); rule != nil {
+		opts = rule.Options
+	}
+	return &opts
+}
+
+// MountOptions provides the options for mounts of every path, which are those
+// of the filesystems mounted.
+func (h *ExportHandler) MountOptions(ctx context.Context, conn net.Conn, req nfs.MountRequest) *nfs.ExportOptions {
+	return h.ExportOptions(ctx, conn, nil)
+}
+
+// Capabilities passes through the capabilities of the wrapped handler.
+func (h *ExportHandler) Capabilities(fs billy.Filesystem) nfs.Capabilities {
+	return nfs.CapabilitiesOf(h.Handler, fs)
+}
+
+func (h *ExportHandler) match(conn net.Conn) *ExportRule {
+	if len(h.Rules) == 0 || conn == nil {
+		return nil
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	var best *ExportRule
+	bestLen := -1
+	for i := range h.Rules {
+		r := &h.Rules[i]
+		if r.Network == nil || !r.Network.Contains(addr.IP) {
+			continue
+		}
+		if ones, _ := r.Network.Mask.Size(); ones > bestLen {
+			best, bestLen = r, ones
+		}
+	}
+	return best
+}
@@ -0,0 +1,463 @@
+// Package gitfs presents a revision of a go-git repository as a read-only
+// billy filesystem, so that a commit or branch can be exported over NFS
+// without checking it out.
+package gitfs
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/willscott/go-nfs/file"
+)
+
+// streams is the number of blobs kept open for reading on from where the
+// last read ended.
+const streams = 16
+
+// linkHops is the number of links followed in resolving a path.
+const linkHops = 40
+
+// New provides a read-only filesystem of the tree of revision rev of repo,
+// such as a branch, tag or commit hash. A branch is resolved once, so the
+// filesystem stays at the commit it was at; a new one is needed to follow
+// the branch.
+func New(repo *git.Repository, rev string) (*FS, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return &FS{
+		repo:    repo,
+		commit:  commit,
+		root:    tree,
+		streams: make(map[plumbing.Hash]*stream),
+	}, nil
+}
+
+// FS is the tree of a commit. Every object has the time of the commit. Calls
+// modifying it fail with billy.ErrReadOnly, which clients see as
+// NFS3ERR_ROFS. Submodules are presented as empty directories.
+type FS struct {
+	repo   *git.Repository
+	commit *object.Commit
+	root   *object.Tree
+
+	mu      sync.Mutex
+	streams map[plumbing.Hash]*stream
+}
+
+// Commit provides the commit the filesystem presents.
+func (g *FS) Commit() *object.Commit {
+	return g.commit
+}
+
+// stream is a blob being read.
+type stream struct {
+	r   io.ReadCloser
+	pos int64
+}
+
+// node is an object of the tree.
+type node struct {
+	path string
+	mode filemode.FileMode
+	hash plumbing.Hash
+	tree *object.Tree // the entries of a directory.
+}
+
+func readOnly(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: billy.ErrReadOnly}
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// resolve finds the object at name, following links in it, and in its last
+// element when follow is set.
+func (g *FS) resolve(op, name string, follow bool) (*node, error) {
+	elems := strings.Split(strings.TrimPrefix(cleanPath(name), "/"), "/")
+	cur := &node{path: "/", mode: filemode.Dir, tree: g.root}
+	hops := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		if elem == "" {
+			continue
+		}
+		if cur.tree == nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		e, err := cur.tree.FindEntry(elem)
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		next := &node{path: path.Join(cur.path, elem), mode: e.Mode, hash: e.Hash}
+		switch e.Mode {
+		case filemode.Symlink:
+			if len(elems) == 0 && !follow {
+				break
+			}
+			if hops++; hops > linkHops {
+				return nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target, err := g.readlink(e.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if !path.IsAbs(target) {
+				target = path.Join(cur.path, target)
+			}
+			elems = append(strings.Split(strings.TrimPrefix(path.Clean(target), "/"), "/"), elems...)
+			cur = &node{path: "/", mode: filemode.Dir, tree: g.root}
+			continue
+		case filemode.Dir:
+			if next.tree, err = g.repo.TreeObject(e.Hash); err != nil {
+				return nil, err
+			}
+		case filemode.Submodule:
+			next.tree = &object.Tree{}
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+func (g *FS) readlink(hash plumbing.Hash) (string, error) {
+	blob, err := g.repo.BlobObject(hash)
+	if err != nil {
+		return "", err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	target, err := io.ReadAll(io.LimitReader(r, 4096))
+	return string(target), err
+}
+
+func (g *FS) info(n *node, name string) (os.FileInfo, error) {
+	info := &fileInfo{name: name, mtime: g.commit.Committer.When}
+	h := fnv.New64()
+	_, _ = h.Write([]byte(n.path))
+	info.fileid = h.Sum64()
+	switch n.mode {
+	case filemode.Dir, filemode.Submodule:
+		info.mode = os.ModeDir | 0555
+		return info, nil
+	case filemode.Symlink:
+		info.mode = os.ModeSymlink | 0777
+	case filemode.Executable:
+		info.mode = 0555
+	default:
+		info.mode = 0444
+	}
+	blob, err := g.repo.BlobObject(n.hash)
+	if err != nil {
+		return nil, err
+	}
+	info.size = blob.Size
+	return info, nil
+}
+
+// Create fails, since the tree is read-only.
+func (g *FS) Create(filename string) (billy.File, error) {
+	return nil, readOnly("create", filename)
+}
+
+// Open opens a file for reading.
+func (g *FS) Open(filename string) (billy.File, error) {
+	return g.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file for reading.
+func (g *FS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, readOnly("open", filename)
+	}
+	n, err := g.resolve("open", filename, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.tree != nil {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: syscall.EISDIR}
+	}
+	blob, err := g.repo.BlobObject(n.hash)
+	if err != nil {
+		return nil, err
+	}
+	return &gitFile{fs: g, hash: n.hash, size: blob.Size, name: filename}, nil
+}
+
+// Stat provides the attributes of an object, following links.
+func (g *FS) Stat(filename string) (os.FileInfo, error) {
+	n, err := g.resolve("stat", filename, true)
+	if err != nil {
+		return nil, err
+	}
+	return g.info(n, path.Base(cleanPath(filename)))
+}
+
+// Lstat provides the attributes of an object, not following links.
+func (g *FS) Lstat(filename string) (os.FileInfo, error) {
+	n, err := g.resolve("lstat", filename, false)
+	if err != nil {
+		return nil, err
+	}
+	return g.info(n, path.Base(cleanPath(filename)))
+}
+
+// ReadDir lists a directory, sorted by name.
+func (g *FS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	n, err := g.resolve("readdir", dirname, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.tree == nil {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: syscall.ENOTDIR}
+	}
+	entries := make([]os.FileInfo, 0, len(n.tree.Entries))
+	for _, e := range n.tree.Entries {
+		info, err := g.info(&node{path: path.Join(n.path, e.Name), mode: e.Mode, hash: e.Hash}, e.Name)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, info)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Readlink provides the target of a link.
+func (g *FS) Readlink(link string) (string, error) {
+	n, err := g.resolve("readlink", link, false)
+	if err != nil {
+		return "", err
+	}
+	if n.mode != filemode.Symlink {
+		return "", &os.PathError{Op: "readlink", Path: link, Err: os.ErrInvalid}
+	}
+	return g.readlink(n.hash)
+}
+
+// Rename fails, since the tree is read-only.
+func (g *FS) Rename(oldpath, newpath string) error {
+	return readOnly("rename", oldpath)
+}
+
+// Remove fails, since the tree is read-only.
+func (g *FS) Remove(filename string) error {
+	return readOnly("remove", filename)
+}
+
+// MkdirAll fails, since the tree is read-only.
+func (g *FS) MkdirAll(filename string, perm os.FileMode) error {
+	return readOnly("mkdir", filename)
+}
+
+// Symlink fails, since the tree is read-only.
+func (g *FS) Symlink(target, link string) error {
+	return readOnly("symlink", link)
+}
+
+// TempFile fails, since the tree is read-only.
+func (g *FS) TempFile(dir, prefix string) (billy.File, error) {
+	return nil, readOnly("tempfile", dir)
+}
+
+// Join joins the elements of a path.
+func (g *FS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// Chroot provides a filesystem of a directory of the tree.
+func (g *FS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(g, path), nil
+}
+
+// Root provides the root of the tree.
+func (g *FS) Root() string {
+	return "/"
+}
+
+// Capabilities marks the tree read-only, so that the server answers calls
+// modifying it with NFS3ERR_ROFS.
+func (g *FS) Capabilities() billy.Capability {
+	return billy.ReadCapability | billy.SeekCapability
+}
+
+// Close closes the blobs being read.
+func (g *FS) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for h, s := range g.streams {
+		_ = s.r.Close()
+		delete(g.streams, h)
+	}
+	return nil
+}
+
+// readAt reads a blob, reading on from where the last read of it ended when
+// it can, since blobs are compressed and can only be read from their start.
+func (g *FS) readAt(hash plumbing.Hash, size int64, p []byte, off int64) (int, error) {
+	if off >= size {
+		return 0, io.EOF
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.streams[hash]
+	if !ok || s.pos > off {
+		if ok {
+			_ = s.r.Close()
+			delete(g.streams, hash)
+		}
+		blob, err := g.repo.BlobObject(hash)
+		if err != nil {
+			return 0, err
+		}
+		r, err := blob.Reader()
+		if err != nil {
+			return 0, err
+		}
+		if len(g.streams) >= streams {
+			for old, s := range g.streams {
+				_ = s.r.Close()
+				delete(g.streams, old)
+				break
+			}
+		}
+		s = &stream{r: r}
+		g.streams[hash] = s
+	}
+	if off > s.pos {
+		skipped, err := io.CopyN(io.Discard, s.r, off-s.pos)
+		s.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(s.r, p)
+	s.pos += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// fileInfo describes an object of the tree.
+type fileInfo struct {
+	name   string
+	size   int64
+	mode   os.FileMode
+	mtime  time.Time
+	fileid uint64
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() os.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.mtime }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fileInfo) Fileid() uint64     { return i.fileid }
+
+func (i *fileInfo) Sys() interface{} {
+	return &file.FileInfo{Nlink: 1, Fileid: i.fileid}
+}
+
+// gitFile is a blob open for reading.
+type gitFile struct {
+	fs     *FS
+	hash   plumbing.Hash
+	size   int64
+	name   string
+	pos    int64
+	closed bool
+}
+
+func (f *gitFile) Name() string {
+	return f.name
+}
+
+func (f *gitFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	return f.fs.readAt(f.hash, f.size, p, off)
+}
+
+func (f *gitFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *gitFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *gitFile) Write(p []byte) (int, error) {
+	return 0, readOnly("write", f.name)
+}
+
+func (f *gitFile) Truncate(size int64) error {
+	return readOnly("truncate", f.name)
+}
+
+func (f *gitFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *gitFile) Lock() error {
+	return nil
+}
+
+func (f *gitFile) Unlock() error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package gitfs_test
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	gitmemory "github.com/go-git/go-git/v5/storage/memory"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers/gitfs"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestGitFS(t *testing.T) {
+	worktree := memfs.New()
+	repo, err := git.Init(gitmemory.NewStorage(), worktree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = billyutil.WriteFile(worktree, "/README", []byte("at the root"), 0644)
+	_ = billyutil.WriteFile(worktree, "/src/main.go", []byte("package main"), 0644)
+	_ = worktree.Symlink("src/main.go", "/main")
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.AddGlob("*"); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, err := wt.Commit("first", &git.CommitOptions{Author: &object.Signature{Name: "a", Email: "a@example.com", When: when}}); err != nil {
+		t.Fatal(err)
+	}
+	_ = billyutil.WriteFile(worktree, "/README", []byte("changed since"), 0644)
+	if _, err := wt.Add("README"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Commit("second", &git.CommitOptions{Author: &object.Signature{Name: "a", Email: "a@example.com", When: when.Add(time.Hour)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	gfs, err := gitfs.New(repo, "HEAD~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gfs.Close()
+	srv := nfstest.ServeFS(t, gfs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	entries, err := nfstest.ReadDir(target.Target, "/")
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected the three entries of the commit, got %d: %v", len(entries), err)
+	}
+	read := func(name string) []byte {
+		rf, err := target.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rf.Close()
+		b, err := io.ReadAll(rf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if b := read("/README"); string(b) != "at the root" {
+		t.Fatalf("expected the file as of the first commit, got %q", b)
+	}
+	if b := read("/src/main.go"); string(b) != "package main" {
+		t.Fatalf("unexpected contents of a nested file: %q", b)
+	}
+	if info, err := gfs.Lstat("/main"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected the link to be kept, got %v", err)
+	}
+	if info, err := gfs.Stat("/main"); err != nil || info.Size() != int64(len("package main")) {
+		t.Fatalf("expected the link to be followed, got %v", err)
+	}
+	if info, _, err := target.Lookup("/src"); err != nil || !info.ModTime().Equal(when) {
+		t.Fatalf("expected the time of the commit, got %v", err)
+	}
+	if _, err := target.Create("/new", 0644); !nfstest.IsStatus(err, nfs.NFSStatusROFS) {
+		t.Fatalf("expected the tree to be read-only, got %v", err)
+	}
+}
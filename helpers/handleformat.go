@@ -0,0 +1,83 @@
+package helpers
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/willscott/go-nfs"
+)
+
+// HandleFormat lays out the handles a CachingHandler gives clients.
+type HandleFormat struct {
+	// Size is the length of the handles, from 16 to nfs.FHSize bytes, 16
+	// when zero. Handles of 16 bytes are the ID of the handle alone, as
+	// handles have always been laid out. Larger handles lead with a byte
+	// giving the version of their layout, followed by the ID and padded with
+	// zeros, so that later layouts can be told apart from them.
+	Size int
+}
+
+const (
+	handleIDSize = 16
+	// handleLayout1 is the version of the layout of handles larger than
+	// their ID.
+	handleLayout1 = 1
+	// mountV1HandleSize is the fixed size of the handles MOUNT v1 gives,
+	// which pads them with zeros, and which clients then use as they are.
+	mountV1HandleSize = 32
+)
+
+// SetHandleFormat has the handles given from now on laid out as f. Handles
+// of every layout the cache knows of resolve whatever its format, so that
+// clients keep the handles they were given before a change of format, and
+// servers given a new format can be upgraded one at a time. It may be called
+// while the handler is serving.
+func (c *CachingHandler) SetHandleFormat(f HandleFormat) error {
+	if f.Size != 0 && (f.Size < handleIDSize || f.Size > nfs.FHSize) {
+		return fmt.Errorf("handle size %d is not between %d and %d bytes", f.Size, handleIDSize, nfs.FHSize)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.format = f
+	return nil
+}
+
+// encode lays out the handle of id.
+func (f HandleFormat) encode(id uuid.UUID) []byte {
+	if f.Size <= handleIDSize {
+		return append([]byte{}, id[:]...)
+	}
+	fh := make([]byte, f.Size)
+	fh[0] = handleLayout1
+	copy(fh[1:], id[:])
+	return fh
+}
+
+// handleIDs provides the IDs fh may hold, in each layout it could be of.
+func handleIDs(fh []byte) []uuid.UUID {
+	var ids []uuid.UUID
+	add := func(b []byte) {
+		var id uuid.UUID
+		copy(id[:], b)
+		ids = append(ids, id)
+	}
+	if len(fh) == handleIDSize {
+		add(fh)
+	}
+	if len(fh) > handleIDSize && fh[0] == handleLayout1 && isZero(fh[1+handleIDSize:]) {
+		add(fh[1 : 1+handleIDSize])
+	}
+	if len(fh) == mountV1HandleSize && isZero(fh[handleIDSize:]) {
+		add(fh[:handleIDSize])
+	}
+	return ids
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package helpers_test
+
+import (
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestHandleFormat(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/file", []byte("hello"), 0644)
+	cache := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024).(*helpers.CachingHandler)
+	if err := cache.SetHandleFormat(helpers.HandleFormat{Size: 8}); err == nil {
+		t.Fatal("expected handles too small for their ID to be refused")
+	}
+	if err := cache.SetHandleFormat(helpers.HandleFormat{Size: 32}); err != nil {
+		t.Fatal(err)
+	}
+	srv := nfstest.Serve(t, cache)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	_, fh, err := target.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fh) != 32 || fh[0] != 1 {
+		t.Fatalf("expected a versioned handle of 32 bytes, got %x", fh)
+	}
+	if _, err := target.GetAttr(fh); err != nil {
+		t.Fatal(err)
+	}
+
+	// handles given before a change of format keep resolving.
+	if err := cache.SetHandleFormat(helpers.HandleFormat{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.GetAttr(fh); err != nil {
+		t.Fatalf("expected a handle of the earlier format to resolve: %v", err)
+	}
+	if compact := cache.ToHandle(mem, []string{"file"}); len(compact) != 16 {
+		t.Fatalf("expected a handle of 16 bytes, got %x", compact)
+	}
+}
+
+func TestHandleFormatWhileServing(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/file", []byte("hello"), 0644)
+	cache := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024).(*helpers.CachingHandler)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = cache.SetHandleFormat(helpers.HandleFormat{Size: 16 + (i%2)*16})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		fh := cache.ToHandle(mem, []string{"file"})
+		if len(fh) != 16 && len(fh) != 32 {
+			t.Fatalf("expected a handle of either format, got %x", fh)
+		}
+		if _, _, err := cache.FromHandle(fh); err != nil {
+			t.Fatalf("expected the handle to resolve: %v", err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,192 @@
+package helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// HTTPManifest lists the files of a dataset served over HTTP, as read by
+// NewHTTPFS. Directories holding files need not be listed.
+type HTTPManifest struct {
+	Files []HTTPManifestEntry `json:"files"`
+}
+
+// HTTPManifestEntry describes a file, directory or link of a dataset.
+type HTTPManifestEntry struct {
+	// Path is the name of the entry in the filesystem.
+	Path string `json:"path"`
+	// Type is "file", "dir" or "symlink". An entry of no type is a file.
+	Type string `json:"type,omitempty"`
+	// URL locates the data of a file, relative to the manifest. It is the
+	// path of the file when empty.
+	URL string `json:"url,omitempty"`
+	// Size is the length of the data of a file.
+	Size int64 `json:"size,omitempty"`
+	// Mode holds the permission bits of the entry, defaulting to 0444 for
+	// files and 0555 for directories.
+	Mode os.FileMode `json:"mode,omitempty"`
+	// ModTime is the modification time of the entry.
+	ModTime time.Time `json:"mtime,omitempty"`
+	// Target is where a link points.
+	Target string `json:"target,omitempty"`
+}
+
+// NewHTTPFS provides a read-only filesystem of the files listed by the
+// HTTPManifest at manifestURL, reading their data with range requests. Data
+// is requested in blocks of DefaultBlockSize bytes, and up to cacheSize bytes
+// of the blocks read are kept, dropping the least recently read blocks
+// first. A cache size of zero takes DefaultBlockCacheSize, and a nil client
+// is http.DefaultClient.
+//
+// The files are expected not to change under the manifest: a file which does
+// may read as a mix of its old and new data.
+func NewHTTPFS(client *http.Client, manifestURL string, cacheSize int64) (*ArchiveFS, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if cacheSize <= 0 {
+		cacheSize = DefaultBlockCacheSize
+	}
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", manifestURL, resp.Status)
+	}
+	var manifest HTTPManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", manifestURL, err)
+	}
+
+	count := int(cacheSize / DefaultBlockSize)
+	if count < 1 {
+		count = 1
+	}
+	blocks, _ := lru.New[blockKey, []byte](count)
+	h := &httpData{client: client, blocks: blocks}
+	a := newArchiveFS()
+	for _, m := range manifest.Files {
+		e := &archiveEntry{mode: m.Mode.Perm(), mtime: m.ModTime}
+		switch m.Type {
+		case "dir":
+			if e.mode == 0 {
+				e.mode = 0555
+			}
+			e.mode |= os.ModeDir
+		case "symlink":
+			e.mode = os.ModeSymlink | 0777
+			e.target = m.Target
+		case "", "file":
+			if e.mode == 0 {
+				e.mode = 0444
+			}
+			if m.Size < 0 {
+				return nil, fmt.Errorf("%s: negative size", m.Path)
+			}
+			ref := &url.URL{Path: strings.TrimPrefix(cleanArchivePath(m.Path), "/")}
+			if m.URL != "" {
+				if ref, err = url.Parse(m.URL); err != nil {
+					return nil, fmt.Errorf("%s: %w", m.Path, err)
+				}
+			}
+			e.size = m.Size
+			e.section = io.NewSectionReader(&httpFile{h: h, url: base.ResolveReference(ref).String(), size: m.Size}, 0, m.Size)
+		default:
+			return nil, fmt.Errorf("%s: unknown type %q", m.Path, m.Type)
+		}
+		a.add(m.Path, e)
+	}
+	return a, nil
+}
+
+// httpData holds the blocks of the files of an HTTP dataset read so far.
+type httpData struct {
+	client *http.Client
+	blocks *lru.Cache[blockKey, []byte]
+}
+
+// httpFile reads the data of a file of an HTTP dataset.
+type httpFile struct {
+	h    *httpData
+	url  string
+	size int64
+}
+
+func (f *httpFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= f.size {
+			return n, io.EOF
+		}
+		index := pos / DefaultBlockSize
+		data, err := f.block(index)
+		if err != nil {
+			return n, err
+		}
+		start := pos - index*DefaultBlockSize
+		if start >= int64(len(data)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(p[n:], data[start:])
+	}
+	return n, nil
+}
+
+// block provides a block of the file, requesting it when it isn't kept.
+func (f *httpFile) block(index int64) ([]byte, error) {
+	key := blockKey{f.url, index}
+	if data, ok := f.h.blocks.Get(key); ok {
+		return data, nil
+	}
+	start := index * DefaultBlockSize
+	end := start + DefaultBlockSize
+	if end > f.size {
+		end = f.size
+	}
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	resp, err := f.h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, so skip to it.
+		if _, err := io.CopyN(io.Discard, resp.Body, start); err != nil {
+			return nil, err
+		}
+	case http.StatusNotFound:
+		return nil, &os.PathError{Op: "read", Path: f.url, Err: os.ErrNotExist}
+	default:
+		return nil, fmt.Errorf("%s: %s", f.url, resp.Status)
+	}
+	data := make([]byte, end-start)
+	n, err := io.ReadFull(resp.Body, data)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	data = data[:n]
+	f.h.blocks.Add(key, data)
+	return data, nil
+}
@@ -0,0 +1,88 @@
+package helpers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestHTTPFS(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	files := map[string][]byte{"/data/big.bin": big, "/blobs/small": []byte("small file")}
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(helpers.HTTPManifest{Files: []helpers.HTTPManifestEntry{
+			{Path: "data/big.bin", Size: int64(len(big))},
+			{Path: "small", URL: "blobs/small", Size: 10, Mode: 0640},
+			{Path: "latest", Type: "symlink", Target: "data/big.bin"},
+			{Path: "empty", Type: "dir"},
+		}})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	})
+	web := httptest.NewServer(mux)
+	defer web.Close()
+
+	hfs, err := helpers.NewHTTPFS(web.Client(), web.URL+"/manifest.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := nfstest.ServeFS(t, hfs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	entries, err := nfstest.ReadDir(target.Target, "/")
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("expected the entries of the manifest, got %d: %v", len(entries), err)
+	}
+	read := func(name string) []byte {
+		rf, err := target.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rf.Close()
+		b, err := io.ReadAll(rf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if b := read("/data/big.bin"); !bytes.Equal(b, big) {
+		t.Fatalf("unexpected contents read over ranges: %d bytes", len(b))
+	}
+	if b := read("/small"); string(b) != "small file" {
+		t.Fatalf("unexpected contents of a file at its own url: %q", b)
+	}
+	fetched := atomic.LoadInt32(&requests)
+	if want := int32(len(big)/helpers.DefaultBlockSize + 2); fetched != want {
+		t.Fatalf("expected a request per block, got %d", fetched)
+	}
+	if b, err := billyutil.ReadFile(hfs, "/latest"); err != nil || !bytes.Equal(b, big) || atomic.LoadInt32(&requests) != fetched {
+		t.Fatalf("expected a second read through the link to be served from the cache: %v", err)
+	}
+	if info, _, err := target.Lookup("/small"); err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("expected the mode of the manifest, got %v", err)
+	}
+	if _, err := target.Create("/new", 0644); !nfstest.IsStatus(err, nfs.NFSStatusROFS) {
+		t.Fatalf("expected the dataset to be read-only, got %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package helpers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/willscott/go-nfs"
+)
+
+// journalEntry is a change recorded in the journal of a JournalFS.
+type journalEntry struct {
+	Op     string      `json:"op"`
+	Path   string      `json:"path"`
+	Target string      `json:"target,omitempty"`
+	Flag   int         `json:"flag,omitempty"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+	Offset int64       `json:"offset,omitempty"`
+	Size   int64       `json:"size,omitempty"`
+	Data   []byte      `json:"data,omitempty"`
+	UID    int         `json:"uid,omitempty"`
+	GID    int         `json:"gid,omitempty"`
+	Atime  *time.Time  `json:"atime,omitempty"`
+	Mtime  *time.Time  `json:"mtime,omitempty"`
+}
+
+// NewJournalFS wraps fs so that each change made through it is first
+// recorded in the journal file at path, on local disk, replaying the changes
+// already in the journal onto fs. The journal is kept until Checkpoint.
+func NewJournalFS(fs billy.Filesystem, path string) (*JournalFS, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &JournalFS{Filesystem: fs, journal: f, touched: make(map[string]bool)}
+	n, err := j.replay()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if n > 0 {
+		nfs.Log.Infof("replayed %d changes from journal %s", n, path)
+	}
+	return j, nil
+}
+
+// JournalFS records the changes made to a filesystem in a journal before
+// making them, so that after a crash they can be replayed onto a backend
+// that lost them, as one whose Sync can't be relied upon.
+//
+// Changes to the namespace and attributes are synced to the journal before
+// they are made. Writes are synced by Sync, and so by the COMMIT of the
+// UNSTABLE writes of clients, which are then durable through the journal
+// whatever the backend does with them.
+//
+// Replay applies the journal in order to the filesystem as it is found:
+// writes land at the offsets recorded, and the changes to the namespace that
+// were already made, such as the removal of a missing file, are skipped.
+// Checkpoint once the backend holds the changes keeps the journal short.
+// Changes are made one at a time, so that the journal records them in the
+// order they were made.
+type JournalFS struct {
+	billy.Filesystem
+	mu      sync.Mutex
+	journal *os.File
+	touched map[string]bool // the files written since the last checkpoint.
+}
+
+// record appends e to the journal, syncing it when sync is set, with j.mu
+// held.
+func (j *JournalFS) record(e *journalEntry, sync bool) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.journal.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if e.Path != "" {
+		j.touched[e.Path] = true
+	}
+	if sync {
+		return j.journal.Sync()
+	}
+	return nil
+}
+
+// change records e, then makes it.
+func (j *JournalFS) change(e *journalEntry) error {
+	switch e.Op {
+	case "chmod", "chown", "lchown", "chtimes":
+		if _, ok := j.Filesystem.(billy.Change); !ok {
+			return billy.ErrNotSupported
+		}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.record(e, true); err != nil {
+		return err
+	}
+	return j.apply(e)
+}
+
+// apply makes the change of an entry to the filesystem.
+func (j *JournalFS) apply(e *journalEntry) error {
+	fs := j.Filesystem
+	switch e.Op {
+	case "open":
+		f, err := fs.OpenFile(e.Path, e.Flag, e.Mode)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	case "write", "truncate":
+		f, err := fs.OpenFile(e.Path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if e.Op == "truncate" {
+			err = f.Truncate(e.Size)
+		} else if _, err = f.Seek(e.Offset, io.SeekStart); err == nil {
+			_, err = f.Write(e.Data)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	case "remove":
+		return fs.Remove(e.Path)
+	case "rename":
+		return fs.Rename(e.Path, e.Target)
+	case "mkdir":
+		return fs.MkdirAll(e.Path, e.Mode)
+	case "symlink":
+		return fs.Symlink(e.Target, e.Path)
+	}
+	c, ok := fs.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	switch e.Op {
+	case "chmod":
+		return c.Chmod(e.Path, e.Mode)
+	case "chown":
+		return c.Chown(e.Path, e.UID, e.GID)
+	case "lchown":
+		return c.Lchown(e.Path, e.UID, e.GID)
+	case "chtimes":
+		if e.Atime == nil || e.Mtime == nil {
+			return os.ErrInvalid
+		}
+		return c.Chtimes(e.Path, *e.Atime, *e.Mtime)
+	}
+	return os.ErrInvalid
+}
+
+// replay applies the entries of the journal, dropping a last entry torn by a
+// crash while it was written. It provides the number of entries applied.
+func (j *JournalFS) replay() (int, error) {
+	if _, err := j.journal.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	dec := json.NewDecoder(bufio.NewReader(j.journal))
+	n := 0
+	for {
+		var e journalEntry
+		end := dec.InputOffset()
+		if err := dec.Decode(&e); err != nil {
+			if !errors.Is(err, io.EOF) {
+				nfs.Log.Warnf("dropping the torn end of the journal: %v", err)
+				if err := j.journal.Truncate(end); err != nil {
+					return n, err
+				}
+			}
+			if _, err := j.journal.Seek(0, io.SeekEnd); err != nil {
+				return n, err
+			}
+			return n, nil
+		}
+		if err := j.apply(&e); err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrExist) {
+			nfs.Log.Warnf("unable to replay %s of %s: %v", e.Op, e.Path, err)
+		}
+		if e.Path != "" {
+			j.touched[e.Path] = true
+		}
+		n++
+	}
+}
+
+// Create creates a file.
+func (j *JournalFS) Create(filename string) (billy.File, error) {
+	return j.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens a file for reading.
+func (j *JournalFS) Open(filename string) (billy.File, error) {
+	return j.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file, recording its creation or truncation, and the
+// writes made to it.
+func (j *JournalFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		j.mu.Lock()
+		err := j.record(&journalEntry{Op: "open", Path: filename, Flag: flag&^(os.O_RDWR|os.O_EXCL) | os.O_WRONLY, Mode: perm}, true)
+		j.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := j.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return &journalFile{File: f, fs: j, name: filename, append: flag&os.O_APPEND != 0}, nil
+}
+
+// TempFile creates a temporary file, recording it once it is named.
+func (j *JournalFS) TempFile(dir, prefix string) (billy.File, error) {
+	f, err := j.Filesystem.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	j.mu.Lock()
+	err = j.record(&journalEntry{Op: "open", Path: f.Name(), Flag: os.O_WRONLY | os.O_CREATE, Mode: 0600}, true)
+	j.mu.Unlock()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &journalFile{File: f, fs: j, name: f.Name()}, nil
+}
+
+// Rename moves a file.
+func (j *JournalFS) Rename(oldpath, newpath string) error {
+	return j.change(&journalEntry{Op: "rename", Path: oldpath, Target: newpath})
+}
+
+// Remove removes a file or empty directory.
+func (j *JournalFS) Remove(filename string) error {
+	return j.change(&journalEntry{Op: "remove", Path: filename})
+}
+
+// MkdirAll creates a directory and its parents.
+func (j *JournalFS) MkdirAll(filename string, perm os.FileMode) error {
+	return j.change(&journalEntry{Op: "mkdir", Path: filename, Mode: perm})
+}
+
+// Symlink creates a link.
+func (j *JournalFS) Symlink(target, link string) error {
+	return j.change(&journalEntry{Op: "symlink", Path: link, Target: target})
+}
+
+// Chroot provides a JournalFS of a directory.
+func (j *JournalFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(j, path), nil
+}
+
+// Chmod changes the mode of a file.
+func (j *JournalFS) Chmod(name string, mode os.FileMode) error {
+	return j.change(&journalEntry{Op: "chmod", Path: name, Mode: mode})
+}
+
+// Lchown changes the owner of a file, not following links.
+func (j *JournalFS) Lchown(name string, uid, gid int) error {
+	return j.change(&journalEntry{Op: "lchown", Path: name, UID: uid, GID: gid})
+}
+
+// Chown changes the owner of a file.
+func (j *JournalFS) Chown(name string, uid, gid int) error {
+	return j.change(&journalEntry{Op: "chown", Path: name, UID: uid, GID: gid})
+}
+
+// Chtimes changes the times of a file.
+func (j *JournalFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return j.change(&journalEntry{Op: "chtimes", Path: name, Atime: &atime, Mtime: &mtime})
+}
+
+// Sync makes the writes recorded in the journal durable, which makes those
+// of every file so, not only of filename.
+func (j *JournalFS) Sync(filename string) error {
+	return j.journal.Sync()
+}
+
+// FSInfo provides the limits of the wrapped filesystem.
+func (j *JournalFS) FSInfo(info *nfs.FSInfo) error {
+	if ifs, ok := j.Filesystem.(nfs.FSInfoFilesystem); ok {
+		return ifs.FSInfo(info)
+	}
+	return nil
+}
+
+// Checkpoint empties the journal, once the files written since the last
+// checkpoint are synced by the wrapped filesystem, if it can be. It is for
+// when the backend is known to hold the changes, as after its own flush.
+func (j *JournalFS) Checkpoint() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if sfs, ok := j.Filesystem.(nfs.SyncFilesystem); ok {
+		for name := range j.touched {
+			if err := sfs.Sync(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	if err := j.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	j.touched = make(map[string]bool)
+	return j.journal.Sync()
+}
+
+// Close closes the journal.
+func (j *JournalFS) Close() error {
+	return j.journal.Close()
+}
+
+// journalFile records the writes made to a file of a JournalFS.
+type journalFile struct {
+	billy.File
+	fs     *JournalFS
+	name   string
+	append bool
+}
+
+func (f *journalFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	var offset int64
+	if f.append {
+		info, err := f.fs.Filesystem.Stat(f.name)
+		if err != nil {
+			return 0, err
+		}
+		offset = info.Size()
+	} else {
+		var err error
+		if offset, err = f.File.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.fs.record(&journalEntry{Op: "write", Path: f.name, Offset: offset, Data: p}, false); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+// Sync makes the writes recorded in the journal durable, rather than the
+// writes to the file alone.
+func (f *journalFile) Sync() error {
+	return f.fs.Sync(f.name)
+}
+
+func (f *journalFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.record(&journalEntry{Op: "truncate", Path: f.name, Size: size}, true); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,68 @@
+package helpers_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestJournal(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "journal")
+	jfs, err := helpers.NewJournalFS(memfs.New(), journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jfs.MkdirAll("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jfs.Create("/d/f"); err != nil {
+		t.Fatal(err)
+	}
+	srv := nfstest.ServeFS(t, jfs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	f, err := target.OpenFile("/d/f", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("journaled")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := jfs.Rename("/d/f", "/d/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := jfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a backend which lost every change gets them back from the journal.
+	restored := memfs.New()
+	jfs, err = helpers.NewJournalFS(restored, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jfs.Close()
+	if b, err := billyutil.ReadFile(restored, "/d/g"); err != nil || string(b) != "journaled" {
+		t.Fatalf("expected the journal to restore /d/g, got %q: %v", b, err)
+	}
+	if _, err := restored.Stat("/d/f"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the rename to be replayed, got %v", err)
+	}
+
+	if err := jfs.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(journal); err != nil || info.Size() != 0 {
+		t.Fatalf("expected the checkpoint to empty the journal: %v", err)
+	}
+}
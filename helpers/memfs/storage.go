@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -73,9 +74,17 @@ func (s *storage) createParent(path string, mode os.FileMode, f *file) error {
 	}
 
 	s.children[base][f.Name()] = f
+	s.touch(base)
 	return nil
 }
 
+// touch updates the mtime of the directory at path, as its entries changed.
+func (s *storage) touch(path string) {
+	if dir, ok := s.files[path]; ok {
+		dir.mtime = time.Now()
+	}
+}
+
 func (s *storage) Children(path string) []*file {
 	path = clean(path)
 
@@ -117,7 +126,7 @@ func (s *storage) Rename(from, to string) error {
 	move := [][2]string{{from, to}}
 
 	for pathFrom := range s.files {
-		if pathFrom == from || !strings.HasPrefix(pathFrom, from) {
+		if pathFrom == from || !strings.HasPrefix(pathFrom, from+string(filepath.Separator)) {
 			continue
 		}
 
@@ -148,6 +157,7 @@ func (s *storage) move(from, to string) error {
 		delete(s.children, from)
 		delete(s.files, from)
 		delete(s.children[filepath.Dir(from)], filepath.Base(from))
+		s.touch(filepath.Dir(from))
 	}()
 
 	return s.createParent(to, 0644, s.files[to])
@@ -162,7 +172,7 @@ func (s *storage) Remove(path string) error {
 	}
 
 	if f.mode.IsDir() && len(s.children[path]) != 0 {
-		return fmt.Errorf("dir: %s contains files", path)
+		return &os.PathError{Op: "remove", Path: path, Err: syscall.ENOTEMPTY}
 	}
 
 	base, file := filepath.Split(path)
@@ -170,6 +180,7 @@ func (s *storage) Remove(path string) error {
 
 	delete(s.children[base], file)
 	delete(s.files, path)
+	s.touch(base)
 	return nil
 }
 
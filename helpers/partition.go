@@ -0,0 +1,583 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/willscott/go-nfs"
+)
+
+// HashRing places keys on members by consistent hashing: each member holds
+// points on a ring, and owns the keys hashing up to its points, so that
+// adding or removing a member only moves the keys it gains or loses.
+type HashRing struct {
+	points  []uint64
+	members []string // the member of each point.
+}
+
+// NewHashRing places replicas points of each member on a ring; more points
+// spread the keys more evenly.
+func NewHashRing(members []string, replicas int) *HashRing {
+	if replicas < 1 {
+		replicas = 1
+	}
+	type point struct {
+		hash   uint64
+		member string
+	}
+	points := make([]point, 0, len(members)*replicas)
+	for _, m := range members {
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{ringHash(m + "#" + strconv.Itoa(i)), m})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].member < points[j].member
+	})
+	r := &HashRing{points: make([]uint64, len(points)), members: make([]string, len(points))}
+	for i, p := range points {
+		r.points[i], r.members[i] = p.hash, p.member
+	}
+	return r
+}
+
+// ringHash places a key on the ring. FNV leaves the high bits of similar
+// keys alike, which would place files of one directory together.
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Lookup provides the member owning key, or "" when the ring is empty.
+func (r *HashRing) Lookup(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[i]
+}
+
+// DefaultPartitionReplicas is the number of points of each backend on the
+// ring of a PartitionedFS when it is given none.
+const DefaultPartitionReplicas = 64
+
+// NewPartitionedFS presents the named backends as one filesystem, spreading
+// its files across them by consistent hashing of their paths. Directories
+// are created in every backend.
+func NewPartitionedFS(backends map[string]billy.Filesystem, replicas int) (*PartitionedFS, error) {
+	if replicas <= 0 {
+		replicas = DefaultPartitionReplicas
+	}
+	p := &PartitionedFS{replicas: replicas}
+	if err := p.SetBackends(backends); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PartitionedFS is one namespace over several backend filesystems, for
+// exports larger than a single backend. A file is kept by the backend its
+// path hashes to, and every backend holds the directory tree.
+//
+// Files are looked for in every backend when they are not where their path
+// hashes to, as after renaming them or changing the backends with
+// SetBackends, so that the handles given to clients keep resolving to them.
+// Rebalance then moves them to where they hash to.
+//
+// Objects are given fileids derived from their paths, since the inode
+// numbers of the backends overlap. Links are followed within the backend
+// holding them.
+type PartitionedFS struct {
+	replicas int
+	mu       sync.RWMutex
+	view     *partitionView
+}
+
+// partitionView is the placement of a PartitionedFS, replaced as a whole by
+// SetBackends.
+type partitionView struct {
+	names    []string
+	backends map[string]billy.Filesystem
+	ring     *HashRing
+}
+
+// SetBackends changes the backends of the filesystem. Files stay on the
+// backends they are in until Rebalance moves them; the backends removed
+// should only be those already emptied.
+func (p *PartitionedFS) SetBackends(backends map[string]billy.Filesystem) error {
+	if len(backends) == 0 {
+		return errors.New("a partitioned filesystem needs a backend")
+	}
+	v := &partitionView{backends: make(map[string]billy.Filesystem, len(backends))}
+	for name, b := range backends {
+		v.names = append(v.names, name)
+		v.backends[name] = b
+	}
+	sort.Strings(v.names)
+	v.ring = NewHashRing(v.names, p.replicas)
+	p.mu.Lock()
+	p.view = v
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *PartitionedFS) current() *partitionView {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.view
+}
+
+// Backend provides the name of the backend the file at name belongs on.
+func (p *PartitionedFS) Backend(name string) string {
+	return p.current().ring.Lookup(cleanPartitionPath(name))
+}
+
+func cleanPartitionPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// order lists the backends to look for name in, the one it belongs on first.
+func (v *partitionView) order(name string) []string {
+	home := v.ring.Lookup(name)
+	order := make([]string, 0, len(v.names))
+	order = append(order, home)
+	for _, n := range v.names {
+		if n != home {
+			order = append(order, n)
+		}
+	}
+	return order
+}
+
+func (v *partitionView) home(name string) billy.Filesystem {
+	return v.backends[v.ring.Lookup(name)]
+}
+
+// locate finds the backend holding the object at name, without following a
+// link there.
+func (v *partitionView) locate(op, name string) (string, os.FileInfo, error) {
+	for _, n := range v.order(name) {
+		info, err := v.backends[n].Lstat(name)
+		if err == nil {
+			return n, info, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", nil, err
+		}
+	}
+	return "", nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// ensureDir creates the directory dir of the namespace in b, for a backend
+// added after it was made.
+func (v *partitionView) ensureDir(b billy.Filesystem, dir string) error {
+	if _, err := b.Stat(dir); err == nil {
+		return nil
+	}
+	_, info, err := v.locate("mkdir", dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return b.MkdirAll(dir, info.Mode().Perm())
+}
+
+// Create creates a file on the backend it belongs on.
+func (p *PartitionedFS) Create(filename string) (billy.File, error) {
+	return p.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens a file for reading.
+func (p *PartitionedFS) Open(filename string) (billy.File, error) {
+	return p.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file on the backend holding it, or creates it on the one
+// it belongs on.
+func (p *PartitionedFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	name := cleanPartitionPath(filename)
+	v := p.current()
+	n, _, err := v.locate("open", name)
+	if err == nil {
+		return v.backends[n].OpenFile(name, flag, perm)
+	}
+	if !errors.Is(err, os.ErrNotExist) || flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+	home := v.home(name)
+	if err := v.ensureDir(home, path.Dir(name)); err != nil {
+		return nil, err
+	}
+	return home.OpenFile(name, flag, perm)
+}
+
+// Stat provides the attributes of a file.
+func (p *PartitionedFS) Stat(filename string) (os.FileInfo, error) {
+	name := cleanPartitionPath(filename)
+	v := p.current()
+	n, _, err := v.locate("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := v.backends[n].Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return partitionInfo(info, name), nil
+}
+
+// Lstat provides the attributes of a file, not following links.
+func (p *PartitionedFS) Lstat(filename string) (os.FileInfo, error) {
+	name := cleanPartitionPath(filename)
+	_, info, err := p.current().locate("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return partitionInfo(info, name), nil
+}
+
+// ReadDir lists a directory, merging its entries in every backend.
+func (p *PartitionedFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	name := cleanPartitionPath(dirname)
+	v := p.current()
+	found := false
+	seen := make(map[string]bool)
+	var entries []os.FileInfo
+	for _, n := range v.order(name) {
+		list, err := v.backends[n].ReadDir(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, e := range list {
+			if seen[e.Name()] {
+				continue
+			}
+			seen[e.Name()] = true
+			entries = append(entries, partitionInfo(e, path.Join(name, e.Name())))
+		}
+	}
+	if !found {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// MkdirAll creates a directory in every backend.
+func (p *PartitionedFS) MkdirAll(filename string, perm os.FileMode) error {
+	name := cleanPartitionPath(filename)
+	v := p.current()
+	for _, n := range v.names {
+		if err := v.backends[n].MkdirAll(name, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename moves a file within the backend holding it, where it stays until a
+// Rebalance. A directory is renamed in every backend.
+func (p *PartitionedFS) Rename(oldpath, newpath string) error {
+	from, to := cleanPartitionPath(oldpath), cleanPartitionPath(newpath)
+	v := p.current()
+	n, info, err := v.locate("rename", from)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		for _, b := range v.names {
+			if _, err := v.backends[b].Lstat(from); err != nil {
+				continue
+			}
+			if err := v.ensureDir(v.backends[b], path.Dir(to)); err != nil {
+				return err
+			}
+			if err := v.backends[b].Rename(from, to); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// the file replaces whatever file is at newpath, in whichever backend.
+	for _, b := range v.names {
+		if b == n {
+			continue
+		}
+		if existing, err := v.backends[b].Lstat(to); err == nil && !existing.IsDir() {
+			if err := v.backends[b].Remove(to); err != nil {
+				return err
+			}
+		}
+	}
+	if err := v.ensureDir(v.backends[n], path.Dir(to)); err != nil {
+		return err
+	}
+	return v.backends[n].Rename(from, to)
+}
+
+// Remove removes a file, or an empty directory from every backend.
+func (p *PartitionedFS) Remove(filename string) error {
+	name := cleanPartitionPath(filename)
+	v := p.current()
+	n, info, err := v.locate("remove", name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return v.backends[n].Remove(name)
+	}
+	if entries, err := p.ReadDir(name); err != nil {
+		return err
+	} else if len(entries) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	for _, b := range v.names {
+		if err := v.backends[b].Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Join joins the elements of a path.
+func (p *PartitionedFS) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+// TempFile creates a temporary file on the backend dir belongs on.
+func (p *PartitionedFS) TempFile(dir, prefix string) (billy.File, error) {
+	name := cleanPartitionPath(dir)
+	v := p.current()
+	home := v.home(name)
+	if err := v.ensureDir(home, name); err != nil {
+		return nil, err
+	}
+	return home.TempFile(name, prefix)
+}
+
+// Symlink creates a link on the backend it belongs on.
+func (p *PartitionedFS) Symlink(target, link string) error {
+	name := cleanPartitionPath(link)
+	v := p.current()
+	if _, _, err := v.locate("symlink", name); err == nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: os.ErrExist}
+	}
+	home := v.home(name)
+	if err := v.ensureDir(home, path.Dir(name)); err != nil {
+		return err
+	}
+	return home.Symlink(target, name)
+}
+
+// Readlink reads the target of a link.
+func (p *PartitionedFS) Readlink(link string) (string, error) {
+	name := cleanPartitionPath(link)
+	v := p.current()
+	n, _, err := v.locate("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return v.backends[n].Readlink(name)
+}
+
+// Chroot provides a PartitionedFS of a directory.
+func (p *PartitionedFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(p, path), nil
+}
+
+// Root is the root of the namespace.
+func (p *PartitionedFS) Root() string {
+	return "/"
+}
+
+// Capabilities are those every backend has.
+func (p *PartitionedFS) Capabilities() billy.Capability {
+	v := p.current()
+	caps := billy.AllCapabilities
+	for _, n := range v.names {
+		caps &= billy.Capabilities(v.backends[n])
+	}
+	return caps
+}
+
+// Chmod changes the mode of a file, or of a directory in every backend.
+func (p *PartitionedFS) Chmod(name string, mode os.FileMode) error {
+	return p.change("chmod", name, func(c billy.Change, name string) error { return c.Chmod(name, mode) })
+}
+
+// Lchown changes the owner of a file, not following links.
+func (p *PartitionedFS) Lchown(name string, uid, gid int) error {
+	return p.change("lchown", name, func(c billy.Change, name string) error { return c.Lchown(name, uid, gid) })
+}
+
+// Chown changes the owner of a file.
+func (p *PartitionedFS) Chown(name string, uid, gid int) error {
+	return p.change("chown", name, func(c billy.Change, name string) error { return c.Chown(name, uid, gid) })
+}
+
+// Chtimes changes the times of a file.
+func (p *PartitionedFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return p.change("chtimes", name, func(c billy.Change, name string) error { return c.Chtimes(name, atime, mtime) })
+}
+
+// change applies fn to the backend holding a file, or to every backend
+// holding a directory.
+func (p *PartitionedFS) change(op, filename string, fn func(billy.Change, string) error) error {
+	name := cleanPartitionPath(filename)
+	v := p.current()
+	n, info, err := v.locate(op, name)
+	if err != nil {
+		return err
+	}
+	targets := []string{n}
+	if info.IsDir() {
+		targets = v.names
+	}
+	for _, b := range targets {
+		c, ok := v.backends[b].(billy.Change)
+		if !ok {
+			return billy.ErrNotSupported
+		}
+		if err := fn(c, name); err != nil && !(info.IsDir() && errors.Is(err, os.ErrNotExist)) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync flushes a file on the backend holding it, when it can be.
+func (p *PartitionedFS) Sync(filename string) error {
+	name := cleanPartitionPath(filename)
+	v := p.current()
+	n, _, err := v.locate("sync", name)
+	if err != nil {
+		return err
+	}
+	if sfs, ok := v.backends[n].(nfs.SyncFilesystem); ok {
+		return sfs.Sync(name)
+	}
+	return nil
+}
+
+// Rebalance moves the files not on the backend they belong on to it, and
+// creates the directories missing from backends added since they were made.
+// A file is copied before it is removed from where it was, so it can always
+// be found, but writes made to it while it is copied may be lost: Rebalance
+// is meant for when the filesystem is quiet. It provides the number of files
+// moved.
+func (p *PartitionedFS) Rebalance() (int, error) {
+	return p.rebalance(p.current(), "/")
+}
+
+func (p *PartitionedFS) rebalance(v *partitionView, dir string) (int, error) {
+	entries, err := p.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		if e.IsDir() {
+			for _, b := range v.names {
+				if err := v.ensureDir(v.backends[b], name); err != nil {
+					return moved, err
+				}
+			}
+			n, err := p.rebalance(v, name)
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+			continue
+		}
+		from, info, err := v.locate("rebalance", name)
+		if err != nil {
+			return moved, err
+		}
+		to := v.ring.Lookup(name)
+		if from == to {
+			continue
+		}
+		if err := moveBetween(v.backends[from], v.backends[to], name, info); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// moveBetween moves the file or link at name from one backend to another.
+func moveBetween(from, to billy.Filesystem, name string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := from.Readlink(name)
+		if err != nil {
+			return err
+		}
+		if err := to.Symlink(target, name); err != nil {
+			return err
+		}
+		return from.Remove(name)
+	}
+	src, err := from.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := to.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		_ = to.Remove(name)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = to.Remove(name)
+		return err
+	}
+	if c, ok := to.(billy.Change); ok {
+		_ = c.Chtimes(name, info.ModTime(), info.ModTime())
+	}
+	return from.Remove(name)
+}
+
+// partitionFileInfo is an object of a PartitionedFS, with a fileid derived
+// from its path.
+type partitionFileInfo struct {
+	os.FileInfo
+	fileid uint64
+}
+
+func (i *partitionFileInfo) Fileid() uint64 { return i.fileid }
+
+func partitionInfo(info os.FileInfo, name string) os.FileInfo {
+	h := fnv.New64()
+	_, _ = h.Write([]byte(name))
+	return &partitionFileInfo{FileInfo: info, fileid: h.Sum64()}
+}
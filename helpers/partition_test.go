@@ -0,0 +1,95 @@
+package helpers_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestPartitionedFS(t *testing.T) {
+	backends := map[string]billy.Filesystem{"a": memfs.New(), "b": memfs.New(), "c": memfs.New()}
+	pfs, err := helpers.NewPartitionedFS(backends, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pfs.MkdirAll("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := billyutil.WriteFile(pfs, fmt.Sprintf("/d/f%d", i), []byte{byte(i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := 0
+	for _, b := range backends {
+		if entries, _ := b.ReadDir("/d"); len(entries) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatalf("expected the files to be spread across backends, found them in %d", used)
+	}
+
+	srv := nfstest.ServeFS(t, pfs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	entries, err := nfstest.ReadDir(target.Target, "/d")
+	if err != nil || len(entries) != 30 {
+		t.Fatalf("expected one listing of every file, got %d: %v", len(entries), err)
+	}
+	_, dir, err := target.Lookup("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handles [][]byte
+	for i := 0; i < 30; i++ {
+		fh, _, err := nfstest.Lookup(target.Target, dir, fmt.Sprintf("f%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, fh)
+	}
+
+	// a new backend takes files over, which are found where they were until
+	// rebalanced, and then where they now belong.
+	backends["e"] = memfs.New()
+	if err := pfs.SetBackends(backends); err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		for i, fh := range handles {
+			if _, err := target.GetAttr(fh); err != nil {
+				t.Fatalf("expected the handle of f%d to resolve: %v", i, err)
+			}
+			b, err := billyutil.ReadFile(pfs, fmt.Sprintf("/d/f%d", i))
+			if err != nil || !bytes.Equal(b, []byte{byte(i)}) {
+				t.Fatalf("unexpected contents %v of f%d: %v", b, i, err)
+			}
+		}
+	}
+	check()
+	moved, err := pfs.Rebalance()
+	if err != nil || moved == 0 {
+		t.Fatalf("expected files to move to the new backend, moved %d: %v", moved, err)
+	}
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("/d/f%d", i)
+		if _, err := backends[pfs.Backend(name)].Stat(name); err != nil {
+			t.Fatalf("expected %s on %s after rebalancing: %v", name, pfs.Backend(name), err)
+		}
+	}
+	check()
+
+	if err := pfs.Remove("/d"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatalf("expected a non-empty directory to stay, got %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+package helpers
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs"
+)
+
+// NewQuotaFS wraps fs to hold no more than limit bytes of file data, as the
+// volumes carved out of a server for its tenants must. The data fs holds is
+// counted once, by walking it, and then kept up to date as it is written
+// through the wrapper.
+func NewQuotaFS(fs billy.Filesystem, limit int64) (*QuotaFS, error) {
+	q := &QuotaFS{Filesystem: fs, limit: limit, sizes: make(map[string]int64)}
+	err := util.Walk(fs, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			q.used += info.Size()
+			q.sizes[quotaKey(name)] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// QuotaFS refuses writes, truncations and creations that would take the data
+// of the wrapped filesystem over its limit with nfs.ErrQuotaExceeded, which
+// clients are given as NFS3ERR_DQUOT. Files are counted by their sizes, so
+// sparse files count in full and hard links more than once. Changes made
+// other than through the wrapper aren't counted until it is made anew.
+type QuotaFS struct {
+	billy.Filesystem
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	// sizes are the sizes counted for files, shared by the handles of each,
+	// so that handles writing concurrently don't count the same growth.
+	sizes map[string]int64
+}
+
+// quotaKey provides the key of the file at name in sizes.
+func quotaKey(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// Usage provides the bytes counted against the quota, and the limit.
+func (q *QuotaFS) Usage() (used, limit int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used, q.limit
+}
+
+// SetLimit changes the limit of the quota. Data already over a lowered limit
+// is kept, but can't grow.
+func (q *QuotaFS) SetLimit(limit int64) {
+	q.mu.Lock()
+	q.limit = limit
+	q.mu.Unlock()
+}
+
+// LimitFSStat bounds the sizes of s, as given by the wrapped filesystem, to
+// those of the quota, so that clients see the size of their volume rather
+// than that of the filesystem it is carved from.
+func (q *QuotaFS) LimitFSStat(s *nfs.FSStat) {
+	used, limit := q.Usage()
+	free := uint64(0)
+	if used < limit {
+		free = uint64(limit - used)
+	}
+	if s.TotalSize == 0 || s.TotalSize > uint64(limit) {
+		s.TotalSize = uint64(limit)
+	}
+	if s.FreeSize == 0 || s.FreeSize > free {
+		s.FreeSize = free
+	}
+	if s.AvailableSize == 0 || s.AvailableSize > free {
+		s.AvailableSize = free
+	}
+}
+
+// sizeOf provides the size counted for the file at name, if there is one,
+// with q.mu held. Files not counted yet are counted at their size.
+func (q *QuotaFS) sizeOf(name string) int64 {
+	if size, ok := q.sizes[quotaKey(name)]; ok {
+		return size
+	}
+	info, err := q.Filesystem.Lstat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	q.sizes[quotaKey(name)] = info.Size()
+	return info.Size()
+}
+
+// grow counts the file at name as being at least end bytes long, failing
+// when its growth would exceed the limit. It provides the size counted
+// before.
+func (q *QuotaFS) grow(name string, end int64) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	size := q.sizeOf(name)
+	if end <= size {
+		return size, nil
+	}
+	if q.used+end-size > q.limit {
+		return size, nfs.ErrQuotaExceeded
+	}
+	q.used += end - size
+	q.sizes[quotaKey(name)] = end
+	return size, nil
+}
+
+// unreserve releases the bytes grow counted for a write ending at end which
+// only reached written, unless another has grown the file since.
+func (q *QuotaFS) unreserve(name string, before, written, end int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.sizes[quotaKey(name)] != end {
+		return
+	}
+	if written < before {
+		written = before
+	}
+	q.setSize(name, end, written)
+}
+
+// resize counts the file at name as being size bytes long, failing when its
+// growth would exceed the limit.
+func (q *QuotaFS) resize(name string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	before := q.sizeOf(name)
+	if size > before && q.used+size-before > q.limit {
+		return nfs.ErrQuotaExceeded
+	}
+	q.setSize(name, before, size)
+	return nil
+}
+
+// setSize counts the file at name as size bytes long rather than before, with
+// q.mu held.
+func (q *QuotaFS) setSize(name string, before, size int64) {
+	q.used += size - before
+	if q.used < 0 {
+		q.used = 0
+	}
+	q.sizes[quotaKey(name)] = size
+}
+
+// forget releases the data of the file at name, and of those below it, with
+// q.mu held.
+func (q *QuotaFS) forget(name string) {
+	key := quotaKey(name)
+	for k, size := range q.sizes {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			q.used -= size
+			delete(q.sizes, k)
+		}
+	}
+	if q.used < 0 {
+		q.used = 0
+	}
+}
+
+// Create creates a file, truncating it if it exists.
+func (q *QuotaFS) Create(filename string) (billy.File, error) {
+	return q.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens a file for reading.
+func (q *QuotaFS) Open(filename string) (billy.File, error) {
+	return q.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file, releasing the data of one it truncates.
+func (q *QuotaFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := q.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, nil
+	}
+	q.mu.Lock()
+	size := q.sizeOf(filename)
+	if flag&os.O_TRUNC != 0 {
+		q.setSize(filename, size, 0)
+		size = 0
+	}
+	q.mu.Unlock()
+	qf := &quotaFile{File: f, q: q, name: filename}
+	if flag&os.O_APPEND != 0 {
+		qf.pos = size
+	}
+	return qf, nil
+}
+
+// TempFile creates a file with a unique name in dir.
+func (q *QuotaFS) TempFile(dir, prefix string) (billy.File, error) {
+	f, err := q.Filesystem.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaFile{File: f, q: q, name: f.Name()}, nil
+}
+
+// Remove removes a file or empty directory, releasing its data.
+func (q *QuotaFS) Remove(filename string) error {
+	q.mu.Lock()
+	_ = q.sizeOf(filename)
+	q.mu.Unlock()
+	if err := q.Filesystem.Remove(filename); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.forget(filename)
+	q.mu.Unlock()
+	return nil
+}
+
+// Rename moves a file or directory, releasing the data of a file it replaces.
+func (q *QuotaFS) Rename(oldpath, newpath string) error {
+	q.mu.Lock()
+	_ = q.sizeOf(oldpath)
+	_ = q.sizeOf(newpath)
+	q.mu.Unlock()
+	if err := q.Filesystem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	oldKey, newKey := quotaKey(oldpath), quotaKey(newpath)
+	if oldKey == newKey {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.forget(newpath)
+	// the counted sizes move with the files.
+	for k, size := range q.sizes {
+		if k == oldKey || strings.HasPrefix(k, oldKey+"/") {
+			delete(q.sizes, k)
+			q.sizes[newKey+strings.TrimPrefix(k, oldKey)] = size
+		}
+	}
+	return nil
+}
+
+// Chroot provides a QuotaFS of a directory, sharing the quota.
+func (q *QuotaFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(q, path), nil
+}
+
+// Chmod changes the mode of a file.
+func (q *QuotaFS) Chmod(name string, mode os.FileMode) error {
+	ch, ok := q.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return ch.Chmod(name, mode)
+}
+
+// Lchown changes the owner of a file, not following links.
+func (q *QuotaFS) Lchown(name string, uid, gid int) error {
+	ch, ok := q.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return ch.Lchown(name, uid, gid)
+}
+
+// Chown changes the owner of a file.
+func (q *QuotaFS) Chown(name string, uid, gid int) error {
+	ch, ok := q.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return ch.Chown(name, uid, gid)
+}
+
+// Chtimes changes the times of a file.
+func (q *QuotaFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	ch, ok := q.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return ch.Chtimes(name, atime, mtime)
+}
+
+// Sync flushes the contents of a file, when the wrapped filesystem can.
+func (q *QuotaFS) Sync(filename string) error {
+	if sfs, ok := q.Filesystem.(nfs.SyncFilesystem); ok {
+		return sfs.Sync(filename)
+	}
+	return nil
+}
+
+// FSInfo provides the limits of the wrapped filesystem.
+func (q *QuotaFS) FSInfo(info *nfs.FSInfo) error {
+	if ifs, ok := q.Filesystem.(nfs.FSInfoFilesystem); ok {
+		return ifs.FSInfo(info)
+	}
+	return nil
+}
+
+// quotaFile is a file of a QuotaFS open for writing, counting the data it
+// grows by against the size the QuotaFS counts for it.
+type quotaFile struct {
+	billy.File
+	q    *QuotaFS
+	name string
+	mu   sync.Mutex
+	pos  int64
+}
+
+func (f *quotaFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+	}
+	return pos, err
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.pos + int64(len(p))
+	before, err := f.q.grow(f.name, end)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.File.Write(p)
+	f.pos += int64(n)
+	if f.pos < end {
+		f.q.unreserve(f.name, before, f.pos, end)
+	}
+	return n, err
+}
+
+func (f *quotaFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.q.mu.Lock()
+	before := f.q.sizeOf(f.name)
+	f.q.mu.Unlock()
+	if err := f.q.resize(f.name, size); err != nil {
+		return err
+	}
+	if err := f.File.Truncate(size); err != nil {
+		_ = f.q.resize(f.name, before)
+		return err
+	}
+	return nil
+}
+
+// Sync flushes the file, or has the filesystem flush it.
+func (f *quotaFile) Sync() error {
+	if sf, ok := f.File.(interface{ Sync() error }); ok {
+		return sf.Sync()
+	}
+	return f.q.Sync(f.Name())
+}
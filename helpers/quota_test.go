@@ -0,0 +1,91 @@
+package helpers_test
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestQuotaFS(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/old", []byte("12345"), 0644)
+	quota, err := helpers.NewQuotaFS(mem, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := nfstest.ServeFS(t, quota)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	f, err := target.OpenFile("/new", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("expected a write within the quota to succeed: %v", err)
+	}
+	if _, err := f.Write([]byte("0123456789")); !nfstest.IsStatus(err, nfs.NFSStatusDQuot) {
+		t.Fatalf("expected a write beyond the quota to fail, got %v", err)
+	}
+	_ = f.Close()
+	if used, _ := quota.Usage(); used != 15 {
+		t.Fatalf("expected 15 bytes to be used, got %d", used)
+	}
+	if err := target.Remove("/old"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := quota.Usage(); used != 10 {
+		t.Fatalf("expected a removal to release its data, got %d bytes used", used)
+	}
+}
+
+func TestQuotaFSHandles(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/file", nil, 0644)
+	quota, err := helpers.NewQuotaFS(mem, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as WRITEs of a file sent in parallel are, each through its own handle.
+	first, err := quota.OpenFile("/file", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := quota.OpenFile("file", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make([]byte, 4096)
+	if _, err := second.Seek(4096, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Write(block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Write(block); err != nil {
+		t.Fatal(err)
+	}
+	_ = first.Close()
+	_ = second.Close()
+	if used, _ := quota.Usage(); used != 8192 {
+		t.Fatalf("expected the 8192 bytes of the file to be used, got %d", used)
+	}
+
+	if err := quota.Rename("/file", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := quota.Remove("/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := quota.Usage(); used != 0 {
+		t.Fatalf("expected a removal to release the data counted, got %d bytes used", used)
+	}
+}
@@ -0,0 +1,200 @@
+package helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/willscott/go-nfs"
+
+	"github.com/google/uuid"
+)
+
+// HandleOp is the kind of a HandleChange.
+type HandleOp string
+
+const (
+	// HandleAdded is a handle given out for a path in a mount.
+	HandleAdded HandleOp = "add"
+	// HandleRemoved is a handle evicted or invalidated, which is stale from
+	// then on.
+	HandleRemoved HandleOp = "remove"
+	// VerifierChanged is a change of the write verifier of the server, only
+	// carried by a ReplicationStream.
+	VerifierChanged HandleOp = "verifier"
+)
+
+// HandleChange is a change to the handle table of a CachingHandler.
+type HandleChange struct {
+	Op HandleOp  `json:"op"`
+	ID uuid.UUID `json:"id"`
+	// Mount and Path are the path the filesystem of an added handle was
+	// mounted at, and the path of the handle within it.
+	Mount string   `json:"mount,omitempty"`
+	Path  []string `json:"path,omitempty"`
+	// Verifier is the write verifier of a VerifierChanged change.
+	Verifier []byte `json:"verifier,omitempty"`
+}
+
+// HandleReplicator is given the changes to the handle table of a
+// CachingHandler, as by SetReplicator.
+type HandleReplicator interface {
+	Replicate(change HandleChange)
+}
+
+// SetReplicator has the changes to the handle table passed to r, starting
+// with a HandleAdded for each handle already in it, least recently used
+// first. Only the handles of filesystems mounted through the cache are
+// passed on, as with Export. r is called with the cache locked, so that it
+// sees the changes in order, and must not block for long. A nil r stops
+// replication.
+func (c *CachingHandler) SetReplicator(r HandleReplicator) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replicator = r
+	for _, k := range c.activeHandles.Keys() {
+		e, ok := c.activeHandles.Peek(k)
+		if !ok {
+			continue
+		}
+		if dirpath, ok := c.mountOf(e.f); ok {
+			c.replicate(HandleChange{Op: HandleAdded, ID: k, Mount: dirpath, Path: e.p})
+		}
+	}
+}
+
+// replicate passes a change on to the replicator, with c.mu held.
+func (c *CachingHandler) replicate(change HandleChange) {
+	if c.replicator != nil {
+		c.replicator.Replicate(change)
+	}
+}
+
+// Apply makes a change replicated from another CachingHandler to this one.
+// The filesystem of an added handle is mounted through the wrapped handler
+// if it is not mounted yet; the handles of mounts it refuses are dropped.
+func (c *CachingHandler) Apply(change HandleChange) error {
+	switch change.Op {
+	case HandleAdded:
+		f := c.mountPath(change.Mount)
+		if f == nil {
+			return nil
+		}
+		p := change.Path
+		if p == nil {
+			p = []string{}
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !c.activeHandles.Contains(change.ID) {
+			c.addHandle(change.ID, f, p)
+		}
+		return nil
+	case HandleRemoved:
+		return c.InvalidateHandle(nil, change.ID[:])
+	default:
+		return fmt.Errorf("unsupported handle change %q", change.Op)
+	}
+}
+
+// ReplicationStream writes the changes to the handle table of a
+// CachingHandler, and the write verifier of its server, as a stream of JSON
+// values read by Standby.Follow on a standby server, so that the clients of
+// the server keep their handles when it fails over to the standby.
+type ReplicationStream struct {
+	c   *CachingHandler
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewReplicationStream starts replicating the handle table of c to w,
+// beginning with verifier and the handles already in the table.
+func NewReplicationStream(c *CachingHandler, w io.Writer, verifier [8]byte) *ReplicationStream {
+	s := &ReplicationStream{c: c, enc: json.NewEncoder(w)}
+	s.SetVerifier(verifier)
+	c.SetReplicator(s)
+	return s
+}
+
+// Replicate writes a change to the stream. Once a write fails, the stream
+// writes nothing more, and the standby needs a new stream to catch up.
+func (s *ReplicationStream) Replicate(change HandleChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	if err := s.enc.Encode(&change); err != nil {
+		nfs.Log.Warnf("handle replication stopped: %v", err)
+		s.err = err
+	}
+}
+
+// SetVerifier writes a change of the server's write verifier to the stream.
+func (s *ReplicationStream) SetVerifier(verifier [8]byte) {
+	s.Replicate(HandleChange{Op: VerifierChanged, Verifier: verifier[:]})
+}
+
+// Err provides the error that stopped the stream, if any.
+func (s *ReplicationStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops replicating the handle table. It doesn't close the writer.
+func (s *ReplicationStream) Close() error {
+	s.c.SetReplicator(nil)
+	return nil
+}
+
+// Standby applies the changes of a ReplicationStream to the CachingHandler of
+// a standby server.
+type Standby struct {
+	c        *CachingHandler
+	mu       sync.Mutex
+	verifier [8]byte
+}
+
+// NewStandby provides a Standby applying changes to c.
+func NewStandby(c *CachingHandler) *Standby {
+	return &Standby{c: c}
+}
+
+// Follow applies the changes read from r until it ends, as when the primary
+// server fails or the connection to it is lost.
+func (s *Standby) Follow(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var change HandleChange
+		if err := dec.Decode(&change); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if change.Op == VerifierChanged {
+			s.mu.Lock()
+			copy(s.verifier[:], change.Verifier)
+			s.mu.Unlock()
+			continue
+		}
+		if err := s.c.Apply(change); err != nil {
+			return err
+		}
+	}
+}
+
+// Verifier provides the last write verifier of the primary server. A standby
+// taking over should take it on with Server.SetWriteVerifier only if every
+// write the primary acknowledged reached storage the standby shares;
+// otherwise another verifier has clients resend the writes they have not
+// committed.
+func (s *Standby) Verifier() [8]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.verifier
+}
@@ -0,0 +1,69 @@
+package helpers_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestHandleReplication(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/d", 0755)
+	_ = billyutil.WriteFile(mem, "/d/f", []byte("x"), 0644)
+	_ = billyutil.WriteFile(mem, "/d/g", []byte("y"), 0644)
+
+	primary := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024).(*helpers.CachingHandler)
+	srv := nfstest.Serve(t, primary)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	_, dir, err := target.Lookup("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// handles given out before and after the stream starts are replicated,
+	// as is the invalidation of one of them.
+	var stream bytes.Buffer
+	verifier := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	rs := helpers.NewReplicationStream(primary, &stream, verifier)
+	defer rs.Close()
+	f, _, err := nfstest.Lookup(target.Target, dir, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _, err := nfstest.Lookup(target.Target, dir, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, _, err := primary.FromHandle(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary.InvalidatePath(fs, []string{"d", "g"})
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	standby := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024).(*helpers.CachingHandler)
+	follower := helpers.NewStandby(standby)
+	if err := follower.Follow(&stream); err != nil {
+		t.Fatal(err)
+	}
+	if follower.Verifier() != verifier {
+		t.Fatalf("unexpected verifier %v", follower.Verifier())
+	}
+	for fh, want := range map[string][]string{string(dir): {"d"}, string(f): {"d", "f"}} {
+		if _, path, err := standby.FromHandle([]byte(fh)); err != nil || !reflect.DeepEqual(path, want) {
+			t.Fatalf("unexpected path %v for %v: %v", path, want, err)
+		}
+	}
+	if _, _, err := standby.FromHandle(g); err == nil {
+		t.Fatal("expected the invalidated handle to be stale on the standby")
+	}
+}
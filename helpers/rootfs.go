@@ -0,0 +1,220 @@
+//go:build go1.25
+
+package helpers
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// NewRootFS exports the directory dir through an os.Root, so that every path
+// is resolved by the kernel beneath it. Unlike a chroot of osfs, which checks
+// path strings, a link or rename racing a call cannot lead it outside the
+// directory: links pointing out of it, or that are absolute, fail to resolve.
+// The directory stays open until the filesystem is closed, and is followed
+// if it is moved. Special files and hard links cannot be made in it.
+//
+// NewRootFS needs Go 1.25 or later.
+func NewRootFS(dir string) (*RootFS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &RootFS{root: root}, nil
+}
+
+// RootFS is a local directory confined by an os.Root.
+type RootFS struct {
+	root *os.Root
+	temp uint32
+}
+
+// rootPath provides the name of a path within the root.
+func rootPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if name == "" {
+		return "."
+	}
+	return filepath.FromSlash(name)
+}
+
+// Create creates a file, truncating it if it exists.
+func (r *RootFS) Create(filename string) (billy.File, error) {
+	return r.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens a file for reading.
+func (r *RootFS) Open(filename string) (billy.File, error) {
+	return r.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file.
+func (r *RootFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := r.root.OpenFile(rootPath(filename), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &rootFile{File: f, name: filename}, nil
+}
+
+// Stat provides the attributes of a file, following links.
+func (r *RootFS) Stat(filename string) (os.FileInfo, error) {
+	return r.root.Stat(rootPath(filename))
+}
+
+// Lstat provides the attributes of a file, not following links.
+func (r *RootFS) Lstat(filename string) (os.FileInfo, error) {
+	return r.root.Lstat(rootPath(filename))
+}
+
+// ReadDir lists a directory, sorted by name. Each entry is statted through
+// the root, rather than by the path of the directory.
+func (r *RootFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	dir := rootPath(dirname)
+	f, err := r.root.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		info, err := r.root.Lstat(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			// removed since it was listed.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, info)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// MkdirAll creates a directory and the directories it is in.
+func (r *RootFS) MkdirAll(filename string, perm os.FileMode) error {
+	return r.root.MkdirAll(rootPath(filename), perm)
+}
+
+// Rename moves a file or directory.
+func (r *RootFS) Rename(oldpath, newpath string) error {
+	return r.root.Rename(rootPath(oldpath), rootPath(newpath))
+}
+
+// Remove removes a file or empty directory.
+func (r *RootFS) Remove(filename string) error {
+	return r.root.Remove(rootPath(filename))
+}
+
+// Symlink creates a link at link to target. The link can only be followed
+// if target is relative and within the root.
+func (r *RootFS) Symlink(target, link string) error {
+	return r.root.Symlink(target, rootPath(link))
+}
+
+// Readlink provides the target of a link.
+func (r *RootFS) Readlink(link string) (string, error) {
+	return r.root.Readlink(rootPath(link))
+}
+
+// TempFile creates a new file in dir, named from prefix.
+func (r *RootFS) TempFile(dir, prefix string) (billy.File, error) {
+	for {
+		name := path.Join(dir, prefix+strconv.FormatInt(time.Now().UnixNano(), 36)+strconv.Itoa(int(atomic.AddUint32(&r.temp, 1))))
+		f, err := r.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, os.ErrExist) {
+			return f, err
+		}
+	}
+}
+
+// Join joins the elements of a path.
+func (r *RootFS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// Chroot provides a filesystem of a directory, confined by a root of its
+// own.
+func (r *RootFS) Chroot(dir string) (billy.Filesystem, error) {
+	root, err := r.root.OpenRoot(rootPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	return &RootFS{root: root}, nil
+}
+
+// Root provides the name the directory was opened with.
+func (r *RootFS) Root() string {
+	return r.root.Name()
+}
+
+// Capabilities reports the directory can be read, written and truncated.
+func (r *RootFS) Capabilities() billy.Capability {
+	return billy.DefaultCapabilities
+}
+
+// Chmod changes the permissions of a file.
+func (r *RootFS) Chmod(name string, mode os.FileMode) error {
+	return r.root.Chmod(rootPath(name), mode)
+}
+
+// Lchown changes the owner of a file, not following links.
+func (r *RootFS) Lchown(name string, uid, gid int) error {
+	return r.root.Lchown(rootPath(name), uid, gid)
+}
+
+// Chown changes the owner of a file.
+func (r *RootFS) Chown(name string, uid, gid int) error {
+	return r.root.Chown(rootPath(name), uid, gid)
+}
+
+// Chtimes changes the access and modification times of a file.
+func (r *RootFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return r.root.Chtimes(rootPath(name), atime, mtime)
+}
+
+// Sync flushes the contents of a file to stable storage.
+func (r *RootFS) Sync(name string) error {
+	f, err := r.root.OpenFile(rootPath(name), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Close closes the directory.
+func (r *RootFS) Close() error {
+	return r.root.Close()
+}
+
+// rootFile is a file opened through a root, named by its path within it.
+type rootFile struct {
+	*os.File
+	name string
+}
+
+func (f *rootFile) Name() string {
+	return f.name
+}
+
+func (f *rootFile) Lock() error {
+	return nil
+}
+
+func (f *rootFile) Unlock() error {
+	return nil
+}
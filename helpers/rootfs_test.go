@@ -0,0 +1,77 @@
+//go:build go1.25
+
+package helpers_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestRootFS(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside")
+	export := filepath.Join(dir, "export")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(export, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", filepath.Join(export, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub", filepath.Join(export, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	rfs, err := helpers.NewRootFS(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rfs.Close()
+	srv := nfstest.ServeFS(t, rfs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	wf, err := target.OpenFile("/sub/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wf.Write([]byte("confined")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(export, "sub", "file")); err != nil || string(b) != "confined" {
+		t.Fatalf("expected the file to be written in the export, got %q: %v", b, err)
+	}
+	if f, err := rfs.Open("/inside/file"); err != nil {
+		t.Fatalf("expected a link within the export to be followed: %v", err)
+	} else {
+		b, _ := io.ReadAll(f)
+		_ = f.Close()
+		if string(b) != "confined" {
+			t.Fatalf("unexpected contents through a link: %q", b)
+		}
+	}
+	if _, err := rfs.Open("/escape/secret"); err == nil {
+		t.Fatal("expected a link out of the export not to be followed")
+	}
+	if _, err := target.Open("/escape/secret"); err == nil {
+		t.Fatal("expected a client not to read through a link out of the export")
+	}
+	entries, err := nfstest.ReadDir(target.Target, "/")
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected the entries of the export, got %d: %v", len(entries), err)
+	}
+}
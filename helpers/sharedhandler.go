@@ -0,0 +1,230 @@
+package helpers
+
+import (
+	"context"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/willscott/go-nfs"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/google/uuid"
+)
+
+// StoredHandle is what a handle in a HandleStore refers to: the path the
+// filesystem was mounted at, and the path within it.
+type StoredHandle struct {
+	Mount string
+	Path  []string
+}
+
+// HandleStore keeps the handles given out by a SharedHandler. Servers behind
+// a load balancer which share a store, such as a database or key-value
+// service, resolve the handles given out by each other, so that clients are
+// served consistently by any of them.
+type HandleStore interface {
+	// Handle provides the handle of h, creating one when it has none. It must
+	// be atomic, so that servers racing to create the handle of a path agree
+	// on one.
+	Handle(h StoredHandle) ([]byte, error)
+	// Lookup provides what a handle refers to; ok is false for a handle the
+	// store doesn't know.
+	Lookup(id []byte) (h StoredHandle, ok bool, err error)
+	// Remove forgets a handle, which is stale from then on.
+	Remove(id []byte) error
+}
+
+// NewSharedHandler wraps a handler to keep its handles in store rather than
+// in memory. The filesystems handles are in are found by mounting the path
+// they were mounted at through h, with a nil net.Conn, so h must give the
+// same filesystem for a path on every server sharing the store. Handles are
+// only given out for filesystems mounted through the SharedHandler.
+func NewSharedHandler(h nfs.Handler, store HandleStore) nfs.Handler {
+	return &SharedHandler{Handler: h, Store: store}
+}
+
+// SharedHandler implements to/from handle via a HandleStore.
+type SharedHandler struct {
+	nfs.Handler
+	Store  HandleStore
+	mu     sync.Mutex
+	mounts []mount
+}
+
+// ExportOptions passes through the options of the wrapped handler, if it
+// applies any to its exports.
+func (s *SharedHandler) ExportOptions(ctx context.Context, conn net.Conn, f billy.Filesystem) *nfs.ExportOptions {
+	if eh, ok := s.Handler.(nfs.ExportHandler); ok {
+		return eh.ExportOptions(ctx, conn, f)
+	}
+	return nil
+}
+
+// MountOptions passes through the options of the wrapped handler for mounts,
+// if it gives them.
+func (s *SharedHandler) MountOptions(ctx context.Context, conn net.Conn, req nfs.MountRequest) *nfs.ExportOptions {
+	if mh, ok := s.Handler.(nfs.MountOptionsHandler); ok {
+		return mh.MountOptions(ctx, conn, req)
+	}
+	return nil
+}
+
+// Capabilities passes through the capabilities of the wrapped handler.
+func (s *SharedHandler) Capabilities(f billy.Filesystem) nfs.Capabilities {
+	return nfs.CapabilitiesOf(s.Handler, f)
+}
+
+// Mount passes the mount to the wrapped handler, and records the path the
+// filesystem was mounted at, for the handles within it.
+func (s *SharedHandler) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	status, f, flavors := s.Handler.Mount(ctx, conn, req)
+	if status == nfs.MountStatusOk {
+		s.recordMount(f, string(req.Dirpath))
+	}
+	return status, f, flavors
+}
+
+func (s *SharedHandler) recordMount(f billy.Filesystem, dirpath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.mounts {
+		if reflect.DeepEqual(m.f, f) {
+			return
+		}
+	}
+	s.mounts = append(s.mounts, mount{f, dirpath})
+}
+
+// ToHandle provides the handle of path in f from the store, which creates it
+// if need be.
+func (s *SharedHandler) ToHandle(f billy.Filesystem, path []string) []byte {
+	dirpath, ok := s.mountOf(f)
+	if !ok {
+		nfs.Log.Errorf("no handle for %s: its filesystem was not mounted through the shared handler", f.Join(path...))
+		return nil
+	}
+	id, err := s.Store.Handle(StoredHandle{Mount: dirpath, Path: append([]string{}, path...)})
+	if err != nil {
+		nfs.Log.Errorf("no handle for %s: %v", f.Join(path...), err)
+		return nil
+	}
+	return id
+}
+
+// FromHandle converts from an opaque handle to the file it represents,
+// mounting its filesystem if this server has not yet.
+func (s *SharedHandler) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
+	h, ok, err := s.Store.Lookup(fh)
+	if err != nil {
+		return nil, []string{}, &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusServerFault, WrappedErr: err}
+	}
+	if !ok {
+		return nil, []string{}, &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusStale}
+	}
+	f := s.mountPath(h.Mount)
+	if f == nil {
+		return nil, []string{}, &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusStale}
+	}
+	return f, append([]string{}, h.Path...), nil
+}
+
+// InvalidateHandle removes the handle from the store.
+func (s *SharedHandler) InvalidateHandle(f billy.Filesystem, fh []byte) error {
+	return s.Store.Remove(fh)
+}
+
+// HandleLimit is unbounded, as the handles are kept by the store.
+func (s *SharedHandler) HandleLimit() int {
+	return math.MaxInt32
+}
+
+func (s *SharedHandler) mountOf(f billy.Filesystem) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.mounts {
+		if reflect.DeepEqual(m.f, f) {
+			return m.dirpath, true
+		}
+	}
+	return "", false
+}
+
+// mountPath provides the filesystem mounted at dirpath, mounting it if it is
+// not mounted yet, or nil if the wrapped handler refuses the mount.
+func (s *SharedHandler) mountPath(dirpath string) billy.Filesystem {
+	s.mu.Lock()
+	for _, m := range s.mounts {
+		if m.dirpath == dirpath {
+			s.mu.Unlock()
+			return m.f
+		}
+	}
+	s.mu.Unlock()
+	status, f, _ := s.Handler.Mount(context.Background(), nil, nfs.MountRequest{Dirpath: []byte(dirpath)})
+	if status != nfs.MountStatusOk || f == nil {
+		nfs.Log.Warnf("handles of %s are stale: mount failed with status %d", dirpath, status)
+		return nil
+	}
+	s.recordMount(f, dirpath)
+	return f
+}
+
+// NewMemoryHandleStore provides a HandleStore in memory, for a single server
+// or for tests.
+func NewMemoryHandleStore() HandleStore {
+	return &memoryHandleStore{
+		handles: make(map[uuid.UUID]StoredHandle),
+		ids:     make(map[string]uuid.UUID),
+	}
+}
+
+type memoryHandleStore struct {
+	mu      sync.Mutex
+	handles map[uuid.UUID]StoredHandle
+	ids     map[string]uuid.UUID
+}
+
+func storedHandleKey(h StoredHandle) string {
+	return h.Mount + "\x00" + strings.Join(h.Path, "/")
+}
+
+func (m *memoryHandleStore) Handle(h StoredHandle) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := storedHandleKey(h)
+	id, ok := m.ids[key]
+	if !ok {
+		id = uuid.New()
+		m.ids[key] = id
+		m.handles[id] = h
+	}
+	return id[:], nil
+}
+
+func (m *memoryHandleStore) Lookup(fh []byte) (StoredHandle, bool, error) {
+	id, err := uuid.FromBytes(fh)
+	if err != nil {
+		return StoredHandle{}, false, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.handles[id]
+	return h, ok, nil
+}
+
+func (m *memoryHandleStore) Remove(fh []byte) error {
+	id, err := uuid.FromBytes(fh)
+	if err != nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.handles[id]; ok {
+		delete(m.ids, storedHandleKey(h))
+		delete(m.handles, id)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package helpers_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// sharedMounts is a MountStore shared by the servers of a test.
+type sharedMounts struct {
+	mu     sync.Mutex
+	mounts []nfs.MountInfo
+}
+
+func (s *sharedMounts) AddMount(m nfs.MountInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mounts = append(s.mounts, m)
+	return nil
+}
+
+func (s *sharedMounts) RemoveMount(client net.Addr, export string) error {
+	return s.RemoveMounts(client)
+}
+
+func (s *sharedMounts) RemoveMounts(client net.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mounts = nil
+	return nil
+}
+
+func (s *sharedMounts) Mounts() ([]nfs.MountInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]nfs.MountInfo(nil), s.mounts...), nil
+}
+
+func TestSharedState(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/d", 0755)
+	_ = billyutil.WriteFile(mem, "/d/f", []byte("x"), 0644)
+
+	store := helpers.NewMemoryHandleStore()
+	mounts := &sharedMounts{}
+	serve := func() (*nfstest.Server, *nfstest.Client) {
+		srv := nfstest.Start(t, &nfs.Server{
+			Handler:    helpers.NewSharedHandler(helpers.NewNullAuthHandler(mem), store),
+			MountStore: mounts,
+		})
+		target := srv.Mount(t, "/", rpc.AuthNull)
+		return srv, target
+	}
+	first, firstTarget := serve()
+	defer first.Close()
+	defer firstTarget.Close()
+	second, secondTarget := serve()
+	defer second.Close()
+	defer secondTarget.Close()
+
+	_, dir, err := firstTarget.Lookup("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a handle from the first server resolves on the second.
+	fh, _, err := nfstest.Lookup(secondTarget.Target, dir, "f")
+	if err != nil {
+		t.Fatalf("expected the handle of the first server to resolve: %v", err)
+	}
+	again, _, err := nfstest.Lookup(firstTarget.Target, dir, "f")
+	if err != nil || !bytes.Equal(fh, again) {
+		t.Fatalf("expected both servers to give f one handle: %v", err)
+	}
+	if got := second.Mounts(); len(got) != 2 {
+		t.Fatalf("expected the mounts of both servers, got %+v", got)
+	}
+}
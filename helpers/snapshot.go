@@ -0,0 +1,476 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/file"
+)
+
+// DefaultSnapshotDir is the name of the directory snapshots are reached
+// through, as on NetApp filers.
+const DefaultSnapshotDir = ".snapshot"
+
+// Snapshotter provides the snapshots of a filesystem.
+type Snapshotter interface {
+	// Snapshots lists the names of the snapshots.
+	Snapshots() ([]string, error)
+	// Snapshot provides a snapshot as a filesystem laid out as the live one.
+	Snapshot(name string) (billy.Filesystem, error)
+}
+
+// NewDirSnapshotter provides the snapshots kept as the directories of dir in
+// fs, each holding a copy of the whole tree, as ZFS does in .zfs/snapshot and
+// btrfs setups commonly do.
+func NewDirSnapshotter(fs billy.Filesystem, dir string) Snapshotter {
+	return &dirSnapshotter{fs: fs, dir: dir}
+}
+
+type dirSnapshotter struct {
+	fs  billy.Filesystem
+	dir string
+}
+
+func (d *dirSnapshotter) Snapshots() ([]string, error) {
+	entries, err := d.fs.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *dirSnapshotter) Snapshot(name string) (billy.Filesystem, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, os.ErrNotExist
+	}
+	p := d.fs.Join(d.dir, name)
+	if info, err := d.fs.Stat(p); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	return d.fs.Chroot(p)
+}
+
+// NewSnapshotFS wraps fs so that the snapshots of every directory can be
+// reached, read-only, through a directory of it named DefaultSnapshotDir:
+// dir/.snapshot/name is dir as it was in the snapshot name.
+func NewSnapshotFS(fs billy.Filesystem, snapshots Snapshotter) *SnapshotFS {
+	return &SnapshotFS{Filesystem: fs, Snapshots: snapshots, Dir: DefaultSnapshotDir}
+}
+
+// SnapshotFS presents the snapshots of a filesystem in a synthetic directory
+// of each of its directories. Calls modifying a snapshot fail with
+// billy.ErrReadOnly, which clients see as NFS3ERR_ROFS.
+//
+// Objects in snapshots are given fileids of their own, since a file and its
+// copy in a snapshot often share an inode number.
+type SnapshotFS struct {
+	billy.Filesystem
+	Snapshots Snapshotter
+	// Dir is the name of the snapshot directory.
+	Dir string
+	// Visible lists the snapshot directory in directory listings. It is
+	// otherwise only found by name, so that tools walking the tree don't
+	// descend into every snapshot.
+	Visible bool
+}
+
+// snapshotPath is a path of a SnapshotFS resolved to the filesystem holding
+// it.
+type snapshotPath struct {
+	// dir is the directory the snapshot directory is in, when the path is in
+	// one.
+	dir []string
+	// snapshot names the snapshot, and fs and path are the filesystem and
+	// path of the object, unless the path is the snapshot directory itself.
+	snapshot string
+	fs       billy.Filesystem
+	path     string
+}
+
+func (p *snapshotPath) inSnapshots() bool {
+	return p.dir != nil
+}
+
+func (p *snapshotPath) isSnapshotDir() bool {
+	return p.dir != nil && p.snapshot == ""
+}
+
+func splitPath(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == filepath.Separator })
+}
+
+func (s *SnapshotFS) resolve(name string) (*snapshotPath, error) {
+	elems := splitPath(name)
+	for i, e := range elems {
+		if e != s.Dir {
+			continue
+		}
+		p := &snapshotPath{dir: elems[:i:i]}
+		if i == len(elems)-1 {
+			return p, nil
+		}
+		p.snapshot = elems[i+1]
+		sfs, err := s.Snapshots.Snapshot(p.snapshot)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		p.fs = sfs
+		p.path = sfs.Join(append(p.dir, elems[i+2:]...)...)
+		return p, nil
+	}
+	return &snapshotPath{fs: s.Filesystem, path: name}, nil
+}
+
+func readOnly(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: billy.ErrReadOnly}
+}
+
+// writable resolves a path that is about to be modified.
+func (s *SnapshotFS) writable(op, name string) error {
+	p, err := s.resolve(name)
+	if err != nil {
+		return err
+	}
+	if p.isSnapshotDir() {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	}
+	if p.inSnapshots() {
+		return readOnly(op, name)
+	}
+	return nil
+}
+
+// Create creates a file outside of the snapshots.
+func (s *SnapshotFS) Create(filename string) (billy.File, error) {
+	if err := s.writable("create", filename); err != nil {
+		return nil, err
+	}
+	return s.Filesystem.Create(filename)
+}
+
+// Open opens a file for reading.
+func (s *SnapshotFS) Open(filename string) (billy.File, error) {
+	return s.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file, which can only be read in a snapshot.
+func (s *SnapshotFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	p, err := s.resolve(filename)
+	if err != nil {
+		return nil, err
+	}
+	if p.isSnapshotDir() {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrInvalid}
+	}
+	if p.inSnapshots() && flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, readOnly("open", filename)
+	}
+	return p.fs.OpenFile(p.path, flag, perm)
+}
+
+// Stat provides the attributes of a file.
+func (s *SnapshotFS) Stat(filename string) (os.FileInfo, error) {
+	return s.stat(filename, true)
+}
+
+// Lstat provides the attributes of a file, not following links.
+func (s *SnapshotFS) Lstat(filename string) (os.FileInfo, error) {
+	return s.stat(filename, false)
+}
+
+func (s *SnapshotFS) stat(filename string, follow bool) (os.FileInfo, error) {
+	p, err := s.resolve(filename)
+	if err != nil {
+		return nil, err
+	}
+	if p.isSnapshotDir() {
+		return s.snapshotDirInfo(p.dir)
+	}
+	var info os.FileInfo
+	if follow {
+		info, err = p.fs.Stat(p.path)
+	} else {
+		info, err = p.fs.Lstat(p.path)
+	}
+	if err != nil || !p.inSnapshots() {
+		return info, err
+	}
+	name := info.Name()
+	if len(splitPath(filename)) == len(p.dir)+2 {
+		// the root of the snapshot is named for it.
+		name = p.snapshot
+	}
+	return snapshotInfo(info, name, p.snapshot, p.path), nil
+}
+
+// snapshotDirInfo provides the attributes of the snapshot directory of dir,
+// which exists in each directory.
+func (s *SnapshotFS) snapshotDirInfo(dir []string) (os.FileInfo, error) {
+	info, err := s.Filesystem.Stat(s.Filesystem.Join(dir...))
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "stat", Path: s.Filesystem.Join(append(dir, s.Dir)...), Err: os.ErrNotExist}
+	}
+	return &snapshotDirInfo{name: s.Dir, modTime: info.ModTime(), dir: s.Filesystem.Join(dir...)}, nil
+}
+
+// ReadDir lists a directory. The snapshot directory lists the snapshots in
+// which the directory existed.
+func (s *SnapshotFS) ReadDir(path string) ([]os.FileInfo, error) {
+	p, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if p.isSnapshotDir() {
+		return s.readSnapshotDir(p.dir)
+	}
+	entries, err := p.fs.ReadDir(p.path)
+	if err != nil {
+		return nil, err
+	}
+	if p.inSnapshots() {
+		for i, e := range entries {
+			entries[i] = snapshotInfo(e, e.Name(), p.snapshot, p.fs.Join(p.path, e.Name()))
+		}
+		return entries, nil
+	}
+	if s.Visible {
+		if info, err := s.snapshotDirInfo(splitPath(path)); err == nil {
+			entries = append(entries, info)
+		}
+	}
+	return entries, nil
+}
+
+func (s *SnapshotFS) readSnapshotDir(dir []string) ([]os.FileInfo, error) {
+	if _, err := s.snapshotDirInfo(dir); err != nil {
+		return nil, err
+	}
+	names, err := s.Snapshots.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	entries := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		sfs, err := s.Snapshots.Snapshot(name)
+		if err != nil {
+			continue
+		}
+		p := sfs.Join(dir...)
+		info, err := sfs.Stat(p)
+		if err != nil || !info.IsDir() {
+			// the directory didn't exist when the snapshot was taken.
+			continue
+		}
+		entries = append(entries, snapshotInfo(info, name, name, p))
+	}
+	return entries, nil
+}
+
+// Rename moves a file outside of the snapshots.
+func (s *SnapshotFS) Rename(oldpath, newpath string) error {
+	if err := s.writable("rename", oldpath); err != nil {
+		return err
+	}
+	if err := s.writable("rename", newpath); err != nil {
+		return err
+	}
+	return s.Filesystem.Rename(oldpath, newpath)
+}
+
+// Remove removes a file outside of the snapshots.
+func (s *SnapshotFS) Remove(filename string) error {
+	p, err := s.resolve(filename)
+	if err != nil {
+		return err
+	}
+	if p.inSnapshots() {
+		return readOnly("remove", filename)
+	}
+	return s.Filesystem.Remove(filename)
+}
+
+// TempFile creates a temporary file outside of the snapshots.
+func (s *SnapshotFS) TempFile(dir, prefix string) (billy.File, error) {
+	if err := s.writable("tempfile", s.Join(dir, prefix)); err != nil {
+		return nil, err
+	}
+	return s.Filesystem.TempFile(dir, prefix)
+}
+
+// MkdirAll creates a directory outside of the snapshots.
+func (s *SnapshotFS) MkdirAll(filename string, perm os.FileMode) error {
+	if err := s.writable("mkdir", filename); err != nil {
+		return err
+	}
+	return s.Filesystem.MkdirAll(filename, perm)
+}
+
+// Symlink creates a link outside of the snapshots.
+func (s *SnapshotFS) Symlink(target, link string) error {
+	if err := s.writable("symlink", link); err != nil {
+		return err
+	}
+	return s.Filesystem.Symlink(target, link)
+}
+
+// Readlink reads the target of a link.
+func (s *SnapshotFS) Readlink(link string) (string, error) {
+	p, err := s.resolve(link)
+	if err != nil {
+		return "", err
+	}
+	if p.isSnapshotDir() {
+		return "", &os.PathError{Op: "readlink", Path: link, Err: os.ErrInvalid}
+	}
+	return p.fs.Readlink(p.path)
+}
+
+// Chroot provides a SnapshotFS of a directory.
+func (s *SnapshotFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(s, path), nil
+}
+
+// Capabilities are those of the live filesystem.
+func (s *SnapshotFS) Capabilities() billy.Capability {
+	return billy.Capabilities(s.Filesystem)
+}
+
+// Chmod changes the mode of a file outside of the snapshots.
+func (s *SnapshotFS) Chmod(name string, mode os.FileMode) error {
+	c, err := s.change("chmod", name)
+	if err != nil {
+		return err
+	}
+	return c.Chmod(name, mode)
+}
+
+// Lchown changes the owner of a file outside of the snapshots.
+func (s *SnapshotFS) Lchown(name string, uid, gid int) error {
+	c, err := s.change("lchown", name)
+	if err != nil {
+		return err
+	}
+	return c.Lchown(name, uid, gid)
+}
+
+// Chown changes the owner of a file outside of the snapshots.
+func (s *SnapshotFS) Chown(name string, uid, gid int) error {
+	c, err := s.change("chown", name)
+	if err != nil {
+		return err
+	}
+	return c.Chown(name, uid, gid)
+}
+
+// Chtimes changes the times of a file outside of the snapshots.
+func (s *SnapshotFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	c, err := s.change("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return c.Chtimes(name, atime, mtime)
+}
+
+func (s *SnapshotFS) change(op, name string) (billy.Change, error) {
+	if p, err := s.resolve(name); err != nil {
+		return nil, err
+	} else if p.inSnapshots() {
+		return nil, readOnly(op, name)
+	}
+	c, ok := s.Filesystem.(billy.Change)
+	if !ok {
+		return nil, billy.ErrNotSupported
+	}
+	return c, nil
+}
+
+// Sync flushes a file of the live filesystem, when it can be.
+func (s *SnapshotFS) Sync(name string) error {
+	if sfs, ok := s.Filesystem.(nfs.SyncFilesystem); ok {
+		return sfs.Sync(name)
+	}
+	return nil
+}
+
+// FSInfo provides the limits of the live filesystem.
+func (s *SnapshotFS) FSInfo(info *nfs.FSInfo) error {
+	if ifs, ok := s.Filesystem.(nfs.FSInfoFilesystem); ok {
+		return ifs.FSInfo(info)
+	}
+	return nil
+}
+
+// SetInvalidator passes inv on to the live filesystem, whose paths are those
+// of s.
+func (s *SnapshotFS) SetInvalidator(inv nfs.Invalidator) {
+	if ifs, ok := s.Filesystem.(nfs.InvalidatingFilesystem); ok {
+		ifs.SetInvalidator(inv)
+	}
+}
+
+// snapshotFileInfo is an object in a snapshot, with a fileid of its own.
+type snapshotFileInfo struct {
+	os.FileInfo
+	name   string
+	fileid uint64
+}
+
+func (i *snapshotFileInfo) Name() string   { return i.name }
+func (i *snapshotFileInfo) Fileid() uint64 { return i.fileid }
+
+// snapshotInfo gives the object at path in snapshot a fileid derived from
+// its inode number, so that its hard links keep sharing one, or otherwise
+// from its path.
+func snapshotInfo(info os.FileInfo, name, snapshot, path string) os.FileInfo {
+	h := fnv.New64()
+	_, _ = h.Write([]byte(snapshot))
+	_, _ = h.Write([]byte{0})
+	if fi := file.GetInfo(info); fi != nil && fi.Fileid != 0 {
+		var ino [8]byte
+		binary.BigEndian.PutUint64(ino[:], fi.Fileid)
+		_, _ = h.Write(ino[:])
+	} else {
+		_, _ = h.Write([]byte(filepath.ToSlash(filepath.Clean("/" + path))))
+	}
+	return &snapshotFileInfo{FileInfo: info, name: name, fileid: h.Sum64()}
+}
+
+// snapshotDirInfo is the synthetic snapshot directory of dir.
+type snapshotDirInfo struct {
+	name    string
+	modTime time.Time
+	dir     string
+}
+
+func (i *snapshotDirInfo) Name() string       { return i.name }
+func (i *snapshotDirInfo) Size() int64        { return 0 }
+func (i *snapshotDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (i *snapshotDirInfo) ModTime() time.Time { return i.modTime }
+func (i *snapshotDirInfo) IsDir() bool        { return true }
+func (i *snapshotDirInfo) Sys() interface{}   { return nil }
+
+func (i *snapshotDirInfo) Fileid() uint64 {
+	h := fnv.New64()
+	_, _ = h.Write([]byte(DefaultSnapshotDir + "\x00" + filepath.ToSlash(filepath.Clean("/"+i.dir))))
+	return h.Sum64()
+}
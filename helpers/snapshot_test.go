@@ -0,0 +1,86 @@
+package helpers_test
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestSnapshotDir(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/src", 0755)
+	_ = billyutil.WriteFile(mem, "/src/a.txt", []byte("new"), 0644)
+	snaps := memfs.New()
+	_ = snaps.MkdirAll("/daily/src", 0755)
+	_ = snaps.MkdirAll("/weekly", 0755)
+	_ = billyutil.WriteFile(snaps, "/daily/src/a.txt", []byte("old"), 0644)
+	fs := helpers.NewSnapshotFS(mem, helpers.NewDirSnapshotter(snaps, "/"))
+
+	srv := nfstest.ServeFS(t, fs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	names := func(dir string) []string {
+		entries, err := nfstest.ReadDir(target.Target, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.FileName)
+		}
+		return out
+	}
+	if got := names("/src"); !reflect.DeepEqual(got, []string{"a.txt"}) {
+		t.Fatalf("expected the snapshot directory to be unlisted, got %v", got)
+	}
+	if got := names("/.snapshot"); !reflect.DeepEqual(got, []string{"daily", "weekly"}) {
+		t.Fatalf("unexpected snapshots of / %v", got)
+	}
+	if got := names("/src/.snapshot"); !reflect.DeepEqual(got, []string{"daily"}) {
+		t.Fatalf("expected only the snapshot holding /src, got %v", got)
+	}
+	if got := names("/src/.snapshot/daily"); !reflect.DeepEqual(got, []string{"a.txt"}) {
+		t.Fatalf("unexpected snapshot listing %v", got)
+	}
+
+	rf, err := target.Open("/src/.snapshot/daily/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(rf)
+	_ = rf.Close()
+	if err != nil || string(data) != "old" {
+		t.Fatalf("expected the snapshot contents, got %q: %v", data, err)
+	}
+
+	live, _, err := target.Lookup("/src/a.txt", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _, err := target.Lookup("/src/.snapshot/daily/a.txt", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.(*nfsc.Fattr).Fileid == old.(*nfsc.Fattr).Fileid {
+		t.Fatal("a file and its snapshot should have distinct fileids")
+	}
+
+	if _, err := target.Create("/src/.snapshot/daily/b.txt", 0644); !nfstest.IsStatus(err, nfs.NFSStatusROFS) {
+		t.Errorf("expected creating in a snapshot to fail with ROFS: %v", err)
+	}
+	if err := target.Remove("/src/.snapshot/daily/a.txt"); !nfstest.IsStatus(err, nfs.NFSStatusROFS) {
+		t.Errorf("expected removing from a snapshot to fail with ROFS: %v", err)
+	}
+	if _, err := target.Mkdir("/src/.snapshot", 0755); err == nil {
+		t.Error("expected creating the snapshot directory to fail")
+	}
+}
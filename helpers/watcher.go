@@ -0,0 +1,135 @@
+package helpers
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs"
+)
+
+// Watcher invalidates the caches of a CachingHandler when the directory
+// exported by a filesystem is modified by other processes, so that clients
+// see a removed or renamed file as stale rather than as whatever takes its
+// place.
+type Watcher struct {
+	cache   *CachingHandler
+	fs      billy.Filesystem
+	root    string
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// NewWatcher watches root, the directory on disk exported as fs, and every
+// directory below it for changes. It is closed with Close.
+func NewWatcher(cache *CachingHandler, fs billy.Filesystem, root string) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		cache:   cache,
+		fs:      fs,
+		root:    filepath.Clean(root),
+		watcher: fw,
+		done:    make(chan struct{}),
+	}
+	if err := w.addTree(w.root); err != nil {
+		_ = fw.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+// addTree watches dir and the directories below it, which fsnotify doesn't
+// do by itself.
+func (w *Watcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return w.watcher.Add(p)
+	})
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	for {
+		select {
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(ev)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// changes were missed, so no listing can be trusted. The
+				// handles are kept, as dropping them would fail every client.
+				nfs.Log.Warnf("watcher of %s overflowed", w.root)
+				w.cache.invalidateListings("", true)
+				continue
+			}
+			nfs.Log.Warnf("watcher of %s: %v", w.root, err)
+		}
+	}
+}
+
+func (w *Watcher) handle(ev fsnotify.Event) {
+	p, ok := w.rel(ev.Name)
+	if !ok {
+		return
+	}
+	nfs.Log.Tracef("watcher: %s", ev)
+	if len(p) > 0 {
+		w.cache.InvalidateListing(w.fs, p[:len(p)-1])
+	}
+
+	switch {
+	case ev.Has(fsnotify.Create):
+		if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+			if err := w.addTree(ev.Name); err != nil {
+				nfs.Log.Warnf("unable to watch %s: %v", ev.Name, err)
+			}
+		}
+	case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+		// the path may have been created again, through NFS, by the time its
+		// removal is seen, and the handles it was given since must be kept.
+		if _, err := w.fs.Lstat(w.fs.Join(p...)); !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		w.cache.InvalidatePath(w.fs, p)
+	}
+}
+
+// rel converts a path on disk into the path of fs.
+func (w *Watcher) rel(name string) ([]string, bool) {
+	r, err := filepath.Rel(w.root, name)
+	if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return nil, false
+	}
+	if r == "." {
+		return []string{}, true
+	}
+	return strings.Split(r, string(filepath.Separator)), true
+}
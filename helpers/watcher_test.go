@@ -0,0 +1,48 @@
+package helpers_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+func TestWatcherInvalidatesRemovedPaths(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bfs := osfs.New(root)
+	cache := helpers.NewCachingHandler(helpers.NewNullAuthHandler(bfs), 1024).(*helpers.CachingHandler)
+	w, err := helpers.NewWatcher(cache, bfs, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	kept := cache.ToHandle(bfs, []string{"dir"})
+	removed := cache.ToHandle(bfs, []string{"dir", "file"})
+	if err := os.Remove(filepath.Join(root, "dir", "file")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, err := cache.FromHandle(removed); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the handle of a removed file to become stale")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, p, err := cache.FromHandle(kept); err != nil || !reflect.DeepEqual(p, []string{"dir"}) {
+		t.Fatalf("expected the handle of the directory to be kept, got %v %v", p, err)
+	}
+}
@@ -0,0 +1,51 @@
+package helpers
+
+import (
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/runes"
+)
+
+// WindowsNames is the encoding, for NewEncodingFS, of backends served to
+// Windows clients, which can't open names holding the characters Windows
+// reserves: `\ : * ? " < > |` and the control characters. Those characters
+// are presented as the private use characters U+F000 above them, as Services
+// for UNIX and Cygwin present them, and the names clients give are mapped
+// back, so that entries named on other systems can be opened, renamed and
+// removed from Windows. Names of the backend holding those private use
+// characters themselves are then kept by a different name.
+var WindowsNames encoding.Encoding = windowsNames{}
+
+// windowsPrivateUse is the base of the private use characters reserved
+// characters are presented as.
+const windowsPrivateUse = 0xf000
+
+type windowsNames struct{}
+
+func (windowsNames) NewDecoder() *encoding.Decoder {
+	return &encoding.Decoder{Transformer: runes.Map(func(r rune) rune {
+		if isWindowsReserved(r) {
+			return windowsPrivateUse + r
+		}
+		return r
+	})}
+}
+
+func (windowsNames) NewEncoder() *encoding.Encoder {
+	return &encoding.Encoder{Transformer: runes.Map(func(r rune) rune {
+		if r >= windowsPrivateUse && isWindowsReserved(r-windowsPrivateUse) {
+			return r - windowsPrivateUse
+		}
+		return r
+	})}
+}
+
+func isWindowsReserved(r rune) bool {
+	if r > 0 && r < 0x20 {
+		return true
+	}
+	switch r {
+	case '\\', ':', '*', '?', '"', '<', '>', '|':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,558 @@
+package helpers
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/willscott/go-nfs"
+)
+
+// DefaultWriteBackSize is the number of bytes of writes a WriteBackFS holds
+// when given no limit.
+const DefaultWriteBackSize = 64 << 20
+
+// NewWriteBackFS wraps fs to hold up to limit bytes of the writes made to its
+// files in memory, writing them to fs when they are synced, as by the COMMIT
+// that follows UNSTABLE writes, when the WriteBackFS is closed, or, largest
+// file first, when more than limit bytes are held. A limit of zero takes the
+// default.
+func NewWriteBackFS(fs billy.Filesystem, limit int64) *WriteBackFS {
+	if limit <= 0 {
+		limit = DefaultWriteBackSize
+	}
+	return &WriteBackFS{Filesystem: fs, limit: limit, pending: make(map[string]*pendingWrites)}
+}
+
+// WriteBackFS gathers the writes made to files before passing them on, for
+// backends such as object stores, which are slow to write to in small pieces
+// or which rewrite a whole object on each change.
+//
+// Reads and stats of a file see the writes held for it. Closing a file
+// doesn't write back what is held for it, since the server opens a file for
+// each call; writes held when the process exits are lost, as the UNSTABLE
+// writes of clients may be until committed.
+type WriteBackFS struct {
+	billy.Filesystem
+	limit int64
+
+	mu      sync.Mutex
+	pending map[string]*pendingWrites
+	held    int64 // bytes held across pending.
+}
+
+// pendingWrites are the writes held for a file.
+type pendingWrites struct {
+	extents []writeExtent // sorted by offset, neither overlapping nor adjacent.
+	size    int64         // the size of the file once they are written.
+	mtime   time.Time
+}
+
+// writeExtent is data written at an offset.
+type writeExtent struct {
+	off  int64
+	data []byte
+}
+
+func (e writeExtent) end() int64 {
+	return e.off + int64(len(e.data))
+}
+
+// add holds data written at off, providing the number of bytes it adds to
+// those held.
+func (p *pendingWrites) add(off int64, data []byte) int64 {
+	start, end := off, off+int64(len(data))
+	var kept, merged []writeExtent
+	for _, e := range p.extents {
+		if e.end() < start || e.off > end {
+			kept = append(kept, e)
+			continue
+		}
+		merged = append(merged, e)
+		if e.off < start {
+			start = e.off
+		}
+		if e.end() > end {
+			end = e.end()
+		}
+	}
+	buf := make([]byte, end-start)
+	var before int64
+	for _, e := range merged {
+		copy(buf[e.off-start:], e.data)
+		before += int64(len(e.data))
+	}
+	copy(buf[off-start:], data)
+	kept = append(kept, writeExtent{start, buf})
+	sort.Slice(kept, func(i, j int) bool { return kept[i].off < kept[j].off })
+	p.extents = kept
+	if end > p.size {
+		p.size = end
+	}
+	p.mtime = time.Now()
+	return int64(len(buf)) - before
+}
+
+func cleanWriteBackPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// hold adds a write to those held for a file, writing back the largest files
+// while more than the limit is held.
+func (w *WriteBackFS) hold(name string, off int64, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.pending[name]
+	if !ok {
+		info, err := w.Filesystem.Stat(name)
+		if err != nil {
+			return err
+		}
+		p = &pendingWrites{size: info.Size()}
+		w.pending[name] = p
+	}
+	w.held += p.add(off, data)
+	for w.held > w.limit {
+		largest, most := "", int64(-1)
+		for n, p := range w.pending {
+			if s := p.held(); s > most {
+				largest, most = n, s
+			}
+		}
+		if err := w.writeBack(largest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pendingWrites) held() int64 {
+	var n int64
+	for _, e := range p.extents {
+		n += int64(len(e.data))
+	}
+	return n
+}
+
+// writeBack writes the writes held for a file to the wrapped filesystem,
+// with w.mu held. They are kept if that fails, to be tried again.
+func (w *WriteBackFS) writeBack(name string) error {
+	p, ok := w.pending[name]
+	if !ok {
+		return nil
+	}
+	f, err := w.Filesystem.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			w.drop(name)
+		}
+		return err
+	}
+	for _, e := range p.extents {
+		if _, err = f.Seek(e.off, io.SeekStart); err != nil {
+			break
+		}
+		if _, err = f.Write(e.data); err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	w.drop(name)
+	return nil
+}
+
+// drop forgets the writes held for a file, with w.mu held.
+func (w *WriteBackFS) drop(name string) {
+	if p, ok := w.pending[name]; ok {
+		w.held -= p.held()
+		delete(w.pending, name)
+	}
+}
+
+// below provides the files beneath name holding writes, and name itself if
+// it does, with w.mu held.
+func (w *WriteBackFS) below(name string) []string {
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	var names []string
+	for n := range w.pending {
+		if n == name || strings.HasPrefix(n, prefix) {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// Flush writes back every write held.
+func (w *WriteBackFS) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name := range w.pending {
+		if err := w.writeBack(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes back every write held, for when the server stops.
+func (w *WriteBackFS) Close() error {
+	return w.Flush()
+}
+
+// Sync writes back the writes held for a file, and syncs it on the wrapped
+// filesystem when it can be.
+func (w *WriteBackFS) Sync(filename string) error {
+	w.mu.Lock()
+	err := w.writeBack(cleanWriteBackPath(filename))
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if sfs, ok := w.Filesystem.(nfs.SyncFilesystem); ok {
+		return sfs.Sync(filename)
+	}
+	return nil
+}
+
+// Create creates a file.
+func (w *WriteBackFS) Create(filename string) (billy.File, error) {
+	return w.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens a file for reading.
+func (w *WriteBackFS) Open(filename string) (billy.File, error) {
+	return w.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file, whose writes are held. Truncating the file discards
+// the writes held for it.
+func (w *WriteBackFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	name := cleanWriteBackPath(filename)
+	f, err := w.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 {
+		w.mu.Lock()
+		w.drop(name)
+		w.mu.Unlock()
+	}
+	return &writeBackFile{File: f, fs: w, name: name, append: flag&os.O_APPEND != 0}, nil
+}
+
+// Stat provides the attributes of a file, with the size and modification
+// time it has once the writes held for it are written back.
+func (w *WriteBackFS) Stat(filename string) (os.FileInfo, error) {
+	info, err := w.Filesystem.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return w.withPending(info, cleanWriteBackPath(filename)), nil
+}
+
+// Lstat is Stat, not following links.
+func (w *WriteBackFS) Lstat(filename string) (os.FileInfo, error) {
+	info, err := w.Filesystem.Lstat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return w.withPending(info, cleanWriteBackPath(filename)), nil
+}
+
+// ReadDir lists a directory, with the sizes and modification times its files
+// have once the writes held for them are written back.
+func (w *WriteBackFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries, err := w.Filesystem.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	dir := cleanWriteBackPath(dirname)
+	for i, e := range entries {
+		entries[i] = w.withPending(e, path.Join(dir, e.Name()))
+	}
+	return entries, nil
+}
+
+func (w *WriteBackFS) withPending(info os.FileInfo, name string) os.FileInfo {
+	w.mu.Lock()
+	p, ok := w.pending[name]
+	w.mu.Unlock()
+	if !ok || !info.Mode().IsRegular() {
+		return info
+	}
+	wi := &writeBackInfo{FileInfo: info, size: p.size, mtime: p.mtime}
+	if fi, ok := info.(nfs.FileIdentifier); ok {
+		return &writeBackIdentifiedInfo{wi, fi.Fileid()}
+	}
+	return wi
+}
+
+// Rename moves a file, after writing back the writes held for it, or for the
+// files below it.
+func (w *WriteBackFS) Rename(oldpath, newpath string) error {
+	from, to := cleanWriteBackPath(oldpath), cleanWriteBackPath(newpath)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, name := range w.below(from) {
+		if err := w.writeBack(name); err != nil {
+			return err
+		}
+	}
+	if err := w.Filesystem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	for _, name := range w.below(to) {
+		w.drop(name)
+	}
+	return nil
+}
+
+// Remove removes a file, discarding the writes held for it.
+func (w *WriteBackFS) Remove(filename string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.Filesystem.Remove(filename); err != nil {
+		return err
+	}
+	w.drop(cleanWriteBackPath(filename))
+	return nil
+}
+
+// Chroot provides a WriteBackFS of a directory, sharing what is held.
+func (w *WriteBackFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(w, path), nil
+}
+
+// Chmod changes the mode of a file.
+func (w *WriteBackFS) Chmod(name string, mode os.FileMode) error {
+	c, ok := w.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Chmod(name, mode)
+}
+
+// Lchown changes the owner of a file, not following links.
+func (w *WriteBackFS) Lchown(name string, uid, gid int) error {
+	c, ok := w.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Lchown(name, uid, gid)
+}
+
+// Chown changes the owner of a file.
+func (w *WriteBackFS) Chown(name string, uid, gid int) error {
+	c, ok := w.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Chown(name, uid, gid)
+}
+
+// Chtimes changes the times of a file, after writing back the writes held
+// for it, which would change its modification time again.
+func (w *WriteBackFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	c, ok := w.Filesystem.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	w.mu.Lock()
+	err := w.writeBack(cleanWriteBackPath(name))
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Chtimes(name, atime, mtime)
+}
+
+// FSInfo provides the limits of the wrapped filesystem.
+func (w *WriteBackFS) FSInfo(info *nfs.FSInfo) error {
+	if ifs, ok := w.Filesystem.(nfs.FSInfoFilesystem); ok {
+		return ifs.FSInfo(info)
+	}
+	return nil
+}
+
+// SetInvalidator passes inv on to the wrapped filesystem.
+func (w *WriteBackFS) SetInvalidator(inv nfs.Invalidator) {
+	if ifs, ok := w.Filesystem.(nfs.InvalidatingFilesystem); ok {
+		ifs.SetInvalidator(inv)
+	}
+}
+
+// writeBackInfo is a file with writes held for it.
+type writeBackInfo struct {
+	os.FileInfo
+	size  int64
+	mtime time.Time
+}
+
+func (i *writeBackInfo) Size() int64        { return i.size }
+func (i *writeBackInfo) ModTime() time.Time { return i.mtime }
+
+type writeBackIdentifiedInfo struct {
+	*writeBackInfo
+	fileid uint64
+}
+
+func (i *writeBackIdentifiedInfo) Fileid() uint64 { return i.fileid }
+
+// writeBackFile is a file of a WriteBackFS, whose writes are held and whose
+// reads see them.
+type writeBackFile struct {
+	billy.File
+	fs     *WriteBackFS
+	name   string
+	append bool
+	pos    int64
+}
+
+func (f *writeBackFile) size() (int64, error) {
+	f.fs.mu.Lock()
+	p, ok := f.fs.pending[f.name]
+	f.fs.mu.Unlock()
+	if ok {
+		return p.size, nil
+	}
+	info, err := f.fs.Filesystem.Stat(f.name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (f *writeBackFile) Write(p []byte) (int, error) {
+	if f.append {
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		f.pos = size
+	}
+	if err := f.fs.hold(f.name, f.pos, p); err != nil {
+		return 0, err
+	}
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *writeBackFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *writeBackFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *writeBackFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	pw, ok := f.fs.pending[f.name]
+	var extents []writeExtent
+	var size int64
+	if ok {
+		extents, size = pw.extents, pw.size
+	}
+	f.fs.mu.Unlock()
+	if !ok {
+		return f.File.ReadAt(p, off)
+	}
+
+	if off >= size {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if size-off < want {
+		want = size - off
+	}
+	buf := p[:want]
+	n := 0
+	for n < len(buf) {
+		m, err := f.File.ReadAt(buf[n:], off+int64(n))
+		n += m
+		if errors.Is(err, io.EOF) || m == 0 {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	for _, e := range extents {
+		if e.end() <= off || e.off >= off+want {
+			continue
+		}
+		if e.off >= off {
+			copy(buf[e.off-off:], e.data)
+		} else {
+			copy(buf, e.data[off-e.off:])
+		}
+	}
+	if want < int64(len(p)) {
+		return int(want), io.EOF
+	}
+	return int(want), nil
+}
+
+// Sync writes back the writes held for the file, and syncs it.
+func (f *writeBackFile) Sync() error {
+	f.fs.mu.Lock()
+	err := f.fs.writeBack(f.name)
+	f.fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if sf, ok := f.File.(interface{ Sync() error }); ok {
+		return sf.Sync()
+	}
+	if sfs, ok := f.fs.Filesystem.(nfs.SyncFilesystem); ok {
+		return sfs.Sync(f.name)
+	}
+	return nil
+}
+
+// Truncate writes back the writes held for the file before truncating it.
+func (f *writeBackFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.writeBack(f.name); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,112 @@
+package helpers_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// syncFS counts calls to its SyncFilesystem extension.
+type syncFS struct {
+	billy.Filesystem
+	syncs *int32
+}
+
+func (s syncFS) Sync(string) error {
+	atomic.AddInt32(s.syncs, 1)
+	return nil
+}
+
+func TestWriteBack(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	var syncs int32
+	wb := helpers.NewWriteBackFS(syncFS{mem, &syncs}, 0)
+
+	srv := nfstest.ServeFS(t, wb)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(proc nfs.NFSProcedure, args interface{}) {
+		res, err := target.Call(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, err := xdr.ReadUint32(res); err != nil || status != 0 {
+			t.Fatalf("call %d failed: %d %v", proc, status, err)
+		}
+	}
+	header := func(proc nfs.NFSProcedure) rpc.Header {
+		return rpc.Header{Rpcvers: 2, Vers: nfsc.Nfs3Vers, Prog: nfsc.Nfs3Prog, Proc: uint32(proc), Cred: rpc.AuthNull, Verf: rpc.AuthNull}
+	}
+	data := []byte("held back")
+	call(nfs.NFSProcedureWrite, &struct {
+		rpc.Header
+		Handle []byte
+		Offset uint64
+		Count  uint32
+		How    uint32
+		Data   []byte
+	}{header(nfs.NFSProcedureWrite), fh, 0, uint32(len(data)), 0, data})
+
+	if b, _ := billyutil.ReadFile(mem, "/data"); len(b) != 0 {
+		t.Fatalf("expected the unstable write to be held, backend has %q", b)
+	}
+	if attr, err := target.GetAttr(fh); err != nil || attr.Size() != int64(len(data)) {
+		t.Fatalf("expected the size to include the held write: %v", err)
+	}
+	if b, err := billyutil.ReadFile(wb, "/data"); err != nil || string(b) != "held back" {
+		t.Fatalf("expected reads to see the held write, got %q: %v", b, err)
+	}
+
+	call(nfs.NFSProcedureCommit, &struct {
+		rpc.Header
+		Handle []byte
+		Offset uint64
+		Count  uint32
+	}{header(nfs.NFSProcedureCommit), fh, 0, 0})
+	if b, _ := billyutil.ReadFile(mem, "/data"); string(b) != "held back" {
+		t.Fatalf("expected the commit to write back the held write, backend has %q", b)
+	}
+	if n := atomic.LoadInt32(&syncs); n != 1 {
+		t.Fatalf("expected the commit to sync the backend once, got %d", n)
+	}
+
+	// holding more than the limit writes back the largest file.
+	small := helpers.NewWriteBackFS(mem, 6)
+	for name, data := range map[string]string{"/a": "aaaa", "/b": "bbbbbb"} {
+		f, err := small.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		_ = f.Close()
+	}
+	if b, _ := billyutil.ReadFile(mem, "/b"); string(b) != "bbbbbb" {
+		t.Fatalf("expected going over the limit to write back /b, backend has %q", b)
+	}
+	if a, _ := billyutil.ReadFile(mem, "/a"); len(a) != 0 {
+		t.Fatalf("expected /a to still be held, backend has %q", a)
+	}
+	if err := small.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := billyutil.ReadFile(mem, "/a"); string(a) != "aaaa" {
+		t.Fatalf("expected close to write back /a, backend has %q", a)
+	}
+}
@@ -0,0 +1,126 @@
+package nfs
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// IDMapper maps the identities clients assert to those calls are served as,
+// and uids and gids to and from the names NFSv4 carries in owner attributes,
+// so that directories such as LDAP or SSSD can be consulted for both.
+type IDMapper interface {
+	// MapCredentials provides the identity a call made from conn with the
+	// AUTH_SYS credentials cred is served as. It is applied before the
+	// squashing of the export, which then sees the mapped identity. Nil
+	// serves the call as one made without credentials, which exports give
+	// their anonymous identity, and an error refuses it with AUTH_BADCRED.
+	MapCredentials(ctx context.Context, conn net.Conn, cred *AuthUnix) (*AuthUnix, error)
+	// UserName and GroupName provide the names of a uid and a gid, as
+	// "user@domain".
+	UserName(ctx context.Context, uid uint32) (string, error)
+	GroupName(ctx context.Context, gid uint32) (string, error)
+	// UID and GID provide the ids of names given by clients.
+	UID(ctx context.Context, name string) (uint32, error)
+	GID(ctx context.Context, name string) (uint32, error)
+}
+
+// CertificateMapper is an optional extension of an IDMapper providing the
+// identity calls made by the holder of a verified TLS client certificate are
+// served as, when Server.MapClientCertificates is set, in place of mapping
+// the name of the certificate with UID and GID.
+type CertificateMapper interface {
+	MapCertificate(ctx context.Context, cert *x509.Certificate) (*AuthUnix, error)
+}
+
+// ErrUnknownID is returned by an IDMapper for names and ids it can't map.
+var ErrUnknownID = errors.New("unknown user or group")
+
+// NumericIDMapper is the IDMapper of servers not given one. Identities are
+// served as clients assert them, and ids are named by their decimal form, as
+// rfc7530 section 5.9 allows with AUTH_SYS, followed by "@" and Domain when
+// it is set.
+type NumericIDMapper struct {
+	Domain string
+}
+
+// MapCredentials serves calls as the identity they are made with.
+func (m NumericIDMapper) MapCredentials(ctx context.Context, conn net.Conn, cred *AuthUnix) (*AuthUnix, error) {
+	return cred, nil
+}
+
+// UserName provides the decimal form of uid.
+func (m NumericIDMapper) UserName(ctx context.Context, uid uint32) (string, error) {
+	return m.name(uid), nil
+}
+
+// GroupName provides the decimal form of gid.
+func (m NumericIDMapper) GroupName(ctx context.Context, gid uint32) (string, error) {
+	return m.name(gid), nil
+}
+
+// UID parses the decimal form of a uid, with or without a domain.
+func (m NumericIDMapper) UID(ctx context.Context, name string) (uint32, error) {
+	return m.id(name)
+}
+
+// GID parses the decimal form of a gid, with or without a domain.
+func (m NumericIDMapper) GID(ctx context.Context, name string) (uint32, error) {
+	return m.id(name)
+}
+
+func (m NumericIDMapper) name(id uint32) string {
+	s := strconv.FormatUint(uint64(id), 10)
+	if m.Domain != "" {
+		s += "@" + m.Domain
+	}
+	return s
+}
+
+func (m NumericIDMapper) id(name string) (uint32, error) {
+	if i := strings.LastIndexByte(name, '@'); i >= 0 {
+		if m.Domain != "" && !strings.EqualFold(name[i+1:], m.Domain) {
+			return 0, ErrUnknownID
+		}
+		name = name[:i]
+	}
+	id, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		return 0, ErrUnknownID
+	}
+	return uint32(id), nil
+}
+
+// idMapper provides the IDMapper of the server.
+func (s *Server) idMapper() IDMapper {
+	if s.IDMapper != nil {
+		return s.IDMapper
+	}
+	return NumericIDMapper{}
+}
+
+// GroupResolver provides the groups of users, for servers to consult rather
+// than the supplementary groups asserted by clients, which AUTH_SYS bounds to
+// 16, as the manage-gids option of Linux's mountd does. It is consulted for
+// each call, and so should cache what it looks up.
+type GroupResolver interface {
+	// Groups provides the supplementary groups of uid.
+	Groups(ctx context.Context, uid uint32) ([]uint32, error)
+}
+
+// resolveGroups replaces the supplementary groups of cred with those the
+// GroupResolver of the server gives. The groups asserted by the client are
+// kept when the resolver fails.
+func (s *Server) resolveGroups(ctx context.Context, cred *AuthUnix) *AuthUnix {
+	gids, err := s.GroupResolver.Groups(ctx, cred.UID)
+	if err != nil {
+		Log.Debugf("unable to resolve the groups of uid %d: %v", cred.UID, err)
+		return cred
+	}
+	resolved := *cred
+	resolved.GIDs = gids
+	return &resolved
+}
@@ -0,0 +1,115 @@
+package nfs_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// mappedIDs serves uid 1000 as uid 2000, and refuses uid 666.
+type mappedIDs struct {
+	nfs.NumericIDMapper
+}
+
+func (mappedIDs) MapCredentials(ctx context.Context, conn net.Conn, cred *nfs.AuthUnix) (*nfs.AuthUnix, error) {
+	switch cred.UID {
+	case 666:
+		return nil, nfs.ErrUnknownID
+	case 1000:
+		mapped := *cred
+		mapped.UID = 2000
+		return &mapped, nil
+	}
+	return cred, nil
+}
+
+func TestIDMapper(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/dir", 0755)
+
+	var mu sync.Mutex
+	var uids []uint32
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:  helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		IDMapper: mappedIDs{},
+		Authorize: func(ctx context.Context, op *nfs.Operation) nfs.NFSStatus {
+			if op.Credentials != nil {
+				mu.Lock()
+				uids = append(uids, op.Credentials.UID)
+				mu.Unlock()
+			}
+			return nfs.NFSStatusOk
+		},
+	})
+	target := srv.Mount(t, "/", rpc.NewAuthUnix("client", 1000, 100).Auth())
+
+	if _, _, err := target.Lookup("/dir", false); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(uids) == 0 || uids[len(uids)-1] != 2000 {
+		t.Errorf("expected calls to be served as the mapped uid, got %v", uids)
+	}
+	mu.Unlock()
+
+	if _, err := nfstest.Dial(srv.Addr(), "/", rpc.NewAuthUnix("client", 666, 100).Auth()); err == nil {
+		t.Fatal("expected credentials the mapper refuses to be refused")
+	}
+
+	m := nfs.NumericIDMapper{Domain: "example.com"}
+	if name, _ := m.UserName(context.Background(), 1000); name != "1000@example.com" {
+		t.Errorf("expected a numeric name with the domain, got %q", name)
+	}
+	if id, err := m.GID(context.Background(), "100@EXAMPLE.COM"); err != nil || id != 100 {
+		t.Errorf("expected the numeric name to be parsed, got %d: %v", id, err)
+	}
+	if _, err := m.UID(context.Background(), "alice@example.com"); !errors.Is(err, nfs.ErrUnknownID) {
+		t.Errorf("expected a name that isn't numeric to be unknown, got %v", err)
+	}
+}
+
+// staticGroups resolves every uid to the groups it lists.
+type staticGroups []uint32
+
+func (g staticGroups) Groups(ctx context.Context, uid uint32) ([]uint32, error) {
+	return g, nil
+}
+
+func TestGroupResolver(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/team", 0770)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{CheckPermissions: true})
+	for _, tc := range []struct {
+		resolver nfs.GroupResolver
+		allowed  bool
+	}{
+		{nil, false},
+		{staticGroups{0}, true},
+	} {
+		srv := nfstest.Start(t, &nfs.Server{
+			Handler:       helpers.NewCachingHandler(handler, 1024),
+			GroupResolver: tc.resolver,
+		})
+		cred := rpc.AuthUnix{Machinename: "client", Uid: 1000, Gid: 100, GidLen: 1, Gids: 5}
+		target := srv.Mount(t, "/", cred.Auth())
+		_, err := target.Mkdir("/team/new", 0755)
+		target.Close()
+		srv.Close()
+		if tc.allowed && err != nil {
+			t.Fatalf("expected a resolved group to grant access, got %v", err)
+		}
+		if !tc.allowed && !nfstest.IsStatus(err, nfs.NFSStatusAccess) {
+			t.Fatalf("expected access to be denied without the group, got %v", err)
+		}
+		_ = mem.Remove("/team/new")
+	}
+}
@@ -0,0 +1,71 @@
+package nfs
+
+import (
+	"context"
+	"sync"
+)
+
+// byteLimiter bounds the number of request payload bytes held in memory
+// across all connections of a server. A nil limiter imposes no bound.
+type byteLimiter struct {
+	mu       sync.Mutex
+	limit    int64
+	used     int64
+	released chan struct{}
+}
+
+func newByteLimiter(limit int64) *byteLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &byteLimiter{
+		limit:    limit,
+		released: make(chan struct{}),
+	}
+}
+
+// clamp ensures a single request larger than the whole budget can still
+// make progress once it has the server to itself.
+func (l *byteLimiter) clamp(n int64) int64 {
+	if n > l.limit {
+		return l.limit
+	}
+	return n
+}
+
+// acquire blocks until n bytes are available or the context is done.
+func (l *byteLimiter) acquire(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+	n = l.clamp(n)
+	for {
+		l.mu.Lock()
+		if l.used+n <= l.limit {
+			l.used += n
+			l.mu.Unlock()
+			return nil
+		}
+		wait := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release returns n bytes previously acquired and wakes any waiters.
+func (l *byteLimiter) release(n int64) {
+	if l == nil {
+		return
+	}
+	n = l.clamp(n)
+	l.mu.Lock()
+	l.used -= n
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mu.Unlock()
+}
@@ -0,0 +1,89 @@
+package nfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestMaxInFlightBytes(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/slow", []byte("x"), 0644)
+	_ = billyutil.WriteFile(mem, "/fast", []byte("x"), 0644)
+	fs := &blockingFS{Filesystem: mem, release: make(chan struct{})}
+
+	// a budget smaller than any call, so that a single call holds all of it.
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:          helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024),
+		MaxInFlightBytes: 1,
+	})
+	slow := srv.Mount(t, "/", rpc.AuthNull)
+	fast := srv.Mount(t, "/", rpc.AuthNull)
+	var once sync.Once
+	release := func() { once.Do(func() { close(fs.release) }) }
+	// before the clients unmount, should the test fail with the slow
+	// lookup blocked.
+	t.Cleanup(release)
+
+	slowDone := make(chan error, 1)
+	go func() {
+		_, _, err := slow.Lookup("/slow", false)
+		slowDone <- err
+	}()
+	// wait for the slow lookup to take the budget.
+	time.Sleep(50 * time.Millisecond)
+
+	fastDone := make(chan error, 1)
+	go func() {
+		_, _, err := fast.Lookup("/fast", false)
+		fastDone <- err
+	}()
+	select {
+	case err := <-fastDone:
+		t.Fatalf("expected a call over the budget to wait for the one in flight, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release()
+	for name, done := range map[string]chan error{"slow": slowDone, "fast": fastDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("expected the %s lookup to succeed: %v", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the %s lookup to resume once the budget was released", name)
+		}
+	}
+}
+
+// blockingFS blocks looking up "slow" until release is closed.
+type blockingFS struct {
+	billy.Filesystem
+	release chan struct{}
+}
+
+func (fs *blockingFS) Lstat(name string) (os.FileInfo, error) {
+	if filepath.Base(name) == "slow" {
+		<-fs.release
+	}
+	return fs.Filesystem.Lstat(name)
+}
+
+func (fs *blockingFS) Stat(name string) (os.FileInfo, error) {
+	if filepath.Base(name) == "slow" {
+		<-fs.release
+	}
+	return fs.Filesystem.Stat(name)
+}
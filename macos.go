@@ -0,0 +1,157 @@
+package nfs
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// appleDoublePrefix begins the names of the AppleDouble files in which macOS
+// keeps the extended attributes and resource forks of files on filesystems
+// without them, "._name" holding those of "name".
+const appleDoublePrefix = "._"
+
+const (
+	// attrCacheTTL is how long the attributes GETATTR and ACCESS stat are
+	// reused for.
+	attrCacheTTL = time.Second
+	// attrCacheMax bounds the objects whose attributes are cached.
+	attrCacheMax = 4096
+)
+
+// macOSQuirks reports whether the export a call is made against is served
+// for macOS clients.
+func macOSQuirks(ctx context.Context) bool {
+	opts := exportOptionsFromContext(ctx)
+	return opts != nil && opts.MacOSQuirks
+}
+
+// attrCache keeps the attributes of objects, by handle, for the GETATTR and
+// ACCESS calls Finder repeats for each object it shows. It is cleared by
+// every call that modifies an export, so that only the changes made around
+// the server are seen late, by up to attrCacheTTL.
+type attrCache struct {
+	mu      sync.Mutex
+	entries map[string]attrCacheEntry
+}
+
+type attrCacheEntry struct {
+	info os.FileInfo
+	at   time.Time
+}
+
+func newAttrCache() *attrCache {
+	return &attrCache{entries: make(map[string]attrCacheEntry)}
+}
+
+// lstat provides the attributes of the object at fullPath, whose handle is
+// handle, from the cache when the export serves macOS clients.
+func (c *attrCache) lstat(ctx context.Context, fs billy.Filesystem, fullPath string, handle []byte) (os.FileInfo, error) {
+	if !macOSQuirks(ctx) {
+		return fs.Lstat(fullPath)
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[string(handle)]
+	c.mu.Unlock()
+	if ok && now.Sub(e.at) < attrCacheTTL {
+		return e.info, nil
+	}
+	info, err := fs.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if len(c.entries) >= attrCacheMax {
+		c.entries = make(map[string]attrCacheEntry)
+	}
+	c.entries[string(handle)] = attrCacheEntry{info, now}
+	c.mu.Unlock()
+	return info, nil
+}
+
+func (c *attrCache) clear() {
+	c.mu.Lock()
+	if len(c.entries) > 0 {
+		c.entries = make(map[string]attrCacheEntry)
+	}
+	c.mu.Unlock()
+}
+
+// modifiesExport reports whether a call may change the attributes of the
+// objects of an export, and so must clear the attributes cached.
+func modifiesExport(h *rpc.Header) bool {
+	if h.Prog != nfsServiceID {
+		return false
+	}
+	if h.Vers != nfs3Version {
+		return true
+	}
+	return isModifyingProcedure(NFSProcedure(h.Proc))
+}
+
+// appleDouble provides the path of the AppleDouble file of the entry name of
+// dir, or nil when name is itself an AppleDouble file.
+func appleDouble(dir []string, name []byte) []string {
+	if strings.HasPrefix(string(name), appleDoublePrefix) {
+		return nil
+	}
+	return entryPath(dir, append([]byte(appleDoublePrefix), name...))
+}
+
+// removeAppleDouble removes the AppleDouble file of an entry removed from
+// dir, as macOS does on filesystems without extended attributes, so that it
+// isn't left behind for Finder to show. Failures are logged, since the entry
+// is removed regardless.
+func removeAppleDouble(ctx context.Context, userHandle Handler, fs billy.Filesystem, dir []string, name []byte) {
+	p := appleDouble(dir, name)
+	if p == nil || !macOSQuirks(ctx) {
+		return
+	}
+	if _, err := fs.Lstat(fs.Join(p...)); err != nil {
+		return
+	}
+	handle := userHandle.ToHandle(fs, p)
+	if err := fs.Remove(fs.Join(p...)); err != nil {
+		Log.Debugf("unable to remove %s: %v", fs.Join(p...), err)
+		return
+	}
+	if err := userHandle.InvalidateHandle(fs, handle); err != nil {
+		Log.Debugf("unable to invalidate the handle of %s: %v", fs.Join(p...), err)
+	}
+}
+
+// renameAppleDouble moves the AppleDouble file of an entry renamed from
+// fromName of fromDir to toName of toDir along with it, replacing any of
+// the entry it replaced, so that the entry keeps its extended attributes.
+func renameAppleDouble(ctx context.Context, userHandle Handler, fs billy.Filesystem, fromDir []string, fromName []byte, toDir []string, toName []byte) {
+	from, to := appleDouble(fromDir, fromName), appleDouble(toDir, toName)
+	if from == nil || to == nil || !macOSQuirks(ctx) {
+		return
+	}
+	if _, err := fs.Lstat(fs.Join(from...)); err != nil {
+		return
+	}
+	handles := [][]byte{userHandle.ToHandle(fs, from)}
+	if _, err := fs.Lstat(fs.Join(to...)); err == nil {
+		handles = append(handles, userHandle.ToHandle(fs, to))
+		if err := fs.Remove(fs.Join(to...)); err != nil {
+			Log.Debugf("unable to remove %s: %v", fs.Join(to...), err)
+			return
+		}
+	}
+	if err := fs.Rename(fs.Join(from...), fs.Join(to...)); err != nil {
+		Log.Debugf("unable to rename %s: %v", fs.Join(from...), err)
+		return
+	}
+	for _, h := range handles {
+		if err := userHandle.InvalidateHandle(fs, h); err != nil {
+			Log.Debugf("unable to invalidate a handle: %v", err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package nfs_test
+
+import (
+	"os"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestMacOSQuirks(t *testing.T) {
+	mem := memfs.New()
+	for _, name := range []string{"/a", "/._a", "/b", "/._b", "/._orphan"} {
+		if err := billyutil.WriteFile(mem, name, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{MacOSQuirks: true})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if err := target.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/._a"); !os.IsNotExist(err) {
+		t.Fatalf("expected the AppleDouble file to be removed with its file, got %v", err)
+	}
+	if err := target.Rename("/b", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/._c"); err != nil {
+		t.Fatalf("expected the AppleDouble file to be renamed with its file: %v", err)
+	}
+	if _, err := mem.Stat("/._b"); !os.IsNotExist(err) {
+		t.Fatalf("expected the AppleDouble file to leave its old name, got %v", err)
+	}
+	if err := target.Remove("/._orphan"); err != nil {
+		t.Fatal(err)
+	}
+
+	// attributes are cached until the export is modified.
+	_, fh, err := target.Lookup("/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.GetAttr(fh); err != nil {
+		t.Fatal(err)
+	}
+	if err := billyutil.WriteFile(mem, "/c", []byte("hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	attr, err := target.GetAttr(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.Size() != 5 {
+		t.Fatalf("expected the attributes to be cached, got a size of %d", attr.Size())
+	}
+	if _, err := target.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if attr, err = target.GetAttr(fh); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Size() != 12 {
+		t.Fatalf("expected a modification to clear the attributes cached, got a size of %d", attr.Size())
+	}
+}
@@ -3,18 +3,29 @@ package nfs
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 const (
 	mountServiceID = 100005
+	mountVersion   = 3
+	// mountVersion1 is the first version of the MOUNT program, of NFSv2,
+	// whose MNT replies with an fhstatus: a status which is an errno, and a
+	// handle of fhSizeV1 bytes. Version 2 only adds a PATHCONF procedure.
+	mountVersion1 = 1
+	fhSizeV1      = 32
 )
 
 func init() {
 	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcNull), onMountNull)
 	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcMount), onMount)
+	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcDump), onMountDump)
 	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcUmnt), onUMount)
+	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcUmntAll), onUMountAll)
 }
 
 func onMountNull(ctx context.Context, w *response, userHandle Handler) error {
@@ -22,37 +33,173 @@ func onMountNull(ctx context.Context, w *response, userHandle Handler) error {
 }
 
 func onMount(ctx context.Context, w *response, userHandle Handler) error {
-	// TODO: auth check.
-	dirpath, err := xdr.ReadOpaque(w.req.Body)
+	dirpath, err := readBoundedOpaque(w.req.Body, mountPathMax)
 	if err != nil {
 		return err
 	}
 	mountReq := MountRequest{Header: w.req.Header, Dirpath: dirpath}
-	status, handle, flavors := userHandle.Mount(ctx, w.conn, mountReq)
+	w.mount = &mountReq
+
+	// the options of the export are checked before it is mounted when the
+	// handler gives them by path, and otherwise once it is.
+	status := MountStatusOk
+	var opts *ExportOptions
+	if mh, ok := userHandle.(MountOptionsHandler); ok {
+		if opts = mh.MountOptions(ctx, w.conn, mountReq); opts != nil {
+			if status, err = w.checkMount(opts); err != nil {
+				return err
+			}
+		}
+	}
+	var handle billy.Filesystem
+	var flavors []AuthFlavor
+	if status == MountStatusOk {
+		status, handle, flavors = userHandle.Mount(ctx, w.conn, mountReq)
+		if status != MountStatusOk {
+			w.refused = true
+			w.err = mountStatusError(status)
+		} else if eh, ok := userHandle.(ExportHandler); ok && opts == nil {
+			if opts = eh.ExportOptions(ctx, w.conn, handle); opts != nil {
+				if status, err = w.checkMount(opts); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if status == MountStatusOk && opts != nil && len(opts.AuthFlavors) > 0 {
+		flavors = opts.AuthFlavors
+	}
+	w.flavors = flavors
+	if status == MountStatusOk {
+		Log.Infof("mount of %s by %v with flavor %d", dirpath, w.conn.RemoteAddr(), w.req.Header.Cred.Flavor)
+		if err := w.Server.mountStore().AddMount(MountInfo{
+			Client: w.conn.RemoteAddr(),
+			Export: string(dirpath),
+			Time:   time.Now(),
+			Flavor: AuthFlavor(w.req.Header.Cred.Flavor),
+		}); err != nil {
+			Log.Errorf("recording mount of %s by %v: %v", dirpath, w.conn.RemoteAddr(), err)
+		}
+	} else {
+		Log.Infof("mount of %s by %v refused: status %d", dirpath, w.conn.RemoteAddr(), status)
+	}
 
 	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
 		return err
 	}
+	if w.req.Header.Vers < mountVersion {
+		return w.Write(fhStatus(status, userHandle, handle))
+	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(status)); err != nil {
 		return err
 	}
 
-	rootHndl := userHandle.ToHandle(handle, []string{})
-
 	if status == MountStatusOk {
+		rootHndl := userHandle.ToHandle(handle, []string{})
 		_ = xdr.Write(writer, rootHndl)
 		_ = xdr.Write(writer, flavors)
 	}
 	return w.Write(writer.Bytes())
 }
 
+// checkMount refuses a MNT the options of its export don't allow: one made
+// with a flavor they don't accept with AUTH_TOOWEAK, and one from an
+// unprivileged port or without an accepted client certificate with the
+// status it is refused with. Mounts of exports listing flavors that aren't
+// implemented are refused with MNT3ERR_SERVERFAULT.
+func (w *response) checkMount(opts *ExportOptions) (MountStatus, error) {
+	if err := opts.checkFlavors(); err != nil {
+		Log.Errorf("mount of %s by %v refused: %v", w.mount.Dirpath, w.conn.RemoteAddr(), err)
+		w.refused = true
+		w.err = err
+		return MountStatusErrServerFault, nil
+	}
+	if len(opts.AuthFlavors) > 0 && !opts.allowsFlavor(w.req.Header.Cred.Flavor) {
+		Log.Infof("mount of %s by %v refused: flavor %d not accepted", w.mount.Dirpath, w.conn.RemoteAddr(), w.req.Header.Cred.Flavor)
+		return MountStatusOk, &AuthError{AuthStatTooWeak}
+	}
+	if !opts.allowsPort(w.conn.RemoteAddr()) {
+		w.refused = true
+		w.err = errInsecurePort
+		return MountStatusErrPerm, nil
+	}
+	if err := opts.checkClientCert(w.conn); err != nil {
+		w.refused = true
+		w.err = err
+		return MountStatusErrAcces, nil
+	}
+	return MountStatusOk, nil
+}
+
+// fhStatus encodes the reply of a MNT of version 1 or 2 of the MOUNT program.
+// The handle of the root of fs is padded with zeros to the fixed size of the
+// handles of those versions, and a root handle too long to fit fails the
+// mount. The statuses of version 3 which aren't errnos are given as EIO.
+func fhStatus(status MountStatus, userHandle Handler, fs billy.Filesystem) []byte {
+	var fh []byte
+	if status == MountStatusOk {
+		fh = userHandle.ToHandle(fs, []string{})
+		if len(fh) > fhSizeV1 {
+			Log.Errorf("mount refused: the root handle of %d bytes is too long for MOUNT v1", len(fh))
+			status = MountStatusErrIO
+		}
+	}
+	if status == MountStatusErrNotSupp || status == MountStatusErrServerFault {
+		status = MountStatusErrIO
+	}
+	writer := bytes.NewBuffer([]byte{})
+	_ = xdr.Write(writer, uint32(status))
+	if status == MountStatusOk {
+		var fixed [fhSizeV1]byte
+		copy(fixed[:], fh)
+		writer.Write(fixed[:])
+	}
+	return writer.Bytes()
+}
+
+// mountStatusError records the status a MNT was refused with.
+type mountStatusError MountStatus
+
+func (m mountStatusError) Error() string {
+	return fmt.Sprintf("mount refused with status %d", uint32(m))
+}
+
 func onUMount(ctx context.Context, w *response, userHandle Handler) error {
-	_, err := xdr.ReadOpaque(w.req.Body)
+	dirpath, err := readBoundedOpaque(w.req.Body, mountPathMax)
 	if err != nil {
 		return err
 	}
+	w.mount = &MountRequest{Header: w.req.Header, Dirpath: dirpath}
+	Log.Infof("unmount of %s by %v", dirpath, w.conn.RemoteAddr())
+	if err := w.Server.mountStore().RemoveMount(w.conn.RemoteAddr(), string(dirpath)); err != nil {
+		Log.Errorf("recording unmount of %s by %v: %v", dirpath, w.conn.RemoteAddr(), err)
+	}
+
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+func onUMountAll(ctx context.Context, w *response, userHandle Handler) error {
+	Log.Infof("unmount of all exports by %v", w.conn.RemoteAddr())
+	if err := w.Server.mountStore().RemoveMounts(w.conn.RemoteAddr()); err != nil {
+		Log.Errorf("recording unmount of all exports by %v: %v", w.conn.RemoteAddr(), err)
+	}
 
 	return w.writeHeader(ResponseCodeSuccess)
 }
+
+// onMountDump lists the mounts of the server, as shown by `showmount -a`.
+func onMountDump(ctx context.Context, w *response, userHandle Handler) error {
+	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+		return err
+	}
+	writer := bytes.NewBuffer([]byte{})
+	for _, m := range w.Server.Mounts() {
+		_ = xdr.Write(writer, uint32(1))
+		_ = xdr.Write(writer, clientKey(m.Client))
+		_ = xdr.Write(writer, m.Export)
+	}
+	_ = xdr.Write(writer, uint32(0))
+	return w.Write(writer.Bytes())
+}
@@ -0,0 +1,65 @@
+package nfs_test
+
+import (
+	"io"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestMountV1(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/file", []byte("hello"), 0644)
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	res, err := target.Call(&struct {
+		rpc.Header
+		Dirpath string
+	}{rpc.Header{
+		Rpcvers: 2,
+		Prog:    nfsc.MountProg,
+		Vers:    1,
+		Proc:    uint32(nfs.MountProcMount),
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	}, "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fhstatus struct {
+		Status uint32
+		Handle [32]byte
+	}
+	if err := xdr.Read(res, &fhstatus); err != nil {
+		t.Fatal(err)
+	}
+	if fhstatus.Status != uint32(nfs.MountStatusOk) {
+		t.Fatalf("expected a MOUNT v1 MNT to succeed, got status %d", fhstatus.Status)
+	}
+	if rest, _ := io.ReadAll(res); len(rest) != 0 {
+		t.Fatalf("expected an fhstatus without auth flavors, got %d more bytes", len(rest))
+	}
+	// clients use the fixed size handle as they are given it.
+	if _, err := target.GetAttr(fhstatus.Handle[:]); err != nil {
+		t.Fatalf("expected the handle of MOUNT v1 to resolve: %v", err)
+	}
+
+	if _, err := target.Call(&rpc.Header{
+		Rpcvers: 2,
+		Prog:    nfsc.MountProg,
+		Vers:    4,
+		Proc:    uint32(nfs.MountProcNull),
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	}); err == nil {
+		t.Fatal("expected an unknown version of MOUNT to be refused")
+	}
+}
@@ -10,6 +10,9 @@ const FHSize = 64
 // MNTNameLen is the maximum size of a mount name
 const MNTNameLen = 255
 
+// mountPathMax is MNTPATHLEN, the longest dirpath of a MNT or UMNT.
+const mountPathMax = 1024
+
 // MntPathLen is the maximum size of a mount path
 const MntPathLen = 1024
 
@@ -74,6 +77,14 @@ const (
 	AuthFlavorUnix  AuthFlavor = 1
 	AuthFlavorShort AuthFlavor = 2
 	AuthFlavorDES   AuthFlavor = 3
+	// AuthFlavorRPCSECGSS is the flavor of calls made with RPCSEC_GSS, per rfc2203
+	AuthFlavorRPCSECGSS AuthFlavor = 6
+
+	// Pseudo-flavors advertised for RPCSEC_GSS with Kerberos V5, per rfc2623.
+	// These never appear as the flavor of a call.
+	AuthFlavorKrb5  AuthFlavor = 390003
+	AuthFlavorKrb5i AuthFlavor = 390004
+	AuthFlavorKrb5p AuthFlavor = 390005
 )
 
 // MountRequest contains the format of a client request to open a mount.
@@ -0,0 +1,110 @@
+package nfs
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// MountInfo is a mount of an export by a client.
+type MountInfo struct {
+	// Client is the address the client mounted from.
+	Client net.Addr
+	// Export is the path the client mounted.
+	Export string
+	// Time is when the client mounted the export.
+	Time time.Time
+	// Flavor is the authentication flavor of the client's MNT call.
+	Flavor AuthFlavor
+}
+
+// MountStore keeps the mounts of a server, from the MNT of an export by a
+// client to its UMNT. Clients are identified by address without the port,
+// since they unmount over another connection than the one they mounted over.
+// Servers behind a load balancer can share a store, such as a database, so
+// that each lists the mounts made through any of them, and clients may
+// unmount through another server than the one they mounted through.
+type MountStore interface {
+	// AddMount records a mount, replacing an earlier mount of the same
+	// export by the client.
+	AddMount(MountInfo) error
+	// RemoveMount forgets the mount of export by client, and RemoveMounts
+	// every mount of client.
+	RemoveMount(client net.Addr, export string) error
+	RemoveMounts(client net.Addr) error
+	// Mounts lists the mounts, oldest first.
+	Mounts() ([]MountInfo, error)
+}
+
+// mountTable is the MountStore of a server when it is given none.
+type mountTable struct {
+	mu     sync.Mutex
+	mounts []MountInfo
+}
+
+func (t *mountTable) AddMount(m MountInfo) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := clientKey(m.Client)
+	for i, old := range t.mounts {
+		if clientKey(old.Client) == key && old.Export == m.Export {
+			// mounting again, as after a client reboot, replaces the mount.
+			t.mounts = append(t.mounts[:i], t.mounts[i+1:]...)
+			break
+		}
+	}
+	t.mounts = append(t.mounts, m)
+	return nil
+}
+
+func (t *mountTable) RemoveMount(client net.Addr, export string) error {
+	t.remove(client, export, false)
+	return nil
+}
+
+func (t *mountTable) RemoveMounts(client net.Addr) error {
+	t.remove(client, "", true)
+	return nil
+}
+
+// remove forgets the mount of export by client, or all of its mounts when
+// all is set.
+func (t *mountTable) remove(client net.Addr, export string, all bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := clientKey(client)
+	kept := t.mounts[:0]
+	for _, m := range t.mounts {
+		if clientKey(m.Client) != key || !all && m.Export != export {
+			kept = append(kept, m)
+		}
+	}
+	t.mounts = kept
+}
+
+func (t *mountTable) Mounts() ([]MountInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]MountInfo(nil), t.mounts...), nil
+}
+
+// mountStore provides the MountStore of the server.
+func (s *Server) mountStore() MountStore {
+	if s.MountStore != nil {
+		return s.MountStore
+	}
+	return &s.mountTable
+}
+
+// Mounts lists the exports clients have mounted, oldest first. A mount lasts
+// until the client unmounts the export, which a client that crashed or lost
+// the server never does, so the list may hold mounts no longer in use.
+// NFSv4 clients don't mount, and aren't listed. The mounts of a MountStore
+// which fails to list them are logged and left out.
+func (s *Server) Mounts() []MountInfo {
+	mounts, err := s.mountStore().Mounts()
+	if err != nil {
+		Log.Errorf("listing mounts: %v", err)
+	}
+	return mounts
+}
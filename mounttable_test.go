@@ -0,0 +1,65 @@
+package nfs_test
+
+import (
+	"reflect"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestMounts(t *testing.T) {
+	mem := memfs.New()
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	mounts := srv.Mounts()
+	if len(mounts) != 1 || mounts[0].Export != "/" || mounts[0].Flavor != nfs.AuthFlavorNull || mounts[0].Time.IsZero() {
+		t.Fatalf("unexpected mounts %+v", mounts)
+	}
+
+	res, err := target.Call(&rpc.Header{
+		Rpcvers: 2,
+		Prog:    nfsc.MountProg,
+		Vers:    nfsc.MountVers,
+		Proc:    uint32(nfs.MountProcDump),
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dumped []string
+	for {
+		more, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if more == 0 {
+			break
+		}
+		var m struct {
+			Host string
+			Dir  string
+		}
+		if err := xdr.Read(res, &m); err != nil {
+			t.Fatal(err)
+		}
+		dumped = append(dumped, m.Host+":"+m.Dir)
+	}
+	if !reflect.DeepEqual(dumped, []string{"127.0.0.1:/"}) {
+		t.Fatalf("unexpected DUMP %v", dumped)
+	}
+
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if mounts := srv.Mounts(); len(mounts) != 0 {
+		t.Fatalf("expected UMNT to remove the mount, got %+v", mounts)
+	}
+}
@@ -0,0 +1,153 @@
+package nfs
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Names of entries and targets of links come from clients, and are checked
+// here before any procedure joins them to a path: a name must name a single
+// entry of the directory it is given with. The server applies no Unicode
+// normalization, nor case folding unless an export is CaseInsensitive, so
+// look-alikes of "/" or ".", such as U+2215 or U+FF0E, are names like any
+// other; filesystems that fold names, such as on Windows, refuse those they
+// can't keep apart.
+
+// pathMax bounds the target of a symbolic link, as PATH_MAX does locally.
+const pathMax = 4096
+
+// checkName validates a single path component supplied by a client. Names
+// that are empty, longer than PathNameMax, or that contain a NUL or a path
+// separator are refused, since joining them would not name a single entry
+// in the directory.
+func checkName(name []byte) error {
+	if len(name) == 0 {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+	if len(name) > PathNameMax {
+		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	}
+	for _, c := range name {
+		if c == 0 || c == '/' || c == os.PathSeparator {
+			return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+		}
+	}
+	return nil
+}
+
+// checkNewName validates the name of an entry about to be created. "." and
+// ".." always exist.
+func checkNewName(name []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if isDotEntry(name) {
+		return &NFSStatusError{NFSStatusExist, os.ErrExist}
+	}
+	return nil
+}
+
+// checkExistingName validates the name of an entry about to be removed or
+// renamed, or of a rename target, none of which can be "." or "..".
+func checkExistingName(name []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if isDotEntry(name) {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+	return nil
+}
+
+// checkLinkTarget validates the target of a symbolic link about to be made.
+// Targets are otherwise kept as given, since they are only resolved by
+// clients; an empty target or one with a NUL can't be stored.
+func checkLinkTarget(target []byte) error {
+	if len(target) > pathMax {
+		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	}
+	if len(target) == 0 {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+	for _, c := range target {
+		if c == 0 {
+			return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+		}
+	}
+	return nil
+}
+
+func isDotEntry(name []byte) bool {
+	return string(name) == "." || string(name) == ".."
+}
+
+// entryPath provides the path of the entry name of the directory at dir, in
+// a slice of its own so that dir, which may be shared, is left as it is. The
+// name must have been checked.
+func entryPath(dir []string, name []byte) []string {
+	p := make([]string, len(dir), len(dir)+1)
+	copy(p, dir)
+	return append(p, string(name))
+}
+
+// lookupPath provides the path name resolves to in the directory at dir,
+// resolving "." and "..". The parent of the root of an export is the root,
+// so that clients can't walk out of it. The name must have been checked.
+func lookupPath(dir []string, name []byte) []string {
+	switch string(name) {
+	case ".":
+		return append([]string(nil), dir...)
+	case "..":
+		if len(dir) == 0 {
+			return []string{}
+		}
+		return append([]string(nil), dir[:len(dir)-1]...)
+	}
+	return entryPath(dir, name)
+}
+
+// foldKey provides the form of name that names equal but for case share.
+func foldKey(name string) string {
+	return strings.ToLower(strings.ToUpper(name))
+}
+
+// foldedName provides the name of the entry of the directory at dir that
+// name refers to regardless of case: the entry of that very name when there
+// is one, and otherwise the first by name of those equal to it but for case.
+// Names matching no entry, such as those of entries about to be created, are
+// given as they are. The name must have been checked.
+func foldedName(fs billy.Filesystem, dir []string, name []byte) []byte {
+	if isDotEntry(name) {
+		return name
+	}
+	if _, err := fs.Lstat(fs.Join(entryPath(dir, name)...)); err == nil {
+		return name
+	}
+	entries, err := fs.ReadDir(fs.Join(dir...))
+	if err != nil {
+		return name
+	}
+	key := foldKey(string(name))
+	found := ""
+	for _, e := range entries {
+		if foldKey(e.Name()) == key && (found == "" || e.Name() < found) {
+			found = e.Name()
+		}
+	}
+	if found == "" {
+		return name
+	}
+	return []byte(found)
+}
+
+// caseName provides the name of the entry name refers to in the directory at
+// dir, folding its case when the export is CaseInsensitive.
+func caseName(ctx context.Context, fs billy.Filesystem, dir []string, name []byte) []byte {
+	if opts := exportOptionsFromContext(ctx); opts != nil && opts.foldsCase() {
+		return foldedName(fs, dir, name)
+	}
+	return name
+}
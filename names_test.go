@@ -0,0 +1,127 @@
+package nfs_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestNameValidation(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/dir/sub", 0755)
+
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	_, root, err := target.Lookup("/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		expected nfs.NFSStatus
+	}{
+		{"", nfs.NFSStatusInval},
+		{"dir/sub", nfs.NFSStatusInval},
+		{"dir\x00", nfs.NFSStatusInval},
+		{strings.Repeat("a", nfs.PathNameMax+1), nfs.NFSStatusNameTooLong},
+	} {
+		_, _, err := nfstest.Lookup(target.Target, root, tc.name)
+		var nerr *nfsc.Error
+		if !errors.As(err, &nerr) || nerr.ErrorNum != uint32(tc.expected) {
+			t.Fatalf("lookup %q: expected %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+	if _, _, err := nfstest.Lookup(target.Target, root, strings.Repeat("a", nfs.PathNameMax)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("lookup of a maximal name: expected not exist, got %v", err)
+	}
+}
+
+func TestNameTraversal(t *testing.T) {
+	dir := t.TempDir()
+	export := filepath.Join(dir, "export")
+	_ = os.MkdirAll(filepath.Join(export, "sub"), 0755)
+	fs := helpers.NewChangeOSFS(osfs.New(export))
+	srv := nfstest.ServeFS(t, fs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	_, sub, err := target.Lookup("/sub", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/etc", "../escaped", "sub/.."} {
+		_, _, err := nfstest.Lookup(target.Target, sub, name)
+		if !nfstest.IsStatus(err, nfs.NFSStatusInval) {
+			t.Fatalf("lookup %q: expected the name to be refused, got %v", name, err)
+		}
+	}
+	if err := target.Rename("/sub/..", "/moved"); !nfstest.IsStatus(err, nfs.NFSStatusInval) {
+		t.Fatalf("expected renaming .. to be refused, got %v", err)
+	}
+
+	// look-alikes of dots and slashes are names like any other.
+	for _, name := range []string{"．．", "∕escaped", "‥", "..∕escaped"} {
+		if _, err := target.Mkdir("/sub/"+name, 0755); err != nil {
+			t.Fatalf("mkdir %q: %v", name, err)
+		}
+		if info, err := os.Stat(filepath.Join(export, "sub", name)); err != nil || !info.IsDir() {
+			t.Fatalf("expected %q to be made in the directory: %v", name, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected nothing to be made outside the export, got %d entries", len(entries))
+	}
+
+	if err := target.Symlink("a\x00b", "/sub/nul"); !nfstest.IsStatus(err, nfs.NFSStatusInval) {
+		t.Fatalf("expected a target with a NUL to be refused, got %v", err)
+	}
+	if err := target.Symlink("", "/sub/empty"); !nfstest.IsStatus(err, nfs.NFSStatusInval) {
+		t.Fatalf("expected an empty target to be refused, got %v", err)
+	}
+	if err := target.Symlink("../../outside", "/sub/link"); err != nil {
+		t.Fatalf("expected a target to be kept as given: %v", err)
+	}
+	if got, err := os.Readlink(filepath.Join(export, "sub", "link")); err != nil || got != "../../outside" {
+		t.Fatalf("unexpected target %q: %v", got, err)
+	}
+}
+
+func TestRequireUTF8(t *testing.T) {
+	mem := memfs.New()
+	for _, name := range []string{"/dir/caf\xe9", "/dir/ok"} {
+		if err := billyutil.WriteFile(mem, name, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{RequireUTF8: true})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	entries, err := nfstest.ReadDir(target.Target, "/dir")
+	if err != nil || len(entries) != 1 || entries[0].FileName != "ok" {
+		t.Fatalf("expected only the UTF-8 name to be listed, got %v: %v", entries, err)
+	}
+	_, dir, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := nfstest.Lookup(target.Target, dir, "caf\xe9"); !nfstest.IsStatus(err, nfs.NFSStatusInval) {
+		t.Fatalf("expected a name which isn't UTF-8 to be refused, got %v", err)
+	}
+	if _, err := target.Mkdir("/dir/\xff", 0755); !nfstest.IsStatus(err, nfs.NFSStatusInval) {
+		t.Fatalf("expected creating a name which isn't UTF-8 to be refused, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 const (
 	nfsServiceID = 100003
+	nfs3Version  = 3
 )
 
 func init() {
@@ -0,0 +1,350 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// NFSv4 has a single procedure besides NULL: COMPOUND, which carries a list
+// of operations run in order against a current filehandle, per rfc7530
+// section 15. Operations are registered with registerNFS4Op, so that they can
+// be added individually. From minor version 1, COMPOUNDs run within a session
+// started by their SEQUENCE, per rfc8881 section 2.10.
+const (
+	nfs4Version      = 4
+	nfs4ProcNull     = 0
+	nfs4ProcCompound = 1
+
+	// nfs4MaxMinorVersion is the highest minor version COMPOUNDs are served
+	// for.
+	nfs4MaxMinorVersion = 2
+	// nfs4TagMax bounds the tag of a COMPOUND, which is echoed in the reply.
+	nfs4TagMax = 1024
+	// nfs4MaxOps bounds the number of operations of a COMPOUND.
+	nfs4MaxOps = 128
+	// nfs4FHSize is the maximum size of an nfs_fh4.
+	nfs4FHSize = 128
+)
+
+var nfs4Handlers = map[uint32]HandleFunc{
+	nfs4ProcNull:     onNull,
+	nfs4ProcCompound: onCompound,
+}
+
+// NFS4Operation is an operation of a COMPOUND, per rfc7530 section 16.
+type NFS4Operation uint32
+
+// NFSv4.0 operations
+const (
+	NFS4OpAccess NFS4Operation = iota + 3
+	NFS4OpClose
+	NFS4OpCommit
+	NFS4OpCreate
+	NFS4OpDelegPurge
+	NFS4OpDelegReturn
+	NFS4OpGetAttr
+	NFS4OpGetFH
+	NFS4OpLink
+	NFS4OpLock
+	NFS4OpLockT
+	NFS4OpLockU
+	NFS4OpLookup
+	NFS4OpLookupP
+	NFS4OpNVerify
+	NFS4OpOpen
+	NFS4OpOpenAttr
+	NFS4OpOpenConfirm
+	NFS4OpOpenDowngrade
+	NFS4OpPutFH
+	NFS4OpPutPubFH
+	NFS4OpPutRootFH
+	NFS4OpRead
+	NFS4OpReadDir
+	NFS4OpReadLink
+	NFS4OpRemove
+	NFS4OpRename
+	NFS4OpRenew
+	NFS4OpRestoreFH
+	NFS4OpSaveFH
+	NFS4OpSecInfo
+	NFS4OpSetAttr
+	NFS4OpSetClientID
+	NFS4OpSetClientIDConfirm
+	NFS4OpVerify
+	NFS4OpWrite
+	NFS4OpReleaseLockOwner
+
+	NFS4OpIllegal NFS4Operation = 10044
+)
+
+// NFSv4.1 and NFSv4.2 operations
+const (
+	NFS4OpBindConnToSession NFS4Operation = 41
+	NFS4OpExchangeID        NFS4Operation = 42
+	NFS4OpCreateSession     NFS4Operation = 43
+	NFS4OpDestroySession    NFS4Operation = 44
+	NFS4OpSequence          NFS4Operation = 53
+	NFS4OpDestroyClientID   NFS4Operation = 57
+	NFS4OpReclaimComplete   NFS4Operation = 58
+	NFS4OpReadPlus          NFS4Operation = 68
+)
+
+// lastNFS4Op is the highest numbered operation defined by each minor version.
+var lastNFS4Op = [...]NFS4Operation{0: NFS4OpReleaseLockOwner, 1: 58, 2: 74}
+
+// NFSv4 statuses. The statuses shared with NFSv3 keep their values.
+const (
+	NFSStatusResource          NFSStatus = 10018
+	NFSStatusNoFileHandle      NFSStatus = 10020
+	NFSStatusMinorVersMismatch NFSStatus = 10021
+	NFSStatusRestoreFH         NFSStatus = 10030
+	NFSStatusAttrNotSupp       NFSStatus = 10032
+	NFSStatusBadXDR            NFSStatus = 10036
+	NFSStatusBadOwner          NFSStatus = 10039
+	NFSStatusBadName           NFSStatus = 10041
+	NFSStatusOpIllegal         NFSStatus = 10044
+)
+
+// compoundState is threaded through the operations of a COMPOUND.
+type compoundState struct {
+	*response
+	handler      Handler
+	minorVersion uint32
+	// current and saved are the current and saved filehandles, nil until
+	// set.
+	current []byte
+	saved   []byte
+	// session and slot are those the SEQUENCE of the COMPOUND was sent on,
+	// nil without one, whose reply is cached when cache is set. replay is
+	// the cached reply of a SEQUENCE sent again.
+	session *nfs4Session
+	slot    uint32
+	cache   bool
+	replay  []byte
+}
+
+// clientID provides the clientid of the session of the COMPOUND, or that an
+// NFSv4.0 operation gives.
+func (s *compoundState) clientID(given uint64) uint64 {
+	if s.session != nil {
+		return s.session.client.clientID
+	}
+	return given
+}
+
+// exportOptions provides the options of the export fs, if the handler
+// applies any.
+func (s *compoundState) exportOptions(ctx context.Context, fs billy.Filesystem) *ExportOptions {
+	if eh, ok := s.handler.(ExportHandler); ok {
+		return eh.ExportOptions(ctx, s.conn, fs)
+	}
+	return nil
+}
+
+// checkClientCert refuses filehandles of exports requiring a client
+// certificate the client lacks, as they come into the COMPOUND. Those
+// reached from them by LOOKUP are of the same export.
+func (s *compoundState) checkClientCert(ctx context.Context, fs billy.Filesystem) error {
+	if opts := s.exportOptions(ctx, fs); opts != nil {
+		if err := opts.checkClientCert(s.conn); err != nil {
+			return &NFSStatusError{NFSStatusAccess, err}
+		}
+	}
+	return nil
+}
+
+// currentObject resolves the current filehandle.
+func (s *compoundState) currentObject() (billy.Filesystem, []string, error) {
+	if s.current == nil {
+		return nil, nil, &NFSStatusError{NFSStatusNoFileHandle, nil}
+	}
+	fs, p, err := s.handler.FromHandle(s.current)
+	if err != nil {
+		return nil, nil, &NFSStatusError{NFSStatusStale, err}
+	}
+	return fs, p, nil
+}
+
+// currentFS resolves the current filehandle of an operation acting on it,
+// which fails with NFS4ERR_MOVED within a referral.
+func (s *compoundState) currentFS(ctx context.Context) (billy.Filesystem, []string, error) {
+	fs, p, err := s.currentObject()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.checkMoved(ctx, fs, p); err != nil {
+		return nil, nil, err
+	}
+	return fs, p, nil
+}
+
+// nfs4OpFunc runs a single operation of a COMPOUND. It decodes its arguments
+// from args and writes the result that follows the status of the operation to
+// res. The status is taken from the returned error, which ends the COMPOUND.
+type nfs4OpFunc func(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error
+
+type nfs4OpEntry struct {
+	minorVersion uint32
+	// until is the minor version the operation is withdrawn from, or zero.
+	until uint32
+	fn    nfs4OpFunc
+}
+
+var nfs4Ops = make(map[NFS4Operation]nfs4OpEntry)
+
+// registerNFS4Op makes op available to COMPOUNDs of minorVersion and later.
+func registerNFS4Op(op NFS4Operation, minorVersion uint32, fn nfs4OpFunc) {
+	nfs4Ops[op] = nfs4OpEntry{minorVersion: minorVersion, fn: fn}
+}
+
+// retireNFS4Op withdraws a registered op from COMPOUNDs of minorVersion and
+// later, which fail it with NFS4ERR_NOTSUPP, as the minor versions replacing
+// it require.
+func retireNFS4Op(op NFS4Operation, minorVersion uint32) {
+	entry := nfs4Ops[op]
+	entry.until = minorVersion
+	nfs4Ops[op] = entry
+}
+
+// served reports whether the op of entry is served in COMPOUNDs of minor.
+func (e nfs4OpEntry) served(minor uint32) bool {
+	return e.minorVersion <= minor && (e.until == 0 || minor < e.until)
+}
+
+// nfs4SessionlessOps are the operations which may be sent alone without a
+// SEQUENCE, per rfc8881 section 2.6.3.1.1.8.
+var nfs4SessionlessOps = map[NFS4Operation]bool{
+	NFS4OpBindConnToSession: true,
+	NFS4OpExchangeID:        true,
+	NFS4OpCreateSession:     true,
+	NFS4OpDestroySession:    true,
+	NFS4OpDestroyClientID:   true,
+}
+
+// checkSequence places SEQUENCE first in the COMPOUNDs of minor versions with
+// sessions, where it may only be left out of those of a single operation
+// establishing or ending them.
+func checkSequence(minor, count, n uint32, op NFS4Operation) error {
+	switch {
+	case minor == 0:
+		return nil
+	case n > 0 && op == NFS4OpSequence:
+		return &NFSStatusError{NFSStatusSequencePos, nil}
+	case n > 0 || op == NFS4OpSequence:
+		return nil
+	case !nfs4SessionlessOps[op]:
+		return &NFSStatusError{NFSStatusOpNotInSession, nil}
+	case count > 1:
+		return &NFSStatusError{NFSStatusNotOnlyOp, nil}
+	}
+	return nil
+}
+
+func nfs4Status(err error) NFSStatus {
+	if err == nil {
+		return NFSStatusOk
+	}
+	var nerr *NFSStatusError
+	if errors.As(err, &nerr) {
+		return nerr.NFSStatus
+	}
+	var garbage *ResponseCodeGarbageArgsError
+	if errors.As(err, &garbage) {
+		return NFSStatusBadXDR
+	}
+	return StatusFromError(err, NFSStatusServerFault)
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	var v uint64
+	err := xdr.Read(r, &v)
+	return v, err
+}
+
+func onCompound(ctx context.Context, w *response, userHandle Handler) error {
+	tag, err := readBoundedOpaque(w.req.Body, nfs4TagMax)
+	if err != nil {
+		return writeCompound(w, NFSStatusBadXDR, nil, 0, nil)
+	}
+	minor, err := xdr.ReadUint32(w.req.Body)
+	if err != nil {
+		return writeCompound(w, NFSStatusBadXDR, tag, 0, nil)
+	}
+	if minor > nfs4MaxMinorVersion {
+		return writeCompound(w, NFSStatusMinorVersMismatch, tag, 0, nil)
+	}
+	count, err := xdr.ReadUint32(w.req.Body)
+	if err != nil {
+		return writeCompound(w, NFSStatusBadXDR, tag, 0, nil)
+	}
+	if count > nfs4MaxOps {
+		return writeCompound(w, NFSStatusResource, tag, 0, nil)
+	}
+
+	s := &compoundState{response: w, handler: userHandle, minorVersion: minor}
+	results := bytes.NewBuffer([]byte{})
+	status := NFSStatusOk
+	var n uint32
+	for ; n < count && status == NFSStatusOk; n++ {
+		code, err := xdr.ReadUint32(w.req.Body)
+		if err != nil {
+			status = NFSStatusBadXDR
+			break
+		}
+		op := NFS4Operation(code)
+		res := bytes.NewBuffer([]byte{})
+		if op < NFS4OpAccess || op > lastNFS4Op[minor] {
+			op = NFS4OpIllegal
+			status = NFSStatusOpIllegal
+		} else if err := checkSequence(minor, count, n, op); err != nil {
+			status = nfs4Status(err)
+		} else if entry, ok := nfs4Ops[op]; ok && entry.served(minor) {
+			status = nfs4Status(entry.fn(ctx, s, w.req.Body, res))
+		} else {
+			status = NFSStatusNotSupp
+		}
+		Log.Tracef("nfs4 op %d: %v", op, status)
+		if s.replay != nil {
+			if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+				return err
+			}
+			return w.Write(s.replay)
+		}
+
+		_ = xdr.Write(results, uint32(op))
+		_ = xdr.Write(results, uint32(status))
+		results.Write(res.Bytes())
+	}
+	reply := compoundReply(status, tag, n, results.Bytes())
+	if s.session != nil {
+		s.conn.Server.nfs4State.completeSlot(s.session, s.slot, s.cache, reply)
+	}
+	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+		return err
+	}
+	return w.Write(reply)
+}
+
+// compoundReply encodes the reply to a COMPOUND: the status of its last
+// operation, its tag, and the results of the n operations that were run.
+func compoundReply(status NFSStatus, tag []byte, n uint32, results []byte) []byte {
+	writer := bytes.NewBuffer([]byte{})
+	_ = xdr.Write(writer, uint32(status))
+	_ = xdr.Write(writer, tag)
+	_ = xdr.Write(writer, n)
+	writer.Write(results)
+	return writer.Bytes()
+}
+
+// writeCompound writes the reply to a COMPOUND that isn't run.
+func writeCompound(w *response, status NFSStatus, tag []byte, n uint32, results []byte) error {
+	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+		return err
+	}
+	return w.Write(compoundReply(status, tag, n, results))
+}
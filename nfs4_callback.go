@@ -0,0 +1,210 @@
+package nfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// The NFSv4.0 callback program, per rfc7530 section 17. The server is the RPC
+// client of the callback program, which a client serves at the address it
+// gives in SETCLIENTID.
+//
+// CB_NOTIFY is only defined for NFSv4.1, whose callbacks are carried by the
+// backchannel of a session rather than by a connection of their own, and so
+// is not sent.
+const (
+	nfs4CBVersion      = 1
+	nfs4CBProcNull     = 0
+	nfs4CBProcCompound = 1
+	nfs4CBOpRecall     = 4
+
+	// nfs4CBTimeout bounds a callback which is given no deadline.
+	nfs4CBTimeout = 5 * time.Second
+	// nfs4CBReplyMax bounds the reply to a callback.
+	nfs4CBReplyMax = 64 * 1024
+)
+
+var errCallbackDown = errors.New("callback path is down")
+
+var nfs4CBXid uint32
+
+// nfs4Callback is the callback path a client gave in SETCLIENTID.
+type nfs4Callback struct {
+	program uint32
+	netid   string
+	addr    string
+	ident   uint32
+}
+
+// parseUniversalAddr converts a universal address, per rfc5665 section 5.2.3,
+// to a network and address for net.Dial.
+func parseUniversalAddr(netid, uaddr string) (string, string, error) {
+	if netid != "tcp" && netid != "tcp6" {
+		return "", "", fmt.Errorf("unsupported callback netid %q", netid)
+	}
+	parts := strings.Split(uaddr, ".")
+	if len(parts) < 3 {
+		return "", "", fmt.Errorf("invalid universal address %q", uaddr)
+	}
+	hi, err1 := strconv.ParseUint(parts[len(parts)-2], 10, 8)
+	lo, err2 := strconv.ParseUint(parts[len(parts)-1], 10, 8)
+	ip := net.ParseIP(strings.Join(parts[:len(parts)-2], "."))
+	if err1 != nil || err2 != nil || ip == nil {
+		return "", "", fmt.Errorf("invalid universal address %q", uaddr)
+	}
+	return netid, net.JoinHostPort(ip.String(), strconv.Itoa(int(hi<<8|lo))), nil
+}
+
+// call makes a single call to the callback program, on a connection of its
+// own, and returns the results of an accepted reply.
+func (cb *nfs4Callback) call(ctx context.Context, proc uint32, args []byte) ([]byte, error) {
+	network, address, err := parseUniversalAddr(cb.netid, cb.addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(nfs4CBTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(deadline)
+
+	xid := atomic.AddUint32(&nfs4CBXid, 1)
+	msg := bytes.NewBuffer(make([]byte, 4))
+	_ = xdr.Write(msg, xid)
+	_ = xdr.Write(msg, uint32(0)) // CALL
+	_ = xdr.Write(msg, &rpc.Header{
+		Rpcvers: 2,
+		Prog:    cb.program,
+		Vers:    nfs4CBVersion,
+		Proc:    proc,
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	})
+	msg.Write(args)
+	frame := msg.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4)|1<<31)
+	if _, err := c.Write(frame); err != nil {
+		return nil, err
+	}
+
+	reply, err := readRecord(bufio.NewReader(c), nfs4CBReplyMax)
+	if err != nil {
+		return nil, err
+	}
+	return parseCallbackReply(bytes.NewReader(reply), xid)
+}
+
+// readRecord reads an RPC record of at most max bytes from its fragments.
+func readRecord(r io.Reader, max uint32) ([]byte, error) {
+	var record []byte
+	for {
+		fragment, err := xdr.ReadUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		size := fragment &^ (1 << 31)
+		if uint32(len(record))+size > max {
+			return nil, ErrInputInvalid
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		record = append(record, buf...)
+		if fragment&(1<<31) != 0 {
+			return record, nil
+		}
+	}
+}
+
+func parseCallbackReply(r *bytes.Reader, xid uint32) ([]byte, error) {
+	var hdr [3]uint32
+	for i := range hdr {
+		v, err := xdr.ReadUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		hdr[i] = v
+	}
+	if hdr[0] != xid || hdr[1] != 1 {
+		return nil, ErrInputInvalid
+	}
+	if hdr[2] != rpc.MsgAccepted {
+		return nil, errors.New("callback was denied")
+	}
+	if _, err := xdr.ReadUint32(r); err != nil { // verifier flavor
+		return nil, err
+	}
+	if _, err := readBoundedOpaque(r, maxAuthBytes); err != nil {
+		return nil, err
+	}
+	stat, err := xdr.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if stat != rpc.Success {
+		return nil, fmt.Errorf("callback was not accepted: %d", stat)
+	}
+	rest := make([]byte, r.Len())
+	_, _ = r.Read(rest)
+	return rest, nil
+}
+
+// probe checks the callback path with CB_NULL.
+func (cb *nfs4Callback) probe(ctx context.Context) error {
+	_, err := cb.call(ctx, nfs4CBProcNull, nil)
+	return err
+}
+
+// recall asks the client to return the delegation sid of fh, with CB_RECALL.
+// When truncate is set, the file is about to be truncated to zero length.
+func (cb *nfs4Callback) recall(ctx context.Context, sid nfs4Stateid, truncate bool, fh []byte) error {
+	args := bytes.NewBuffer([]byte{})
+	_ = xdr.Write(args, "")
+	_ = xdr.Write(args, uint32(0)) // minorversion
+	_ = xdr.Write(args, cb.ident)
+	_ = xdr.Write(args, uint32(1))
+	_ = xdr.Write(args, uint32(nfs4CBOpRecall))
+	_ = xdr.Write(args, sid.Seqid)
+	args.Write(sid.Other[:])
+	trunc := uint32(0)
+	if truncate {
+		trunc = 1
+	}
+	_ = xdr.Write(args, trunc)
+	_ = xdr.Write(args, fh)
+
+	res, err := cb.call(ctx, nfs4CBProcCompound, args.Bytes())
+	if err != nil {
+		return err
+	}
+	status, err := xdr.ReadUint32(bytes.NewReader(res))
+	if err != nil {
+		return err
+	}
+	if NFSStatus(status) != NFSStatusOk {
+		return &NFSStatusError{NFSStatus(status), nil}
+	}
+	return nil
+}
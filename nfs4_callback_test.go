@@ -0,0 +1,97 @@
+package nfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestNFSv4CallbackProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	probes := make(chan rpc.Header, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var frame, xid, mtype uint32
+		var hdr rpc.Header
+		_ = xdr.Read(c, &frame)
+		_ = xdr.Read(c, &xid)
+		_ = xdr.Read(c, &mtype)
+		if err := xdr.Read(c, &hdr); err != nil {
+			return
+		}
+		// an accepted, successful reply with a null verifier.
+		var reply bytes.Buffer
+		_ = xdr.Write(&reply, uint32(1<<31|24))
+		for _, v := range []uint32{xid, 1, 0, 0, 0, 0} {
+			_ = xdr.Write(&reply, v)
+		}
+		_, _ = c.Write(reply.Bytes())
+		probes <- hdr
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:     helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 1024),
+		EnableNFSv4: true,
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	var ops bytes.Buffer
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetClientID))
+	ops.Write([]byte("verifier"))
+	_ = xdr.Write(&ops, "client-1")
+	_ = xdr.Write(&ops, uint32(0x40000000))
+	_ = xdr.Write(&ops, "tcp")
+	_ = xdr.Write(&ops, fmt.Sprintf("127.0.0.1.%d.%d", port>>8, port&0xff))
+	_ = xdr.Write(&ops, uint32(1))
+	res, err := compound4(target, 1, ops.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ { // status, tag, count, op and op status
+		_, _ = xdr.ReadUint32(res)
+	}
+	var clientID uint64
+	var confirm [8]byte
+	_ = xdr.Read(res, &clientID)
+	_, _ = io.ReadFull(res, confirm[:])
+	ops.Reset()
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetClientIDConfirm))
+	_ = xdr.Write(&ops, clientID)
+	ops.Write(confirm[:])
+	res, err = compound4(target, 1, ops.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := xdr.ReadUint32(res); st != 0 {
+		t.Fatalf("expected SETCLIENTID_CONFIRM to succeed, got %d", st)
+	}
+
+	select {
+	case hdr := <-probes:
+		if hdr.Prog != 0x40000000 || hdr.Vers != 1 || hdr.Proc != 0 {
+			t.Fatalf("expected CB_NULL to the callback program, got %+v", hdr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the callback path to be probed")
+	}
+}
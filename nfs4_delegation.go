@@ -0,0 +1,127 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+)
+
+// The types of delegation an OPEN grants, per rfc7530 section 10.4.
+const (
+	nfs4DelegNone  = 0
+	nfs4DelegRead  = 1
+	nfs4DelegWrite = 2
+)
+
+var errDelegated = errors.New("file is delegated to another client")
+
+// breakDelegations recalls the delegations of fh held by clients other than
+// clientID which a call conflicts with: any delegation when write is set, and
+// write delegations otherwise. While any is outstanding it fails with
+// NFS3ERR_JUKEBOX, which is also NFS4ERR_DELAY, for the call to be retried.
+// Delegations not returned a lease after their recall are revoked, as are
+// those whose holder can't be reached, per rfc7530 section 10.4.6.
+func (m *nfs4StateManager) breakDelegations(fh []byte, clientID uint64, write bool) error {
+	m.mu.Lock()
+	now := time.Now()
+	m.expire(now)
+	var recalls []nfs4Stateid
+	pending := false
+	for _, c := range m.clients {
+		if c.clientID == clientID {
+			continue
+		}
+		for other, s := range c.states {
+			if s.kind != nfs4DelegState || !bytes.Equal(s.fh, fh) {
+				continue
+			}
+			if !write && s.access&nfs4ShareAccessWrite == 0 {
+				continue
+			}
+			switch {
+			case s.recalled.IsZero():
+				s.recalled = now
+				recalls = append(recalls, nfs4Stateid{Seqid: s.seqid, Other: other})
+			case now.Sub(s.recalled) > m.lease:
+				Log.Debugf("revoking the delegation of nfsv4 client %x", c.clientID)
+				delete(c.states, other)
+				continue
+			}
+			pending = true
+		}
+	}
+	m.mu.Unlock()
+
+	for _, sid := range recalls {
+		go m.recallDelegation(sid)
+	}
+	if pending {
+		return &NFSStatusError{NFSStatusJukebox, errDelegated}
+	}
+	return nil
+}
+
+// recallDelegation sends the recall of a delegation, revoking it when the
+// recall fails.
+func (m *nfs4StateManager) recallDelegation(sid nfs4Stateid) {
+	err := m.recall(context.Background(), sid, false)
+	if err == nil {
+		return
+	}
+	Log.Debugf("unable to recall nfsv4 delegation: %v", err)
+	m.removeState(sid)
+}
+
+// delegated reports whether any client holds a delegation.
+func (m *nfs4StateManager) delegated() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.clients {
+		for _, s := range c.states {
+			if s.kind == nfs4DelegState {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// holder provides the clientid of the client a stateid was issued to, or zero
+// for the special stateids and those that aren't known.
+func (m *nfs4StateManager) holder(sid nfs4Stateid) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.clients {
+		if _, ok := c.states[sid.Other]; ok {
+			return c.clientID
+		}
+	}
+	return 0
+}
+
+// breakDelegations recalls the NFSv4 delegations an NFSv3 call conflicts
+// with before it is dispatched: those of the files it modifies, and the write
+// delegations of files it reads.
+func (s *Server) breakDelegations(op *Operation) error {
+	if s.nfs4State == nil || !s.NFS4Delegations {
+		return nil
+	}
+	write := isModifyingProcedure(op.Procedure)
+	if !write && op.Procedure != NFSProcedureRead {
+		return nil
+	}
+	if !s.nfs4State.delegated() {
+		return nil
+	}
+	h := s.handler()
+	for _, p := range [][]string{op.Path, op.To} {
+		if p == nil {
+			continue
+		}
+		if err := s.nfs4State.breakDelegations(h.ToHandle(op.Filesystem, p), 0, write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
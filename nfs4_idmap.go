@@ -0,0 +1,61 @@
+package nfs
+
+import (
+	"context"
+	"strconv"
+)
+
+// NFSv4 names owners by strings rather than ids, per rfc7530 section 5.9.
+// As Linux's nfsd and idmapd do, ids are named through the IDMapper of the
+// server, as "user@domain", and given by their decimal form when the mapper
+// has no name for them. Names given by clients which are decimal numbers
+// without a domain are taken as ids as they are, and others are mapped, or
+// refused with NFS4ERR_BADOWNER.
+
+// owner provides the owner attribute of uid.
+func (s *compoundState) owner(ctx context.Context, uid uint32) string {
+	name, err := s.Server.idMapper().UserName(ctx, uid)
+	if err != nil || name == "" {
+		return strconv.FormatUint(uint64(uid), 10)
+	}
+	return name
+}
+
+// ownerGroup provides the owner_group attribute of gid.
+func (s *compoundState) ownerGroup(ctx context.Context, gid uint32) string {
+	name, err := s.Server.idMapper().GroupName(ctx, gid)
+	if err != nil || name == "" {
+		return strconv.FormatUint(uint64(gid), 10)
+	}
+	return name
+}
+
+// ownerUID provides the uid of an owner attribute given by a client.
+func (s *compoundState) ownerUID(ctx context.Context, owner string) (uint32, error) {
+	if id, ok := numericOwner(owner); ok {
+		return id, nil
+	}
+	uid, err := s.Server.idMapper().UID(ctx, owner)
+	if err != nil {
+		return 0, &NFSStatusError{NFSStatusBadOwner, err}
+	}
+	return uid, nil
+}
+
+// ownerGID provides the gid of an owner_group attribute given by a client.
+func (s *compoundState) ownerGID(ctx context.Context, group string) (uint32, error) {
+	if id, ok := numericOwner(group); ok {
+		return id, nil
+	}
+	gid, err := s.Server.idMapper().GID(ctx, group)
+	if err != nil {
+		return 0, &NFSStatusError{NFSStatusBadOwner, err}
+	}
+	return gid, nil
+}
+
+// numericOwner parses an owner which is the decimal form of an id.
+func numericOwner(owner string) (uint32, bool) {
+	id, err := strconv.ParseUint(owner, 10, 32)
+	return uint32(id), err == nil
+}
@@ -0,0 +1,103 @@
+package nfs_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestNFSv4Owners(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := changeOS{osfs.New(dir), dir}
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:     helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024),
+		EnableNFSv4: true,
+		IDMapper:    nfs.NumericIDMapper{Domain: "example.com"},
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	// setattr sets the owner and group given by name, or by a bare id, and
+	// the mode.
+	setattr := func(owner, group string) (uint32, error) {
+		var attrs bytes.Buffer
+		_ = xdr.Write(&attrs, uint32(0600))
+		_ = xdr.Write(&attrs, owner)
+		_ = xdr.Write(&attrs, group)
+		var ops bytes.Buffer
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpPutRootFH))
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpLookup))
+		_ = xdr.Write(&ops, "f")
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetAttr))
+		ops.Write(make([]byte, 16))
+		_ = xdr.Write(&ops, []uint32{0, 1<<1 | 1<<4 | 1<<5})
+		_ = xdr.Write(&ops, attrs.Bytes())
+		res, err := compound4(target, 3, ops.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		status, _ := xdr.ReadUint32(res)
+		return status, nil
+	}
+	if status, err := setattr("1000@example.com", "100"); err != nil || status != uint32(nfs.NFSStatusOk) {
+		t.Fatalf("expected the owner to be set, got %d: %v", status, err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", info.Mode())
+	}
+	if status, _ := setattr("alice@example.com", "100"); status != uint32(nfs.NFSStatusBadOwner) {
+		t.Fatalf("expected a name the mapper doesn't know to be refused, got %d", status)
+	}
+
+	// the owner is read back by GETATTR, where the server could give it.
+	if os.Geteuid() != 0 {
+		return
+	}
+	var ops bytes.Buffer
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpPutRootFH))
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpLookup))
+	_ = xdr.Write(&ops, "f")
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpGetAttr))
+	_ = xdr.Write(&ops, []uint32{0, 1<<4 | 1<<5})
+	res, err := compound4(target, 3, ops.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := xdr.ReadUint32(res); status != uint32(nfs.NFSStatusOk) {
+		t.Fatalf("expected GETATTR to succeed, got %d", status)
+	}
+	_, _ = xdr.ReadOpaque(res)
+	_, _ = xdr.ReadUint32(res)
+	for i := 0; i < 2; i++ {
+		_, _ = xdr.ReadUint32(res)
+		_, _ = xdr.ReadUint32(res)
+	}
+	_, _ = xdr.ReadUint32(res) // op
+	_, _ = xdr.ReadUint32(res) // status
+	var bitmap []uint32
+	if err := xdr.Read(res, &bitmap); err != nil {
+		t.Fatal(err)
+	}
+	values, _ := xdr.ReadOpaque(res)
+	r := bytes.NewReader(values)
+	owner, _ := xdr.ReadOpaque(r)
+	group, _ := xdr.ReadOpaque(r)
+	if string(owner) != "1000@example.com" || string(group) != "100@example.com" {
+		t.Fatalf("expected the owner and group by name, got %q and %q", owner, group)
+	}
+}
@@ -0,0 +1,408 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func init() {
+	registerNFS4Op(NFS4OpGetAttr, 0, onNFS4GetAttr)
+	registerNFS4Op(NFS4OpSetAttr, 0, onNFS4SetAttr)
+}
+
+// The attributes of fattr4 served, per rfc7530 section 5. Attributes are
+// numbered by their bit in a bitmap4, and encoded in that order.
+const (
+	nfs4AttrSupportedAttrs = 0
+	nfs4AttrType           = 1
+	nfs4AttrChange         = 3
+	nfs4AttrSize           = 4
+	nfs4AttrFsid           = 8
+	nfs4AttrFileid         = 20
+	nfs4AttrFsLocations    = 24
+	nfs4AttrMode           = 33
+	nfs4AttrNumLinks       = 35
+	nfs4AttrOwner          = 36
+	nfs4AttrOwnerGroup     = 37
+	nfs4AttrTimeModify     = 53
+	nfs4AttrSecLabel       = 80
+
+	// nfs4BitmapMax bounds the words of a bitmap4 given by a client.
+	nfs4BitmapMax = 8
+	// nfs4AttrListMax bounds the encoded attributes given by a client.
+	nfs4AttrListMax = 4096
+	// nfs4SecLabelMax bounds the sec_label given by a client.
+	nfs4SecLabelMax = 1024
+)
+
+// nfs4Attrs are the attributes served by GETATTR.
+var nfs4Attrs = bitmap4Of(nfs4AttrSupportedAttrs, nfs4AttrType, nfs4AttrChange, nfs4AttrSize, nfs4AttrFsid,
+	nfs4AttrFileid, nfs4AttrFsLocations, nfs4AttrMode, nfs4AttrNumLinks, nfs4AttrOwner, nfs4AttrOwnerGroup,
+	nfs4AttrTimeModify)
+
+// nfs4ReferralAttrs are the attributes GETATTR serves of objects within a
+// referral, per rfc7530 section 8.4.1. Asking for others fails with
+// NFS4ERR_MOVED.
+var nfs4ReferralAttrs = bitmap4Of(nfs4AttrSupportedAttrs, nfs4AttrFsid, nfs4AttrFsLocations)
+
+// nfs4SettableAttrs are the attributes SETATTR sets.
+var nfs4SettableAttrs = bitmap4Of(nfs4AttrMode, nfs4AttrOwner, nfs4AttrOwnerGroup)
+
+// nfs4SecLabel is the sec_label4 of a file, per rfc7862 section 12.2.2. Labels
+// are taken as SELinux contexts, and are served with the default format.
+type nfs4SecLabel struct {
+	LFS  uint32
+	PI   uint32
+	Data []byte
+}
+
+// hasSecLabel reports whether the sec_label of objects of fs is served, as it
+// is from minor version 2 of filesystems storing extended attributes.
+func (s *compoundState) hasSecLabel(fs billy.Filesystem) bool {
+	if _, ok := fs.(XattrFilesystem); !ok || s.minorVersion < 2 {
+		return false
+	}
+	return CapabilitiesOf(s.handler, fs)&CapabilityXattrs != 0
+}
+
+// supportedAttrs provides the attributes GETATTR serves of objects of fs.
+func (s *compoundState) supportedAttrs(fs billy.Filesystem) bitmap4 {
+	if s.hasSecLabel(fs) {
+		return nfs4Attrs.union(bitmap4Of(nfs4AttrSecLabel))
+	}
+	return nfs4Attrs
+}
+
+// settableAttrs provides the attributes SETATTR sets of objects of fs.
+func (s *compoundState) settableAttrs(fs billy.Filesystem) bitmap4 {
+	if s.hasSecLabel(fs) {
+		return nfs4SettableAttrs.union(bitmap4Of(nfs4AttrSecLabel))
+	}
+	return nfs4SettableAttrs
+}
+
+// readSecLabel reads the sec_label of the attributes given by a client.
+func readSecLabel(r io.Reader) ([]byte, error) {
+	// the lfs and pi of its format.
+	for i := 0; i < 2; i++ {
+		if _, err := xdr.ReadUint32(r); err != nil {
+			return nil, &NFSStatusError{NFSStatusBadXDR, err}
+		}
+	}
+	label, err := readBoundedOpaque(r, nfs4SecLabelMax)
+	if err != nil {
+		return nil, &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	return label, nil
+}
+
+// secLabel provides the sec_label of the file at path, which is empty when it
+// has none.
+func secLabel(fs billy.Filesystem, path string) (nfs4SecLabel, error) {
+	label, err := fs.(XattrFilesystem).Getxattr(path, SecLabelXattr)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nfs4SecLabel{}, statusError(err, NFSStatusIO)
+	}
+	return nfs4SecLabel{Data: label}, nil
+}
+
+// setSecLabel sets the sec_label of the file at path.
+func setSecLabel(fs billy.Filesystem, path string, label []byte) error {
+	if err := fs.(XattrFilesystem).Setxattr(path, SecLabelXattr, label); err != nil {
+		return statusError(err, NFSStatusIO)
+	}
+	return nil
+}
+
+// bitmap4 is a set of attributes.
+type bitmap4 []uint32
+
+func bitmap4Of(attrs ...int) bitmap4 {
+	var b bitmap4
+	for _, a := range attrs {
+		for len(b) <= a/32 {
+			b = append(b, 0)
+		}
+		b[a/32] |= 1 << (a % 32)
+	}
+	return b
+}
+
+func (b bitmap4) has(attr int) bool {
+	return attr/32 < len(b) && b[attr/32]&(1<<(attr%32)) != 0
+}
+
+// union provides the attributes of either b or o.
+func (b bitmap4) union(o bitmap4) bitmap4 {
+	out := append(bitmap4{}, b...)
+	for len(out) < len(o) {
+		out = append(out, 0)
+	}
+	for i, w := range o {
+		out[i] |= w
+	}
+	return out
+}
+
+// intersect provides the attributes of both b and o.
+func (b bitmap4) intersect(o bitmap4) bitmap4 {
+	n := len(b)
+	if len(o) < n {
+		n = len(o)
+	}
+	out := make(bitmap4, n)
+	for i := range out {
+		out[i] = b[i] & o[i]
+	}
+	return out
+}
+
+func (b bitmap4) subsetOf(o bitmap4) bool {
+	for i, w := range b {
+		if i >= len(o) && w != 0 || i < len(o) && w&^o[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// max provides the highest attribute of b, or -1.
+func (b bitmap4) max() int {
+	for i := len(b)*32 - 1; i >= 0; i-- {
+		if b.has(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+func readBitmap4(r io.Reader) (bitmap4, error) {
+	n, err := xdr.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > nfs4BitmapMax {
+		return nil, &NFSStatusError{NFSStatusResource, os.ErrInvalid}
+	}
+	b := make(bitmap4, n)
+	for i := range b {
+		if b[i], err = xdr.ReadUint32(r); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func writeBitmap4(w io.Writer, b bitmap4) error {
+	return xdr.Write(w, []uint32(b))
+}
+
+func onNFS4GetAttr(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	requested, err := readBitmap4(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	fs, p, err := s.currentObject()
+	if err != nil {
+		return err
+	}
+	// Attributes that aren't served are left out of the reply.
+	supported := s.supportedAttrs(fs)
+	served := requested.intersect(supported)
+	opts := s.exportOptions(ctx, fs)
+	referral := opts.referral(p)
+	attr := &FileAttribute{}
+	fullPath := fs.Join(p...)
+	if referral != nil {
+		if !served.subsetOf(nfs4ReferralAttrs) {
+			return &NFSStatusError{NFSStatusMoved, errMoved}
+		}
+	} else {
+		info, err := fs.Lstat(fullPath)
+		if err != nil {
+			return statusError(err, NFSStatusIO)
+		}
+		attr = ToFileAttribute(info, fullPath)
+		if opts != nil {
+			attr = exportAttributes(context.WithValue(ctx, exportOptionsKey{}, opts), attr)
+		}
+	}
+
+	values := bytes.NewBuffer([]byte{})
+	for a := 0; a <= served.max(); a++ {
+		if !served.has(a) {
+			continue
+		}
+		var v interface{}
+		switch a {
+		case nfs4AttrSupportedAttrs:
+			v = []uint32(supported)
+		case nfs4AttrType:
+			v = uint32(attr.Type)
+		case nfs4AttrChange:
+			v = attr.Change()
+		case nfs4AttrSize:
+			v = attr.Filesize
+		case nfs4AttrFsid:
+			v = [2]uint64{attr.FSID, 0}
+			if referral != nil {
+				v = referral.fsid()
+			}
+		case nfs4AttrFileid:
+			v = attr.Fileid
+		case nfs4AttrFsLocations:
+			v = referral.fsLocations(p)
+		case nfs4AttrMode:
+			v = attr.FileMode & 07777
+		case nfs4AttrNumLinks:
+			v = attr.Nlink
+		case nfs4AttrOwner:
+			v = s.owner(ctx, attr.UID)
+		case nfs4AttrOwnerGroup:
+			v = s.ownerGroup(ctx, attr.GID)
+		case nfs4AttrTimeModify:
+			v = struct {
+				Seconds  int64
+				Nseconds uint32
+			}{int64(attr.Mtime.Seconds), attr.Mtime.Nseconds}
+		case nfs4AttrSecLabel:
+			if v, err = secLabel(fs, fullPath); err != nil {
+				return err
+			}
+		}
+		if err := xdr.Write(values, v); err != nil {
+			return &NFSStatusError{NFSStatusServerFault, err}
+		}
+	}
+	if err := writeBitmap4(res, served); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return xdr.Write(res, values.Bytes())
+}
+
+// onNFS4SetAttr sets the mode, owner and owner_group attributes, and the
+// sec_label of filesystems storing extended attributes. Setting others fails
+// with NFS4ERR_ATTRNOTSUPP. None of these depend on open state, so the
+// stateid only tells which client's delegation isn't recalled.
+func onNFS4SetAttr(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) (err error) {
+	var set bitmap4
+	defer func() {
+		// the attributes set are given whether or not the operation
+		// succeeds.
+		if err != nil {
+			set = nil
+		}
+		_ = writeBitmap4(res, set)
+	}()
+
+	stateid, err := readStateid(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	requested, err := readBitmap4(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	list, err := readBoundedOpaque(args, nfs4AttrListMax)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	fs, p, err := s.currentFS(ctx)
+	if err != nil {
+		return err
+	}
+	if !requested.subsetOf(s.settableAttrs(fs)) {
+		return &NFSStatusError{NFSStatusAttrNotSupp, os.ErrInvalid}
+	}
+	// as an NFSv3 SETATTR of the object would be.
+	op := &Operation{Procedure: NFSProcedureSetAttr, Filesystem: fs, Path: p}
+	if ctx, err = s.operationContext(ctx, s.response, op, nil); err != nil {
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			return &NFSStatusError{NFSStatusAccess, err}
+		}
+		return err
+	}
+	if isReadOnly(ctx, fs) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	fullPath := fs.Join(op.Path...)
+	info, err := fs.Lstat(fullPath)
+	if err != nil {
+		return statusError(err, NFSStatusIO)
+	}
+
+	values := bytes.NewReader(list)
+	attrs := SetFileAttributes{}
+	if requested.has(nfs4AttrMode) {
+		mode, err := xdr.ReadUint32(values)
+		if err != nil {
+			return &NFSStatusError{NFSStatusBadXDR, err}
+		}
+		mode &= 07777
+		attrs.SetMode = &mode
+	}
+	if requested.has(nfs4AttrOwner) {
+		owner, err := readBoundedOpaque(values, nfs4OwnerMax)
+		if err != nil {
+			return &NFSStatusError{NFSStatusBadXDR, err}
+		}
+		uid, err := s.ownerUID(ctx, string(owner))
+		if err != nil {
+			return err
+		}
+		attrs.SetUID = &uid
+	}
+	if requested.has(nfs4AttrOwnerGroup) {
+		group, err := readBoundedOpaque(values, nfs4OwnerMax)
+		if err != nil {
+			return &NFSStatusError{NFSStatusBadXDR, err}
+		}
+		gid, err := s.ownerGID(ctx, string(group))
+		if err != nil {
+			return err
+		}
+		attrs.SetGID = &gid
+	}
+	var label []byte
+	if requested.has(nfs4AttrSecLabel) {
+		if label, err = readSecLabel(values); err != nil {
+			return err
+		}
+	}
+
+	fileAttr := ToFileAttribute(info, fullPath)
+	if err := checkSetAttr(ctx, fileAttr, &attrs); err != nil {
+		return err
+	}
+	// the owner of a file may label it, as it may set its mode.
+	if requested.has(nfs4AttrSecLabel) {
+		if err := checkOwner(ctx, fileAttr); err != nil {
+			return err
+		}
+	}
+	restrictSetgid(ctx, fileAttr, &attrs)
+	if m := s.conn.Server.nfs4State; m != nil {
+		// the delegations of other clients than the one setting the
+		// attributes under its stateid.
+		if err := m.breakDelegations(s.current, m.holder(stateid), true); err != nil {
+			return err
+		}
+	}
+	if err := attrs.Apply(s.handler.Change(fs), fs, fullPath); err != nil {
+		return err
+	}
+	if requested.has(nfs4AttrSecLabel) {
+		if err := setSecLabel(fs, fullPath, label); err != nil {
+			return err
+		}
+	}
+	set = requested
+	return nil
+}
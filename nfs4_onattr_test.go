@@ -0,0 +1,231 @@
+package nfs_test
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestNFSv4SetAttrExportOptions(t *testing.T) {
+	// chown gives /f, owned by 0:0 as memfs objects are, to 1000:100.
+	chown := func(opts nfs.ExportOptions, cred rpc.Auth) (uint32, [2]int) {
+		mem := memfs.New()
+		f, _ := mem.Create("/f")
+		_ = f.Close()
+		fs := &ownerFS{Filesystem: mem, owners: make(map[string][2]int)}
+		srv := nfstest.Start(t, &nfs.Server{
+			Handler:     helpers.NewCachingHandler(helpers.NewExportHandler(helpers.NewNullAuthHandler(fs), opts), 1024),
+			EnableNFSv4: true,
+		})
+		target := srv.Mount(t, "/", rpc.NewAuthUnix("client", 1000, 100).Auth())
+
+		var attrs bytes.Buffer
+		_ = xdr.Write(&attrs, "1000")
+		_ = xdr.Write(&attrs, "100")
+		var ops bytes.Buffer
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpPutRootFH))
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpLookup))
+		_ = xdr.Write(&ops, "f")
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetAttr))
+		ops.Write(make([]byte, 16))
+		_ = xdr.Write(&ops, []uint32{0, 1<<4 | 1<<5})
+		_ = xdr.Write(&ops, attrs.Bytes())
+		res, err := compound4As(target, cred, 3, ops.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _ := xdr.ReadUint32(res)
+		return status, fs.owner("f")
+	}
+
+	root := rpc.NewAuthUnix("client", 0, 0).Auth()
+	user := rpc.NewAuthUnix("client", 1000, 100).Auth()
+	for _, tc := range []struct {
+		name   string
+		opts   nfs.ExportOptions
+		cred   rpc.Auth
+		status nfs.NFSStatus
+	}{
+		{"root", nfs.ExportOptions{CheckPermissions: true}, root, nfs.NFSStatusOk},
+		{"non-owner", nfs.ExportOptions{CheckPermissions: true}, user, nfs.NFSStatusPerm},
+		{"squashed root", nfs.ExportOptions{CheckPermissions: true, RootSquash: true}, root, nfs.NFSStatusPerm},
+		{"refused flavor", nfs.ExportOptions{AuthFlavors: []nfs.AuthFlavor{nfs.AuthFlavorUnix}}, rpc.AuthNull, nfs.NFSStatusAccess},
+		{"disabled", nfs.ExportOptions{DisableProcedures: []nfs.NFSProcedure{nfs.NFSProcedureSetAttr}}, root, nfs.NFSStatusROFS},
+	} {
+		status, owner := chown(tc.opts, tc.cred)
+		if status != uint32(tc.status) {
+			t.Fatalf("%s: expected SETATTR to give %d, got %d", tc.name, tc.status, status)
+		}
+		if expected := [2]int{1000, 100}; tc.status != nfs.NFSStatusOk {
+			if owner != ([2]int{}) {
+				t.Fatalf("%s: expected the owner to be left alone, got %v", tc.name, owner)
+			}
+		} else if owner != expected {
+			t.Fatalf("%s: expected the owner to be set, got %v", tc.name, owner)
+		}
+	}
+}
+
+// xattrFS stores the extended attributes of memfs objects.
+type xattrFS struct {
+	billy.Filesystem
+	mu     sync.Mutex
+	xattrs map[string][]byte
+}
+
+// key names the attribute name of the object at p, of either form of path.
+func (x *xattrFS) key(p, name string) string {
+	return path.Join("/", filepath.ToSlash(p)) + "\x00" + name
+}
+
+func (x *xattrFS) Getxattr(p, name string) ([]byte, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	v, ok := x.xattrs[x.key(p, name)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return v, nil
+}
+
+func (x *xattrFS) Setxattr(p, name string, value []byte) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.xattrs[x.key(p, name)] = append([]byte{}, value...)
+	return nil
+}
+
+func TestNFSv4SecLabel(t *testing.T) {
+	mem := memfs.New()
+	f, _ := mem.Create("/f")
+	_ = f.Close()
+	fs := &xattrFS{Filesystem: mem, xattrs: make(map[string][]byte)}
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:     helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024),
+		EnableNFSv4: true,
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	secLabel := []uint32{0, 0, 1 << (80 - 64)}
+	const label = "system_u:object_r:etc_t:s0"
+
+	// getAttr provides the status of a GETATTR of attrs of /f, and its values.
+	getAttr := func(s *session4, attrs []uint32) (uint32, []byte) {
+		var ops bytes.Buffer
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpPutRootFH))
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpLookup))
+		_ = xdr.Write(&ops, "f")
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpGetAttr))
+		_ = xdr.Write(&ops, attrs)
+		st, res := s.run(3, ops.Bytes())
+		if st != 0 {
+			return st, nil
+		}
+		for i := 0; i < 6; i++ {
+			_, _ = xdr.ReadUint32(res) // the ops and their statuses
+		}
+		var reply struct {
+			Attrs  []uint32
+			Values []byte
+		}
+		_ = xdr.Read(res, &reply)
+		return st, reply.Values
+	}
+	// setLabel sets the sec_label of /f, providing the status of SETATTR.
+	setLabel := func(s *session4) uint32 {
+		var attrs bytes.Buffer
+		_ = xdr.Write(&attrs, uint32(0)) // lfs
+		_ = xdr.Write(&attrs, uint32(0)) // pi
+		_ = xdr.Write(&attrs, label)
+		var ops bytes.Buffer
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpPutRootFH))
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpLookup))
+		_ = xdr.Write(&ops, "f")
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetAttr))
+		ops.Write(make([]byte, 16))
+		_ = xdr.Write(&ops, secLabel)
+		_ = xdr.Write(&ops, attrs.Bytes())
+		st, _ := s.run(3, ops.Bytes())
+		return st
+	}
+	// supported reports whether sec_label is among the supported_attrs.
+	supported := func(s *session4) bool {
+		st, values := getAttr(s, []uint32{1})
+		if st != 0 {
+			t.Fatalf("expected GETATTR of supported_attrs to succeed, got %d", st)
+		}
+		var words []uint32
+		_ = xdr.Read(bytes.NewReader(values), &words)
+		return len(words) > 2 && words[2]&secLabel[2] != 0
+	}
+
+	// sec_label is of minor version 2.
+	s := newSession4(t, target, 1, "client-1")
+	if supported(s) {
+		t.Fatal("expected sec_label not to be supported in minor version 1")
+	}
+	if st := setLabel(s); st != uint32(nfs.NFSStatusAttrNotSupp) {
+		t.Fatalf("expected setting sec_label in minor version 1 to fail, got %d", st)
+	}
+
+	s = newSession4(t, target, 2, "client-2")
+	if !supported(s) {
+		t.Fatal("expected sec_label to be supported in minor version 2")
+	}
+	if st := setLabel(s); st != 0 {
+		t.Fatalf("expected setting sec_label to succeed, got %d", st)
+	}
+	if v, _ := fs.Getxattr("/f", nfs.SecLabelXattr); string(v) != label {
+		t.Fatalf("expected the label to be stored as an extended attribute, got %q", v)
+	}
+	st, values := getAttr(s, secLabel)
+	if st != 0 {
+		t.Fatalf("expected GETATTR of sec_label to succeed, got %d", st)
+	}
+	var got struct {
+		LFS  uint32
+		PI   uint32
+		Data []byte
+	}
+	if err := xdr.Read(bytes.NewReader(values), &got); err != nil || string(got.Data) != label {
+		t.Fatalf("expected the label to be read back, got %q (%v)", got.Data, err)
+	}
+}
+
+// ownerFS records the ownership given to files, as memfs doesn't track it.
+type ownerFS struct {
+	billy.Filesystem
+	mu     sync.Mutex
+	owners map[string][2]int
+}
+
+func (o *ownerFS) Chmod(name string, mode os.FileMode) error { return nil }
+
+func (o *ownerFS) Lchown(name string, uid, gid int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.owners[filepath.ToSlash(name)] = [2]int{uid, gid}
+	return nil
+}
+
+func (o *ownerFS) Chown(name string, uid, gid int) error { return o.Lchown(name, uid, gid) }
+
+func (o *ownerFS) Chtimes(name string, atime time.Time, mtime time.Time) error { return nil }
+
+func (o *ownerFS) owner(name string) [2]int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.owners[name]
+}
@@ -0,0 +1,135 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func init() {
+	registerNFS4Op(NFS4OpSetClientID, 0, onNFS4SetClientID)
+	registerNFS4Op(NFS4OpSetClientIDConfirm, 0, onNFS4SetClientIDConfirm)
+	registerNFS4Op(NFS4OpRenew, 0, onNFS4Renew)
+	registerNFS4Op(NFS4OpReleaseLockOwner, 0, onNFS4ReleaseLockOwner)
+	// clients of minor version 1 and later are established by EXCHANGE_ID
+	// and renewed by SEQUENCE instead.
+	for _, op := range []NFS4Operation{NFS4OpSetClientID, NFS4OpSetClientIDConfirm, NFS4OpRenew, NFS4OpReleaseLockOwner} {
+		retireNFS4Op(op, 1)
+	}
+}
+
+// nfs4Principal identifies the credential of a call, which a client must keep
+// using for its clientid.
+func nfs4Principal(ctx context.Context) string {
+	if cred, ok := CredentialsFromContext(ctx); ok {
+		return fmt.Sprintf("sys:%d", cred.UID)
+	}
+	return "none"
+}
+
+func (s *compoundState) state() (*nfs4StateManager, error) {
+	if s.conn.Server.nfs4State == nil {
+		return nil, &NFSStatusError{NFSStatusServerFault, nil}
+	}
+	return s.conn.Server.nfs4State, nil
+}
+
+func onNFS4SetClientID(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	var verifier [8]byte
+	if _, err := io.ReadFull(args, verifier[:]); err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	id, err := readBoundedOpaque(args, nfs4OwnerMax)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	var cb nfs4Callback
+	if cb.program, err = xdr.ReadUint32(args); err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	netid, err := readBoundedOpaque(args, nfs4OwnerMax)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	addr, err := readBoundedOpaque(args, nfs4OwnerMax)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	cb.netid, cb.addr = string(netid), string(addr)
+	if cb.ident, err = xdr.ReadUint32(args); err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	clientID, confirm, err := m.setClientID(id, verifier, nfs4Principal(ctx), clientKey(s.conn.RemoteAddr()), cb)
+	if err != nil {
+		if nfs4Status(err) == NFSStatusClidInUse {
+			// client_using: the netid and address of the client in use,
+			// which aren't disclosed.
+			_ = xdr.Write(res, "")
+			_ = xdr.Write(res, "")
+		}
+		return err
+	}
+	if err := xdr.Write(res, clientID); err != nil {
+		return err
+	}
+	_, err = res.Write(confirm[:])
+	return err
+}
+
+func onNFS4SetClientIDConfirm(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	clientID, err := readUint64(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	var confirm [8]byte
+	if _, err := io.ReadFull(args, confirm[:]); err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	if err := m.confirmClientID(clientID, confirm, nfs4Principal(ctx)); err != nil {
+		return err
+	}
+	// the callback path is checked in the background; a client is not
+	// offered delegations until it answers.
+	go m.probeCallback(context.Background(), clientID)
+	return nil
+}
+
+func onNFS4Renew(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	clientID, err := readUint64(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	return m.renew(clientID)
+}
+
+func onNFS4ReleaseLockOwner(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	clientID, err := readUint64(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	owner, err := readBoundedOpaque(args, nfs4OwnerMax)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	return m.releaseLockOwner(clientID, owner)
+}
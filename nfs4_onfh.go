@@ -0,0 +1,84 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func init() {
+	registerNFS4Op(NFS4OpPutFH, 0, onNFS4PutFH)
+	registerNFS4Op(NFS4OpPutRootFH, 0, onNFS4PutRootFH)
+	registerNFS4Op(NFS4OpPutPubFH, 0, onNFS4PutRootFH)
+	registerNFS4Op(NFS4OpGetFH, 0, onNFS4GetFH)
+	registerNFS4Op(NFS4OpSaveFH, 0, onNFS4SaveFH)
+	registerNFS4Op(NFS4OpRestoreFH, 0, onNFS4RestoreFH)
+}
+
+func onNFS4PutFH(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	fh, err := readBoundedOpaque(args, nfs4FHSize)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	fs, _, err := s.handler.FromHandle(fh)
+	if err != nil {
+		return &NFSStatusError{NFSStatusStale, err}
+	}
+	if err := s.checkClientCert(ctx, fs); err != nil {
+		return err
+	}
+	s.current = fh
+	return nil
+}
+
+// onNFS4PutRootFH sets the current filehandle to the root of the export
+// mounted at "/". The public filehandle is the same as the root.
+func onNFS4PutRootFH(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	status, fs, _ := s.handler.Mount(ctx, s.conn, MountRequest{Header: s.req.Header, Dirpath: []byte("/")})
+	switch status {
+	case MountStatusOk:
+	case MountStatusErrNoEnt:
+		return &NFSStatusError{NFSStatusNoEnt, nil}
+	case MountStatusErrPerm, MountStatusErrAcces:
+		return &NFSStatusError{NFSStatusAccess, nil}
+	default:
+		return &NFSStatusError{NFSStatusServerFault, nil}
+	}
+	if err := s.checkClientCert(ctx, fs); err != nil {
+		return err
+	}
+	s.current = s.handler.ToHandle(fs, []string{})
+	return nil
+}
+
+// onNFS4GetFH provides the current filehandle, unless it is within a
+// referral, as rfc7530 section 8.4.1 has clients find them.
+func onNFS4GetFH(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	if s.current == nil {
+		return &NFSStatusError{NFSStatusNoFileHandle, nil}
+	}
+	if fs, p, err := s.handler.FromHandle(s.current); err == nil {
+		if err := s.checkMoved(ctx, fs, p); err != nil {
+			return err
+		}
+	}
+	return xdr.Write(res, s.current)
+}
+
+func onNFS4SaveFH(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	if s.current == nil {
+		return &NFSStatusError{NFSStatusNoFileHandle, nil}
+	}
+	s.saved = s.current
+	return nil
+}
+
+func onNFS4RestoreFH(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	if s.saved == nil {
+		return &NFSStatusError{NFSStatusRestoreFH, nil}
+	}
+	s.current = s.saved
+	return nil
+}
@@ -0,0 +1,76 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+func init() {
+	registerNFS4Op(NFS4OpLookup, 0, onNFS4Lookup)
+	registerNFS4Op(NFS4OpLookupP, 0, onNFS4LookupP)
+}
+
+// currentDir resolves the current filehandle, which must be a directory.
+func (s *compoundState) currentDir(ctx context.Context) (fs billy.Filesystem, p []string, err error) {
+	fs, p, err = s.currentFS(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := fs.Lstat(fs.Join(p...))
+	if err != nil {
+		return nil, nil, statusError(err, NFSStatusStale)
+	}
+	if !info.IsDir() {
+		return nil, nil, &NFSStatusError{NFSStatusNotDir, nil}
+	}
+	return fs, p, nil
+}
+
+func onNFS4Lookup(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	name, err := readBoundedOpaque(args, PathNameMax)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	if err := checkName(name); err != nil {
+		return err
+	}
+	// rfc7530 section 16.15.4: "." and ".." are not names in the namespace.
+	if isDotEntry(name) {
+		return &NFSStatusError{NFSStatusBadName, os.ErrInvalid}
+	}
+
+	fs, dir, err := s.currentDir(ctx)
+	if err != nil {
+		return err
+	}
+	opts := s.exportOptions(ctx, fs)
+	if opts != nil && opts.hidesEntry(dir, string(name)) {
+		return &NFSStatusError{NFSStatusNoEnt, errHidden}
+	}
+	p := entryPath(dir, name)
+	// a referral needn't exist here, and its filehandle fails any operation
+	// but GETATTR with NFS4ERR_MOVED.
+	if opts.referral(p) == nil {
+		if _, err := fs.Lstat(fs.Join(p...)); err != nil {
+			return statusError(err, NFSStatusNoEnt)
+		}
+	}
+	s.current = s.handler.ToHandle(fs, p)
+	return nil
+}
+
+func onNFS4LookupP(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	fs, dir, err := s.currentDir(ctx)
+	if err != nil {
+		return err
+	}
+	if len(dir) == 0 {
+		return &NFSStatusError{NFSStatusNoEnt, os.ErrNotExist}
+	}
+	s.current = s.handler.ToHandle(fs, dir[:len(dir)-1:len(dir)-1])
+	return nil
+}
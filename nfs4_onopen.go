@@ -0,0 +1,399 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func init() {
+	registerNFS4Op(NFS4OpOpen, 0, onNFS4Open)
+	registerNFS4Op(NFS4OpClose, 0, onNFS4Close)
+	registerNFS4Op(NFS4OpDelegReturn, 0, onNFS4DelegReturn)
+}
+
+// The arguments and results of OPEN, per rfc7530 section 16.16.
+const (
+	nfs4ShareAccessRead  = 1
+	nfs4ShareAccessWrite = 2
+	nfs4ShareAccessBoth  = 3
+	nfs4ShareDenyBoth    = 3
+
+	nfs4OpenNoCreate = 0
+	nfs4OpenCreate   = 1
+
+	nfs4ClaimNull     = 0
+	nfs4ClaimPrevious = 1
+
+	// nfs4OpenLockTypePosix is the rflags of an OPEN: locks are POSIX
+	// locks, and OPEN_CONFIRM is never asked for.
+	nfs4OpenLockTypePosix = 4
+	// nfs4LimitSize is the nfs_space_limit4 of a write delegation, which
+	// limits it by the size of the file.
+	nfs4LimitSize = 1
+	// nfs4AceEveryone is the who of the nfsace4 of a delegation.
+	nfs4AceEveryone = "EVERYONE@"
+)
+
+// NFSStatusSymlink is NFS4ERR_SYMLINK, given when an OPEN names a symlink.
+const NFSStatusSymlink NFSStatus = 10029
+
+// nfs4OpenAttrs are the attributes an OPEN that creates a file sets.
+var nfs4OpenAttrs = bitmap4Of(nfs4AttrSize, nfs4AttrMode)
+
+func readStateid(r io.Reader) (nfs4Stateid, error) {
+	var sid nfs4Stateid
+	var err error
+	if sid.Seqid, err = xdr.ReadUint32(r); err != nil {
+		return sid, err
+	}
+	_, err = io.ReadFull(r, sid.Other[:])
+	return sid, err
+}
+
+func writeStateid(w *bytes.Buffer, sid nfs4Stateid) {
+	_ = xdr.Write(w, sid.Seqid)
+	w.Write(sid.Other[:])
+}
+
+// readOpenAttrs reads the createattrs of an OPEN, of which only the size and
+// mode are set, and from minor version 2 the sec_label.
+func readOpenAttrs(r io.Reader, minorVersion uint32) (bitmap4, *SetFileAttributes, []byte, error) {
+	requested, err := readBitmap4(r)
+	if err != nil {
+		return nil, nil, nil, &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	list, err := readBoundedOpaque(r, nfs4AttrListMax)
+	if err != nil {
+		return nil, nil, nil, &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	allowed := nfs4OpenAttrs
+	if minorVersion >= 2 {
+		allowed = allowed.union(bitmap4Of(nfs4AttrSecLabel))
+	}
+	if !requested.subsetOf(allowed) {
+		return nil, nil, nil, &NFSStatusError{NFSStatusAttrNotSupp, os.ErrInvalid}
+	}
+	values := bytes.NewReader(list)
+	attrs := &SetFileAttributes{}
+	if requested.has(nfs4AttrSize) {
+		size, err := readUint64(values)
+		if err != nil {
+			return nil, nil, nil, &NFSStatusError{NFSStatusBadXDR, err}
+		}
+		attrs.SetSize = &size
+	}
+	if requested.has(nfs4AttrMode) {
+		mode, err := xdr.ReadUint32(values)
+		if err != nil {
+			return nil, nil, nil, &NFSStatusError{NFSStatusBadXDR, err}
+		}
+		mode &= 07777
+		attrs.SetMode = &mode
+	}
+	var label []byte
+	if requested.has(nfs4AttrSecLabel) {
+		if label, err = readSecLabel(values); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return requested, attrs, label, nil
+}
+
+// onNFS4Open opens a file, creating it when asked, and issues its open state.
+// Files are opened by name, or reclaimed after a restart by their filehandle;
+// EXCLUSIVE creation and the claims of delegated files are not supported.
+// Clients whose callback path answers may be offered a delegation of the file
+// when Server.NFS4Delegations is set.
+func onNFS4Open(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	seqid, err := xdr.ReadUint32(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	access, err := xdr.ReadUint32(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	deny, err := xdr.ReadUint32(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	clientID, err := readUint64(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	// from minor version 1, owners are of the client of the session.
+	clientID = s.clientID(clientID)
+	owner, err := readBoundedOpaque(args, nfs4OwnerMax)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	opentype, err := xdr.ReadUint32(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	how := uint32(createModeUnchecked)
+	var attrset bitmap4
+	var label []byte
+	attrs := &SetFileAttributes{}
+	switch opentype {
+	case nfs4OpenNoCreate:
+	case nfs4OpenCreate:
+		if how, err = xdr.ReadUint32(args); err != nil {
+			return &NFSStatusError{NFSStatusBadXDR, err}
+		}
+		if how != createModeUnchecked && how != createModeGuarded {
+			return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
+		}
+		if attrset, attrs, label, err = readOpenAttrs(args, s.minorVersion); err != nil {
+			return err
+		}
+	default:
+		return &NFSStatusError{NFSStatusBadXDR, os.ErrInvalid}
+	}
+	claim, err := xdr.ReadUint32(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	var name []byte
+	switch claim {
+	case nfs4ClaimNull:
+		if name, err = readBoundedOpaque(args, PathNameMax); err != nil {
+			return &NFSStatusError{NFSStatusBadXDR, err}
+		}
+		if err := checkName(name); err != nil {
+			return err
+		}
+		if isDotEntry(name) {
+			return &NFSStatusError{NFSStatusBadName, os.ErrInvalid}
+		}
+	case nfs4ClaimPrevious:
+		// the delegation the client held is not granted again.
+		if _, err := xdr.ReadUint32(args); err != nil {
+			return &NFSStatusError{NFSStatusBadXDR, err}
+		}
+		if opentype == nfs4OpenCreate {
+			return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+		}
+	default:
+		return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
+	}
+	if access == 0 || access > nfs4ShareAccessBoth || deny > nfs4ShareDenyBoth {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	fs, p, err := s.currentFS(ctx)
+	if err != nil {
+		return err
+	}
+	if attrset.has(nfs4AttrSecLabel) && !s.hasSecLabel(fs) {
+		return &NFSStatusError{NFSStatusAttrNotSupp, os.ErrInvalid}
+	}
+	var dir []string
+	var dirAttr *FileAttribute
+	if claim == nfs4ClaimNull {
+		if fs, dir, err = s.currentDir(ctx); err != nil {
+			return err
+		}
+		if opts := s.exportOptions(ctx, fs); opts != nil && opts.hidesEntry(dir, string(name)) {
+			return &NFSStatusError{NFSStatusNoEnt, errHidden}
+		}
+		p = entryPath(dir, name)
+		if err := s.checkMoved(ctx, fs, p); err != nil {
+			return err
+		}
+	}
+
+	// as the NFSv3 call the open stands for would be.
+	write := access&nfs4ShareAccessWrite != 0
+	op := &Operation{Procedure: NFSProcedureRead, Filesystem: fs, Path: p}
+	switch {
+	case opentype == nfs4OpenCreate:
+		op.Procedure = NFSProcedureCreate
+	case write:
+		op.Procedure = NFSProcedureWrite
+	}
+	if ctx, err = s.operationContext(ctx, s.response, op, nil); err != nil {
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			return &NFSStatusError{NFSStatusAccess, err}
+		}
+		return err
+	}
+	if (write || opentype == nfs4OpenCreate) && isReadOnly(ctx, fs) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	p = op.Path
+	fullPath := fs.Join(p...)
+
+	var before uint64
+	if claim == nfs4ClaimNull {
+		dirAttr = tryStat(ctx, fs, dir)
+		if dirAttr == nil {
+			return &NFSStatusError{NFSStatusStale, os.ErrNotExist}
+		}
+		before = dirAttr.Change()
+	}
+	fh := s.handler.ToHandle(fs, p)
+
+	info, err := fs.Lstat(fullPath)
+	switch {
+	case err == nil:
+		if opentype == nfs4OpenCreate && how == createModeGuarded {
+			return &NFSStatusError{NFSStatusExist, os.ErrExist}
+		}
+		if err := checkOpenable(info); err != nil {
+			return err
+		}
+		fileAttr := ToFileAttribute(info, fullPath)
+		if access&nfs4ShareAccessRead != 0 {
+			if err := checkIOAccess(ctx, fileAttr, false); err != nil {
+				return err
+			}
+		}
+		// only the size is set of a file that already exists.
+		truncate := attrs.SetSize != nil
+		if write || truncate {
+			if err := checkIOAccess(ctx, fileAttr, true); err != nil {
+				return err
+			}
+		}
+		if err := m.breakDelegations(fh, clientID, write || truncate); err != nil {
+			return err
+		}
+		if truncate {
+			if err := (&SetFileAttributes{SetSize: attrs.SetSize}).Apply(s.handler.Change(fs), fs, fullPath); err != nil {
+				return err
+			}
+			attrset = bitmap4Of(nfs4AttrSize)
+		} else {
+			attrset = nil
+		}
+	case os.IsNotExist(err) && opentype == nfs4OpenCreate:
+		if err := checkAccess(ctx, dirAttr, accessModify|accessLookup); err != nil {
+			return err
+		}
+		if err := createOpenFile(ctx, s.handler.Change(fs), fs, fullPath, how == createModeGuarded, attrs, dirAttr); err != nil {
+			return err
+		}
+		if attrset.has(nfs4AttrSecLabel) {
+			if err := setSecLabel(fs, fullPath, label); err != nil {
+				return err
+			}
+		}
+	default:
+		return statusError(err, NFSStatusNoEnt)
+	}
+
+	openSid, delegSid, delegType, err := m.open(clientID, seqid, owner, fh, access, deny, claim == nfs4ClaimPrevious)
+	if err != nil {
+		return err
+	}
+	s.current = fh
+
+	after := before
+	if claim == nfs4ClaimNull {
+		if attr := tryStat(ctx, fs, dir); attr != nil {
+			after = attr.Change()
+		}
+	}
+	writeStateid(res, openSid)
+	_ = xdr.Write(res, uint32(0)) // cinfo.atomic
+	_ = xdr.Write(res, before)
+	_ = xdr.Write(res, after)
+	_ = xdr.Write(res, uint32(nfs4OpenLockTypePosix))
+	_ = writeBitmap4(res, attrset)
+	_ = xdr.Write(res, delegType)
+	if delegType == nfs4DelegNone {
+		return nil
+	}
+	writeStateid(res, delegSid)
+	_ = xdr.Write(res, uint32(0)) // recall
+	if delegType == nfs4DelegWrite {
+		_ = xdr.Write(res, uint32(nfs4LimitSize))
+		_ = xdr.Write(res, uint64(math.MaxUint64))
+	}
+	// the permissions the client may check locally without asking; none.
+	_ = xdr.Write(res, uint32(0))
+	_ = xdr.Write(res, uint32(0))
+	_ = xdr.Write(res, uint32(0))
+	return xdr.Write(res, nfs4AceEveryone)
+}
+
+// checkOpenable refuses to OPEN objects other than regular files.
+func checkOpenable(info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		return &NFSStatusError{NFSStatusIsDir, nil}
+	case info.Mode()&os.ModeSymlink != 0:
+		return &NFSStatusError{NFSStatusSymlink, nil}
+	case !info.Mode().IsRegular():
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+	return nil
+}
+
+// createOpenFile creates the file of an OPEN, as an NFSv3 CREATE would.
+func createOpenFile(ctx context.Context, changer billy.Change, fs billy.Filesystem, path string, exclusive bool, attrs *SetFileAttributes, dirAttr *FileAttribute) error {
+	exportMode(ctx, attrs, createDefaultMode, false)
+	if err := createFile(fs, path, exclusive); err != nil {
+		return statusError(err, NFSStatusAccess)
+	}
+	chownToCaller(ctx, changer, path, dirAttr)
+	return attrs.Apply(changer, fs, path)
+}
+
+func onNFS4Close(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	if _, err := xdr.ReadUint32(args); err != nil { // seqid
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	sid, err := readStateid(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	state, err := m.findState(sid, s.minorVersion)
+	if err != nil {
+		return err
+	}
+	if state.kind != nfs4OpenState {
+		return &NFSStatusError{NFSStatusBadStateid, nil}
+	}
+	m.removeState(sid)
+	sid.Seqid++
+	writeStateid(res, sid)
+	return nil
+}
+
+func onNFS4DelegReturn(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	sid, err := readStateid(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	state, err := m.findState(sid, s.minorVersion)
+	if err != nil {
+		return err
+	}
+	if state.kind != nfs4DelegState {
+		return &NFSStatusError{NFSStatusBadStateid, nil}
+	}
+	m.removeState(sid)
+	return nil
+}
@@ -0,0 +1,242 @@
+package nfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// callbackServer answers CB_NULL and CB_COMPOUND, sending the procedure of
+// each call it gets to calls.
+func callbackServer(t *testing.T) (string, chan uint32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	calls := make(chan uint32, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var frame uint32
+				if err := xdr.Read(c, &frame); err != nil {
+					return
+				}
+				msg := make([]byte, frame&^(1<<31))
+				if _, err := io.ReadFull(c, msg); err != nil {
+					return
+				}
+				r := bytes.NewReader(msg)
+				var xid, mtype uint32
+				var hdr rpc.Header
+				_ = xdr.Read(r, &xid)
+				_ = xdr.Read(r, &mtype)
+				if err := xdr.Read(r, &hdr); err != nil {
+					return
+				}
+				// an accepted, successful reply with a null verifier,
+				// and for CB_COMPOUND an empty successful result.
+				words := []uint32{xid, 1, 0, 0, 0, 0}
+				if hdr.Proc == 1 {
+					words = append(words, 0, 0, 0)
+				}
+				var reply bytes.Buffer
+				_ = xdr.Write(&reply, uint32(1)<<31|uint32(4*len(words)))
+				for _, v := range words {
+					_ = xdr.Write(&reply, v)
+				}
+				_, _ = c.Write(reply.Bytes())
+				calls <- hdr.Proc
+			}()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+	return fmt.Sprintf("127.0.0.1.%d.%d", port>>8, port&0xff), calls
+}
+
+func TestNFSv4Delegations(t *testing.T) {
+	for _, delegations := range []bool{true, false} {
+		t.Run(fmt.Sprintf("delegations=%v", delegations), func(t *testing.T) {
+			mem := memfs.New()
+			f, _ := mem.Create("/file")
+			_ = f.Close()
+			srv := nfstest.Start(t, &nfs.Server{
+				Handler:         helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+				EnableNFSv4:     true,
+				NFS4Delegations: delegations,
+			})
+			target := srv.Mount(t, "/", rpc.AuthNull)
+			uaddr, calls := callbackServer(t)
+
+			// run sends a COMPOUND, providing the status of its last
+			// operation and the result of it.
+			run := func(count uint32, ops *bytes.Buffer) (uint32, io.Reader) {
+				res, err := compound4(target, count, ops.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				st, _ := xdr.ReadUint32(res)
+				_, _ = xdr.ReadUint32(res) // empty tag
+				_, _ = xdr.ReadUint32(res) // result count
+				for i := uint32(0); i < count*2; i++ {
+					_, _ = xdr.ReadUint32(res) // op and op status
+				}
+				return st, res
+			}
+			var ops bytes.Buffer
+			_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetClientID))
+			ops.Write([]byte("verifier"))
+			_ = xdr.Write(&ops, "client-1")
+			_ = xdr.Write(&ops, uint32(0x40000000))
+			_ = xdr.Write(&ops, "tcp")
+			_ = xdr.Write(&ops, uaddr)
+			_ = xdr.Write(&ops, uint32(1))
+			st, res := run(1, &ops)
+			if st != 0 {
+				t.Fatalf("expected SETCLIENTID to succeed, got %d", st)
+			}
+			var clientID uint64
+			var confirm [8]byte
+			_ = xdr.Read(res, &clientID)
+			_, _ = io.ReadFull(res, confirm[:])
+			ops.Reset()
+			_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetClientIDConfirm))
+			_ = xdr.Write(&ops, clientID)
+			ops.Write(confirm[:])
+			if st, _ := run(1, &ops); st != 0 {
+				t.Fatalf("expected SETCLIENTID_CONFIRM to succeed, got %d", st)
+			}
+			select {
+			case <-calls:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the callback path to be probed")
+			}
+
+			// open opens /file for reading and writing, providing the
+			// stateids and type of the delegation granted.
+			owner := 0
+			open := func() (open, deleg [16]byte, delegType uint32) {
+				owner++
+				ops.Reset()
+				_ = xdr.Write(&ops, uint32(nfs.NFS4OpPutRootFH))
+				_ = xdr.Write(&ops, uint32(nfs.NFS4OpOpen))
+				_ = xdr.Write(&ops, uint32(0)) // seqid
+				_ = xdr.Write(&ops, uint32(3)) // share_access BOTH
+				_ = xdr.Write(&ops, uint32(0)) // share_deny NONE
+				_ = xdr.Write(&ops, clientID)
+				_ = xdr.Write(&ops, fmt.Sprintf("owner-%d", owner))
+				_ = xdr.Write(&ops, uint32(0)) // NOCREATE
+				_ = xdr.Write(&ops, uint32(0)) // CLAIM_NULL
+				_ = xdr.Write(&ops, "file")
+				st, res := run(2, &ops)
+				if st != 0 {
+					t.Fatalf("expected OPEN to succeed, got %d", st)
+				}
+				_, _ = io.ReadFull(res, open[:])
+				var cinfo [20]byte
+				_, _ = io.ReadFull(res, cinfo[:])
+				_, _ = xdr.ReadUint32(res) // rflags
+				var attrset []uint32
+				_ = xdr.Read(res, &attrset)
+				delegType, _ = xdr.ReadUint32(res)
+				if delegType != 0 {
+					_, _ = io.ReadFull(res, deleg[:])
+				}
+				return open, deleg, delegType
+			}
+			sid, deleg, delegType := open()
+			// the callback path is marked up once the probe is answered.
+			for i := 0; delegations && delegType == 0 && i < 50; i++ {
+				time.Sleep(20 * time.Millisecond)
+				sid, deleg, delegType = open()
+			}
+			if !delegations {
+				if delegType != 0 {
+					t.Fatalf("expected no delegation unless they are enabled, got %d", delegType)
+				}
+				if err := target.Remove("/file"); err != nil {
+					t.Fatalf("expected the undelegated file to be removed: %v", err)
+				}
+				return
+			}
+			if delegType != 2 {
+				t.Fatalf("expected a write delegation, got %d", delegType)
+			}
+
+			ops.Reset()
+			_ = xdr.Write(&ops, uint32(nfs.NFS4OpClose))
+			_ = xdr.Write(&ops, uint32(1))
+			ops.Write(sid[:])
+			if st, _ := run(1, &ops); st != 0 {
+				t.Fatalf("expected CLOSE to succeed, got %d", st)
+			}
+			if _, err := target.Getattr("/file"); err != nil {
+				t.Fatalf("expected a GETATTR not to recall the delegation: %v", err)
+			}
+			// the client doesn't know JUKEBOX, so the status is read from
+			// the reply.
+			_, root, err := target.Lookup("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			type removeArgs struct {
+				rpc.Header
+				Handle   []byte
+				Filename string
+			}
+			res, err = target.Call(&removeArgs{
+				Header: rpc.Header{
+					Rpcvers: 2,
+					Vers:    nfsc.Nfs3Vers,
+					Prog:    nfsc.Nfs3Prog,
+					Proc:    uint32(nfs.NFSProcedureRemove),
+					Cred:    rpc.AuthNull,
+					Verf:    rpc.AuthNull,
+				},
+				Handle:   root,
+				Filename: "file",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status, err := xdr.ReadUint32(res); err != nil || status != uint32(nfs.NFSStatusJukebox) {
+				t.Fatalf("expected a REMOVE of a delegated file to be delayed, got %d: %v", status, err)
+			}
+			select {
+			case proc := <-calls:
+				if proc != 1 {
+					t.Fatalf("expected the delegation to be recalled, got procedure %d", proc)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the delegation to be recalled")
+			}
+
+			ops.Reset()
+			_ = xdr.Write(&ops, uint32(nfs.NFS4OpDelegReturn))
+			ops.Write(deleg[:])
+			if st, _ := run(1, &ops); st != 0 {
+				t.Fatalf("expected DELEGRETURN to succeed, got %d", st)
+			}
+			if err := target.Remove("/file"); err != nil {
+				t.Fatalf("expected the returned file to be removed: %v", err)
+			}
+		})
+	}
+}
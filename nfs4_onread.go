@@ -0,0 +1,182 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func init() {
+	registerNFS4Op(NFS4OpReadPlus, 2, onNFS4ReadPlus)
+}
+
+// The kinds of read_plus_content, per rfc7862 section 15.10.
+const (
+	nfs4ContentData = 0
+	nfs4ContentHole = 1
+)
+
+// readSegment is a read_plus_content: data read from offset, or a hole of
+// length bytes there.
+type readSegment struct {
+	offset int64
+	length int64
+	data   []byte
+	hole   bool
+}
+
+// onNFS4ReadPlus reads a file as READ does, but with the holes of files that
+// are SparseFiles reported as such rather than as their zeros. Reads don't
+// depend on open state, so the stateid only tells which client's delegation
+// isn't recalled.
+func onNFS4ReadPlus(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	stateid, err := readStateid(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	offset, err := readUint64(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	count, err := xdr.ReadUint32(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	if offset > math.MaxInt64 {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+
+	fs, p, err := s.currentFS(ctx)
+	if err != nil {
+		return err
+	}
+	// as an NFSv3 READ of the file would be.
+	op := &Operation{Procedure: NFSProcedureRead, Filesystem: fs, Path: p}
+	if ctx, err = s.operationContext(ctx, s.response, op, nil); err != nil {
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			return &NFSStatusError{NFSStatusAccess, err}
+		}
+		return err
+	}
+	fullPath := fs.Join(op.Path...)
+	info, err := fs.Lstat(fullPath)
+	if err != nil {
+		return statusError(err, NFSStatusIO)
+	}
+	if err := checkOpenable(info); err != nil {
+		return err
+	}
+	if err := checkIOAccess(ctx, ToFileAttribute(info, fullPath), false); err != nil {
+		return err
+	}
+	if m := s.conn.Server.nfs4State; m != nil {
+		if err := m.breakDelegations(s.current, m.holder(stateid), false); err != nil {
+			return err
+		}
+	}
+
+	f, err := fs.Open(fullPath)
+	if err != nil {
+		return statusError(err, NFSStatusAccess)
+	}
+	defer f.Close()
+	if count > MaxRead {
+		count = MaxRead
+	}
+	end := int64(offset) + int64(count)
+	if end > info.Size() {
+		end = info.Size()
+	}
+	segments, err := readSegments(f, int64(offset), end)
+	if err != nil {
+		return err
+	}
+
+	// eof is judged against the post-read size, as it is for READ.
+	size := info.Size()
+	if attr := tryStat(ctx, fs, op.Path); attr != nil {
+		size = int64(attr.Filesize)
+	}
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		end = last.offset + last.length
+	}
+	eof := uint32(0)
+	if end >= size {
+		eof = 1
+	}
+	_ = xdr.Write(res, eof)
+	_ = xdr.Write(res, uint32(len(segments)))
+	for _, seg := range segments {
+		if seg.hole {
+			_ = xdr.Write(res, uint32(nfs4ContentHole))
+			_ = xdr.Write(res, uint64(seg.offset))
+			_ = xdr.Write(res, uint64(seg.length))
+			continue
+		}
+		_ = xdr.Write(res, uint32(nfs4ContentData))
+		_ = xdr.Write(res, uint64(seg.offset))
+		if err := xdr.Write(res, seg.data); err != nil {
+			return &NFSStatusError{NFSStatusServerFault, err}
+		}
+	}
+	return nil
+}
+
+// readSegments reads f from off up to end, as the data and holes it holds.
+// Files which aren't SparseFiles are read as data alone, and those which end
+// before end are read up to their end.
+func readSegments(f billy.File, off, end int64) ([]readSegment, error) {
+	sf, sparse := f.(SparseFile)
+	var segments []readSegment
+	for off < end {
+		next := end
+		if sparse {
+			hole, herr := sf.SeekHole(off)
+			if herr == nil && hole <= off {
+				data, err := sf.SeekData(off)
+				switch {
+				case errors.Is(err, io.EOF) || err == nil && data > end:
+					data = end
+				case err != nil:
+					return nil, statusError(err, NFSStatusIO)
+				}
+				if data > off {
+					segments = append(segments, readSegment{offset: off, length: data - off, hole: true})
+					off = data
+					continue
+				}
+			} else if herr == nil && hole < end {
+				next = hole
+			}
+		}
+
+		// ReadAt may return less than requested without reaching the end
+		// of the file, so keep reading until the buffer is full or EOF is
+		// reported.
+		buf := make([]byte, next-off)
+		cnt := 0
+		for cnt < len(buf) {
+			n, err := f.ReadAt(buf[cnt:], off+int64(cnt))
+			cnt += n
+			if errors.Is(err, io.EOF) || err == nil && n == 0 {
+				break
+			} else if err != nil {
+				return nil, statusError(err, NFSStatusIO)
+			}
+		}
+		segments = append(segments, readSegment{offset: off, length: int64(cnt), data: buf[:cnt]})
+		if cnt < len(buf) {
+			break
+		}
+		off = next
+	}
+	return segments, nil
+}
@@ -0,0 +1,103 @@
+package nfs_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"reflect"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestNFSv4ReadPlus(t *testing.T) {
+	// a file of a frame of data, two of zeros and a little more data.
+	const frame = 4096
+	content := make([]byte, 3*frame+4)
+	copy(content, "head")
+	copy(content[3*frame:], "tail")
+	cfs := helpers.NewCompressedFS(memfs.New(), frame, flate.DefaultCompression)
+	if err := billyutil.WriteFile(cfs, "/sparse", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:     helpers.NewCachingHandler(helpers.NewNullAuthHandler(cfs), 1024),
+		EnableNFSv4: true,
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	type segment struct {
+		Offset uint64
+		Length uint64
+		Hole   bool
+		Data   []byte
+	}
+	// readPlus reads /sparse from offset over session s, providing whether
+	// the end of the file was reached and the segments read.
+	readPlus := func(s *session4, offset uint64, count uint32) (uint32, bool, []segment) {
+		var ops bytes.Buffer
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpPutRootFH))
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpLookup))
+		_ = xdr.Write(&ops, "sparse")
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpReadPlus))
+		ops.Write(make([]byte, 16)) // the anonymous stateid
+		_ = xdr.Write(&ops, offset)
+		_ = xdr.Write(&ops, count)
+		st, res := s.run(3, ops.Bytes())
+		if st != 0 {
+			return st, false, nil
+		}
+		for i := 0; i < 6; i++ {
+			_, _ = xdr.ReadUint32(res) // the ops and their statuses
+		}
+		eof, _ := xdr.ReadUint32(res)
+		n, _ := xdr.ReadUint32(res)
+		var segments []segment
+		for ; n > 0; n-- {
+			var seg segment
+			kind, _ := xdr.ReadUint32(res)
+			_ = xdr.Read(res, &seg.Offset)
+			if seg.Hole = kind == 1; seg.Hole {
+				_ = xdr.Read(res, &seg.Length)
+			} else {
+				seg.Data, _ = xdr.ReadOpaque(res)
+				_, _ = io.CopyN(io.Discard, res, int64(-len(seg.Data)&3))
+				seg.Length = uint64(len(seg.Data))
+			}
+			segments = append(segments, seg)
+		}
+		return st, eof == 1, segments
+	}
+
+	s := newSession4(t, target, 2, "client-1")
+	st, eof, segments := readPlus(s, 0, 1<<16)
+	if st != 0 || !eof {
+		t.Fatalf("expected the whole file to be read, got %d with eof %v", st, eof)
+	}
+	expected := []segment{
+		{Offset: 0, Length: frame, Data: content[:frame]},
+		{Offset: frame, Length: 2 * frame, Hole: true},
+		{Offset: 3 * frame, Length: 4, Data: []byte("tail")},
+	}
+	if !reflect.DeepEqual(segments, expected) {
+		t.Fatalf("expected the zeros to be read as a hole, got %+v", segments)
+	}
+
+	// a read within the hole ends with it.
+	if st, eof, segments = readPlus(s, frame+100, 1000); st != 0 || eof ||
+		!reflect.DeepEqual(segments, []segment{{Offset: frame + 100, Length: 1000, Hole: true}}) {
+		t.Fatalf("expected a read of part of the hole, got %d with eof %v: %+v", st, eof, segments)
+	}
+
+	// READ_PLUS is of minor version 2.
+	if st, _, _ := readPlus(newSession4(t, target, 1, "client-2"), 0, 1<<16); st != uint32(nfs.NFSStatusOpIllegal) {
+		t.Fatalf("expected READ_PLUS to be illegal in minor version 1, got %d", st)
+	}
+}
@@ -0,0 +1,299 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func init() {
+	registerNFS4Op(NFS4OpExchangeID, 1, onNFS4ExchangeID)
+	registerNFS4Op(NFS4OpCreateSession, 1, onNFS4CreateSession)
+	registerNFS4Op(NFS4OpDestroySession, 1, onNFS4DestroySession)
+	registerNFS4Op(NFS4OpSequence, 1, onNFS4Sequence)
+	registerNFS4Op(NFS4OpDestroyClientID, 1, onNFS4DestroyClientID)
+	registerNFS4Op(NFS4OpReclaimComplete, 1, onNFS4ReclaimComplete)
+}
+
+// The flags of EXCHANGE_ID, per rfc8881 section 18.35.
+const (
+	nfs4ExchgIDSuppMovedRefer = 0x00000001
+	nfs4ExchgIDUseNonPNFS     = 0x00010000
+	nfs4ExchgIDConfirmedR     = 0x80000000
+
+	// nfs4SP4None is the state protection of clients: none.
+	nfs4SP4None = 0
+)
+
+// The flavors of the callback_sec_parms4 of CREATE_SESSION.
+const (
+	nfs4CallbackAuthNone   = 0
+	nfs4CallbackAuthSys    = 1
+	nfs4CallbackRPCSECGSS  = 6
+	nfs4CallbackSecParmMax = 16
+)
+
+func readSessionID(r io.Reader) ([16]byte, error) {
+	var id [16]byte
+	_, err := io.ReadFull(r, id[:])
+	return id, err
+}
+
+// onNFS4ExchangeID establishes a client of minor version 1 or later, which
+// then confirms itself by creating a session. State protection isn't
+// served, and the implementation the client names is ignored.
+func onNFS4ExchangeID(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	var verifier [8]byte
+	if _, err := io.ReadFull(args, verifier[:]); err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	ownerID, err := readBoundedOpaque(args, nfs4OwnerMax)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	if _, err := xdr.ReadUint32(args); err != nil { // flags
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	how, err := xdr.ReadUint32(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	if how != nfs4SP4None {
+		return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
+	}
+	impls, err := xdr.ReadUint32(args)
+	if err != nil || impls > 1 {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	if impls == 1 {
+		// nii_domain, nii_name and nii_date.
+		for i := 0; i < 2; i++ {
+			if _, err := readBoundedOpaque(args, nfs4OwnerMax); err != nil {
+				return &NFSStatusError{NFSStatusBadXDR, err}
+			}
+		}
+		var date [12]byte
+		if _, err := io.ReadFull(args, date[:]); err != nil {
+			return &NFSStatusError{NFSStatusBadXDR, err}
+		}
+	}
+
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	clientID, seq, confirmed, err := m.exchangeID(ownerID, verifier, nfs4Principal(ctx), clientKey(s.conn.RemoteAddr()))
+	if err != nil {
+		return err
+	}
+	flags := uint32(nfs4ExchgIDSuppMovedRefer | nfs4ExchgIDUseNonPNFS)
+	if confirmed {
+		flags |= nfs4ExchgIDConfirmedR
+	}
+	// the server is told apart from others, and from itself before a
+	// restart, by its boot verifier.
+	var owner [4]byte
+	binary.BigEndian.PutUint32(owner[:], m.boot)
+	_ = xdr.Write(res, clientID)
+	_ = xdr.Write(res, seq)
+	_ = xdr.Write(res, flags)
+	_ = xdr.Write(res, uint32(nfs4SP4None))
+	_ = xdr.Write(res, uint64(0)) // so_minor_id
+	_ = xdr.Write(res, owner[:])  // so_major_id
+	_ = xdr.Write(res, owner[:])  // server_scope
+	return xdr.Write(res, uint32(0))
+}
+
+// readChannelAttrs reads a channel_attrs4, of which a client names at most
+// one RDMA ird.
+func readChannelAttrs(r io.Reader) (nfs4ChannelAttrs, error) {
+	var a nfs4ChannelAttrs
+	for _, v := range []*uint32{&a.HeaderPadSize, &a.MaxRequestSize, &a.MaxResponseSize,
+		&a.MaxResponseSizeCached, &a.MaxOperations, &a.MaxRequests} {
+		var err error
+		if *v, err = xdr.ReadUint32(r); err != nil {
+			return a, err
+		}
+	}
+	n, err := xdr.ReadUint32(r)
+	if err != nil {
+		return a, err
+	}
+	if n > 1 {
+		return a, os.ErrInvalid
+	}
+	for ; n > 0; n-- {
+		if _, err := xdr.ReadUint32(r); err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+// skipCallbackSecParms reads the callback_sec_parms4 of CREATE_SESSION,
+// which go unused as the back channel isn't served.
+func skipCallbackSecParms(r io.Reader) error {
+	n, err := xdr.ReadUint32(r)
+	if err != nil {
+		return err
+	}
+	if n > nfs4CallbackSecParmMax {
+		return os.ErrInvalid
+	}
+	for ; n > 0; n-- {
+		flavor, err := xdr.ReadUint32(r)
+		if err != nil {
+			return err
+		}
+		switch flavor {
+		case nfs4CallbackAuthNone:
+		case nfs4CallbackAuthSys:
+			var parms struct {
+				Stamp       uint32
+				MachineName string
+				UID         uint32
+				GID         uint32
+				GIDs        []uint32
+			}
+			if err := readArgs(r, &parms); err != nil {
+				return err
+			}
+		case nfs4CallbackRPCSECGSS:
+			if _, err := xdr.ReadUint32(r); err != nil { // gcbp_service
+				return err
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := readBoundedOpaque(r, nfs4OwnerMax); err != nil {
+					return err
+				}
+			}
+		default:
+			return os.ErrInvalid
+		}
+	}
+	return nil
+}
+
+// onNFS4CreateSession creates a session. Its back channel is agreed to but
+// never used, so clients of sessions are sent no callbacks, and are offered
+// no delegations.
+func onNFS4CreateSession(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	clientID, err := readUint64(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	seq, err := xdr.ReadUint32(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	if _, err := xdr.ReadUint32(args); err != nil { // flags
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	fore, err := readChannelAttrs(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	back, err := readChannelAttrs(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	if _, err := xdr.ReadUint32(args); err != nil { // cb_program
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	if err := skipCallbackSecParms(args); err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	session, err := m.createSession(clientID, seq, nfs4Principal(ctx), fore, back)
+	if err != nil {
+		return err
+	}
+	res.Write(session.id[:])
+	_ = xdr.Write(res, session.seq)
+	_ = xdr.Write(res, uint32(0)) // flags: not persistent, no back channel
+	_ = xdr.Write(res, session.fore)
+	return xdr.Write(res, session.back)
+}
+
+func onNFS4DestroySession(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	id, err := readSessionID(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	return m.destroySession(id)
+}
+
+// onNFS4Sequence starts the COMPOUND on a slot of a session. A COMPOUND sent
+// again is answered with its cached reply, in place of being run.
+func onNFS4Sequence(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	id, err := readSessionID(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	var seq struct {
+		Seqid       uint32
+		Slot        uint32
+		HighestSlot uint32
+		CacheThis   bool
+	}
+	if err := readArgs(args, &seq); err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	session, replay, err := m.sequence(id, seq.Seqid, seq.Slot)
+	if err != nil {
+		return err
+	}
+	if replay != nil {
+		s.replay = replay
+		return nil
+	}
+	s.session, s.slot, s.cache = session, seq.Slot, seq.CacheThis
+	highest := uint32(len(session.slots) - 1)
+	res.Write(id[:])
+	_ = xdr.Write(res, seq.Seqid)
+	_ = xdr.Write(res, seq.Slot)
+	_ = xdr.Write(res, highest)
+	_ = xdr.Write(res, highest)      // target_highest_slotid
+	return xdr.Write(res, uint32(0)) // status_flags
+}
+
+func onNFS4DestroyClientID(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	clientID, err := readUint64(args)
+	if err != nil {
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	return m.destroyClientID(clientID)
+}
+
+// onNFS4ReclaimComplete ends the reclaims of the client of the session. Those
+// of single filesystems aren't told apart.
+func onNFS4ReclaimComplete(ctx context.Context, s *compoundState, args io.Reader, res *bytes.Buffer) error {
+	if _, err := xdr.ReadUint32(args); err != nil { // rca_one_fs
+		return &NFSStatusError{NFSStatusBadXDR, err}
+	}
+	m, err := s.state()
+	if err != nil {
+		return err
+	}
+	return m.reclaimComplete(s.clientID(0))
+}
@@ -0,0 +1,100 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Referral refers the NFSv4 clients of a subtree of an export to the other
+// servers it is served by instead, so that a server can head a namespace
+// joining the exports of others, per rfc7530 section 8.4.
+type Referral struct {
+	// Path is the subtree, from the root of the export, such as
+	// "/projects/archive". It needn't exist in the filesystem.
+	Path string
+	// Locations are where the subtree is served, in order of preference.
+	Locations []FSLocation
+}
+
+// FSLocation is where a subtree is served: the servers serving it, by name
+// or address, and the path of the subtree on them.
+type FSLocation struct {
+	Servers  []string
+	RootPath string
+}
+
+// NFSStatusMoved is NFS4ERR_MOVED, of operations on objects within a
+// referral.
+const NFSStatusMoved NFSStatus = 10019
+
+var errMoved = errors.New("object is within a subtree served by another server")
+
+// fsLocation4 and fsLocations4 are the fs_location4 and fs_locations4 of the
+// fs_locations attribute, whose paths are pathname4s of components.
+type fsLocation4 struct {
+	Servers  []string
+	RootPath []string
+}
+
+type fsLocations4 struct {
+	FSRoot    []string
+	Locations []fsLocation4
+}
+
+// pathComponents provides the components of a path such as "/a/b".
+func pathComponents(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return []string{}
+	}
+	return strings.Split(p[1:], "/")
+}
+
+// referral provides the referral of the export p is within, if there is one.
+func (o *ExportOptions) referral(p []string) *Referral {
+	if o == nil {
+		return nil
+	}
+	for i := range o.Referrals {
+		if hasPathPrefix(p, pathComponents(o.Referrals[i].Path)) {
+			return &o.Referrals[i]
+		}
+	}
+	return nil
+}
+
+// fsid provides the fsid of the subtree of a referral, which is told apart
+// from those of FileAttributes by its minor number.
+func (r *Referral) fsid() [2]uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(path.Clean("/" + r.Path)))
+	return [2]uint64{h.Sum64(), 1}
+}
+
+// fsLocations provides the fs_locations attribute of the object at p. It is
+// that of the referral p is within, and for other objects one without
+// locations.
+func (r *Referral) fsLocations(p []string) fsLocations4 {
+	if r == nil {
+		return fsLocations4{FSRoot: p, Locations: []fsLocation4{}}
+	}
+	locs := fsLocations4{FSRoot: pathComponents(r.Path), Locations: make([]fsLocation4, 0, len(r.Locations))}
+	for _, l := range r.Locations {
+		locs.Locations = append(locs.Locations, fsLocation4{l.Servers, pathComponents(l.RootPath)})
+	}
+	return locs
+}
+
+// checkMoved refuses objects within a referral of their export with
+// NFS4ERR_MOVED.
+func (s *compoundState) checkMoved(ctx context.Context, fs billy.Filesystem, p []string) error {
+	if s.exportOptions(ctx, fs).referral(p) != nil {
+		return &NFSStatusError{NFSStatusMoved, errMoved}
+	}
+	return nil
+}
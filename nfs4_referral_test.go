@@ -0,0 +1,110 @@
+package nfs_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestNFSv4Referrals(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/projects/local", 0755)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{
+		Referrals: []nfs.Referral{{
+			Path:      "/projects/archive",
+			Locations: []nfs.FSLocation{{Servers: []string{"archive.example.com"}, RootPath: "/export/archive"}},
+		}},
+	})
+	srv := nfstest.Start(t, &nfs.Server{Handler: helpers.NewCachingHandler(handler, 1024), EnableNFSv4: true})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	// lookup looks up /projects and then name, ending with the operation
+	// last, and provides the status of each operation.
+	lookup := func(name string, last func(*bytes.Buffer)) ([]uint32, io.Reader) {
+		var ops bytes.Buffer
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpPutRootFH))
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpLookup))
+		_ = xdr.Write(&ops, "projects")
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpLookup))
+		_ = xdr.Write(&ops, name)
+		last(&ops)
+		res, err := compound4(target, 4, ops.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = xdr.ReadUint32(res) // status
+		_, _ = xdr.ReadOpaque(res) // tag
+		n, _ := xdr.ReadUint32(res)
+		statuses := make([]uint32, n)
+		for i := range statuses {
+			_, _ = xdr.ReadUint32(res) // op
+			statuses[i], _ = xdr.ReadUint32(res)
+		}
+		return statuses, res
+	}
+	getFH := func(ops *bytes.Buffer) { _ = xdr.Write(ops, uint32(nfs.NFS4OpGetFH)) }
+	getAttr := func(attrs ...uint32) func(*bytes.Buffer) {
+		return func(ops *bytes.Buffer) {
+			_ = xdr.Write(ops, uint32(nfs.NFS4OpGetAttr))
+			_ = xdr.Write(ops, attrs)
+		}
+	}
+
+	if statuses, _ := lookup("local", getFH); !reflect.DeepEqual(statuses, []uint32{0, 0, 0, 0}) {
+		t.Fatalf("expected the filehandle of a local directory, got %v", statuses)
+	}
+	// the referral is looked up, but its filehandle is refused.
+	moved := uint32(nfs.NFSStatusMoved)
+	if statuses, _ := lookup("archive", getFH); !reflect.DeepEqual(statuses, []uint32{0, 0, 0, moved}) {
+		t.Fatalf("expected GETFH of the referral to fail with NFS4ERR_MOVED, got %v", statuses)
+	}
+	// the size of the referral isn't known here,
+	if statuses, _ := lookup("archive", getAttr(1<<4)); !reflect.DeepEqual(statuses, []uint32{0, 0, 0, moved}) {
+		t.Fatalf("expected the size of the referral to fail with NFS4ERR_MOVED, got %v", statuses)
+	}
+
+	// but where it is served is.
+	statuses, res := lookup("archive", getAttr(1<<24))
+	if !reflect.DeepEqual(statuses, []uint32{0, 0, 0, 0}) {
+		t.Fatalf("expected the fs_locations of the referral, got %v", statuses)
+	}
+	var served []uint32
+	_ = xdr.Read(res, &served)
+	if len(served) < 1 || served[0] != 1<<24 {
+		t.Fatalf("expected fs_locations to be served, got %v", served)
+	}
+	_, _ = xdr.ReadUint32(res) // length of the attributes
+	var locations struct {
+		FSRoot    []string
+		Locations []struct {
+			Servers  []string
+			RootPath []string
+		}
+	}
+	if err := xdr.Read(res, &locations); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(locations.FSRoot, []string{"projects", "archive"}) || len(locations.Locations) != 1 ||
+		!reflect.DeepEqual(locations.Locations[0].Servers, []string{"archive.example.com"}) ||
+		!reflect.DeepEqual(locations.Locations[0].RootPath, []string{"export", "archive"}) {
+		t.Fatalf("expected the referral to name where it is served, got %+v", locations)
+	}
+
+	// operations within the referral fail too.
+	lookupWithin := func(ops *bytes.Buffer) {
+		_ = xdr.Write(ops, uint32(nfs.NFS4OpLookup))
+		_ = xdr.Write(ops, "2023")
+	}
+	if statuses, _ := lookup("archive", lookupWithin); !reflect.DeepEqual(statuses, []uint32{0, 0, 0, moved}) {
+		t.Fatalf("expected a LOOKUP within the referral to fail with NFS4ERR_MOVED, got %v", statuses)
+	}
+}
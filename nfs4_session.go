@@ -0,0 +1,288 @@
+package nfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// NFSv4.1 session statuses
+const (
+	NFSStatusBadSession       NFSStatus = 10052
+	NFSStatusBadSlot          NFSStatus = 10053
+	NFSStatusCompleteAlready  NFSStatus = 10054
+	NFSStatusSeqMisordered    NFSStatus = 10063
+	NFSStatusSequencePos      NFSStatus = 10064
+	NFSStatusRetryUncachedRep NFSStatus = 10068
+	NFSStatusOpNotInSession   NFSStatus = 10071
+	NFSStatusClientIDBusy     NFSStatus = 10074
+	NFSStatusNotOnlyOp        NFSStatus = 10081
+)
+
+const (
+	// nfs4MaxSlots bounds the slots of the fore channel of a session, and so
+	// the COMPOUNDs a client may have outstanding on it.
+	nfs4MaxSlots = 64
+	// nfs4SessionMaxSize bounds the requests and replies of a session: the
+	// largest READ_PLUS, with room for the rest of its COMPOUND.
+	nfs4SessionMaxSize = MaxRead + 1<<12
+	// nfs4SessionMaxCached bounds the replies cached for their retry.
+	nfs4SessionMaxCached = 1 << 16
+)
+
+// nfs4ChannelAttrs is the channel_attrs4 of a channel of a session, per
+// rfc8881 section 18.36.
+type nfs4ChannelAttrs struct {
+	HeaderPadSize         uint32
+	MaxRequestSize        uint32
+	MaxResponseSize       uint32
+	MaxResponseSizeCached uint32
+	MaxOperations         uint32
+	MaxRequests           uint32
+	RdmaIrd               []uint32
+}
+
+// limit bounds the attributes asked for by a client to those served.
+func (a nfs4ChannelAttrs) limit() nfs4ChannelAttrs {
+	bound := func(v *uint32, max uint32) {
+		if *v > max {
+			*v = max
+		}
+	}
+	a.HeaderPadSize = 0
+	bound(&a.MaxRequestSize, nfs4SessionMaxSize)
+	bound(&a.MaxResponseSize, nfs4SessionMaxSize)
+	bound(&a.MaxResponseSizeCached, nfs4SessionMaxCached)
+	bound(&a.MaxOperations, nfs4MaxOps)
+	bound(&a.MaxRequests, nfs4MaxSlots)
+	if a.MaxRequests == 0 {
+		a.MaxRequests = 1
+	}
+	a.RdmaIrd = nil
+	return a
+}
+
+// nfs4Slot is a slot of a session, holding the sequenceid of the last
+// COMPOUND sent on it and, once it completes, its reply when cached.
+type nfs4Slot struct {
+	seqid  uint32
+	busy   bool
+	cached bool
+	reply  []byte
+}
+
+// nfs4Session is a session of an NFSv4.1 client, over whose slots its
+// COMPOUNDs are sequenced, so that their retries are answered from the
+// replies cached rather than run again.
+type nfs4Session struct {
+	id     [16]byte
+	client *nfs4Client
+	seq    uint32
+	fore   nfs4ChannelAttrs
+	back   nfs4ChannelAttrs
+	slots  []nfs4Slot
+}
+
+// exchangeID records the client owning ownerID, per rfc8881 section 18.35,
+// providing its clientid, the sequenceid of its next CREATE_SESSION, and
+// whether it was already confirmed. A client presenting another verifier
+// has rebooted, and is recorded anew until it creates a session. It fails
+// with NFS4ERR_CLID_INUSE when a client with the same id but another
+// principal holds state.
+func (m *nfs4StateManager) exchangeID(ownerID []byte, verifier [8]byte, principal, host string) (uint64, uint32, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.expire(now)
+
+	for _, c := range m.clients {
+		if !bytes.Equal(c.ID, ownerID) {
+			continue
+		}
+		if c.Principal != principal && c.hasState() {
+			return 0, 0, false, &NFSStatusError{NFSStatusClidInUse, nil}
+		}
+		if c.sessions && c.Principal == principal && c.verifier == verifier {
+			c.lastRenew = now
+			return c.clientID, c.csSeq, true, nil
+		}
+	}
+	for cid, c := range m.unconfirmed {
+		if bytes.Equal(c.ID, ownerID) {
+			delete(m.unconfirmed, cid)
+		}
+	}
+	c := &nfs4Client{
+		NFS4ClientRecord: NFS4ClientRecord{ID: append([]byte{}, ownerID...), Principal: principal},
+		verifier:         verifier,
+		clientID:         m.newClientID(),
+		host:             host,
+		lastRenew:        now,
+		sessions:         true,
+		csSeq:            1,
+	}
+	m.unconfirmed[c.clientID] = c
+	return c.clientID, c.csSeq, false, nil
+}
+
+// createSession creates a session of a client, per rfc8881 section 18.36,
+// confirming the client by its first. A CREATE_SESSION sent again provides
+// the session it created. A confirmed client with the same id has rebooted,
+// and its state is discarded.
+func (m *nfs4StateManager) createSession(clientID uint64, seq uint32, principal string, fore, back nfs4ChannelAttrs) (*nfs4Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.expire(now)
+
+	c, ok := m.unconfirmed[clientID]
+	if !ok {
+		c, ok = m.clients[clientID]
+	}
+	if !ok || !c.sessions {
+		return nil, &NFSStatusError{NFSStatusStaleClient, nil}
+	}
+	if c.Principal != principal {
+		return nil, &NFSStatusError{NFSStatusClidInUse, nil}
+	}
+	switch {
+	case seq == c.csSeq-1 && c.lastSession != nil:
+		return c.lastSession, nil
+	case seq != c.csSeq:
+		return nil, &NFSStatusError{NFSStatusSeqMisordered, nil}
+	}
+
+	if !c.confirmed {
+		delete(m.unconfirmed, clientID)
+		for _, prev := range m.clients {
+			if bytes.Equal(prev.ID, c.ID) {
+				m.removeClient(prev)
+			}
+		}
+		c.openOwners = make(map[string]*nfs4Owner)
+		c.lockOwners = make(map[string]*nfs4Owner)
+		c.states = make(map[[12]byte]*nfs4StateEntry)
+		c.confirmed = true
+		m.clients[c.clientID] = c
+		if m.store != nil {
+			if err := m.store.AddClient(c.NFS4ClientRecord); err != nil {
+				Log.Errorf("unable to record nfsv4 client: %v", err)
+			}
+		}
+	}
+
+	m.next++
+	s := &nfs4Session{client: c, seq: seq, fore: fore.limit(), back: back.limit()}
+	binary.BigEndian.PutUint32(s.id[0:4], m.boot)
+	binary.BigEndian.PutUint64(s.id[4:12], m.next)
+	s.slots = make([]nfs4Slot, s.fore.MaxRequests)
+	m.sessions[s.id] = s
+	c.csSeq++
+	c.lastSession = s
+	c.lastRenew = now
+	return s, nil
+}
+
+// destroySession ends a session.
+func (m *nfs4StateManager) destroySession(id [16]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[id]; !ok {
+		return &NFSStatusError{NFSStatusBadSession, nil}
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+// destroyClientID discards a client without sessions or state, per rfc8881
+// section 18.50.
+func (m *nfs4StateManager) destroyClientID(clientID uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.unconfirmed[clientID]; ok {
+		delete(m.unconfirmed, clientID)
+		return nil
+	}
+	c, ok := m.clients[clientID]
+	if !ok {
+		return &NFSStatusError{NFSStatusStaleClient, nil}
+	}
+	for _, s := range m.sessions {
+		if s.client == c {
+			return &NFSStatusError{NFSStatusClientIDBusy, nil}
+		}
+	}
+	if c.hasState() {
+		return &NFSStatusError{NFSStatusClientIDBusy, nil}
+	}
+	m.removeClient(c)
+	return nil
+}
+
+// sequence starts a COMPOUND on a slot of a session, per rfc8881 section
+// 18.46, renewing the lease of its client. A COMPOUND sent again on its slot
+// is answered with the reply cached, which is returned, or fails with
+// NFS4ERR_RETRY_UNCACHED_REP when it wasn't, and with NFS4ERR_DELAY while it
+// is still being run.
+func (m *nfs4StateManager) sequence(id [16]byte, seqid, slot uint32) (*nfs4Session, []byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(time.Now())
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, nil, &NFSStatusError{NFSStatusBadSession, nil}
+	}
+	if slot >= uint32(len(s.slots)) {
+		return nil, nil, &NFSStatusError{NFSStatusBadSlot, nil}
+	}
+	sl := &s.slots[slot]
+	switch {
+	case seqid == sl.seqid+1:
+		if sl.busy {
+			return nil, nil, &NFSStatusError{NFSStatusSeqMisordered, nil}
+		}
+	case seqid == sl.seqid && sl.busy:
+		return nil, nil, &NFSStatusError{NFSStatusJukebox, nil}
+	case seqid == sl.seqid && sl.cached:
+		return s, sl.reply, nil
+	case seqid == sl.seqid && sl.seqid != 0:
+		return nil, nil, &NFSStatusError{NFSStatusRetryUncachedRep, nil}
+	default:
+		return nil, nil, &NFSStatusError{NFSStatusSeqMisordered, nil}
+	}
+	if _, err := m.client(s.client.clientID); err != nil {
+		return nil, nil, err
+	}
+	sl.seqid, sl.busy, sl.cached, sl.reply = seqid, true, false, nil
+	return s, nil, nil
+}
+
+// completeSlot frees the slot of a COMPOUND once it has run, keeping its
+// reply for a retry when cache is set.
+func (m *nfs4StateManager) completeSlot(s *nfs4Session, slot uint32, cache bool, reply []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sl := &s.slots[slot]
+	sl.busy = false
+	if cache && len(reply) <= int(s.fore.MaxResponseSizeCached) {
+		sl.cached, sl.reply = true, reply
+	}
+}
+
+// reclaimComplete records that a client has reclaimed the state it held
+// before the restart, per rfc8881 section 18.51, so that the grace period
+// need not wait on it.
+func (m *nfs4StateManager) reclaimComplete(clientID uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.client(clientID)
+	if err != nil {
+		return err
+	}
+	if c.reclaimComplete {
+		return &NFSStatusError{NFSStatusCompleteAlready, nil}
+	}
+	c.reclaimComplete = true
+	delete(m.reclaimable, string(c.ID))
+	return nil
+}
@@ -0,0 +1,211 @@
+package nfs_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// session4 is a session of an NFSv4.1 or later client, whose COMPOUNDs are
+// sent on its first slot.
+type session4 struct {
+	t        *testing.T
+	target   *nfstest.Client
+	minor    uint32
+	clientID uint64
+	id       [16]byte
+	seqid    uint32
+}
+
+// exchangeID4 establishes the client owner, providing its clientid, the
+// sequenceid of its CREATE_SESSION and the flags of the reply.
+func exchangeID4(t *testing.T, target *nfstest.Client, minor uint32, owner string) (uint64, uint32, uint32) {
+	var ops bytes.Buffer
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpExchangeID))
+	ops.Write([]byte("verifier"))
+	_ = xdr.Write(&ops, owner)
+	_ = xdr.Write(&ops, uint32(0)) // flags
+	_ = xdr.Write(&ops, uint32(0)) // SP4_NONE
+	_ = xdr.Write(&ops, uint32(0)) // no implementation id
+	res, err := compound4Minor(target, minor, 1, ops.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := xdr.ReadUint32(res); st != 0 {
+		t.Fatalf("expected EXCHANGE_ID to succeed, got %d", st)
+	}
+	_, _ = xdr.ReadOpaque(res) // tag
+	_, _ = xdr.ReadUint32(res) // result count
+	_, _ = xdr.ReadUint32(res) // op
+	_, _ = xdr.ReadUint32(res) // status
+	var reply struct {
+		ClientID uint64
+		Seq      uint32
+		Flags    uint32
+	}
+	_ = xdr.Read(res, &reply)
+	return reply.ClientID, reply.Seq, reply.Flags
+}
+
+// newSession4 establishes a client of minor version minor, and creates a
+// session of it.
+func newSession4(t *testing.T, target *nfstest.Client, minor uint32, owner string) *session4 {
+	clientID, seq, _ := exchangeID4(t, target, minor, owner)
+	var ops bytes.Buffer
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpCreateSession))
+	_ = xdr.Write(&ops, clientID)
+	_ = xdr.Write(&ops, seq)
+	_ = xdr.Write(&ops, uint32(0)) // flags
+	for i := 0; i < 2; i++ {
+		// the fore and back channel attributes.
+		for _, v := range []uint32{0, 1 << 20, 1 << 20, 1 << 16, 16, 8, 0} {
+			_ = xdr.Write(&ops, v)
+		}
+	}
+	_ = xdr.Write(&ops, uint32(0x40000000)) // cb_program
+	_ = xdr.Write(&ops, uint32(1))          // a single sec_parms
+	_ = xdr.Write(&ops, uint32(0))          // of AUTH_NONE
+	res, err := compound4Minor(target, minor, 1, ops.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := xdr.ReadUint32(res); st != 0 {
+		t.Fatalf("expected CREATE_SESSION to succeed, got %d", st)
+	}
+	_, _ = xdr.ReadOpaque(res) // tag
+	_, _ = xdr.ReadUint32(res) // result count
+	_, _ = xdr.ReadUint32(res) // op
+	_, _ = xdr.ReadUint32(res) // status
+	s := &session4{t: t, target: target, minor: minor, clientID: clientID}
+	_, _ = io.ReadFull(res, s.id[:])
+	return s
+}
+
+// sequence encodes a SEQUENCE of seqid on the first slot.
+func (s *session4) sequence(seqid uint32, cache bool) []byte {
+	var ops bytes.Buffer
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpSequence))
+	ops.Write(s.id[:])
+	_ = xdr.Write(&ops, seqid)
+	_ = xdr.Write(&ops, uint32(0)) // slotid
+	_ = xdr.Write(&ops, uint32(0)) // highest_slotid
+	_ = xdr.Write(&ops, cache)
+	return ops.Bytes()
+}
+
+// run sends the count operations of ops after the next SEQUENCE of the
+// session, providing the status of the COMPOUND and its reply from the
+// results of the operations following SEQUENCE on.
+func (s *session4) run(count uint32, ops []byte) (uint32, io.Reader) {
+	s.seqid++
+	res, err := compound4Minor(s.target, s.minor, count+1, append(s.sequence(s.seqid, false), ops...))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	st, _ := xdr.ReadUint32(res)
+	_, _ = xdr.ReadOpaque(res) // tag
+	_, _ = xdr.ReadUint32(res) // result count
+	_, _ = xdr.ReadUint32(res) // op
+	if seqst, _ := xdr.ReadUint32(res); seqst != 0 {
+		s.t.Fatalf("expected SEQUENCE to succeed, got %d", seqst)
+	}
+	// sessionid, sequenceid, slotid, highest and target slotids, and flags.
+	_, _ = io.CopyN(io.Discard, res, 16+5*4)
+	return st, res
+}
+
+func TestNFSv4Sessions(t *testing.T) {
+	mem := memfs.New()
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:     helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		EnableNFSv4: true,
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	// status sends a COMPOUND of minor version minor, providing its status.
+	status := func(minor, count uint32, ops []byte) uint32 {
+		res, err := compound4Minor(target, minor, count, ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, _ := xdr.ReadUint32(res)
+		return st
+	}
+	var root bytes.Buffer
+	_ = xdr.Write(&root, uint32(nfs.NFS4OpPutRootFH))
+	if st := status(3, 1, root.Bytes()); st != uint32(nfs.NFSStatusMinorVersMismatch) {
+		t.Fatalf("expected minor version 3 to be refused, got %d", st)
+	}
+	if st := status(1, 1, root.Bytes()); st != uint32(nfs.NFSStatusOpNotInSession) {
+		t.Fatalf("expected an operation outside of a session to be refused, got %d", st)
+	}
+
+	s := newSession4(t, target, 1, "client-1")
+	if _, _, flags := exchangeID4(t, target, 1, "client-1"); flags&0x80000000 == 0 {
+		t.Fatalf("expected the client to be confirmed by its session, got flags %x", flags)
+	}
+	if st, _ := s.run(1, root.Bytes()); st != 0 {
+		t.Fatalf("expected PUTROOTFH within the session to succeed, got %d", st)
+	}
+	var renew bytes.Buffer
+	_ = xdr.Write(&renew, uint32(nfs.NFS4OpRenew))
+	_ = xdr.Write(&renew, s.clientID)
+	if st, _ := s.run(1, renew.Bytes()); st != uint32(nfs.NFSStatusNotSupp) {
+		t.Fatalf("expected RENEW to be withdrawn from minor version 1, got %d", st)
+	}
+	if st, _ := s.run(1, s.sequence(s.seqid+1, false)); st != uint32(nfs.NFSStatusSequencePos) {
+		t.Fatalf("expected SEQUENCE to come first alone, got %d", st)
+	}
+
+	// a retry is answered from the cache, and one not cached is refused.
+	getFH := append(append([]byte{}, root.Bytes()...), 0, 0, 0, byte(nfs.NFS4OpGetFH))
+	s.seqid++
+	cached := append(s.sequence(s.seqid, true), getFH...)
+	first, err := compound4Minor(target, 1, 3, cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := compound4Minor(target, 1, 3, cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := io.ReadAll(first)
+	b, _ := io.ReadAll(again)
+	if len(a) == 0 || !bytes.Equal(a, b) {
+		t.Fatal("expected the retry to be answered with the cached reply")
+	}
+	if st, _ := s.run(1, root.Bytes()); st != 0 {
+		t.Fatalf("expected the next COMPOUND to succeed, got %d", st)
+	}
+	if st := status(1, 1, s.sequence(s.seqid, false)); st != uint32(nfs.NFSStatusRetryUncachedRep) {
+		t.Fatalf("expected the retry of an uncached COMPOUND to be refused, got %d", st)
+	}
+	if st := status(1, 1, s.sequence(s.seqid+2, false)); st != uint32(nfs.NFSStatusSeqMisordered) {
+		t.Fatalf("expected a skipped sequenceid to be refused, got %d", st)
+	}
+
+	var destroyClient, destroySession bytes.Buffer
+	_ = xdr.Write(&destroyClient, uint32(nfs.NFS4OpDestroyClientID))
+	_ = xdr.Write(&destroyClient, s.clientID)
+	if st := status(1, 1, destroyClient.Bytes()); st != uint32(nfs.NFSStatusClientIDBusy) {
+		t.Fatalf("expected a client with a session to be kept, got %d", st)
+	}
+	_ = xdr.Write(&destroySession, uint32(nfs.NFS4OpDestroySession))
+	destroySession.Write(s.id[:])
+	if st := status(1, 1, destroySession.Bytes()); st != 0 {
+		t.Fatalf("expected DESTROY_SESSION to succeed, got %d", st)
+	}
+	if st := status(1, 1, s.sequence(s.seqid+1, false)); st != uint32(nfs.NFSStatusBadSession) {
+		t.Fatalf("expected the destroyed session to be refused, got %d", st)
+	}
+	if st := status(1, 1, destroyClient.Bytes()); st != 0 {
+		t.Fatalf("expected DESTROY_CLIENTID to succeed, got %d", st)
+	}
+}
@@ -0,0 +1,638 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// NFSv4 state statuses
+const (
+	NFSStatusExpired      NFSStatus = 10011
+	NFSStatusLocksHeld    NFSStatus = 10012
+	NFSStatusGrace        NFSStatus = 10013
+	NFSStatusShareDenied  NFSStatus = 10015
+	NFSStatusClidInUse    NFSStatus = 10017
+	NFSStatusStaleClient  NFSStatus = 10022
+	NFSStatusStaleStateid NFSStatus = 10023
+	NFSStatusOldStateid   NFSStatus = 10024
+	NFSStatusBadStateid   NFSStatus = 10025
+	NFSStatusBadSeqid     NFSStatus = 10026
+	NFSStatusNoGrace      NFSStatus = 10033
+	NFSStatusReclaimBad   NFSStatus = 10034
+)
+
+// DefaultNFS4LeaseTime is the lease of NFSv4 clients when Server.NFS4LeaseTime
+// is unset.
+const DefaultNFS4LeaseTime = 90 * time.Second
+
+// nfs4OwnerMax bounds the opaque client and owner identifiers.
+const nfs4OwnerMax = 1024
+
+// NFS4ClientRecord is the durable record of a confirmed NFSv4 client. After a
+// restart, clients with a record may reclaim their state during the grace
+// period.
+type NFS4ClientRecord struct {
+	// ID is the nfs_client_id4 id the client established itself with.
+	ID []byte
+	// Principal identifies the credential the client was established with.
+	Principal string
+}
+
+// NFS4StateStore persists the records of confirmed NFSv4 clients across
+// restarts of the server.
+type NFS4StateStore interface {
+	Clients() ([]NFS4ClientRecord, error)
+	AddClient(NFS4ClientRecord) error
+	RemoveClient(id []byte) error
+}
+
+type nfs4StateKind int
+
+const (
+	nfs4OpenState nfs4StateKind = iota + 1
+	nfs4LockState
+	nfs4DelegState
+)
+
+// nfs4Stateid is a stateid4. The first 4 bytes of other hold the boot
+// verifier of the server that issued it.
+type nfs4Stateid struct {
+	Seqid uint32
+	Other [12]byte
+}
+
+type nfs4Owner struct {
+	seqid     uint32
+	confirmed bool
+}
+
+type nfs4StateEntry struct {
+	kind   nfs4StateKind
+	client *nfs4Client
+	owner  string
+	fh     []byte
+	access uint32
+	deny   uint32
+	seqid  uint32
+	// open is the open state a lock state was created under.
+	open *nfs4StateEntry
+	// recalled is when a delegation was recalled, zero until it is.
+	recalled time.Time
+}
+
+type nfs4Client struct {
+	NFS4ClientRecord
+	verifier [8]byte
+	clientID uint64
+	// host is the address the client established itself from, by which it
+	// is fenced.
+	host       string
+	confirm    [8]byte
+	confirmed  bool
+	lastRenew  time.Time
+	openOwners map[string]*nfs4Owner
+	lockOwners map[string]*nfs4Owner
+	states     map[[12]byte]*nfs4StateEntry
+	callback   nfs4Callback
+	// callbackUp is set once the callback path answers CB_NULL. Delegations
+	// are only offered to clients which can be recalled.
+	callbackUp bool
+
+	// sessions is set of clients established by EXCHANGE_ID, of minor
+	// versions 1 and later. csSeq is the sequenceid of their next
+	// CREATE_SESSION, and lastSession the session their last one created.
+	sessions        bool
+	csSeq           uint32
+	lastSession     *nfs4Session
+	reclaimComplete bool
+}
+
+func (c *nfs4Client) hasState() bool {
+	return len(c.states) > 0
+}
+
+// nfs4StateManager holds the clients of an NFSv4 server, their open and lock
+// owners, and the stateids issued to them. Clients which go a lease without
+// renewing are expired along with their state.
+type nfs4StateManager struct {
+	mu    sync.Mutex
+	store NFS4StateStore
+	lease time.Duration
+	grace time.Duration
+	boot  uint32
+	start time.Time
+	next  uint64
+	// delegations offers delegations to clients whose callback path is up.
+	delegations bool
+
+	clients     map[uint64]*nfs4Client
+	unconfirmed map[uint64]*nfs4Client
+	// reclaimable are the ids of clients recorded before the restart.
+	reclaimable map[string]bool
+	sessions    map[[16]byte]*nfs4Session
+}
+
+func newNFS4StateManager(store NFS4StateStore, lease, grace time.Duration) *nfs4StateManager {
+	if lease <= 0 {
+		lease = DefaultNFS4LeaseTime
+	}
+	if grace <= 0 {
+		grace = lease
+	}
+	m := &nfs4StateManager{
+		store:       store,
+		lease:       lease,
+		grace:       grace,
+		start:       time.Now(),
+		clients:     make(map[uint64]*nfs4Client),
+		unconfirmed: make(map[uint64]*nfs4Client),
+		reclaimable: make(map[string]bool),
+		sessions:    make(map[[16]byte]*nfs4Session),
+	}
+	// the boot verifier tells clientids and stateids from before a restart
+	// apart from current ones.
+	var boot [4]byte
+	_, _ = rand.Read(boot[:])
+	m.boot = binary.BigEndian.Uint32(boot[:])
+	if store != nil {
+		records, err := store.Clients()
+		if err != nil {
+			Log.Errorf("unable to load nfsv4 client records: %v", err)
+		}
+		for _, r := range records {
+			m.reclaimable[string(r.ID)] = true
+		}
+	}
+	return m
+}
+
+// inGrace reports whether clients may still reclaim the state they held
+// before a restart.
+func (m *nfs4StateManager) inGrace() bool {
+	return len(m.reclaimable) > 0 && time.Since(m.start) < m.grace
+}
+
+// admit decides whether a client may be granted state, per rfc7530 section
+// 9.6.2: during the grace period only the state reclaimed by clients
+// recorded before the restart is, and afterwards none can be reclaimed.
+func (m *nfs4StateManager) admit(c *nfs4Client, reclaim bool) error {
+	switch {
+	case reclaim && !m.inGrace():
+		return &NFSStatusError{NFSStatusNoGrace, nil}
+	case reclaim && !m.reclaimable[string(c.ID)]:
+		return &NFSStatusError{NFSStatusReclaimBad, nil}
+	case !reclaim && m.inGrace():
+		return &NFSStatusError{NFSStatusGrace, nil}
+	}
+	return nil
+}
+
+// mayReclaim reports whether the client with id may reclaim state.
+func (m *nfs4StateManager) mayReclaim(id []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inGrace() && m.reclaimable[string(id)]
+}
+
+func (m *nfs4StateManager) newClientID() uint64 {
+	m.next++
+	return uint64(m.boot)<<32 | m.next&0xffffffff
+}
+
+// expire discards the clients that have not renewed their lease, with their
+// state.
+func (m *nfs4StateManager) expire(now time.Time) {
+	for id, c := range m.clients {
+		if now.Sub(c.lastRenew) > m.lease {
+			Log.Debugf("expiring nfsv4 client %x", id)
+			m.removeClient(c)
+		}
+	}
+	for id, c := range m.unconfirmed {
+		if now.Sub(c.lastRenew) > m.lease {
+			delete(m.unconfirmed, id)
+		}
+	}
+}
+
+func (m *nfs4StateManager) removeClient(c *nfs4Client) {
+	delete(m.clients, c.clientID)
+	for id, s := range m.sessions {
+		if s.client == c {
+			delete(m.sessions, id)
+		}
+	}
+	if m.store != nil {
+		if err := m.store.RemoveClient(c.ID); err != nil {
+			Log.Errorf("unable to remove nfsv4 client record: %v", err)
+		}
+	}
+}
+
+// removeClientsAt discards the clients established from host, with their
+// state.
+func (m *nfs4StateManager) removeClientsAt(host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.clients {
+		if c.host == host {
+			Log.Debugf("discarding nfsv4 client %x of fenced %s", c.clientID, host)
+			m.removeClient(c)
+		}
+	}
+	for id, c := range m.unconfirmed {
+		if c.host == host {
+			delete(m.unconfirmed, id)
+		}
+	}
+}
+
+// setClientID records an unconfirmed client, per rfc7530 section 16.33. It
+// fails with NFS4ERR_CLID_INUSE when a client with the same id but another
+// principal holds state.
+func (m *nfs4StateManager) setClientID(id []byte, verifier [8]byte, principal, host string, cb nfs4Callback) (uint64, [8]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.expire(now)
+
+	for _, c := range m.clients {
+		if bytes.Equal(c.ID, id) && c.Principal != principal && c.hasState() {
+			return 0, [8]byte{}, &NFSStatusError{NFSStatusClidInUse, nil}
+		}
+	}
+	// a new SETCLIENTID replaces any unconfirmed record for the same id.
+	for cid, c := range m.unconfirmed {
+		if bytes.Equal(c.ID, id) {
+			delete(m.unconfirmed, cid)
+		}
+	}
+
+	c := &nfs4Client{
+		NFS4ClientRecord: NFS4ClientRecord{ID: append([]byte{}, id...), Principal: principal},
+		verifier:         verifier,
+		host:             host,
+		lastRenew:        now,
+		callback:         cb,
+	}
+	// a client updating its callback keeps its clientid.
+	for _, prev := range m.clients {
+		if bytes.Equal(prev.ID, id) && prev.verifier == verifier {
+			c.clientID = prev.clientID
+		}
+	}
+	if c.clientID == 0 {
+		c.clientID = m.newClientID()
+	}
+	if _, err := rand.Read(c.confirm[:]); err != nil {
+		return 0, [8]byte{}, err
+	}
+	m.unconfirmed[c.clientID] = c
+	return c.clientID, c.confirm, nil
+}
+
+// confirmClientID confirms a client recorded by setClientID. A confirmed
+// client with the same id but another verifier has rebooted, and its state is
+// discarded.
+func (m *nfs4StateManager) confirmClientID(clientID uint64, confirm [8]byte, principal string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(time.Now())
+
+	c, ok := m.unconfirmed[clientID]
+	if !ok {
+		// a retransmitted confirmation succeeds again.
+		if c, ok = m.clients[clientID]; ok && c.confirm == confirm && c.Principal == principal {
+			c.lastRenew = time.Now()
+			return nil
+		}
+		return &NFSStatusError{NFSStatusStaleClient, nil}
+	}
+	if c.confirm != confirm || c.Principal != principal {
+		return &NFSStatusError{NFSStatusClidInUse, nil}
+	}
+	delete(m.unconfirmed, clientID)
+
+	for _, prev := range m.clients {
+		if bytes.Equal(prev.ID, c.ID) {
+			if prev.clientID == c.clientID {
+				// the callback was updated; the state is kept.
+				c.openOwners, c.lockOwners, c.states = prev.openOwners, prev.lockOwners, prev.states
+				for _, s := range c.states {
+					s.client = c
+				}
+			}
+			m.removeClient(prev)
+		}
+	}
+	if c.states == nil {
+		c.openOwners = make(map[string]*nfs4Owner)
+		c.lockOwners = make(map[string]*nfs4Owner)
+		c.states = make(map[[12]byte]*nfs4StateEntry)
+	}
+	c.confirmed = true
+	c.lastRenew = time.Now()
+	m.clients[c.clientID] = c
+	if m.store != nil {
+		if err := m.store.AddClient(c.NFS4ClientRecord); err != nil {
+			Log.Errorf("unable to record nfsv4 client: %v", err)
+		}
+	}
+	return nil
+}
+
+// client finds a confirmed client and renews its lease.
+func (m *nfs4StateManager) client(clientID uint64) (*nfs4Client, error) {
+	if uint32(clientID>>32) != m.boot {
+		return nil, &NFSStatusError{NFSStatusStaleClient, nil}
+	}
+	now := time.Now()
+	m.expire(now)
+	c, ok := m.clients[clientID]
+	if !ok {
+		return nil, &NFSStatusError{NFSStatusExpired, nil}
+	}
+	c.lastRenew = now
+	return c, nil
+}
+
+// renew renews the lease of a client.
+func (m *nfs4StateManager) renew(clientID uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.client(clientID)
+	return err
+}
+
+// owner finds, or creates, an open or lock owner of a client.
+func (m *nfs4StateManager) owner(clientID uint64, kind nfs4StateKind, owner []byte) (*nfs4Owner, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.client(clientID)
+	if err != nil {
+		return nil, err
+	}
+	owners := c.openOwners
+	if kind == nfs4LockState {
+		owners = c.lockOwners
+	}
+	o, ok := owners[string(owner)]
+	if !ok {
+		o = &nfs4Owner{}
+		owners[string(owner)] = o
+	}
+	return o, nil
+}
+
+// addState issues a stateid for an open or lock of fh by owner, or for one
+// the client is reclaiming after a restart.
+func (m *nfs4StateManager) addState(clientID uint64, kind nfs4StateKind, owner []byte, fh []byte, access, deny uint32, open *nfs4StateEntry, reclaim bool) (nfs4Stateid, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.client(clientID)
+	if err != nil {
+		return nfs4Stateid{}, err
+	}
+	if err := m.admit(c, reclaim); err != nil {
+		return nfs4Stateid{}, err
+	}
+	return m.issue(c, kind, owner, fh, access, deny, open), nil
+}
+
+// issue adds a state of client c, providing its stateid.
+func (m *nfs4StateManager) issue(c *nfs4Client, kind nfs4StateKind, owner []byte, fh []byte, access, deny uint32, open *nfs4StateEntry) nfs4Stateid {
+	m.next++
+	sid := nfs4Stateid{Seqid: 1}
+	binary.BigEndian.PutUint32(sid.Other[0:4], m.boot)
+	binary.BigEndian.PutUint64(sid.Other[4:12], m.next)
+	c.states[sid.Other] = &nfs4StateEntry{
+		kind:   kind,
+		client: c,
+		owner:  string(owner),
+		fh:     append([]byte{}, fh...),
+		access: access,
+		deny:   deny,
+		seqid:  1,
+		open:   open,
+	}
+	return sid
+}
+
+// open issues the open state of fh for owner, per rfc7530 section 16.16, or
+// upgrades the one owner already has. It fails with NFS4ERR_SHARE_DENIED when
+// the access or deny asked for conflicts with an open of another owner. When
+// no other client has fh open, the client may be offered a delegation of it
+// as well, of delegType; the delegation's stateid is then set.
+func (m *nfs4StateManager) open(clientID uint64, seqid uint32, owner []byte, fh []byte, access, deny uint32, reclaim bool) (openSid, delegSid nfs4Stateid, delegType uint32, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.client(clientID)
+	if err != nil {
+		return openSid, delegSid, nfs4DelegNone, err
+	}
+	if err := m.admit(c, reclaim); err != nil {
+		return openSid, delegSid, nfs4DelegNone, err
+	}
+
+	var mine *nfs4StateEntry
+	var other [12]byte
+	shared, delegated := false, false
+	for _, h := range m.clients {
+		for o, s := range h.states {
+			if !bytes.Equal(s.fh, fh) {
+				continue
+			}
+			if s.kind == nfs4DelegState && h == c {
+				delegated = true
+			}
+			if s.kind != nfs4OpenState {
+				continue
+			}
+			if h == c && s.owner == string(owner) {
+				mine, other = s, o
+				continue
+			}
+			if s.access&deny != 0 || s.deny&access != 0 {
+				return openSid, delegSid, nfs4DelegNone, &NFSStatusError{NFSStatusShareDenied, nil}
+			}
+			if h != c {
+				shared = true
+			}
+		}
+	}
+
+	o, ok := c.openOwners[string(owner)]
+	if !ok {
+		o = &nfs4Owner{}
+		c.openOwners[string(owner)] = o
+	}
+	// OPEN_CONFIRM is not asked for, so that owners are confirmed by their
+	// first OPEN.
+	o.seqid, o.confirmed = seqid, true
+
+	if mine != nil {
+		mine.access |= access
+		mine.deny |= deny
+		mine.seqid++
+		openSid = nfs4Stateid{Seqid: mine.seqid, Other: other}
+	} else {
+		openSid = m.issue(c, nfs4OpenState, owner, fh, access, deny, nil)
+	}
+
+	// conflicting delegations of other clients were recalled before the
+	// open was let through, so only the opens of others stand in the way.
+	if !m.delegations || !c.callbackUp || reclaim || shared || delegated {
+		return openSid, delegSid, nfs4DelegNone, nil
+	}
+	delegType, delegAccess := uint32(nfs4DelegRead), uint32(nfs4ShareAccessRead)
+	if access&nfs4ShareAccessWrite != 0 {
+		delegType, delegAccess = nfs4DelegWrite, nfs4ShareAccessBoth
+	}
+	delegSid = m.issue(c, nfs4DelegState, nil, fh, delegAccess, 0, nil)
+	return openSid, delegSid, delegType, nil
+}
+
+// findState resolves a stateid presented by a client, renewing the client's
+// lease. From minor version 1, a seqid of zero stands for the current one.
+func (m *nfs4StateManager) findState(sid nfs4Stateid, minorVersion uint32) (*nfs4StateEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if binary.BigEndian.Uint32(sid.Other[0:4]) != m.boot {
+		return nil, &NFSStatusError{NFSStatusStaleStateid, nil}
+	}
+	m.expire(time.Now())
+	for _, c := range m.clients {
+		s, ok := c.states[sid.Other]
+		if !ok {
+			continue
+		}
+		switch {
+		case sid.Seqid == 0 && minorVersion > 0:
+		case sid.Seqid < s.seqid:
+			return nil, &NFSStatusError{NFSStatusOldStateid, nil}
+		case sid.Seqid > s.seqid:
+			return nil, &NFSStatusError{NFSStatusBadStateid, nil}
+		}
+		c.lastRenew = time.Now()
+		return s, nil
+	}
+	return nil, &NFSStatusError{NFSStatusBadStateid, nil}
+}
+
+// removeState releases a stateid, along with the lock states of an open.
+func (m *nfs4StateManager) removeState(sid nfs4Stateid) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.clients {
+		s, ok := c.states[sid.Other]
+		if !ok {
+			continue
+		}
+		delete(c.states, sid.Other)
+		for other, l := range c.states {
+			if l.open == s {
+				delete(c.states, other)
+			}
+		}
+		return
+	}
+}
+
+// releaseLockOwner forgets a lock owner, which must hold no locks.
+func (m *nfs4StateManager) releaseLockOwner(clientID uint64, owner []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.client(clientID)
+	if err != nil {
+		return err
+	}
+	for _, s := range c.states {
+		if s.kind == nfs4LockState && s.owner == string(owner) {
+			return &NFSStatusError{NFSStatusLocksHeld, nil}
+		}
+	}
+	delete(c.lockOwners, string(owner))
+	return nil
+}
+
+// probeCallback checks the callback path of a confirmed client, recording
+// whether it may be recalled.
+func (m *nfs4StateManager) probeCallback(ctx context.Context, clientID uint64) {
+	m.mu.Lock()
+	c, ok := m.clients[clientID]
+	var cb nfs4Callback
+	if ok {
+		cb = c.callback
+	}
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	err := cb.probe(ctx)
+	if err != nil {
+		Log.Debugf("nfsv4 client %x callback path is down: %v", clientID, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.clients[clientID] == c {
+		c.callbackUp = err == nil
+	}
+}
+
+// callbackUp reports whether a client can be sent callbacks.
+func (m *nfs4StateManager) callbackUp(clientID uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.clients[clientID]
+	return ok && c.callbackUp
+}
+
+// recall asks the client holding the delegation sid to return it. A client
+// which can't be reached has its callback path marked down.
+func (m *nfs4StateManager) recall(ctx context.Context, sid nfs4Stateid, truncate bool) error {
+	m.mu.Lock()
+	var holder *nfs4Client
+	var fh []byte
+	for _, c := range m.clients {
+		if s, ok := c.states[sid.Other]; ok && s.kind == nfs4DelegState {
+			holder, fh, sid.Seqid = c, s.fh, s.seqid
+			break
+		}
+	}
+	if holder == nil {
+		m.mu.Unlock()
+		return &NFSStatusError{NFSStatusBadStateid, nil}
+	}
+	if !holder.callbackUp {
+		m.mu.Unlock()
+		return errCallbackDown
+	}
+	cb := holder.callback
+	m.mu.Unlock()
+
+	err := cb.recall(ctx, sid, truncate, fh)
+	var nerr *NFSStatusError
+	if err != nil && !errors.As(err, &nerr) {
+		m.mu.Lock()
+		holder.callbackUp = false
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// InGrace reports whether the server is in its NFSv4 grace period, accepting
+// only the reclaims of clients recorded before it started.
+func (s *Server) InGrace() bool {
+	s.init()
+	if s.nfs4State == nil {
+		return false
+	}
+	s.nfs4State.mu.Lock()
+	defer s.nfs4State.mu.Unlock()
+	return s.nfs4State.inGrace()
+}
@@ -0,0 +1,146 @@
+package nfs_test
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+type memNFS4Store struct {
+	mu      sync.Mutex
+	clients map[string]nfs.NFS4ClientRecord
+}
+
+func (s *memNFS4Store) Clients() ([]nfs.NFS4ClientRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []nfs.NFS4ClientRecord
+	for _, c := range s.clients {
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func (s *memNFS4Store) AddClient(r nfs.NFS4ClientRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[string(r.ID)] = r
+	return nil
+}
+
+func (s *memNFS4Store) RemoveClient(id []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, string(id))
+	return nil
+}
+
+func TestNFSv4GracePeriod(t *testing.T) {
+	mem := memfs.New()
+	store := &memNFS4Store{clients: make(map[string]nfs.NFS4ClientRecord)}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+
+	// with no client to reclaim state, there is no grace period.
+	srv := &nfs.Server{Handler: handler, EnableNFSv4: true, NFS4StateStore: store, NFS4GracePeriod: time.Hour}
+	if srv.InGrace() {
+		t.Fatal("expected no grace period without recorded clients")
+	}
+
+	_ = store.AddClient(nfs.NFS4ClientRecord{ID: []byte("client-1")})
+	srv = &nfs.Server{Handler: handler, EnableNFSv4: true, NFS4StateStore: store, NFS4GracePeriod: 100 * time.Millisecond}
+	if !srv.InGrace() {
+		t.Fatal("expected a grace period for the recorded client")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if srv.InGrace() {
+		t.Fatal("expected the grace period to end")
+	}
+}
+
+func TestNFSv4ClientID(t *testing.T) {
+	mem := memfs.New()
+	store := &memNFS4Store{clients: make(map[string]nfs.NFS4ClientRecord)}
+	start := func() (*nfstest.Server, *nfstest.Client) {
+		srv := nfstest.Start(t, &nfs.Server{
+			Handler:        helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+			EnableNFSv4:    true,
+			NFS4StateStore: store,
+		})
+		target := srv.Mount(t, "/", rpc.AuthNull)
+		return srv, target
+	}
+	// status reads the status of a single operation COMPOUND.
+	status := func(res io.ReadSeeker, err error) uint32 {
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, _ := xdr.ReadUint32(res)
+		_, _ = xdr.ReadUint32(res) // empty tag
+		_, _ = xdr.ReadUint32(res) // result count
+		_, _ = xdr.ReadUint32(res) // op
+		_, _ = xdr.ReadUint32(res) // op status
+		return st
+	}
+	renew := func(target *nfstest.Client, clientID uint64) uint32 {
+		var ops bytes.Buffer
+		_ = xdr.Write(&ops, uint32(nfs.NFS4OpRenew))
+		_ = xdr.Write(&ops, clientID)
+		return status(compound4(target, 1, ops.Bytes()))
+	}
+
+	srv, target := start()
+	var ops bytes.Buffer
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetClientID))
+	ops.Write([]byte("verifier"))
+	_ = xdr.Write(&ops, "client-1")
+	_ = xdr.Write(&ops, uint32(0x40000000))
+	_ = xdr.Write(&ops, "tcp")
+	_ = xdr.Write(&ops, "127.0.0.1.8.1")
+	_ = xdr.Write(&ops, uint32(1))
+	res, err := compound4(target, 1, ops.Bytes())
+	if st := status(res, err); st != 0 {
+		t.Fatalf("expected SETCLIENTID to succeed, got %d", st)
+	}
+	var clientID uint64
+	var confirm [8]byte
+	_ = xdr.Read(res, &clientID)
+	_, _ = io.ReadFull(res, confirm[:])
+
+	if st := renew(target, clientID); st != uint32(nfs.NFSStatusExpired) {
+		t.Fatalf("expected an unconfirmed client to be unable to renew, got %d", st)
+	}
+	ops.Reset()
+	_ = xdr.Write(&ops, uint32(nfs.NFS4OpSetClientIDConfirm))
+	_ = xdr.Write(&ops, clientID)
+	ops.Write(confirm[:])
+	if st := status(compound4(target, 1, ops.Bytes())); st != 0 {
+		t.Fatalf("expected SETCLIENTID_CONFIRM to succeed, got %d", st)
+	}
+	if st := renew(target, clientID); st != 0 {
+		t.Fatalf("expected a confirmed client to renew, got %d", st)
+	}
+	if recs, _ := store.Clients(); len(recs) != 1 || string(recs[0].ID) != "client-1" {
+		t.Fatalf("expected the confirmed client to be recorded, got %v", recs)
+	}
+	_ = target.Close()
+	_ = srv.Close()
+
+	// after a restart the clientid is stale, but the record remains for the
+	// client to reclaim its state.
+	srv, target = start()
+	defer srv.Close()
+	defer target.Close()
+	if st := renew(target, clientID); st != uint32(nfs.NFSStatusStaleClient) {
+		t.Fatalf("expected the clientid to be stale after a restart, got %d", st)
+	}
+}
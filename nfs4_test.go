@@ -0,0 +1,155 @@
+package nfs_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestNFSv4Compound(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/home/user", 0755)
+
+	type compoundArgs struct {
+		rpc.Header
+		Tag     string
+		Minor   uint32
+		Count   uint32
+		Root    uint32
+		GetRoot uint32
+		Save    uint32
+		Lookup1 uint32
+		Name1   string
+		Lookup2 uint32
+		Name2   string
+		Parent  uint32
+		GetFH   uint32
+		Restore uint32
+		Missing uint32
+		Name3   string
+		After   uint32
+	}
+	call := func(target *nfstest.Client) (io.ReadSeeker, error) {
+		return target.Call(&compoundArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Vers:    4,
+				Prog:    nfsc.Nfs3Prog,
+				Proc:    1,
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Tag:     "test",
+			Count:   10,
+			Root:    uint32(nfs.NFS4OpPutRootFH),
+			GetRoot: uint32(nfs.NFS4OpGetFH),
+			Save:    uint32(nfs.NFS4OpSaveFH),
+			Lookup1: uint32(nfs.NFS4OpLookup),
+			Name1:   "home",
+			Lookup2: uint32(nfs.NFS4OpLookup),
+			Name2:   "user",
+			Parent:  uint32(nfs.NFS4OpLookupP),
+			GetFH:   uint32(nfs.NFS4OpGetFH),
+			Restore: uint32(nfs.NFS4OpRestoreFH),
+			Missing: uint32(nfs.NFS4OpLookup),
+			Name3:   "missing",
+			After:   uint32(nfs.NFS4OpGetFH),
+		})
+	}
+
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+	disabled := nfstest.Serve(t, handler)
+	target := disabled.Mount(t, "/", rpc.AuthNull)
+	if _, err := call(target); err == nil {
+		t.Fatal("expected NFSv4 to be refused unless enabled")
+	}
+
+	srv := nfstest.Start(t, &nfs.Server{Handler: handler, EnableNFSv4: true})
+	target = srv.Mount(t, "/", rpc.AuthNull)
+	res, err := call(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := xdr.ReadUint32(res)
+	if status != uint32(nfs.NFSStatusNoEnt) {
+		t.Fatalf("expected the compound to end with the failed lookup, got %d", status)
+	}
+	if tag, _ := xdr.ReadOpaque(res); string(tag) != "test" {
+		t.Fatalf("expected the tag to be echoed, got %q", tag)
+	}
+	if n, _ := xdr.ReadUint32(res); n != 9 {
+		t.Fatalf("expected results up to the failed operation, got %d", n)
+	}
+	var handles [][]byte
+	for i := 0; i < 9; i++ {
+		op, _ := xdr.ReadUint32(res)
+		st, _ := xdr.ReadUint32(res)
+		if i < 8 && st != 0 {
+			t.Fatalf("expected op %d to succeed, got %d", op, st)
+		}
+		if nfs.NFS4Operation(op) == nfs.NFS4OpGetFH {
+			fh, _ := xdr.ReadOpaque(res)
+			_, _ = res.Seek(int64(len(fh)+3)&^3-int64(len(fh)), io.SeekCurrent)
+			handles = append(handles, fh)
+		}
+	}
+	if len(handles) != 2 {
+		t.Fatalf("expected two filehandles, got %d", len(handles))
+	}
+	_, home, err := target.Lookup("/home", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(handles[1], home) {
+		t.Fatal("expected LOOKUPP to return to the parent directory")
+	}
+}
+
+// compound4 sends an NFSv4 COMPOUND of the count operations encoded in ops.
+func compound4(target *nfstest.Client, count uint32, ops []byte) (io.ReadSeeker, error) {
+	return compound4As(target, rpc.AuthNull, count, ops)
+}
+
+// compound4As sends an NFSv4 COMPOUND made with the credentials cred.
+func compound4As(target *nfstest.Client, cred rpc.Auth, count uint32, ops []byte) (io.ReadSeeker, error) {
+	return compound4Of(target, cred, 0, count, ops)
+}
+
+// compound4Minor sends an NFSv4 COMPOUND of minor version minor.
+func compound4Minor(target *nfstest.Client, minor, count uint32, ops []byte) (io.ReadSeeker, error) {
+	return compound4Of(target, rpc.AuthNull, minor, count, ops)
+}
+
+func compound4Of(target *nfstest.Client, cred rpc.Auth, minor, count uint32, ops []byte) (io.ReadSeeker, error) {
+	var body bytes.Buffer
+	_ = xdr.Write(&body, "")
+	_ = xdr.Write(&body, minor)
+	_ = xdr.Write(&body, count)
+	body.Write(ops)
+
+	args := reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "Header", Type: reflect.TypeOf(rpc.Header{})},
+		{Name: "Body", Type: reflect.ArrayOf(body.Len(), reflect.TypeOf(byte(0)))},
+	}))
+	args.Elem().Field(0).Set(reflect.ValueOf(rpc.Header{
+		Rpcvers: 2,
+		Vers:    4,
+		Prog:    nfsc.Nfs3Prog,
+		Proc:    1,
+		Cred:    cred,
+		Verf:    rpc.AuthNull,
+	}))
+	reflect.Copy(args.Elem().Field(1), reflect.ValueOf(body.Bytes()))
+	return target.Call(args.Interface())
+}
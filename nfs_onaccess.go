@@ -4,13 +4,12 @@ import (
 	"bytes"
 	"context"
 
-	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func onAccess(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
-	roothandle, err := xdr.ReadOpaque(w.req.Body)
+	roothandle, err := readHandle(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -23,16 +22,32 @@ func onAccess(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
+	var attr *FileAttribute
+	fullPath := fs.Join(path...)
+	if info, err := w.Server.attrCache.lstat(ctx, fs, fullPath, roothandle); err == nil {
+		attr = exportAttributes(ctx, ToFileAttribute(info, fullPath))
+	} else {
+		Log.Errorf("err loading attrs for %s: %v", fullPath, err)
+	}
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, attr); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
-		mask = mask & (1 | 2 | 0x20)
+	if isReadOnly(ctx, fs) {
+		mask = mask & (accessRead | accessLookup | accessExecute)
+	}
+	if procedureDisabled(ctx, NFSProcedureRemove) {
+		mask &^= accessDelete
+	}
+	if procedureDisabled(ctx, NFSProcedureWrite) && (attr == nil || attr.Type != FileTypeDirectory) {
+		mask &^= accessModify | accessExtend
+	}
+	if cred, ok := permissionCaller(ctx); ok && attr != nil {
+		mask &= grantedAccess(cred, attr)
 	}
 
 	if err := xdr.Write(writer, mask); err != nil {
@@ -9,10 +9,11 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-// onCommit - note this is a no-op, as we always push writes to the backing store.
+// onCommit flushes previously UNSTABLE writes to stable storage. The whole file
+// is flushed irrespective of the requested range.
 func onCommit(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
-	handle, err := xdr.ReadOpaque(w.req.Body)
+	handle, err := readHandle(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -22,8 +23,26 @@ func onCommit(ctx context.Context, w *response, userHandle Handler) error {
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
-		return &NFSStatusError{NFSStatusServerFault, os.ErrPermission}
+	if isReadOnly(ctx, fs) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+
+	fullPath := fs.Join(path...)
+	info, err := fs.Lstat(fullPath)
+	if err != nil {
+		return statusError(err, NFSStatusIO)
+	}
+	preOpCache := ToFileAttribute(info, fullPath).AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, path, preOpCache})
+	if !info.Mode().IsRegular() {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+
+	if CapabilitiesOf(userHandle, fs)&CapabilitySync != 0 {
+		if err := commitFile(fs, fullPath); err != nil {
+			Log.Errorf("error syncing: %v", err)
+			return statusError(err, NFSStatusIO)
+		}
 	}
 
 	writer := bytes.NewBuffer([]byte{})
@@ -31,15 +50,11 @@ func onCommit(ctx context.Context, w *response, userHandle Handler) error {
 		return err
 	}
 
-	// no pre-op cache data.
-	if err := xdr.Write(writer, uint32(0)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preOpCache, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 	// write the 8 bytes of write verification.
-	if err := xdr.Write(writer, w.Server.ID); err != nil {
+	if err := xdr.Write(writer, w.Server.writeVerifier()); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -48,3 +63,21 @@ func onCommit(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	return nil
 }
+
+// commitFile flushes the file at path to stable storage. It is opened for
+// writing, as flushing may require, as FlushFileBuffers does on Windows; a
+// file that can't be is flushed by the filesystem, if it is able to.
+func commitFile(fs billy.Filesystem, path string) error {
+	file, err := fs.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if sfs, ok := fs.(SyncFilesystem); ok {
+			return sfs.Sync(path)
+		}
+		return err
+	}
+	if err := syncToStable(fs, file, path); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,186 @@
+package nfs_test
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// syncFS counts calls to its SyncFilesystem extension.
+type syncFS struct {
+	billy.Filesystem
+	syncs *int32
+}
+
+func (s syncFS) Sync(string) error {
+	atomic.AddInt32(s.syncs, 1)
+	return nil
+}
+
+func TestCommitSyncs(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	var syncs int32
+	fs := syncFS{mem, &syncs}
+
+	srv := nfstest.ServeFS(t, fs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type writeArgs struct {
+		rpc.Header
+		Handle []byte
+		Offset uint64
+		Count  uint32
+		How    uint32
+		Data   []byte
+	}
+	type writeRes struct {
+		Wcc       nfsc.WccData
+		Count     uint32
+		Committed uint32
+		Verf      uint64
+	}
+	data := []byte("unstable")
+	res, err := target.Call(&writeArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Vers:    nfsc.Nfs3Vers,
+			Prog:    nfsc.Nfs3Prog,
+			Proc:    uint32(nfs.NFSProcedureWrite),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+		Count:  uint32(len(data)),
+		How:    0,
+		Data:   data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := xdr.ReadUint32(res); err != nil || status != 0 {
+		t.Fatalf("write failed: %d %v", status, err)
+	}
+	var wr writeRes
+	if err := xdr.Read(res, &wr); err != nil {
+		t.Fatal(err)
+	}
+	if wr.Committed != 0 {
+		t.Fatalf("expected an unstable write to be reported unstable, got %d", wr.Committed)
+	}
+	if n := atomic.LoadInt32(&syncs); n != 0 {
+		t.Fatalf("unstable write synced %d times", n)
+	}
+
+	if status := commit(t, target, fh); status != 0 {
+		t.Fatalf("commit failed: %d", status)
+	}
+	if n := atomic.LoadInt32(&syncs); n != 1 {
+		t.Fatalf("expected commit to sync once, got %d", n)
+	}
+}
+
+// commit sends a COMMIT of the file fh, providing its status.
+func commit(t *testing.T, target *nfstest.Client, fh []byte) uint32 {
+	t.Helper()
+	type commitArgs struct {
+		rpc.Header
+		Handle []byte
+		Offset uint64
+		Count  uint32
+	}
+	res, err := target.Call(&commitArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Vers:    nfsc.Nfs3Vers,
+			Prog:    nfsc.Nfs3Prog,
+			Proc:    uint32(nfs.NFSProcedureCommit),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// flushFS gives files that, as on Windows, can only be flushed when opened for
+// writing. Flushing fails once fail is set.
+type flushFS struct {
+	billy.Filesystem
+	syncs int32
+	fail  int32
+}
+
+func (fs *flushFS) Open(name string) (billy.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *flushFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &flushFile{f, fs, flag&(os.O_WRONLY|os.O_RDWR) != 0}, nil
+}
+
+type flushFile struct {
+	billy.File
+	fs       *flushFS
+	writable bool
+}
+
+func (f *flushFile) Sync() error {
+	if !f.writable {
+		return os.ErrPermission
+	}
+	if atomic.LoadInt32(&f.fs.fail) != 0 {
+		return errors.New("flush failed")
+	}
+	atomic.AddInt32(&f.fs.syncs, 1)
+	return nil
+}
+
+func TestCommitFlushesWritableFile(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	fs := &flushFS{Filesystem: mem}
+	srv := nfstest.ServeFS(t, fs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := commit(t, target, fh); status != 0 {
+		t.Fatalf("expected commit to flush the file opened for writing, got %d", status)
+	}
+	if n := atomic.LoadInt32(&fs.syncs); n != 1 {
+		t.Fatalf("expected commit to sync once, got %d", n)
+	}
+	atomic.StoreInt32(&fs.fail, 1)
+	if status := commit(t, target, fh); status != uint32(nfs.NFSStatusIO) {
+		t.Fatalf("expected commit to fail when the file can't be flushed, got %d", status)
+	}
+}
@@ -3,7 +3,10 @@ package nfs
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
@@ -13,12 +16,93 @@ const (
 	createModeUnchecked = 0
 	createModeGuarded   = 1
 	createModeExclusive = 2
+
+	// createDefaultMode is the mode of files created without one, as
+	// billy.Filesystem.Create gives them.
+	createDefaultMode = 0666
 )
 
+// createVerifier is the createverf3 of an EXCLUSIVE CREATE. As Linux's nfsd
+// does, it is kept in the times of the file created, its first half in the
+// seconds of the modification time and its second in those of the access
+// time, until the client sets them, so that a retransmitted CREATE can be
+// told from one made by another client. Those of backends without a Change
+// are remembered by the server instead, until it restarts.
+type createVerifier [8]byte
+
+// createVerifiersMax bounds the verifiers a server remembers.
+const createVerifiersMax = 1024
+
+// createVerifiers are the verifiers of the files a server created
+// exclusively, by the handles of the files.
+type createVerifiers struct {
+	mu sync.Mutex
+	m  map[string]createVerifier
+}
+
+func newCreateVerifiers() *createVerifiers {
+	return &createVerifiers{m: make(map[string]createVerifier)}
+}
+
+func (c *createVerifiers) remember(handle []byte, v createVerifier) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.m) >= createVerifiersMax {
+		c.m = make(map[string]createVerifier)
+	}
+	c.m[string(handle)] = v
+}
+
+func (c *createVerifiers) has(handle []byte, v createVerifier) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	got, ok := c.m[string(handle)]
+	return ok && got == v
+}
+
+func (v createVerifier) times() (atime, mtime time.Time) {
+	return time.Unix(int64(binary.BigEndian.Uint32(v[4:])), 0), time.Unix(int64(binary.BigEndian.Uint32(v[:4])), 0)
+}
+
+func (v createVerifier) store(changer billy.Change, path string) {
+	if changer == nil {
+		return
+	}
+	atime, mtime := v.times()
+	if err := changer.Chtimes(path, atime, mtime); err != nil {
+		Log.Debugf("unable to keep the create verifier of %s: %v", path, err)
+	}
+}
+
+// matches reports whether the file with attributes attr holds v. Backends
+// keeping no access time give the modification time as it, which is then
+// all that is compared.
+func (v createVerifier) matches(attr *FileAttribute) bool {
+	atime, mtime := v.times()
+	if attr.Mtime.Seconds != uint32(mtime.Unix()) || attr.Mtime.Nseconds != 0 {
+		return false
+	}
+	return attr.Atime == attr.Mtime || attr.Atime.Seconds == uint32(atime.Unix())
+}
+
+// createFile creates an empty file at path, which must not exist when
+// exclusive, so that of clients racing to create it only one succeeds.
+func createFile(fs billy.Filesystem, path string, exclusive bool) error {
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flag = os.O_RDWR | os.O_CREATE | os.O_EXCL
+	}
+	file, err := fs.OpenFile(path, flag, createDefaultMode)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
 func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -27,6 +111,7 @@ func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 	var attrs *SetFileAttributes
+	var verf createVerifier
 	if how == createModeUnchecked || how == createModeGuarded {
 		sattr, err := ReadSetFileAttributes(w.req.Body)
 		if err != nil {
@@ -34,14 +119,12 @@ func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 		}
 		attrs = sattr
 	} else if how == createModeExclusive {
-		// read createverf3
-		var verf [8]byte
-		if err := xdr.Read(w.req.Body, &verf); err != nil {
+		if err := readArgs(w.req.Body, &verf); err != nil {
 			return &NFSStatusError{NFSStatusInval, err}
 		}
-		Log.Errorf("failing create to indicate lack of support for 'exclusive' mode.")
-		// TODO: support 'exclusive' mode.
-		return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
+		// clients set the attributes of exclusively created files with a
+		// SETATTR once they are created.
+		attrs = &SetFileAttributes{}
 	} else {
 		// invalid
 		return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
@@ -51,16 +134,35 @@ func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, nil}
+	if err := checkNewName(obj.Filename); err != nil {
+		return err
 	}
+	obj.Filename = caseName(ctx, fs, path, obj.Filename)
 
-	newFile := append(path, string(obj.Filename))
+	newFile := entryPath(path, obj.Filename)
 	newFilePath := fs.Join(newFile...)
+	dirPath := fs.Join(path...)
+	dirInfo, err := fs.Stat(dirPath)
+	if err != nil {
+		return statusError(err, NFSStatusAccess)
+	} else if !dirInfo.IsDir() {
+		return &NFSStatusError{NFSStatusNotDir, nil}
+	}
+	dirAttr := ToFileAttribute(dirInfo, dirPath)
+	preDirAttr := dirAttr.AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, path, preDirAttr})
+	if err := checkAccess(ctx, dirAttr, accessModify|accessLookup); err != nil {
+		return err
+	}
+
+	exportMode(ctx, attrs, createDefaultMode, false)
+
+	changer := userHandle.Change(fs)
+	created := true
 	if s, err := fs.Stat(newFilePath); err == nil {
 		if s.IsDir() {
 			return &NFSStatusError{NFSStatusExist, nil}
@@ -68,30 +170,32 @@ func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 		if how == createModeGuarded {
 			return &NFSStatusError{NFSStatusExist, os.ErrPermission}
 		}
-	} else {
-		if s, err := fs.Stat(fs.Join(path...)); err != nil {
-			return &NFSStatusError{NFSStatusAccess, err}
-		} else if !s.IsDir() {
-			return &NFSStatusError{NFSStatusNotDir, nil}
+		if how == createModeExclusive {
+			// a retransmission of the CREATE which made the file finds
+			// the verifier it was given.
+			if !verf.matches(ToFileAttribute(s, newFilePath)) && !w.Server.createVerifiers.has(userHandle.ToHandle(fs, newFile), verf) {
+				return &NFSStatusError{NFSStatusExist, os.ErrExist}
+			}
+			created = false
 		}
 	}
 
-	file, err := fs.Create(newFilePath)
-	if err != nil {
-		Log.Errorf("Error Creating: %v", err)
-		return &NFSStatusError{NFSStatusAccess, err}
-	}
-	if err := file.Close(); err != nil {
-		Log.Errorf("Error Creating: %v", err)
-		return &NFSStatusError{NFSStatusAccess, err}
-	}
-
-	fp := userHandle.ToHandle(fs, newFile)
-	changer := userHandle.Change(fs)
-	if err := attrs.Apply(changer, fs, newFilePath); err != nil {
-		Log.Errorf("Error applying attributes: %v\n", err)
-		return &NFSStatusError{NFSStatusIO, err}
+	if created {
+		if err := createFile(fs, newFilePath, how == createModeExclusive); err != nil {
+			Log.Errorf("Error Creating: %v", err)
+			return statusError(err, NFSStatusAccess)
+		}
+		chownToCaller(ctx, changer, newFilePath, dirAttr)
+		if err := attrs.Apply(changer, fs, newFilePath); err != nil {
+			Log.Errorf("Error applying attributes: %v\n", err)
+			return statusError(err, NFSStatusIO)
+		}
+		if how == createModeExclusive {
+			verf.store(changer, newFilePath)
+			w.Server.createVerifiers.remember(userHandle.ToHandle(fs, newFile), verf)
+		}
 	}
+	fp := w.toHandle(ctx, userHandle, fs, newFile)
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
@@ -105,15 +209,11 @@ func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, fp); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, []string{file.Name()})); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, newFile)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	// dir_wcc (we don't include pre_op_attr)
-	if err := xdr.Write(writer, uint32(0)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preDirAttr, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
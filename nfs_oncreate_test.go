@@ -0,0 +1,150 @@
+package nfs_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestESXiQuirks(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, "vm"), 0755)
+	fs := helpers.NewChangeOSFS(osfs.New(dir))
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(fs), nfs.ExportOptions{ESXiQuirks: true})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	_, vm, err := target.Lookup("/vm", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type createArgs struct {
+		rpc.Header
+		Where nfsc.Diropargs3
+		How   uint32
+		Verf  [8]byte
+	}
+	create := func(verf byte) uint32 {
+		res, err := target.Call(&createArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Vers:    nfsc.Nfs3Vers,
+				Prog:    nfsc.Nfs3Prog,
+				Proc:    uint32(nfs.NFSProcedureCreate),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Where: nfsc.Diropargs3{FH: vm, Filename: ".lck-1"},
+			How:   2,
+			Verf:  [8]byte{1, 2, 3, 4, 5, 6, 7, verf},
+		})
+		if err != nil {
+			var nfsErr *nfsc.Error
+			if errors.As(err, &nfsErr) {
+				return nfsErr.ErrorNum
+			}
+			t.Fatal(err)
+		}
+		status, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	if status := create(8); status != 0 {
+		t.Fatalf("expected an exclusive create to succeed, got %d", status)
+	}
+	if status := create(8); status != 0 {
+		t.Fatalf("expected a retransmitted exclusive create to succeed, got %d", status)
+	}
+	if status := create(9); status != uint32(nfs.NFSStatusExist) {
+		t.Fatalf("expected an exclusive create by another client to fail, got %d", status)
+	}
+
+	info, err := target.FSInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.WTPref != 1<<20 || info.RTMax != 1<<20 {
+		t.Fatalf("expected transfers of at most a MiB, got %d and %d", info.WTPref, info.RTMax)
+	}
+}
+
+func TestCreateWcc(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/dir", 0755)
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	_, dir, err := target.Lookup("/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type createArgs struct {
+		rpc.Header
+		Where nfsc.Diropargs3
+		How   uint32
+		Attrs nfsc.Sattr3
+	}
+	// create makes a GUARDED CREATE of name, providing its status and the
+	// wcc_data of the directory.
+	create := func(name string) (uint32, *nfsc.WccData) {
+		res, err := target.Call(&createArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Vers:    nfsc.Nfs3Vers,
+				Prog:    nfsc.Nfs3Prog,
+				Proc:    uint32(nfs.NFSProcedureCreate),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Where: nfsc.Diropargs3{FH: dir, Filename: name},
+			How:   1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status == uint32(nfs.NFSStatusOk) {
+			var fh nfsc.PostOpFH3
+			var attr nfsc.PostOpAttr
+			if err := xdr.Read(res, &fh); err != nil {
+				t.Fatal(err)
+			}
+			if err := xdr.Read(res, &attr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wcc := new(nfsc.WccData)
+		if err := xdr.Read(res, wcc); err != nil {
+			t.Fatal(err)
+		}
+		return status, wcc
+	}
+
+	if status, wcc := create("file"); status != uint32(nfs.NFSStatusOk) {
+		t.Fatalf("expected CREATE to succeed, got %d", status)
+	} else if !wcc.Before.IsSet || !wcc.After.IsSet {
+		t.Fatal("expected the wcc data of the directory with CREATE")
+	}
+	// a failed CREATE still lets the client revalidate the directory.
+	if status, wcc := create("file"); status != uint32(nfs.NFSStatusExist) {
+		t.Fatalf("expected a GUARDED CREATE of an existing file to fail, got %d", status)
+	} else if !wcc.Before.IsSet || !wcc.After.IsSet {
+		t.Fatal("expected the wcc data of the directory with EXIST")
+	}
+}
@@ -3,8 +3,8 @@ package nfs
 import (
 	"bytes"
 	"context"
+	"time"
 
-	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
@@ -17,10 +17,13 @@ const (
 	FSInfoPropertyHomogeneous = 0x0008
 	// FSInfoPropertyCanSetTime can the FS support setting access/mod times?
 	FSInfoPropertyCanSetTime = 0x0010
+
+	// esxiTransferMax is the largest transfer offered to ESXi hosts.
+	esxiTransferMax = 1 << 20
 )
 
 func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
-	roothandle, err := xdr.ReadOpaque(w.req.Body)
+	roothandle, err := readHandle(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -29,11 +32,16 @@ func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 
+	info, err := fsInfoFor(fs)
+	if err != nil {
+		return statusError(err, NFSStatusServerFault)
+	}
+
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -46,7 +54,7 @@ func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
 		Wtmult      uint32
 		Dtpref      uint32
 		Maxfilesize uint64
-		TimeDelta   uint64
+		TimeDelta   FileTime
 		Properties  uint32
 	}
 
@@ -58,24 +66,32 @@ func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
 		Wtpref:      1 << 30,
 		Wtmult:      4096,
 		Dtpref:      8192,
-		Maxfilesize: 1 << 62, // wild guess. this seems big.
-		TimeDelta:   1,       // nanosecond precision.
-		Properties:  0,
+		Maxfilesize: info.MaxFileSize,
+		TimeDelta: FileTime{
+			Seconds:  uint32(info.TimeDelta / time.Second),
+			Nseconds: uint32(info.TimeDelta % time.Second),
+		},
+		Properties: 0,
 	}
 
-	// TODO: these aren't great indications of support, really.
-	if _, ok := fs.(billy.Symlink); ok {
+	if esxiQuirks(ctx) {
+		res.Rtmax, res.Rtpref, res.Wtmax, res.Wtpref = esxiTransferMax, esxiTransferMax, esxiTransferMax, esxiTransferMax
+	}
+
+	caps := CapabilitiesOf(userHandle, fs)
+	if caps&CapabilityLinks != 0 && !procedureDisabled(ctx, NFSProcedureLink) {
 		res.Properties |= FSInfoPropertyLink
+	}
+	if caps&CapabilitySymlinks != 0 && !procedureDisabled(ctx, NFSProcedureSymlink) {
 		res.Properties |= FSInfoPropertySymlink
 	}
 	// TODO: if the nfs share spans multiple virtual mounts, may need
 	// to support granular PATHINFO responses.
 	res.Properties |= FSInfoPropertyHomogeneous
 	// TODO: not a perfect indicator
-	if billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if !isReadOnly(ctx, fs) && !procedureDisabled(ctx, NFSProcedureSetAttr) {
 		res.Properties |= FSInfoPropertyCanSetTime
 	}
-	// TODO: this whole struct should be specifiable by the userhandler.
 
 	if err := xdr.Write(writer, res); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
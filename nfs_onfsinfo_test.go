@@ -0,0 +1,60 @@
+package nfs_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// limitedFS reports coarser limits than the server defaults.
+type limitedFS struct {
+	billy.Filesystem
+}
+
+func (limitedFS) FSInfo(info *nfs.FSInfo) error {
+	info.MaxFileSize = 1 << 20
+	info.TimeDelta = 2 * time.Second
+	return nil
+}
+
+func TestFSInfoLimits(t *testing.T) {
+	mem := memfs.New()
+	f, _ := mem.Create("/file")
+	_ = f.Close()
+
+	srv := nfstest.ServeFS(t, limitedFS{mem})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	info, err := target.FSInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 1<<20 {
+		t.Fatalf("expected maxfilesize of 1MiB, got %d", info.Size)
+	}
+	if info.TimeDelta.Seconds != 2 || info.TimeDelta.Nseconds != 0 {
+		t.Fatalf("expected a time delta of 2s, got %+v", info.TimeDelta)
+	}
+
+	wf, err := target.OpenFile("/file", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wf.Close()
+	if _, err := wf.Seek(1<<20, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	var nerr *nfsc.Error
+	if _, err := wf.Write([]byte("x")); !errors.As(err, &nerr) || nerr.ErrorNum != uint32(nfs.NFSStatusFBig) {
+		t.Fatalf("expected a write past maxfilesize to fail with FBIG, got %v", err)
+	}
+}
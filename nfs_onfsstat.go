@@ -4,12 +4,11 @@ import (
 	"bytes"
 	"context"
 
-	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func onFSStat(ctx context.Context, w *response, userHandle Handler) error {
-	roothandle, err := xdr.ReadOpaque(w.req.Body)
+	roothandle, err := readHandle(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -27,24 +26,21 @@ func onFSStat(ctx context.Context, w *response, userHandle Handler) error {
 		AvailableFiles: 1 << 62,
 		CacheHint:      0,
 	}
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		defaults.AvailableFiles = 0
 		defaults.AvailableSize = 0
 	}
 
 	err = userHandle.FSStat(ctx, fs, &defaults)
 	if err != nil {
-		if _, ok := err.(*NFSStatusError); ok {
-			return err
-		}
-		return &NFSStatusError{NFSStatusServerFault, err}
+		return statusError(err, NFSStatusServerFault)
 	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -3,13 +3,12 @@ package nfs
 import (
 	"bytes"
 	"context"
-	"os"
 
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func onGetAttr(ctx context.Context, w *response, userHandle Handler) error {
-	handle, err := xdr.ReadOpaque(w.req.Body)
+	handle, err := readHandle(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -20,14 +19,11 @@ func onGetAttr(ctx context.Context, w *response, userHandle Handler) error {
 	}
 
 	fullPath := fs.Join(path...)
-	info, err := fs.Stat(fullPath)
+	info, err := w.Server.attrCache.lstat(ctx, fs, fullPath, handle)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return statusError(err, NFSStatusIO)
 	}
-	attr := ToFileAttribute(info, fullPath)
+	attr := exportAttributes(ctx, ToFileAttribute(info, fullPath))
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
@@ -13,7 +13,7 @@ import (
 func onLink(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -22,7 +22,7 @@ func onLink(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
-	target, err := xdr.ReadOpaque(w.req.Body)
+	target, err := readBoundedOpaque(w.req.Body, pathMax)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -31,40 +31,52 @@ func onLink(ctx context.Context, w *response, userHandle Handler) error {
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	if err := checkNewName(obj.Filename); err != nil {
+		return err
 	}
+	obj.Filename = caseName(ctx, fs, path, obj.Filename)
 
-	newFilePath := fs.Join(append(path, string(obj.Filename))...)
+	newFilePath := fs.Join(entryPath(path, obj.Filename)...)
 	if _, err := fs.Stat(newFilePath); err == nil {
 		return &NFSStatusError{NFSStatusExist, os.ErrExist}
 	}
-	if s, err := fs.Stat(fs.Join(path...)); err != nil {
-		return &NFSStatusError{NFSStatusAccess, err}
-	} else if !s.IsDir() {
+	dirPath := fs.Join(path...)
+	dirInfo, err := fs.Stat(dirPath)
+	if err != nil {
+		return statusError(err, NFSStatusAccess)
+	} else if !dirInfo.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
+	dirAttr := ToFileAttribute(dirInfo, dirPath)
+	preDirAttr := dirAttr.AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, path, preDirAttr})
+	if err := checkAccess(ctx, dirAttr, accessModify|accessLookup); err != nil {
+		return err
+	}
 
-	fp := userHandle.ToHandle(fs, append(path, string(obj.Filename)))
+	fp := w.toHandle(ctx, userHandle, fs, entryPath(path, obj.Filename))
 	changer := userHandle.Change(fs)
 	if changer == nil {
 		return &NFSStatusError{NFSStatusAccess, err}
 	}
+	if err := requireCapability(userHandle, fs, CapabilityLinks); err != nil {
+		return err
+	}
 	cos, ok := changer.(UnixChange)
 	if !ok {
-		return &NFSStatusError{NFSStatusAccess, err}
+		return &NFSStatusError{NFSStatusNotSupp, billy.ErrNotSupported}
 	}
 
 	err = cos.Link(string(target), newFilePath)
 	if err != nil {
-		return &NFSStatusError{NFSStatusAccess, err}
+		return statusError(err, NFSStatusAccess)
 	}
 	if err := attrs.Apply(changer, fs, newFilePath); err != nil {
-		return &NFSStatusError{NFSStatusIO, err}
+		return statusError(err, NFSStatusIO)
 	}
 
 	writer := bytes.NewBuffer([]byte{})
@@ -79,11 +91,11 @@ func onLink(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, fp); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, append(path, string(obj.Filename)))); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, entryPath(path, obj.Filename))); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, nil, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preDirAttr, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -3,13 +3,12 @@ package nfs
 import (
 	"bytes"
 	"context"
-	"os"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func lookupSuccessResponse(handle []byte, entPath, dirPath []string, fs billy.Filesystem) ([]byte, error) {
+func lookupSuccessResponse(ctx context.Context, handle []byte, entPath, dirPath []string, fs billy.Filesystem) ([]byte, error) {
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return nil, err
@@ -17,10 +16,10 @@ func lookupSuccessResponse(handle []byte, entPath, dirPath []string, fs billy.Fi
 	if err := xdr.Write(writer, handle); err != nil {
 		return nil, err
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, entPath)); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, entPath)); err != nil {
 		return nil, err
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, dirPath)); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, dirPath)); err != nil {
 		return nil, err
 	}
 	return writer.Bytes(), nil
@@ -29,7 +28,7 @@ func lookupSuccessResponse(handle []byte, entPath, dirPath []string, fs billy.Fi
 func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -39,28 +38,30 @@ func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 	dirInfo, err := fs.Lstat(fs.Join(p...))
-	if err != nil || !dirInfo.IsDir() {
-		return &NFSStatusError{NFSStatusNotDir, err}
+	if err != nil {
+		return statusError(err, NFSStatusNotDir)
 	}
-
-	// Special cases for "." and ".."
-	if bytes.Equal(obj.Filename, []byte(".")) {
-		resp, err := lookupSuccessResponse(obj.Handle, p, p, fs)
-		if err != nil {
-			return &NFSStatusError{NFSStatusServerFault, err}
-		}
-		if err := w.Write(resp); err != nil {
-			return &NFSStatusError{NFSStatusServerFault, err}
-		}
-		return nil
+	if !dirInfo.IsDir() {
+		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
-	if bytes.Equal(obj.Filename, []byte("..")) {
-		if len(p) == 0 {
-			return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+	w.errorFmt = opAttrErrorFormatterFor(ctx, fs, p)
+	if err := checkName(obj.Filename); err != nil {
+		return err
+	}
+	obj.Filename = caseName(ctx, fs, p, obj.Filename)
+	if err := checkAccess(ctx, ToFileAttribute(dirInfo, fs.Join(p...)), accessLookup); err != nil {
+		return err
+	}
+
+	// Special cases for "." and "..". The parent of the export root is the
+	// root itself, so that clients can't walk out of the export.
+	if isDotEntry(obj.Filename) {
+		dotPath := lookupPath(p, obj.Filename)
+		dotHandle := obj.Handle
+		if len(dotPath) != len(p) {
+			dotHandle = w.toHandle(ctx, userHandle, fs, dotPath)
 		}
-		pPath := p[0 : len(p)-1]
-		pHandle := userHandle.ToHandle(fs, pPath)
-		resp, err := lookupSuccessResponse(pHandle, pPath, p, fs)
+		resp, err := lookupSuccessResponse(ctx, dotHandle, dotPath, p, fs)
 		if err != nil {
 			return &NFSStatusError{NFSStatusServerFault, err}
 		}
@@ -70,13 +71,13 @@ func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 		return nil
 	}
 
-	reqPath := append(p, string(obj.Filename))
+	reqPath := entryPath(p, obj.Filename)
 	if _, err = fs.Lstat(fs.Join(reqPath...)); err != nil {
-		return &NFSStatusError{NFSStatusNoEnt, os.ErrNotExist}
+		return statusError(err, NFSStatusNoEnt)
 	}
 
-	newHandle := userHandle.ToHandle(fs, reqPath)
-	resp, err := lookupSuccessResponse(newHandle, reqPath, p, fs)
+	newHandle := w.toHandle(ctx, userHandle, fs, reqPath)
+	resp, err := lookupSuccessResponse(ctx, newHandle, reqPath, p, fs)
 	if err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
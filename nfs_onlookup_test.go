@@ -0,0 +1,56 @@
+package nfs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestLookupDotDot(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/dir/sub", 0755)
+
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	_, root, err := target.Lookup("/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dir, err := target.Lookup("/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sub, err := target.Lookup("/dir/sub", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc     string
+		dir      []byte
+		name     string
+		expected []byte
+	}{
+		{"root dot", root, ".", root},
+		{"root dotdot", root, "..", root},
+		{"dir dot", dir, ".", dir},
+		{"dir dotdot", dir, "..", root},
+		{"sub dotdot", sub, "..", dir},
+	} {
+		fh, attr, err := nfstest.Lookup(target.Target, tc.dir, tc.name)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if !bytes.Equal(fh, tc.expected) {
+			t.Fatalf("%s: resolved to the wrong handle", tc.desc)
+		}
+		if !attr.IsSet || !attr.Attr.IsDir() {
+			t.Fatalf("%s: expected directory attributes", tc.desc)
+		}
+	}
+}
@@ -5,18 +5,17 @@ import (
 	"context"
 	"os"
 
-	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 const (
-	mkdirDefaultMode = 755
+	mkdirDefaultMode = 0755
 )
 
 func onMkdir(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -30,40 +29,55 @@ func onMkdir(ctx context.Context, w *response, userHandle Handler) error {
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
-	}
-	if string(obj.Filename) == "." || string(obj.Filename) == ".." {
-		return &NFSStatusError{NFSStatusExist, os.ErrExist}
+	if err := checkNewName(obj.Filename); err != nil {
+		return err
 	}
+	obj.Filename = caseName(ctx, fs, path, obj.Filename)
 
-	newFolder := append(path, string(obj.Filename))
+	newFolder := entryPath(path, obj.Filename)
 	newFolderPath := fs.Join(newFolder...)
-	if s, err := fs.Stat(newFolderPath); err == nil {
-		if s.IsDir() {
-			return &NFSStatusError{NFSStatusExist, nil}
-		}
-	} else {
-		if s, err := fs.Stat(fs.Join(path...)); err != nil {
-			return &NFSStatusError{NFSStatusAccess, err}
-		} else if !s.IsDir() {
-			return &NFSStatusError{NFSStatusNotDir, nil}
-		}
+	dirPath := fs.Join(path...)
+	dirInfo, err := fs.Stat(dirPath)
+	if err != nil {
+		return statusError(err, NFSStatusAccess)
+	} else if !dirInfo.IsDir() {
+		return &NFSStatusError{NFSStatusNotDir, nil}
+	}
+	dirAttr := ToFileAttribute(dirInfo, dirPath)
+	preDirAttr := dirAttr.AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, path, preDirAttr})
+	if err := checkAccess(ctx, dirAttr, accessModify|accessLookup); err != nil {
+		return err
 	}
 
-	if err := fs.MkdirAll(newFolderPath, attrs.Mode(mkdirDefaultMode)); err != nil {
-		return &NFSStatusError{NFSStatusAccess, err}
+	if _, err := fs.Lstat(newFolderPath); err == nil {
+		return &NFSStatusError{NFSStatusExist, nil}
+	}
+
+	exportMode(ctx, attrs, mkdirDefaultMode, true)
+	mode := attrs.Mode(mkdirDefaultMode)
+	if dirAttr.Mode()&os.ModeSetgid != 0 {
+		// as locally, the directories of a setgid directory are setgid too.
+		mode |= os.ModeSetgid
+		if attrs.SetMode != nil {
+			m := unixMode(mode)
+			attrs.SetMode = &m
+		}
+	}
+	if err := fs.MkdirAll(newFolderPath, mode); err != nil {
+		return statusError(err, NFSStatusAccess)
 	}
 
-	fp := userHandle.ToHandle(fs, newFolder)
+	fp := w.toHandle(ctx, userHandle, fs, newFolder)
 	changer := userHandle.Change(fs)
+	chownToCaller(ctx, changer, newFolderPath, dirAttr)
 	if changer != nil {
 		if err := attrs.Apply(changer, fs, newFolderPath); err != nil {
-			return &NFSStatusError{NFSStatusIO, err}
+			return statusError(err, NFSStatusIO)
 		}
 	}
 
@@ -79,11 +93,11 @@ func onMkdir(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, fp); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, newFolder)); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, newFolder)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, nil, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preDirAttr, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
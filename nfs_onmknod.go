@@ -26,7 +26,7 @@ const (
 func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -41,33 +41,44 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 	c := userHandle.Change(fs)
 	if c == nil {
 		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
 	}
+	if err := requireCapability(userHandle, fs, CapabilitySpecialFiles); err != nil {
+		return err
+	}
 	cu, ok := c.(UnixChange)
 	if !ok {
-		return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+		return &NFSStatusError{NFSStatusNotSupp, billy.ErrNotSupported}
 	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	if err := checkNewName(obj.Filename); err != nil {
+		return err
 	}
+	obj.Filename = caseName(ctx, fs, path, obj.Filename)
 
-	newFilePath := fs.Join(append(path, string(obj.Filename))...)
+	newFilePath := fs.Join(entryPath(path, obj.Filename)...)
 	if _, err := fs.Stat(newFilePath); err == nil {
 		return &NFSStatusError{NFSStatusExist, os.ErrExist}
 	}
-	parent, err := fs.Stat(fs.Join(path...))
+	dirPath := fs.Join(path...)
+	parent, err := fs.Stat(dirPath)
 	if err != nil {
-		return &NFSStatusError{NFSStatusAccess, err}
+		return statusError(err, NFSStatusAccess)
 	} else if !parent.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
-	fp := userHandle.ToHandle(fs, append(path, string(obj.Filename)))
+	dirAttr := ToFileAttribute(parent, dirPath)
+	preDirAttr := dirAttr.AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, path, preDirAttr})
+	if err := checkAccess(ctx, dirAttr, accessModify|accessLookup); err != nil {
+		return err
+	}
+	fp := w.toHandle(ctx, userHandle, fs, entryPath(path, obj.Filename))
 
 	switch nfs_ftype(ftype) {
 	case FTYPE_NF3CHR:
@@ -77,6 +88,7 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 		if err != nil {
 			return &NFSStatusError{NFSStatusInval, err}
 		}
+		exportMode(ctx, attrs, createDefaultMode, false)
 		specData1, err := xdr.ReadUint32(w.req.Body)
 		if err != nil {
 			return &NFSStatusError{NFSStatusInval, err}
@@ -86,12 +98,13 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 			return &NFSStatusError{NFSStatusInval, err}
 		}
 
-		err = cu.Mknod(newFilePath, uint32(attrs.Mode(parent.Mode())), specData1, specData2)
+		err = cu.Mknod(newFilePath, unixMode(attrs.Mode(parent.Mode())), specData1, specData2)
 		if err != nil {
-			return &NFSStatusError{NFSStatusAccess, err}
+			return statusError(err, NFSStatusAccess)
 		}
+		chownToCaller(ctx, cu, newFilePath, dirAttr)
 		if err = attrs.Apply(cu, fs, newFilePath); err != nil {
-			return &NFSStatusError{NFSStatusServerFault, err}
+			return statusError(err, NFSStatusServerFault)
 		}
 
 	case FTYPE_NF3SOCK:
@@ -100,11 +113,13 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 		if err != nil {
 			return &NFSStatusError{NFSStatusInval, err}
 		}
+		exportMode(ctx, attrs, createDefaultMode, false)
 		if err := cu.Socket(newFilePath); err != nil {
-			return &NFSStatusError{NFSStatusAccess, err}
+			return statusError(err, NFSStatusAccess)
 		}
+		chownToCaller(ctx, cu, newFilePath, dirAttr)
 		if err = attrs.Apply(cu, fs, newFilePath); err != nil {
-			return &NFSStatusError{NFSStatusServerFault, err}
+			return statusError(err, NFSStatusServerFault)
 		}
 
 	case FTYPE_NF3FIFO:
@@ -113,12 +128,14 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 		if err != nil {
 			return &NFSStatusError{NFSStatusInval, err}
 		}
-		err = cu.Mkfifo(newFilePath, uint32(attrs.Mode(parent.Mode())))
+		exportMode(ctx, attrs, createDefaultMode, false)
+		err = cu.Mkfifo(newFilePath, unixMode(attrs.Mode(parent.Mode())))
 		if err != nil {
-			return &NFSStatusError{NFSStatusAccess, err}
+			return statusError(err, NFSStatusAccess)
 		}
+		chownToCaller(ctx, cu, newFilePath, dirAttr)
 		if err = attrs.Apply(cu, fs, newFilePath); err != nil {
-			return &NFSStatusError{NFSStatusServerFault, err}
+			return statusError(err, NFSStatusServerFault)
 		}
 
 	default:
@@ -140,11 +157,11 @@ func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 	// attr
-	if err := WritePostOpAttrs(writer, tryStat(fs, append(path, string(obj.Filename)))); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, entryPath(path, obj.Filename))); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 	// wcc
-	if err := WriteWcc(writer, nil, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preDirAttr, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
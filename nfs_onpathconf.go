@@ -10,8 +10,12 @@ import (
 // PathNameMax is the maximum length for a file name
 const PathNameMax = 255
 
+// linkMax is the LinkMax reported to macOS clients of filesystems with hard
+// links, that of APFS.
+const linkMax = 32767
+
 func onPathConf(ctx context.Context, w *response, userHandle Handler) error {
-	roothandle, err := xdr.ReadOpaque(w.req.Body)
+	roothandle, err := readHandle(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -24,7 +28,7 @@ func onPathConf(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -45,6 +49,13 @@ func onPathConf(ctx context.Context, w *response, userHandle Handler) error {
 		CaseInsensitive: 0,
 		CasePreserving:  1,
 	}
+	if opts := exportOptionsFromContext(ctx); opts != nil && opts.foldsCase() {
+		defaults.CaseInsensitive = 1
+	}
+	// macOS takes a LinkMax of 1 to mean that hard links can't be made.
+	if macOSQuirks(ctx) && CapabilitiesOf(userHandle, fs)&CapabilityLinks != 0 {
+		defaults.LinkMax = linkMax
+	}
 	if err := xdr.Write(writer, defaults); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
@@ -5,13 +5,14 @@ import (
 	"context"
 	"errors"
 	"io"
+	"math"
 	"os"
 
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 type nfsReadArgs struct {
-	Handle []byte
+	Handle []byte `xdrmax:"handle"`
 	Offset uint64
 	Count  uint32
 }
@@ -33,7 +34,7 @@ const CheckRead = 1 << 15
 func onRead(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	var obj nfsReadArgs
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -42,37 +43,68 @@ func onRead(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 
-	fh, err := fs.Open(fs.Join(path...))
+	if obj.Offset > math.MaxInt64 {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+
+	if err := checkIOAccess(ctx, tryStat(ctx, fs, path), false); err != nil {
+		return err
+	}
+
+	fullPath := fs.Join(path...)
+	fh, err := fs.Open(fullPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		return &NFSStatusError{NFSStatusAccess, err}
+		return statusError(err, NFSStatusAccess)
 	}
+	defer fh.Close()
 
 	resp := nfsReadResponse{}
 
 	if obj.Count > CheckRead {
-		info, err := fs.Stat(fs.Join(path...))
+		info, err := fs.Stat(fullPath)
 		if err != nil {
-			return &NFSStatusError{NFSStatusAccess, err}
+			return statusError(err, NFSStatusAccess)
 		}
-		if info.Size()-int64(obj.Offset) < int64(obj.Count) {
-			obj.Count = uint32(uint64(info.Size()) - obj.Offset)
+		if obj.Offset >= uint64(info.Size()) {
+			obj.Count = 0
+		} else if remaining := uint64(info.Size()) - obj.Offset; remaining < uint64(obj.Count) {
+			obj.Count = uint32(remaining)
 		}
 	}
 	if obj.Count > MaxRead {
 		obj.Count = MaxRead
 	}
 	resp.Data = make([]byte, obj.Count)
-	// todo: multiple reads if size isn't full
-	cnt, err := fh.ReadAt(resp.Data, int64(obj.Offset))
-	if err != nil && !errors.Is(err, io.EOF) {
-		return &NFSStatusError{NFSStatusIO, err}
+
+	// ReadAt may return less than requested without reaching the end of the
+	// file, so keep reading until the buffer is full or EOF is reported.
+	cnt := 0
+	hitEOF := false
+	for cnt < len(resp.Data) {
+		n, err := fh.ReadAt(resp.Data[cnt:], int64(obj.Offset)+int64(cnt))
+		cnt += n
+		if errors.Is(err, io.EOF) {
+			hitEOF = true
+			break
+		} else if err != nil {
+			return statusError(err, NFSStatusIO)
+		} else if n == 0 {
+			break
+		}
 	}
 	resp.Count = uint32(cnt)
 	resp.Data = resp.Data[:resp.Count]
-	if errors.Is(err, io.EOF) {
+
+	// eof is judged against the post-read size rather than the result of the
+	// read alone, so that a file appended to concurrently isn't reported as
+	// ended while a zero-length read at the end of a file is.
+	postAttr := tryStat(ctx, fs, path)
+	end := obj.Offset + uint64(cnt)
+	if postAttr != nil {
+		if end >= postAttr.Filesize {
+			resp.EOF = 1
+		}
+	} else if hitEOF {
 		resp.EOF = 1
 	}
 
@@ -80,7 +112,7 @@ func onRead(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, postAttr); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
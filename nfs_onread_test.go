@@ -0,0 +1,51 @@
+package nfs_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestReadEOF(t *testing.T) {
+	mem := memfs.New()
+	f, err := mem.Create("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("0123456789"))
+	f.Close()
+
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	rf, err := target.Open("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		off  int64
+		size int
+		n    int
+		eof  bool
+	}{
+		{0, 4, 4, false},
+		{6, 4, 4, true},
+		{8, 4, 2, true},
+		{10, 4, 0, true},
+		{1 << 20, 1 << 16, 0, true},
+	}
+	for _, c := range cases {
+		buf := make([]byte, c.size)
+		n, err := rf.ReadAt(buf, c.off)
+		if n != c.n {
+			t.Errorf("read at %d: got %d bytes, want %d", c.off, n, c.n)
+		}
+		if (err == io.EOF) != c.eof {
+			t.Errorf("read at %d: got err %v, want eof=%v", c.off, err, c.eof)
+		}
+	}
+}
@@ -11,16 +11,22 @@ import (
 	"path"
 	"sort"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 type readDirArgs struct {
-	Handle      []byte
+	Handle      []byte `xdrmax:"handle"`
 	Cookie      uint64
 	CookieVerif uint64
 	Count       uint32
 }
 
+// maxDirCount bounds the replies of READDIR and READDIRPLUS, which are built
+// in memory, whatever count the client asks for; clients are given fewer
+// entries, as they may be.
+const maxDirCount = 1 << 20
+
 type readDirEntity struct {
 	FileID uint64
 	Name   []byte
@@ -31,7 +37,7 @@ type readDirEntity struct {
 func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	obj := readDirArgs{}
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -39,35 +45,52 @@ func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
 	if obj.Count < 1024 {
 		return &NFSStatusError{NFSStatusTooSmall, io.ErrShortBuffer}
 	}
+	if obj.Count > maxDirCount {
+		obj.Count = maxDirCount
+	}
 
 	fs, p, err := userHandle.FromHandle(obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 
-	contents, verifier, err := getDirListingWithVerifier(userHandle, obj.Handle, obj.CookieVerif)
+	if err := checkAccess(ctx, tryStat(ctx, fs, p), accessRead); err != nil {
+		return err
+	}
+
+	listing, verifier, err := w.listDir(ctx, userHandle, obj.Handle, obj.Cookie, obj.CookieVerif)
 	if err != nil {
 		return err
 	}
-	if obj.Cookie > 0 && obj.CookieVerif > 0 && verifier != obj.CookieVerif {
-		return &NFSStatusError{NFSStatusBadCookie, nil}
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, p)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+
+	if err := xdr.Write(writer, verifier); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
 	entities := make([]readDirEntity, 0)
-	maxBytes := uint32(100) // conservative overhead measure
+	// the reply holds the entries between its head and the list's end and
+	// eof markers, and its size is bounded by count.
+	size := uint32(writer.Len()) + 8
 
-	started := obj.Cookie == 0
-	if started {
+	if obj.Cookie == 0 {
 		// add '.' and '..' to entities
 		dotdotFileID := uint64(0)
 		if len(p) > 0 {
-			dda := tryStat(fs, p[0:len(p)-1])
+			dda := tryStat(ctx, fs, p[0:len(p)-1])
 			if dda != nil {
 				dotdotFileID = dda.Fileid
 			}
 		}
 		dotFileID := uint64(0)
-		da := tryStat(fs, p)
+		da := tryStat(ctx, fs, p)
 		if da != nil {
 			dotFileID = da.Fileid
 		}
@@ -75,42 +98,51 @@ func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
 			readDirEntity{Name: []byte("."), Cookie: 0, Next: true, FileID: dotFileID},
 			readDirEntity{Name: []byte(".."), Cookie: 1, Next: true, FileID: dotdotFileID},
 		)
+		for _, e := range entities {
+			n, err := xdrSize(e)
+			if err != nil {
+				return &NFSStatusError{NFSStatusServerFault, err}
+			}
+			size += n
+		}
 	}
 
 	eof := true
 	maxEntities := userHandle.HandleLimit() / 2
-	for i, c := range contents {
-		// cookie equates to index within contents + 2 (for '.' and '..')
-		cookie := uint64(i + 2)
-		if started {
-			maxBytes += 512 // TODO: better estimation.
-			if maxBytes > obj.Count || len(entities) > maxEntities {
-				eof = false
-				break
-			}
-
-			attrs := ToFileAttribute(c, path.Join(append(p, c.Name())...))
-			entities = append(entities, readDirEntity{
-				FileID: attrs.Fileid,
-				Name:   []byte(c.Name()),
-				Cookie: cookie,
-				Next:   true,
-			})
-		} else if cookie == obj.Cookie {
-			started = true
+	for {
+		c, cookie, err := listing.next()
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			break
+		}
+		if len(entities) > maxEntities {
+			eof = false
+			break
 		}
-	}
 
-	writer := bytes.NewBuffer([]byte{})
-	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, p)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
+		attrs := exportAttributes(ctx, ToFileAttribute(c, path.Join(append(p, c.Name())...)))
+		e := readDirEntity{
+			FileID: attrs.Fileid,
+			Name:   []byte(c.Name()),
+			Cookie: cookie,
+			Next:   true,
+		}
+		n, err := xdrSize(e)
+		if err != nil {
+			return &NFSStatusError{NFSStatusServerFault, err}
+		}
+		if size+n > obj.Count {
+			eof = false
+			break
+		}
+		size += n
+		entities = append(entities, e)
 	}
-
-	if err := xdr.Write(writer, verifier); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
+	if !eof && len(entities) == 0 {
+		// not even the next entry fits.
+		return &NFSStatusError{NFSStatusTooSmall, io.ErrShortBuffer}
 	}
 
 	if err := xdr.Write(writer, len(entities) > 0); err != nil { // next
@@ -129,7 +161,6 @@ func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, eof); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	// TODO: track writer size at this point to validate maxcount estimation and stop early if needed.
 
 	if err := w.Write(writer.Bytes()); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
@@ -137,7 +168,13 @@ func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
 	return nil
 }
 
-func getDirListingWithVerifier(userHandle Handler, fsHandle []byte, verifier uint64) ([]fs.FileInfo, uint64, error) {
+// getDirListingWithVerifier lists a directory along with the cookie verifier
+// for its contents. A continuation of a listing still cached for its verifier
+// continues that listing while the change attribute of the directory is that
+// it was listed at; others read the directory afresh, so that one against a
+// directory modified since the verifier was issued can be refused rather than
+// skipping or repeating entries.
+func getDirListingWithVerifier(ctx context.Context, userHandle Handler, cookies *dirCookies, fsHandle []byte, verifier uint64) ([]fs.FileInfo, uint64, error) {
 	// figure out what directory it is.
 	fs, p, err := userHandle.FromHandle(fsHandle)
 	if err != nil {
@@ -145,34 +182,253 @@ func getDirListingWithVerifier(userHandle Handler, fsHandle []byte, verifier uin
 	}
 
 	path := fs.Join(p...)
+	info, err := fs.Lstat(path)
+	if err != nil {
+		return nil, 0, statusError(err, NFSStatusStale)
+	}
+	change := ToFileAttribute(info, path).Change()
 	// see if the verifier has this dir cached:
-	if vh, ok := userHandle.(CachingHandler); verifier != 0 && ok {
+	if vh, ok := userHandle.(CachingHandler); verifier != 0 && ok && cookies.unchanged(verifier, change) {
 		entries := vh.DataForVerifier(path, verifier)
 		if entries != nil {
 			return entries, verifier, nil
 		}
 	}
-	// load the entries.
-	contents, err := fs.ReadDir(path)
+
+	contents, err := readDirSorted(ctx, fs, p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id := hashPathAndContents(path, contents)
+	if vh, ok := userHandle.(ListingVerifier); ok {
+		// let the user handler make a verifier if it can.
+		id = vh.VerifierFor(path, contents)
+	}
+	cookies.listed(id, change)
+	return contents, id, nil
+}
+
+// dirEntries yields the entries of a directory listing in turn.
+type dirEntries interface {
+	// next provides the following entry with the cookie to continue after
+	// it, or nil at the end of the listing.
+	next() (fs.FileInfo, uint64, error)
+}
+
+// listDir provides the entries of the directory at handle following cookie,
+// along with the cookie verifier of the listing. Filesystems listing a part
+// at a time are listed as the entries are needed, and others in full.
+func (w *response) listDir(ctx context.Context, userHandle Handler, handle []byte, cookie, cookieVerif uint64) (dirEntries, uint64, error) {
+	fs, p, err := userHandle.FromHandle(handle)
 	if err != nil {
-		if os.IsPermission(err) {
-			return nil, 0, &NFSStatusError{NFSStatusAccess, err}
+		return nil, 0, &NFSStatusError{NFSStatusStale, err}
+	}
+	dir := fs.Join(p...)
+	s := &streamedEntries{cookies: w.Server.dirCookies, opts: exportOptionsFromContext(ctx), handle: string(handle), p: p}
+	switch sfs := fs.(type) {
+	case ListingFilesystem:
+		// listings resume from the name of an entry, which is the token of
+		// the page following it.
+		s.byName = true
+		s.list = func(after string) ([]os.FileInfo, string, error) {
+			entries, err := sfs.ReadDirFrom(dir, after, dirBatch)
+			if err != nil || len(entries) < dirBatch {
+				return entries, "", err
+			}
+			return entries, entries[len(entries)-1].Name(), nil
+		}
+	case PagedFilesystem:
+		s.list = func(token string) ([]os.FileInfo, string, error) {
+			return sfs.ReadDirPaged(dir, token, dirBatch)
+		}
+	default:
+		if w.Server.StableDirCookies {
+			// the directory is read in full once for the call, and each
+			// page is that following a name in it.
+			var contents []os.FileInfo
+			s.byName = true
+			s.list = func(after string) ([]os.FileInfo, string, error) {
+				if contents == nil {
+					var err error
+					if contents, err = readDirSorted(ctx, fs, p); err != nil {
+						return nil, "", err
+					}
+				}
+				i := sort.Search(len(contents), func(i int) bool { return contents[i].Name() > after })
+				if len(contents)-i <= dirBatch {
+					return contents[i:], "", nil
+				}
+				page := contents[i : i+dirBatch]
+				return page, page[len(page)-1].Name(), nil
+			}
+		}
+	}
+	if s.list != nil {
+		// cookies stay valid as the directory changes, and the verifier
+		// only tells them from those of the listings of other directories.
+		verifier := hashPathAndContents(dir, nil)
+		if cookie > 0 && cookieVerif > 0 && verifier != cookieVerif {
+			return nil, 0, &NFSStatusError{NFSStatusBadCookie, nil}
+		}
+		if cookie > 1 {
+			c, ok := s.cookies.resume(s.handle, cookie)
+			if !ok {
+				return nil, 0, &NFSStatusError{NFSStatusBadCookie, nil}
+			}
+			s.token, s.i, s.pos = c.token, c.skip, c.pos
+		}
+		return s, verifier, nil
+	}
+
+	contents, verifier, err := getDirListingWithVerifier(ctx, userHandle, w.Server.dirCookies, handle, cookieVerif)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cookie > 0 && cookieVerif > 0 && verifier != cookieVerif {
+		return nil, 0, &NFSStatusError{NFSStatusBadCookie, nil}
+	}
+	// cookies are the index of an entry within contents + 2 (for '.' and
+	// '..').
+	l := &listedEntries{contents: contents}
+	if cookie > 1 {
+		l.i = len(contents)
+		if cookie-1 < uint64(len(contents)) {
+			l.i = int(cookie - 1)
+		}
+	}
+	return l, verifier, nil
+}
+
+// listedEntries are the entries of a directory read in full.
+type listedEntries struct {
+	contents []fs.FileInfo
+	i        int
+}
+
+func (l *listedEntries) next() (fs.FileInfo, uint64, error) {
+	if l.i >= len(l.contents) {
+		return nil, 0, nil
+	}
+	l.i++
+	return l.contents[l.i-1], uint64(l.i + 1), nil
+}
+
+// dirBatch is the number of entries read at a time from filesystems listing
+// a part at a time.
+const dirBatch = 128
+
+// streamedEntries are the entries of a directory of a ListingFilesystem or
+// PagedFilesystem, read a page at a time.
+type streamedEntries struct {
+	// list provides the page of entries at token, with the token of the
+	// following page.
+	list func(token string) ([]fs.FileInfo, string, error)
+	// byName resumes listings from the name of an entry, rather than from
+	// within its page.
+	byName  bool
+	cookies *dirCookies
+	opts    *ExportOptions
+	handle  string
+	p       []string
+
+	// token is that of the page in batch, and i the index in it of the next
+	// entry.
+	token     string
+	i         int
+	batch     []fs.FileInfo
+	following string
+	listed    bool
+	// pos is the number of entries provided in the listing so far.
+	pos int
+}
+
+func (s *streamedEntries) next() (fs.FileInfo, uint64, error) {
+	for {
+		if !s.listed {
+			batch, following, err := s.list(s.token)
+			if err != nil {
+				return nil, 0, statusError(err, NFSStatusNotDir)
+			}
+			s.batch, s.following, s.listed = batch, following, true
+		}
+		if s.i >= len(s.batch) {
+			if s.following == "" {
+				return nil, 0, nil
+			}
+			s.token, s.i, s.listed = s.following, 0, false
+			continue
+		}
+		c := s.batch[s.i]
+		s.i++
+		if s.opts != nil && s.opts.hidesEntry(s.p, c.Name()) {
+			continue
+		}
+		if s.pos++; s.opts != nil && s.opts.MaxDirEntries > 0 && s.pos > s.opts.MaxDirEntries {
+			return nil, 0, &NFSStatusError{NFSStatusFBig, errDirTooLarge}
+		}
+		token, skip := s.token, s.i
+		if s.byName {
+			token, skip = c.Name(), 0
+		}
+		return c, s.cookies.issue(s.handle, token, skip, s.pos), nil
+	}
+}
+
+// xdrSize provides the length of the XDR encoding of v.
+func xdrSize(v interface{}) (uint32, error) {
+	var c byteCounter
+	err := xdr.Write(&c, v)
+	return uint32(c), err
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// readDirSorted lists the entries of the directory at p which the export
+// shows, sorted by name.
+func readDirSorted(ctx context.Context, fs billy.Filesystem, p []string) ([]fs.FileInfo, error) {
+	contents, err := fs.ReadDir(fs.Join(p...))
+	if err != nil {
+		return nil, statusError(err, NFSStatusNotDir)
+	}
+	if opts := exportOptionsFromContext(ctx); opts != nil {
+		// entries are hidden before cookies and the verifier are derived from
+		// the listing, so that neither gives them away.
+		visible := contents[:0]
+		for _, c := range contents {
+			if !opts.hidesEntry(p, c.Name()) {
+				visible = append(visible, c)
+			}
+		}
+		contents = visible
+		if opts.MaxDirEntries > 0 && len(contents) > opts.MaxDirEntries {
+			return nil, &NFSStatusError{NFSStatusFBig, errDirTooLarge}
 		}
-		return nil, 0, &NFSStatusError{NFSStatusNotDir, err}
 	}
 
 	sort.Slice(contents, func(i, j int) bool {
 		return contents[i].Name() < contents[j].Name()
 	})
-
-	if vh, ok := userHandle.(CachingHandler); ok {
-		// let the user handler make a verifier if it can.
-		v := vh.VerifierFor(path, contents)
-		return contents, v, nil
+	if opts := exportOptionsFromContext(ctx); opts != nil && opts.foldsCase() {
+		// the first of the entries equal but for case is the one names
+		// refer to.
+		seen := make(map[string]bool, len(contents))
+		distinct := contents[:0]
+		for _, c := range contents {
+			if key := foldKey(c.Name()); !seen[key] {
+				seen[key] = true
+				distinct = append(distinct, c)
+			}
+		}
+		contents = distinct
 	}
-
-	id := hashPathAndContents(path, contents)
-	return contents, id, nil
+	return contents, nil
 }
 
 func hashPathAndContents(path string, contents []fs.FileInfo) uint64 {
@@ -0,0 +1,344 @@
+package nfs_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestReadDirCounts(t *testing.T) {
+	mem := memfs.New()
+	const files = 200
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("/dir/%03d-%s", i, strings.Repeat("x", i%64))
+		if err := billyutil.WriteFile(mem, name, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	_, fh, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replySize provides the length of the reply to a listing, not counting
+	// the RPC header, and whether it reached the end of the directory.
+	replySize := func(proc nfs.NFSProcedure, counts ...uint32) (int64, bool) {
+		type readDirArgs struct {
+			rpc.Header
+			Handle      []byte
+			Cookie      uint64
+			CookieVerif uint64
+			Count       uint32
+		}
+		type readDirPlusArgs struct {
+			rpc.Header
+			Handle      []byte
+			Cookie      uint64
+			CookieVerif uint64
+			DirCount    uint32
+			MaxCount    uint32
+		}
+		args := readDirArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Vers:    nfsc.Nfs3Vers,
+				Prog:    nfsc.Nfs3Prog,
+				Proc:    uint32(proc),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Handle: fh,
+			Count:  counts[0],
+		}
+		var call interface{} = &args
+		if len(counts) > 1 {
+			call = &readDirPlusArgs{Header: args.Header, Handle: fh, DirCount: counts[0], MaxCount: counts[1]}
+		}
+		res, err := target.Call(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := binary.BigEndian.Uint32(body); status != uint32(nfs.NFSStatusOk) {
+			t.Fatalf("listing failed with %d", status)
+		}
+		return int64(len(body)), binary.BigEndian.Uint32(body[len(body)-4:]) != 0
+	}
+
+	for _, count := range []uint32{1024, 1500, 8192} {
+		if size, eof := replySize(nfs.NFSProcedureReadDir, count); size > int64(count) || eof {
+			t.Fatalf("expected READDIR to fill %d bytes, got %d (eof %v)", count, size, eof)
+		} else if size < int64(count)-100 {
+			t.Fatalf("expected READDIR to send up to %d bytes, got only %d", count, size)
+		}
+	}
+	if size, eof := replySize(nfs.NFSProcedureReadDir, 1<<20); !eof || size > 1<<20 {
+		t.Fatalf("expected a large count to reach the end, got %d (eof %v)", size, eof)
+	}
+	for _, counts := range [][2]uint32{{512, 4096}, {4096, 4096}, {65536, 8192}} {
+		size, eof := replySize(nfs.NFSProcedureReadDirPlus, counts[0], counts[1])
+		if size > int64(counts[1]) || eof {
+			t.Fatalf("expected READDIRPLUS within %v, got %d (eof %v)", counts, size, eof)
+		}
+	}
+
+	if entries, err := nfstest.ReadDir(target.Target, "/dir"); err != nil || len(entries) != files {
+		t.Fatalf("expected paging to list every entry, got %d: %v", len(entries), err)
+	}
+	plus, err := target.ReadDirPlus("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := 0
+	for _, e := range plus {
+		if e.FileName != "." && e.FileName != ".." {
+			names++
+		}
+	}
+	if names != files {
+		t.Fatalf("expected READDIRPLUS paging to list every entry, got %d", names)
+	}
+}
+
+func TestReadDirModified(t *testing.T) {
+	mem := memfs.New()
+	for i := 0; i < 500; i++ {
+		f, err := mem.Create(fmt.Sprintf("/f-%04d.txt", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	cache := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024).(*helpers.CachingHandler)
+
+	// modify removes the next entry of the directory, continuing a listing
+	// of it a page in both before and after.
+	next := 0
+	modify := func(handler nfs.Handler, after func()) {
+		srv := nfstest.Serve(t, handler)
+		target := srv.Mount(t, "/", rpc.AuthNull)
+		_, fh, err := target.Lookup("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, verf, eof, err := nfstest.ReadDirPage(target.Target, fh, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eof {
+			t.Fatal("expected listing to span multiple pages")
+		}
+		cookie := page[len(page)-1].Cookie
+
+		// an unchanged directory continues from the cookie.
+		if _, _, _, err := nfstest.ReadDirPage(target.Target, fh, cookie, verf); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mem.Remove(fmt.Sprintf("/f-%04d.txt", next)); err != nil {
+			t.Fatal(err)
+		}
+		next++
+		after()
+		if _, _, _, err := nfstest.ReadDirPage(target.Target, fh, cookie, verf); err == nil || err.Error() != "NFS3ERR_BAD_COOKIE" {
+			t.Fatalf("expected NFS3ERR_BAD_COOKIE after modification, got %v", err)
+		}
+	}
+
+	// the cached listing is continued until the directory changes, with the
+	// stock handler,
+	modify(helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024), func() {})
+	// or until it is invalidated,
+	modify(cache, func() { cache.InvalidateListing(mem, nil) })
+	// and one kept by nothing is read again each time.
+	modify(listingVerifier{cache}, func() {})
+}
+
+// listingVerifier keeps no listings, making verifiers as a
+// nfs.ListingVerifier.
+type listingVerifier struct {
+	nfs.Handler
+}
+
+func (listingVerifier) VerifierFor(path string, contents []os.FileInfo) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(path))
+	for _, c := range contents {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(c.Name()))
+	}
+	return h.Sum64()
+}
+
+// streamingFS lists only a part of a directory at a time, in name order, as a
+// database would.
+type streamingFS struct {
+	billy.Filesystem
+}
+
+func (s streamingFS) ReadDir(string) ([]os.FileInfo, error) {
+	return nil, errors.New("directory read in full")
+}
+
+func (s streamingFS) ReadDirFrom(dirname, after string, n int) ([]os.FileInfo, error) {
+	entries, err := s.Filesystem.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	entries = entries[sort.Search(len(entries), func(i int) bool { return entries[i].Name() > after }):]
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries, nil
+}
+
+func TestStreamedReadDir(t *testing.T) {
+	mem := memfs.New()
+	const files = 1000
+	for i := 0; i < files; i++ {
+		if err := billyutil.WriteFile(mem, fmt.Sprintf("/dir/%04d", i), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(streamingFS{mem}), nfs.ExportOptions{Hide: []string{"/dir/0500"}})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if entries, err := nfstest.ReadDir(target.Target, "/dir"); err != nil || len(entries) != files-1 {
+		t.Fatalf("expected the visible entries to be listed, got %d: %v", len(entries), err)
+	}
+	plus, err := target.ReadDirPlus("/dir")
+	if err != nil || len(plus) != files-1 {
+		t.Fatalf("expected READDIRPLUS to list the visible entries, got %d: %v", len(plus), err)
+	}
+
+	// entries added and removed before where a listing has reached neither
+	// repeat nor skip the rest.
+	_, fh, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, verf, eof, err := nfstest.ReadDirPage(target.Target, fh, 0, 0)
+	if err != nil || eof {
+		t.Fatalf("expected a first page, got eof %v: %v", eof, err)
+	}
+	last := page[len(page)-1]
+	if err := mem.Remove("/dir/0000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := billyutil.WriteFile(mem, "/dir/0000a", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	rest, _, _, err := nfstest.ReadDirPage(target.Target, fh, last.Cookie, verf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%04d", len(page)-2); rest[0].FileName != want {
+		t.Fatalf("expected the listing to continue with %s, got %s", want, rest[0].FileName)
+	}
+	if _, _, _, err := nfstest.ReadDirPage(target.Target, fh, 1<<40, verf); !nfstest.IsStatus(err, nfs.NFSStatusBadCookie) {
+		t.Fatalf("expected an unknown cookie to be refused, got %v", err)
+	}
+}
+
+// pagedFS lists directories in pages of at most 50 entries, with tokens
+// holding the offset of a page as an object store's might.
+type pagedFS struct {
+	billy.Filesystem
+	pages *int32
+}
+
+func (p pagedFS) ReadDir(string) ([]os.FileInfo, error) {
+	return nil, errors.New("directory read in full")
+}
+
+func (p pagedFS) ReadDirPaged(dirname, token string, n int) ([]os.FileInfo, string, error) {
+	atomic.AddInt32(p.pages, 1)
+	entries, err := p.Filesystem.ReadDir(dirname)
+	if err != nil {
+		return nil, "", err
+	}
+	start := 0
+	if token != "" {
+		if start, err = strconv.Atoi(token); err != nil {
+			return nil, "", err
+		}
+	}
+	if n > 50 {
+		n = 50
+	}
+	if start+n >= len(entries) {
+		return entries[start:], "", nil
+	}
+	return entries[start : start+n], strconv.Itoa(start + n), nil
+}
+
+func TestPagedReadDir(t *testing.T) {
+	mem := memfs.New()
+	const files = 300
+	for i := 0; i < files; i++ {
+		if err := billyutil.WriteFile(mem, fmt.Sprintf("/dir/%04d", i), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var pages int32
+	srv := nfstest.ServeFS(t, pagedFS{mem, &pages})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	entries, err := nfstest.ReadDir(target.Target, "/dir")
+	if err != nil || len(entries) != files {
+		t.Fatalf("expected every entry to be listed, got %d: %v", len(entries), err)
+	}
+	for i, e := range entries {
+		if e.FileName != fmt.Sprintf("%04d", i) {
+			t.Fatalf("expected entries in order, got %s at %d", e.FileName, i)
+		}
+	}
+	if atomic.LoadInt32(&pages) == 0 {
+		t.Fatal("expected the listing to be read in pages")
+	}
+
+	// a listing continues from any entry, not only the last of a page.
+	_, fh, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, verf, _, err := nfstest.ReadDirPage(target.Target, fh, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{2, 49, 50, len(page) - 1} {
+		rest, _, _, err := nfstest.ReadDirPage(target.Target, fh, page[i].Cookie, verf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%04d", i-1); rest[0].FileName != want {
+			t.Fatalf("expected the listing after %s to continue with %s, got %s", page[i].FileName, want, rest[0].FileName)
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 )
 
 type readDirPlusArgs struct {
-	Handle      []byte
+	Handle      []byte `xdrmax:"handle"`
 	Cookie      uint64
 	CookieVerif uint64
 	DirCount    uint32
@@ -35,7 +35,7 @@ func joinPath(parent []string, elements ...string) []string {
 func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	obj := readDirPlusArgs{}
-	if err := xdr.Read(w.req.Body, &obj); err != nil {
+	if err := readArgs(w.req.Body, &obj); err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
@@ -45,36 +45,71 @@ func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
 	if obj.DirCount < 512 || obj.MaxCount < 4096 {
 		return &NFSStatusError{NFSStatusTooSmall, nil}
 	}
+	if obj.DirCount > maxDirCount {
+		obj.DirCount = maxDirCount
+	}
+	if obj.MaxCount > maxDirCount {
+		obj.MaxCount = maxDirCount
+	}
 
 	fs, p, err := userHandle.FromHandle(obj.Handle)
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 
-	contents, verifier, err := getDirListingWithVerifier(userHandle, obj.Handle, obj.CookieVerif)
+	if err := checkAccess(ctx, tryStat(ctx, fs, p), accessRead); err != nil {
+		return err
+	}
+
+	listing, verifier, err := w.listDir(ctx, userHandle, obj.Handle, obj.Cookie, obj.CookieVerif)
 	if err != nil {
 		return err
 	}
-	if obj.Cookie > 0 && obj.CookieVerif > 0 && verifier != obj.CookieVerif {
-		return &NFSStatusError{NFSStatusBadCookie, nil}
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, p)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := xdr.Write(writer, verifier); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
 	entities := make([]readDirPlusEntity, 0)
+	// dircount bounds the entries as they would be sent by READDIR, without
+	// their attributes and handles, and maxcount the whole of the reply.
 	dirBytes := uint32(0)
-	maxBytes := uint32(100) // conservative overhead measure
+	maxBytes := uint32(writer.Len()) + 8
+	fits := func(e readDirPlusEntity) (bool, error) {
+		d, err := xdrSize(readDirEntity{FileID: e.FileID, Name: e.Name, Cookie: e.Cookie, Next: e.Next})
+		if err != nil {
+			return false, err
+		}
+		m, err := xdrSize(e)
+		if err != nil {
+			return false, err
+		}
+		if dirBytes+d > obj.DirCount || maxBytes+m > obj.MaxCount {
+			return false, nil
+		}
+		dirBytes += d
+		maxBytes += m
+		return true, nil
+	}
 
-	started := obj.Cookie == 0
-	if started {
+	if obj.Cookie == 0 {
 		// add '.' and '..' to entities
 		dotdotFileID := uint64(0)
 		if len(p) > 0 {
-			dda := tryStat(fs, p[0:len(p)-1])
+			dda := tryStat(ctx, fs, p[0:len(p)-1])
 			if dda != nil {
 				dotdotFileID = dda.Fileid
 			}
 		}
 		dotFileID := uint64(0)
-		da := tryStat(fs, p)
+		da := tryStat(ctx, fs, p)
 		if da != nil {
 			dotFileID = da.Fileid
 		}
@@ -82,50 +117,54 @@ func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
 			readDirPlusEntity{Name: []byte("."), Cookie: 0, Next: true, FileID: dotFileID, Attributes: da},
 			readDirPlusEntity{Name: []byte(".."), Cookie: 1, Next: true, FileID: dotdotFileID},
 		)
+		for _, e := range entities {
+			if _, err := fits(e); err != nil {
+				return &NFSStatusError{NFSStatusServerFault, err}
+			}
+		}
 	}
 
 	eof := true
 	maxEntities := userHandle.HandleLimit() / 2
-	fb := 0
-	fss := 0
-	for i, c := range contents {
-		// cookie equates to index within contents + 2 (for '.' and '..')
-		cookie := uint64(i + 2)
-		fb++
-		if started {
-			fss++
-			dirBytes += uint32(len(c.Name()) + 20)
-			maxBytes += 512 // TODO: better estimation.
-			if dirBytes > obj.DirCount || maxBytes > obj.MaxCount || len(entities) > maxEntities {
-				eof = false
-				break
-			}
-
-			filePath := joinPath(p, c.Name())
-			handle := userHandle.ToHandle(fs, filePath)
-			attrs := ToFileAttribute(c, path.Join(filePath...))
-			entities = append(entities, readDirPlusEntity{
-				FileID:     attrs.Fileid,
-				Name:       []byte(c.Name()),
-				Cookie:     cookie,
-				Attributes: attrs,
-				Handle:     &handle,
-				Next:       true,
-			})
-		} else if cookie == obj.Cookie {
-			started = true
+	for {
+		c, cookie, err := listing.next()
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			break
+		}
+		if len(entities) > maxEntities {
+			eof = false
+			break
 		}
-	}
 
-	writer := bytes.NewBuffer([]byte{})
-	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, p)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
+		filePath := joinPath(p, c.Name())
+		handle := userHandle.ToHandle(fs, filePath)
+		attrs := exportAttributes(ctx, ToFileAttribute(c, path.Join(filePath...)))
+		e := readDirPlusEntity{
+			FileID:     attrs.Fileid,
+			Name:       []byte(c.Name()),
+			Cookie:     cookie,
+			Attributes: attrs,
+			Handle:     &handle,
+			Next:       true,
+		}
+		ok, err := fits(e)
+		if err != nil {
+			return &NFSStatusError{NFSStatusServerFault, err}
+		}
+		if !ok {
+			eof = false
+			break
+		}
+		// the handle is only counted as given once it is sent.
+		w.toHandle(ctx, userHandle, fs, filePath)
+		entities = append(entities, e)
 	}
-	if err := xdr.Write(writer, verifier); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
+	if !eof && len(entities) == 0 {
+		// not even the next entry fits.
+		return &NFSStatusError{NFSStatusTooSmall, nil}
 	}
 
 	if err := xdr.Write(writer, len(entities) > 0); err != nil { // next
@@ -144,7 +183,6 @@ func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, eof); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	// TODO: track writer size at this point to validate maxcount estimation and stop early if needed.
 
 	if err := w.Write(writer.Bytes()); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
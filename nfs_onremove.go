@@ -5,14 +5,13 @@ import (
 	"context"
 	"os"
 
-	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func onRemove(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
-	if err := xdr.Read(w.req.Body, &obj); err != nil {
+	if err := readArgs(w.req.Body, &obj); err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 	fs, path, err := userHandle.FromHandle(obj.Handle)
@@ -20,53 +19,56 @@ func onRemove(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
 
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, nil}
+	if err := checkExistingName(obj.Filename); err != nil {
+		return err
 	}
+	obj.Filename = caseName(ctx, fs, path, obj.Filename)
 
 	fullPath := fs.Join(path...)
 	dirInfo, err := fs.Stat(fullPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		if os.IsPermission(err) {
-			return &NFSStatusError{NFSStatusAccess, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return statusError(err, NFSStatusIO)
 	}
 	if !dirInfo.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
-	preCacheData := ToFileAttribute(dirInfo, fullPath).AsCache()
+	dirAttr := ToFileAttribute(dirInfo, fullPath)
+	preCacheData := dirAttr.AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, path, preCacheData})
+	if err := checkAccess(ctx, dirAttr, accessDelete|accessLookup); err != nil {
+		return err
+	}
 
-	toDelete := fs.Join(append(path, string(obj.Filename))...)
+	toDelete := fs.Join(entryPath(path, obj.Filename)...)
+	if NFSProcedure(w.req.Header.Proc) == NFSProcedureRmDir {
+		if info, err := fs.Lstat(toDelete); err == nil && !info.IsDir() {
+			return &NFSStatusError{NFSStatusNotDir, nil}
+		}
+	}
 
+	// the handle of the entry removed is invalidated, not that of its
+	// directory, which clients go on using.
+	removedHandle := userHandle.ToHandle(fs, entryPath(path, obj.Filename))
 	err = fs.Remove(toDelete)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		if os.IsPermission(err) {
-			return &NFSStatusError{NFSStatusAccess, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return statusError(err, NFSStatusIO)
 	}
 
-	if err := userHandle.InvalidateHandle(fs, obj.Handle); err != nil {
+	if err := userHandle.InvalidateHandle(fs, removedHandle); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
+	removeAppleDouble(ctx, userHandle, fs, path, obj.Filename)
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, preCacheData, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preCacheData, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -10,12 +10,10 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-var doubleWccErrorBody = [16]byte{}
-
 func onRename(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = errFormatterWithBody(doubleWccErrorBody[:])
 	from := DirOpArg{}
-	err := xdr.Read(w.req.Body, &from)
+	err := readArgs(w.req.Body, &from)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -25,7 +23,7 @@ func onRename(ctx context.Context, w *response, userHandle Handler) error {
 	}
 
 	to := DirOpArg{}
-	if err = xdr.Read(w.req.Body, &to); err != nil {
+	if err = readArgs(w.req.Body, &to); err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 	fs2, toPath, err := userHandle.FromHandle(to.Handle)
@@ -34,61 +32,109 @@ func onRename(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	// check the two fs are the same
 	if !reflect.DeepEqual(fs, fs2) {
-		return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
+		return &NFSStatusError{NFSStatusXDev, os.ErrInvalid}
 	}
 
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(from.Filename)) > PathNameMax || len(string(to.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	if err := checkExistingName(from.Filename); err != nil {
+		return err
+	}
+	if err := checkExistingName(to.Filename); err != nil {
+		return err
+	}
+	from.Filename = caseName(ctx, fs, fromPath, from.Filename)
+	// a target that is the entry being renamed changes the case of its name.
+	if toName := caseName(ctx, fs, toPath, to.Filename); fs.Join(toPath...) != fs.Join(fromPath...) || string(toName) != string(from.Filename) {
+		to.Filename = toName
 	}
 
 	fromDirPath := fs.Join(fromPath...)
 	fromDirInfo, err := fs.Stat(fromDirPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return statusError(err, NFSStatusIO)
 	}
 	if !fromDirInfo.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
-	preCacheData := ToFileAttribute(fromDirInfo, fromDirPath).AsCache()
+	fromDirAttr := ToFileAttribute(fromDirInfo, fromDirPath)
+	preCacheData := fromDirAttr.AsCache()
 
 	toDirPath := fs.Join(toPath...)
 	toDirInfo, err := fs.Stat(toDirPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return statusError(err, NFSStatusIO)
 	}
 	if !toDirInfo.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
-	preDestData := ToFileAttribute(toDirInfo, toDirPath).AsCache()
-
-	oldHandle := userHandle.ToHandle(fs, append(fromPath, string(from.Filename)))
+	toDirAttr := ToFileAttribute(toDirInfo, toDirPath)
+	preDestData := toDirAttr.AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, fromPath, preCacheData}, wccObject{fs, toPath, preDestData})
+	if err := checkAccess(ctx, fromDirAttr, accessDelete|accessLookup); err != nil {
+		return err
+	}
+	if err := checkAccess(ctx, toDirAttr, accessModify|accessLookup); err != nil {
+		return err
+	}
 
-	fromLoc := fs.Join(append(fromPath, string(from.Filename))...)
-	toLoc := fs.Join(append(toPath, string(to.Filename))...)
+	fromFile := entryPath(fromPath, from.Filename)
+	toFile := entryPath(toPath, to.Filename)
+	fromLoc := fs.Join(fromFile...)
+	toLoc := fs.Join(toFile...)
 
-	err = fs.Rename(fromLoc, toLoc)
+	fromInfo, err := fs.Lstat(fromLoc)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
+		return statusError(err, NFSStatusNoEnt)
+	}
+	toInfo, err := fs.Lstat(toLoc)
+	replacing := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return statusError(err, NFSStatusIO)
+	}
+
+	// Renaming an object onto itself, or onto another link to the same file,
+	// succeeds without doing anything.
+	noop := fromLoc == toLoc || (replacing && os.SameFile(fromInfo, toInfo))
+	if !noop {
+		if fromInfo.IsDir() && hasPathPrefix(toFile, fromFile) {
+			// a directory can't be moved inside itself.
+			return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
 		}
-		if os.IsPermission(err) {
-			return &NFSStatusError{NFSStatusAccess, err}
+		if replacing {
+			if err := checkReplaceable(fs, fromInfo, toInfo, toLoc); err != nil {
+				return err
+			}
 		}
-		return &NFSStatusError{NFSStatusIO, err}
-	}
 
-	if err := userHandle.InvalidateHandle(fs, oldHandle); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
+		oldHandle := userHandle.ToHandle(fs, fromFile)
+		var replacedHandle []byte
+		if replacing {
+			replacedHandle = userHandle.ToHandle(fs, toFile)
+		}
+
+		err = fs.Rename(fromLoc, toLoc)
+		if err != nil && replacing && os.IsExist(err) {
+			// The backend can't replace an entry in place. Removing the
+			// target first would leave a window in which neither name
+			// exists, so the rename is refused instead.
+			return &NFSStatusError{NFSStatusNotSupp, err}
+		}
+		if err != nil {
+			return statusError(err, NFSStatusIO)
+		}
+
+		if err := userHandle.InvalidateHandle(fs, oldHandle); err != nil {
+			return &NFSStatusError{NFSStatusServerFault, err}
+		}
+		if replacedHandle != nil {
+			if err := userHandle.InvalidateHandle(fs, replacedHandle); err != nil {
+				return &NFSStatusError{NFSStatusServerFault, err}
+			}
+		}
+		renameAppleDouble(ctx, userHandle, fs, fromPath, from.Filename, toPath, to.Filename)
 	}
 
 	writer := bytes.NewBuffer([]byte{})
@@ -96,10 +142,10 @@ func onRename(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, preCacheData, tryStat(fs, fromPath)); err != nil {
+	if err := WriteWcc(writer, preCacheData, tryStat(ctx, fs, fromPath)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WriteWcc(writer, preDestData, tryStat(fs, toPath)); err != nil {
+	if err := WriteWcc(writer, preDestData, tryStat(ctx, fs, toPath)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -108,3 +154,38 @@ func onRename(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	return nil
 }
+
+// checkReplaceable reports whether the existing entry at toLoc may be replaced
+// by a rename of from: a directory may only replace an empty directory, and a
+// non-directory may only replace a non-directory.
+func checkReplaceable(fs billy.Filesystem, from, to os.FileInfo, toLoc string) error {
+	if from.IsDir() && !to.IsDir() {
+		return &NFSStatusError{NFSStatusNotDir, os.ErrExist}
+	}
+	if !from.IsDir() && to.IsDir() {
+		return &NFSStatusError{NFSStatusIsDir, os.ErrExist}
+	}
+	if to.IsDir() {
+		contents, err := fs.ReadDir(toLoc)
+		if err != nil {
+			return statusError(err, NFSStatusIO)
+		}
+		if len(contents) > 0 {
+			return &NFSStatusError{NFSStatusNotEmpty, os.ErrExist}
+		}
+	}
+	return nil
+}
+
+// hasPathPrefix reports whether p is prefix or lies beneath it.
+func hasPathPrefix(p, prefix []string) bool {
+	if len(p) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if p[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
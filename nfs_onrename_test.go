@@ -0,0 +1,96 @@
+package nfs_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestRename(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/a", []byte("a"), 0666)
+	_ = billyutil.WriteFile(mem, "/b", []byte("b"), 0666)
+	_ = mem.MkdirAll("/dir/sub", 0755)
+	_ = mem.MkdirAll("/empty", 0755)
+	_ = billyutil.WriteFile(mem, "/full/file", []byte("f"), 0666)
+
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	for _, tc := range []struct {
+		from, to string
+		expected nfs.NFSStatus
+	}{
+		{"/a", "/a", nfs.NFSStatusOk},
+		{"/a", "/b", nfs.NFSStatusOk},
+		{"/b", "/dir", nfs.NFSStatusIsDir},
+		{"/dir", "/b", nfs.NFSStatusNotDir},
+		{"/dir", "/full", nfs.NFSStatusNotEmpty},
+		{"/dir", "/dir/sub/dir", nfs.NFSStatusInval},
+		{"/dir", "/empty", nfs.NFSStatusOk},
+	} {
+		err := target.Rename(tc.from, tc.to)
+		if tc.expected == nfs.NFSStatusOk {
+			if err != nil {
+				t.Fatalf("rename %s to %s: %v", tc.from, tc.to, err)
+			}
+			continue
+		}
+		var nerr *nfsc.Error
+		if !errors.As(err, &nerr) || nerr.ErrorNum != uint32(tc.expected) {
+			t.Fatalf("rename %s to %s: expected %v, got %v", tc.from, tc.to, tc.expected, err)
+		}
+	}
+
+	if contents, err := billyutil.ReadFile(mem, "/b"); err != nil || string(contents) != "a" {
+		t.Fatalf("expected /a to replace /b, got %q, %v", contents, err)
+	}
+	if _, err := mem.Stat("/a"); !os.IsNotExist(err) {
+		t.Fatalf("expected /a to be gone, got %v", err)
+	}
+	if info, err := mem.Stat("/empty/sub"); err != nil || !info.IsDir() {
+		t.Fatalf("expected /dir to replace /empty, got %v", err)
+	}
+}
+
+// noReplaceFS can't rename over an existing entry.
+type noReplaceFS struct {
+	billy.Filesystem
+}
+
+func (fs noReplaceFS) Rename(from, to string) error {
+	if _, err := fs.Lstat(to); err == nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrExist}
+	}
+	return fs.Filesystem.Rename(from, to)
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/a", []byte("a"), 0666)
+	_ = billyutil.WriteFile(mem, "/b", []byte("b"), 0666)
+
+	srv := nfstest.ServeFS(t, noReplaceFS{mem})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if err := target.Rename("/a", "/b"); !nfstest.IsStatus(err, nfs.NFSStatusNotSupp) {
+		t.Fatalf("expected a rename over an entry the backend can't replace to be refused: %v", err)
+	}
+	for name, expected := range map[string]string{"/a": "a", "/b": "b"} {
+		if contents, err := billyutil.ReadFile(mem, name); err != nil || string(contents) != expected {
+			t.Fatalf("expected %s to be left as it was, got %q, %v", name, contents, err)
+		}
+	}
+	if err := target.Rename("/a", "/c"); err != nil {
+		t.Fatalf("expected a rename to a new name to succeed: %v", err)
+	}
+}
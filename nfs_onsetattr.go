@@ -5,13 +5,12 @@ import (
 	"context"
 	"os"
 
-	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func onSetAttr(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
-	handle, err := xdr.ReadOpaque(w.req.Body)
+	handle, err := readHandle(w.req.Body)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -28,11 +27,11 @@ func onSetAttr(ctx context.Context, w *response, userHandle Handler) error {
 	fullPath := fs.Join(path...)
 	info, err := fs.Lstat(fullPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		return &NFSStatusError{NFSStatusAccess, err}
+		return statusError(err, NFSStatusAccess)
 	}
+	fileAttr := ToFileAttribute(info, fullPath)
+	preAttr := fileAttr.AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, path, preAttr})
 
 	// see if there's a "guard"
 	if guard, err := xdr.ReadUint32(w.req.Body); err != nil {
@@ -40,32 +39,45 @@ func onSetAttr(ctx context.Context, w *response, userHandle Handler) error {
 	} else if guard != 0 {
 		// read the ctime.
 		t := FileTime{}
-		if err := xdr.Read(w.req.Body, &t); err != nil {
+		if err := readArgs(w.req.Body, &t); err != nil {
 			return &NFSStatusError{NFSStatusInval, err}
 		}
-		attr := ToFileAttribute(info, fullPath)
-		if t != attr.Ctime {
+		// the change is only applied if the object hasn't changed since the
+		// client last observed it.
+		if t != preAttr.Ctime {
 			return &NFSStatusError{NFSStatusNotSync, nil}
 		}
 	}
 
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
+	if attrs.SetSize != nil {
+		if limits, err := fsInfoFor(fs); err == nil && *attrs.SetSize > limits.MaxFileSize {
+			return &NFSStatusError{NFSStatusFBig, os.ErrInvalid}
+		}
+	}
+	if err := checkSetAttr(ctx, fileAttr, attrs); err != nil {
+		return err
+	}
+	restrictSetgid(ctx, fileAttr, attrs)
+
 	changer := userHandle.Change(fs)
 	if err := attrs.Apply(changer, fs, fs.Join(path...)); err != nil {
 		// Already an nfsstatuserror
 		return err
 	}
-
-	preAttr := ToFileAttribute(info, fullPath).AsCache()
+	if attrs.SetSize != nil && attrs.SetMode == nil {
+		// truncating a file changes it as a write does.
+		killPrivileges(ctx, changer, fullPath, fileAttr)
+	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WriteWcc(writer, preAttr, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preAttr, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
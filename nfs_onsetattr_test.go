@@ -0,0 +1,167 @@
+package nfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestSetAttrGuard(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+
+	srv := nfstest.ServeFS(t, mem)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	attr, fh, err := target.Lookup("/test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctime := attr.(*nfsc.Fattr).Ctime
+
+	stale := ctime
+	stale.Seconds--
+	if status, wcc, err := setAttrGuarded(target.Target, fh, stale); err != nil {
+		t.Fatal(err)
+	} else if status != uint32(nfs.NFSStatusNotSync) {
+		t.Fatalf("expected NOT_SYNC for a stale guard, got %d", status)
+	} else if !wcc.Before.IsSet || !wcc.After.IsSet {
+		t.Fatal("expected wcc data with NOT_SYNC")
+	}
+
+	if status, _, err := setAttrGuarded(target.Target, fh, ctime); err != nil {
+		t.Fatal(err)
+	} else if status != uint32(nfs.NFSStatusOk) {
+		t.Fatalf("expected a matching guard to succeed, got %d", status)
+	}
+}
+
+// setAttrGuarded issues an empty SETATTR guarded by the provided ctime.
+func setAttrGuarded(target *nfsc.Target, fh []byte, ctime nfsc.NFS3Time) (uint32, *nfsc.WccData, error) {
+	type setAttrArgs struct {
+		rpc.Header
+		Handle []byte
+		Attrs  nfsc.Sattr3
+		Guard  nfsc.Sattrguard3
+	}
+
+	res, err := target.Call(&setAttrArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Vers:    nfsc.Nfs3Vers,
+			Prog:    nfsc.Nfs3Prog,
+			Proc:    uint32(nfs.NFSProcedureSetAttr),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+		Guard:  nfsc.Sattrguard3{Check: 1, Time: ctime},
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		return 0, nil, err
+	}
+	wcc := new(nfsc.WccData)
+	if err := xdr.Read(res, wcc); err != nil {
+		return 0, nil, err
+	}
+	return status, wcc, nil
+}
+
+func TestSpecialModeBits(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "prog"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "shared"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "shared"), 0775|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := changeOS{osfs.New(dir), dir}
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(fs), nfs.ExportOptions{})
+	srv := nfstest.ServeCached(t, handler)
+	target := srv.Mount(t, "/", rpc.NewAuthUnix("client", 1000, 100).Auth())
+
+	if err := target.Setattr("/prog", nfsc.Sattr3{Mode: nfsc.SetMode{SetIt: true, Mode: 04755}}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "prog")); err != nil || info.Mode()&os.ModeSetuid == 0 {
+		t.Fatalf("expected SETATTR to set the setuid bit, got %v: %v", info, err)
+	}
+	attr, _, err := target.Lookup("/prog", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := attr.(*nfsc.Fattr).FileMode & 07777; mode != 04755 {
+		t.Fatalf("expected mode 04755, got %o", mode)
+	}
+	attr, _, err = target.Lookup("/shared", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := attr.(*nfsc.Fattr).FileMode & 07777; mode != 02775 {
+		t.Fatalf("expected mode 02775, got %o", mode)
+	}
+
+	if _, err := target.Mkdir("/shared/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "shared", "sub")); err != nil || info.Mode()&os.ModeSetgid == 0 {
+		t.Fatalf("expected a directory of a setgid directory to be setgid, got %v: %v", info, err)
+	}
+
+	f, err := target.OpenFile("/prog", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("#!/bin/sh\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "prog")); err != nil || info.Mode()&os.ModeSetuid != 0 {
+		t.Fatalf("expected a write to drop the setuid bit, got %v: %v", info, err)
+	}
+}
+
+// changeOS adds billy.Change to an os backed filesystem rooted at root.
+type changeOS struct {
+	billy.Filesystem
+	root string
+}
+
+func (c changeOS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(filepath.Join(c.root, name), mode)
+}
+
+func (c changeOS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(filepath.Join(c.root, name), uid, gid)
+}
+
+func (c changeOS) Chown(name string, uid, gid int) error {
+	return os.Chown(filepath.Join(c.root, name), uid, gid)
+}
+
+func (c changeOS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(filepath.Join(c.root, name), atime, mtime)
+}
@@ -5,14 +5,13 @@ import (
 	"context"
 	"os"
 
-	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -21,7 +20,7 @@ func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
-	target, err := xdr.ReadOpaque(w.req.Body)
+	target, err := readBoundedOpaque(w.req.Body, pathMax)
 	if err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
@@ -30,34 +29,50 @@ func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
+	if err := requireCapability(userHandle, fs, CapabilitySymlinks); err != nil {
+		return err
+	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	if err := checkNewName(obj.Filename); err != nil {
+		return err
+	}
+	obj.Filename = caseName(ctx, fs, path, obj.Filename)
+	if err := checkLinkTarget(target); err != nil {
+		return err
 	}
 
-	newFilePath := fs.Join(append(path, string(obj.Filename))...)
+	newFilePath := fs.Join(entryPath(path, obj.Filename)...)
 	if _, err := fs.Stat(newFilePath); err == nil {
 		return &NFSStatusError{NFSStatusExist, os.ErrExist}
 	}
-	if s, err := fs.Stat(fs.Join(path...)); err != nil {
-		return &NFSStatusError{NFSStatusAccess, err}
-	} else if !s.IsDir() {
+	dirPath := fs.Join(path...)
+	dirInfo, err := fs.Stat(dirPath)
+	if err != nil {
+		return statusError(err, NFSStatusAccess)
+	} else if !dirInfo.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
+	dirAttr := ToFileAttribute(dirInfo, dirPath)
+	preDirAttr := dirAttr.AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, path, preDirAttr})
+	if err := checkAccess(ctx, dirAttr, accessModify|accessLookup); err != nil {
+		return err
+	}
 
 	err = fs.Symlink(string(target), newFilePath)
 	if err != nil {
-		return &NFSStatusError{NFSStatusAccess, err}
+		return statusError(err, NFSStatusAccess)
 	}
 
-	fp := userHandle.ToHandle(fs, append(path, string(obj.Filename)))
+	fp := w.toHandle(ctx, userHandle, fs, entryPath(path, obj.Filename))
 	changer := userHandle.Change(fs)
+	chownToCaller(ctx, changer, newFilePath, dirAttr)
 	if changer != nil {
 		if err := attrs.Apply(changer, fs, newFilePath); err != nil {
-			return &NFSStatusError{NFSStatusIO, err}
+			return statusError(err, NFSStatusIO)
 		}
 	}
 
@@ -73,11 +88,11 @@ func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, fp); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, append(path, string(obj.Filename)))); err != nil {
+	if err := WritePostOpAttrs(writer, tryStat(ctx, fs, entryPath(path, obj.Filename))); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, nil, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preDirAttr, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
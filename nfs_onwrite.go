@@ -7,7 +7,6 @@ import (
 	"math"
 	"os"
 
-	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
@@ -21,7 +20,7 @@ const (
 )
 
 type writeArgs struct {
-	Handle []byte
+	Handle []byte `xdrmax:"handle"`
 	Offset uint64
 	Count  uint32
 	How    uint32
@@ -31,7 +30,7 @@ type writeArgs struct {
 func onWrite(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	var req writeArgs
-	if err := xdr.Read(w.req.Body, &req); err != nil {
+	if err := readArgs(w.req.Body, &req); err != nil {
 		return &NFSStatusError{NFSStatusInval, err}
 	}
 
@@ -39,7 +38,7 @@ func onWrite(ctx context.Context, w *response, userHandle Handler) error {
 	if err != nil {
 		return &NFSStatusError{NFSStatusStale, err}
 	}
-	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+	if isReadOnly(ctx, fs) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 	if len(req.Data) > math.MaxInt32 || req.Count > math.MaxInt32 {
@@ -49,28 +48,37 @@ func onWrite(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
 	}
 
+	if limits, err := fsInfoFor(fs); err == nil {
+		if req.Offset > limits.MaxFileSize || uint64(req.Count) > limits.MaxFileSize-req.Offset {
+			return &NFSStatusError{NFSStatusFBig, os.ErrInvalid}
+		}
+	}
+
 	// stat first for pre-op wcc.
 	fullPath := fs.Join(path...)
 	info, err := fs.Stat(fullPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		return &NFSStatusError{NFSStatusAccess, err}
+		return statusError(err, NFSStatusAccess)
 	}
 	if !info.Mode().IsRegular() {
 		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
 	}
-	preOpCache := ToFileAttribute(info, fullPath).AsCache()
+	preOpAttr := ToFileAttribute(info, fullPath)
+	preOpCache := preOpAttr.AsCache()
+	w.errorFmt = wccErrorFormatter(ctx, wccObject{fs, path, preOpCache})
+	if err := checkIOAccess(ctx, preOpAttr, true); err != nil {
+		return err
+	}
 
 	// now the actual op.
 	file, err := fs.OpenFile(fs.Join(path...), os.O_RDWR, info.Mode().Perm())
 	if err != nil {
-		return &NFSStatusError{NFSStatusAccess, err}
+		return statusError(err, NFSStatusAccess)
 	}
 	if req.Offset > 0 {
 		if _, err := file.Seek(int64(req.Offset), io.SeekStart); err != nil {
-			return &NFSStatusError{NFSStatusIO, err}
+			_ = file.Close()
+			return statusError(err, NFSStatusIO)
 		}
 	}
 	end := req.Count
@@ -80,28 +88,44 @@ func onWrite(ctx context.Context, w *response, userHandle Handler) error {
 	writtenCount, err := file.Write(req.Data[:end])
 	if err != nil {
 		Log.Errorf("Error writing: %v", err)
-		return &NFSStatusError{NFSStatusIO, err}
+		_ = file.Close()
+		return statusError(err, NFSStatusIO)
+	}
+
+	// An UNSTABLE write is left for a later COMMIT to flush when the backend
+	// is able to, but on ESXi datastores; otherwise data is flushed before
+	// replying.
+	committed := fileSync
+	if CapabilitiesOf(userHandle, fs)&CapabilitySync != 0 && canSync(fs, file) {
+		if writeStability(req.How) == unstable && !esxiQuirks(ctx) {
+			committed = unstable
+		} else if err := syncToStable(fs, file, fullPath); err != nil {
+			Log.Errorf("error syncing: %v", err)
+			_ = file.Close()
+			return statusError(err, NFSStatusIO)
+		}
 	}
 	if err := file.Close(); err != nil {
 		Log.Errorf("error closing: %v", err)
-		return &NFSStatusError{NFSStatusIO, err}
+		return statusError(err, NFSStatusIO)
 	}
+	killPrivileges(ctx, userHandle.Change(fs), fullPath, preOpAttr)
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, preOpCache, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preOpCache, tryStat(ctx, fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 	if err := xdr.Write(writer, uint32(writtenCount)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := xdr.Write(writer, fileSync); err != nil {
+	if err := xdr.Write(writer, committed); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := xdr.Write(writer, w.Server.ID); err != nil {
+	if err := xdr.Write(writer, w.Server.writeVerifier()); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
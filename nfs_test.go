@@ -11,11 +11,11 @@ import (
 	nfs "github.com/willscott/go-nfs"
 	"github.com/willscott/go-nfs/helpers"
 	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
 
 	nfsc "github.com/willscott/go-nfs-client/nfs"
 	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
 	"github.com/willscott/go-nfs-client/nfs/util"
-	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func TestNFS(t *testing.T) {
@@ -129,7 +129,7 @@ func TestNFS(t *testing.T) {
 	}
 
 	// for test nfs.ReadDir in case of many files
-	manyEntities, err := readDir(target, "/")
+	manyEntities, err := nfstest.ReadDir(target, "/")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -184,7 +184,7 @@ func TestNFS(t *testing.T) {
 	}
 
 	// for test nfs.ReadDir in case of empty directory
-	emptyEntities, err := readDir(target, "/empty")
+	emptyEntities, err := nfstest.ReadDir(target, "/empty")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -192,99 +192,3 @@ func TestNFS(t *testing.T) {
 		t.Fatal("nfs.ReadDir error reading empty dir")
 	}
 }
-
-type readDirEntry struct {
-	FileId   uint64
-	FileName string
-	Cookie   uint64
-}
-
-// readDir implementation "appropriated" from go-nfs-client implementation of READDIRPLUS
-func readDir(target *nfsc.Target, dir string) ([]*readDirEntry, error) {
-	_, fh, err := target.Lookup(dir)
-	if err != nil {
-		return nil, err
-	}
-
-	type readDirArgs struct {
-		rpc.Header
-		Handle      []byte
-		Cookie      uint64
-		CookieVerif uint64
-		Count       uint32
-	}
-
-	type readDirList struct {
-		IsSet bool         `xdr:"union"`
-		Entry readDirEntry `xdr:"unioncase=1"`
-	}
-
-	type readDirListOK struct {
-		DirAttrs   nfsc.PostOpAttr
-		CookieVerf uint64
-	}
-
-	cookie := uint64(0)
-	cookieVerf := uint64(0)
-	eof := false
-
-	var entries []*readDirEntry
-	for !eof {
-		res, err := target.Call(&readDirArgs{
-			Header: rpc.Header{
-				Rpcvers: 2,
-				Vers:    nfsc.Nfs3Vers,
-				Prog:    nfsc.Nfs3Prog,
-				Proc:    uint32(nfs.NFSProcedureReadDir),
-				Cred:    rpc.AuthNull,
-				Verf:    rpc.AuthNull,
-			},
-			Handle:      fh,
-			Cookie:      cookie,
-			CookieVerif: cookieVerf,
-			Count:       4096,
-		})
-		if err != nil {
-			return nil, err
-		}
-
-		status, err := xdr.ReadUint32(res)
-		if err != nil {
-			return nil, err
-		}
-
-		if err = nfsc.NFS3Error(status); err != nil {
-			return nil, err
-		}
-
-		dirListOK := new(readDirListOK)
-		if err = xdr.Read(res, dirListOK); err != nil {
-			return nil, err
-		}
-
-		for {
-			var item readDirList
-			if err = xdr.Read(res, &item); err != nil {
-				return nil, err
-			}
-
-			if !item.IsSet {
-				break
-			}
-
-			cookie = item.Entry.Cookie
-			if item.Entry.FileName == "." || item.Entry.FileName == ".." {
-				continue
-			}
-			entries = append(entries, &item.Entry)
-		}
-
-		if err = xdr.Read(res, &eof); err != nil {
-			return nil, err
-		}
-
-		cookieVerf = dirListOK.CookieVerf
-	}
-
-	return entries, nil
-}
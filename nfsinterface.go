@@ -183,6 +183,6 @@ func (s NFSStatus) String() string {
 
 // DirOpArg is a common serialization used for referencing an object in a directory
 type DirOpArg struct {
-	Handle   []byte
-	Filename []byte
+	Handle   []byte `xdrmax:"handle"`
+	Filename []byte `xdrmax:"name"`
 }
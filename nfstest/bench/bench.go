@@ -0,0 +1,436 @@
+// Package bench drives an NFS server with a configurable mix of operations
+// and reports the resulting throughput and latency.
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// Workload is a class of operation issued by the load generator.
+type Workload int
+
+// Workloads that can be mixed in a run.
+const (
+	// Metadata issues lookups, getattrs, directory listings, and
+	// create/remove pairs of empty files.
+	Metadata Workload = iota
+	// StreamingRead reads a whole file sequentially in IOSize chunks.
+	StreamingRead
+	// RandomWrite writes a single IOSize chunk at a random offset.
+	RandomWrite
+)
+
+var workloads = []Workload{Metadata, StreamingRead, RandomWrite}
+
+func (w Workload) String() string {
+	switch w {
+	case Metadata:
+		return "metadata"
+	case StreamingRead:
+		return "streaming-read"
+	case RandomWrite:
+		return "random-write"
+	default:
+		return fmt.Sprintf("workload(%d)", int(w))
+	}
+}
+
+// Config describes a benchmark run.
+type Config struct {
+	// Addr is the host:port of the server under test.
+	Addr string
+	// Dirpath is the export to mount. Defaults to "/".
+	Dirpath string
+	// Auth is the credential presented by every worker. Defaults to AUTH_NULL.
+	Auth rpc.Auth
+	// Dir is the directory, relative to the export, holding the working set.
+	// It is created if missing. Defaults to "bench".
+	Dir string
+
+	// Workers is the number of concurrent clients, each on its own connection.
+	Workers int
+	// Duration bounds the run. If zero, Ops must be set.
+	Duration time.Duration
+	// Ops bounds the total number of operations across all workers.
+	Ops int
+	// Mix is the relative weight of each workload. Defaults to an even mix.
+	Mix map[Workload]int
+
+	// Files is the number of files in the working set.
+	Files int
+	// FileSize is the size of each file in the working set.
+	FileSize int
+	// IOSize is the size of each read or write.
+	IOSize int
+	// Seed seeds operation selection, for reproducible runs.
+	Seed int64
+}
+
+func (c *Config) setDefaults() error {
+	if c.Addr == "" {
+		return errors.New("bench: no server address")
+	}
+	if c.Dirpath == "" {
+		c.Dirpath = "/"
+	}
+	if c.Auth.Flavor == 0 && c.Auth.Body == nil {
+		c.Auth = rpc.AuthNull
+	}
+	if c.Dir == "" {
+		c.Dir = "bench"
+	}
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.Duration <= 0 && c.Ops <= 0 {
+		return errors.New("bench: one of Duration or Ops must be set")
+	}
+	if len(c.Mix) == 0 {
+		c.Mix = map[Workload]int{Metadata: 1, StreamingRead: 1, RandomWrite: 1}
+	}
+	if c.Files <= 0 {
+		c.Files = 16
+	}
+	if c.FileSize <= 0 {
+		c.FileSize = 1 << 20
+	}
+	if c.IOSize <= 0 {
+		c.IOSize = 64 << 10
+	}
+	if c.IOSize > c.FileSize {
+		c.IOSize = c.FileSize
+	}
+	return nil
+}
+
+// Stats summarizes the operations of one workload.
+type Stats struct {
+	Ops    int
+	Errors int
+	Bytes  int64
+
+	latencies []time.Duration
+}
+
+func (s *Stats) record(d time.Duration, n int64, err error) {
+	s.Ops++
+	s.Bytes += n
+	if err != nil {
+		s.Errors++
+	}
+	s.latencies = append(s.latencies, d)
+}
+
+func (s *Stats) merge(o *Stats) {
+	s.Ops += o.Ops
+	s.Errors += o.Errors
+	s.Bytes += o.Bytes
+	s.latencies = append(s.latencies, o.latencies...)
+}
+
+// Percentile returns the latency below which fraction p of operations completed.
+func (s *Stats) Percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(s.latencies)-1))
+	return s.latencies[i]
+}
+
+// Mean is the average operation latency.
+func (s *Stats) Mean() time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, l := range s.latencies {
+		total += l
+	}
+	return total / time.Duration(len(s.latencies))
+}
+
+// Result is the outcome of a benchmark run.
+type Result struct {
+	Elapsed   time.Duration
+	Workloads map[Workload]*Stats
+}
+
+// Total aggregates the stats of all workloads.
+func (r *Result) Total() *Stats {
+	t := &Stats{}
+	for _, s := range r.Workloads {
+		t.merge(s)
+	}
+	sort.Slice(t.latencies, func(i, j int) bool { return t.latencies[i] < t.latencies[j] })
+	return t
+}
+
+// String renders the result as a table.
+func (r *Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-15s %8s %6s %10s %10s %10s %10s %10s\n", "workload", "ops", "errs", "ops/s", "MiB/s", "mean", "p50", "p99")
+	line := func(name string, s *Stats) {
+		secs := r.Elapsed.Seconds()
+		fmt.Fprintf(&b, "%-15s %8d %6d %10.1f %10.2f %10s %10s %10s\n", name, s.Ops, s.Errors,
+			float64(s.Ops)/secs, float64(s.Bytes)/secs/(1<<20),
+			s.Mean().Round(time.Microsecond), s.Percentile(0.5).Round(time.Microsecond), s.Percentile(0.99).Round(time.Microsecond))
+	}
+	for _, w := range workloads {
+		if s, ok := r.Workloads[w]; ok {
+			line(w.String(), s)
+		}
+	}
+	line("total", r.Total())
+	return b.String()
+}
+
+// Run populates the working set and then drives the configured workload mix
+// until the duration elapses, the op budget is spent, or ctx is done.
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	if err := setup(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	budget := int64(cfg.Ops)
+
+	workers := make([]*worker, cfg.Workers)
+	for i := range workers {
+		c, err := nfstest.Dial(cfg.Addr, cfg.Dirpath, cfg.Auth)
+		if err != nil {
+			for _, w := range workers[:i] {
+				_ = w.Close()
+			}
+			return nil, err
+		}
+		workers[i] = &worker{
+			Client: c,
+			cfg:    &cfg,
+			id:     i,
+			rng:    rand.New(rand.NewSource(cfg.Seed + int64(i))),
+			buf:    make([]byte, cfg.IOSize),
+			stats:  make(map[Workload]*Stats),
+		}
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(ctx, &budget)
+		}(w)
+	}
+	wg.Wait()
+
+	res := &Result{
+		Elapsed:   time.Since(start),
+		Workloads: make(map[Workload]*Stats),
+	}
+	for _, w := range workers {
+		_ = w.Close()
+		for wl, s := range w.stats {
+			if _, ok := res.Workloads[wl]; !ok {
+				res.Workloads[wl] = &Stats{}
+			}
+			res.Workloads[wl].merge(s)
+		}
+	}
+	for _, s := range res.Workloads {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	}
+	return res, nil
+}
+
+func fileName(cfg *Config, i int) string {
+	return path.Join(cfg.Dir, fmt.Sprintf("file%04d", i))
+}
+
+// setup creates the working set directory and fills each file to FileSize.
+func setup(cfg *Config) error {
+	c, err := nfstest.Dial(cfg.Addr, cfg.Dirpath, cfg.Auth)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, _, err := c.Lookup(cfg.Dir, false); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if _, err := c.Mkdir(cfg.Dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	chunk := make([]byte, cfg.IOSize)
+	rand.New(rand.NewSource(cfg.Seed)).Read(chunk)
+	for i := 0; i < cfg.Files; i++ {
+		f, err := c.OpenFile(fileName(cfg, i), 0666)
+		if err != nil {
+			return err
+		}
+		for written := 0; written < cfg.FileSize; {
+			n := len(chunk)
+			if rem := cfg.FileSize - written; rem < n {
+				n = rem
+			}
+			if _, err := f.Write(chunk[:n]); err != nil {
+				_ = f.Close()
+				return err
+			}
+			written += n
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type worker struct {
+	*nfstest.Client
+	cfg   *Config
+	id    int
+	rng   *rand.Rand
+	buf   []byte
+	stats map[Workload]*Stats
+	seq   int
+}
+
+// run issues operations until ctx is done or, when an op budget is set, the
+// shared budget is spent.
+func (w *worker) run(ctx context.Context, budget *int64) {
+	total := 0
+	for _, weight := range w.cfg.Mix {
+		if weight > 0 {
+			total += weight
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	for ctx.Err() == nil {
+		if w.cfg.Ops > 0 && atomic.AddInt64(budget, -1) < 0 {
+			return
+		}
+
+		wl := w.pick(total)
+		start := time.Now()
+		n, err := w.do(wl)
+		d := time.Since(start)
+
+		s, ok := w.stats[wl]
+		if !ok {
+			s = &Stats{}
+			w.stats[wl] = s
+		}
+		s.record(d, n, err)
+	}
+}
+
+func (w *worker) pick(total int) Workload {
+	r := w.rng.Intn(total)
+	for _, wl := range workloads {
+		weight := w.cfg.Mix[wl]
+		if weight <= 0 {
+			continue
+		}
+		if r < weight {
+			return wl
+		}
+		r -= weight
+	}
+	return Metadata
+}
+
+func (w *worker) do(wl Workload) (int64, error) {
+	switch wl {
+	case Metadata:
+		return 0, w.metadata()
+	case StreamingRead:
+		return w.streamingRead()
+	case RandomWrite:
+		return w.randomWrite()
+	default:
+		return 0, fmt.Errorf("unknown workload %v", wl)
+	}
+}
+
+func (w *worker) metadata() error {
+	switch w.rng.Intn(4) {
+	case 0:
+		_, _, err := w.Lookup(fileName(w.cfg, w.rng.Intn(w.cfg.Files)), false)
+		return err
+	case 1:
+		_, err := w.Getattr(fileName(w.cfg, w.rng.Intn(w.cfg.Files)))
+		return err
+	case 2:
+		_, err := w.ReadDirPlus(w.cfg.Dir)
+		return err
+	default:
+		w.seq++
+		name := path.Join(w.cfg.Dir, fmt.Sprintf("tmp-%d-%d", w.id, w.seq))
+		if _, err := w.Create(name, 0666); err != nil {
+			return err
+		}
+		return w.Remove(name)
+	}
+}
+
+func (w *worker) streamingRead() (int64, error) {
+	f, err := w.Open(fileName(w.cfg, w.rng.Intn(w.cfg.Files)))
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for {
+		n, err := f.ReadAt(w.buf, total)
+		total += int64(n)
+		if err == io.EOF || (err == nil && n == 0) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (w *worker) randomWrite() (int64, error) {
+	f, err := w.OpenFile(fileName(w.cfg, w.rng.Intn(w.cfg.Files)), 0666)
+	if err != nil {
+		return 0, err
+	}
+	off := w.rng.Int63n(int64(w.cfg.FileSize - w.cfg.IOSize + 1))
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	w.rng.Read(w.buf)
+	n, err := f.Write(w.buf)
+	return int64(n), err
+}
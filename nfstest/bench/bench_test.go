@@ -0,0 +1,43 @@
+package bench_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+	"github.com/willscott/go-nfs/nfstest/bench"
+)
+
+func TestRun(t *testing.T) {
+	mem := memfs.New()
+	// File needs to exist in the root for memfs to acknowledge the root exists.
+	_, _ = mem.Create("/test")
+
+	srv, err := nfstest.NewServer(helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	res, err := bench.Run(context.Background(), bench.Config{
+		Addr:     srv.Addr(),
+		Duration: 200 * time.Millisecond,
+		Files:    4,
+		FileSize: 64 << 10,
+		IOSize:   8 << 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := res.Total()
+	if total.Ops == 0 {
+		t.Fatal("no operations completed")
+	}
+	if total.Errors != 0 {
+		t.Fatalf("%d operations failed:\n%s", total.Errors, res)
+	}
+	t.Log("\n" + res.String())
+}
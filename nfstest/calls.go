@@ -0,0 +1,171 @@
+package nfstest
+
+import (
+	"errors"
+
+	nfs "github.com/willscott/go-nfs"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// IsStatus reports whether err is an NFS error of the given status.
+func IsStatus(err error, status nfs.NFSStatus) bool {
+	var nerr *nfsc.Error
+	return errors.As(err, &nerr) && nerr.ErrorNum == uint32(status)
+}
+
+// DirEntry is an entry of a READDIR reply.
+type DirEntry struct {
+	FileId   uint64
+	FileName string
+	Cookie   uint64
+}
+
+// ReadDir lists the directory dir with READDIR, page by page, leaving out "."
+// and "..". The client only lists directories with READDIRPLUS.
+func ReadDir(target *nfsc.Target, dir string) ([]*DirEntry, error) {
+	_, fh, err := target.Lookup(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := uint64(0)
+	cookieVerf := uint64(0)
+	eof := false
+
+	var entries []*DirEntry
+	for !eof {
+		var page []*DirEntry
+		page, cookieVerf, eof, err = ReadDirPage(target, fh, cookie, cookieVerf)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			cookie = e.Cookie
+			if e.FileName == "." || e.FileName == ".." {
+				continue
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, nil
+}
+
+// ReadDirPage issues a single READDIR call of the directory fh continuing
+// from cookie, providing its entries, cookie verifier and eof.
+func ReadDirPage(target *nfsc.Target, fh []byte, cookie, cookieVerf uint64) ([]*DirEntry, uint64, bool, error) {
+	type readDirArgs struct {
+		rpc.Header
+		Handle      []byte
+		Cookie      uint64
+		CookieVerif uint64
+		Count       uint32
+	}
+
+	type readDirList struct {
+		IsSet bool     `xdr:"union"`
+		Entry DirEntry `xdr:"unioncase=1"`
+	}
+
+	type readDirListOK struct {
+		DirAttrs   nfsc.PostOpAttr
+		CookieVerf uint64
+	}
+
+	res, err := target.Call(&readDirArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Vers:    nfsc.Nfs3Vers,
+			Prog:    nfsc.Nfs3Prog,
+			Proc:    uint32(nfs.NFSProcedureReadDir),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle:      fh,
+		Cookie:      cookie,
+		CookieVerif: cookieVerf,
+		Count:       4096,
+	})
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if err = nfsc.NFS3Error(status); err != nil {
+		return nil, 0, false, err
+	}
+
+	dirListOK := new(readDirListOK)
+	if err = xdr.Read(res, dirListOK); err != nil {
+		return nil, 0, false, err
+	}
+
+	var entries []*DirEntry
+	for {
+		var item readDirList
+		if err = xdr.Read(res, &item); err != nil {
+			return nil, 0, false, err
+		}
+
+		if !item.IsSet {
+			break
+		}
+		entry := item.Entry
+		entries = append(entries, &entry)
+	}
+
+	var eof bool
+	if err = xdr.Read(res, &eof); err != nil {
+		return nil, 0, false, err
+	}
+
+	return entries, dirListOK.CookieVerf, eof, nil
+}
+
+// Lookup looks name up in the directory dir with a single LOOKUP, which the
+// client only makes of paths it has resolved itself.
+func Lookup(target *nfsc.Target, dir []byte, name string) ([]byte, *nfsc.PostOpAttr, error) {
+	type lookupArgs struct {
+		rpc.Header
+		Handle   []byte
+		Filename string
+	}
+	res, err := target.Call(&lookupArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Vers:    nfsc.Nfs3Vers,
+			Prog:    nfsc.Nfs3Prog,
+			Proc:    uint32(nfs.NFSProcedureLookup),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle:   dir,
+		Filename: name,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = nfsc.NFS3Error(status); err != nil {
+		return nil, nil, err
+	}
+	fh, err := xdr.ReadOpaque(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	attr := new(nfsc.PostOpAttr)
+	if err = xdr.Read(res, attr); err != nil {
+		return nil, nil, err
+	}
+	return fh, attr, nil
+}
@@ -0,0 +1,395 @@
+// Package conformance checks that a server, with a given nfs.Handler, behaves
+// as RFC 1813 requires: that replies carry wcc data, that failures are
+// reported with the right errors, that directory cookies page through a
+// listing, and that exclusive creates are idempotent.
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// Check is a single conformance check, run against the handle of an empty
+// directory it may modify.
+type Check struct {
+	Name string
+	Run  func(t *testing.T, c *Conn, dir []byte)
+}
+
+// Checks are the checks Run performs.
+var Checks = []Check{
+	{"WccData", checkWccData},
+	{"ErrorCodes", checkErrorCodes},
+	{"ReadDirCookies", checkReadDirCookies},
+	{"ExclusiveCreate", checkExclusiveCreate},
+}
+
+// Run serves handler on a loopback port and runs each of Checks as a subtest
+// of t. The handler must export a writable filesystem at "/", in which each
+// check makes a directory of its own.
+func Run(t *testing.T, handler nfs.Handler) {
+	srv, err := nfstest.NewServer(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	target, err := nfstest.Dial(srv.Addr(), "/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	c := &Conn{target: target}
+	res, status := c.call(nfsc.MountProg, nfsc.MountVers, uint32(nfs.MountProcMount), "/")
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("unable to mount the export: %v", status)
+	}
+	root := readHandle(t, res)
+	for _, check := range Checks {
+		check := check
+		t.Run(check.Name, func(t *testing.T) {
+			res, status := c.Call(nfs.NFSProcedureMkDir, root, "conformance-"+check.Name, Sattr{})
+			if status != nfs.NFSStatusOk {
+				t.Fatalf("unable to make a directory for the check: %v", status)
+			}
+			dir := c.postOpHandle(t, res)
+			check.Run(t, c, dir)
+		})
+	}
+}
+
+// Conn makes raw NFSv3 calls to the server under test.
+type Conn struct {
+	target *nfstest.Client
+}
+
+// Sattr is an sattr3 setting no attributes.
+type Sattr struct{}
+
+// Call makes an NFSv3 call with args encoded in order, and returns its status
+// with the rest of the reply. Handles are []byte, names are strings, and
+// fixed-size opaques such as verifiers are [8]byte.
+func (c *Conn) Call(proc nfs.NFSProcedure, args ...interface{}) (io.ReadSeeker, nfs.NFSStatus) {
+	return c.call(nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(proc), args...)
+}
+
+func (c *Conn) call(prog, vers, proc uint32, args ...interface{}) (io.ReadSeeker, nfs.NFSStatus) {
+	var body bytes.Buffer
+	for _, arg := range args {
+		switch a := arg.(type) {
+		case [8]byte:
+			body.Write(a[:])
+		case Sattr:
+			for i := 0; i < 6; i++ {
+				_ = xdr.Write(&body, uint32(0))
+			}
+		default:
+			if err := xdr.Write(&body, a); err != nil {
+				panic(fmt.Sprintf("unable to encode %T: %v", arg, err))
+			}
+		}
+	}
+	call := reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "Header", Type: reflect.TypeOf(rpc.Header{})},
+		{Name: "Body", Type: reflect.ArrayOf(body.Len(), reflect.TypeOf(byte(0)))},
+	}))
+	call.Elem().Field(0).Set(reflect.ValueOf(rpc.Header{
+		Rpcvers: 2,
+		Prog:    prog,
+		Vers:    vers,
+		Proc:    proc,
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	}))
+	reflect.Copy(call.Elem().Field(1), reflect.ValueOf(body.Bytes()))
+	res, err := c.target.Call(call.Interface())
+	if err != nil {
+		return nil, nfs.NFSStatusServerFault
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		return nil, nfs.NFSStatusServerFault
+	}
+	return res, nfs.NFSStatus(status)
+}
+
+func (c *Conn) postOpHandle(t *testing.T, res io.Reader) []byte {
+	t.Helper()
+	if follows, _ := xdr.ReadUint32(res); follows != 1 {
+		t.Fatal("expected a handle to follow")
+	}
+	return readHandle(t, res)
+}
+
+func readHandle(t *testing.T, res io.Reader) []byte {
+	t.Helper()
+	size, err := xdr.ReadUint32(res)
+	if err != nil || size > nfs.FHSize {
+		t.Fatalf("expected a handle, got %d bytes: %v", size, err)
+	}
+	fh := make([]byte, (size+3)&^3)
+	if _, err := io.ReadFull(res, fh); err != nil {
+		t.Fatal(err)
+	}
+	return fh[:size]
+}
+
+func readPostOpAttr(t *testing.T, res io.Reader) *nfs.FileAttribute {
+	t.Helper()
+	follows, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if follows == 0 {
+		return nil
+	}
+	var attr nfs.FileAttribute
+	if err := xdr.Read(res, &attr); err != nil {
+		t.Fatal(err)
+	}
+	return &attr
+}
+
+func readWcc(t *testing.T, res io.Reader) (*nfs.FileCacheAttribute, *nfs.FileAttribute) {
+	t.Helper()
+	follows, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pre *nfs.FileCacheAttribute
+	if follows != 0 {
+		pre = &nfs.FileCacheAttribute{}
+		if err := xdr.Read(res, pre); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pre, readPostOpAttr(t, res)
+}
+
+func (c *Conn) getattr(t *testing.T, fh []byte) *nfs.FileAttribute {
+	t.Helper()
+	res, status := c.Call(nfs.NFSProcedureGetAttr, fh)
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("GETATTR failed: %v", status)
+	}
+	var attr nfs.FileAttribute
+	if err := xdr.Read(res, &attr); err != nil {
+		t.Fatal(err)
+	}
+	return &attr
+}
+
+func (c *Conn) create(t *testing.T, dir []byte, name string) []byte {
+	t.Helper()
+	res, status := c.Call(nfs.NFSProcedureCreate, dir, name, uint32(0), Sattr{})
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("CREATE of %s failed: %v", name, status)
+	}
+	return c.postOpHandle(t, res)
+}
+
+// checkWccData checks that the wcc data of a change to a directory and to a
+// file describe the object before and after it.
+func checkWccData(t *testing.T, c *Conn, dir []byte) {
+	before := c.getattr(t, dir)
+	res, status := c.Call(nfs.NFSProcedureCreate, dir, "file", uint32(0), Sattr{})
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("CREATE failed: %v", status)
+	}
+	fh := c.postOpHandle(t, res)
+	readPostOpAttr(t, res)
+	pre, post := readWcc(t, res)
+	if pre == nil || post == nil {
+		t.Fatal("expected CREATE to return the wcc data of the directory")
+	}
+	if *pre != *before.AsCache() {
+		t.Fatalf("expected the pre-operation attributes to match the directory before CREATE: %+v and %+v", pre, before.AsCache())
+	}
+	if post.Fileid != before.Fileid {
+		t.Fatal("expected the post-operation attributes to be of the directory")
+	}
+
+	res, status = c.Call(nfs.NFSProcedureWrite, fh, uint64(0), uint32(5), uint32(2), []byte("hello"))
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("WRITE failed: %v", status)
+	}
+	pre, post = readWcc(t, res)
+	if pre == nil || post == nil {
+		t.Fatal("expected WRITE to return the wcc data of the file")
+	}
+	if pre.Filesize != 0 || post.Filesize != 5 {
+		t.Fatalf("expected the file to grow from 0 to 5 bytes, got %d to %d", pre.Filesize, post.Filesize)
+	}
+	if count, _ := xdr.ReadUint32(res); count != 5 {
+		t.Fatalf("expected 5 bytes to be written, got %d", count)
+	}
+}
+
+// checkErrorCodes checks the errors of common failures.
+func checkErrorCodes(t *testing.T, c *Conn, dir []byte) {
+	file := c.create(t, dir, "file")
+	if res, status := c.Call(nfs.NFSProcedureMkDir, dir, "sub", Sattr{}); status != nfs.NFSStatusOk {
+		t.Fatalf("MKDIR failed: %v", status)
+	} else {
+		sub := c.postOpHandle(t, res)
+		c.create(t, sub, "child")
+	}
+
+	cases := []struct {
+		name string
+		proc nfs.NFSProcedure
+		args []interface{}
+		want []nfs.NFSStatus
+	}{
+		{"lookup of a missing name", nfs.NFSProcedureLookup, []interface{}{dir, "missing"}, []nfs.NFSStatus{nfs.NFSStatusNoEnt}},
+		{"lookup in a file", nfs.NFSProcedureLookup, []interface{}{file, "child"}, []nfs.NFSStatus{nfs.NFSStatusNotDir}},
+		{"mkdir of an existing name", nfs.NFSProcedureMkDir, []interface{}{dir, "file", Sattr{}}, []nfs.NFSStatus{nfs.NFSStatusExist}},
+		{"remove of a missing name", nfs.NFSProcedureRemove, []interface{}{dir, "missing"}, []nfs.NFSStatus{nfs.NFSStatusNoEnt}},
+		{"rmdir of a non-empty directory", nfs.NFSProcedureRmDir, []interface{}{dir, "sub"}, []nfs.NFSStatus{nfs.NFSStatusNotEmpty, nfs.NFSStatusExist}},
+		{"rmdir of a file", nfs.NFSProcedureRmDir, []interface{}{dir, "file"}, []nfs.NFSStatus{nfs.NFSStatusNotDir}},
+		{"getattr of an invalid handle", nfs.NFSProcedureGetAttr, []interface{}{[]byte("not a handle")}, []nfs.NFSStatus{nfs.NFSStatusBadHandle, nfs.NFSStatusStale}},
+	}
+	for _, tc := range cases {
+		_, status := c.Call(tc.proc, tc.args...)
+		ok := false
+		for _, want := range tc.want {
+			ok = ok || status == want
+		}
+		if !ok {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, status)
+		}
+	}
+}
+
+type readDirPage struct {
+	verifier [8]byte
+	names    []string
+	cookie   uint64
+	eof      bool
+}
+
+func (c *Conn) readDir(t *testing.T, dir []byte, cookie uint64, verifier [8]byte, count uint32) (*readDirPage, nfs.NFSStatus) {
+	t.Helper()
+	res, status := c.Call(nfs.NFSProcedureReadDir, dir, cookie, verifier, count)
+	if status != nfs.NFSStatusOk {
+		return nil, status
+	}
+	readPostOpAttr(t, res)
+	page := &readDirPage{cookie: cookie}
+	if _, err := io.ReadFull(res, page.verifier[:]); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		follows, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if follows == 0 {
+			break
+		}
+		var entry struct {
+			Fileid uint64
+			Name   string
+			Cookie uint64
+		}
+		if err := xdr.Read(res, &entry); err != nil {
+			t.Fatal(err)
+		}
+		page.names = append(page.names, entry.Name)
+		page.cookie = entry.Cookie
+	}
+	eof, _ := xdr.ReadUint32(res)
+	page.eof = eof != 0
+	return page, nfs.NFSStatusOk
+}
+
+// checkReadDirCookies checks that READDIR pages through a directory by its
+// cookies, listing each entry once, and that a listing continued after the
+// directory changes either still succeeds or is refused with BAD_COOKIE.
+func checkReadDirCookies(t *testing.T, c *Conn, dir []byte) {
+	want := make(map[string]bool)
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("entry-%02d", i)
+		c.create(t, dir, name)
+		want[name] = true
+	}
+
+	seen := make(map[string]bool)
+	var first *readDirPage
+	cookie, verifier := uint64(0), [8]byte{}
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("expected READDIR to reach the end of the directory")
+		}
+		page, status := c.readDir(t, dir, cookie, verifier, 1024)
+		if status != nfs.NFSStatusOk {
+			t.Fatalf("READDIR failed: %v", status)
+		}
+		if first == nil {
+			first = page
+		}
+		for _, name := range page.names {
+			if name == "." || name == ".." {
+				continue
+			}
+			if seen[name] {
+				t.Fatalf("expected %s to be listed once", name)
+			}
+			seen[name] = true
+		}
+		if page.eof {
+			break
+		}
+		if len(page.names) == 0 {
+			t.Fatal("expected a page which isn't the last to list entries")
+		}
+		cookie, verifier = page.cookie, page.verifier
+	}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("expected the listing to hold the directory's %d entries, got %d", len(want), len(seen))
+	}
+	if first.eof {
+		t.Fatal("expected the listing to take more than one page")
+	}
+
+	c.create(t, dir, "added")
+	if _, status := c.readDir(t, dir, first.cookie, first.verifier, 1024); status != nfs.NFSStatusOk && status != nfs.NFSStatusBadCookie {
+		t.Fatalf("expected a continued listing of a changed directory to succeed or fail with BAD_COOKIE, got %v", status)
+	}
+}
+
+// checkExclusiveCreate checks that an exclusive CREATE retransmitted with its
+// verifier succeeds again, and that one with another verifier fails as the
+// file exists. Handlers that don't support exclusive creates are skipped.
+func checkExclusiveCreate(t *testing.T, c *Conn, dir []byte) {
+	verifier := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	res, status := c.Call(nfs.NFSProcedureCreate, dir, "exclusive", uint32(2), verifier)
+	if status == nfs.NFSStatusNotSupp {
+		t.Skip("exclusive create is not supported")
+	}
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("exclusive CREATE failed: %v", status)
+	}
+	fh := c.postOpHandle(t, res)
+
+	res, status = c.Call(nfs.NFSProcedureCreate, dir, "exclusive", uint32(2), verifier)
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("expected a retransmitted exclusive CREATE to succeed, got %v", status)
+	}
+	if again := c.postOpHandle(t, res); !bytes.Equal(again, fh) {
+		t.Fatal("expected a retransmitted exclusive CREATE to return the same file")
+	}
+
+	if _, status := c.Call(nfs.NFSProcedureCreate, dir, "exclusive", uint32(2), [8]byte{8, 7, 6, 5, 4, 3, 2, 1}); status != nfs.NFSStatusExist {
+		t.Fatalf("expected an exclusive CREATE with another verifier to fail with EXIST, got %v", status)
+	}
+}
@@ -0,0 +1,17 @@
+package conformance_test
+
+import (
+	"testing"
+
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest/conformance"
+)
+
+func TestMemfs(t *testing.T) {
+	mem := memfs.New()
+	if err := mem.MkdirAll("/", 0777); err != nil {
+		t.Fatal(err)
+	}
+	conformance.Run(t, helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024))
+}
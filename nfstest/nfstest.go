@@ -0,0 +1,168 @@
+// Package nfstest runs an nfs.Handler on a loopback listener and provides a
+// client mounted against it, for use in tests and benchmarks.
+package nfstest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// Server is an NFS server listening on a local port.
+type Server struct {
+	*nfs.Server
+	listener  net.Listener
+	done      chan error
+	startOnce sync.Once
+	started   bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Start serves srv on an ephemeral loopback port for the test t, which fails
+// if it can't, and closes it when the test ends.
+func Start(t testing.TB, srv *nfs.Server) *Server {
+	t.Helper()
+	s, err := NewUnstartedServer(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// Serve serves handler for the test t, as Start does.
+func Serve(t testing.TB, handler nfs.Handler) *Server {
+	t.Helper()
+	return Start(t, &nfs.Server{Handler: handler})
+}
+
+// ServeCached serves handler behind a CachingHandler of 1024 handles, as
+// handlers giving no handles of their own are served, for the test t.
+func ServeCached(t testing.TB, handler nfs.Handler) *Server {
+	t.Helper()
+	return Serve(t, helpers.NewCachingHandler(handler, 1024))
+}
+
+// ServeFS serves fs to every client through a NullAuthHandler, behind a
+// CachingHandler, for the test t.
+func ServeFS(t testing.TB, fs billy.Filesystem) *Server {
+	t.Helper()
+	return ServeCached(t, helpers.NewNullAuthHandler(fs))
+}
+
+// Mount mounts dirpath of the server with auth for the test t, which fails if
+// it can't, and unmounts it when the test ends.
+func (s *Server) Mount(t testing.TB, dirpath string, auth rpc.Auth) *Client {
+	t.Helper()
+	c, err := Dial(s.Addr(), dirpath, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// NewServer starts serving handler on an ephemeral loopback port.
+func NewServer(handler nfs.Handler) (*Server, error) {
+	s, err := NewUnstartedServer(&nfs.Server{Handler: handler})
+	if err != nil {
+		return nil, err
+	}
+	s.Start()
+	return s, nil
+}
+
+// NewUnstartedServer opens an ephemeral loopback port for srv without serving
+// it, so that its options can be configured knowing the address it will be
+// served on. Start serves it.
+func NewUnstartedServer(srv *nfs.Server) (*Server, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		Server:   srv,
+		listener: l,
+		done:     make(chan error, 1),
+	}, nil
+}
+
+// Start serves the server on its port. Connections made before are accepted
+// once it is started.
+func (s *Server) Start() {
+	s.startOnce.Do(func() {
+		s.started = true
+		go func() {
+			s.done <- s.Server.Serve(s.listener)
+		}()
+	})
+}
+
+// Addr is the host:port the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting new connections and waits for the accept loop to
+// exit, if the server was started. Closing it again does nothing.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		s.startOnce.Do(func() {})
+		s.closeErr = s.listener.Close()
+		if s.started {
+			<-s.done
+		}
+	})
+	return s.closeErr
+}
+
+// Client is an rpc connection with a mounted export.
+type Client struct {
+	*nfsc.Target
+	mount     nfsc.Mount
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Dial connects to addr and mounts dirpath using auth.
+func Dial(addr string, dirpath string, auth rpc.Auth) (*Client, error) {
+	c, err := rpc.DialTCP("tcp", addr, false)
+	// the client binds a random local port, which may be taken, and only
+	// picks another for privileged ports.
+	for attempt := 0; errors.Is(err, syscall.EADDRINUSE) && attempt < 10; attempt++ {
+		c, err = rpc.DialTCP("tcp", addr, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cl := &Client{}
+	cl.mount.Client = c
+	target, err := cl.mount.Mount(dirpath, auth)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	cl.Target = target
+	return cl, nil
+}
+
+// Close unmounts the export and closes the connection. Closing it again does
+// nothing.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.mount.Unmount()
+		c.mount.Client.Close()
+	})
+	return c.closeErr
+}
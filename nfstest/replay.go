@@ -0,0 +1,77 @@
+package nfstest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+)
+
+// Replay sends the calls of a trace written by an nfs.TraceRecorder to the
+// server at addr, in order and over one connection, and returns the replies
+// it receives. Truncated calls can't be replayed and are skipped.
+func Replay(addr string, trace io.Reader) ([]nfs.TraceRecord, error) {
+	records, err := nfs.ReadTrace(trace)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	var replies []nfs.TraceRecord
+	for _, call := range records {
+		if call.Reply || call.Truncated() {
+			continue
+		}
+		frame := make([]byte, 4, 4+len(call.Data))
+		binary.BigEndian.PutUint32(frame, uint32(len(call.Data))|1<<31)
+		if _, err := c.Write(append(frame, call.Data...)); err != nil {
+			return replies, err
+		}
+		data, err := readRecord(r)
+		if err != nil {
+			return replies, err
+		}
+		reply := call
+		reply.Time = time.Now()
+		reply.Reply = true
+		reply.Length, reply.Data = len(data), data
+		if len(data) >= 4 {
+			reply.Xid = binary.BigEndian.Uint32(data)
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// readRecord reads an RPC record, joining its fragments.
+func readRecord(r io.Reader) ([]byte, error) {
+	var record []byte
+	for {
+		var mark [4]byte
+		if _, err := io.ReadFull(r, mark[:]); err != nil {
+			return nil, err
+		}
+		fragment := binary.BigEndian.Uint32(mark[:])
+		size := int(fragment &^ (1 << 31))
+		if len(record)+size > 1<<24 {
+			return nil, errors.New("reply too large")
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		record = append(record, buf...)
+		if fragment&(1<<31) != 0 {
+			return record, nil
+		}
+	}
+}
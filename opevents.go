@@ -0,0 +1,180 @@
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// OperationType classifies the changes to exports published to a
+// Subscription.
+type OperationType int
+
+// Operation types
+const (
+	// OperationCreated is published when a CREATE, MKDIR, SYMLINK, MKNOD or
+	// LINK makes an entry.
+	OperationCreated OperationType = iota + 1
+	// OperationWritten is published when a WRITE changes the data of a file.
+	OperationWritten
+	// OperationChanged is published when a SETATTR changes the attributes,
+	// or the size, of an object.
+	OperationChanged
+	// OperationRemoved is published when a REMOVE or RMDIR removes an entry.
+	OperationRemoved
+	// OperationRenamed is published when a RENAME moves an entry.
+	OperationRenamed
+)
+
+func (t OperationType) String() string {
+	switch t {
+	case OperationCreated:
+		return "created"
+	case OperationWritten:
+		return "written"
+	case OperationChanged:
+		return "changed"
+	case OperationRemoved:
+		return "removed"
+	case OperationRenamed:
+		return "renamed"
+	default:
+		return fmt.Sprintf("operation(%d)", int(t))
+	}
+}
+
+// OperationEvent is a change made to an export by a client.
+type OperationEvent struct {
+	Type      OperationType
+	Time      time.Time
+	Procedure NFSProcedure
+	// RequestID is the ID of the call which made the change.
+	RequestID string
+	// Filesystem is the export the change was made to, and Path the object
+	// changed, or the entry made, removed or moved from. To is the path an
+	// entry was renamed to.
+	Filesystem billy.Filesystem
+	Path       []string
+	To         []string
+	// Client is the address the call was made from, Flavor its
+	// authentication flavor, and Credentials its AUTH_SYS identity after
+	// squashing, when it had one.
+	Client      net.Addr
+	Flavor      AuthFlavor
+	Credentials *AuthUnix
+}
+
+// Subscription delivers the changes made to an export, or every export, by
+// the calls of clients once they succeed. Changes made other than through
+// NFS, and by NFSv4 calls, aren't seen.
+type Subscription struct {
+	// C receives the events of the subscription. Events are dropped rather
+	// than wait for a full channel, so that a slow subscriber can't hold up
+	// calls, and are then counted by Dropped.
+	C <-chan OperationEvent
+
+	c       chan OperationEvent
+	server  *Server
+	fs      billy.Filesystem
+	dropped uint64
+	once    sync.Once
+}
+
+// Subscribe subscribes to the changes made to the export fs, the filesystem
+// its handler mounts, or to every export when fs is nil. Up to buffer events
+// are held for the subscriber to receive. Close ends the subscription.
+func (s *Server) Subscribe(fs billy.Filesystem, buffer int) *Subscription {
+	c := make(chan OperationEvent, buffer)
+	sub := &Subscription{C: c, c: c, server: s, fs: fs}
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[*Subscription]struct{})
+	}
+	s.subs[sub] = struct{}{}
+	return sub
+}
+
+// Dropped counts the events dropped for a full channel.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Close ends the subscription, and closes its channel.
+func (sub *Subscription) Close() {
+	sub.once.Do(func() {
+		s := sub.server
+		s.subsMu.Lock()
+		delete(s.subs, sub)
+		close(sub.c)
+		s.subsMu.Unlock()
+	})
+}
+
+// operationType provides the type of the change a successful call of proc
+// makes, or zero if it makes none.
+func operationType(proc NFSProcedure) OperationType {
+	switch proc {
+	case NFSProcedureCreate, NFSProcedureMkDir, NFSProcedureSymlink, NFSProcedureMkNod, NFSProcedureLink:
+		return OperationCreated
+	case NFSProcedureWrite:
+		return OperationWritten
+	case NFSProcedureSetAttr:
+		return OperationChanged
+	case NFSProcedureRemove, NFSProcedureRmDir:
+		return OperationRemoved
+	case NFSProcedureRename:
+		return OperationRenamed
+	}
+	return 0
+}
+
+// publishOperation publishes the change made by a successful call to the
+// subscriptions of its export.
+func (c *conn) publishOperation(ctx context.Context, w *response) {
+	if w.op == nil {
+		return
+	}
+	t := operationType(w.op.Procedure)
+	if t == 0 {
+		return
+	}
+	s := c.Server
+	s.subsMu.RLock()
+	defer s.subsMu.RUnlock()
+	if len(s.subs) == 0 {
+		return
+	}
+	e := OperationEvent{
+		Type:       t,
+		Time:       time.Now(),
+		Procedure:  w.op.Procedure,
+		RequestID:  w.req.id,
+		Filesystem: w.op.Filesystem,
+		Path:       w.op.Path,
+		Client:     c.Conn.RemoteAddr(),
+		Flavor:     AuthFlavor(w.req.Header.Cred.Flavor),
+	}
+	if t == OperationRenamed {
+		e.To = w.op.To
+	} else if w.op.Procedure == NFSProcedureLink {
+		// the entry made is the new name of the file linked.
+		e.Path = w.op.To
+	}
+	e.Credentials, _ = CredentialsFromContext(ctx)
+	for sub := range s.subs {
+		if sub.fs != nil && !sameFilesystem(sub.fs, e.Filesystem) {
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package nfs_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestSubscribe(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/dir", 0755)
+	srv := &nfs.Server{Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)}
+	sub := srv.Subscribe(mem, 16)
+	defer sub.Close()
+	other := srv.Subscribe(memfs.New(), 16)
+	defer other.Close()
+	ts := nfstest.Start(t, srv)
+	target := ts.Mount(t, "/", rpc.NewAuthUnix("client", 1000, 1000).Auth())
+
+	if _, err := target.Create("/a", 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := target.OpenFile("/a", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Rename("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Remove("/b"); err != nil {
+		t.Fatal(err)
+	}
+	// a failed call changes nothing.
+	if err := target.Remove("/b"); err == nil {
+		t.Fatal("expected the removal of a missing file to fail")
+	}
+
+	var got []string
+	for len(sub.C) > 0 {
+		e := <-sub.C
+		if e.Credentials == nil || e.Credentials.UID != 1000 || e.Client == nil {
+			t.Fatalf("expected the event to carry the identity of the client, got %+v", e)
+		}
+		s := e.Type.String() + " " + strings.Join(e.Path, "/")
+		if e.To != nil {
+			s += " " + strings.Join(e.To, "/")
+		}
+		got = append(got, s)
+	}
+	want := []string{"created a", "written a", "renamed a b", "removed b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events %v, got %v", want, got)
+	}
+	if len(other.C) != 0 {
+		t.Fatal("expected no events for a subscription to another export")
+	}
+}
@@ -0,0 +1,124 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// The portmap program, version 2, per rfc1833 section 3. Clients ask it for
+// the ports of the NFS and MOUNT programs unless they're given them as mount
+// options. The rpcbind versions 3 and 4 are refused with PROG_MISMATCH, which
+// clients answer by falling back to version 2.
+const (
+	portmapServiceID = 100000
+	portmapVersion   = 2
+
+	portmapProcNull    = 0
+	portmapProcSet     = 1
+	portmapProcUnset   = 2
+	portmapProcGetPort = 3
+	portmapProcDump    = 4
+
+	ipProtoTCP = 6
+)
+
+func init() {
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcNull, onPortmapNull)
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcSet, onPortmapSet)
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcUnset, onPortmapSet)
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcGetPort, onPortmapGetPort)
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcDump, onPortmapDump)
+}
+
+// portmapping is a program served over TCP, as told to portmap clients.
+type portmapping struct {
+	Prog uint32
+	Vers uint32
+	Prot uint32
+	Port uint32
+}
+
+// port is the port the NFS and MOUNT programs are served on, as advertised by
+// portmap and MountOptions.
+func (s *Server) port(local net.Addr) uint32 {
+	if s.AdvertisedPort != 0 {
+		return uint32(s.AdvertisedPort)
+	}
+	if a, ok := local.(*net.TCPAddr); ok {
+		return uint32(a.Port)
+	}
+	return 0
+}
+
+// portmappings are the programs of the server.
+func (s *Server) portmappings(local net.Addr) []portmapping {
+	port := s.port(local)
+	maps := []portmapping{
+		{portmapServiceID, portmapVersion, ipProtoTCP, port},
+		{mountServiceID, mountVersion1, ipProtoTCP, port},
+		{mountServiceID, mountVersion1 + 1, ipProtoTCP, port},
+		{mountServiceID, mountVersion, ipProtoTCP, port},
+		{nfsServiceID, nfs3Version, ipProtoTCP, port},
+	}
+	if s.EnableNFSv4 {
+		maps = append(maps, portmapping{nfsServiceID, nfs4Version, ipProtoTCP, port})
+	}
+	return maps
+}
+
+// MountOptions are the options Linux clients mount the exports of the server
+// with, when it is listening on addr, so that they need not find its ports
+// through portmap, nor have it serve NLM for locking.
+func (s *Server) MountOptions(addr net.Addr) string {
+	port := s.port(addr)
+	return fmt.Sprintf("nfsvers=3,proto=tcp,port=%d,mountport=%d,mountproto=tcp,nolock", port, port)
+}
+
+func onPortmapNull(ctx context.Context, w *response, userHandle Handler) error {
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+// onPortmapSet refuses to register programs: only those of the server are
+// mapped.
+func onPortmapSet(ctx context.Context, w *response, userHandle Handler) error {
+	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+		return err
+	}
+	return w.Write([]byte{0, 0, 0, 0})
+}
+
+func onPortmapGetPort(ctx context.Context, w *response, userHandle Handler) error {
+	var req portmapping
+	if err := readArgs(w.req.Body, &req); err != nil {
+		return err
+	}
+	port := uint32(0)
+	for _, m := range w.Server.portmappings(w.conn.LocalAddr()) {
+		if m.Prog == req.Prog && m.Vers == req.Vers && m.Prot == req.Prot {
+			port = m.Port
+		}
+	}
+	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+		return err
+	}
+	writer := bytes.NewBuffer([]byte{})
+	_ = xdr.Write(writer, port)
+	return w.Write(writer.Bytes())
+}
+
+func onPortmapDump(ctx context.Context, w *response, userHandle Handler) error {
+	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
+		return err
+	}
+	writer := bytes.NewBuffer([]byte{})
+	for _, m := range w.Server.portmappings(w.conn.LocalAddr()) {
+		_ = xdr.Write(writer, uint32(1))
+		_ = xdr.Write(writer, &m)
+	}
+	_ = xdr.Write(writer, uint32(0))
+	return w.Write(writer.Bytes())
+}
@@ -0,0 +1,60 @@
+package nfs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestPortmap(t *testing.T) {
+	srv, _ := fuzzServer(t)
+	getPort := func(prog, vers uint32) (uint32, uint32) {
+		var args bytes.Buffer
+		for _, v := range []uint32{prog, vers, 6, 0} {
+			_ = xdr.Write(&args, v)
+		}
+		reply, err := srv.HandleMessage(context.Background(), callMessage(100000, 2, 3, args.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// xid, reply, accepted, an empty verifier and the accept status.
+		stat := binary.BigEndian.Uint32(reply[20:])
+		if stat != 0 || len(reply) < 28 {
+			return stat, 0
+		}
+		return stat, binary.BigEndian.Uint32(reply[24:])
+	}
+
+	if stat, _ := getPort(nfsc.Nfs3Prog, 3); stat == 0 {
+		t.Fatal("expected portmap to be unavailable unless enabled")
+	}
+	srv.EnablePortmap = true
+	if _, port := getPort(nfsc.Nfs3Prog, 3); port != 2049 {
+		t.Fatalf("expected NFSv3 on the port of the listener, got %d", port)
+	}
+	srv.AdvertisedPort = 20490
+	if _, port := getPort(nfsc.MountProg, 3); port != 20490 {
+		t.Fatalf("expected MOUNT on the advertised port, got %d", port)
+	}
+	if _, port := getPort(nfsc.Nfs3Prog, 2); port != 0 {
+		t.Fatalf("expected NFSv2 to be unregistered, got %d", port)
+	}
+	if opts := srv.MountOptions(nil); !strings.Contains(opts, "port=20490,mountport=20490") {
+		t.Fatalf("unexpected mount options %q", opts)
+	}
+
+	reply, err := srv.HandleMessage(context.Background(), callMessage(100000, 4, 3, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := binary.BigEndian.Uint32(reply[20:]); stat != uint32(nfs.ResponseCodeProgMismatch) {
+		t.Fatalf("expected rpcbind v4 to be refused with PROG_MISMATCH, got %d", stat)
+	}
+}
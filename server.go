@@ -1,19 +1,176 @@
 package nfs
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
 	"errors"
 	"net"
+	"sync"
 	"time"
 )
 
 // Server is a handle to the listening NFS server.
 type Server struct {
 	Handler
+	// ID is the write verifier returned from WRITE and COMMIT. Clients resend
+	// any UNSTABLE writes they haven't committed when it changes, so it must
+	// differ across restarts that may have lost such data. A random ID is
+	// chosen when left unset. Once serving, it is read and changed through
+	// WriteVerifier, SetWriteVerifier and RotateWriteVerifier.
 	ID [8]byte
 	context.Context
+
+	// MaxInFlightBytes bounds the total size of requests being processed
+	// across all connections. Once reached, the server stops reading from
+	// client sockets until earlier requests complete, so that many clients
+	// writing at once cannot exhaust memory. Zero means no limit.
+	MaxInFlightBytes int64
+
+	// SocketOptions tune each accepted connection.
+	SocketOptions SocketOptions
+
+	// AbuseOptions throttle and ban clients making malformed or refused
+	// calls. Clients are not tracked unless a threshold is set.
+	AbuseOptions AbuseOptions
+
+	// Events, when set, receives the security relevant events of the
+	// server, such as mounts and refused calls.
+	Events EventSubscriber
+
+	// EnableNFSv4 dispatches calls to version 4 of the NFS program, which is
+	// incomplete: only the operations registered with the COMPOUND framework
+	// are served. When unset, such calls are refused with PROG_MISMATCH so
+	// that clients fall back to version 3.
+	EnableNFSv4 bool
+	// NFS4LeaseTime is the lease of NFSv4 clients, after which a client which
+	// hasn't renewed loses its state. DefaultNFS4LeaseTime is used when zero.
+	NFS4LeaseTime time.Duration
+	// NFS4StateStore, when set, records NFSv4 clients so that they may
+	// reclaim their state after a restart.
+	NFS4StateStore NFS4StateStore
+	// NFS4BootVerifier is the boot verifier carried by NFSv4 clientids and
+	// stateids, which tells those issued before a restart apart. A random
+	// one is chosen when zero; servers taking over from each other with
+	// their state may share one instead.
+	NFS4BootVerifier uint32
+	// NFS4GracePeriod is how long after starting the clients recorded in
+	// NFS4StateStore have to reclaim their opens and locks, during which no
+	// other state is granted, so that none conflicts with what is reclaimed.
+	// The lease time is used when zero. There is no grace period when no
+	// client was recorded.
+	NFS4GracePeriod time.Duration
+	// NFS4Delegations offers delegations of the files NFSv4 clients OPEN to
+	// those whose callback path answers, letting a client that alone uses a
+	// file cache it. A delegation is recalled before a call of any other
+	// client, over NFSv3 or NFSv4, that conflicts with it, which fails with
+	// NFS3ERR_JUKEBOX or NFS4ERR_DELAY until the delegation is returned, or
+	// revoked after a lease.
+	NFS4Delegations bool
+
+	// Authorize, when set, is consulted before each NFS call is dispatched
+	// and may refuse it. Calls whose arguments don't resolve to an object are
+	// left for the procedure to fail.
+	Authorize AuthorizeFunc
+
+	// Trace, when set, records every call the server decodes and its reply,
+	// for diagnosing interoperability problems after the fact.
+	Trace *TraceRecorder
+
+	// OnError, when set, is called with the error of each call that fails,
+	// such as to report it to an error tracker. Its context carries the
+	// request ID of the call, which its logs, trace records and events also
+	// carry, so that a failing call can be followed across them.
+	OnError func(ctx context.Context, err error)
+
+	// EnablePortmap answers calls to the portmap program on every listener of
+	// the server, so that clients can find the NFS and MOUNT programs when
+	// the server runs without privileges, on ports other than 2049. Clients
+	// given MountOptions don't need it.
+	EnablePortmap bool
+	// AdvertisedPort is the port of the NFS and MOUNT programs given by
+	// portmap and MountOptions, for a server reached through a forwarded port
+	// or a listener of its own for portmap. When zero, it is the local port of
+	// the listener.
+	AdvertisedPort int
+
+	// OperationTimeout, when set, bounds the time an NFSv3 procedure may run.
+	// Once it passes, the context of the procedure is cancelled and the call
+	// fails with NFS3ERR_JUKEBOX, which clients retry, rather than a hung
+	// backend wedging the connection. The procedure is left to return in the
+	// background, as calls to billy filesystems can't be interrupted.
+	// OperationTimeouts sets the timeout of specific procedures instead, such
+	// as a longer one for COMMIT; a zero timeout there disables it.
+	OperationTimeout  time.Duration
+	OperationTimeouts map[NFSProcedure]time.Duration
+
+	// SlowOperationThreshold, when set, logs each call taking at least so
+	// long as a warning, with its procedure, path and client, and how its
+	// time split between reading and decoding it, running its procedure,
+	// which is mostly the time of the backend, and encoding and sending its
+	// reply, so that pathological paths can be found without debug logging.
+	SlowOperationThreshold time.Duration
+
+	// EnableClientStats counts the calls, errors and bytes of each client
+	// address, as provided by ClientStats, for finding noisy clients. The
+	// counts of a client are kept for as long as the server runs.
+	EnableClientStats bool
+
+	// StableDirCookies has READDIR and READDIRPLUS continue listings from
+	// the name of the entry a cookie was given for, rather than from its
+	// position in the listing. Listings continued after entries are added or
+	// removed then neither repeat nor skip the rest, where otherwise they
+	// are refused with NFS3ERR_BAD_COOKIE for clients to list the directory
+	// afresh. Directories are read in full and sorted by name for each page
+	// either way, so the order backends list entries in doesn't matter.
+	// Listings of a ListingFilesystem or PagedFilesystem always continue so.
+	StableDirCookies bool
+
+	// IDMapper, when set, maps the identities clients assert to those calls
+	// are served as, and ids to and from names, in place of a
+	// NumericIDMapper.
+	IDMapper IDMapper
+	// MapClientCertificates serves the calls of clients which presented a
+	// verified TLS client certificate as the identity of the certificate,
+	// whatever AUTH_SYS credentials they send, so that files they create
+	// are owned correctly. The identity is given by the MapCertificate of
+	// an IDMapper which is a CertificateMapper or, otherwise, is the uid and
+	// gid the IDMapper gives the name of the certificate, its common name or
+	// else its first email or DNS subject alternative name. Calls of
+	// certificates which can't be mapped are refused with AUTH_BADCRED.
+	MapClientCertificates bool
+	// GroupResolver, when set, provides the supplementary groups calls are
+	// served with and permissions are checked against, in place of those
+	// clients assert.
+	GroupResolver GroupResolver
+
+	// HealthOptions configure the checks of Healthy.
+	HealthOptions HealthOptions
+
+	// MountStore, when set, keeps the mounts of the server in place of a
+	// table of its own, as for sharing them between the servers of a
+	// cluster.
+	MountStore MountStore
+
+	initOnce  sync.Once
+	inFlight  *byteLimiter
+	abuse     *abuseTracker
+	nfs4State *nfs4StateManager
+
+	fenceMu sync.RWMutex
+	fences  map[string]NFSStatus
+
+	subsMu sync.RWMutex
+	subs   map[*Subscription]struct{}
+
+	verifierMu sync.RWMutex // guards ID once serving.
+
+	mountTable      mountTable
+	clientStats     *clientStatsTracker
+	handleQuotas    *handleQuotas
+	dirCookies      *dirCookies
+	health          *healthTracker
+	attrCache       *attrCache
+	createVerifiers *createVerifiers
+	exports         *exportSet
 }
 
 // RegisterMessageHandler registers a handler for a specific
@@ -50,11 +207,10 @@ func (s *Server) Serve(l net.Listener) error {
 	if s.Context != nil {
 		baseCtx = s.Context
 	}
-	if bytes.Equal(s.ID[:], []byte{0, 0, 0, 0, 0, 0, 0, 0}) {
-		if _, err := rand.Reader.Read(s.ID[:]); err != nil {
-			return err
-		}
-	}
+	s.init()
+	s.health.listening(1)
+	defer s.health.listening(-1)
+	Log.Infof("serving on %s; clients mount with -o %s", l.Addr(), s.MountOptions(l.Addr()))
 
 	var tempDelay time.Duration
 
@@ -76,22 +232,118 @@ func (s *Server) Serve(l net.Listener) error {
 			return err
 		}
 		tempDelay = 0
+		if s.abuse.banned(conn.RemoteAddr()) {
+			_ = conn.Close()
+			continue
+		}
 		c := s.newConn(conn)
 		go c.serve(baseCtx)
 	}
 }
 
+// init sets up the state shared by the connections of the server.
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.initVerifier()
+		s.inFlight = newByteLimiter(s.MaxInFlightBytes)
+		s.abuse = newAbuseTracker(s.AbuseOptions)
+		s.clientStats = newClientStatsTracker(s.EnableClientStats)
+		s.handleQuotas = newHandleQuotas()
+		s.dirCookies = newDirCookies()
+		s.health = newHealthTracker(s.HealthOptions)
+		s.attrCache = newAttrCache()
+		s.createVerifiers = newCreateVerifiers()
+		s.exports = newExportSet(s)
+		if s.EnableNFSv4 {
+			s.nfs4State = newNFS4StateManager(s.NFS4StateStore, s.NFS4LeaseTime, s.NFS4GracePeriod)
+			if s.NFS4BootVerifier != 0 {
+				s.nfs4State.boot = s.NFS4BootVerifier
+			}
+			s.nfs4State.delegations = s.NFS4Delegations
+		}
+	})
+}
+
+// SocketOptions configure the transport of accepted connections.
+type SocketOptions struct {
+	// DisableNoDelay clears TCP_NODELAY, which Go sets by default, letting
+	// the kernel coalesce small replies at the cost of latency.
+	DisableNoDelay bool
+	// ReadBuffer and WriteBuffer set SO_RCVBUF and SO_SNDBUF when non-zero.
+	ReadBuffer  int
+	WriteBuffer int
+	// BatchWrites defers flushing a reply while further replies for the
+	// same connection are queued, so that they leave in a single write.
+	BatchWrites bool
+}
+
+// apply sets the socket level options on a connection. Connections which
+// are not backed by TCP are left untouched.
+func (o *SocketOptions) apply(nc net.Conn) error {
+	// unwrap connections such as tls.Conn to reach the socket.
+	for {
+		inner, ok := nc.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		nc = inner.NetConn()
+	}
+	tc, ok := nc.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.DisableNoDelay {
+		if err := tc.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Server) newConn(nc net.Conn) *conn {
+	if err := s.SocketOptions.apply(nc); err != nil {
+		Log.Warnf("failed to set socket options for %v: %v", nc.RemoteAddr(), err)
+	}
 	c := &conn{
 		Server: s,
 		Conn:   nc,
+		id:     connIDs.Add(1),
 	}
 	return c
 }
 
+// servesNFSVersion reports whether calls to version vers of the NFS program
+// are dispatched.
+func (s *Server) servesNFSVersion(vers uint32) bool {
+	return vers == nfs3Version || (vers == nfs4Version && s.EnableNFSv4)
+}
+
+func (s *Server) maxNFSVersion() uint32 {
+	if s.EnableNFSv4 {
+		return nfs4Version
+	}
+	return nfs3Version
+}
+
 // TODO: keep an immutable map for each server instance to have less
 // chance of races.
-func (s *Server) handlerFor(prog uint32, proc uint32) HandleFunc {
+func (s *Server) handlerFor(prog uint32, vers uint32, proc uint32) HandleFunc {
+	if prog == nfsServiceID && vers == nfs4Version {
+		return nfs4Handlers[proc]
+	}
+	if prog == portmapServiceID && !s.EnablePortmap {
+		return nil
+	}
 	for k, v := range registeredHandlers {
 		if k.protocol == prog && k.proc == proc {
 			return v
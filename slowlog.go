@@ -0,0 +1,43 @@
+package nfs
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// logSlow logs a call which took SlowOperationThreshold or longer, from when
+// it was read until its reply was handed to the connection: the time before
+// it was dispatched, reading, queueing and decoding it, the time its
+// procedure ran, most of which is spent in the backend, and the time taken to
+// encode and send the reply.
+func (c *conn) logSlow(w *response) {
+	threshold := c.Server.SlowOperationThreshold
+	if threshold <= 0 {
+		return
+	}
+	total := time.Since(w.start)
+	if total < threshold {
+		return
+	}
+	queued, backend := total, time.Duration(0)
+	if !w.dispatched.IsZero() {
+		queued = w.dispatched.Sub(w.start)
+		backend = w.returned.Sub(w.dispatched)
+	}
+	p := ""
+	if w.mount != nil {
+		p = string(w.mount.Dirpath)
+	} else if w.op != nil {
+		p = "/" + path.Join(w.op.Path...)
+	}
+	client := c.Conn.RemoteAddr().String()
+	if w.req.Header.Cred.Flavor == uint32(AuthFlavorUnix) {
+		// as asserted, as the identity the call was served as isn't kept.
+		if cred, err := parseAuthUnix(w.req.Header.Cred.Body); err == nil {
+			client = fmt.Sprintf("%s (uid %d)", client, cred.UID)
+		}
+	}
+	Log.Warnf("slow %v of %q by %s: %v in total, %v before dispatch, %v in the procedure, %v encoding and sending the reply; err: %v",
+		w.req, p, client, total, queued, backend, total-queued-backend, w.err)
+}
@@ -0,0 +1,69 @@
+package nfs_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// warningLogger records the warnings logged, passing on everything else.
+type warningLogger struct {
+	nfs.Logger
+	mu       sync.Mutex
+	warnings []string
+}
+
+func (l *warningLogger) Warnf(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *warningLogger) matching(s string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []string
+	for _, w := range l.warnings {
+		if strings.Contains(w, s) {
+			found = append(found, w)
+		}
+	}
+	return found
+}
+
+func TestSlowOperationThreshold(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/slow", []byte("x"), 0644)
+	_ = billyutil.WriteFile(mem, "/fast", []byte("x"), 0644)
+	fs := &blockingFS{Filesystem: mem, release: make(chan struct{})}
+	logger := &warningLogger{Logger: nfs.Log}
+	nfs.SetLogger(logger)
+	defer nfs.SetLogger(logger.Logger)
+
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:                helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024),
+		SlowOperationThreshold: 50 * time.Millisecond,
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	if _, _, err := target.Lookup("/fast", false); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(100*time.Millisecond, func() { close(fs.release) })
+	if _, _, err := target.Lookup("/slow", false); err != nil {
+		t.Fatal(err)
+	}
+	if found := logger.matching("slow "); len(found) != 1 || !strings.Contains(found[0], `nfs.Lookup) of "/slow"`) || !strings.Contains(found[0], "in the procedure") {
+		t.Fatalf("expected the slow lookup alone to be logged, got %q", found)
+	}
+}
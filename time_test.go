@@ -0,0 +1,52 @@
+package nfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestTimestampPrecision(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := changeOS{osfs.New(dir), dir}
+	srv := nfstest.ServeFS(t, fs)
+	target := srv.Mount(t, "/", rpc.AuthNull)
+
+	want := nfsc.NFS3Time{Seconds: 1700000000, Nseconds: 123456789}
+	if err := target.Setattr("/a", nfsc.Sattr3{
+		Atime: nfsc.SetTime{SetIt: nfsc.SetToClientTime, Time: want},
+		Mtime: nfsc.SetTime{SetIt: nfsc.SetToClientTime, Time: want},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Nanosecond() != int(want.Nseconds) {
+		// the backing filesystem doesn't store nanoseconds.
+		t.Skipf("filesystem truncated mtime to %v", info.ModTime())
+	}
+
+	attr, _, err := target.Lookup("/a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attr.(*nfsc.Fattr).Mtime; got != want {
+		t.Fatalf("mtime round-tripped as %+v, want %+v", got, want)
+	}
+	if got := attr.(*nfsc.Fattr).Atime; got != want {
+		t.Fatalf("atime round-tripped as %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+package nfs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"path"
+	"strings"
+)
+
+var (
+	errNoClientCert         = errors.New("no verified client certificate")
+	errClientCertNotAllowed = errors.New("client certificate not accepted by the export")
+)
+
+// ClientCertificate provides the certificate the client of conn presented,
+// when conn is a TLS connection, or wraps one, and the certificate was
+// verified against the client CAs of the tls.Config it is served with.
+// Certificates which weren't verified, as with tls.RequireAnyClientCert,
+// aren't provided.
+func ClientCertificate(conn net.Conn) (*x509.Certificate, bool) {
+	for conn != nil {
+		if tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+			state := tc.ConnectionState()
+			if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+				return nil, false
+			}
+			return state.PeerCertificates[0], true
+		}
+		inner, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = inner.NetConn()
+	}
+	return nil, false
+}
+
+// certificateNames provides the names a certificate is matched by: its DNS,
+// email and URI subject alternative names, and its common name.
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// checkClientCert refuses the client of conn when the export requires a
+// verified client certificate it lacks, or one naming none of the patterns
+// of ClientCertNames.
+func (o *ExportOptions) checkClientCert(conn net.Conn) error {
+	if !o.RequireClientCert && len(o.ClientCertNames) == 0 {
+		return nil
+	}
+	cert, ok := ClientCertificate(conn)
+	if !ok {
+		return errNoClientCert
+	}
+	if len(o.ClientCertNames) == 0 {
+		return nil
+	}
+	for _, name := range certificateNames(cert) {
+		name = strings.ToLower(name)
+		for _, pattern := range o.ClientCertNames {
+			if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+				return nil
+			}
+		}
+	}
+	return errClientCertNotAllowed
+}
+
+// certificateName provides the name a client certificate is mapped to an
+// identity by.
+func certificateName(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// certificateCredentials provides the identity the calls of the client of
+// conn are served as by its certificate, when MapClientCertificates is set
+// and it presented a verified one.
+func (s *Server) certificateCredentials(ctx context.Context, conn net.Conn) (*AuthUnix, bool, error) {
+	if !s.MapClientCertificates {
+		return nil, false, nil
+	}
+	cert, ok := ClientCertificate(conn)
+	if !ok {
+		return nil, false, nil
+	}
+	mapper := s.idMapper()
+	if cm, ok := mapper.(CertificateMapper); ok {
+		cred, err := cm.MapCertificate(ctx, cert)
+		if err == nil && cred == nil {
+			err = ErrUnknownID
+		}
+		return cred, err == nil, err
+	}
+	name := certificateName(cert)
+	if name == "" {
+		return nil, false, ErrUnknownID
+	}
+	uid, err := mapper.UID(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+	gid, err := mapper.GID(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+	return &AuthUnix{MachineName: name, UID: uid, GID: gid}, true, nil
+}
@@ -0,0 +1,244 @@
+package nfs_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// testCA issues certificates for tests of TLS.
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{t: t, cert: cert, key: key, pool: pool}
+}
+
+// issue provides a certificate for the DNS name, of a server or a client.
+func (ca *testCA) issue(name string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveTLS serves srv over TLS with a certificate of ca, verifying the
+// certificates clients give against it.
+func serveTLS(t *testing.T, srv *nfs.Server, ca *testCA) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		_ = srv.Serve(tls.NewListener(l, &tls.Config{
+			Certificates: []tls.Certificate{ca.issue("server", x509.ExtKeyUsageServerAuth)},
+			ClientCAs:    ca.pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}))
+	}()
+	return l.Addr().String()
+}
+
+// tlsTunnel forwards the connections made to the address it provides to addr
+// over TLS, as stunnel does for clients, with the client certificates of
+// conf.
+func tlsTunnel(t *testing.T, addr string, conf *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			plain, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer plain.Close()
+				secure, err := tls.Dial("tcp", addr, conf)
+				if err != nil {
+					return
+				}
+				defer secure.Close()
+				go func() { _, _ = io.Copy(secure, plain) }()
+				_, _ = io.Copy(plain, secure)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClientCertNames(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/file", []byte("hello"), 0644)
+	ca := newTestCA(t)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{ClientCertNames: []string{"*.clients.test"}})
+	addr := serveTLS(t, &nfs.Server{Handler: helpers.NewCachingHandler(handler, 1024)}, ca)
+
+	for _, tc := range []struct {
+		name    string
+		certs   []tls.Certificate
+		allowed bool
+	}{
+		{"matching certificate", []tls.Certificate{ca.issue("host.clients.test", x509.ExtKeyUsageClientAuth)}, true},
+		{"other certificate", []tls.Certificate{ca.issue("host.example.test", x509.ExtKeyUsageClientAuth)}, false},
+		{"no certificate", nil, false},
+	} {
+		tunnel := tlsTunnel(t, addr, &tls.Config{RootCAs: ca.pool, ServerName: "server", Certificates: tc.certs})
+		target, err := nfstest.Dial(tunnel, "/", rpc.AuthNull)
+		if !tc.allowed {
+			if err == nil {
+				target.Close()
+				t.Fatalf("%s: expected the mount to be refused", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if _, _, err := target.Lookup("/file", false); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		target.Close()
+	}
+
+	// calls over connections without TLS are refused too.
+	plain := nfstest.ServeCached(t, helpers.NewExportHandler(helpers.NewNullAuthHandler(mem), nfs.ExportOptions{RequireClientCert: true}))
+	if target, err := nfstest.Dial(plain.Addr(), "/", rpc.AuthNull); err == nil {
+		target.Close()
+		t.Fatal("expected the mount of an export requiring a client certificate to be refused without TLS")
+	}
+}
+
+// directoryIDMapper maps the names of a directory of users to their ids.
+type directoryIDMapper struct {
+	nfs.NumericIDMapper
+	ids map[string]uint32
+}
+
+func (m directoryIDMapper) UID(ctx context.Context, name string) (uint32, error) {
+	if id, ok := m.ids[name]; ok {
+		return id, nil
+	}
+	return 0, nfs.ErrUnknownID
+}
+
+func (m directoryIDMapper) GID(ctx context.Context, name string) (uint32, error) {
+	if id, ok := m.ids[name]; ok {
+		return id + 1, nil
+	}
+	return 0, nfs.ErrUnknownID
+}
+
+func TestMapClientCertificates(t *testing.T) {
+	mem := memfs.New()
+	_ = mem.MkdirAll("/home", 0755)
+	fs := &ownerFS{Filesystem: mem, owners: make(map[string][2]int)}
+	ca := newTestCA(t)
+	handler := helpers.NewExportHandler(helpers.NewNullAuthHandler(fs), nfs.ExportOptions{})
+	addr := serveTLS(t, &nfs.Server{
+		Handler:               helpers.NewCachingHandler(handler, 1024),
+		IDMapper:              directoryIDMapper{ids: map[string]uint32{"alice.clients.test": 1234}},
+		MapClientCertificates: true,
+	}, ca)
+
+	// the client asserts root, but is served as the user of its certificate.
+	auth := rpc.NewAuthUnix("client", 0, 0).Auth()
+	tunnel := tlsTunnel(t, addr, &tls.Config{RootCAs: ca.pool, ServerName: "server",
+		Certificates: []tls.Certificate{ca.issue("alice.clients.test", x509.ExtKeyUsageClientAuth)}})
+	target, err := nfstest.Dial(tunnel, "/", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Create("alice", 0666); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	if got := fs.owner("alice"); got != [2]int{1234, 1235} {
+		t.Fatalf("expected the file to be owned by the user of the certificate, got %v", got)
+	}
+
+	// certificates of unknown users are refused rather than trusting what
+	// their clients assert.
+	tunnel = tlsTunnel(t, addr, &tls.Config{RootCAs: ca.pool, ServerName: "server",
+		Certificates: []tls.Certificate{ca.issue("mallory.clients.test", x509.ExtKeyUsageClientAuth)}})
+	if target, err := nfstest.Dial(tunnel, "/", auth); err == nil {
+		target.Close()
+		t.Fatal("expected the mount of a client with an unknown certificate to be refused")
+	}
+
+	// clients without certificates are served as they assert.
+	tunnel = tlsTunnel(t, addr, &tls.Config{RootCAs: ca.pool, ServerName: "server"})
+	target, err = nfstest.Dial(tunnel, "/", rpc.NewAuthUnix("client", 1000, 100).Auth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Create("other", 0666); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	if got := fs.owner("other"); got != [2]int{1000, 100} {
+		t.Fatalf("expected the file to be owned by the asserted user, got %v", got)
+	}
+}
@@ -0,0 +1,132 @@
+package nfs
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTracePayload is the number of bytes of each message a TraceRecorder
+// keeps when no limit is given.
+const DefaultTracePayload = 4096
+
+// TraceRecord is a call decoded by the server, or its reply, as captured by a
+// TraceRecorder.
+type TraceRecord struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Reply  bool      `json:"reply,omitempty"`
+	Xid    uint32    `json:"xid"`
+	// RequestID is the ID of the call, as logs and events name it by.
+	RequestID string `json:"request_id,omitempty"`
+	Prog      uint32 `json:"prog"`
+	Vers      uint32 `json:"vers"`
+	Proc      uint32 `json:"proc"`
+	// Length is the size of the RPC message, and Data its first bytes, from
+	// the xid on. A call which isn't truncated can be replayed by sending Data
+	// in a record of its own.
+	Length int    `json:"length"`
+	Data   []byte `json:"data"`
+}
+
+// Truncated reports whether Data holds only part of the message.
+func (r *TraceRecord) Truncated() bool {
+	return len(r.Data) < r.Length
+}
+
+// TraceRecorder writes each call a server handles, followed by its reply, as
+// a line of JSON encoding a TraceRecord. It is set as Server.Trace.
+type TraceRecorder struct {
+	mu         sync.Mutex
+	enc        *json.Encoder
+	maxPayload int
+}
+
+// NewTraceRecorder records to w, keeping at most maxPayload bytes of each
+// message, or DefaultTracePayload when maxPayload is zero. A negative
+// maxPayload keeps messages whole.
+func NewTraceRecorder(w io.Writer, maxPayload int) *TraceRecorder {
+	if maxPayload == 0 {
+		maxPayload = DefaultTracePayload
+	}
+	return &TraceRecorder{enc: json.NewEncoder(w), maxPayload: maxPayload}
+}
+
+// ReadTrace reads the records written by a TraceRecorder.
+func ReadTrace(r io.Reader) ([]TraceRecord, error) {
+	dec := json.NewDecoder(r)
+	var out []TraceRecord
+	for {
+		var rec TraceRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return out, err
+		}
+		out = append(out, rec)
+	}
+}
+
+// traceBuffer keeps the first bytes written to it, counting the rest.
+type traceBuffer struct {
+	data  []byte
+	limit int
+	n     int
+}
+
+func (b *traceBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.n += n
+	if keep := b.limit - len(b.data); b.limit < 0 || keep > 0 {
+		if b.limit >= 0 && n > keep {
+			p = p[:keep]
+		}
+		b.data = append(b.data, p...)
+	}
+	return n, nil
+}
+
+func (t *TraceRecorder) newBuffer() *traceBuffer {
+	if t == nil {
+		return nil
+	}
+	return &traceBuffer{limit: t.maxPayload}
+}
+
+// record writes the call of w and the reply sent to it.
+func (t *TraceRecorder) record(addr net.Addr, w *response) {
+	if t == nil || w.trace == nil {
+		return
+	}
+	call := TraceRecord{
+		Time:      w.start,
+		Xid:       w.req.xid,
+		RequestID: w.req.id,
+		Prog:      w.req.Header.Prog,
+		Vers:      w.req.Header.Vers,
+		Proc:      w.req.Header.Proc,
+		Length:    w.trace.n,
+		Data:      w.trace.data,
+	}
+	if addr != nil {
+		call.Client = addr.String()
+	}
+	reply := call
+	reply.Time = time.Now()
+	reply.Reply = true
+	out := &traceBuffer{limit: t.maxPayload}
+	_, _ = out.Write(w.writer.Bytes())
+	reply.Length, reply.Data = out.n, out.data
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.enc.Encode(&call); err != nil {
+		Log.Errorf("unable to record trace: %v", err)
+		return
+	}
+	if err := t.enc.Encode(&reply); err != nil {
+		Log.Errorf("unable to record trace: %v", err)
+	}
+}
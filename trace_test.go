@@ -0,0 +1,96 @@
+package nfs_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte{}, s.b.Bytes()...)
+}
+
+func TestTraceRecorder(t *testing.T) {
+	mem := memfs.New()
+	if err := billyutil.WriteFile(mem, "/file", []byte("hello"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var trace syncBuffer
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		Trace:   nfs.NewTraceRecorder(&trace, -1),
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	if _, _, err := target.Lookup("/file"); err != nil {
+		t.Fatal(err)
+	}
+	_ = target.Close()
+
+	records, err := nfs.ReadTrace(bytes.NewReader(trace.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) < 4 || len(records)%2 != 0 {
+		t.Fatalf("expected calls and their replies, got %d records", len(records))
+	}
+	for i, rec := range records {
+		if rec.Reply != (i%2 == 1) || rec.Truncated() || rec.Xid != records[i&^1].Xid {
+			t.Fatalf("unexpected record %d: %+v", i, rec)
+		}
+	}
+	if records[0].Prog != nfsc.MountProg || records[0].Proc != uint32(nfs.MountProcMount) {
+		t.Fatalf("expected the trace to start with MNT, got %+v", records[0])
+	}
+
+	replies, err := nfstest.Replay(srv.Addr(), bytes.NewReader(trace.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != len(records)/2 {
+		t.Fatalf("expected a reply to each replayed call, got %d", len(replies))
+	}
+	for i, reply := range replies {
+		if !bytes.Equal(reply.Data, records[2*i+1].Data) {
+			t.Fatalf("expected replaying call %d to get the recorded reply", i)
+		}
+	}
+
+	// messages beyond the payload limit are truncated.
+	var short bytes.Buffer
+	srv2 := nfstest.Start(t, &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		Trace:   nfs.NewTraceRecorder(&short, 16),
+	})
+	if _, err := nfstest.Replay(srv2.Addr(), bytes.NewReader(trace.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	records, err = nfs.ReadTrace(&short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || len(records[0].Data) != 16 || !records[0].Truncated() {
+		t.Fatalf("expected truncated records, got %+v", records)
+	}
+}
@@ -0,0 +1,106 @@
+package nfs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// initVerifier chooses a random write verifier when the server was given
+// none.
+func (s *Server) initVerifier() {
+	s.verifierMu.Lock()
+	defer s.verifierMu.Unlock()
+	if s.ID == ([8]byte{}) {
+		if _, err := rand.Read(s.ID[:]); err != nil {
+			Log.Errorf("unable to choose a write verifier: %v", err)
+		}
+	}
+}
+
+// WriteVerifier provides the write verifier returned from WRITE and COMMIT.
+func (s *Server) WriteVerifier() [8]byte {
+	s.init()
+	s.verifierMu.RLock()
+	defer s.verifierMu.RUnlock()
+	return s.ID
+}
+
+// SetWriteVerifier replaces the write verifier, as for a standby taking over
+// from a server whose acknowledged writes it is known to hold.
+//
+// Clients compare the verifier of each WRITE and COMMIT reply with that of
+// the WRITEs they sent UNSTABLE: when it differs, they resend every write
+// they have not seen committed under the new verifier. Keeping the verifier
+// across a failover is therefore only safe when none of those writes can
+// have been lost; otherwise a change of verifier is what recovers them.
+func (s *Server) SetWriteVerifier(verifier [8]byte) {
+	s.init()
+	s.verifierMu.Lock()
+	defer s.verifierMu.Unlock()
+	s.ID = verifier
+}
+
+// RotateWriteVerifier replaces the write verifier with a random one, which
+// has clients resend their uncommitted writes, as after data held for
+// COMMIT may have been lost. It provides the new verifier.
+func (s *Server) RotateWriteVerifier() ([8]byte, error) {
+	var verifier [8]byte
+	if _, err := rand.Read(verifier[:]); err != nil {
+		return verifier, err
+	}
+	s.SetWriteVerifier(verifier)
+	return verifier, nil
+}
+
+// writeVerifier is the write verifier for a reply.
+func (s *Server) writeVerifier() [8]byte {
+	s.verifierMu.RLock()
+	defer s.verifierMu.RUnlock()
+	return s.ID
+}
+
+// BootVerifier provides the NFSv4 boot verifier, which the clientids and
+// stateids issued by the server carry. It is zero when NFSv4 is disabled.
+func (s *Server) BootVerifier() uint32 {
+	s.init()
+	if s.nfs4State == nil {
+		return 0
+	}
+	s.nfs4State.mu.Lock()
+	defer s.nfs4State.mu.Unlock()
+	return s.nfs4State.boot
+}
+
+// RotateBootVerifier replaces the NFSv4 boot verifier with a random one, as
+// if the server had restarted. Clients see NFS4ERR_STALE_CLIENTID and
+// NFS4ERR_STALE_STATEID for what they were issued before, establish
+// themselves again, and reclaim their state during a new grace period. It
+// provides the new verifier, which is zero when NFSv4 is disabled.
+func (s *Server) RotateBootVerifier() (uint32, error) {
+	s.init()
+	if s.nfs4State == nil {
+		return 0, nil
+	}
+	var boot [4]byte
+	if _, err := rand.Read(boot[:]); err != nil {
+		return 0, err
+	}
+	m := s.nfs4State
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restart(binary.BigEndian.Uint32(boot[:]))
+	return m.boot, nil
+}
+
+// restart takes on a new boot verifier, dropping the clients and their state
+// while leaving the confirmed clients to reclaim it, with m.mu held.
+func (m *nfs4StateManager) restart(boot uint32) {
+	for _, c := range m.clients {
+		m.reclaimable[string(c.ID)] = true
+	}
+	m.clients = make(map[uint64]*nfs4Client)
+	m.unconfirmed = make(map[uint64]*nfs4Client)
+	m.boot = boot
+	m.start = time.Now()
+}
@@ -0,0 +1,70 @@
+package nfs_test
+
+import (
+	"io"
+	"testing"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"github.com/willscott/go-nfs/helpers/memfs"
+	"github.com/willscott/go-nfs/nfstest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestVerifiers(t *testing.T) {
+	mem := memfs.New()
+	_ = billyutil.WriteFile(mem, "/f", []byte("x"), 0644)
+	id := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	srv := nfstest.Start(t, &nfs.Server{
+		Handler:          helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		ID:               id,
+		EnableNFSv4:      true,
+		NFS4BootVerifier: 7,
+	})
+	target := srv.Mount(t, "/", rpc.AuthNull)
+	_, fh, err := target.Lookup("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// commitVerifier reads the verifier ending a COMMIT reply.
+	commitVerifier := func() [8]byte {
+		res, err := target.Call(&struct {
+			rpc.Header
+			Handle []byte
+			Offset uint64
+			Count  uint32
+		}{
+			Header: rpc.Header{Rpcvers: 2, Prog: nfsc.Nfs3Prog, Vers: nfsc.Nfs3Vers, Proc: uint32(nfs.NFSProcedureCommit), Cred: rpc.AuthNull, Verf: rpc.AuthNull},
+			Handle: fh,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res)
+		var v [8]byte
+		copy(v[:], b[len(b)-8:])
+		return v
+	}
+
+	if srv.WriteVerifier() != id || commitVerifier() != id {
+		t.Fatalf("expected the configured write verifier %v", id)
+	}
+	rotated, err := srv.RotateWriteVerifier()
+	if err != nil || rotated == id || srv.WriteVerifier() != rotated || commitVerifier() != rotated {
+		t.Fatalf("expected COMMIT to return the rotated verifier %v: %v", rotated, err)
+	}
+	srv.SetWriteVerifier(id)
+	if commitVerifier() != id {
+		t.Fatal("expected COMMIT to return the verifier set")
+	}
+
+	if srv.BootVerifier() != 7 {
+		t.Fatalf("expected the configured boot verifier, got %d", srv.BootVerifier())
+	}
+	if boot, err := srv.RotateBootVerifier(); err != nil || boot == 7 || srv.BootVerifier() != boot {
+		t.Fatalf("expected a new boot verifier, got %d: %v", boot, err)
+	}
+}